@@ -0,0 +1,212 @@
+// Copyright 2017, Square, Inc.
+
+// Package idgen generates unique IDs that sort chronologically, like request
+// IDs and job try IDs. IDs made later sort after IDs made earlier, as strings,
+// so they can be used as storage keys and to order log lines across hosts.
+package idgen
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownType is returned by New for an unknown generator type.
+	ErrUnknownType = errors.New("unknown ID generator type")
+
+	// ErrInvalidNode is returned by NewSnowflake if the node ID is too large.
+	ErrInvalidNode = errors.New("snowflake node ID must be less than 1024")
+
+	// ErrClockBackwards is returned by a snowflake generator if the clock
+	// moved backwards, which could make duplicate IDs.
+	ErrClockBackwards = errors.New("clock moved backwards")
+)
+
+// Generator types for New.
+const (
+	ULID      = "ulid"
+	KSUID     = "ksuid"
+	SNOWFLAKE = "snowflake"
+)
+
+// now is time.Now, changed by tests.
+var now = time.Now
+
+// A Generator generates unique IDs. It is safe to use from multiple goroutines.
+type Generator interface {
+	// UID returns a new unique ID.
+	UID() (string, error)
+}
+
+// New returns a Generator of the given type: ULID, KSUID, or SNOWFLAKE. The
+// node ID is only used by SNOWFLAKE, and it must be unique per host.
+func New(genType string, node uint) (Generator, error) {
+	switch genType {
+	case ULID:
+		return NewULID(), nil
+	case KSUID:
+		return NewKSUID(), nil
+	case SNOWFLAKE:
+		return NewSnowflake(node)
+	}
+	return nil, fmt.Errorf("%s: %s", ErrUnknownType, genType)
+}
+
+// -------------------------------------------------------------------------- //
+
+// crockford is the Crockford base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulid generates ULIDs: 26 characters, a 48-bit millisecond timestamp then 80
+// random bits. IDs made in the same millisecond increment the random bits so
+// they still sort in the order they were made.
+type ulid struct {
+	lastMs   uint64
+	lastRand [10]byte
+	// --
+	*sync.Mutex // guards all fields
+}
+
+// NewULID returns a Generator that makes ULIDs (https://github.com/ulid/spec).
+func NewULID() Generator {
+	return &ulid{Mutex: &sync.Mutex{}}
+}
+
+func (g *ulid) UID() (string, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	ms := uint64(now().UnixNano() / int64(time.Millisecond))
+	// In the same millisecond, the incremented random bits sort after the
+	// last ID. They only overflow after 2^80 IDs, so never in practice.
+	if ms != g.lastMs || !increment(g.lastRand[:]) {
+		if _, err := rand.Read(g.lastRand[:]); err != nil {
+			return "", err
+		}
+		g.lastMs = ms
+	}
+
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(g.lastMs >> uint(40-8*i))
+	}
+	copy(b[6:], g.lastRand[:])
+
+	// 128 bits is 26 base32 characters, the first only has 3 bits.
+	n := new(big.Int).SetBytes(b[:])
+	id := make([]byte, 26)
+	mask := big.NewInt(31)
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(id), nil
+}
+
+// increment adds one to b as a big-endian number. It returns false if b
+// overflowed.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------------------------------------------------------------- //
+
+// base62 is the alphabet used by KSUIDs.
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ksuidEpoch is the KSUID epoch (2014-05-13 16:53:20 UTC) in Unix seconds.
+const ksuidEpoch = 1400000000
+
+// ksuid generates KSUIDs: 27 characters, a 32-bit second timestamp then 128
+// random bits. IDs made in the same second are unique but not ordered.
+type ksuid struct{}
+
+// NewKSUID returns a Generator that makes KSUIDs (https://github.com/segmentio/ksuid).
+func NewKSUID() Generator {
+	return ksuid{}
+}
+
+func (g ksuid) UID() (string, error) {
+	var b [20]byte
+	ts := uint32(now().Unix() - ksuidEpoch)
+	b[0], b[1], b[2], b[3] = byte(ts>>24), byte(ts>>16), byte(ts>>8), byte(ts)
+	if _, err := rand.Read(b[4:]); err != nil {
+		return "", err
+	}
+
+	// 160 bits is at most 27 base62 characters, left-padded with zeros.
+	n := new(big.Int).SetBytes(b[:])
+	base := big.NewInt(62)
+	mod := new(big.Int)
+	id := []byte("000000000000000000000000000")
+	for i := 26; n.Sign() > 0; i-- {
+		n.DivMod(n, base, mod)
+		id[i] = base62[mod.Int64()]
+	}
+	return string(id), nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// snowflakeEpoch is the snowflake epoch (2017-01-01 00:00:00 UTC) in Unix
+// milliseconds.
+const snowflakeEpoch = 1483228800000
+
+// snowflake generates snowflake IDs: a 64-bit number made of a 41-bit
+// millisecond timestamp, a 10-bit node ID, and a 12-bit sequence number.
+// Unlike ULIDs and KSUIDs, they're only unique if every host has its own node.
+type snowflake struct {
+	node   uint64
+	lastMs uint64
+	seq    uint64
+	// --
+	*sync.Mutex // guards lastMs and seq
+}
+
+// NewSnowflake returns a Generator that makes snowflake IDs for the given node
+// (0-1023). IDs are 19 decimal digits, zero-padded so they sort as strings.
+func NewSnowflake(node uint) (Generator, error) {
+	if node >= 1<<10 {
+		return nil, ErrInvalidNode
+	}
+	return &snowflake{node: uint64(node), Mutex: &sync.Mutex{}}, nil
+}
+
+func (g *snowflake) UID() (string, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	ms := g.ms()
+	if ms < g.lastMs {
+		return "", ErrClockBackwards
+	}
+	if ms == g.lastMs {
+		g.seq = (g.seq + 1) & 0xFFF
+		if g.seq == 0 {
+			// 4096 IDs this millisecond, wait for the next one.
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = g.ms()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+
+	return fmt.Sprintf("%019d", ms<<22|g.node<<12|g.seq), nil
+}
+
+func (g *snowflake) ms() uint64 {
+	return uint64(now().UnixNano()/int64(time.Millisecond) - snowflakeEpoch)
+}
@@ -0,0 +1,111 @@
+// Copyright 2017, Square, Inc.
+
+package idgen
+
+import (
+	"testing"
+	"time"
+)
+
+// IDs made one after another are unique, fixed length, and sort in the order
+// they were made, even when many are made in the same millisecond.
+func TestUIDSorted(t *testing.T) {
+	snowflake, err := NewSnowflake(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gens := []struct {
+		name string
+		gen  Generator
+		len  int
+		tick time.Duration // how often the clock advances, KSUIDs only sort by second
+	}{
+		{ULID, NewULID(), 26, 0},
+		{KSUID, NewKSUID(), 27, time.Second},
+		{SNOWFLAKE, snowflake, 19, 0},
+	}
+
+	defer func() { now = time.Now }()
+	for _, g := range gens {
+		clock := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+		now = func() time.Time { return clock }
+
+		seen := map[string]bool{}
+		last := ""
+		for i := 0; i < 1000; i++ {
+			if i%100 == 0 {
+				clock = clock.Add(time.Millisecond + g.tick)
+			}
+			id, err := g.gen.UID()
+			if err != nil {
+				t.Fatalf("%s: err = %s, expected nil", g.name, err)
+			}
+			if len(id) != g.len {
+				t.Errorf("%s: id %s is %d characters, expected %d", g.name, id, len(id), g.len)
+			}
+			if seen[id] {
+				t.Fatalf("%s: id %s made twice", g.name, id)
+			}
+			seen[id] = true
+			if g.tick == 0 && id <= last {
+				t.Fatalf("%s: id %s made after %s sorts before it", g.name, id, last)
+			}
+			if g.tick > 0 && i%100 == 0 && id <= last {
+				t.Fatalf("%s: id %s made a tick after %s sorts before it", g.name, id, last)
+			}
+			last = id
+		}
+	}
+}
+
+func TestULIDKnownTime(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1469918176, 385000000) } // 0x01563E3AB5D1 ms
+
+	id, err := NewULID().UID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id[:10] != "01ARYZ6S41" {
+		t.Errorf("timestamp = %s, expected 01ARYZ6S41", id[:10])
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	if _, err := NewSnowflake(1024); err != ErrInvalidNode {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidNode)
+	}
+
+	defer func() { now = time.Now }()
+	clock := time.Unix(snowflakeEpoch/1000+60, 0)
+	now = func() time.Time { return clock }
+
+	g, err := NewSnowflake(1023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := g.UID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "0000000251662430208" // 60000 ms << 22 | 1023 << 12
+	if id != expect {
+		t.Errorf("id = %s, expected %s", id, expect)
+	}
+
+	clock = clock.Add(-time.Millisecond)
+	if _, err := g.UID(); err != ErrClockBackwards {
+		t.Errorf("err = %v, expected %s", err, ErrClockBackwards)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, genType := range []string{ULID, KSUID, SNOWFLAKE} {
+		if _, err := New(genType, 1); err != nil {
+			t.Errorf("%s: err = %s, expected nil", genType, err)
+		}
+	}
+	if _, err := New("uuid", 1); err == nil {
+		t.Error("err = nil, expected an error for an unknown type")
+	}
+}
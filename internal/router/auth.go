@@ -0,0 +1,182 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrInvalidCredentials is returned by an Authenticator when the request
+	// has credentials but they are not valid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrAccessDenied is returned by an Authorizer when the caller is not
+	// allowed to call the route.
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrImpersonationDenied is returned by an Impersonator when the caller is
+	// not allowed to act on behalf of the operator.
+	ErrImpersonationDenied = errors.New("not allowed to act on behalf of other users")
+)
+
+// ON_BEHALF_OF_HEADER is the request header of a caller, like an automation
+// account for chatops or a portal, acting on behalf of a human operator:
+//
+//	Spincycle-On-Behalf-Of: finch
+const ON_BEHALF_OF_HEADER = "Spincycle-On-Behalf-Of"
+
+// Caller is the identity of the client that made a request. The zero value is
+// an anonymous caller (the request had no credentials).
+type Caller struct {
+	Name  string   // user or service name, empty if anonymous
+	Roles []string // roles or groups the caller belongs to
+
+	// OnBehalfOf is the operator the caller acts for, from the
+	// Spincycle-On-Behalf-Of header, once the Impersonator allowed it. Empty
+	// if the caller acts for itself.
+	OnBehalfOf string
+}
+
+// Anonymous returns true if the request had no credentials.
+func (c Caller) Anonymous() bool {
+	return c.Name == ""
+}
+
+// User returns the operator the caller acts for, if any, else the caller's
+// name. It's who a request is for, like who to notify or ask for approval.
+func (c Caller) User() string {
+	if c.OnBehalfOf != "" {
+		return c.OnBehalfOf
+	}
+	return c.Name
+}
+
+// HasRole returns true if the caller has the given role.
+func (c Caller) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// An Authenticator determines who made a request. If the request has no
+// credentials, it should return an anonymous Caller and a nil error so that
+// the Authorizer can decide if anonymous callers are allowed. If the request
+// has credentials that aren't valid, it should return an error, and the
+// router responds 401 Unauthorized.
+type Authenticator interface {
+	Authenticate(*http.Request) (Caller, error)
+}
+
+// An Authorizer determines if a caller is allowed to call a route, identified
+// by the name given to Router.AddRoute. If it returns an error, the router
+// responds 401 Unauthorized for anonymous callers, else 403 Forbidden.
+type Authorizer interface {
+	Authorize(caller Caller, route string, req *http.Request) error
+}
+
+// An Impersonator determines if a caller is allowed to act on behalf of an
+// operator, given in the Spincycle-On-Behalf-Of header. It's called after the
+// caller is authenticated and before the Authorizer, which is given the
+// caller with OnBehalfOf set. If it returns an error, the router responds 403
+// Forbidden.
+type Impersonator interface {
+	Impersonate(caller Caller, operator string, req *http.Request) error
+}
+
+// --------------------------------------------------------------------------
+
+// TokenAuthenticator authenticates API tokens sent in the Authorization header
+// like "Authorization: Bearer <token>". It maps tokens to callers.
+type TokenAuthenticator map[string]Caller
+
+func (a TokenAuthenticator) Authenticate(req *http.Request) (Caller, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return Caller{}, nil
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return Caller{}, ErrInvalidCredentials
+	}
+	caller, ok := a[strings.TrimPrefix(auth, prefix)]
+	if !ok {
+		return Caller{}, ErrInvalidCredentials
+	}
+	return caller, nil
+}
+
+// CertAuthenticator authenticates TLS client certificates (mTLS). The caller
+// name is the common name of the certificate subject, and the caller roles are
+// the organizational units. The certificate must already be verified by the
+// TLS server (tls.Config.ClientAuth >= tls.VerifyClientCertIfGiven).
+type CertAuthenticator struct{}
+
+func (a CertAuthenticator) Authenticate(req *http.Request) (Caller, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return Caller{}, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return Caller{}, ErrInvalidCredentials
+	}
+	return Caller{
+		Name:  cert.Subject.CommonName,
+		Roles: cert.Subject.OrganizationalUnit,
+	}, nil
+}
+
+// MultiAuthenticator tries each Authenticator in order and returns the first
+// non-anonymous caller or the first error.
+type MultiAuthenticator []Authenticator
+
+func (a MultiAuthenticator) Authenticate(req *http.Request) (Caller, error) {
+	for _, auth := range a {
+		caller, err := auth.Authenticate(req)
+		if err != nil || !caller.Anonymous() {
+			return caller, err
+		}
+	}
+	return Caller{}, nil
+}
+
+// RoleAuthorizer maps route names to the roles allowed to call them. A caller
+// must have at least one of the roles. A route name prefixed with a method,
+// like "DELETE api-job-chain", maps the roles of only that method of the route,
+// and takes precedence over the route name alone. Routes not in the map can be
+// called by anyone, including anonymous callers.
+type RoleAuthorizer map[string][]string
+
+func (a RoleAuthorizer) Authorize(caller Caller, route string, req *http.Request) error {
+	roles, ok := a[req.Method+" "+route]
+	if !ok {
+		roles, ok = a[route]
+	}
+	if !ok {
+		return nil
+	}
+	for _, role := range roles {
+		if caller.HasRole(role) {
+			return nil
+		}
+	}
+	return ErrAccessDenied
+}
+
+// RoleImpersonator allows callers with one of the roles, like automation
+// accounts, to act on behalf of any operator.
+type RoleImpersonator []string
+
+func (a RoleImpersonator) Impersonate(caller Caller, operator string, req *http.Request) error {
+	for _, role := range a {
+		if caller.HasRole(role) {
+			return nil
+		}
+	}
+	return ErrImpersonationDenied
+}
@@ -0,0 +1,183 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	r := &Router{
+		Authenticator: TokenAuthenticator{
+			"admin-token": {Name: "alice", Roles: []string{"admin"}},
+			"user-token":  {Name: "bob", Roles: []string{"user"}},
+		},
+		Authorizer: RoleAuthorizer{
+			"stop": {"admin"},
+		},
+	}
+	var caller Caller
+	handler := func(ctx HTTPContext) { caller = ctx.Caller }
+	r.AddRoute("/stop", handler, "stop")
+	r.AddRoute("/status", handler, "status")
+
+	tests := []struct {
+		path   string
+		token  string
+		status int
+		caller Caller
+	}{
+		{"/status", "", http.StatusOK, Caller{}},
+		{"/status", "user-token", http.StatusOK, Caller{Name: "bob", Roles: []string{"user"}}},
+		{"/status", "bad-token", http.StatusUnauthorized, Caller{}},
+		{"/stop", "", http.StatusUnauthorized, Caller{}},
+		{"/stop", "user-token", http.StatusForbidden, Caller{}},
+		{"/stop", "admin-token", http.StatusOK, Caller{Name: "alice", Roles: []string{"admin"}}},
+	}
+
+	for _, test := range tests {
+		caller = Caller{}
+		req := httptest.NewRequest("PUT", test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s with token %q: status = %d, expected %d", test.path, test.token, rw.Code, test.status)
+		}
+		if !reflect.DeepEqual(caller, test.caller) {
+			t.Errorf("%s with token %q: caller = %+v, expected %+v", test.path, test.token, caller, test.caller)
+		}
+	}
+}
+
+func TestRoleAuthorizerMethod(t *testing.T) {
+	a := RoleAuthorizer{
+		"DELETE chain": {"operator"},
+		"stop":         {"admin"},
+		"PUT stop":     {"operator"},
+	}
+	operator := Caller{Name: "bob", Roles: []string{"operator"}}
+	tests := []struct {
+		method, route string
+		caller        Caller
+		err           error
+	}{
+		{"GET", "chain", Caller{}, nil},
+		{"DELETE", "chain", Caller{}, ErrAccessDenied},
+		{"DELETE", "chain", operator, nil},
+		{"PUT", "stop", operator, nil}, // method takes precedence
+		{"POST", "stop", operator, ErrAccessDenied},
+	}
+	for _, test := range tests {
+		err := a.Authorize(test.caller, test.route, httptest.NewRequest(test.method, "/", nil))
+		if err != test.err {
+			t.Errorf("%s %s by %+v: err = %v, expected %v", test.method, test.route, test.caller, err, test.err)
+		}
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	r := &Router{
+		Authenticator: TokenAuthenticator{
+			"bot-token":  {Name: "chatops", Roles: []string{"automation", "admin"}},
+			"user-token": {Name: "bob", Roles: []string{"user"}},
+		},
+		Authorizer: RoleAuthorizer{
+			"stop": {"admin"},
+		},
+	}
+	var caller Caller
+	r.AddRoute("/stop", func(ctx HTTPContext) { caller = ctx.Caller }, "stop")
+
+	type test struct {
+		token      string
+		onBehalfOf string
+		status     int
+		user       string
+	}
+	run := func(tests []test) {
+		for _, test := range tests {
+			caller = Caller{}
+			req := httptest.NewRequest("PUT", "/stop", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			if test.onBehalfOf != "" {
+				req.Header.Set(ON_BEHALF_OF_HEADER, test.onBehalfOf)
+			}
+			rw := httptest.NewRecorder()
+			r.ServeHTTP(rw, req)
+
+			if rw.Code != test.status {
+				t.Errorf("token %q on behalf of %q: status = %d, expected %d", test.token, test.onBehalfOf, rw.Code, test.status)
+			}
+			if caller.User() != test.user {
+				t.Errorf("token %q on behalf of %q: user = %q, expected %q", test.token, test.onBehalfOf, caller.User(), test.user)
+			}
+		}
+	}
+
+	// Without an Impersonator, nobody can act on behalf of others
+	run([]test{
+		{"bot-token", "", http.StatusOK, "chatops"},
+		{"bot-token", "finch", http.StatusForbidden, ""},
+		{"", "finch", http.StatusUnauthorized, ""},
+	})
+
+	r.Impersonator = RoleImpersonator{"automation"}
+	run([]test{
+		{"bot-token", "finch", http.StatusOK, "finch"},
+		{"user-token", "finch", http.StatusForbidden, ""}, // not automation
+		{"", "finch", http.StatusUnauthorized, ""},
+	})
+
+	// Both identities reach the handler
+	req := httptest.NewRequest("PUT", "/stop", nil)
+	req.Header.Set("Authorization", "Bearer bot-token")
+	req.Header.Set(ON_BEHALF_OF_HEADER, "finch")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if caller.Name != "chatops" || caller.OnBehalfOf != "finch" {
+		t.Errorf("caller = %+v, expected chatops on behalf of finch", caller)
+	}
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	req := httptest.NewRequest("GET", "/status", nil)
+
+	// No client cert.
+	caller, err := CertAuthenticator{}.Authenticate(req)
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if !caller.Anonymous() {
+		t.Errorf("caller = %+v, expected anonymous", caller)
+	}
+
+	// Verified client cert.
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "request-manager",
+			OrganizationalUnit: []string{"spincycle"},
+		},
+	}
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{cert}},
+	}
+	caller, err = CertAuthenticator{}.Authenticate(req)
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	expectedCaller := Caller{Name: "request-manager", Roles: []string{"spincycle"}}
+	if !reflect.DeepEqual(caller, expectedCaller) {
+		t.Errorf("caller = %+v, expected %+v", caller, expectedCaller)
+	}
+}
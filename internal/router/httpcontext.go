@@ -7,14 +7,21 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/square/spincycle/proto"
+
 	log "github.com/Sirupsen/logrus"
 )
 
 // HTTPContext is an object that is passed around during the handling of the request.
+// Request.Context() is done when the client goes away or the server cancels its
+// requests, so handlers pass it to work that should stop then, like computing
+// a status or waiting for something.
 type HTTPContext struct {
 	Response  http.ResponseWriter // HTTP Response object.
 	Request   *http.Request       // HTTP Request object.
 	Arguments []string            // Arguments matched by the wildcard portions ({}) in the URL pattern.
+	Caller    Caller              // Who made the request, set by the router's Authenticator.
+	Version   string              // API version that serves the request, like "v1", if the router has Versions.
 	router    *Router
 }
 
@@ -33,8 +40,15 @@ func (ctx HTTPContext) WriteJSON(v interface{}) error {
 	return nil
 }
 
-// APIError writes a custom error message in the JSON format.
+// APIError writes an API error of the type as a proto.Error in JSON, with the
+// generic code of the type, like proto.ERR_NOT_FOUND for ErrNotFound.
 func (ctx HTTPContext) APIError(errorType, message string, messageArgs ...interface{}) {
+	ctx.APIErrorCode(errorType, errorTypeCodes[errorType], message, messageArgs...)
+}
+
+// APIErrorCode writes an API error like APIError with a specific code, like
+// proto.ERR_CHAIN_NOT_FOUND, for clients to switch on.
+func (ctx HTTPContext) APIErrorCode(errorType, code, message string, messageArgs ...interface{}) {
 	ctx.Response.Header().Set("Content-Type", "application/json")
 
 	errorCode, ok := errorCodes[errorType]
@@ -42,10 +56,11 @@ func (ctx HTTPContext) APIError(errorType, message string, messageArgs ...interf
 		log.Errorf("Unknown error type: %v", errorType)
 		errorType = ErrInternal
 		errorCode = http.StatusInternalServerError
+		code = proto.ERR_INTERNAL
 	}
 	formatted := fmt.Sprintf(message, messageArgs...)
 	ctx.Response.WriteHeader(errorCode)
-	ctx.WriteJSON(ErrorResponse{formatted, errorType})
+	ctx.WriteJSON(proto.Error{Code: code, Type: errorType, Message: formatted})
 }
 
 // UnsupportedAPIMethod writes an error message regarding unsupported HTTP method.
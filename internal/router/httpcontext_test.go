@@ -0,0 +1,52 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/square/spincycle/proto"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		write  func(HTTPContext)
+		status int
+		expect proto.Error
+	}{
+		{
+			func(ctx HTTPContext) { ctx.APIError(ErrNotFound, "No %s.", "chain") },
+			http.StatusNotFound,
+			proto.Error{Code: proto.ERR_NOT_FOUND, Type: ErrNotFound, Message: "No chain."},
+		},
+		{
+			func(ctx HTTPContext) {
+				ctx.APIErrorCode(ErrConflict, proto.ERR_CHAIN_ALREADY_STARTED, "Chain is RUNNING.")
+			},
+			http.StatusConflict,
+			proto.Error{Code: proto.ERR_CHAIN_ALREADY_STARTED, Type: ErrConflict, Message: "Chain is RUNNING."},
+		},
+		{
+			func(ctx HTTPContext) { ctx.APIErrorCode("bogus", proto.ERR_CHAIN_NOT_FOUND, "Oops.") },
+			http.StatusInternalServerError,
+			proto.Error{Code: proto.ERR_INTERNAL, Type: ErrInternal, Message: "Oops."},
+		},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		test.write(HTTPContext{Response: rw, Request: httptest.NewRequest("GET", "/", nil)})
+		if rw.Code != test.status {
+			t.Errorf("status = %d, expected %d", rw.Code, test.status)
+		}
+		var got proto.Error
+		if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.expect {
+			t.Errorf("error = %+v, expected %+v", got, test.expect)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RateLimiter determines if a request is allowed by rate limits. If not, it
+// returns how long the client should wait before retrying, and the router
+// responds 429 Too Many Requests with a Retry-After header. It's called after
+// authentication, so the caller is known.
+type RateLimiter interface {
+	Allow(caller Caller, route string, req *http.Request) (bool, time.Duration)
+}
+
+// A Rate is a token bucket rate: PerSecond requests per second on average,
+// with bursts of up to Burst requests. A zero PerSecond is no limit.
+type Rate struct {
+	PerSecond float64
+	Burst     uint // min 1
+}
+
+// ParseRates parses rates like "api-new-job-chain=5:10,api-start-job-chain=2"
+// into route name => Rate. The burst after the colon is optional; the default
+// burst is the rate rounded up.
+func ParseRates(s string) (map[string]Rate, error) {
+	rates := map[string]Rate{}
+	if s == "" {
+		return rates, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid rate %q, expected route=rate[:burst]", kv)
+		}
+		rate, err := ParseRate(p[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate for %s: %s", p[0], err)
+		}
+		rates[p[0]] = rate
+	}
+	return rates, nil
+}
+
+// ParseRate parses a rate like "5" or "5:10" (5 requests/second, burst 10).
+func ParseRate(s string) (Rate, error) {
+	p := strings.SplitN(s, ":", 2)
+	perSecond, err := strconv.ParseFloat(p[0], 64)
+	if err != nil || perSecond < 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	burst := uint(math.Ceil(perSecond))
+	if len(p) == 2 {
+		b, err := strconv.ParseUint(p[1], 10, 32)
+		if err != nil {
+			return Rate{}, fmt.Errorf("invalid burst %q", s)
+		}
+		burst = uint(b)
+	}
+	return Rate{PerSecond: perSecond, Burst: burst}, nil
+}
+
+// --------------------------------------------------------------------------
+
+// now is time.Now, changed by tests.
+var now = time.Now
+
+// maxBuckets is how many token buckets a TokenBucketLimiter keeps before it
+// forgets the ones that are full (i.e. clients that haven't called lately).
+const maxBuckets = 10000
+
+// TokenBucketLimiter is a RateLimiter with a token bucket per route (all
+// clients) and per client per route. A client is the caller name if the
+// request is authenticated, else the remote IP address.
+type TokenBucketLimiter struct {
+	Routes       map[string]Rate // route name => max rate of all clients
+	PerClient    Rate            // max rate of each client on each route
+	ClientRoutes map[string]Rate // route name => max rate of each client, overrides PerClient
+	// --
+	buckets     map[string]*bucket // route or client+route => bucket
+	*sync.Mutex                    // guards buckets
+}
+
+// NewTokenBucketLimiter returns a TokenBucketLimiter with no limits.
+func NewTokenBucketLimiter() *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		Routes:       map[string]Rate{},
+		ClientRoutes: map[string]Rate{},
+		buckets:      map[string]*bucket{},
+		Mutex:        &sync.Mutex{},
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(caller Caller, route string, req *http.Request) (bool, time.Duration) {
+	client := caller.Name
+	if client == "" {
+		client, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	clientRate, ok := l.ClientRoutes[route]
+	if !ok {
+		clientRate = l.PerClient
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	t := now()
+
+	// A request takes a token from both buckets, so it's only allowed if both
+	// have one
+	buckets := []*bucket{}
+	if rate := l.Routes[route]; rate.PerSecond > 0 {
+		buckets = append(buckets, l.bucket("route "+route, rate, t))
+	}
+	if clientRate.PerSecond > 0 {
+		buckets = append(buckets, l.bucket("client "+client+" "+route, clientRate, t))
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// bucket returns the bucket for a key, filled up to time t. The caller must
+// hold the lock.
+func (l *TokenBucketLimiter) bucket(key string, rate Rate, t time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			for k, old := range l.buckets {
+				if old.fill(t); old.full() {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		b = &bucket{rate: rate, last: t}
+		b.tokens = b.capacity()
+		l.buckets[key] = b
+	}
+	b.rate = rate
+	b.fill(t)
+	return b
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) capacity() float64 {
+	if b.rate.Burst < 1 {
+		return 1
+	}
+	return float64(b.rate.Burst)
+}
+
+// fill adds the tokens earned since the last fill, up to the capacity.
+func (b *bucket) fill(t time.Time) {
+	if t.After(b.last) {
+		b.tokens = math.Min(b.capacity(), b.tokens+t.Sub(b.last).Seconds()*b.rate.PerSecond)
+		b.last = t
+	}
+}
+
+func (b *bucket) full() bool {
+	return b.tokens >= b.capacity()
+}
+
+// wait returns how long until the bucket has a token, 0 if it has one now.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
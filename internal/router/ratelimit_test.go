@@ -0,0 +1,96 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	defer func() { now = time.Now }()
+	t0 := time.Now()
+	now = func() time.Time { return t0 }
+
+	l := NewTokenBucketLimiter()
+	l.Routes["new"] = Rate{PerSecond: 1, Burst: 3}
+	l.PerClient = Rate{PerSecond: 1, Burst: 2}
+	l.ClientRoutes["status"] = Rate{PerSecond: 10, Burst: 10}
+	r := &Router{
+		Authenticator: TokenAuthenticator{"rm-token": {Name: "rm"}},
+		RateLimiter:   l,
+	}
+	handler := func(ctx HTTPContext) {}
+	r.AddRoute("/new", handler, "new")
+	r.AddRoute("/status", handler, "status")
+
+	send := func(path, token, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = addr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Each client has a burst of 2 on /new, and all clients 3
+	tests := []struct {
+		token  string
+		addr   string
+		status int
+	}{
+		{"rm-token", "10.0.0.1:1000", http.StatusOK},
+		{"rm-token", "10.0.0.2:1000", http.StatusOK}, // same caller, different address
+		{"rm-token", "10.0.0.1:1000", http.StatusTooManyRequests},
+		{"", "10.0.0.3:1000", http.StatusOK},
+		{"", "10.0.0.4:1000", http.StatusTooManyRequests}, // route limit
+	}
+	for i, test := range tests {
+		rw := send("/new", test.token, test.addr)
+		if rw.Code != test.status {
+			t.Errorf("request %d: status = %d, expected %d", i, rw.Code, test.status)
+		}
+	}
+
+	rw := send("/new", "rm-token", "10.0.0.1:1000")
+	if rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, expected 1", rw.Header().Get("Retry-After"))
+	}
+
+	// Other routes have their own buckets
+	for i := 0; i < 10; i++ {
+		if rw := send("/status", "rm-token", "10.0.0.1:1000"); rw.Code != http.StatusOK {
+			t.Fatalf("status request %d: status = %d, expected 200", i, rw.Code)
+		}
+	}
+
+	// Tokens are added over time
+	now = func() time.Time { return t0.Add(1 * time.Second) }
+	if rw := send("/new", "rm-token", "10.0.0.1:1000"); rw.Code != http.StatusOK {
+		t.Errorf("status = %d after waiting, expected 200", rw.Code)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates("api-new-job-chain=5:10,api-start-job-chain=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]Rate{
+		"api-new-job-chain":   {PerSecond: 5, Burst: 10},
+		"api-start-job-chain": {PerSecond: 0.5, Burst: 1},
+	}
+	if !reflect.DeepEqual(rates, expect) {
+		t.Errorf("rates = %+v, expected %+v", rates, expect)
+	}
+	for _, s := range []string{"x", "=5", "x=fast", "x=5:many", "x=-1"} {
+		if _, err := ParseRates(s); err == nil {
+			t.Errorf("%s: err = nil, expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2017, Square, Inc.
+
+// Package router provides routing logic and implements the http.Handler interface.
+// It's internal to the Job Runner and Request Manager APIs, so it can change in
+// any release.
+package router
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/square/spincycle/proto"
+)
+
+// Error types of API errors, which set the HTTP status. The response is a
+// proto.Error with the type and a code, the generic code of the type (see
+// errorTypeCodes) unless the handler gives a more specific one.
+const (
+	ErrNotFound      = "not_found"
+	ErrMissingParam  = "bad_request.missing_parameter"
+	ErrInvalidParam  = "bad_request.invalid_parameter"
+	ErrBadRequest    = "bad_request"
+	ErrUnauthorized  = "unauthorized"
+	ErrForbidden     = "forbidden"
+	ErrConflict      = "conflict"
+	ErrNotAcceptable = "not_acceptable"
+	ErrTooMany       = "too_many_requests"
+	ErrUnavailable   = "service_unavailable"
+	ErrInternal      = "internal_server_error"
+)
+
+var errorCodes = map[string]int{
+	ErrNotFound:      http.StatusNotFound,
+	ErrMissingParam:  http.StatusBadRequest,
+	ErrInvalidParam:  http.StatusBadRequest,
+	ErrBadRequest:    http.StatusBadRequest,
+	ErrUnauthorized:  http.StatusUnauthorized,
+	ErrForbidden:     http.StatusForbidden,
+	ErrConflict:      http.StatusConflict,
+	ErrNotAcceptable: http.StatusNotAcceptable,
+	ErrTooMany:       http.StatusTooManyRequests,
+	ErrUnavailable:   http.StatusServiceUnavailable,
+	ErrInternal:      http.StatusInternalServerError,
+}
+
+var errorTypeCodes = map[string]string{
+	ErrNotFound:      proto.ERR_NOT_FOUND,
+	ErrMissingParam:  proto.ERR_MISSING_PARAM,
+	ErrInvalidParam:  proto.ERR_INVALID_PARAM,
+	ErrBadRequest:    proto.ERR_BAD_REQUEST,
+	ErrUnauthorized:  proto.ERR_UNAUTHORIZED,
+	ErrForbidden:     proto.ERR_FORBIDDEN,
+	ErrConflict:      proto.ERR_CONFLICT,
+	ErrNotAcceptable: proto.ERR_NOT_ACCEPTABLE,
+	ErrTooMany:       proto.ERR_RATE_LIMITED,
+	ErrUnavailable:   proto.ERR_UNAVAILABLE,
+	ErrInternal:      proto.ERR_INTERNAL,
+}
+
+const section = "([^/]*)"
+
+// Route represents a single endpoint matched by regex.
+type Route struct {
+	Name    string            // API endpoint name.
+	Pattern *regexp.Regexp    // URL Path to match against.
+	Handler func(HTTPContext) // Handler function.
+}
+
+// Router is a collection of routes.
+type Router struct {
+	Routes []Route // list of routes supported by the application.
+
+	// Optional authentication and authorization of every request. If nil,
+	// all requests are anonymous and allowed.
+	Authenticator Authenticator
+	Authorizer    Authorizer
+
+	// Optional check of callers acting on behalf of operators (see
+	// ON_BEHALF_OF_HEADER). If nil, requests with the header are rejected.
+	Impersonator Impersonator
+
+	// Optional rate limiting of every request, after authentication. If nil,
+	// requests are not limited.
+	RateLimiter RateLimiter
+
+	// Optional API versions served at the same time (see Versions). If nil,
+	// paths are routed as-is and have no version.
+	Versions *Versions
+}
+
+// AddRoute adds an HTTP handler to the router. Any parameter {} is replacted to become
+// a slash-component of the URL.
+func (router *Router) AddRoute(pattern string, handler func(HTTPContext), name string) {
+	processed := strings.Replace(pattern, "{}", section, -1)
+	compiled := regexp.MustCompile("\\A" + processed + "/?\\z")
+	router.Routes = append(router.Routes, Route{
+		Name:    name,
+		Pattern: compiled,
+		Handler: handler,
+	})
+}
+
+func (router *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if handler, _ := router.Handler(req); handler != nil {
+		handler.ServeHTTP(rw, req)
+		return
+	}
+	http.NotFound(rw, req)
+}
+
+// Handler returns the HTTP handler and associated pattern for the given request.
+func (router *Router) Handler(req *http.Request) (h http.Handler, pattern string) {
+	version, path := "", req.URL.Path
+	if router.Versions != nil {
+		var err error
+		if version, path, err = router.Versions.resolve(req); err != nil {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				ctx := HTTPContext{Response: rw, Request: req, router: router}
+				ctx.APIError(err.(versionError).errType, "%s", err)
+			}), ""
+		}
+	}
+	for _, route := range router.Routes {
+		match := route.Pattern.FindStringSubmatch(path)
+		if len(match) != 0 {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				ctx := HTTPContext{
+					Response:  rw,
+					Request:   req,
+					Arguments: match,
+					Version:   version,
+					router:    router,
+				}
+				if version != "" {
+					rw.Header().Set(VERSION_HEADER, version)
+				}
+				if !router.auth(&ctx, route.Name) {
+					return
+				}
+				if !router.limit(&ctx, route.Name) {
+					return
+				}
+				ctx.Request.ParseForm()
+				route.Handler(ctx)
+			}), route.Name
+		}
+	}
+
+	return nil, ""
+}
+
+// limit applies the rate limiter to the request. If the request is over the
+// limit, it responds 429 with a Retry-After header and returns false.
+func (router *Router) limit(ctx *HTTPContext, route string) bool {
+	if router.RateLimiter == nil {
+		return true
+	}
+	ok, wait := router.RateLimiter.Allow(ctx.Caller, route, ctx.Request)
+	if ok {
+		return true
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	ctx.Response.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	ctx.APIError(ErrTooMany, "Rate limit exceeded for %s, retry after %ds.", route, retryAfter)
+	return false
+}
+
+// auth authenticates the request, checks if the caller can act on behalf of
+// the operator in the Spincycle-On-Behalf-Of header, if any, and authorizes
+// the request, setting ctx.Caller. If the request is not allowed, it responds
+// with an API error and returns false.
+func (router *Router) auth(ctx *HTTPContext, route string) bool {
+	if router.Authenticator != nil {
+		caller, err := router.Authenticator.Authenticate(ctx.Request)
+		if err != nil {
+			ctx.APIError(ErrUnauthorized, "Authentication failed (error: %s).", err)
+			return false
+		}
+		ctx.Caller = caller
+	}
+
+	if operator := ctx.Request.Header.Get(ON_BEHALF_OF_HEADER); operator != "" {
+		if ctx.Caller.Anonymous() {
+			ctx.APIError(ErrUnauthorized, "Authentication required to act on behalf of %s.", operator)
+			return false
+		}
+		err := ErrImpersonationDenied
+		if router.Impersonator != nil {
+			err = router.Impersonator.Impersonate(ctx.Caller, operator, ctx.Request)
+		}
+		if err != nil {
+			ctx.APIError(ErrForbidden, "%s is not allowed to act on behalf of %s (error: %s).", ctx.Caller.Name, operator, err)
+			return false
+		}
+		ctx.Caller.OnBehalfOf = operator
+	}
+
+	if router.Authorizer != nil {
+		if err := router.Authorizer.Authorize(ctx.Caller, route, ctx.Request); err != nil {
+			if ctx.Caller.Anonymous() {
+				ctx.APIError(ErrUnauthorized, "Authentication required (error: %s).", err)
+			} else {
+				ctx.APIError(ErrForbidden, "%s is not allowed to call %s (error: %s).", ctx.Caller.Name, route, err)
+			}
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,151 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A TLSLoader loads the certificate and key of a TLS server, and the CAs of
+// client certificates (mTLS), from files, and reloads them when the files
+// change, so certificates can be rotated without restarting the server. If
+// a reload fails, like when a cert is changed but its key isn't yet, the files
+// that were last loaded are used until the next reload.
+type TLSLoader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // "" = no client certificates
+
+	// RequireClientCert requires clients to give a certificate signed by a
+	// CA in ClientCAFile, else the handshake fails. If false, certificates
+	// are only verified if given, so clients can authenticate another way.
+	RequireClientCert bool
+	// --
+	config      *tls.Config
+	modTimes    []time.Time // of the files when config was loaded
+	*sync.Mutex             // guards config and modTimes
+}
+
+// NewTLSLoader makes a TLSLoader and loads the files. If clientCAFile is set,
+// client certificates are verified (see CertAuthenticator): required if
+// requireClientCert is true, else only if given, so clients without one can
+// still authenticate another way.
+func NewTLSLoader(certFile, keyFile, clientCAFile string, requireClientCert bool) (*TLSLoader, error) {
+	l := &TLSLoader{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      clientCAFile,
+		RequireClientCert: requireClientCert,
+		Mutex:             &sync.Mutex{},
+	}
+	if _, err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Config returns the config of a TLS server that always uses the files last
+// loaded (see http.Server.TLSConfig).
+func (l *TLSLoader) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			l.Lock()
+			defer l.Unlock()
+			return &l.config.Certificates[0], nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l.Lock()
+			defer l.Unlock()
+			return l.config, nil
+		},
+	}
+}
+
+// Reload loads the files if any changed since they were last loaded. It
+// returns true if they were reloaded.
+func (l *TLSLoader) Reload() (bool, error) {
+	files := []string{l.CertFile, l.KeyFile}
+	if l.ClientCAFile != "" {
+		files = append(files, l.ClientCAFile)
+	}
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+
+	l.Lock()
+	changed := l.config == nil
+	for i := range modTimes {
+		if !changed && !modTimes[i].Equal(l.modTimes[i]) {
+			changed = true
+		}
+	}
+	l.Unlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if l.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in client CA file %s", l.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if l.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	l.Lock()
+	l.config = config
+	l.modTimes = modTimes
+	l.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files every interval until stopChan is closed. Errors are
+// logged, and the files last loaded are kept.
+func (l *TLSLoader) Watch(interval time.Duration, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopChan:
+			return
+		}
+		reloaded, err := l.Reload()
+		if err != nil {
+			log.Errorf("Can't reload TLS certificate %s: %s", l.CertFile, err)
+			continue
+		}
+		if reloaded {
+			log.Infof("Reloaded TLS certificate %s", l.CertFile)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selfSigned returns the PEM of a self-signed cert and its key.
+func selfSigned(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// write writes a file with a mod time in the future so it's newer than the
+// last time it was written, however fast the test is.
+func write(t *testing.T, file string, data []byte, age time.Duration) {
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(age)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The name of the cert the server would use.
+func serving(t *testing.T, config *tls.Config) string {
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestTLSLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "router-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	cert, key := selfSigned(t, "jr1")
+	write(t, certFile, cert, 0)
+	write(t, keyFile, key, 0)
+	ca, _ := selfSigned(t, "client-ca")
+	write(t, caFile, ca, 0)
+
+	l, err := NewTLSLoader(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	config := l.Config()
+	if name := serving(t, config); name != "jr1" {
+		t.Errorf("serving %s, expected jr1", name)
+	}
+	clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig.ClientAuth != tls.VerifyClientCertIfGiven || clientConfig.ClientCAs == nil {
+		t.Errorf("client auth = %d, expected client certs verified if given", clientConfig.ClientAuth)
+	}
+
+	// Nothing changed
+	if reloaded, err := l.Reload(); reloaded || err != nil {
+		t.Errorf("reloaded = %t, err = %v; expected false, nil", reloaded, err)
+	}
+
+	// The cert is rotated, but not its key yet: the old cert is kept
+	cert2, key2 := selfSigned(t, "jr2")
+	write(t, certFile, cert2, time.Second)
+	if reloaded, err := l.Reload(); reloaded || err == nil {
+		t.Errorf("reloaded = %t, err = %v; expected false and an error", reloaded, err)
+	}
+	if name := serving(t, config); name != "jr1" {
+		t.Errorf("serving %s, expected jr1", name)
+	}
+
+	// Then its key is, and the new cert is served
+	write(t, keyFile, key2, time.Second)
+	if reloaded, err := l.Reload(); !reloaded || err != nil {
+		t.Errorf("reloaded = %t, err = %v; expected true, nil", reloaded, err)
+	}
+	if name := serving(t, config); name != "jr2" {
+		t.Errorf("serving %s, expected jr2", name)
+	}
+
+	// Files that don't load don't make a loader
+	if _, err := NewTLSLoader(certFile, keyFile, keyFile, false); err == nil {
+		t.Error("err = nil, expected an error for a client CA file without certs")
+	}
+
+	// Client certs can be required
+	l, err = NewTLSLoader(certFile, keyFile, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig, err = l.Config().GetConfigForClient(&tls.ClientHelloInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if clientConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("client auth = %d, expected client certs required", clientConfig.ClientAuth)
+	}
+}
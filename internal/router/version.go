@@ -0,0 +1,104 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// VERSION_HEADER is the response header with the API version that served the
+// request.
+const VERSION_HEADER = "Spincycle-Api-Version"
+
+// mediaVersion matches the version in a media type like
+// application/vnd.spincycle.v2+json.
+var mediaVersion = regexp.MustCompile(`\Aapplication/vnd\.spincycle\.(v[0-9]+)\+json\z`)
+
+// pathVersion matches a version path component like v2.
+var pathVersion = regexp.MustCompile(`\Av[0-9]+\z`)
+
+// Versions are the API versions that a router serves at the same time, so
+// clients can move to a new version one at a time. Routes of every version are
+// added with the version in the path, like /api/v2/job-chains. A client asks
+// for a version by the path, or, for a path without a version under Prefix
+// (like /api/job-chains), by its Accept header:
+//
+//	Accept: application/vnd.spincycle.v2+json
+//
+// Without either, it gets the Default version. The version that served the
+// request is in HTTPContext.Version and the Spincycle-Api-Version response
+// header. A version that isn't supported is 404 Not Found in a path, and 406
+// Not Acceptable in the Accept header.
+type Versions struct {
+	Prefix    string   // path prefix of all versions, like "/api/"
+	Supported []string // versions, like ["v1", "v2"], oldest first
+	Default   string   // version of requests that don't ask for one
+}
+
+// versionError is an unsupported version, written as an API error of its type.
+type versionError struct {
+	errType string
+	message string
+}
+
+func (e versionError) Error() string {
+	return e.message
+}
+
+// resolve returns the API version of a request and the path with the version
+// to route it by. Paths not under Prefix have no version.
+func (v *Versions) resolve(req *http.Request) (string, string, error) {
+	path := req.URL.Path
+	if !strings.HasPrefix(path, v.Prefix) {
+		return "", path, nil
+	}
+	rest := strings.TrimPrefix(path, v.Prefix)
+	first := strings.SplitN(rest, "/", 2)[0]
+	if pathVersion.MatchString(first) {
+		if !v.supported(first) {
+			return "", path, versionError{ErrNotFound, "Unsupported API version " + first + "."}
+		}
+		return first, path, nil
+	}
+
+	version, err := v.accept(req.Header.Get("Accept"))
+	if err != nil {
+		return "", path, err
+	}
+	return version, v.Prefix + version + "/" + rest, nil
+}
+
+// accept returns the newest supported version in an Accept header, or the
+// default version if it doesn't ask for one.
+func (v *Versions) accept(header string) (string, error) {
+	asked := []string{}
+	for _, mt := range strings.Split(header, ",") {
+		mt = strings.TrimSpace(strings.SplitN(mt, ";", 2)[0])
+		if m := mediaVersion.FindStringSubmatch(mt); m != nil {
+			asked = append(asked, m[1])
+		}
+	}
+	if len(asked) == 0 {
+		return v.Default, nil
+	}
+	for i := len(v.Supported) - 1; i >= 0; i-- {
+		for _, a := range asked {
+			if a == v.Supported[i] {
+				return a, nil
+			}
+		}
+	}
+	return "", versionError{ErrNotAcceptable, "Unsupported API version " + strings.Join(asked, ", ") +
+		", supported versions are " + strings.Join(v.Supported, ", ") + "."}
+}
+
+func (v *Versions) supported(version string) bool {
+	for _, s := range v.Supported {
+		if s == version {
+			return true
+		}
+	}
+	return false
+}
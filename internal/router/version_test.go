@@ -0,0 +1,67 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	r := &Router{
+		Versions: &Versions{
+			Prefix:    "/api/",
+			Supported: []string{"v1", "v2"},
+			Default:   "v1",
+		},
+	}
+	var version, arg string
+	handler := func(ctx HTTPContext) { version, arg = ctx.Version, ctx.Arguments[1] }
+	r.AddRoute("/api/v1/chains/{}", handler, "chain")
+	r.AddRoute("/api/v2/chains/{}", handler, "chain")
+	r.AddRoute("/health", handler, "health")
+
+	tests := []struct {
+		path    string
+		accept  string
+		status  int
+		version string
+	}{
+		{"/api/v1/chains/7", "", http.StatusOK, "v1"},
+		{"/api/v2/chains/7", "", http.StatusOK, "v2"},
+		{"/api/v2/chains/7", "application/vnd.spincycle.v1+json", http.StatusOK, "v2"}, // path wins
+		{"/api/chains/7", "", http.StatusOK, "v1"},
+		{"/api/chains/7", "application/json", http.StatusOK, "v1"},
+		{"/api/chains/7", "application/vnd.spincycle.v2+json", http.StatusOK, "v2"},
+		{"/api/chains/7", "application/vnd.spincycle.v1+json, application/vnd.spincycle.v2+json;q=0.9", http.StatusOK, "v2"},
+		{"/api/chains/7", "application/vnd.spincycle.v9+json", http.StatusNotAcceptable, ""},
+		{"/api/v9/chains/7", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		version, arg = "", ""
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s (Accept %q): status = %d, expected %d", test.path, test.accept, rw.Code, test.status)
+		}
+		if version != test.version || rw.Header().Get(VERSION_HEADER) != test.version {
+			t.Errorf("%s (Accept %q): version = %q, header %q, expected %q", test.path, test.accept, version, rw.Header().Get(VERSION_HEADER), test.version)
+		}
+		if test.status == http.StatusOK && arg != "7" {
+			t.Errorf("%s (Accept %q): arg = %q, expected 7", test.path, test.accept, arg)
+		}
+	}
+
+	// Paths not under the prefix have no version
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/health/x", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("/health/x: status = %d, expected 404", rw.Code)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// websocketGUID is the magic GUID from RFC 6455 used to compute Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+var (
+	// ErrNotWebSocket is returned by UpgradeWebSocket when the request is not
+	// a valid WebSocket handshake.
+	ErrNotWebSocket = errors.New("not a websocket handshake")
+
+	// ErrWebSocketClosed is returned when writing to a closed WebSocket.
+	ErrWebSocketClosed = errors.New("websocket is closed")
+)
+
+// WebSocket is a minimal server-side WebSocket connection (RFC 6455). It only
+// supports sending text messages to the client; messages from the client are
+// discarded except for control frames (ping and close). It is meant for pushing
+// updates to clients.
+type WebSocket struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	done chan struct{} // closed when the connection is closed
+	// --
+	closed      bool
+	*sync.Mutex // guards closed and writes to rw
+}
+
+// UpgradeWebSocket upgrades the HTTP connection to a WebSocket. If it returns
+// an error, nothing has been written to the response, so the caller can still
+// respond with an API error. Else, the caller must Close the WebSocket.
+func (ctx HTTPContext) UpgradeWebSocket() (*WebSocket, error) {
+	req := ctx.Request
+	if req.Method != "GET" ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		req.Header.Get("Sec-WebSocket-Key") == "" {
+		return nil, ErrNotWebSocket
+	}
+
+	hijacker, ok := ctx.Response.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("response does not support hijacking the connection")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		conn:  conn,
+		rw:    rw,
+		done:  make(chan struct{}),
+		Mutex: &sync.Mutex{},
+	}
+	go ws.readLoop()
+	return ws, nil
+}
+
+// WriteJSON sends v encoded as JSON to the client in a text message.
+func (ws *WebSocket) WriteJSON(v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(opText, bytes)
+}
+
+// Done returns a channel that is closed when the WebSocket is closed by either
+// the client or the server.
+func (ws *WebSocket) Done() <-chan struct{} {
+	return ws.done
+}
+
+// Close sends a close frame to the client and closes the connection. It is
+// safe to call more than once.
+func (ws *WebSocket) Close() error {
+	ws.writeFrame(opClose, []byte{})
+	return ws.close()
+}
+
+// -------------------------------------------------------------------------- //
+
+func (ws *WebSocket) close() error {
+	ws.Lock()
+	defer ws.Unlock()
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	close(ws.done)
+	return ws.conn.Close()
+}
+
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.Lock()
+	defer ws.Unlock()
+	if ws.closed {
+		return ErrWebSocketClosed
+	}
+
+	// FIN bit set, no fragmentation. Server frames are not masked.
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// readLoop reads frames from the client until the connection is closed. Ping
+// frames are answered, data frames are discarded, and a close frame closes the
+// connection.
+func (ws *WebSocket) readLoop() {
+	defer ws.close()
+	for {
+		opcode, payload, err := readFrame(ws.rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opClose:
+			ws.writeFrame(opClose, []byte{})
+			return
+		case opPing:
+			ws.writeFrame(opPong, payload)
+		}
+	}
+}
+
+// readFrame reads one frame from r and returns its opcode and unmasked payload.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := h[0] & 0x0F
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7F)
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Don't let a client make the server allocate an absurd amount of memory.
+	if n > 1<<20 {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for the given key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns whether or not a comma-separated header contains the
+// given token, case-insensitive.
+func headerContains(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
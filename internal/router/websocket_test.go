@@ -0,0 +1,38 @@
+// Copyright 2017, Square, Inc.
+
+package router
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	expectedAccept := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if accept != expectedAccept {
+		t.Errorf("accept = %s, expected %s", accept, expectedAccept)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	// Masked "Hello" text frame from RFC 6455 section 5.7.
+	frame := []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+	opcode, payload, err := readFrame(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if opcode != opText {
+		t.Errorf("opcode = %d, expected %d", opcode, opText)
+	}
+	if string(payload) != "Hello" {
+		t.Errorf("payload = %q, expected %q", payload, "Hello")
+	}
+
+	// Truncated frame.
+	_, _, err = readFrame(bytes.NewReader(frame[:4]))
+	if err == nil {
+		t.Error("expected an error but did not get one")
+	}
+}
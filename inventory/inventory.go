@@ -0,0 +1,275 @@
+// Copyright 2017, Square, Inc.
+
+// Package inventory expands target selectors, like "all replicas of shard 7"
+// (role=replica,shard=7), into the hosts they select. The hosts come from a
+// Provider: a static file, a CMDB HTTP API, or the Consul catalog. The Request
+// Manager expands selectors when it creates a request and stores the hosts in
+// the chain args with the time of the snapshot, so jobs operate on the hosts
+// as they were when the request was made.
+package inventory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoHosts is returned by Expand when a selector selects no hosts.
+	ErrNoHosts = errors.New("selector selects no hosts")
+)
+
+// A Selector selects hosts by tags, like {"role": "replica", "shard": "7"}. A
+// host is selected if it has all of the tags.
+type Selector map[string]string
+
+// ParseSelector parses a selector like "role=replica,shard=7".
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{}
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid selector %q, expected key=value[,key=value...]", s)
+		}
+		sel[p[0]] = p[1]
+	}
+	return sel, nil
+}
+
+// String returns the selector like "role=replica,shard=7", sorted by key.
+func (s Selector) String() string {
+	kvs := make([]string, 0, len(s))
+	for k, v := range s {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// Matches returns true if tags has all of the selector's tags.
+func (s Selector) Matches(tags map[string]string) bool {
+	for k, v := range s {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// A Provider is a source of hosts.
+type Provider interface {
+	// Hosts returns the hosts that the selector selects, in any order.
+	Hosts(Selector) ([]string, error)
+}
+
+// A Snapshot is the hosts that a selector selected at a point in time.
+type Snapshot struct {
+	Selector Selector
+	Hosts    []string // sorted
+	Time     time.Time
+}
+
+// Expand returns a snapshot of the hosts that the selector selects now. It
+// returns ErrNoHosts if there are none, because operating on no hosts is
+// usually a mistake in the selector.
+func Expand(p Provider, sel Selector) (Snapshot, error) {
+	hosts, err := p.Hosts(sel)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(hosts) == 0 {
+		return Snapshot{}, ErrNoHosts
+	}
+	hosts = append([]string{}, hosts...)
+	sort.Strings(hosts)
+	return Snapshot{
+		Selector: sel,
+		Hosts:    hosts,
+		Time:     time.Now().UTC(),
+	}, nil
+}
+
+// Args returns the snapshot as chain args: arg is the comma-separated hosts,
+// arg_selector is the selector, and arg_snapshot is the time (RFC 3339).
+func (s Snapshot) Args(arg string) map[string]string {
+	return map[string]string{
+		arg:               strings.Join(s.Hosts, ","),
+		arg + "_selector": s.Selector.String(),
+		arg + "_snapshot": s.Time.Format(time.RFC3339),
+	}
+}
+
+// Recheck queries the provider again for the snapshot's selector and returns a
+// new snapshot with only the hosts in s that are still selected, and the hosts
+// that were dropped. Hosts selected now but not in s are not added: a request
+// operates on the hosts it was created for. Call it between waves of a rollout
+// so that hosts which became unhealthy or were removed since the request was
+// created (e.g. failing their Consul health checks) aren't operated on.
+func Recheck(p Provider, s Snapshot) (Snapshot, []string, error) {
+	hosts, err := p.Hosts(s.Selector)
+	if err != nil {
+		return s, nil, err
+	}
+	now := map[string]bool{}
+	for _, h := range hosts {
+		now[h] = true
+	}
+	kept := []string{}
+	dropped := []string{}
+	for _, h := range s.Hosts {
+		if now[h] {
+			kept = append(kept, h)
+		} else {
+			dropped = append(dropped, h)
+		}
+	}
+	return Snapshot{
+		Selector: s.Selector,
+		Hosts:    kept,
+		Time:     time.Now().UTC(),
+	}, dropped, nil
+}
+
+// --------------------------------------------------------------------------
+
+// A Host is a host and its tags in a static inventory.
+type Host struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags"`
+}
+
+// Static is a Provider with a fixed list of hosts.
+type Static []Host
+
+// LoadStatic loads a static inventory from a JSON file: a list of hosts like
+// [{"name": "db1", "tags": {"role": "replica", "shard": "7"}}].
+func LoadStatic(file string) (Static, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s Static
+	if err := json.Unmarshal(bytes, &s); err != nil {
+		return nil, fmt.Errorf("can't decode %s: %s", file, err)
+	}
+	return s, nil
+}
+
+func (s Static) Hosts(sel Selector) ([]string, error) {
+	hosts := []string{}
+	for _, h := range s {
+		if sel.Matches(h.Tags) {
+			hosts = append(hosts, h.Name)
+		}
+	}
+	return hosts, nil
+}
+
+// NewCMDB returns a Provider that gets hosts from a CMDB HTTP API at url. The
+// selector is sent as query parameters (GET url?role=replica&shard=7), and the
+// response must be a JSON list of host names.
+func NewCMDB(client *http.Client, url string) Provider {
+	return cmdb{client: client, url: url}
+}
+
+type cmdb struct {
+	client *http.Client
+	url    string
+}
+
+func (c cmdb) Hosts(sel Selector) ([]string, error) {
+	q := url.Values{}
+	for k, v := range sel {
+		q.Set(k, v)
+	}
+	reqUrl := c.url
+	if strings.Contains(reqUrl, "?") {
+		reqUrl += "&" + q.Encode()
+	} else {
+		reqUrl += "?" + q.Encode()
+	}
+	var hosts []string
+	if err := getJSON(c.client, reqUrl, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// NewConsul returns a Provider that gets hosts from the Consul catalog at addr
+// (e.g. "http://localhost:8500"). The selector key "service" is the service
+// name, which is required, and key "dc" is the datacenter. Other keys select
+// nodes of the service with the tag "key=value". Hosts are node names. Only
+// nodes passing their health checks are selected.
+func NewConsul(client *http.Client, addr string) Provider {
+	return consul{client: client, addr: strings.TrimSuffix(addr, "/")}
+}
+
+type consul struct {
+	client *http.Client
+	addr   string
+}
+
+func (c consul) Hosts(sel Selector) ([]string, error) {
+	service := sel["service"]
+	if service == "" {
+		return nil, errors.New("consul selector requires a service")
+	}
+	q := url.Values{}
+	q.Set("passing", "1")
+	if dc := sel["dc"]; dc != "" {
+		q.Set("dc", dc)
+	}
+	reqUrl := c.addr + "/v1/health/service/" + url.PathEscape(service) + "?" + q.Encode()
+	var entries []struct {
+		Node struct {
+			Node string
+		}
+		Service struct {
+			Tags []string
+		}
+	}
+	if err := getJSON(c.client, reqUrl, &entries); err != nil {
+		return nil, err
+	}
+
+	// Filter by tags here: the health API only filters by one tag
+	hosts := []string{}
+	for _, e := range entries {
+		tags := map[string]string{"service": service, "dc": sel["dc"]}
+		for _, t := range e.Service.Tags {
+			if p := strings.SplitN(t, "=", 2); len(p) == 2 {
+				tags[p[0]] = p[1]
+			}
+		}
+		if sel.Matches(tags) {
+			hosts = append(hosts, e.Node.Node)
+		}
+	}
+	return hosts, nil
+}
+
+// getJSON gets a URL and decodes the JSON response into v.
+func getJSON(client *http.Client, reqUrl string, v interface{}) error {
+	res, err := client.Get(reqUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", reqUrl, res.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("can't decode response from %s: %s", reqUrl, err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017, Square, Inc.
+
+package inventory_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/inventory"
+)
+
+func TestParseSelector(t *testing.T) {
+	sel, err := inventory.ParseSelector("shard=7, role=replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (inventory.Selector{"role": "replica", "shard": "7"}); !reflect.DeepEqual(sel, expect) {
+		t.Errorf("selector = %v, expected %v", sel, expect)
+	}
+	if sel.String() != "role=replica,shard=7" {
+		t.Errorf("String = %s, expected role=replica,shard=7", sel.String())
+	}
+	if _, err := inventory.ParseSelector("replica"); err == nil {
+		t.Error("err = nil, expected an error")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	f, err := ioutil.TempFile("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `[
+		{"name": "db2", "tags": {"role": "replica", "shard": "7"}},
+		{"name": "db1", "tags": {"role": "primary", "shard": "7"}},
+		{"name": "db3", "tags": {"role": "replica", "shard": "7"}},
+		{"name": "db4", "tags": {"role": "replica", "shard": "8"}}
+	]`)
+	f.Close()
+
+	p, err := inventory.LoadStatic(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UTC().Add(-time.Second)
+	snap, err := inventory.Expand(p, inventory.Selector{"role": "replica", "shard": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap.Hosts, []string{"db2", "db3"}) {
+		t.Errorf("hosts = %v, expected db2 and db3", snap.Hosts)
+	}
+	if snap.Time.Before(before) {
+		t.Errorf("snapshot time = %s, expected now", snap.Time)
+	}
+	args := snap.Args("hosts")
+	expect := map[string]string{
+		"hosts":          "db2,db3",
+		"hosts_selector": "role=replica,shard=7",
+		"hosts_snapshot": snap.Time.Format(time.RFC3339),
+	}
+	if !reflect.DeepEqual(args, expect) {
+		t.Errorf("args = %v, expected %v", args, expect)
+	}
+
+	if _, err := inventory.Expand(p, inventory.Selector{"shard": "9"}); err != inventory.ErrNoHosts {
+		t.Errorf("err = %v, expected %s", err, inventory.ErrNoHosts)
+	}
+}
+
+func TestCMDB(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts" || r.URL.Query().Get("shard") != "7" || r.URL.Query().Get("env") != "prod" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `["db3", "db2"]`)
+	}))
+	defer ts.Close()
+
+	p := inventory.NewCMDB(http.DefaultClient, ts.URL+"/hosts?env=prod")
+	hosts, err := p.Hosts(inventory.Selector{"shard": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, []string{"db3", "db2"}) {
+		t.Errorf("hosts = %v, expected db3 and db2", hosts)
+	}
+	if _, err := p.Hosts(inventory.Selector{"shard": "8"}); err == nil {
+		t.Error("err = nil, expected an error for status 400")
+	}
+}
+
+func TestConsul(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/mysql" || r.URL.Query().Get("dc") != "east" || r.URL.Query().Get("passing") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"Node": {"Node": "db1"}, "Service": {"Tags": ["role=primary", "shard=7"]}},
+			{"Node": {"Node": "db2"}, "Service": {"Tags": ["role=replica", "shard=7"]}},
+			{"Node": {"Node": "db3"}, "Service": {"Tags": ["role=replica", "shard=8"]}}
+		]`)
+	}))
+	defer ts.Close()
+
+	p := inventory.NewConsul(http.DefaultClient, ts.URL)
+	hosts, err := p.Hosts(inventory.Selector{"service": "mysql", "dc": "east", "shard": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(hosts)
+	if !reflect.DeepEqual(hosts, []string{"db1", "db2"}) {
+		t.Errorf("hosts = %v, expected db1 and db2", hosts)
+	}
+	if _, err := p.Hosts(inventory.Selector{"shard": "7"}); err == nil {
+		t.Error("err = nil, expected an error without a service")
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	sel := inventory.Selector{"shard": "7"}
+	p := inventory.Static{
+		{Name: "db1", Tags: map[string]string{"shard": "7"}},
+		{Name: "db2", Tags: map[string]string{"shard": "7"}},
+		{Name: "db3", Tags: map[string]string{"shard": "7"}},
+	}
+	snap, err := inventory.Expand(p, sel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// db2 became unhealthy (no longer selected) and db4 was added since the
+	// snapshot: db2 is dropped and db4 isn't added
+	p = inventory.Static{
+		{Name: "db1", Tags: map[string]string{"shard": "7"}},
+		{Name: "db3", Tags: map[string]string{"shard": "7"}},
+		{Name: "db4", Tags: map[string]string{"shard": "7"}},
+	}
+	snap, dropped, err := inventory.Recheck(p, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap.Hosts, []string{"db1", "db3"}) {
+		t.Errorf("hosts = %v, expected db1 and db3", snap.Hosts)
+	}
+	if !reflect.DeepEqual(dropped, []string{"db2"}) {
+		t.Errorf("dropped = %v, expected db2", dropped)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// registryClient is a client.AgentClient that calls a Registry directly.
+type registryClient struct {
+	r *Registry
+}
+
+func (c registryClient) Register(a proto.Agent) (proto.AgentRegistration, error) {
+	return c.r.Register(a)
+}
+
+func (c registryClient) Next(agentName string, wait time.Duration) (proto.AgentWork, bool, error) {
+	return c.r.Next(context.Background(), agentName, wait)
+}
+
+func (c registryClient) Update(agentName, workId string, u proto.AgentUpdate) (proto.AgentUpdateResponse, error) {
+	return c.r.Update(agentName, workId, u)
+}
+
+func (c registryClient) Download(path string) ([]byte, error) {
+	file, err := c.r.Binary(strings.TrimPrefix(path, "agents/updates/"))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.Register(proto.Agent{Name: "host1"}); err != ErrInvalidAgent {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidAgent)
+	}
+	if _, err := r.Register(proto.Agent{Name: "host2", Pool: "db", Version: VERSION}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register(proto.Agent{Name: "host1", Pool: "db", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	agents := r.Agents()
+	if len(agents) != 2 || agents[0].Name != "host1" || agents[1].Name != "host2" {
+		t.Errorf("agents = %+v, expected host1 and host2", agents)
+	}
+	if agents[0].LastSeen.IsZero() {
+		t.Error("LastSeen not set")
+	}
+
+	if _, _, err := r.Next(context.Background(), "host3", time.Millisecond); err != ErrUnknownAgent {
+		t.Errorf("err = %v, expected %s", err, ErrUnknownAgent)
+	}
+}
+
+func TestRemoteRunner(t *testing.T) {
+	r := NewRegistry()
+	rf := NewRunnerFactory(&mock.RunnerFactory{}, r)
+	r.Register(proto.Agent{Name: "host1", Pool: "db", Version: VERSION})
+	r.Register(proto.Agent{Name: "host2", Pool: "web", Version: VERSION})
+
+	jr, err := rf.Make(proto.Job{Name: "job1", Type: "jtype", Agent: "db"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jr.Status() != "waiting for an agent in pool db" {
+		t.Errorf("status = %q, expected waiting", jr.Status())
+	}
+
+	jobData := map[string]interface{}{"in": "x"}
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(jobData) }()
+
+	// Agents in other pools don't get the job
+	if _, ok, _ := r.Next(context.Background(), "host2", 50*time.Millisecond); ok {
+		t.Error("agent in pool web got work for pool db")
+	}
+
+	// An agent that went away doesn't get the job, so it's still queued
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok, _ := r.Next(gone, "host1", time.Second); ok {
+		t.Error("agent that went away got work")
+	}
+
+	work, ok, err := r.Next(context.Background(), "host1", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v, expected work", ok, err)
+	}
+	if work.RequestId != 5 || work.Job.Name != "job1" || work.JobData["in"] != "x" {
+		t.Errorf("work = %+v, expected job1 for request 5", work)
+	}
+
+	// Only the agent running the work can update it
+	if _, err := r.Update("host2", work.Id, proto.AgentUpdate{}); err != ErrUnknownWork {
+		t.Errorf("err = %v, expected %s", err, ErrUnknownWork)
+	}
+
+	res, err := r.Update("host1", work.Id, proto.AgentUpdate{Status: "copying", Progress: 50, Log: "line1\n"})
+	if err != nil || res.Stop {
+		t.Fatalf("got %+v, %v, expected no stop", res, err)
+	}
+	if jr.Status() != "running on agent host1: copying" || jr.Progress() != 50 {
+		t.Errorf("status = %q, progress = %d", jr.Status(), jr.Progress())
+	}
+
+	_, err = r.Update("host1", work.Id, proto.AgentUpdate{
+		Log:     "line2\n",
+		Done:    true,
+		State:   proto.STATE_COMPLETE,
+		JobData: map[string]interface{}{"out": "y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_COMPLETE {
+			t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	expect := map[string]interface{}{"in": "x", "out": "y"}
+	if !reflect.DeepEqual(jobData, expect) {
+		t.Errorf("jobData = %v, expected %v", jobData, expect)
+	}
+	out, _, _, closed := jr.Log().Read(0)
+	if string(out) != "line1\nline2\n" || !closed {
+		t.Errorf("log = %q (closed %t), expected both lines and closed", out, closed)
+	}
+
+	// The work is done
+	if _, err := r.Update("host1", work.Id, proto.AgentUpdate{}); err != ErrUnknownWork {
+		t.Errorf("err = %v, expected %s", err, ErrUnknownWork)
+	}
+}
+
+func TestRemoteRunnerStop(t *testing.T) {
+	r := NewRegistry()
+	rf := NewRunnerFactory(&mock.RunnerFactory{}, r)
+	r.Register(proto.Agent{Name: "host1", Pool: "db", Version: VERSION})
+
+	// Stopped while waiting for an agent
+	jr, _ := rf.Make(proto.Job{Name: "job1", Agent: "db"}, 1)
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	time.Sleep(50 * time.Millisecond)
+	jr.Stop(time.Second)
+	if state := <-stateChan; state != proto.STATE_STOPPED {
+		t.Errorf("state = %s, expected STOPPED", proto.StateName[state])
+	}
+
+	// Stopped while running: the agent is told to stop and has the grace
+	// period to do it
+	jr, _ = rf.Make(proto.Job{Name: "job2", Agent: "db"}, 1)
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	work, ok, _ := r.Next(context.Background(), "host1", time.Second)
+	if !ok {
+		t.Fatal("no work")
+	}
+	jr.Stop(time.Second)
+	res, err := r.Update("host1", work.Id, proto.AgentUpdate{})
+	if err != nil || !res.Stop {
+		t.Fatalf("got %+v, %v, expected stop", res, err)
+	}
+	r.Update("host1", work.Id, proto.AgentUpdate{Done: true, State: proto.STATE_STOPPED})
+	if state := <-stateChan; state != proto.STATE_STOPPED {
+		t.Errorf("state = %s, expected STOPPED", proto.StateName[state])
+	}
+
+	// The agent doesn't stop the job within the grace period
+	jr, _ = rf.Make(proto.Job{Name: "job3", Agent: "db"}, 1)
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	if _, ok, _ = r.Next(context.Background(), "host1", time.Second); !ok {
+		t.Fatal("no work")
+	}
+	jr.Stop(50 * time.Millisecond)
+	if state := <-stateChan; state != proto.STATE_FORCE_KILLED {
+		t.Errorf("state = %s, expected FORCE_KILLED", proto.StateName[state])
+	}
+}
+
+func TestRemoteRunnerTimeout(t *testing.T) {
+	r := NewRegistry()
+	rf := NewRunnerFactory(&mock.RunnerFactory{}, r)
+
+	// No agent in the pool
+	jr, err := rf.Make(proto.Job{Name: "job1", Agent: "db", Timeout: "50ms"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := jr.Run(map[string]interface{}{}); state != proto.STATE_TIMEOUT {
+		t.Errorf("state = %s, expected TIMEOUT", proto.StateName[state])
+	}
+
+	if _, err := rf.Make(proto.Job{Name: "job1", Agent: "db", Timeout: "soon"}, 1); err == nil {
+		t.Error("err = nil, expected an error for the invalid timeout")
+	}
+}
+
+func TestRemoteRunnerLostAgent(t *testing.T) {
+	defer func(d time.Duration) { LostAgentTimeout = d }(LostAgentTimeout)
+	LostAgentTimeout = 100 * time.Millisecond
+
+	r := NewRegistry()
+	rf := NewRunnerFactory(&mock.RunnerFactory{}, r)
+	r.Register(proto.Agent{Name: "host1", Pool: "db", Version: VERSION})
+
+	jr, _ := rf.Make(proto.Job{Name: "job1", Agent: "db"}, 1)
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	if _, ok, _ := r.Next(context.Background(), "host1", time.Second); !ok {
+		t.Fatal("no work")
+	}
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_FAIL {
+			t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+// Jobs without an agent pool are made by the wrapped factory.
+func TestFactoryLocalJobs(t *testing.T) {
+	local := mock.NewRunner(true, "", nil, nil, nil)
+	rf := NewRunnerFactory(&mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{"job1": local}}, NewRegistry())
+	jr, err := rf.Make(proto.Job{Name: "job1"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jr != local {
+		t.Errorf("got %v, expected the local runner", jr)
+	}
+}
+
+// A worker runs the job on the agent and the remote runner gets its result.
+func TestWorker(t *testing.T) {
+	r := NewRegistry()
+	jrf := NewRunnerFactory(&mock.RunnerFactory{}, r)
+
+	runBlock := make(chan struct{})
+	agentRunner := mock.NewRunner(true, "working", runBlock, nil, map[string]interface{}{"out": "y"})
+	agentRunner.ProgressResp = 10
+	arf := &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{"job1": agentRunner}}
+
+	w := NewWorker(proto.Agent{Name: "host1", Pool: "db", Version: VERSION}, registryClient{r}, arf)
+	w.Wait = 50 * time.Millisecond
+	w.UpdateInterval = 10 * time.Millisecond
+	stopChan := make(chan struct{})
+	workerDone := make(chan struct{})
+	go func() {
+		w.Run(stopChan)
+		close(workerDone)
+	}()
+
+	jr, _ := jrf.Make(proto.Job{Name: "job1", Agent: "db"}, 1)
+	jobData := map[string]interface{}{}
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(jobData) }()
+
+	// Wait for an update from the agent
+	deadline := time.Now().Add(time.Second)
+	for jr.Progress() != 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if jr.Status() != "running on agent host1: working" {
+		t.Errorf("status = %q, expected it running on host1", jr.Status())
+	}
+
+	agentRunner.Log().Write([]byte("done\n"))
+	close(runBlock)
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_COMPLETE {
+			t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	if jobData["out"] != "y" {
+		t.Errorf("jobData = %v, expected out=y from the agent", jobData)
+	}
+	if out, _, _, _ := jr.Log().Read(0); string(out) != "done\n" {
+		t.Errorf("log = %q, expected the agent's log", out)
+	}
+
+	close(stopChan)
+	select {
+	case <-workerDone:
+	case <-time.After(time.Second):
+		t.Fatal("worker did not stop")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+)
+
+// NewRunnerFactory returns a RunnerFactory that makes runners which run jobs
+// on agents for jobs with an agent pool (proto.Job.Agent), and uses rf to make
+// runners for other jobs. Jobs that run on agents are not made in the Job
+// Runner, so their types only need to be known by the agents.
+func NewRunnerFactory(rf runner.RunnerFactory, registry *Registry) runner.RunnerFactory {
+	return &runnerFactory{
+		rf:       rf,
+		registry: registry,
+	}
+}
+
+type runnerFactory struct {
+	rf       runner.RunnerFactory
+	registry *Registry
+}
+
+func (f *runnerFactory) Make(job proto.Job, requestId uint) (runner.Runner, error) {
+	if job.Agent == "" {
+		return f.rf.Make(job, requestId)
+	}
+
+	var timeout time.Duration
+	if job.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(job.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := f.registry.ids.UID()
+	if err != nil {
+		return nil, err
+	}
+	return &remoteRunner{
+		id:        id,
+		job:       job,
+		requestId: requestId,
+		registry:  f.registry,
+		timeout:   timeout,
+		log:       runner.NewLog(),
+		doneChan:  make(chan proto.AgentUpdate, 1),
+		stopChan:  make(chan struct{}),
+		progress:  -1,
+		Mutex:     &sync.Mutex{},
+	}, nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2017, Square, Inc.
+
+// Package agent runs jobs on spincycle-agents. An agent registers with the Job
+// Runner, then asks it for work: one try of one job in a pool of agents. The
+// agent runs the job on its host and sends updates (status, log output) while
+// it runs and the result when it's done. Jobs run on agents when they must run
+// on the target host itself.
+package agent
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/idgen"
+	"github.com/square/spincycle/job-runner/payload"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidAgent is returned by Register if the agent has no name or pool.
+	ErrInvalidAgent = errors.New("agent name and pool are required")
+
+	// ErrUnknownAgent is returned if an agent that did not register asks for
+	// work or sends an update.
+	ErrUnknownAgent = errors.New("unknown agent, it must register first")
+
+	// ErrUnknownWork is returned if an agent sends an update for work that
+	// isn't running on it.
+	ErrUnknownWork = errors.New("unknown work")
+)
+
+// VERSION is the version of spincycle-agent, sent when it registers, and of
+// the Job Runner in the version handshake.
+const VERSION = "1.1.0"
+
+var (
+	// LostAgentTimeout is how long to wait for an update from the agent that
+	// is running a job before the agent is lost and the job fails.
+	LostAgentTimeout = time.Minute
+)
+
+// now is time.Now, changed by tests.
+var now = time.Now
+
+// A Registry keeps track of agents and hands out work to them. Work is handed
+// out to the first agent in the job's pool that asks for work.
+type Registry struct {
+	ids idgen.Generator // makes work IDs
+	// --
+	agents      map[string]proto.Agent        // agent name => agent
+	queues      map[string]chan *remoteRunner // agent pool => runners waiting for an agent
+	running     map[string]*remoteRunner      // work ID => runner running on an agent
+	updates     *UpdateChannel                // offers upgrades to agents, nil if not set
+	upgrading   map[string]time.Time          // agent name => when it was offered an upgrade
+	payloadKeys map[string]cipher.AEAD        // agent pool => cipher of its payloads
+	*sync.Mutex                               // guards all fields after the separator
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		ids:         idgen.NewULID(),
+		agents:      map[string]proto.Agent{},
+		queues:      map[string]chan *remoteRunner{},
+		running:     map[string]*remoteRunner{},
+		upgrading:   map[string]time.Time{},
+		payloadKeys: map[string]cipher.AEAD{},
+		Mutex:       &sync.Mutex{},
+	}
+}
+
+// Register adds an agent, or updates it if it's already registered (e.g. the
+// agent restarted or was upgraded). The registration tells the agent if its
+// version is compatible, the payload options it can use, and, if an update
+// channel is set, if it should upgrade.
+func (r *Registry) Register(a proto.Agent) (proto.AgentRegistration, error) {
+	if a.Name == "" || a.Pool == "" {
+		return proto.AgentRegistration{}, ErrInvalidAgent
+	}
+	a.LastSeen = now()
+	a.Compatible = compatible(a.Version)
+	reg := proto.AgentRegistration{
+		Version:    VERSION,
+		Compatible: a.Compatible,
+	}
+
+	r.Lock()
+	r.agents[a.Name] = a
+	reg.Upgrade = r.offer(a)
+	reg.Payload = []string{payload.GZIP}
+	if r.payloadKeys[a.Pool] != nil {
+		reg.Payload = append(reg.Payload, payload.AES_GCM)
+	}
+	r.Unlock()
+
+	log.Infof("Agent %s registered in pool %s (version %s, compatible %t).", a.Name, a.Pool, a.Version, a.Compatible)
+	if reg.Upgrade != nil {
+		log.Infof("Agent %s offered upgrade to version %s.", a.Name, reg.Upgrade.Version)
+	}
+	return reg, nil
+}
+
+// SetUpdateChannel sets the update channel that offers upgrades to agents when
+// they register.
+func (r *Registry) SetUpdateChannel(c *UpdateChannel) {
+	r.Lock()
+	r.updates = c
+	r.Unlock()
+}
+
+// SetPayloadKeys sets the ciphers of agent pools that encrypt their payloads
+// (see package payload), keyed by pool.
+func (r *Registry) SetPayloadKeys(keys map[string]cipher.AEAD) {
+	r.Lock()
+	r.payloadKeys = keys
+	r.Unlock()
+}
+
+// Codec returns the payload codec with the options that an agent sent, using
+// the key of its pool to encrypt. It returns payload.ErrNoKey if the agent
+// encrypts but there's no key for its pool, and payload.ErrNotEncrypted if
+// there's a key for its pool but the agent doesn't encrypt.
+func (r *Registry) Codec(agentName string, options []string) (payload.Codec, error) {
+	r.Lock()
+	a, ok := r.agents[agentName]
+	key := r.payloadKeys[a.Pool]
+	r.Unlock()
+	if !ok {
+		return payload.Codec{}, ErrUnknownAgent
+	}
+	return payload.NewCodec(options, key)
+}
+
+// Binary returns the path of a binary in the update channel, by file name.
+func (r *Registry) Binary(name string) (string, error) {
+	r.Lock()
+	c := r.updates
+	r.Unlock()
+	if c == nil || name != filepath.Base(name) || !strings.HasPrefix(name, "spincycle-agent-") {
+		return "", os.ErrNotExist
+	}
+	path := filepath.Join(c.Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Agents returns all registered agents sorted by name.
+func (r *Registry) Agents() []proto.Agent {
+	r.Lock()
+	defer r.Unlock()
+	agents := make([]proto.Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// Next waits up to wait for work for an agent. It returns false if there is
+// no work, or if ctx is done first, like when the agent went away, so the work
+// isn't given to an agent that won't get it.
+func (r *Registry) Next(ctx context.Context, agentName string, wait time.Duration) (proto.AgentWork, bool, error) {
+	a, err := r.seen(agentName)
+	if err != nil {
+		return proto.AgentWork{}, false, err
+	}
+	if !a.Compatible {
+		return proto.AgentWork{}, false, ErrIncompatibleAgent
+	}
+
+	r.Lock()
+	queue := r.queue(a.Pool)
+	r.Unlock()
+
+	if ctx.Err() != nil {
+		return proto.AgentWork{}, false, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case rr := <-queue:
+		r.Lock()
+		r.running[rr.id] = rr
+		r.Unlock()
+		return rr.assign(agentName), true, nil
+	case <-timer.C:
+		return proto.AgentWork{}, false, nil
+	case <-ctx.Done():
+		return proto.AgentWork{}, false, nil
+	}
+}
+
+// Update applies an update from an agent for work running on it. The response
+// tells the agent to stop the job if the job was stopped.
+func (r *Registry) Update(agentName, workId string, u proto.AgentUpdate) (proto.AgentUpdateResponse, error) {
+	if _, err := r.seen(agentName); err != nil {
+		return proto.AgentUpdateResponse{}, err
+	}
+
+	r.Lock()
+	rr, ok := r.running[workId]
+	if ok && u.Done {
+		delete(r.running, workId)
+	}
+	r.Unlock()
+	if !ok || rr.agentName() != agentName {
+		return proto.AgentUpdateResponse{}, ErrUnknownWork
+	}
+
+	return proto.AgentUpdateResponse{Stop: rr.update(u)}, nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// seen records that an agent called the Job Runner and returns it.
+func (r *Registry) seen(agentName string) (proto.Agent, error) {
+	r.Lock()
+	defer r.Unlock()
+	a, ok := r.agents[agentName]
+	if !ok {
+		return a, ErrUnknownAgent
+	}
+	a.LastSeen = now()
+	r.agents[agentName] = a
+	return a, nil
+}
+
+// queue returns the queue of runners waiting for an agent in the pool. The
+// caller must hold the lock.
+func (r *Registry) queue(pool string) chan *remoteRunner {
+	q, ok := r.queues[pool]
+	if !ok {
+		q = make(chan *remoteRunner)
+		r.queues[pool] = q
+	}
+	return q
+}
+
+// offer returns the upgrade to offer an agent, if any. At most MaxUpgrades
+// agents are offered an upgrade at once; an agent counts until it registers
+// with the new version or UpgradeTimeout. The caller must hold the lock.
+func (r *Registry) offer(a proto.Agent) *proto.AgentUpgrade {
+	if r.updates == nil {
+		return nil
+	}
+	upgrade := r.updates.offer(a)
+	if upgrade == nil {
+		delete(r.upgrading, a.Name)
+		return nil
+	}
+	if t, ok := r.upgrading[a.Name]; (!ok || now().Sub(t) > UpgradeTimeout) && r.updates.MaxUpgrades > 0 {
+		delete(r.upgrading, a.Name)
+		n := uint(0)
+		for name, t := range r.upgrading {
+			if now().Sub(t) > UpgradeTimeout {
+				delete(r.upgrading, name)
+				continue
+			}
+			n++
+		}
+		if n >= r.updates.MaxUpgrades {
+			return nil // upgrade later
+		}
+	}
+	if _, ok := r.upgrading[a.Name]; !ok {
+		r.upgrading[a.Name] = now()
+	}
+	return upgrade
+}
+
+// done forgets work that is done, e.g. because the job timed out.
+func (r *Registry) done(workId string) {
+	r.Lock()
+	delete(r.running, workId)
+	r.Unlock()
+}
@@ -0,0 +1,218 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// remoteRunner is a runner.Runner that runs a job on an agent. Run waits for
+// an agent in the job's pool to ask for it, then for the agent's updates.
+type remoteRunner struct {
+	id        string
+	job       proto.Job
+	requestId uint
+	registry  *Registry
+	timeout   time.Duration          // max run time, 0 = no timeout
+	log       *runner.Log            // log output sent by the agent
+	doneChan  chan proto.AgentUpdate // receives the last update from the agent
+	stopChan  chan struct{}          // closed on Stop
+	// --
+	jobData     map[string]interface{} // given to the agent
+	agent       string                 // name of the agent running the job
+	status      string                 // last status sent by the agent
+	progress    int                    // last progress sent by the agent
+	lastUpdate  time.Time              // when the agent last sent an update
+	grace       time.Duration          // how long Run waits for the job after Stop
+	running     bool                   // true when Run is running
+	stopped     bool                   // true after Stop closes stopChan
+	*sync.Mutex                        // guards fields after the separator
+}
+
+var (
+	_ runner.Runner = (*remoteRunner)(nil)
+	_ runner.Placed = (*remoteRunner)(nil)
+)
+
+func (r *remoteRunner) Run(jobData map[string]interface{}) byte {
+	r.Lock()
+	r.jobData = jobData
+	r.running = true
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		r.running = false
+		r.Unlock()
+		r.registry.done(r.id)
+		r.log.Close()
+	}()
+
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	// Wait for an agent in the pool to ask for the job.
+	log.Infof("[chain=%d,job=%s]: Waiting for an agent in pool %s to run the job.", r.requestId, r.job.Name, r.job.Agent)
+	r.registry.Lock()
+	queue := r.registry.queue(r.job.Agent)
+	r.registry.Unlock()
+	select {
+	case queue <- r:
+		log.Infof("[chain=%d,job=%s]: An agent in pool %s took the job.", r.requestId, r.job.Name, r.job.Agent)
+		r.Lock()
+		r.lastUpdate = now()
+		r.Unlock()
+	case <-r.stopChan:
+		return proto.STATE_STOPPED // never ran
+	case <-ctx.Done():
+		log.Errorf("[chain=%d,job=%s]: No agent ran the job within its timeout %s.", r.requestId, r.job.Name, r.timeout)
+		return proto.STATE_TIMEOUT
+	}
+
+	// Wait for the agent to finish the job, a call to Stop, the timeout, or the
+	// agent to be lost.
+	ticker := time.NewTicker(LostAgentTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case u := <-r.doneChan:
+			return r.finish(u, jobData)
+		case <-r.stopChan:
+			r.Lock()
+			grace := r.grace
+			r.Unlock()
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case u := <-r.doneChan:
+				r.finish(u, jobData)
+				return proto.STATE_STOPPED
+			case <-timer.C:
+				log.Errorf("[chain=%d,job=%s]: Agent %s did not stop the job within %s, abandoning it.",
+					r.requestId, r.job.Name, r.agentName(), grace)
+				return proto.STATE_FORCE_KILLED
+			}
+		case <-ctx.Done():
+			log.Errorf("[chain=%d,job=%s]: Job timed out after %s, stopping it.", r.requestId, r.job.Name, r.timeout)
+			r.Stop(0)
+			return proto.STATE_TIMEOUT
+		case <-ticker.C:
+			r.Lock()
+			age := now().Sub(r.lastUpdate)
+			r.Unlock()
+			if age > LostAgentTimeout {
+				log.Errorf("[chain=%d,job=%s]: No update from agent %s in %s, the agent is lost.",
+					r.requestId, r.job.Name, r.agentName(), age)
+				return proto.STATE_FAIL
+			}
+		}
+	}
+}
+
+func (r *remoteRunner) Stop(grace time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+	if !r.running || r.stopped {
+		return nil
+	}
+	// The agent is told to stop the job in the response to its next update.
+	r.grace = grace
+	r.stopped = true
+	close(r.stopChan)
+	return nil
+}
+
+func (r *remoteRunner) Status() string {
+	r.Lock()
+	defer r.Unlock()
+	if r.agent == "" {
+		return "waiting for an agent in pool " + r.job.Agent
+	}
+	return fmt.Sprintf("running on agent %s: %s", r.agent, r.status)
+}
+
+func (r *remoteRunner) Progress() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.progress
+}
+
+func (r *remoteRunner) Log() *runner.Log {
+	return r.log
+}
+
+// -------------------------------------------------------------------------- //
+
+// assign assigns the job to an agent and returns the work to send to it.
+func (r *remoteRunner) assign(agentName string) proto.AgentWork {
+	r.Lock()
+	defer r.Unlock()
+	r.agent = agentName
+	r.lastUpdate = now()
+	return proto.AgentWork{
+		Id:        r.id,
+		RequestId: r.requestId,
+		Job:       r.job,
+		JobData:   r.jobData,
+	}
+}
+
+// Where returns the name of the agent that the job was assigned to, so mirrors
+// of the job can't run on the same agent (see runner.Placed).
+func (r *remoteRunner) Where() string {
+	return r.agentName()
+}
+
+// agentName returns the name of the agent running the job, if any.
+func (r *remoteRunner) agentName() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.agent
+}
+
+// update applies an update from the agent. It returns true if the job was
+// stopped, so the agent should stop it.
+func (r *remoteRunner) update(u proto.AgentUpdate) bool {
+	r.Lock()
+	r.lastUpdate = now()
+	r.status = u.Status
+	r.progress = u.Progress
+	stopped := r.stopped
+	r.Unlock()
+
+	if u.Log != "" {
+		r.log.Write([]byte(u.Log))
+	}
+	if u.Done {
+		select {
+		case r.doneChan <- u:
+		default: // already done
+		}
+	}
+	return stopped
+}
+
+// finish copies the jobData from the agent's last update and returns the
+// final state of the job.
+func (r *remoteRunner) finish(u proto.AgentUpdate, jobData map[string]interface{}) byte {
+	for k, v := range u.JobData {
+		jobData[k] = v
+	}
+	if _, ok := proto.StateName[u.State]; !ok || u.State == proto.STATE_UNKNOWN {
+		log.Errorf("[chain=%d,job=%s]: Agent %s sent unknown state %d.", r.requestId, r.job.Name, r.agentName(), u.State)
+		return proto.STATE_FAIL
+	}
+	return u.State
+}
@@ -0,0 +1,167 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	// ErrIncompatibleAgent is returned if an agent with a version that is not
+	// compatible with the Job Runner asks for work.
+	ErrIncompatibleAgent = errors.New("agent version is not compatible with this Job Runner")
+
+	// ErrBadSignature is returned by Install if the signature of the binary
+	// is not valid.
+	ErrBadSignature = errors.New("invalid signature")
+)
+
+var (
+	// UpgradeTimeout is how long an agent has to upgrade after it's offered an
+	// upgrade before the offer goes to another agent.
+	UpgradeTimeout = 10 * time.Minute
+)
+
+// A VersionRange is a range of versions, inclusive. An empty Max means no max.
+type VersionRange struct {
+	Min string
+	Max string
+}
+
+// Contains returns true if version is in the range.
+func (r VersionRange) Contains(version string) bool {
+	if CompareVersions(version, r.Min) < 0 {
+		return false
+	}
+	return r.Max == "" || CompareVersions(version, r.Max) <= 0
+}
+
+// Compatibility is the compatibility matrix: Job Runner version => versions of
+// spincycle-agent that work with it. Agents that are not compatible register,
+// so they can be upgraded, but don't get work.
+var Compatibility = map[string]VersionRange{
+	"1.0.0": {Min: "1.0.0", Max: "1.0.0"},
+	"1.1.0": {Min: "1.0.0", Max: "1.1.0"},
+}
+
+// CompareVersions compares two "major.minor.patch" versions. It returns -1 if
+// a < b, 0 if a == b, and 1 if a > b. Missing or invalid parts are zero, so an
+// empty version is older than any other.
+func CompareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := range pa {
+		if pa[i] < pb[i] {
+			return -1
+		}
+		if pa[i] > pb[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) [3]int {
+	var parts [3]int
+	for i, s := range strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3) {
+		parts[i], _ = strconv.Atoi(s)
+	}
+	return parts
+}
+
+// compatible returns true if an agent version is compatible with this Job
+// Runner (VERSION) according to the Compatibility matrix.
+func compatible(version string) bool {
+	r, ok := Compatibility[VERSION]
+	return ok && version != "" && r.Contains(version)
+}
+
+// -------------------------------------------------------------------------- //
+
+// An UpdateChannel offers agents signed spincycle-agent binaries to upgrade
+// themselves to Version. Binaries are files in Dir named
+// spincycle-agent-<version>-<os>-<arch>, each with its ed25519 signature in the
+// same file name + ".sig". The Job Runner only serves the binaries; agents
+// verify them with the public key of the key that signed them.
+type UpdateChannel struct {
+	Version     string // version that agents upgrade to
+	Dir         string // directory of binaries and signatures
+	MaxUpgrades uint   // max agents upgrading at once, 0 = no limit
+}
+
+// BinaryName returns the file name of the binary for a version, OS, and
+// architecture.
+func BinaryName(version, goos, goarch string) string {
+	return fmt.Sprintf("spincycle-agent-%s-%s-%s", version, goos, goarch)
+}
+
+// Binary returns the path of the binary for a version, OS, and architecture,
+// and its signature.
+func (c *UpdateChannel) Binary(version, goos, goarch string) (string, []byte, error) {
+	name := BinaryName(version, goos, goarch)
+	if filepath.Base(name) != name {
+		return "", nil, fmt.Errorf("invalid binary name %s", name)
+	}
+	path := filepath.Join(c.Dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", nil, err
+	}
+	sig, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return "", nil, err
+	}
+	return path, sig, nil
+}
+
+// offer returns the upgrade for an agent, or nil if it doesn't need one or
+// there's no binary for its OS and architecture.
+func (c *UpdateChannel) offer(a proto.Agent) *proto.AgentUpgrade {
+	if CompareVersions(a.Version, c.Version) >= 0 {
+		return nil
+	}
+	_, sig, err := c.Binary(c.Version, a.OS, a.Arch)
+	if err != nil {
+		return nil
+	}
+	return &proto.AgentUpgrade{
+		Version:   c.Version,
+		Path:      "agents/updates/" + BinaryName(c.Version, a.OS, a.Arch),
+		Signature: sig,
+	}
+}
+
+// -------------------------------------------------------------------------- //
+
+// Install verifies the signature of a new spincycle-agent binary with key, and
+// replaces the binary at path with it. The old binary is replaced atomically,
+// so it's either the old or the new binary if Install fails.
+func Install(bin, sig []byte, key ed25519.PublicKey, path string) error {
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, bin, sig) {
+		return ErrBadSignature
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".spincycle-agent-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // after a successful rename, it doesn't exist
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,196 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"v2.0", "1.9.9", 1},
+		{"", "0.0.1", -1},
+	}
+	for _, test := range tests {
+		if got := CompareVersions(test.a, test.b); got != test.expect {
+			t.Errorf("CompareVersions(%q, %q) = %d, expected %d", test.a, test.b, got, test.expect)
+		}
+	}
+
+	r := VersionRange{Min: "1.0.0", Max: "1.2.0"}
+	for v, expect := range map[string]bool{"0.9.0": false, "1.0.0": true, "1.2.0": true, "1.2.1": false} {
+		if r.Contains(v) != expect {
+			t.Errorf("%s: Contains = %t, expected %t", v, !expect, expect)
+		}
+	}
+}
+
+// Incompatible agents register but don't get work.
+func TestIncompatibleAgent(t *testing.T) {
+	r := NewRegistry()
+	for _, version := range []string{"", "0.9.0", "99.0.0"} {
+		reg, err := r.Register(proto.Agent{Name: "host1", Pool: "db", Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.Compatible || reg.Version != VERSION {
+			t.Errorf("%s: registration = %+v, expected not compatible", version, reg)
+		}
+		if _, _, err := r.Next(context.Background(), "host1", time.Millisecond); err != ErrIncompatibleAgent {
+			t.Errorf("%s: err = %v, expected %s", version, err, ErrIncompatibleAgent)
+		}
+	}
+	if agents := r.Agents(); agents[0].Compatible {
+		t.Error("agent is compatible, expected not")
+	}
+}
+
+// updateDir makes an update channel directory with a signed binary for
+// version 9.0.0 on linux-amd64.
+func updateDir(t *testing.T) (string, ed25519.PrivateKey, ed25519.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "spincycle-agent-updates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := []byte("new agent binary")
+	path := filepath.Join(dir, BinaryName("9.0.0", "linux", "amd64"))
+	if err := ioutil.WriteFile(path, bin, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".sig", ed25519.Sign(priv, bin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, priv, pub
+}
+
+func TestUpdateChannel(t *testing.T) {
+	dir, _, _ := updateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry()
+	r.SetUpdateChannel(&UpdateChannel{Version: "9.0.0", Dir: dir, MaxUpgrades: 1})
+	a := proto.Agent{Name: "host1", Pool: "db", Version: VERSION, OS: "linux", Arch: "amd64"}
+
+	reg, _ := r.Register(a)
+	if reg.Upgrade == nil {
+		t.Fatal("no upgrade, expected an upgrade to 9.0.0")
+	}
+	if reg.Upgrade.Version != "9.0.0" || reg.Upgrade.Path != "agents/updates/spincycle-agent-9.0.0-linux-amd64" || len(reg.Upgrade.Signature) == 0 {
+		t.Errorf("upgrade = %+v, expected the 9.0.0 linux-amd64 binary", reg.Upgrade)
+	}
+	if path, err := r.Binary("spincycle-agent-9.0.0-linux-amd64"); err != nil || path == "" {
+		t.Errorf("got %q, %v, expected the binary", path, err)
+	}
+	for _, name := range []string{"../spincycle-agent-9.0.0-linux-amd64", "other", "spincycle-agent-1.0.0-linux-amd64"} {
+		if _, err := r.Binary(name); err == nil {
+			t.Errorf("%s: err = nil, expected an error", name)
+		}
+	}
+
+	// Only one agent upgrades at once, and agents without a binary for their
+	// OS don't upgrade
+	b := a
+	b.Name = "host2"
+	if reg, _ := r.Register(b); reg.Upgrade != nil {
+		t.Error("host2 got an upgrade while host1 is upgrading")
+	}
+	if reg, _ := r.Register(a); reg.Upgrade == nil {
+		t.Error("host1 did not get the upgrade again")
+	}
+	c := a
+	c.Name, c.OS = "host3", "darwin"
+	if reg, _ := r.Register(c); reg.Upgrade != nil {
+		t.Error("host3 got an upgrade for linux")
+	}
+
+	// When host1 is upgraded, host2 can upgrade
+	a.Version = "9.0.0"
+	if reg, _ := r.Register(a); reg.Upgrade != nil {
+		t.Error("host1 got an upgrade for the version it has")
+	}
+	if reg, _ := r.Register(b); reg.Upgrade == nil {
+		t.Error("host2 did not get an upgrade after host1 upgraded")
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir, priv, pub := updateDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "spincycle-agent")
+	if err := ioutil.WriteFile(path, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := []byte("new")
+	if err := Install(bin, ed25519.Sign(priv, []byte("other")), pub, path); err != ErrBadSignature {
+		t.Errorf("err = %v, expected %s", err, ErrBadSignature)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "old" {
+		t.Errorf("binary = %q after a bad signature, expected old", got)
+	}
+
+	if err := Install(bin, ed25519.Sign(priv, bin), pub, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "new" {
+		t.Errorf("binary = %q, expected new", got)
+	}
+	if fi, _ := os.Stat(path); fi.Mode()&0111 == 0 {
+		t.Errorf("mode = %s, expected executable", fi.Mode())
+	}
+}
+
+// The worker upgrades when it's offered an upgrade, and Run returns true.
+func TestWorkerUpgrade(t *testing.T) {
+	dir, _, pub := updateDir(t)
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry()
+	r.SetUpdateChannel(&UpdateChannel{Version: "9.0.0", Dir: dir})
+	a := proto.Agent{Name: "host1", Pool: "db", Version: VERSION, OS: "linux", Arch: "amd64"}
+	jr := registryClient{r}
+	w := NewWorker(a, jr, &mock.RunnerFactory{})
+
+	exe := filepath.Join(dir, "spincycle-agent")
+	w.Upgrade = func(u proto.AgentUpgrade) error {
+		bin, err := jr.Download(u.Path)
+		if err != nil {
+			return err
+		}
+		return Install(bin, u.Signature, pub, exe)
+	}
+
+	upgraded := make(chan bool)
+	go func() { upgraded <- w.Run(make(chan struct{})) }()
+	select {
+	case ok := <-upgraded:
+		if !ok {
+			t.Error("Run returned false, expected true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return")
+	}
+	if got, _ := ioutil.ReadFile(exe); string(got) != "new agent binary" {
+		t.Errorf("binary = %q, expected the new binary", got)
+	}
+}
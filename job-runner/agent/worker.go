@@ -0,0 +1,232 @@
+// Copyright 2017, Square, Inc.
+
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A Worker is the main loop of a spincycle-agent: it registers the agent with
+// the Job Runner, asks it for work, runs the jobs, and sends updates for them.
+//
+// The agent registers again every RegisterInterval. If the Job Runner offers
+// an upgrade in the registration (see UpdateChannel) and Upgrade is set, the
+// worker stops getting work, waits for running jobs to finish, and calls
+// Upgrade. An agent with a version that is not compatible with the Job Runner
+// only registers, waiting for an upgrade.
+type Worker struct {
+	Agent            proto.Agent
+	MaxJobs          uint          // max jobs running at once, 0 = 1
+	Wait             time.Duration // how long each request for work waits (long poll)
+	UpdateInterval   time.Duration // how often to send updates for running jobs
+	RegisterInterval time.Duration // how often to register again (version handshake)
+	RetryWait        time.Duration // wait after an error talking to the Job Runner
+	StopGrace        time.Duration // on stop, max time for running jobs to stop
+
+	// Upgrade installs an upgrade, nil to never upgrade. If it returns nil,
+	// Run returns true and the agent must restart to run the new version.
+	Upgrade func(proto.AgentUpgrade) error
+
+	jr client.AgentClient
+	rf runner.RunnerFactory
+}
+
+// NewWorker makes a Worker for the agent that gets work from jr and makes
+// runners for its jobs with rf.
+func NewWorker(a proto.Agent, jr client.AgentClient, rf runner.RunnerFactory) *Worker {
+	return &Worker{
+		Agent:            a,
+		MaxJobs:          1,
+		Wait:             30 * time.Second,
+		UpdateInterval:   5 * time.Second,
+		RegisterInterval: 5 * time.Minute,
+		RetryWait:        5 * time.Second,
+		StopGrace:        10 * time.Second,
+		jr:               jr,
+		rf:               rf,
+	}
+}
+
+// Run runs the worker until stopChan is closed, then stops running jobs and
+// returns false when they're done. It returns true if the agent was upgraded.
+func (w *Worker) Run(stopChan <-chan struct{}) bool {
+	max := w.MaxJobs
+	if max == 0 {
+		max = 1
+	}
+	slots := make(chan struct{}, max)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	var registered time.Time // zero if not registered
+	for {
+		select {
+		case <-stopChan:
+			return false
+		default:
+		}
+
+		if registered.IsZero() || now().Sub(registered) > w.RegisterInterval {
+			reg, err := w.jr.Register(w.Agent)
+			if err != nil {
+				log.Errorf("Can't register agent %s: %s", w.Agent.Name, err)
+				w.sleep(w.RetryWait, stopChan)
+				continue
+			}
+			registered = now()
+
+			if reg.Upgrade != nil && w.Upgrade != nil {
+				log.Infof("Upgrading agent %s from version %s to %s when running jobs are done.",
+					w.Agent.Name, w.Agent.Version, reg.Upgrade.Version)
+				wg.Wait()
+				select {
+				case <-stopChan:
+					return false
+				default:
+				}
+				if err := w.Upgrade(*reg.Upgrade); err != nil {
+					log.Errorf("Can't upgrade agent %s to version %s: %s", w.Agent.Name, reg.Upgrade.Version, err)
+				} else {
+					return true
+				}
+			}
+
+			if !reg.Compatible {
+				log.Errorf("Agent %s version %s is not compatible with Job Runner version %s, waiting for an upgrade.",
+					w.Agent.Name, w.Agent.Version, reg.Version)
+				registered = time.Time{}
+				w.sleep(w.RegisterInterval, stopChan)
+				continue
+			}
+		}
+
+		select {
+		case <-stopChan:
+			return false
+		case slots <- struct{}{}:
+		}
+
+		work, ok, err := w.jr.Next(w.Agent.Name, w.Wait)
+		if err != nil {
+			registered = time.Time{}
+			<-slots
+			if e, ok := err.(proto.Error); ok && e.Code == proto.ERR_AGENT_NOT_FOUND {
+				// The Job Runner restarted and forgot the agent.
+				log.Infof("Job Runner doesn't know agent %s, registering it again.", w.Agent.Name)
+				continue
+			}
+			log.Errorf("Can't get work for agent %s: %s", w.Agent.Name, err)
+			w.sleep(w.RetryWait, stopChan)
+			continue
+		}
+		if !ok {
+			<-slots
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			w.run(work, stopChan)
+		}()
+	}
+}
+
+// -------------------------------------------------------------------------- //
+
+// run runs one job and sends updates for it until it's done.
+func (w *Worker) run(work proto.AgentWork, stopChan <-chan struct{}) {
+	jobData := work.JobData
+	if jobData == nil {
+		jobData = map[string]interface{}{}
+	}
+
+	jr, err := w.rf.Make(work.Job, work.RequestId)
+	if err != nil {
+		log.Errorf("[chain=%d,job=%s]: Can't make job runner: %s", work.RequestId, work.Job.Name, err)
+		w.update(work, proto.AgentUpdate{
+			Status:   "can't make job runner: " + err.Error(),
+			Progress: -1,
+			Done:     true,
+			State:    proto.STATE_FAIL,
+		})
+		return
+	}
+
+	stateChan := make(chan byte, 1)
+	go func() {
+		stateChan <- jr.Run(jobData)
+	}()
+
+	ticker := time.NewTicker(w.UpdateInterval)
+	defer ticker.Stop()
+	offset := 0
+	stopped := false
+	for {
+		select {
+		case state := <-stateChan:
+			out, _, _, _ := jr.Log().Read(offset)
+			w.update(work, proto.AgentUpdate{
+				Status:   jr.Status(),
+				Progress: jr.Progress(),
+				Log:      string(out),
+				Done:     true,
+				State:    state,
+				JobData:  jobData,
+			})
+			return
+		case <-stopChan:
+			if !stopped {
+				stopped = true
+				go jr.Stop(w.StopGrace)
+			}
+			stopChan = nil // don't select it again
+		case <-ticker.C:
+			out, next, _, _ := jr.Log().Read(offset)
+			res, err := w.jr.Update(w.Agent.Name, work.Id, proto.AgentUpdate{
+				Status:   jr.Status(),
+				Progress: jr.Progress(),
+				Log:      string(out),
+			})
+			if err != nil {
+				log.Errorf("[chain=%d,job=%s]: Can't send update: %s", work.RequestId, work.Job.Name, err)
+				continue // send the log output again next time
+			}
+			offset = next
+			if res.Stop && !stopped {
+				log.Infof("[chain=%d,job=%s]: Job Runner stopped the job.", work.RequestId, work.Job.Name)
+				stopped = true
+				go jr.Stop(w.StopGrace)
+			}
+		}
+	}
+}
+
+// update sends the last update for a job, retrying a few times because the
+// Job Runner waits for it.
+func (w *Worker) update(work proto.AgentWork, u proto.AgentUpdate) {
+	for try := 1; try <= 3; try++ {
+		_, err := w.jr.Update(w.Agent.Name, work.Id, u)
+		if err == nil {
+			return
+		}
+		log.Errorf("[chain=%d,job=%s]: Can't send final update (try %d): %s", work.RequestId, work.Job.Name, try, err)
+		time.Sleep(w.RetryWait)
+	}
+}
+
+// sleep waits d or until stopChan is closed.
+func (w *Worker) sleep(d time.Duration, stopChan <-chan struct{}) {
+	select {
+	case <-time.After(d):
+	case <-stopChan:
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/agent"
+	"github.com/square/spincycle/job-runner/payload"
+	"github.com/square/spincycle/proto"
+)
+
+const (
+	DEFAULT_AGENT_WAIT = 30 * time.Second
+	MAX_AGENT_WAIT     = 5 * time.Minute
+)
+
+// POST <API_ROOT>/agents
+// Register a spincycle-agent. The body is a proto.Agent. An agent registers
+// when it starts, before asking for work, and periodically after. The response
+// is a proto.AgentRegistration: the version handshake.
+//
+// GET <API_ROOT>/agents
+// List the registered agents sorted by name.
+func (api *API) agentsHandler(ctx router.HTTPContext) {
+	if api.Agents == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_AGENTS_DISABLED, "Agents are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "POST":
+		var a proto.Agent
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&a); err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't decode agent (error: %s)", err)
+			return
+		}
+		reg, err := api.Agents.Register(a)
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't register agent (error: %s)", err)
+			return
+		}
+		if out, err := marshal(reg); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	case "GET":
+		if out, err := marshal(api.Agents.Agents()); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/agents/{name}/work[?wait=30s]
+// Get the next job for an agent to run, waiting up to wait (long poll) for one.
+// The response is a proto.AgentWork, or 204 No Content if there's no work. It's
+// encoded with the payload options in the X-Spincycle-Payload header, if any.
+func (api *API) agentWorkHandler(ctx router.HTTPContext) {
+	if api.Agents == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_AGENTS_DISABLED, "Agents are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "GET":
+		agentName := ctx.Arguments[1]
+		codec, ok := api.agentCodec(ctx, agentName)
+		if !ok {
+			return
+		}
+
+		wait := DEFAULT_AGENT_WAIT
+		if v := ctx.Request.URL.Query().Get("wait"); v != "" {
+			var err error
+			if wait, err = time.ParseDuration(v); err != nil || wait < 0 || wait > MAX_AGENT_WAIT {
+				ctx.APIError(router.ErrInvalidParam, "Invalid wait: %s", v)
+				return
+			}
+		}
+
+		work, ok, err := api.Agents.Next(ctx.Request.Context(), agentName, wait)
+		if err == agent.ErrUnknownAgent {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_AGENT_NOT_FOUND, "%s (agent: %s)", err, agentName)
+			return
+		}
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't get work (error: %s)", err)
+			return
+		}
+		if !ok {
+			ctx.Response.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		writeAgentResponse(ctx, codec, work)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// POST <API_ROOT>/agents/{name}/work/{id}
+// Send an update for work running on an agent. The body is a
+// proto.AgentUpdate, and the response is a proto.AgentUpdateResponse that
+// tells the agent to stop the job if the job was stopped. Both are encoded with
+// the payload options in the X-Spincycle-Payload header, if any.
+func (api *API) agentUpdateHandler(ctx router.HTTPContext) {
+	if api.Agents == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_AGENTS_DISABLED, "Agents are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "POST":
+		agentName := ctx.Arguments[1]
+		workId := ctx.Arguments[2]
+		codec, ok := api.agentCodec(ctx, agentName)
+		if !ok {
+			return
+		}
+
+		var u proto.AgentUpdate
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err == nil {
+			body, err = codec.Decode(body)
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &u)
+		}
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't decode update (error: %s)", err)
+			return
+		}
+
+		res, err := api.Agents.Update(agentName, workId, u)
+		if err == agent.ErrUnknownAgent || err == agent.ErrUnknownWork {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_AGENT_NOT_FOUND, "%s (agent: %s, work: %s)", err, agentName, workId)
+			return
+		}
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't update work (error: %s)", err)
+			return
+		}
+
+		writeAgentResponse(ctx, codec, res)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/agents/updates/{binary}
+// Download a spincycle-agent binary from the update channel. Agents are told
+// which one in their registration, and verify its signature before installing
+// it.
+func (api *API) agentUpdatesHandler(ctx router.HTTPContext) {
+	if api.Agents == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_AGENTS_DISABLED, "Agents are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "GET":
+		path, err := api.Agents.Binary(ctx.Arguments[1])
+		if err != nil {
+			ctx.APIError(router.ErrNotFound, "No such binary: %s", ctx.Arguments[1])
+			return
+		}
+		ctx.Response.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(ctx.Response, ctx.Request, path)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// agentCodec returns the payload codec of the options in the
+// X-Spincycle-Payload header of a request from an agent. If the agent is
+// unknown, the options aren't supported, or its pool encrypts payloads and the
+// options don't, it writes the error and returns false.
+func (api *API) agentCodec(ctx router.HTTPContext, agentName string) (payload.Codec, bool) {
+	options := payload.ParseOptions(ctx.Request.Header.Get(payload.HEADER))
+	codec, err := api.Agents.Codec(agentName, options)
+	if err == agent.ErrUnknownAgent {
+		ctx.APIErrorCode(router.ErrNotFound, proto.ERR_AGENT_NOT_FOUND, "%s (agent: %s)", err, agentName)
+		return codec, false
+	}
+	if err != nil {
+		ctx.APIError(router.ErrBadRequest, "Unsupported payload options %v (error: %s)", options, err)
+		return codec, false
+	}
+	return codec, true
+}
+
+// writeAgentResponse writes a response to an agent encoded with the codec.
+func writeAgentResponse(ctx router.HTTPContext, codec payload.Codec, v interface{}) {
+	out, err := marshal(v)
+	if err != nil {
+		ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		return
+	}
+	if codec.Plain() {
+		fmt.Fprintln(ctx.Response, string(out))
+		return
+	}
+	if out, err = codec.Encode(out); err != nil {
+		ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		return
+	}
+	ctx.Response.Header().Set(payload.HEADER, codec.Header())
+	ctx.Response.Header().Set("Content-Type", "application/octet-stream")
+	ctx.Response.Write(out)
+}
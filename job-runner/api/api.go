@@ -6,144 +6,739 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/agent"
 	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/job-runner/deadletter"
 	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/job-runner/schedule"
 	"github.com/square/spincycle/proto"
-	"github.com/square/spincycle/router"
+	"github.com/square/spincycle/trace"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 const (
 	API_ROOT           = "/api/v1/"
+	API_ROOT_V2        = "/api/v2/"
 	REQUEST_ID_PATTERN = "([0-9]+)"
+	DEFAULT_STOP_GRACE = 10 * time.Second
+
+	// MAX_BULK_STATUS is the max number of chains in one call for the status
+	// of many chains.
+	MAX_BULK_STATUS = 100
 )
 
+// API_VERSIONS are the API versions served at the same time. Every route is
+// served by every version, with the same handler, until a version makes a
+// breaking change: then the handler checks HTTPContext.Version. Clients ask
+// for a version by the path, like API_ROOT_V2, or by their Accept header on
+// /api/ without a version (see router.Versions).
+var API_VERSIONS = router.Versions{
+	Prefix:    "/api/",
+	Supported: []string{"v1", "v2"},
+	Default:   "v1",
+}
+
+// CONTROL_ROUTES are the routes that create, start, stop, retry, and delete
+// chains (see RequireAuth).
+var CONTROL_ROUTES = []string{
+	"api-new-job-chain",
+	"api-batch-job-chains",
+	"api-start-job-chain",
+	"api-stop-job-chain",
+	"api-retry-job-chain",
+	"DELETE api-job-chain",
+}
+
+// OPERATOR_ROLES are the roles of callers that can call CONTROL_ROUTES when
+// RequireAuth is used: operators, like the Request Manager, automation
+// accounts acting on behalf of operators, and admins.
+var OPERATOR_ROLES = []string{"operator", "automation", "admin"}
+
+// RequireAuth maps CONTROL_ROUTES to OPERATOR_ROLES, so only callers with one
+// of the roles can control chains. Anonymous callers get 401 Unauthorized.
+func RequireAuth(roles router.RoleAuthorizer) {
+	for _, route := range CONTROL_ROUTES {
+		roles[route] = OPERATOR_ROLES
+	}
+}
+
 // API provides controllers for endpoints it registers with a router.
 type API struct {
-	Router        *router.Router
-	chainRepo     chain.Repo
-	runnerFactory runner.RunnerFactory
-	traverserRepo chain.TraverserRepo // Repo for keeping track of active traversers
+	Router         *router.Router
+	Strict         bool                 // Reject job chains with unknown fields, duplicate jobs, etc.
+	StopGrace      time.Duration        // Default time for jobs to stop when a chain is stopped
+	Agents         *agent.Registry      // Agents that run jobs on their hosts, nil if not enabled
+	Callbacks      *Callbacks           // Sends callbacks to chains' callback URLs, nil if not enabled
+	JobDocs        map[string]job.Doc   // Job type => its documentation (see job.Describe), served at job-types
+	AuditLogger    AuditLogger          // Records control actions on chains, nil if not enabled
+	Hooks          chain.Hooks          // Called by every traverser as its chain runs, nil if none
+	Artifacts      runner.ArtifactStore // Artifacts output by jobs, nil if not enabled
+	DeadLetters    *deadletter.Store    // What couldn't be delivered, until an admin retries or discards it, nil if not kept
+	chainRepo      chain.Repo
+	runnerFactory  runner.RunnerFactory
+	limiter        chain.Limiter       // Limits jobs running at once across all chains
+	traverserRepo  chain.TraverserRepo // Repo for keeping track of active traversers
+	scheduler      *schedule.Scheduler // Starts chains started with a future time
+	queue          *chain.Queue        // Limits chains running at once
+	finishedChains *finishedChains     // Results of chains that are done running
+	shutdownChan   chan struct{}       // Closed by Shutdown
+	startTime      time.Time           // When the API was made, for uptime
+	shutdownOnce   *sync.Once
+	newChainMux    *sync.Mutex // Serializes new chains to detect resubmissions
 }
 
 var hostname func() (string, error) = os.Hostname
 
-// NewAPI makes a new API.
-func NewAPI(router *router.Router, chainRepo chain.Repo, runnerFactory runner.RunnerFactory) *API {
+// expiredChains is the number of chains evicted because they were never started.
+var expiredChains = expvar.NewInt("expiredChains")
+
+// NewAPI makes a new API. The limiter is shared by all traversers to limit jobs
+// running at once across all chains. There is no limit on chains running at
+// once until SetMaxRunningChains is called.
+func NewAPI(router *router.Router, chainRepo chain.Repo, runnerFactory runner.RunnerFactory, limiter chain.Limiter) *API {
 	api := &API{
-		Router:        router,
-		chainRepo:     chainRepo,
-		runnerFactory: runnerFactory,
-		traverserRepo: chain.NewTraverserRepo(),
+		Router:         router,
+		StopGrace:      DEFAULT_STOP_GRACE,
+		JobDocs:        map[string]job.Doc{},
+		Callbacks:      NewCallbacks(),
+		DeadLetters:    deadletter.NewStore(),
+		chainRepo:      chainRepo,
+		runnerFactory:  runnerFactory,
+		limiter:        limiter,
+		traverserRepo:  chain.NewTraverserRepo(),
+		queue:          chain.NewQueue(0),
+		finishedChains: newFinishedChains(DEFAULT_MAX_FINISHED_CHAINS),
+		shutdownChan:   make(chan struct{}),
+		startTime:      time.Now(),
+		shutdownOnce:   &sync.Once{},
+		newChainMux:    &sync.Mutex{},
 	}
+	api.scheduler = schedule.NewScheduler(api.startScheduledChain)
+	versions := API_VERSIONS
+	api.Router.Versions = &versions
 
-	api.Router.AddRoute(API_ROOT+"job-chains", api.newJobChainHandler, "api-new-job-chain")
-	api.Router.AddRoute(API_ROOT+"job-chains/"+REQUEST_ID_PATTERN+"/start", api.startJobChainHandler, "api-start-job-chain")
-	api.Router.AddRoute(API_ROOT+"job-chains/"+REQUEST_ID_PATTERN+"/stop", api.stopJobChainHandler, "api-stop-job-chain")
-	api.Router.AddRoute(API_ROOT+"job-chains/"+REQUEST_ID_PATTERN+"/status", api.statusJobChainHandler, "api-status-job-chain")
+	api.addRoute("job-chains", api.audited("POST", AUDIT_NEW, api.jobChainsHandler), "api-new-job-chain")
+	api.addRoute("job-chains/validate", api.validateJobChainHandler, "api-validate-job-chain")
+	api.addRoute("job-chains/batch", api.batchJobChainsHandler, "api-batch-job-chains")
+	api.addRoute("job-chains/stop-all", api.audited("PUT", AUDIT_STOP_ALL, api.stopAllJobChainsHandler), "api-stop-all-job-chains")
+	api.addRoute("job-chains/quarantined", api.quarantinedJobChainsHandler, "api-quarantined-job-chains")
+	api.addRoute("job-chains/status", api.bulkStatusJobChainsHandler, "api-bulk-status-job-chains")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN, api.audited("DELETE", AUDIT_DELETE, api.jobChainHandler), "api-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/start", api.audited("PUT", AUDIT_START, api.startJobChainHandler), "api-start-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/stop", api.audited("PUT", AUDIT_STOP, api.stopJobChainHandler), "api-stop-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/recover", api.audited("PUT", AUDIT_RECOVER, api.recoverJobChainHandler), "api-recover-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/retry", api.audited("PUT", AUDIT_RETRY, api.retryJobChainHandler), "api-retry-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/status", api.audited("GET", AUDIT_STATUS, api.statusJobChainHandler), "api-status-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/report", api.reportJobChainHandler, "api-report-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/result", api.resultJobChainHandler, "api-result-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/status/ws", api.statusWebSocketHandler, "api-status-ws-job-chain")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/jobs/{}/log", api.logJobHandler, "api-log-job")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/jobs/{}/explain", api.explainJobHandler, "api-explain-job")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/jobs/{}/artifacts", api.jobArtifactsHandler, "api-job-artifacts")
+	api.addRoute("job-chains/"+REQUEST_ID_PATTERN+"/jobs/{}/artifacts/{}", api.jobArtifactHandler, "api-job-artifact")
+	api.addRoute("job-types", api.jobTypesHandler, "api-job-types")
+	api.addRoute("dead-letters", api.deadLettersHandler, "api-dead-letters")
+	api.addRoute("dead-letters/{}", api.deadLetterHandler, "api-dead-letter")
+	api.addRoute("dead-letters/{}/retry", api.retryDeadLetterHandler, "api-retry-dead-letter")
+	api.addRoute("job-types/{}", api.jobTypeHandler, "api-job-type")
+	api.addRoute("health", api.healthHandler, "api-health")
+	api.addRoute("ready", api.readyHandler, "api-ready")
+	api.addRoute("agents", api.agentsHandler, "api-agents")
+	api.addRoute("agents/{}/work", api.agentWorkHandler, "api-agent-work")
+	api.addRoute("agents/{}/work/{}", api.agentUpdateHandler, "api-agent-update")
+	api.addRoute("agents/updates/{}", api.agentUpdatesHandler, "api-agent-updates")
+	api.addRoute("versions", api.versionsHandler, "api-versions")
 
 	return api
 }
 
+// addRoute adds a route, a path relative to the API root, to every API version.
+func (api *API) addRoute(path string, handler func(router.HTTPContext), name string) {
+	for _, v := range api.Router.Versions.Supported {
+		api.Router.AddRoute(api.Router.Versions.Prefix+v+"/"+path, handler, name)
+	}
+}
+
 // ============================== CONTROLLERS ============================== //
 
+// GET <API_ROOT>/versions
+// List the API versions that the Job Runner serves (proto.APIVersions). This
+// is also served at /api/versions.
+func (api *API) versionsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		versions := proto.APIVersions{
+			Versions: api.Router.Versions.Supported,
+			Default:  api.Router.Versions.Default,
+			Current:  ctx.Version,
+		}
+		if out, err := marshal(versions); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains[?metadata=key=value...]
+// List a summary of every job chain in the chain repo, sorted by request ID.
+// If metadata is given, only chains with all of the metadata are listed.
+//
 // POST <API_ROOT>/job-chains
 // Do some basic validation on a job chain, and, if it passes, add it to the
-// chain repo. If it doesn't pass, return the validation error.
-func (api *API) newJobChainHandler(ctx router.HTTPContext) {
+// chain repo. A traceparent (or OpenTracing) header puts the chain in the
+// caller's distributed trace. If it doesn't pass, return the validation error.
+// If the chain repo already has a chain for the request, nothing is added: if
+// it's the same chain (e.g. the Request Manager retried), return the existing
+// chain, else return 409 Conflict.
+func (api *API) jobChainsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		chains, err := api.chainRepo.GetAll()
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't retrieve chains from repo (error: %s).", err)
+			return
+		}
+
+		filter := map[string]string{}
+		for _, kv := range ctx.Request.URL.Query()["metadata"] {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) != 2 || p[0] == "" {
+				ctx.APIError(router.ErrBadRequest, "Invalid metadata filter %q, expected key=value.", kv)
+				return
+			}
+			filter[p[0]] = p[1]
+		}
+
+		summaries := make([]proto.JobChainSummary, 0, len(chains))
+	CHAINS:
+		for _, c := range chains {
+			summary := c.Summary()
+			summary.Queued = api.queue.Position(summary.RequestId)
+			for k, v := range filter {
+				if summary.Metadata[k] != v {
+					continue CHAINS
+				}
+			}
+			summaries = append(summaries, summary)
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			return summaries[i].RequestId < summaries[j].RequestId
+		})
+
+		if out, err := marshal(summaries); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	case "POST":
+		if api.shuttingDown() {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_SHUTTING_DOWN, "Job Runner is shutting down, not accepting new chains.")
+			return
+		}
+
+		var jobChain proto.JobChain
+		var err error
+		if api.Strict {
+			jobChain, err = decodeJobChainStrict(ctx.Request.Body)
+		} else {
+			jobChain, err = decodeJobChain(ctx.Request.Body)
+		}
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Invalid job chain (error: %s)", err)
+			return
+		}
+
+		api.newChainMux.Lock()
+		defer api.newChainMux.Unlock()
+
+		existing, cerr := api.addChain(jobChain, ctx.Request.Header, false)
+		if cerr != nil {
+			ctx.APIErrorCode(cerr.errorType, cerr.code, "%s", cerr.message)
+			return
+		}
+		if existing != nil {
+			if out, err := marshal(existing); err != nil {
+				ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+			} else {
+				fmt.Fprintln(ctx.Response, string(out))
+			}
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// newChainError is why a new chain can't be added: the router error type and
+// proto.ERR_* code of the API error, and its message.
+type newChainError struct {
+	errorType string
+	code      string
+	message   string
+}
+
+// addChain validates a new chain and adds it to the chain repo with a new
+// traverser in the traverser repo. If the chain repo already has the same
+// chain (e.g. the Request Manager retried), nothing is added and the existing
+// chain's definition is returned. If checkOnly is true, nothing is added
+// either: it only returns the error adding the chain would. The caller must
+// hold newChainMux.
+func (api *API) addChain(jobChain proto.JobChain, header http.Header, checkOnly bool) (*proto.JobChain, *newChainError) {
+	// Reject a bad graph with a description of what's wrong.
+	if err := chain.Validate(jobChain); err != nil {
+		return nil, &newChainError{router.ErrBadRequest, proto.ERR_INVALID_DAG, fmt.Sprintf("Invalid job chain (error: %s)", err)}
+	}
+
+	c := chain.NewChain(&jobChain)
+	requestIdStr := strconv.FormatUint(uint64(c.RequestId()), 10)
+
+	// Put the chain in the caller's trace. This is done after the chain
+	// is hashed because a retry of the request is a different span.
+	if c.JobChain.Traceparent == "" {
+		if sc, ok := trace.FromHeaders(header); ok {
+			c.JobChain.Traceparent = sc.Traceparent()
+		}
+	}
+
+	if existing, err := api.chainRepo.Get(c.RequestId()); err == nil {
+		if existing.Hash != c.Hash {
+			return nil, &newChainError{router.ErrConflict, proto.ERR_CHAIN_EXISTS, fmt.Sprintf("Chain %s already exists and is different.", requestIdStr)}
+		}
+		jc := existing.Definition()
+		return &jc, nil
+	}
+	if checkOnly {
+		return nil, nil
+	}
+
+	// Create a new traverser.
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c, api.Hooks)
+	if err != nil {
+		return nil, &newChainError{router.ErrBadRequest, proto.ERR_INVALID_DAG, fmt.Sprintf("Problem creating traverser (error: %s)", err)}
+	}
+
+	// Add the traverser to the repo.
+	if err := api.traverserRepo.Add(requestIdStr, traverser); err != nil {
+		return nil, &newChainError{router.ErrBadRequest, proto.ERR_BAD_REQUEST, err.Error()}
+	}
+	return nil, nil
+}
+
+// POST <API_ROOT>/job-chains/validate
+// Dry-run a job chain: check that it's valid and that every job can be made
+// and re-created, and report the order in which the jobs would run. Nothing is
+// run and the chain is not kept. The response is a proto.JobChainDryRun, which
+// is not valid if the chain can't run.
+func (api *API) validateJobChainHandler(ctx router.HTTPContext) {
 	switch ctx.Request.Method {
 	case "POST":
-		decoder := json.NewDecoder(ctx.Request.Body)
 		var jobChain proto.JobChain
-		err := decoder.Decode(&jobChain)
+		var err error
+		if api.Strict {
+			jobChain, err = decodeJobChainStrict(ctx.Request.Body)
+		} else {
+			jobChain, err = decodeJobChain(ctx.Request.Body)
+		}
 		if err != nil {
-			ctx.APIError(router.ErrInternal, "Can't decode request body (error: %s)", err)
+			ctx.APIError(router.ErrBadRequest, "Invalid job chain (error: %s)", err)
 			return
 		}
 
-		c := chain.NewChain(&jobChain)
-		requestIdStr := strconv.FormatUint(uint64(c.RequestId()), 10)
+		dryRun := chain.DryRun(ctx.Request.Context(), jobChain, api.runnerFactory)
+		if ctx.Request.Context().Err() != nil {
+			return // client went away
+		}
+		if out, err := marshal(dryRun); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}
+// Get a job chain from the chain repo: its definition and the state of the
+// chain and its jobs. Unlike /status, this works after the chain is done
+// running, so it returns the chain's final state.
+//
+// DELETE <API_ROOT>/job-chains/{requestId}
+// Remove a job chain that hasn't been started. A chain that was started can't
+// be removed; stop it instead.
+func (api *API) jobChainHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
 
-		// Create a new traverser.
-		traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, c)
+		// Get the chain from the repo.
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
 		if err != nil {
-			ctx.APIError(router.ErrBadRequest, "Problem creating traverser (error: %s)", err)
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve chain from repo (error: %s).", err.Error())
 			return
 		}
 
-		// Add the traverser to the repo.
-		err = api.traverserRepo.Add(requestIdStr, traverser)
+		if out, err := marshal(c.Definition()); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	case "DELETE":
+		requestIdStr := ctx.Arguments[1]
+
+		// Get the chain from the repo.
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
 		if err != nil {
-			ctx.APIError(router.ErrBadRequest, err.Error())
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve chain from repo (error: %s).", err.Error())
 			return
 		}
+
+		// Only pending chains can be deleted. Once deleted, the chain can't
+		// be started, even by a start request that already got its traverser.
+		if !c.Delete() {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_ALREADY_STARTED, "Can't delete the chain because it is %s.", proto.StateName[c.State()])
+			return
+		}
+
+		api.scheduler.Cancel(c.RequestId())
+		api.queue.Cancel(c.RequestId())
+		api.traverserRepo.Remove(requestIdStr)
+		api.chainRepo.Remove(c.RequestId())
 	default:
 		ctx.UnsupportedAPIMethod()
 	}
 }
 
-// PUT <API_ROOT>/job-chains/{requestId}/start
-// Start the traverser for a job chain.
+// PUT <API_ROOT>/job-chains/{requestId}/start[?at=2017-06-01T15:04:05Z]
+// Start the traverser for a job chain. If at (RFC 3339) is in the future, the
+// chain is scheduled to start then instead; starting it again reschedules it,
+// or starts it now if at isn't given.
 func (api *API) startJobChainHandler(ctx router.HTTPContext) {
 	switch ctx.Request.Method {
 	case "PUT":
+		if api.shuttingDown() {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_SHUTTING_DOWN, "Job Runner is shutting down, not starting chains.")
+			return
+		}
+
 		requestIdStr := ctx.Arguments[1]
 
+		var startAt time.Time
+		if v := ctx.Request.URL.Query().Get("at"); v != "" {
+			var err error
+			if startAt, err = time.Parse(time.RFC3339, v); err != nil {
+				ctx.APIError(router.ErrInvalidParam, "Invalid start time: %s", v)
+				return
+			}
+		}
+
 		// Get the traverser from the repo.
 		traverser, err := api.traverserRepo.Get(requestIdStr)
 		if err != nil {
-			ctx.APIError(router.ErrNotFound, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			return
+		}
+
+		// Only pending chains can be started. The traverser checks this,
+		// too, but it runs in a goroutine so it can't return an error.
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
+		if err == nil && c.State() != proto.STATE_PENDING {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_ALREADY_STARTED, "Can't start the chain because it is %s.", proto.StateName[c.State()])
 			return
 		}
 
 		// Set the location in the response header to point to this server.
 		ctx.Response.Header().Set("Location", chainLocation(requestIdStr, os.Hostname))
 
-		// Start the traverser, and remove it from the repo when it's
-		// done running. This could take a very long time to return,
-		// so we run it in a goroutine.
-		go func() {
-			traverser.Run()
-			api.traverserRepo.Remove(requestIdStr)
-		}()
+		if startAt.After(time.Now()) && c != nil {
+			if !c.Schedule(startAt) {
+				ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_ALREADY_STARTED, "Can't schedule the chain because it is %s.", proto.StateName[c.State()])
+				return
+			}
+			if err := api.scheduler.Schedule(c.Definition()); err != nil {
+				c.Schedule(time.Time{})
+				ctx.APIError(router.ErrInternal, "Can't schedule the chain (error: %s)", err)
+				return
+			}
+			log.Infof("[chain=%s]: Chain is scheduled to start at %s.", requestIdStr, startAt.Format(time.RFC3339))
+			return
+		}
+
+		api.scheduler.Cancel(requestId(requestIdStr))
+		api.startChain(requestIdStr, traverser)
 	default:
 		ctx.UnsupportedAPIMethod()
 	}
 }
 
-// PUT <API_ROOT>/job-chains/{requestId}/stop
-// Stop the traverser for a job chain.
+// PUT <API_ROOT>/job-chains/{requestId}/stop[?grace=30s]
+// Stop the traverser for a job chain. Running jobs have the grace period
+// (default API.StopGrace) to stop before they're abandoned and force-killed.
+// If any job is force-killed, the chain is stopped but a 500 error is returned.
+// The optional body is a proto.StopInfo with who's stopping the chain and why,
+// which are kept with the chain.
 func (api *API) stopJobChainHandler(ctx router.HTTPContext) {
 	switch ctx.Request.Method {
 	case "PUT":
 		requestIdStr := ctx.Arguments[1]
 
+		grace := api.StopGrace
+		if v := ctx.Request.URL.Query().Get("grace"); v != "" {
+			var err error
+			if grace, err = time.ParseDuration(v); err != nil || grace < 0 {
+				ctx.APIError(router.ErrInvalidParam, "Invalid grace period: %s", v)
+				return
+			}
+		}
+
+		stop, err := stopInfo(ctx)
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't decode request body (error: %s)", err)
+			return
+		}
+
 		// Get the traverser to the repo.
 		traverser, err := api.traverserRepo.Get(requestIdStr)
 		if err != nil {
-			ctx.APIError(router.ErrNotFound, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
 			return
 		}
 
-		// This is expected to return quickly.
-		err = traverser.Stop()
+		err = api.stopChain(requestIdStr, traverser, grace, stop)
+		if err == chain.ErrJobsForceKilled {
+			ctx.APIError(router.ErrInternal, "Chain stopped, but %s", err)
+			return
+		}
 		if err != nil {
 			ctx.APIError(router.ErrInternal, "Can't stop the chain (error: %s)", err)
 			return
 		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// PUT <API_ROOT>/job-chains/stop-all
+// Stop every chain in the traverser repo, like in an emergency drain. Chains
+// are stopped at the same time, each with the grace period, and the response
+// is the result of stopping each one, ordered by request ID. The optional body
+// is a proto.StopInfo, like for one chain.
+func (api *API) stopAllJobChainsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "PUT":
+		grace := api.StopGrace
+		if v := ctx.Request.URL.Query().Get("grace"); v != "" {
+			var err error
+			if grace, err = time.ParseDuration(v); err != nil || grace < 0 {
+				ctx.APIError(router.ErrInvalidParam, "Invalid grace period: %s", v)
+				return
+			}
+		}
+
+		stop, err := stopInfo(ctx)
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't decode request body (error: %s)", err)
+			return
+		}
+
+		traversers, err := api.traverserRepo.GetAll()
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't retrieve traversers from repo (error: %s).", err)
+			return
+		}
+		log.Warnf("Stopping all %d chains.", len(traversers))
+
+		resultChan := make(chan proto.StoppedJobChain, len(traversers))
+		for requestIdStr, traverser := range traversers {
+			go func(requestIdStr string, traverser chain.Traverser) {
+				r := proto.StoppedJobChain{RequestId: requestId(requestIdStr), Stopped: true}
+				if err := api.stopChain(requestIdStr, traverser, grace, stop); err != nil {
+					r.Stopped = err == chain.ErrJobsForceKilled
+					r.Error = err.Error()
+				}
+				resultChan <- r
+			}(requestIdStr, traverser)
+		}
+		stopped := make([]proto.StoppedJobChain, 0, len(traversers))
+		for range traversers {
+			stopped = append(stopped, <-resultChan)
+		}
+		sort.Slice(stopped, func(i, j int) bool {
+			return stopped[i].RequestId < stopped[j].RequestId
+		})
+
+		if out, err := marshal(stopped); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/quarantined
+// List the chains that were quarantined because their traverser panicked, with
+// the panic and its stack trace, ordered by request ID.
+func (api *API) quarantinedJobChainsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		traversers, err := api.traverserRepo.GetAll()
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't retrieve traversers from repo (error: %s).", err)
+			return
+		}
+		quarantined := []proto.QuarantinedJobChain{}
+		for requestIdStr := range traversers {
+			c, err := api.chainRepo.Get(requestId(requestIdStr))
+			if err != nil || c.State() != proto.STATE_QUARANTINED {
+				continue
+			}
+			jc := c.Snapshot()
+			quarantined = append(quarantined, proto.QuarantinedJobChain{
+				RequestId:   jc.RequestId,
+				RequestType: jc.RequestType,
+				Quarantine:  *jc.Quarantine,
+			})
+		}
+		sort.Slice(quarantined, func(i, j int) bool {
+			return quarantined[i].RequestId < quarantined[j].RequestId
+		})
+
+		if out, err := marshal(quarantined); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// PUT <API_ROOT>/job-chains/{requestId}/recover
+// Recover a quarantined chain once none of its jobs are running: it's suspended
+// and removed from the Job Runner, and the response is the suspended chain
+// (proto.SuspendedJobChain), which can be re-dispatched to be resumed.
+func (api *API) recoverJobChainHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "PUT":
+		requestIdStr := ctx.Arguments[1]
 
+		traverser, err := api.traverserRepo.Get(requestIdStr)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			return
+		}
+		sjc, err := traverser.Recover()
+		if err != nil {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_NOT_QUARANTINED, "Can't recover the chain (error: %s).", err)
+			return
+		}
 		api.traverserRepo.Remove(requestIdStr)
+		api.chainRepo.Remove(requestId(requestIdStr))
+
+		if out, err := marshal(sjc); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// PUT <API_ROOT>/job-chains/{requestId}/retry
+// Retry a chain that failed (INCOMPLETE) from where it failed: its failed jobs,
+// and the jobs after them, run again, and jobs that completed don't. The chain
+// must still be in the Job Runner (see SetMaxFinishedChains), and its rollback
+// jobs must not have run. It's started right away, like a chain that's started.
+func (api *API) retryJobChainHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "PUT":
+		if api.shuttingDown() {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_SHUTTING_DOWN, "Job Runner is shutting down, not starting chains.")
+			return
+		}
+
+		requestIdStr := ctx.Arguments[1]
+
+		api.newChainMux.Lock()
+		defer api.newChainMux.Unlock()
+
+		// The traverser is removed once it's done, so a chain that still has
+		// one is running or finishing.
+		if _, err := api.traverserRepo.Get(requestIdStr); err == nil {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_NOT_RETRYABLE, "Can't retry the chain because it's still running.")
+			return
+		}
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve chain from repo (error: %s).", err.Error())
+			return
+		}
+		state := c.State()
+		failed, err := c.ResetFailed()
+		if err != nil {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_CHAIN_NOT_RETRYABLE, "Can't retry the chain because it is %s or was rolled back.", proto.StateName[state])
+			return
+		}
+		log.Infof("[chain=%s]: Retrying the chain from failed jobs %v.", requestIdStr, failed)
+
+		traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c, api.Hooks)
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Problem creating traverser (error: %s)", err)
+			return
+		}
+		if err := api.traverserRepo.Add(requestIdStr, traverser); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't add traverser to repo (error: %s)", err)
+			return
+		}
+		api.finishedChains.Remove(c.RequestId())
+
+		ctx.Response.Header().Set("Location", chainLocation(requestIdStr, os.Hostname))
+		api.startChain(requestIdStr, traverser)
 	default:
 		ctx.UnsupportedAPIMethod()
 	}
 }
 
+// stopChain stops a chain, which returns within about the grace period, and
+// removes its traverser from the repo unless it couldn't be stopped. A chain
+// scheduled to start, or waiting in the queue, is stopped before it starts.
+func (api *API) stopChain(requestIdStr string, traverser chain.Traverser, grace time.Duration, stop proto.StopInfo) error {
+	api.scheduler.Cancel(requestId(requestIdStr))
+	api.queue.Cancel(requestId(requestIdStr))
+
+	err := traverser.Stop(grace, stop)
+	if err != nil && err != chain.ErrJobsForceKilled {
+		return err
+	}
+	api.traverserRepo.Remove(requestIdStr)
+	return err
+}
+
 // GET <API_ROOT>/job-chains/{requestId}/status
-// Get the status of a running job chain.
+// Get the status of a running job chain: the live status of its running and
+// failed jobs. It's only available while the chain's traverser is in the repo;
+// get the job chain itself for its final state.
 func (api *API) statusJobChainHandler(ctx router.HTTPContext) {
 	switch ctx.Request.Method {
 	case "GET":
@@ -152,12 +747,16 @@ func (api *API) statusJobChainHandler(ctx router.HTTPContext) {
 		// Get the traverser to the repo.
 		traverser, err := api.traverserRepo.Get(requestIdStr)
 		if err != nil {
-			ctx.APIError(router.ErrNotFound, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
 			return
 		}
 
-		// This is expected to return quickly.
-		statuses, err := traverser.Status()
+		// This is expected to return quickly, but it stops if the client goes
+		// away or the server shuts down.
+		statuses, err := traverser.Status(ctx.Request.Context())
+		if ctx.Request.Context().Err() != nil {
+			return // client went away
+		}
 		if err != nil {
 			ctx.APIError(router.ErrInternal, "Can't get the chain's status (error: %s)", err)
 			return
@@ -173,8 +772,668 @@ func (api *API) statusJobChainHandler(ctx router.HTTPContext) {
 	}
 }
 
+// GET <API_ROOT>/job-chains/status?ids=1,2,3
+// POST <API_ROOT>/job-chains/status with a JSON list of request IDs, like [1,2,3]
+// Get the status of many job chains in one call (proto.JobChainStatuses), so
+// a dashboard doesn't need a call per chain. Chains that aren't running are in
+// NotFound rather than an error. At most MAX_BULK_STATUS chains. Every status
+// is recorded in the audit log, like a call for one chain.
+func (api *API) bulkStatusJobChainsHandler(ctx router.HTTPContext) {
+	var ids []uint
+	switch ctx.Request.Method {
+	case "GET":
+		for _, s := range strings.Split(ctx.Request.URL.Query().Get("ids"), ",") {
+			if s == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				ctx.APIError(router.ErrInvalidParam, "Invalid request ID: %s", s)
+				return
+			}
+			ids = append(ids, uint(id))
+		}
+	case "POST":
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&ids); err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't decode request IDs (error: %s)", err)
+			return
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+		return
+	}
+	if len(ids) == 0 || len(ids) > MAX_BULK_STATUS {
+		ctx.APIError(router.ErrInvalidParam, "Got %d request IDs, expected 1 to %d", len(ids), MAX_BULK_STATUS)
+		return
+	}
+
+	statuses := proto.JobChainStatuses{
+		Statuses: []proto.JobChainStatus{},
+		NotFound: []uint{},
+	}
+	for _, id := range ids {
+		traverser, err := api.traverserRepo.Get(fmt.Sprintf("%d", id))
+		if err != nil {
+			statuses.NotFound = append(statuses.NotFound, id)
+			continue
+		}
+		status, err := traverser.Status(ctx.Request.Context())
+		if ctx.Request.Context().Err() != nil {
+			return // client went away
+		}
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't get the status of chain %d (error: %s)", id, err)
+			return
+		}
+		statuses.Statuses = append(statuses.Statuses, status)
+		api.audit(ctx, AUDIT_STATUS, id, http.StatusOK)
+	}
+
+	if out, err := marshal(statuses); err != nil {
+		ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+	} else {
+		fmt.Fprintln(ctx.Response, string(out))
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/report[?format=text]
+// Get the final report of a job chain that is done running: the outcome of
+// every job, retries, interventions, and a timeline. It's JSON by default, or
+// human-readable text if format=text.
+func (api *API) reportJobChainHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
+
+		// Get the chain from the repo.
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve chain from repo (error: %s).", err.Error())
+			return
+		}
+
+		report, ok := c.Report()
+		if !ok {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_DONE, "Chain has no report because it is %s.", proto.StateName[c.State()])
+			return
+		}
+
+		if ctx.Request.URL.Query().Get("format") == "text" {
+			ctx.Response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			chain.FormatReport(ctx.Response, report)
+			return
+		}
+
+		if out, err := marshal(report); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/status/ws
+// Upgrade to a WebSocket and push job and chain state changes (proto.JobChainEvent)
+// to the client as they happen. The server closes the WebSocket when the chain
+// is done running.
+func (api *API) statusWebSocketHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
+
+		// Get the traverser to the repo.
+		traverser, err := api.traverserRepo.Get(requestIdStr)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			return
+		}
+
+		// Subscribe before upgrading so no events are missed.
+		events, unsubscribe := traverser.Subscribe()
+		defer unsubscribe()
+
+		ws, err := ctx.UpgradeWebSocket()
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't upgrade to a WebSocket (error: %s).", err.Error())
+			return
+		}
+		defer ws.Close()
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return // chain is done
+				}
+				if err := ws.WriteJSON(event); err != nil {
+					return
+				}
+			case <-ws.Done():
+				return // client went away
+			}
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/jobs/{jobName}/log
+// Stream the log output of a running or failed job in a job chain. The output
+// is streamed in chunks as the job writes it until the job is done running or
+// the client goes away. With ?try=N, get the log of try N of the job, if it
+// failed (see proto.JobTry).
+func (api *API) logJobHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
+		jobName := ctx.Arguments[2]
+
+		var try uint64
+		if v := ctx.Request.URL.Query().Get("try"); v != "" {
+			var err error
+			if try, err = strconv.ParseUint(v, 10, 64); err != nil || try == 0 {
+				ctx.APIError(router.ErrInvalidParam, "Invalid try: %s", v)
+				return
+			}
+		}
+
+		// Get the traverser to the repo.
+		traverser, err := api.traverserRepo.Get(requestIdStr)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			return
+		}
+
+		// Only running and failed jobs, and tries that failed, have a log.
+		jobLog, err := traverser.Log(jobName, uint(try))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_JOB_NOT_FOUND, "Can't retrieve log for job %s (error: %s).", jobName, err.Error())
+			return
+		}
+
+		ctx.Response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		flusher, _ := ctx.Response.(http.Flusher)
+
+		offset := 0
+		for {
+			out, next, changed, closed := jobLog.Read(offset)
+			if len(out) > 0 {
+				if _, err := ctx.Response.Write(out); err != nil {
+					return // client went away
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			offset = next
+			if closed {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Request.Context().Done():
+				return
+			}
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/jobs/{jobName}/explain
+// Explain why a job in a job chain hasn't started running.
+func (api *API) explainJobHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
+		jobName := ctx.Arguments[2]
+
+		// Get the traverser to the repo.
+		traverser, err := api.traverserRepo.Get(requestIdStr)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve traverser from repo (error: %s).", err.Error())
+			return
+		}
+
+		// This is expected to return quickly.
+		exp, err := traverser.Explain(jobName)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_JOB_NOT_FOUND, "Can't explain job %s (error: %s).", jobName, err.Error())
+			return
+		}
+
+		if out, err := marshal(exp); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/jobs/{jobName}/artifacts
+// List the artifacts output by a job: a list of proto.JobArtifact, empty if it
+// has none. Artifacts are kept after the chain is done.
+func (api *API) jobArtifactsHandler(ctx router.HTTPContext) {
+	if api.Artifacts == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_ARTIFACTS_DISABLED, "Artifacts are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "GET":
+		requestId, err := strconv.ParseUint(ctx.Arguments[1], 10, 64)
+		if err != nil {
+			ctx.APIError(router.ErrInvalidParam, "Invalid request ID: %s", ctx.Arguments[1])
+			return
+		}
+		jobName := ctx.Arguments[2]
+
+		artifacts, err := api.Artifacts.List(uint(requestId), jobName)
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't list artifacts of job %s (error: %s)", jobName, err)
+			return
+		}
+
+		if out, err := marshal(artifacts); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-chains/{requestId}/jobs/{jobName}/artifacts/{name}
+// Get an artifact output by a job, with its content type.
+func (api *API) jobArtifactHandler(ctx router.HTTPContext) {
+	if api.Artifacts == nil {
+		ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_ARTIFACTS_DISABLED, "Artifacts are not enabled on this Job Runner.")
+		return
+	}
+	switch ctx.Request.Method {
+	case "GET":
+		requestId, err := strconv.ParseUint(ctx.Arguments[1], 10, 64)
+		if err != nil {
+			ctx.APIError(router.ErrInvalidParam, "Invalid request ID: %s", ctx.Arguments[1])
+			return
+		}
+		jobName, name := ctx.Arguments[2], ctx.Arguments[3]
+
+		artifact, err := api.Artifacts.Get(uint(requestId), jobName, name)
+		if err == runner.ErrArtifactNotFound {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_ARTIFACT_NOT_FOUND, "Job %s has no artifact %s.", jobName, name)
+			return
+		}
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Can't get artifact %s of job %s (error: %s)", name, jobName, err)
+			return
+		}
+
+		contentType := artifact.ContentType
+		if contentType == "" {
+			contentType = runner.DEFAULT_CONTENT_TYPE
+		}
+		ctx.Response.Header().Set("Content-Type", contentType)
+		ctx.Response.Header().Set("Content-Length", strconv.Itoa(len(artifact.Data)))
+		ctx.Response.Write(artifact.Data)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-types
+// List every job type the Job Runner can run with its documentation, if any,
+// and the job args its jobs describe (Doc.Schema): job type => job.Doc.
+func (api *API) jobTypesHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		if out, err := marshal(api.JobDocs); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-types/{type}
+// Get the documentation of a job type: a job.Doc with what it does, its args,
+// the jobData it sets, how it fails, and the job args its jobs describe.
+func (api *API) jobTypeHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		jobType := ctx.Arguments[1]
+		doc, ok := api.JobDocs[jobType]
+		if !ok {
+			ctx.APIError(router.ErrNotFound, "Job type %s does not exist.", jobType)
+			return
+		}
+		if out, err := marshal(doc); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// ========================================================================= //
+
+// ExpireChains evicts chains that were created but not started within ttl.
+// Expired chains are removed from the traverser repo (so they can't be started)
+// and their state is set to EXPIRED in the chain repo. It checks for expired
+// chains every interval until stopChan is closed, so it should be run in a
+// goroutine.
+func (api *API) ExpireChains(ttl, interval time.Duration, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			api.expireChains(ttl)
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// expireChains evicts all chains that expired. It returns the number of
+// chains evicted.
+func (api *API) expireChains(ttl time.Duration) int {
+	traversers, err := api.traverserRepo.GetAll()
+	if err != nil {
+		log.Errorf("Can't get traversers to expire chains (error: %s).", err)
+		return 0
+	}
+
+	n := 0
+	for requestIdStr := range traversers {
+		c, err := api.chainRepo.Get(requestId(requestIdStr))
+		if err != nil {
+			continue
+		}
+		if !c.Expire(ttl) {
+			continue // not pending, or not expired yet
+		}
+		log.Infof("[chain=%s]: Chain was not started within %s, evicting it.", requestIdStr, ttl)
+		api.chainRepo.Set(c)
+		api.traverserRepo.Remove(requestIdStr)
+		expiredChains.Add(1)
+		n++
+	}
+	return n
+}
+
+// ========================================================================= //
+
+// RestoreScheduledChains makes chains scheduled to start survive restarts: it
+// saves them in dir until they start, and it adds and schedules the chains
+// that were saved in dir before the Job Runner restarted. Chains that were due
+// while it was down are started now. Call it before serving the API. It
+// returns the number of chains restored.
+func (api *API) RestoreScheduledChains(dir string) (int, error) {
+	api.scheduler.Dir = dir
+	chains, err := api.scheduler.Load()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, jc := range chains {
+		jc := jc
+		requestIdStr := strconv.FormatUint(uint64(jc.RequestId), 10)
+
+		// The chain is saved with its schedule, which is set again after
+		// the chain is added, like when it was started with a future time.
+		startAt := jc.StartAt
+		jc.StartAt = time.Time{}
+		c := chain.NewChain(&jc)
+		traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c, api.Hooks)
+		if err != nil {
+			log.Errorf("[chain=%s]: Can't restore scheduled chain (error: %s).", requestIdStr, err)
+			continue
+		}
+		if err := api.traverserRepo.Add(requestIdStr, traverser); err != nil {
+			log.Errorf("[chain=%s]: Can't restore scheduled chain (error: %s).", requestIdStr, err)
+			continue
+		}
+		c.Schedule(startAt)
+		if err := api.scheduler.Schedule(c.Definition()); err != nil {
+			return n, err
+		}
+		log.Infof("[chain=%s]: Restored chain scheduled to start at %s.", requestIdStr, startAt.Format(time.RFC3339))
+		n++
+	}
+	return n, nil
+}
+
+// SetScheduleTolerance sets the max time a scheduled chain starts late if the
+// system clock is set forward (default schedule.DEFAULT_TOLERANCE). Chains
+// never start early if it's set back. Call it before serving the API.
+func (api *API) SetScheduleTolerance(d time.Duration) {
+	api.scheduler.Tolerance = d
+}
+
+// startScheduledChain starts a chain when it's due. It's called by the scheduler.
+func (api *API) startScheduledChain(requestId uint) {
+	requestIdStr := strconv.FormatUint(uint64(requestId), 10)
+	if api.shuttingDown() {
+		return // suspended by Shutdown
+	}
+	traverser, err := api.traverserRepo.Get(requestIdStr)
+	if err != nil {
+		log.Errorf("[chain=%s]: Can't start scheduled chain (error: %s).", requestIdStr, err)
+		return
+	}
+	log.Infof("[chain=%s]: Starting scheduled chain.", requestIdStr)
+	api.startChain(requestIdStr, traverser)
+}
+
+// SetMaxRunningChains limits how many chains run at once. Chains started when
+// max chains are running wait in a queue, highest priority first. Zero means
+// no limit. It can be called while serving the API, like to reload the config.
+func (api *API) SetMaxRunningChains(max uint) {
+	api.queue.SetMax(max)
+}
+
+// startChain starts the traverser for a chain once the queue lets it run,
+// removes it from the repo when it's done running, keeps its result, and
+// sends the chain's callback. This could take a very long time to return, so
+// it runs in a goroutine.
+func (api *API) startChain(requestIdStr string, traverser chain.Traverser) {
+	go func() {
+		var priority int
+		if c, err := api.chainRepo.Get(requestId(requestIdStr)); err == nil {
+			priority = c.Summary().Priority
+		}
+		if pos := api.queue.Position(requestId(requestIdStr)); pos > 0 {
+			return // already waiting
+		}
+		if !api.queue.Wait(requestId(requestIdStr), priority) {
+			log.Infof("[chain=%s]: Chain was removed from the queue before it ran.", requestIdStr)
+			return // stopped or deleted
+		}
+		defer api.queue.Done()
+		stopProgress := api.progress(requestId(requestIdStr), traverser)
+		err := traverser.Run()
+		if err == chain.ErrNotPending {
+			stopProgress()
+			return // started by another request, expired, or deleted
+		}
+		if err == chain.ErrQuarantined {
+			// Kept until an operator recovers it
+			log.Errorf("[chain=%s]: Chain is quarantined, recover it with PUT job-chains/%s/recover.", requestIdStr, requestIdStr)
+			return
+		}
+		api.traverserRepo.Remove(requestIdStr)
+		api.finish(requestId(requestIdStr))
+		api.callback(requestId(requestIdStr))
+	}()
+}
+
+// ========================================================================= //
+
+// Shutdown stops accepting new chains and requests to start chains, and
+// suspends all chains at the next job boundary. Running jobs are allowed to
+// finish for up to timeout; chains with jobs still running after that are
+// stopped (see API.StopGrace) and are not suspended. It returns the suspended
+// chains, including chains that were never started, which can be re-dispatched
+// to another Job Runner with PostSuspendedJobChains. Chains scheduled to start
+// are not suspended if they're saved (see RestoreScheduledChains), because
+// this Job Runner will schedule them again when it restarts.
+func (api *API) Shutdown(timeout time.Duration) []proto.SuspendedJobChain {
+	api.shutdownOnce.Do(func() { close(api.shutdownChan) })
+	scheduled := api.scheduler.Stop()
+
+	traversers, err := api.traverserRepo.GetAll()
+	if err != nil {
+		log.Errorf("Can't get traversers to suspend chains (error: %s).", err)
+		return []proto.SuspendedJobChain{}
+	}
+	if api.scheduler.Dir != "" {
+		for _, id := range scheduled {
+			delete(traversers, strconv.FormatUint(uint64(id), 10))
+		}
+		log.Infof("Shutting down, %d chains scheduled to start are saved in %s.", len(scheduled), api.scheduler.Dir)
+	}
+	log.Infof("Shutting down, suspending %d chains.", len(traversers))
+
+	type result struct {
+		requestIdStr string
+		sjc          proto.SuspendedJobChain
+	}
+	resultChan := make(chan result, len(traversers))
+	for requestIdStr, traverser := range traversers {
+		go func(requestIdStr string, traverser chain.Traverser) {
+			resultChan <- result{requestIdStr, traverser.Suspend()}
+		}(requestIdStr, traverser)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	suspended := []proto.SuspendedJobChain{}
+	for len(traversers) > 0 {
+		select {
+		case r := <-resultChan:
+			delete(traversers, r.requestIdStr)
+			if r.sjc.JobChain == nil || r.sjc.JobChain.State != proto.STATE_SUSPENDED {
+				continue // finished before it was suspended
+			}
+			log.Infof("[chain=%s]: Chain is suspended.", r.requestIdStr)
+			suspended = append(suspended, r.sjc)
+		case <-timer.C:
+			for requestIdStr, traverser := range traversers {
+				log.Errorf("[chain=%s]: Jobs still running after %s, stopping the chain.", requestIdStr, timeout)
+				go traverser.Stop(api.StopGrace, proto.StopInfo{
+					Requester: "job-runner",
+					Reason:    fmt.Sprintf("jobs still running %s after shutdown", timeout),
+				})
+			}
+		}
+	}
+
+	return suspended
+}
+
+// PostSuspendedJobChains sends suspended chains to the Request Manager at
+// rmURL so that they can be re-dispatched. It tries to send every chain, and
+// returns an error if any chain couldn't be sent. Chains that couldn't be sent
+// are added to deadLetters, if not nil, so they can be sent again later.
+func PostSuspendedJobChains(client *http.Client, rmURL string, sjcs []proto.SuspendedJobChain, deadLetters *deadletter.Store) error {
+	var lastErr error
+	failed := 0
+	url := rmURL + API_ROOT + "suspended-job-chains"
+	for _, sjc := range sjcs {
+		payload, err := json.Marshal(sjc)
+		if err == nil {
+			err = postJSON(client, url, payload)
+		}
+		if err != nil {
+			log.Errorf("[chain=%d]: Can't send suspended chain to the Request Manager (error: %s).", sjc.RequestId, err)
+			lastErr = err
+			failed++
+			if deadLetters != nil && payload != nil {
+				addDeadLetter(deadLetters, proto.DeadLetter{
+					Kind:      proto.DEAD_LETTER_SUSPENDED_CHAIN,
+					RequestId: sjc.RequestId,
+					URL:       url,
+					Body:      payload,
+					Error:     err.Error(),
+					Tries:     1,
+				})
+			}
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("can't send %d of %d suspended chains (last error: %s)", failed, len(sjcs), lastErr)
+	}
+	return nil
+}
+
+// postJSON POSTs a JSON body to url. A response other than 200 is an error.
+func postJSON(client *http.Client, url string, payload []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unsuccessful status code: %d (response body: %s)", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
 // ========================================================================= //
 
+// shuttingDown returns true if Shutdown was called.
+func (api *API) shuttingDown() bool {
+	select {
+	case <-api.shutdownChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestId converts a request ID string from a URL to a uint. The string has
+// already matched REQUEST_ID_PATTERN.
+func requestId(requestIdStr string) uint {
+	id, _ := strconv.ParseUint(requestIdStr, 10, 64)
+	return uint(id)
+}
+
+// stopInfo reads who's stopping chains and why from the optional body of a
+// stop request. The requester defaults to the operator the caller acts for,
+// or the caller.
+func stopInfo(ctx router.HTTPContext) (proto.StopInfo, error) {
+	var stop proto.StopInfo
+	if ctx.Request.Body != nil {
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return stop, err
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &stop); err != nil {
+				return stop, err
+			}
+		}
+	}
+	if stop.Requester == "" {
+		stop.Requester = ctx.Caller.OnBehalfOf
+	}
+	if stop.Requester == "" {
+		stop.Requester = ctx.Caller.Name
+	}
+	return stop, nil
+}
+
 // chainLocation returns the URL location of a job chain
 func chainLocation(requestId string, hostname func() (string, error)) string {
 	h, _ := hostname()
@@ -3,25 +3,40 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/cipher"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/agent"
 	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/job-runner/deadletter"
+	"github.com/square/spincycle/job-runner/payload"
+	"github.com/square/spincycle/job-runner/runner"
 	"github.com/square/spincycle/proto"
-	"github.com/square/spincycle/router"
 	"github.com/square/spincycle/test/mock"
 )
 
 var noJobData = map[string]interface{}{}
 
 func TestNewJobChainValid(t *testing.T) {
-	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{})
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
 	jobChain := &proto.JobChain{
 		RequestId: uint(4),
 		Jobs:      mock.InitJobs(3),
@@ -49,8 +64,166 @@ func TestNewJobChainValid(t *testing.T) {
 	}
 }
 
+// With RequireAuth, only operators can make chains.
+func TestNewJobChainRequireAuth(t *testing.T) {
+	roles := router.RoleAuthorizer{}
+	RequireAuth(roles)
+	rt := &router.Router{
+		Authenticator: router.TokenAuthenticator{
+			"op":   router.Caller{Name: "spincycle-rm", Roles: []string{"operator"}},
+			"user": router.Caller{Name: "bob", Roles: []string{"user"}},
+		},
+		Authorizer: roles,
+	}
+	api := NewAPI(rt, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	for i, token := range []string{"", "user", "op"} {
+		expect := map[string]int{"": http.StatusUnauthorized, "user": http.StatusForbidden, "op": http.StatusOK}[token]
+		payload, err := json.Marshal(proto.JobChain{RequestId: uint(i + 1), Jobs: mock.InitJobs(1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", h.URL+API_ROOT+"job-chains", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expect {
+			t.Errorf("response status with token %q = %d, expected %d", token, res.StatusCode, expect)
+		}
+	}
+
+	// Reading a chain is still open to anyone, but deleting it isn't
+	for method, expect := range map[string]int{"GET": http.StatusOK, "DELETE": http.StatusUnauthorized} {
+		req, err := http.NewRequest(method, h.URL+API_ROOT+"job-chains/3", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expect {
+			t.Errorf("%s response status = %d, expected %d", method, res.StatusCode, expect)
+		}
+	}
+}
+
+// A traceparent header puts the chain in the caller's trace.
+func TestNewJobChainTraceparent(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	jobChain := &proto.JobChain{
+		RequestId: uint(4),
+		Jobs:      mock.InitJobs(1),
+	}
+	payload, err := json.Marshal(jobChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest("POST", h.URL+API_ROOT+"job-chains", bytes.NewBuffer(payload))
+	req.Header.Set("traceparent", tp)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("response status = %d, expected 200", res.StatusCode)
+	}
+
+	c, err := api.chainRepo.Get(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.JobChain.Traceparent != tp {
+		t.Errorf("traceparent = %q, expected %q", c.JobChain.Traceparent, tp)
+	}
+}
+
+// Submitting the same chain again is a no-op, but submitting a different chain
+// for the same request is a conflict.
+func TestNewJobChainResubmit(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	jobChain := &proto.JobChain{
+		RequestId: uint(4),
+		Jobs:      mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	payload, err := json.Marshal(jobChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobChain.AdjacencyList = map[string][]string{"job2": {"job1"}}
+	different, err := json.Marshal(jobChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	post := func(payload []byte) *http.Response {
+		res, err := http.Post(h.URL+API_ROOT+"job-chains", "application/json; charset=utf-8", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := post(payload)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	traverser, err := api.traverserRepo.Get("4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res = post(payload)
+	var existing proto.JobChain
+	err = json.NewDecoder(res.Body).Decode(&existing)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	if existing.RequestId != 4 || len(existing.Jobs) != 2 {
+		t.Errorf("got chain %+v, expected the existing chain 4", existing)
+	}
+	if t2, _ := api.traverserRepo.Get("4"); t2 != traverser {
+		t.Error("resubmitting the chain replaced its traverser")
+	}
+
+	res = post(different)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
 func TestNewJobChainInvalid(t *testing.T) {
-	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{})
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
 	// The chain is cyclic.
 	jobChain := &proto.JobChain{
 		RequestId: uint(4),
@@ -73,10 +246,111 @@ func TestNewJobChainInvalid(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	var apiErr proto.Error
+	err = json.NewDecoder(res.Body).Decode(&apiErr)
 	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if res.StatusCode != 400 {
-		t.Errorf("response status = %d, expected 200", res.StatusCode)
+		t.Errorf("response status = %d, expected 400", res.StatusCode)
+	}
+	if apiErr.Code != proto.ERR_INVALID_DAG {
+		t.Errorf("error code = %s, expected %s", apiErr.Code, proto.ERR_INVALID_DAG)
+	}
+}
+
+func TestBatchJobChains(t *testing.T) {
+	chainRepo := chain.NewMemoryRepo()
+	api := NewAPI(&router.Router{}, chainRepo, &mock.RunnerFactory{}, chain.NewLimiter(0))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	valid := func(requestId uint) proto.JobChain {
+		return proto.JobChain{
+			RequestId:     requestId,
+			Jobs:          mock.InitJobs(2),
+			AdjacencyList: map[string][]string{"job1": {"job2"}},
+		}
+	}
+	cyclic := valid(0)
+	cyclic.AdjacencyList = map[string][]string{"job1": {"job2"}, "job2": {"job1"}}
+
+	post := func(batch proto.JobChainBatch) proto.JobChainBatchResult {
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Post(h.URL+API_ROOT+"job-chains/batch", "application/json; charset=utf-8", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("response status = %d, expected 200", res.StatusCode)
+		}
+		var result proto.JobChainBatchResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Individual (default): valid chains are added, the rest are rejected
+	cyclic.RequestId = 2
+	result := post(proto.JobChainBatch{Chains: []proto.JobChain{valid(1), cyclic, valid(3), valid(3)}})
+	if result.Mode != proto.BATCH_MODE_INDIVIDUAL {
+		t.Errorf("mode = %s, expected %s", result.Mode, proto.BATCH_MODE_INDIVIDUAL)
+	}
+	expectCodes := []string{"", proto.ERR_INVALID_DAG, "", proto.ERR_CHAIN_EXISTS}
+	if len(result.Results) != len(expectCodes) {
+		t.Fatalf("got %d results, expected %d: %+v", len(result.Results), len(expectCodes), result.Results)
+	}
+	for i, r := range result.Results {
+		if r.Code != expectCodes[i] || r.Accepted != (expectCodes[i] == "") {
+			t.Errorf("result %d = %+v, expected code %q", i, r, expectCodes[i])
+		}
+	}
+	for _, id := range []uint{1, 3} {
+		if _, err := chainRepo.Get(id); err != nil {
+			t.Errorf("chain %d not added: %s", id, err)
+		}
+	}
+	if _, err := chainRepo.Get(2); err == nil {
+		t.Error("chain 2 added, expected it to be rejected")
+	}
+
+	// Atomic: one bad chain rejects the whole batch
+	cyclic.RequestId = 5
+	result = post(proto.JobChainBatch{Mode: proto.BATCH_MODE_ATOMIC, Chains: []proto.JobChain{valid(4), cyclic}})
+	expectCodes = []string{proto.ERR_BATCH_REJECTED, proto.ERR_INVALID_DAG}
+	for i, r := range result.Results {
+		if r.Accepted || r.Code != expectCodes[i] {
+			t.Errorf("result %d = %+v, expected code %q", i, r, expectCodes[i])
+		}
+	}
+	if _, err := chainRepo.Get(4); err == nil {
+		t.Error("chain 4 added, expected the atomic batch to add nothing")
+	}
+
+	// Atomic: every chain is added if all are valid
+	result = post(proto.JobChainBatch{Mode: proto.BATCH_MODE_ATOMIC, Chains: []proto.JobChain{valid(4), valid(6)}})
+	for i, r := range result.Results {
+		if !r.Accepted {
+			t.Errorf("result %d = %+v, expected it accepted", i, r)
+		}
+	}
+
+	// An unknown mode is an error
+	payload := []byte(`{"mode":"some","chains":[]}`)
+	res, err := http.Post(h.URL+API_ROOT+"job-chains/batch", "application/json; charset=utf-8", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("response status = %d, expected 400", res.StatusCode)
 	}
 }
 
@@ -87,7 +361,7 @@ func TestStartJobChain(t *testing.T) {
 			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
 			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
 		},
-	})
+	}, chain.NewLimiter(0))
 	jobChain := &proto.JobChain{
 		RequestId: uint(4),
 		Jobs:      mock.InitJobs(3),
@@ -98,7 +372,7 @@ func TestStartJobChain(t *testing.T) {
 	}
 	c := chain.NewChain(jobChain)
 
-	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, c)
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,7 +404,7 @@ func TestStartJobChain(t *testing.T) {
 }
 
 func TestStopJobChain(t *testing.T) {
-	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}})
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}, chain.NewLimiter(0))
 
 	err := api.traverserRepo.Add("4", &mock.Traverser{})
 	if err != nil {
@@ -164,8 +438,94 @@ func TestStopJobChain(t *testing.T) {
 	}
 }
 
+func TestStopJobChainGrace(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}, chain.NewLimiter(0))
+
+	trav := &mock.Traverser{}
+	if err := api.traverserRepo.Add("4", trav); err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	stop := func(query string) int {
+		url, err := url.Parse(h.URL + API_ROOT + "job-chains/4/stop" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{}).Do(&http.Request{Method: "PUT", URL: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Invalid grace period
+	if status := stop("?grace=soon"); status != 400 {
+		t.Errorf("response status = %d, expected 400", status)
+	}
+
+	// Some jobs didn't stop: the chain is stopped, but it's an error.
+	trav.StopErr = chain.ErrJobsForceKilled
+	if status := stop("?grace=30s"); status != 500 {
+		t.Errorf("response status = %d, expected 500", status)
+	}
+	if trav.StopGrace != 30*time.Second {
+		t.Errorf("grace = %s, expected 30s", trav.StopGrace)
+	}
+	if _, err := api.traverserRepo.Get("4"); err == nil {
+		t.Errorf("Traverser was not removed from the repo as expected.")
+	}
+}
+
+func TestStopJobChainReason(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}, chain.NewLimiter(0))
+
+	trav := &mock.Traverser{}
+	if err := api.traverserRepo.Add("4", trav); err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	body := `{"requester":"alice","reason":"wrong cluster"}`
+	req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/4/stop", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("response status = %d, expected 200", res.StatusCode)
+	}
+	expect := proto.StopInfo{Requester: "alice", Reason: "wrong cluster"}
+	if trav.StopInfo != expect {
+		t.Errorf("stop = %+v, expected %+v", trav.StopInfo, expect)
+	}
+
+	// A body that isn't a StopInfo is a bad request
+	if err := api.traverserRepo.Add("5", &mock.Traverser{}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/5/stop", strings.NewReader("stop it"))
+	res, err = (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("response status = %d, expected 400", res.StatusCode)
+	}
+}
+
 func TestStopJobChainNotRunning(t *testing.T) {
-	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}})
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}, chain.NewLimiter(0))
 
 	h := httptest.NewServer(api.Router)
 	defer h.Close()
@@ -196,12 +556,12 @@ func TestStatusJobChain(t *testing.T) {
 			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
 			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
 		},
-	})
+	}, chain.NewLimiter(0))
 	chainStatus := proto.JobChainStatus{
 		RequestId: uint(4),
 		JobStatuses: proto.JobStatuses{
-			proto.JobStatus{"job2", "", proto.STATE_FAIL},
-			proto.JobStatus{"job3", "95% complete", proto.STATE_RUNNING},
+			proto.JobStatus{Name: "job2", State: proto.STATE_FAIL, Progress: -1},
+			proto.JobStatus{Name: "job3", Status: "95% complete", State: proto.STATE_RUNNING, Progress: 95},
 		},
 	}
 
@@ -236,3 +596,1915 @@ func TestStatusJobChain(t *testing.T) {
 		t.Errorf("actual response = %v, expected %v", actualResponse, expectedResponse)
 	}
 }
+
+func TestBulkStatusJobChains(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	audit := &auditRecorder{}
+	api.AuditLogger = audit
+	for _, id := range []uint{4, 5} {
+		status := proto.JobChainStatus{RequestId: id, JobStatuses: proto.JobStatuses{}}
+		if err := api.traverserRepo.Add(fmt.Sprintf("%d", id), &mock.Traverser{StatusResp: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	expect := proto.JobChainStatuses{
+		Statuses: []proto.JobChainStatus{
+			{RequestId: 5, JobStatuses: proto.JobStatuses{}},
+			{RequestId: 4, JobStatuses: proto.JobStatuses{}},
+		},
+		NotFound: []uint{6},
+	}
+	get := func(res *http.Response, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("response status = %d, expected 200", res.StatusCode)
+		}
+		var statuses proto.JobChainStatuses
+		if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(statuses, expect) {
+			t.Errorf("statuses = %+v, expected %+v", statuses, expect)
+		}
+	}
+	get(http.Get(h.URL + API_ROOT + "job-chains/status?ids=5,4,6"))
+	get(http.Post(h.URL+API_ROOT+"job-chains/status", "application/json", strings.NewReader("[5, 4, 6]")))
+
+	// Every status is audited, like a call for one chain
+	if len(audit.events) != 4 || audit.events[0].RequestId != 5 || audit.events[0].Action != AUDIT_STATUS {
+		t.Errorf("audit events = %+v, expected a status event per chain found", audit.events)
+	}
+
+	for _, ids := range []string{"", "4,x", strings.Repeat("4,", MAX_BULK_STATUS+1)} {
+		res, err := http.Get(h.URL + API_ROOT + "job-chains/status?ids=" + ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("ids=%s: response status = %d, expected 400", ids, res.StatusCode)
+		}
+	}
+}
+
+func TestLogJob(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	jobLog := runner.NewLog()
+	jobLog.Write([]byte("line 1\n"))
+
+	err := api.traverserRepo.Add("4", &mock.Traverser{
+		LogResp: jobLog,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Write more output and close the log while the response is streaming.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		jobLog.Write([]byte("line 2\n"))
+		jobLog.Close()
+	}()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/4/jobs/job1/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("response status = %d, expected 200", res.StatusCode)
+	}
+	expectedLog := "line 1\nline 2\n"
+	if string(bytes) != expectedLog {
+		t.Errorf("log = %q, expected %q", string(bytes), expectedLog)
+	}
+}
+
+func TestExplainJob(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	exp := proto.JobExplanation{
+		RequestId: uint(4),
+		Name:      "job2",
+		State:     proto.STATE_PENDING,
+		Blockers: []proto.JobBlocker{
+			{
+				Reason:  proto.BLOCKED_DEPENDENCY,
+				Message: "previous job job1 is RUNNING",
+				Job:     "job1",
+				State:   proto.STATE_RUNNING,
+			},
+		},
+	}
+
+	err := api.traverserRepo.Add("4", &mock.Traverser{
+		ExplainResp: exp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/4/jobs/job2/explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actualResponse proto.JobExplanation
+	if err := json.Unmarshal(bytes, &actualResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actualResponse, exp) {
+		t.Errorf("actual response = %v, expected %v", actualResponse, exp)
+	}
+}
+
+func TestStatusWebSocket(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	events := make(chan proto.JobChainEvent, 1)
+	err := api.traverserRepo.Add("4", &mock.Traverser{
+		Events: events,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Not a WebSocket handshake.
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/4/status/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("response status = %d, expected 400", res.StatusCode)
+	}
+
+	// Do the WebSocket handshake.
+	conn, err := net.Dial("tcp", h.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %sjob-chains/4/status/ws HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", API_ROOT)
+	r := bufio.NewReader(conn)
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response status = %d, expected %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// Send an event, which should be pushed to the client in a text frame.
+	event := proto.JobChainEvent{
+		RequestId: 4,
+		Job:       "job1",
+		State:     proto.STATE_COMPLETE,
+	}
+	events <- event
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x81 {
+		t.Errorf("frame header = %x, expected a final text frame", header[0])
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	var actualEvent proto.JobChainEvent
+	if err := json.Unmarshal(payload, &actualEvent); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actualEvent, event) {
+		t.Errorf("event = %+v, expected %+v", actualEvent, event)
+	}
+
+	// The server closes the WebSocket when the chain is done.
+	close(events)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x88 {
+		t.Errorf("frame header = %x, expected a close frame", header[0])
+	}
+}
+
+func TestStartJobChainNotPending(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c := chain.NewChain(&proto.JobChain{
+		RequestId: uint(4),
+		Jobs:      mock.InitJobs(1),
+	})
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.traverserRepo.Add("4", traverser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetStart() // already started
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/4/start", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr proto.Error
+	err = json.NewDecoder(res.Body).Decode(&apiErr)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 409 {
+		t.Errorf("response status = %d, expected 409", res.StatusCode)
+	}
+	if apiErr.Code != proto.ERR_CHAIN_ALREADY_STARTED {
+		t.Errorf("error code = %s, expected %s", apiErr.Code, proto.ERR_CHAIN_ALREADY_STARTED)
+	}
+}
+
+func TestExpireChains(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c4 := chain.NewChain(&proto.JobChain{RequestId: uint(4), Jobs: mock.InitJobs(1)})
+	c5 := chain.NewChain(&proto.JobChain{RequestId: uint(5), Jobs: mock.InitJobs(1)})
+	t4, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t5, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", t4)
+	api.traverserRepo.Add("5", t5)
+	c5.SetStart() // chain 5 is running
+
+	n := api.expireChains(0)
+	if n != 1 {
+		t.Errorf("expired %d chains, expected 1", n)
+	}
+
+	if _, err := api.traverserRepo.Get("4"); err == nil {
+		t.Error("traverser 4 was not removed from the repo")
+	}
+	if c4.State() != proto.STATE_EXPIRED {
+		t.Errorf("chain 4 state = %d, expected %d", c4.State(), proto.STATE_EXPIRED)
+	}
+	if _, err := api.traverserRepo.Get("5"); err != nil {
+		t.Error("traverser 5 was removed from the repo")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	api.traverserRepo.Add("4", &mock.Traverser{
+		SuspendResp: proto.SuspendedJobChain{
+			RequestId: 4,
+			JobChain:  &proto.JobChain{RequestId: 4, State: proto.STATE_SUSPENDED},
+		},
+	})
+	api.traverserRepo.Add("5", &mock.Traverser{
+		SuspendResp: proto.SuspendedJobChain{
+			RequestId: 5,
+			JobChain:  &proto.JobChain{RequestId: 5, State: proto.STATE_COMPLETE},
+		},
+	})
+
+	suspended := api.Shutdown(time.Second)
+	if len(suspended) != 1 || suspended[0].RequestId != 4 {
+		t.Errorf("suspended = %+v, expected only chain 4", suspended)
+	}
+
+	// No new chains are accepted after Shutdown.
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	res, err := http.Post(h.URL+API_ROOT+"job-chains", "application/json; charset=utf-8", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPostSuspendedJobChains(t *testing.T) {
+	var got []proto.SuspendedJobChain
+	rm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != API_ROOT+"suspended-job-chains" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var sjc proto.SuspendedJobChain
+		if err := json.NewDecoder(r.Body).Decode(&sjc); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, sjc)
+	}))
+	defer rm.Close()
+
+	sjcs := []proto.SuspendedJobChain{
+		{RequestId: 4, JobChain: &proto.JobChain{RequestId: 4}},
+		{RequestId: 5, JobChain: &proto.JobChain{RequestId: 5}},
+	}
+	if err := PostSuspendedJobChains(http.DefaultClient, rm.URL, sjcs, nil); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if len(got) != 2 || got[0].RequestId != 4 || got[1].RequestId != 5 {
+		t.Errorf("Request Manager got %+v, expected chains 4 and 5", got)
+	}
+
+	// Chains that can't be sent are dead letters
+	deadLetters := deadletter.NewStore()
+	if err := PostSuspendedJobChains(http.DefaultClient, rm.URL+"/bad", sjcs, deadLetters); err == nil {
+		t.Error("err = nil, expected an error")
+	}
+	letters := deadLetters.List()
+	if len(letters) != 2 {
+		t.Fatalf("dead letters = %+v, expected chains 4 and 5", letters)
+	}
+	for i, dl := range letters {
+		if dl.Kind != proto.DEAD_LETTER_SUSPENDED_CHAIN || dl.RequestId != sjcs[i].RequestId || dl.URL != rm.URL+"/bad"+API_ROOT+"suspended-job-chains" {
+			t.Errorf("dead letter = %+v, expected suspended chain %d", dl, sjcs[i].RequestId)
+		}
+	}
+}
+
+func TestNewJobChainStrict(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	api.Strict = true
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	payload := `{"requestId":4,"jobs":{"job1":{"name":"job1"}},"maxJobs":1}`
+	res, err := http.Post(h.URL+API_ROOT+"job-chains", "application/json; charset=utf-8", bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteJobChain(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c4 := chain.NewChain(&proto.JobChain{RequestId: uint(4), Jobs: mock.InitJobs(1)})
+	c5 := chain.NewChain(&proto.JobChain{RequestId: uint(5), Jobs: mock.InitJobs(1)})
+	t4, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t5, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", t4)
+	api.traverserRepo.Add("5", t5)
+	c5.SetStart() // chain 5 is running
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	tests := []struct {
+		requestId string
+		status    int
+	}{
+		{"4", http.StatusOK},       // pending
+		{"5", http.StatusConflict}, // running
+		{"6", http.StatusNotFound}, // doesn't exist
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("DELETE", h.URL+API_ROOT+"job-chains/"+test.requestId, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("chain %s: response status = %d, expected %d", test.requestId, res.StatusCode, test.status)
+		}
+	}
+
+	if _, err := api.traverserRepo.Get("4"); err == nil {
+		t.Error("traverser 4 was not removed from the repo")
+	}
+	if _, err := api.chainRepo.Get(4); err == nil {
+		t.Error("chain 4 was not removed from the repo")
+	}
+	if c4.State() != proto.STATE_DELETED {
+		t.Errorf("chain 4 state = %d, expected %d", c4.State(), proto.STATE_DELETED)
+	}
+	if _, err := api.traverserRepo.Get("5"); err != nil {
+		t.Error("traverser 5 was removed from the repo")
+	}
+}
+
+func TestValidateJobChain(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	payload, err := json.Marshal(proto.JobChain{
+		RequestId:     uint(4),
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Post(h.URL+API_ROOT+"job-chains/validate", "application/json; charset=utf-8", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dryRun proto.JobChainDryRun
+	err = json.NewDecoder(res.Body).Decode(&dryRun)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	expect := proto.JobChainDryRun{
+		RequestId: 4,
+		Valid:     true,
+		Errors:    []string{},
+		Steps:     [][]string{{"job1"}, {"job2"}},
+	}
+	if !reflect.DeepEqual(dryRun, expect) {
+		t.Errorf("dry run = %+v, expected %+v", dryRun, expect)
+	}
+
+	// Nothing is kept.
+	if _, err := api.chainRepo.Get(4); err == nil {
+		t.Error("chain is in the repo, expected it not to be")
+	}
+	if _, err := api.traverserRepo.Get("4"); err == nil {
+		t.Error("traverser is in the repo, expected it not to be")
+	}
+}
+
+// An agent registers, gets work for a job in its pool, and sends its result.
+func TestAgents(t *testing.T) {
+	agents := agent.NewRegistry()
+	rf := agent.NewRunnerFactory(&mock.RunnerFactory{}, agents)
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	c := client.NewAgentClient(&http.Client{}, h.URL, "")
+
+	// Not enabled
+	if _, err := c.Register(proto.Agent{Name: "host1", Pool: "db", Version: agent.VERSION}); err == nil {
+		t.Error("err = nil, expected an error when agents are not enabled")
+	}
+	api.Agents = agents
+
+	if _, _, err := c.Next("host1", 10*time.Millisecond); err == nil {
+		t.Error("err = nil, expected an error for an unknown agent")
+	}
+	if _, err := c.Register(proto.Agent{Name: "host1"}); err == nil {
+		t.Error("err = nil, expected an error for an agent without a pool")
+	}
+	reg, err := c.Register(proto.Agent{Name: "host1", Pool: "db", Version: agent.VERSION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reg.Compatible || reg.Version != agent.VERSION || reg.Upgrade != nil {
+		t.Errorf("registration = %+v, expected compatible and no upgrade", reg)
+	}
+	if _, ok, err := c.Next("host1", 10*time.Millisecond); ok || err != nil {
+		t.Errorf("got %t, %v, expected no work", ok, err)
+	}
+
+	jr, err := rf.Make(proto.Job{Name: "job1", Agent: "db"}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(noJobData) }()
+
+	work, ok, err := c.Next("host1", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v, expected work", ok, err)
+	}
+	if work.RequestId != 4 || work.Job.Name != "job1" {
+		t.Errorf("work = %+v, expected job1 for request 4", work)
+	}
+	res, err := c.Update("host1", work.Id, proto.AgentUpdate{Done: true, State: proto.STATE_COMPLETE})
+	if err != nil || res.Stop {
+		t.Errorf("got %+v, %v, expected no stop", res, err)
+	}
+	if state := <-stateChan; state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	if _, err := c.Update("host1", work.Id, proto.AgentUpdate{}); err == nil {
+		t.Error("err = nil, expected an error for work that is done")
+	}
+
+	res2, err := http.Get(h.URL + API_ROOT + "agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []proto.Agent
+	err = json.NewDecoder(res2.Body).Decode(&list)
+	res2.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "host1" || list[0].Pool != "db" {
+		t.Errorf("agents = %+v, expected host1", list)
+	}
+}
+
+func TestAgentsPayload(t *testing.T) {
+	agents := agent.NewRegistry()
+	key, err := payload.NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents.SetPayloadKeys(map[string]cipher.AEAD{"db": key})
+	rf := agent.NewRunnerFactory(&mock.RunnerFactory{}, agents)
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	api.Agents = agents
+
+	var headers []string // X-Spincycle-Payload of every request
+	var mux sync.Mutex
+	h := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		headers = append(headers, r.Header.Get(payload.HEADER))
+		mux.Unlock()
+		api.Router.ServeHTTP(w, r)
+	}))
+	defer h.Close()
+
+	// The JR has no key for pool web
+	c := client.NewAgentClientWithPayload(&http.Client{}, h.URL, "", payload.Codec{Gzip: true, Cipher: key})
+	if _, err := c.Register(proto.Agent{Name: "host2", Pool: "web", Version: agent.VERSION}); err == nil {
+		t.Error("err = nil, expected an error when the JR has no key for the pool")
+	}
+
+	reg, err := c.Register(proto.Agent{Name: "host1", Pool: "db", Version: agent.VERSION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reg.Payload, []string{payload.GZIP, payload.AES_GCM}) {
+		t.Errorf("payload = %v, expected gzip and aes-256-gcm", reg.Payload)
+	}
+
+	jr, err := rf.Make(proto.Job{Name: "job1", Agent: "db"}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(noJobData) }()
+
+	work, ok, err := c.Next("host1", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v, expected work", ok, err)
+	}
+	if work.RequestId != 4 || work.Job.Name != "job1" {
+		t.Errorf("work = %+v, expected job1 for request 4", work)
+	}
+	if _, err := c.Update("host1", work.Id, proto.AgentUpdate{Done: true, State: proto.STATE_COMPLETE}); err != nil {
+		t.Error(err)
+	}
+	if state := <-stateChan; state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+
+	mux.Lock()
+	expect := []string{"", "", "gzip,aes-256-gcm", "gzip,aes-256-gcm"}
+	if !reflect.DeepEqual(headers, expect) {
+		t.Errorf("payload headers = %q, expected %q", headers, expect)
+	}
+	mux.Unlock()
+
+	// A plain update can't be read as encrypted
+	req, _ := http.NewRequest("POST", h.URL+API_ROOT+"agents/host1/work/"+work.Id, strings.NewReader(`{"done":true}`))
+	req.Header.Set(payload.HEADER, payload.AES_GCM)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected 400", res.StatusCode)
+	}
+
+	// The pool has a key, so work and updates without aes-256-gcm, like with
+	// the header dropped, are rejected
+	for _, header := range []string{"", payload.GZIP} {
+		req, _ := http.NewRequest("GET", h.URL+API_ROOT+"agents/host1/work?wait=0s", nil)
+		if header != "" {
+			req.Header.Set(payload.HEADER, header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("payload %q: response status = %d, expected 400", header, res.StatusCode)
+		}
+	}
+}
+
+func TestGetJobChain(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c := chain.NewChain(&proto.JobChain{
+		RequestId:     uint(4),
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+	})
+	api.chainRepo.Set(c)
+	c.SetStart()
+	c.SetJobState("job1", proto.STATE_COMPLETE)
+	c.SetJobState("job2", proto.STATE_FAIL)
+	c.SetIncomplete()
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// The chain is done, so it has no traverser, but it's still in the repo.
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+	var jc proto.JobChain
+	if err := json.NewDecoder(res.Body).Decode(&jc); err != nil {
+		t.Fatal(err)
+	}
+	if jc.RequestId != 4 || jc.State != proto.STATE_INCOMPLETE {
+		t.Errorf("got chain %d state %d, expected chain 4 state %d", jc.RequestId, jc.State, proto.STATE_INCOMPLETE)
+	}
+	if jc.Jobs["job2"].State != proto.STATE_FAIL {
+		t.Errorf("job2 state = %d, expected %d", jc.Jobs["job2"].State, proto.STATE_FAIL)
+	}
+	if !reflect.DeepEqual(jc.AdjacencyList, c.JobChain.AdjacencyList) {
+		t.Errorf("adjacency list = %v, expected %v", jc.AdjacencyList, c.JobChain.AdjacencyList)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestReportJobChain(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c4 := chain.NewChain(&proto.JobChain{RequestId: uint(4), Jobs: mock.InitJobs(1)})
+	c5 := chain.NewChain(&proto.JobChain{RequestId: uint(5), Jobs: mock.InitJobs(1)})
+	api.chainRepo.Set(c4)
+	api.chainRepo.Set(c5)
+	c4.SetReport(proto.JobChainReport{
+		RequestId: 4,
+		State:     proto.STATE_COMPLETE,
+		Jobs: []proto.JobReport{
+			{Name: "job1", Type: "jtype", State: proto.STATE_COMPLETE, Tries: 1},
+		},
+	})
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/4/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report proto.JobChainReport
+	err = json.NewDecoder(res.Body).Decode(&report)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.RequestId != 4 || len(report.Jobs) != 1 || report.Jobs[0].Name != "job1" {
+		t.Errorf("got report %+v, expected report for chain 4 with job1", report)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/4/report?format=text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"COMPLETE", "job1", "jtype"} {
+		if !bytes.Contains(body, []byte(expect)) {
+			t.Errorf("text report does not contain %q:\n%s", expect, body)
+		}
+	}
+
+	// Chain 5 isn't done, so it has no report.
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/5/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestListJobChains(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	c4 := chain.NewChain(&proto.JobChain{RequestId: uint(4), Jobs: mock.InitJobs(2)})
+	c5 := chain.NewChain(&proto.JobChain{RequestId: uint(5), Jobs: mock.InitJobs(1)})
+	api.chainRepo.Set(c5)
+	api.chainRepo.Set(c4)
+	c4.SetStart()
+	c4.SetJobState("job1", proto.STATE_RUNNING)
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	var summaries []proto.JobChainSummary
+	if err := json.NewDecoder(res.Body).Decode(&summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("got %d summaries, expected 2", len(summaries))
+	}
+	s4, s5 := summaries[0], summaries[1]
+	if s4.RequestId != 4 || s4.State != proto.STATE_RUNNING || s4.StartTime.IsZero() || s4.TotalJobs != 2 || s4.RunningJobs != 1 {
+		t.Errorf("chain 4 summary = %+v, expected running with 1 of 2 jobs running", s4)
+	}
+	if s5.RequestId != 5 || s5.State != proto.STATE_PENDING || !s5.StartTime.IsZero() || s5.RunningJobs != 0 {
+		t.Errorf("chain 5 summary = %+v, expected pending", s5)
+	}
+}
+
+func TestListJobChainsMetadata(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	api.chainRepo.Set(chain.NewChain(&proto.JobChain{
+		RequestId: uint(4),
+		Jobs:      mock.InitJobs(1),
+		Metadata:  map[string]string{"ticket": "CHG-1", "reason": "upgrade"},
+	}))
+	api.chainRepo.Set(chain.NewChain(&proto.JobChain{
+		RequestId: uint(5),
+		Jobs:      mock.InitJobs(1),
+		Metadata:  map[string]string{"ticket": "CHG-2", "reason": "upgrade"},
+	}))
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	tests := []struct {
+		query  string
+		expect []uint
+	}{
+		{"", []uint{4, 5}},
+		{"?metadata=reason=upgrade", []uint{4, 5}},
+		{"?metadata=reason=upgrade&metadata=ticket=CHG-2", []uint{5}},
+		{"?metadata=ticket=CHG-3", []uint{}},
+	}
+	for _, test := range tests {
+		res, err := http.Get(h.URL + API_ROOT + "job-chains" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var summaries []proto.JobChainSummary
+		err = json.NewDecoder(res.Body).Decode(&summaries)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []uint{}
+		for _, s := range summaries {
+			got = append(got, s.RequestId)
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: got chains %v, expected %v", test.query, got, test.expect)
+		}
+	}
+	res, err := http.Get(h.URL + API_ROOT + "job-chains?metadata=ticket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestStartJobChainScheduled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	if n, err := api.RestoreScheduledChains(dir); err != nil || n != 0 {
+		t.Fatalf("restored %d chains (error: %v), expected 0", n, err)
+	}
+	c := chain.NewChain(&proto.JobChain{RequestId: uint(4), Jobs: mock.InitJobs(1)})
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", traverser)
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	put := func(path string) int {
+		req, err := http.NewRequest("PUT", h.URL+API_ROOT+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := put("job-chains/4/start?at=tomorrow"); status != http.StatusBadRequest {
+		t.Errorf("response status = %d, expected 400", status)
+	}
+
+	startAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if status := put("job-chains/4/start?at=" + startAt.Format(time.RFC3339)); status != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", status)
+	}
+	if c.State() != proto.STATE_PENDING {
+		t.Errorf("chain state = %s, expected PENDING until it's due", proto.StateName[c.State()])
+	}
+	if summary := c.Summary(); !summary.StartAt.Equal(startAt) {
+		t.Errorf("StartAt = %s, expected %s", summary.StartAt, startAt)
+	}
+
+	// The Job Runner restarts: the scheduled chain is added and scheduled again
+	api.Shutdown(time.Second)
+	api2 := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	if n, err := api2.RestoreScheduledChains(dir); err != nil || n != 1 {
+		t.Fatalf("restored %d chains (error: %v), expected 1", n, err)
+	}
+	c2, err := api2.chainRepo.Get(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.State() != proto.STATE_PENDING {
+		t.Errorf("restored chain state = %s, expected PENDING", proto.StateName[c2.State()])
+	}
+	if at, ok := api2.scheduler.Scheduled(4); !ok || !at.Equal(startAt) {
+		t.Errorf("chain scheduled at %s (%t), expected %s", at, ok, startAt)
+	}
+
+	// Starting it without a time starts it now
+	h2 := httptest.NewServer(api2.Router)
+	defer h2.Close()
+	h.URL = h2.URL
+	if status := put("job-chains/4/start"); status != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", status)
+	}
+	if _, ok := api2.scheduler.Scheduled(4); ok {
+		t.Error("chain is still scheduled after it started")
+	}
+	deadline := time.Now().Add(time.Second)
+	for c2.State() != proto.STATE_COMPLETE && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c2.State() != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %s, expected COMPLETE", proto.StateName[c2.State()])
+	}
+}
+
+func TestCallback(t *testing.T) {
+	type callback struct {
+		signature string
+		body      []byte
+	}
+	callbacks := make(chan callback, 10)
+	tries := 0
+	cbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // retried
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		callbacks <- callback{r.Header.Get(CALLBACK_SIGNATURE_HEADER), body}
+	}))
+	defer cbServer.Close()
+
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"a": "1"}),
+			"job2": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"b": "2"}),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	api.Callbacks.Secret = []byte("secret")
+	api.Callbacks.Wait = 10 * time.Millisecond
+	c := chain.NewChain(&proto.JobChain{
+		RequestId:     uint(4),
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+		CallbackURL:   cbServer.URL,
+	})
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", traverser)
+	api.startChain("4", traverser)
+
+	var cb callback
+	select {
+	case cb = <-callbacks:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no callback")
+	}
+	if tries != 2 {
+		t.Errorf("callback tried %d times, expected 2", tries)
+	}
+	if cb.signature != SignCallback([]byte("secret"), cb.body) {
+		t.Errorf("signature = %q, expected the HMAC of the body", cb.signature)
+	}
+	var payload proto.JobChainCallback
+	if err := json.Unmarshal(cb.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.RequestId != 4 || payload.State != proto.STATE_COMPLETE || len(payload.Report.Jobs) != 2 {
+		t.Errorf("callback = %+v, expected chain 4 complete with 2 jobs", payload)
+	}
+	// job1's jobData was released when job2 completed, job2 is the last job
+	expect := map[string]map[string]interface{}{"job2": {"a": "1", "b": "2"}}
+	if !reflect.DeepEqual(payload.JobData, expect) {
+		t.Errorf("jobData = %v, expected %v", payload.JobData, expect)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	var up bool
+	var gotSignature string
+	upMux := &sync.Mutex{}
+	cbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upMux.Lock()
+		defer upMux.Unlock()
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		gotSignature = r.Header.Get(CALLBACK_SIGNATURE_HEADER)
+		if gotSignature != SignCallback([]byte("secret"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer cbServer.Close()
+
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	api.Callbacks.Secret = []byte("secret")
+	api.Callbacks.Tries = 2
+	api.Callbacks.Wait = 10 * time.Millisecond
+	c := chain.NewChain(&proto.JobChain{
+		RequestId:   uint(4),
+		Jobs:        mock.InitJobs(1),
+		CallbackURL: cbServer.URL,
+	})
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", traverser)
+	api.startChain("4", traverser)
+
+	// The callback fails every try, so it's a dead letter
+	timeout := time.After(2 * time.Second)
+	for len(api.DeadLetters.List()) == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("no dead letter")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letters []proto.DeadLetter
+	err = json.NewDecoder(res.Body).Decode(&letters)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("dead letters = %+v, expected 1", letters)
+	}
+	dl := letters[0]
+	if dl.Kind != proto.DEAD_LETTER_CALLBACK || dl.RequestId != 4 || dl.URL != cbServer.URL || dl.Tries != 2 || dl.Error == "" {
+		t.Errorf("dead letter = %+v, expected chain 4's callback tried twice", dl)
+	}
+
+	retry := func(id string) int {
+		res, err := http.Post(h.URL+API_ROOT+"dead-letters/"+id+"/retry", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// A retry that fails keeps the dead letter
+	if status := retry(dl.Id); status != http.StatusServiceUnavailable {
+		t.Errorf("response status = %d, expected 503", status)
+	}
+	if got, ok := api.DeadLetters.Get(dl.Id); !ok || got.Tries != 3 {
+		t.Errorf("dead letter = %+v, expected it kept with 3 tries", got)
+	}
+
+	// A retry that's delivered, signed like the callback, removes it
+	upMux.Lock()
+	up = true
+	upMux.Unlock()
+	if status := retry(dl.Id); status != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", status)
+	}
+	if _, ok := api.DeadLetters.Get(dl.Id); ok {
+		t.Error("dead letter still kept after it was delivered")
+	}
+	if status := retry(dl.Id); status != http.StatusNotFound {
+		t.Errorf("response status = %d, expected 404", status)
+	}
+
+	// A dead letter can be discarded
+	dl, _ = api.DeadLetters.Add(proto.DeadLetter{Kind: proto.DEAD_LETTER_CALLBACK, RequestId: 5})
+	req, _ := http.NewRequest("DELETE", h.URL+API_ROOT+"dead-letters/"+dl.Id, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", res.StatusCode)
+	}
+	if len(api.DeadLetters.List()) != 0 {
+		t.Errorf("dead letters = %+v, expected none", api.DeadLetters.List())
+	}
+}
+
+func TestProgress(t *testing.T) {
+	progress := make(chan proto.JobChainProgress, 20)
+	pServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p proto.JobChainProgress
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		progress <- p
+	}))
+	defer pServer.Close()
+
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	c := chain.NewChain(&proto.JobChain{
+		RequestId:     uint(4),
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+		ProgressURL:   pServer.URL,
+		ProgressPatch: true,
+	})
+	traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.traverserRepo.Add("4", traverser)
+	api.startChain("4", traverser)
+
+	// Chain RUNNING, job1 RUNNING, job1 COMPLETE, job2 RUNNING, job2 COMPLETE,
+	// chain COMPLETE
+	var got []proto.JobChainProgress
+	for len(got) < 6 {
+		select {
+		case p := <-progress:
+			got = append(got, p)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d progress, expected 6: %+v", len(got), got)
+		}
+	}
+	for i, p := range got {
+		if p.RequestId != 4 || p.Seq != uint(i+1) {
+			t.Errorf("progress %d = %+v, expected chain 4 seq %d", i, p, i+1)
+		}
+		if (i == 0) != (p.JobChain != nil) {
+			t.Errorf("progress %d has chain %t, expected only the first one to", i, p.JobChain != nil)
+		}
+	}
+	if got[5].Event.Job != "" || got[5].Event.State != proto.STATE_COMPLETE {
+		t.Errorf("last progress event = %+v, expected chain COMPLETE", got[5].Event)
+	}
+
+	// The patches change the first chain into the chain as it's done
+	doc, err := jsonValue(got[0].JobChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range got[1:] {
+		for _, op := range p.Patch {
+			keys := strings.Split(op.Path, "/")[1:]
+			obj := doc.(map[string]interface{})
+			for _, k := range keys[:len(keys)-1] {
+				obj = obj[k].(map[string]interface{})
+			}
+			if op.Op == "remove" {
+				delete(obj, keys[len(keys)-1])
+			} else {
+				obj[keys[len(keys)-1]] = op.Value
+			}
+		}
+	}
+	expect, err := jsonValue(c.Definition())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc, expect) {
+		t.Errorf("patched chain = %v, expected %v", doc, expect)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	from := map[string]interface{}{"a": 1.0, "b": map[string]interface{}{"c/d": "x", "e": []interface{}{1.0}}, "gone": true}
+	to := map[string]interface{}{"a": 1.0, "b": map[string]interface{}{"c/d": "y", "e": []interface{}{1.0, 2.0}}, "new": nil}
+	expect := []proto.JSONPatchOp{
+		{Op: "remove", Path: "/gone"},
+		{Op: "replace", Path: "/b/c~1d", Value: "y"},
+		{Op: "replace", Path: "/b/e", Value: []interface{}{1.0, 2.0}},
+		{Op: "add", Path: "/new", Value: nil},
+	}
+	if ops := jsonPatch("", from, to); !reflect.DeepEqual(ops, expect) {
+		t.Errorf("patch = %+v, expected %+v", ops, expect)
+	}
+	if ops := jsonPatch("", to, to); len(ops) != 0 {
+		t.Errorf("patch = %+v, expected none", ops)
+	}
+}
+
+func TestStartJobChainQueued(t *testing.T) {
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, nil, noJobData),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	api.SetMaxRunningChains(1)
+	chains := map[uint]interface {
+		State() byte
+		Summary() proto.JobChainSummary
+	}{}
+	for _, id := range []uint{4, 5, 6} {
+		priority := 0
+		if id == 6 {
+			priority = 1
+		}
+		c := chain.NewChain(&proto.JobChain{RequestId: id, Jobs: mock.InitJobs(1), Priority: priority})
+		traverser, err := chain.NewTraverser(api.chainRepo, api.runnerFactory, api.limiter, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idStr := fmt.Sprintf("%d", id)
+		api.traverserRepo.Add(idStr, traverser)
+		api.startChain(idStr, traverser)
+		chains[id] = c
+
+		// Wait for it to run or be queued, so they're started in order
+		deadline := time.Now().Add(time.Second)
+		for c.State() == proto.STATE_PENDING && api.queue.Position(id) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Chain 4 is running, chain 6 has a higher priority than chain 5
+	if state := chains[4].State(); state != proto.STATE_RUNNING {
+		t.Errorf("chain 4 state = %s, expected RUNNING", proto.StateName[state])
+	}
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	res, err := http.Get(h.URL + API_ROOT + "job-chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []proto.JobChainSummary
+	err = json.NewDecoder(res.Body).Decode(&summaries)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := map[uint]uint{}
+	for _, s := range summaries {
+		queued[s.RequestId] = s.Queued
+	}
+	if expect := map[uint]uint{4: 0, 5: 2, 6: 1}; !reflect.DeepEqual(queued, expect) {
+		t.Errorf("queued = %v, expected %v", queued, expect)
+	}
+
+	// Once chain 4 is done, chain 6 runs, then chain 5
+	close(runBlock)
+	deadline := time.Now().Add(2 * time.Second)
+	for chains[5].State() != proto.STATE_COMPLETE && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, id := range []uint{4, 5, 6} {
+		if state := chains[id].State(); state != proto.STATE_COMPLETE {
+			t.Errorf("chain %d state = %s, expected COMPLETE", id, proto.StateName[state])
+		}
+	}
+	if !chains[6].Summary().StartTime.Before(chains[5].Summary().StartTime) {
+		t.Error("chain 5 started before chain 6, expected the higher priority chain first")
+	}
+}
+
+func TestJobTypes(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	doc := job.Doc{
+		Description: "checks a db",
+		Args:        []job.ArgDoc{{Name: "host", Type: "string", Required: true}},
+		JobData:     []job.DataDoc{{Key: "healthy", Type: "bool"}},
+		Failures:    []job.FailureDoc{{State: "FAIL", Description: "db is down"}},
+	}
+	api.JobDocs = map[string]job.Doc{"db-check": doc}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs map[string]job.Doc
+	err = json.NewDecoder(res.Body).Decode(&docs)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(docs, api.JobDocs) {
+		t.Errorf("docs = %+v, expected %+v", docs, api.JobDocs)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-types/db-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotDoc job.Doc
+	err = json.NewDecoder(res.Body).Decode(&gotDoc)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotDoc, doc) {
+		t.Errorf("doc = %+v, expected %+v", gotDoc, doc)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-types/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("response status = %d, expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	get := func(path string) (int, proto.JobRunnerHealth) {
+		res, err := http.Get(h.URL + API_ROOT + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var health proto.JobRunnerHealth
+		if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, health
+	}
+
+	status, health := get("ready")
+	if status != http.StatusOK || !health.Ready || len(health.Problems) != 0 {
+		t.Errorf("ready: got %d %+v, expected 200 and ready", status, health)
+	}
+	if health.StartTime.IsZero() || health.Uptime == "" {
+		t.Errorf("health = %+v, expected start time and uptime", health)
+	}
+
+	// A Job Runner shutting down is up but not ready
+	api.Shutdown(time.Second)
+	status, health = get("ready")
+	if status != http.StatusServiceUnavailable || health.Ready || len(health.Problems) != 1 || health.Problems[0] != "shutting down" {
+		t.Errorf("ready: got %d %+v, expected 503 shutting down", status, health)
+	}
+	status, health = get("health")
+	if status != http.StatusOK || health.Ready {
+		t.Errorf("health: got %d %+v, expected 200 and not ready", status, health)
+	}
+}
+
+// auditRecorder is an AuditLogger that keeps the events it's given.
+type auditRecorder struct {
+	events []AuditEvent
+}
+
+func (r *auditRecorder) Log(e AuditEvent) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func TestAuditLogger(t *testing.T) {
+	rt := &router.Router{
+		Authenticator: router.TokenAuthenticator{
+			"t1": router.Caller{Name: "alice"},
+			"t2": router.Caller{Name: "chatops", Roles: []string{"automation"}},
+		},
+		Impersonator: router.RoleImpersonator{"automation"},
+	}
+	api := NewAPI(rt, chain.NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}, chain.NewLimiter(0))
+	audit := &auditRecorder{}
+	api.AuditLogger = audit
+
+	err := api.traverserRepo.Add("4", &mock.Traverser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Stop a running chain, then stop one that isn't running
+	for _, id := range []string{"4", "5"} {
+		req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/"+id+"/stop", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer t1")
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// Listing chains isn't a control action
+	res, err := http.Get(h.URL + API_ROOT + "job-chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// The request ID of a new chain is read from its body
+	payload, err := json.Marshal(&proto.JobChain{RequestId: 6, Jobs: mock.InitJobs(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Post(h.URL+API_ROOT+"job-chains", "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("new chain response status = %d, expected 200", res.StatusCode)
+	}
+
+	// An automation account stops a chain on behalf of an operator
+	req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/7/stop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer t2")
+	req.Header.Set(router.ON_BEHALF_OF_HEADER, "finch")
+	res, err = (&http.Client{}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if len(audit.events) != 4 {
+		t.Fatalf("got %d audit events, expected 4: %+v", len(audit.events), audit.events)
+	}
+	for _, e := range audit.events {
+		if e.Time.IsZero() || e.RemoteAddr == "" {
+			t.Errorf("event time or remote addr not set: %+v", e)
+		}
+	}
+	expect := []AuditEvent{
+		{Caller: "alice", Action: AUDIT_STOP, RequestId: 4, Status: http.StatusOK},
+		{Caller: "alice", Action: AUDIT_STOP, RequestId: 5, Status: http.StatusNotFound},
+		{Caller: "", Action: AUDIT_NEW, RequestId: 6, Status: http.StatusOK},
+		{Caller: "chatops", OnBehalfOf: "finch", Action: AUDIT_STOP, RequestId: 7, Status: http.StatusNotFound},
+	}
+	for i, e := range audit.events {
+		e.Time = time.Time{}
+		e.RemoteAddr = ""
+		if e != expect[i] {
+			t.Errorf("event %d = %+v, expected %+v", i, e, expect[i])
+		}
+	}
+}
+
+func TestStopAllJobChains(t *testing.T) {
+	rt := &router.Router{
+		Authenticator: router.TokenAuthenticator{"t1": router.Caller{Name: "alice", Roles: []string{"admin"}}},
+		Authorizer:    router.RoleAuthorizer{"api-stop-all-job-chains": {"admin"}},
+	}
+	api := NewAPI(rt, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	traversers := map[string]*mock.Traverser{
+		"4": &mock.Traverser{},
+		"5": &mock.Traverser{StopErr: chain.ErrJobsForceKilled},
+		"6": &mock.Traverser{StopErr: mock.ErrTraverser},
+	}
+	for id, traverser := range traversers {
+		if err := api.traverserRepo.Add(id, traverser); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Only admins can stop all chains
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "t1": http.StatusOK} {
+		req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/stop-all?grace=1s", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("response status with token %q = %d, expected %d", token, res.StatusCode, status)
+		}
+		if status != http.StatusOK {
+			continue
+		}
+
+		var stopped []proto.StoppedJobChain
+		if err := json.NewDecoder(res.Body).Decode(&stopped); err != nil {
+			t.Fatal(err)
+		}
+		expect := []proto.StoppedJobChain{
+			{RequestId: 4, Stopped: true},
+			{RequestId: 5, Stopped: true, Error: chain.ErrJobsForceKilled.Error()},
+			{RequestId: 6, Stopped: false, Error: mock.ErrTraverser.Error()},
+		}
+		if !reflect.DeepEqual(stopped, expect) {
+			t.Errorf("stopped = %+v, expected %+v", stopped, expect)
+		}
+	}
+
+	for id, traverser := range traversers {
+		if traverser.StopGrace != time.Second {
+			t.Errorf("chain %s stopped with grace %s, expected 1s", id, traverser.StopGrace)
+		}
+	}
+
+	// The chain that couldn't be stopped is still in the repo
+	remaining, err := api.traverserRepo.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining["6"] == nil {
+		t.Errorf("traversers = %v, expected only chain 6", remaining)
+	}
+}
+
+func TestResultJobChain(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	start := time.Date(2017, 6, 1, 15, 0, 0, 0, time.UTC)
+	for _, id := range []uint{4, 5} {
+		c := chain.NewChain(&proto.JobChain{RequestId: id, Jobs: mock.InitJobs(2)})
+		c.ResetJob("job1", map[string]interface{}{"k": "v"}) // final jobData
+		c.SetReport(proto.JobChainReport{
+			RequestId: id,
+			State:     proto.STATE_INCOMPLETE,
+			StartTime: start,
+			EndTime:   start.Add(3 * time.Second),
+			Jobs: []proto.JobReport{
+				{Name: "job1", State: proto.STATE_COMPLETE, Tries: 1, StartTime: start, EndTime: start.Add(time.Second)},
+				{Name: "job2", State: proto.STATE_FAIL, Tries: 2, StartTime: start.Add(time.Second), EndTime: start.Add(3 * time.Second),
+					TryHistory: []proto.JobTry{
+						{Try: 1, State: proto.STATE_FAIL, Error: "error: timeout"},
+						{Try: 2, State: proto.STATE_FAIL, Error: "error: forced error in job"},
+					}},
+			},
+		})
+		c.SetIncomplete()
+		api.chainRepo.Set(c)
+	}
+
+	// Chain 4 finished running, so its result is kept with the error of the
+	// last try of job2
+	api.finish(4)
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	getResult := func(id string) (proto.JobChainResult, int) {
+		res, err := http.Get(h.URL + API_ROOT + "job-chains/" + id + "/result")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result proto.JobChainResult
+		if res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return result, res.StatusCode
+	}
+
+	result, status := getResult("4")
+	if status != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200", status)
+	}
+	expect := proto.JobChainResult{
+		RequestId: 4,
+		State:     proto.STATE_INCOMPLETE,
+		StartTime: start,
+		EndTime:   start.Add(3 * time.Second),
+		Seconds:   3,
+		Summary: proto.CompletionSummary{
+			TotalJobs:   2,
+			Completed:   1,
+			Failed:      1,
+			Seconds:     3,
+			SlowestJobs: []proto.JobRunTime{{Name: "job2", Seconds: 2}, {Name: "job1", Seconds: 1}},
+		},
+		Jobs: map[string]proto.JobResult{
+			"job1": {State: proto.STATE_COMPLETE, Tries: 1, Seconds: 1, Data: map[string]interface{}{"k": "v"}},
+			"job2": {State: proto.STATE_FAIL, Tries: 2, Seconds: 2, Error: "error: forced error in job"},
+		},
+	}
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("result = %+v, expected %+v", result, expect)
+	}
+
+	// Chain 5 isn't kept, so its result is made from the chain repo without
+	// jobData
+	result, status = getResult("5")
+	if status != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200", status)
+	}
+	if result.Jobs["job1"].Data != nil || result.Jobs["job2"].Error != "error: forced error in job" {
+		t.Errorf("result = %+v, expected job states and errors without jobData", result)
+	}
+
+	// Not keeping finished chains removes them from the chain repo
+	api.SetMaxFinishedChains(0)
+	if _, status = getResult("4"); status != http.StatusNotFound {
+		t.Errorf("response status = %d, expected 404", status)
+	}
+	if _, err := api.chainRepo.Get(4); err == nil {
+		t.Error("chain 4 still in the chain repo")
+	}
+}
+
+func TestRetryJobChain(t *testing.T) {
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), rf, chain.NewLimiter(0))
+	c := chain.NewChain(&proto.JobChain{
+		RequestId:     4,
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+	})
+	c.SetJobState("job1", proto.STATE_COMPLETE)
+	c.SetJobState("job2", proto.STATE_FAIL)
+	c.SetIncomplete()
+	api.chainRepo.Set(c)
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	retry := func(id string) int {
+		req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/"+id+"/retry", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := retry("4"); status != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200", status)
+	}
+	timeout := time.After(3 * time.Second)
+	for c.State() != proto.STATE_COMPLETE {
+		select {
+		case <-timeout:
+			t.Fatalf("chain state = %s, expected COMPLETE", proto.StateName[c.State()])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Only the failed job ran again
+	if n := rf.RunnersToReturn["job1"].Runs(); n != 0 {
+		t.Errorf("job1 ran %d times, expected 0", n)
+	}
+	if n := rf.RunnersToReturn["job2"].Runs(); n != 1 {
+		t.Errorf("job2 ran %d times, expected 1", n)
+	}
+
+	// A chain that completed can't be retried
+	for {
+		if _, err := api.traverserRepo.Get("4"); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := retry("4"); status != http.StatusConflict {
+		t.Errorf("response status = %d, expected 409", status)
+	}
+	if status := retry("5"); status != http.StatusNotFound {
+		t.Errorf("response status = %d, expected 404", status)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	tests := []struct {
+		path    string
+		accept  string
+		current string
+	}{
+		{API_ROOT + "versions", "", "v1"},
+		{API_ROOT_V2 + "versions", "", "v2"},
+		{"/api/versions", "", "v1"},
+		{"/api/versions", "application/vnd.spincycle.v2+json", "v2"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", h.URL+test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var versions proto.APIVersions
+		err = json.NewDecoder(res.Body).Decode(&versions)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := proto.APIVersions{Versions: []string{"v1", "v2"}, Default: "v1", Current: test.current}
+		if !reflect.DeepEqual(versions, expect) {
+			t.Errorf("%s (Accept %q): versions = %+v, expected %+v", test.path, test.accept, versions, expect)
+		}
+	}
+
+	// Every route is served by every version
+	res, err := http.Get(h.URL + API_ROOT_V2 + "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get(router.VERSION_HEADER) != "v2" {
+		t.Errorf("v2 health: status = %d, version = %q, expected 200 and v2", res.StatusCode, res.Header.Get(router.VERSION_HEADER))
+	}
+}
+
+func TestQuarantinedJobChains(t *testing.T) {
+	chainRepo := chain.NewMemoryRepo()
+	api := NewAPI(&router.Router{}, chainRepo, &mock.RunnerFactory{}, chain.NewLimiter(0))
+	for id := uint(4); id <= 5; id++ {
+		c := chain.NewChain(&proto.JobChain{RequestId: id, RequestType: "restart", Jobs: mock.InitJobs(1)})
+		if id == 4 {
+			c.SetQuarantined(proto.Quarantine{Panic: "bug", Stack: "goroutine 1"})
+		}
+		if err := chainRepo.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sjc := proto.SuspendedJobChain{RequestId: 4}
+	api.traverserRepo.Add("4", &mock.Traverser{RecoverResp: sjc})
+	api.traverserRepo.Add("5", &mock.Traverser{RecoverErr: chain.ErrNotQuarantined})
+
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/quarantined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quarantined []proto.QuarantinedJobChain
+	err = json.NewDecoder(res.Body).Decode(&quarantined)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []proto.QuarantinedJobChain{
+		{RequestId: 4, RequestType: "restart", Quarantine: proto.Quarantine{Panic: "bug", Stack: "goroutine 1"}},
+	}
+	if !reflect.DeepEqual(quarantined, expect) {
+		t.Errorf("quarantined = %+v, expected %+v", quarantined, expect)
+	}
+
+	recoverChain := func(id string) *http.Response {
+		req, err := http.NewRequest("PUT", h.URL+API_ROOT+"job-chains/"+id+"/recover", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := (&http.Client{}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Not quarantined
+	res = recoverChain("5")
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("response status = %d, expected 409", res.StatusCode)
+	}
+
+	// Recovered and removed, and the response is the suspended chain
+	res = recoverChain("4")
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200", res.StatusCode)
+	}
+	var recovered proto.SuspendedJobChain
+	if err := json.NewDecoder(res.Body).Decode(&recovered); err != nil {
+		t.Fatal(err)
+	}
+	if recovered.RequestId != 4 {
+		t.Errorf("recovered chain %d, expected 4", recovered.RequestId)
+	}
+	if _, err := api.traverserRepo.Get("4"); err == nil {
+		t.Error("traverser of the recovered chain is in the repo, expected it removed")
+	}
+}
+
+func TestJobArtifacts(t *testing.T) {
+	api := NewAPI(&router.Router{}, chain.NewMemoryRepo(), &mock.RunnerFactory{}, chain.NewLimiter(0))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Not enabled
+	res, err := http.Get(h.URL + API_ROOT + "job-chains/1/jobs/job1/artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected 503 without an artifact store", res.StatusCode)
+	}
+
+	dir, err := ioutil.TempDir("", "api-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	api.Artifacts = runner.NewDirArtifactStore(dir)
+	err = api.Artifacts.Put(1, "job1", job.Artifact{Name: "report.html", ContentType: "text/html", Data: []byte("<p>ok</p>")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/1/jobs/job1/artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artifacts []proto.JobArtifact
+	err = json.NewDecoder(res.Body).Decode(&artifacts)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []proto.JobArtifact{{Name: "report.html", ContentType: "text/html", Size: 9}}
+	if !reflect.DeepEqual(artifacts, expect) {
+		t.Errorf("artifacts = %+v, expected %+v", artifacts, expect)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/1/jobs/job1/artifacts/report.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/html" || string(body) != "<p>ok</p>" {
+		t.Errorf("artifact = %s %q, expected text/html <p>ok</p>", ct, body)
+	}
+
+	res, err = http.Get(h.URL + API_ROOT + "job-chains/1/jobs/job1/artifacts/nope.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, expected 404 for an artifact the job doesn't have", res.StatusCode)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/internal/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	AUDIT_NEW      = "new"      // POST a new job chain
+	AUDIT_START    = "start"    // start a job chain
+	AUDIT_STOP     = "stop"     // stop a job chain
+	AUDIT_STOP_ALL = "stop-all" // stop all job chains
+	AUDIT_STATUS   = "status"   // get the status of a running job chain
+	AUDIT_DELETE   = "delete"   // delete a job chain that wasn't started
+	AUDIT_RECOVER  = "recover"  // recover a quarantined job chain
+	AUDIT_RETRY    = "retry"    // retry a failed job chain
+)
+
+// An AuditEvent is one control action on a job chain: who did what to which
+// chain, when, and the outcome.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Caller     string    `json:"caller"`               // router.Caller.Name, empty if anonymous
+	OnBehalfOf string    `json:"onBehalfOf,omitempty"` // operator the caller acted for (router.Caller.OnBehalfOf)
+	RemoteAddr string    `json:"remoteAddr"`           // address of the client
+	Action     string    `json:"action"`               // AUDIT_* const
+	RequestId  uint      `json:"requestId"`            // 0 if unknown, like for an invalid new chain, or for stop-all
+	Status     int       `json:"status"`               // HTTP status of the response: 2xx if it succeeded
+}
+
+// An AuditLogger records audit events, so compliance teams can reconstruct who
+// did what to a chain and when. It's called after the action, and it should
+// not block for long. If it returns an error, the error is logged; the action
+// is not undone.
+type AuditLogger interface {
+	Log(AuditEvent) error
+}
+
+// FileAuditLogger is an AuditLogger that appends audit events to a file, one
+// JSON object per line.
+type FileAuditLogger struct {
+	file *os.File
+	// --
+	*sync.Mutex // guards writes to file
+}
+
+// NewFileAuditLogger opens a file, making it if it doesn't exist, to append
+// audit events to.
+func NewFileAuditLogger(file string) (*FileAuditLogger, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditLogger{
+		file:  f,
+		Mutex: &sync.Mutex{},
+	}, nil
+}
+
+func (l *FileAuditLogger) Log(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// SyslogAuditLogger is an AuditLogger that sends audit events to the local
+// syslog as JSON, with the auth facility.
+type SyslogAuditLogger struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditLogger connects to the local syslog, tagging audit events with
+// tag.
+func NewSyslogAuditLogger(tag string) (*SyslogAuditLogger, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditLogger{w: w}, nil
+}
+
+func (l *SyslogAuditLogger) Log(e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return l.w.Info(string(line))
+}
+
+// -------------------------------------------------------------------------- //
+
+// audited wraps a controller to record calls with the given method as the
+// action with the API's AuditLogger, if any. Calls with other methods, like
+// GET of a handler that also handles DELETE, are not recorded.
+func (api *API) audited(method, action string, handler func(router.HTTPContext)) func(router.HTTPContext) {
+	return func(ctx router.HTTPContext) {
+		if api.AuditLogger == nil || ctx.Request.Method != method {
+			handler(ctx)
+			return
+		}
+
+		e := AuditEvent{
+			Time:       time.Now().UTC(),
+			Caller:     ctx.Caller.Name,
+			OnBehalfOf: ctx.Caller.OnBehalfOf,
+			RemoteAddr: ctx.Request.RemoteAddr,
+			Action:     action,
+		}
+		if len(ctx.Arguments) > 1 {
+			e.RequestId = requestId(ctx.Arguments[1])
+		} else if action == AUDIT_NEW {
+			// The request ID of a new chain is in the body, which the
+			// handler reads, so read it first and put it back.
+			body, _ := ioutil.ReadAll(ctx.Request.Body)
+			ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var jc struct {
+				RequestId uint `json:"requestId"`
+			}
+			json.Unmarshal(body, &jc)
+			e.RequestId = jc.RequestId
+		}
+
+		sw := &statusWriter{ResponseWriter: ctx.Response, status: http.StatusOK}
+		ctx.Response = sw
+		handler(ctx)
+		e.Status = sw.status
+
+		if err := api.AuditLogger.Log(e); err != nil {
+			log.Errorf("[chain=%d]: Can't record audit event %+v (error: %s).", e.RequestId, e, err)
+		}
+	}
+}
+
+// audit records an action on one chain with the API's AuditLogger, if any, for
+// controllers that act on many chains in one call.
+func (api *API) audit(ctx router.HTTPContext, action string, requestId uint, status int) {
+	if api.AuditLogger == nil {
+		return
+	}
+	e := AuditEvent{
+		Time:       time.Now().UTC(),
+		Caller:     ctx.Caller.Name,
+		OnBehalfOf: ctx.Caller.OnBehalfOf,
+		RemoteAddr: ctx.Request.RemoteAddr,
+		Action:     action,
+		RequestId:  requestId,
+		Status:     status,
+	}
+	if err := api.AuditLogger.Log(e); err != nil {
+		log.Errorf("[chain=%d]: Can't record audit event %+v (error: %s).", e.RequestId, e, err)
+	}
+}
+
+// statusWriter is an http.ResponseWriter that records the status of the
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
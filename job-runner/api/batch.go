@@ -0,0 +1,173 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MAX_BATCH_CHAINS is the max number of chains in one batch (POST
+// job-chains/batch).
+const MAX_BATCH_CHAINS = 100
+
+// POST <API_ROOT>/job-chains/batch
+// Add many job chains in one call (proto.JobChainBatch), so the Request Manager
+// doesn't need a call per chain. Every chain is decoded and validated like a
+// chain added on its own, and the response is a proto.JobChainBatchResult with
+// whether each one was added. In BATCH_MODE_INDIVIDUAL (default), valid chains
+// are added even if others are rejected. In BATCH_MODE_ATOMIC, no chain is
+// added if any is rejected. Every chain is recorded in the audit log, like a
+// chain added on its own.
+func (api *API) batchJobChainsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "POST":
+		if api.shuttingDown() {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_SHUTTING_DOWN, "Job Runner is shutting down, not accepting new chains.")
+			return
+		}
+
+		// The chains are decoded one by one, like chains added on their own.
+		var batch struct {
+			Mode   string            `json:"mode"`
+			Chains []json.RawMessage `json:"chains"`
+		}
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&batch); err != nil {
+			ctx.APIError(router.ErrBadRequest, "Invalid batch (error: %s)", err)
+			return
+		}
+		mode := batch.Mode
+		if mode == "" {
+			mode = proto.BATCH_MODE_INDIVIDUAL
+		}
+		if mode != proto.BATCH_MODE_INDIVIDUAL && mode != proto.BATCH_MODE_ATOMIC {
+			ctx.APIError(router.ErrInvalidParam, "Invalid batch mode: %s", batch.Mode)
+			return
+		}
+		if len(batch.Chains) > MAX_BATCH_CHAINS {
+			ctx.APIError(router.ErrBadRequest, "Too many chains: %d, max %d", len(batch.Chains), MAX_BATCH_CHAINS)
+			return
+		}
+
+		decode := decodeJobChain
+		if api.Strict {
+			decode = decodeJobChainStrict
+		}
+		chains := make([]proto.JobChain, len(batch.Chains))
+		result := proto.JobChainBatchResult{
+			Mode:    mode,
+			Results: make([]proto.AddedJobChain, len(batch.Chains)),
+		}
+		for i, raw := range batch.Chains {
+			jc, err := decode(bytes.NewReader(raw))
+			chains[i] = jc
+			result.Results[i].RequestId = jc.RequestId
+			if err != nil {
+				result.Results[i].Code = proto.ERR_BAD_REQUEST
+				result.Results[i].Error = fmt.Sprintf("Invalid job chain (error: %s)", err)
+			}
+		}
+
+		api.newChainMux.Lock()
+		defer api.newChainMux.Unlock()
+
+		// Check every chain before adding any, so an atomic batch with a bad
+		// chain adds nothing.
+		seen := map[uint]bool{}
+		rejected := false
+		for i, jc := range chains {
+			r := &result.Results[i]
+			if r.Error == "" {
+				if seen[jc.RequestId] {
+					r.Code = proto.ERR_CHAIN_EXISTS
+					r.Error = fmt.Sprintf("Chain %d is in the batch more than once.", jc.RequestId)
+				} else if _, cerr := api.addChain(jc, ctx.Request.Header, true); cerr != nil {
+					r.Code = cerr.code
+					r.Error = cerr.message
+				}
+			}
+			seen[jc.RequestId] = true
+			rejected = rejected || r.Error != ""
+		}
+
+		if mode == proto.BATCH_MODE_ATOMIC && rejected {
+			rejectBatch(result.Results, -1)
+		} else {
+			added := []uint{}
+			for i, jc := range chains {
+				r := &result.Results[i]
+				if r.Error != "" {
+					continue
+				}
+				existing, cerr := api.addChain(jc, ctx.Request.Header, false)
+				if cerr != nil {
+					r.Code = cerr.code
+					r.Error = cerr.message
+					if mode == proto.BATCH_MODE_ATOMIC {
+						api.removeChains(added)
+						rejectBatch(result.Results, i)
+						break
+					}
+					continue
+				}
+				r.Accepted = true
+				if existing == nil {
+					added = append(added, jc.RequestId)
+				}
+			}
+		}
+
+		for _, r := range result.Results {
+			status := http.StatusOK
+			switch {
+			case r.Accepted:
+			case r.Code == proto.ERR_CHAIN_EXISTS:
+				status = http.StatusConflict
+			default:
+				status = http.StatusBadRequest
+			}
+			api.audit(ctx, AUDIT_NEW, r.RequestId, status)
+		}
+
+		if out, err := marshal(result); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// removeChains removes chains that were added by an atomic batch that was then
+// rejected, and their traversers. The chains weren't started.
+func (api *API) removeChains(requestIds []uint) {
+	for _, id := range requestIds {
+		log.Infof("[chain=%d]: Removing chain, its batch was rejected.", id)
+		api.traverserRepo.Remove(strconv.FormatUint(uint64(id), 10))
+		if err := api.chainRepo.Remove(id); err != nil {
+			log.Errorf("[chain=%d]: Error removing chain (error: %s).", id, err)
+		}
+	}
+}
+
+// rejectBatch rejects every chain in an atomic batch that wasn't rejected
+// itself, except the chain at index failed, whose error is already set.
+func rejectBatch(results []proto.AddedJobChain, failed int) {
+	for i := range results {
+		if i == failed || (results[i].Error != "" && !results[i].Accepted) {
+			continue
+		}
+		results[i].Accepted = false
+		results[i].Code = proto.ERR_BATCH_REJECTED
+		results[i].Error = "Not added because another chain in the batch was rejected."
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CALLBACK_SIGNATURE_HEADER is the header of a callback with its signature.
+const CALLBACK_SIGNATURE_HEADER = "X-Spincycle-Signature"
+
+// Callbacks POSTs a proto.JobChainCallback to the callback URL of chains that
+// are done running. If Secret is set, callbacks are signed: the
+// CALLBACK_SIGNATURE_HEADER header is SignCallback of the body, which the
+// receiver should verify with the same secret. A callback that fails is tried
+// again up to Tries times in all, waiting Wait before the first retry and
+// twice as long before each one after.
+type Callbacks struct {
+	Client *http.Client
+	Secret []byte // HMAC-SHA256 key, nil = callbacks are not signed
+	Tries  uint
+	Wait   time.Duration
+}
+
+// NewCallbacks returns Callbacks that are not signed and are tried 5 times.
+func NewCallbacks() *Callbacks {
+	return &Callbacks{
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Tries:  5,
+		Wait:   time.Second,
+	}
+}
+
+// SignCallback returns the signature of a callback body: "sha256=" and the
+// hex-encoded HMAC-SHA256 of the body.
+func SignCallback(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send POSTs the callback to callbackURL, retrying if it fails. It blocks until
+// the callback is received or every try failed, in which case it returns the
+// last error.
+func (c *Callbacks) Send(callbackURL string, cb proto.JobChainCallback) error {
+	body, err := json.Marshal(cb)
+	if err != nil {
+		return err
+	}
+	tries := c.Tries
+	if tries == 0 {
+		tries = 1
+	}
+	wait := c.Wait
+	for try := uint(1); ; try++ {
+		err = c.post(callbackURL, body)
+		if err == nil {
+			return nil
+		}
+		if try == tries {
+			return err
+		}
+		log.Warnf("[chain=%d]: Callback to %s failed (try %d of %d): %s", cb.RequestId, callbackURL, try, tries, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// SendProgress POSTs the progress to progressURL once. Progress isn't retried
+// because the next progress supersedes it.
+func (c *Callbacks) SendProgress(progressURL string, p proto.JobChainProgress) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return c.post(progressURL, body)
+}
+
+func (c *Callbacks) post(callbackURL string, body []byte) error {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Secret != nil {
+		req.Header.Set(CALLBACK_SIGNATURE_HEADER, SignCallback(c.Secret, body))
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unsuccessful status code: %d (response body: %s)", resp.StatusCode, string(respBody))
+	}
+	return nil
+}
+
+// ========================================================================= //
+
+// callback sends the callback for a chain that's done running, if the chain
+// has a callback URL. Suspended chains aren't done; they're resumed elsewhere,
+// which sends the callback.
+func (api *API) callback(requestId uint) {
+	if api.Callbacks == nil {
+		return
+	}
+	c, err := api.chainRepo.Get(requestId)
+	if err != nil {
+		return
+	}
+	jc := c.Snapshot()
+	if jc.CallbackURL == "" || (jc.State != proto.STATE_COMPLETE && jc.State != proto.STATE_INCOMPLETE) {
+		return
+	}
+	report, _ := c.Report()
+	cb := proto.JobChainCallback{
+		RequestId: requestId,
+		State:     jc.State,
+		Summary:   chain.Summarize(report),
+		Report:    report,
+		JobData:   map[string]map[string]interface{}{},
+	}
+	for name, job := range jc.Jobs {
+		if len(job.Data) > 0 {
+			cb.JobData[name] = job.Data
+		}
+	}
+	if err := api.Callbacks.Send(jc.CallbackURL, cb); err != nil {
+		log.Errorf("[chain=%d]: Can't send callback to %s (error: %s).", requestId, jc.CallbackURL, err)
+		if body, jerr := json.Marshal(cb); jerr == nil && api.DeadLetters != nil {
+			tries := api.Callbacks.Tries
+			if tries == 0 {
+				tries = 1
+			}
+			addDeadLetter(api.DeadLetters, proto.DeadLetter{
+				Kind:      proto.DEAD_LETTER_CALLBACK,
+				RequestId: requestId,
+				URL:       jc.CallbackURL,
+				Body:      body,
+				Error:     err.Error(),
+				Tries:     tries,
+			})
+		}
+		return
+	}
+	log.Infof("[chain=%d]: Sent callback to %s.", requestId, jc.CallbackURL)
+}
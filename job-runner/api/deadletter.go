@@ -0,0 +1,124 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"fmt"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/deadletter"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GET <API_ROOT>/dead-letters
+// List what the Job Runner couldn't deliver after every try, oldest first: a
+// list of proto.DeadLetter.
+func (api *API) deadLettersHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		letters := []proto.DeadLetter{}
+		if api.DeadLetters != nil {
+			letters = api.DeadLetters.List()
+		}
+		if out, err := marshal(letters); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET|DELETE <API_ROOT>/dead-letters/{id}
+// Get a dead letter (proto.DeadLetter), or discard it: it's removed and never
+// delivered.
+func (api *API) deadLetterHandler(ctx router.HTTPContext) {
+	id := ctx.Arguments[1]
+	dl, ok := api.getDeadLetter(id)
+	if !ok {
+		ctx.APIError(router.ErrNotFound, "Dead letter %s not found.", id)
+		return
+	}
+	switch ctx.Request.Method {
+	case "GET":
+		if out, err := marshal(dl); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	case "DELETE":
+		api.DeadLetters.Remove(id)
+		log.Warnf("[chain=%d]: %s discarded %s dead letter %s to %s.", dl.RequestId, ctx.Caller.Name, dl.Kind, id, dl.URL)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// POST <API_ROOT>/dead-letters/{id}/retry
+// Try to deliver a dead letter again, once. If it's delivered, it's removed.
+// If not, the error is a 503 and the dead letter is kept with the new error.
+func (api *API) retryDeadLetterHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "POST":
+		id := ctx.Arguments[1]
+		dl, ok := api.getDeadLetter(id)
+		if !ok {
+			ctx.APIError(router.ErrNotFound, "Dead letter %s not found.", id)
+			return
+		}
+
+		err := api.redeliver(dl)
+		dl.Tries++
+		if err != nil {
+			dl.Error = err.Error()
+			if _, serr := api.DeadLetters.Update(dl); serr != nil {
+				log.Errorf("[chain=%d]: Can't save dead letter %s (error: %s).", dl.RequestId, id, serr)
+			}
+			ctx.APIError(router.ErrUnavailable, "Can't deliver %s to %s (error: %s)", dl.Kind, dl.URL, err)
+			return
+		}
+		api.DeadLetters.Remove(id)
+		log.Infof("[chain=%d]: Delivered %s dead letter %s to %s (try %d).", dl.RequestId, dl.Kind, id, dl.URL, dl.Tries)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// getDeadLetter returns a dead letter, and false if dead letters aren't kept or
+// it isn't one of them.
+func (api *API) getDeadLetter(id string) (proto.DeadLetter, bool) {
+	if api.DeadLetters == nil {
+		return proto.DeadLetter{}, false
+	}
+	return api.DeadLetters.Get(id)
+}
+
+// redeliver POSTs a dead letter to its URL once, like it was POSTed the first
+// time: callbacks are signed if Callbacks.Secret is set.
+func (api *API) redeliver(dl proto.DeadLetter) error {
+	callbacks := api.Callbacks
+	if callbacks == nil {
+		callbacks = NewCallbacks()
+	}
+	switch dl.Kind {
+	case proto.DEAD_LETTER_CALLBACK:
+		return callbacks.post(dl.URL, dl.Body)
+	case proto.DEAD_LETTER_SUSPENDED_CHAIN:
+		return postJSON(callbacks.Client, dl.URL, dl.Body)
+	}
+	return fmt.Errorf("unknown kind of dead letter: %s", dl.Kind)
+}
+
+// addDeadLetter adds something that couldn't be delivered to deadLetters. If it
+// can't be saved in the store's Dir, it's logged, and kept until the JR exits.
+func addDeadLetter(deadLetters *deadletter.Store, dl proto.DeadLetter) {
+	dl, err := deadLetters.Add(dl)
+	if err != nil {
+		log.Errorf("[chain=%d]: Can't save %s dead letter to %s (error: %s).", dl.RequestId, dl.Kind, dl.URL, err)
+		return
+	}
+	log.Warnf("[chain=%d]: Kept %s to %s as dead letter %s, retry it with POST dead-letters/%s/retry.", dl.RequestId, dl.Kind, dl.URL, dl.Id, dl.Id)
+}
@@ -0,0 +1,163 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/square/spincycle/proto"
+)
+
+// decodeJobChain decodes a job chain. Jobs are identified by their keys in
+// "jobs", so a job can omit its name. Duplicate keys in "jobs" are always an
+// error because only the last job with the key would be kept.
+func decodeJobChain(r io.Reader) (proto.JobChain, error) {
+	var jc proto.JobChain
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return jc, err
+	}
+	if err := json.Unmarshal(data, &jc); err != nil {
+		return jc, err
+	}
+	return jc, checkDuplicateJobs(data)
+}
+
+// decodeJobChainStrict decodes a job chain like decodeJobChain, but it also
+// rejects payloads with mistakes that would otherwise be silently ignored. This
+// catches schema drift between clients and the Job Runner early. It returns an
+// error if the payload has:
+//   - unknown fields or trailing data
+//   - duplicate job names (keys in "jobs"), or a job name that doesn't match its key
+//   - unknown job or chain states
+//   - duplicate keys in "adjacencyList", or duplicate edges
+func decodeJobChainStrict(r io.Reader) (proto.JobChain, error) {
+	var jc proto.JobChain
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return jc, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&jc); err != nil {
+		return jc, err
+	}
+	if decoder.More() {
+		return jc, errors.New("unexpected data after the job chain")
+	}
+
+	if err := checkDuplicateJobs(data); err != nil {
+		return jc, err
+	}
+	var raw struct {
+		AdjacencyList json.RawMessage `json:"adjacencyList"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return jc, err
+	}
+	if dups, err := duplicateKeys(raw.AdjacencyList); err != nil {
+		return jc, err
+	} else if len(dups) > 0 {
+		return jc, fmt.Errorf("duplicate adjacency list entries for jobs: %s", strings.Join(dups, ", "))
+	}
+
+	if _, ok := proto.StateName[jc.State]; !ok {
+		return jc, fmt.Errorf("chain has unknown state %d", jc.State)
+	}
+
+	names := make([]string, 0, len(jc.Jobs))
+	for name := range jc.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		job := jc.Jobs[name]
+		if job.Name != "" && job.Name != name {
+			return jc, fmt.Errorf("job %s has name %q, expected it to match its key", name, job.Name)
+		}
+		if _, ok := proto.StateName[job.State]; !ok {
+			return jc, fmt.Errorf("job %s has unknown state %d", name, job.State)
+		}
+	}
+
+	names = names[:0]
+	for name := range jc.AdjacencyList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seen := map[string]bool{}
+		for _, next := range jc.AdjacencyList[name] {
+			if seen[next] {
+				return jc, fmt.Errorf("duplicate edge %s -> %s", name, next)
+			}
+			seen[next] = true
+		}
+	}
+
+	return jc, nil
+}
+
+// checkDuplicateJobs returns an error listing the duplicate keys in the "jobs"
+// object of a raw job chain. Duplicate keys are lost when decoding into a map,
+// so they have to be found in the raw JSON.
+func checkDuplicateJobs(data []byte) error {
+	var raw struct {
+		Jobs json.RawMessage `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	dups, err := duplicateKeys(raw.Jobs)
+	if err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		return fmt.Errorf("duplicate job names: %s", strings.Join(dups, ", "))
+	}
+	return nil
+}
+
+// duplicateKeys returns the sorted keys that appear more than once in a raw
+// JSON object. A missing or null object has no keys.
+func duplicateKeys(obj json.RawMessage) ([]string, error) {
+	if len(obj) == 0 || string(obj) == "null" {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(obj))
+	if _, err := decoder.Token(); err != nil { // {
+		return nil, err
+	}
+	count := map[string]int{}
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		count[key]++
+
+		var value json.RawMessage // skip the value
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+
+	dups := []string{}
+	for key, n := range count {
+		if n > 1 {
+			dups = append(dups, key)
+		}
+	}
+	sort.Strings(dups)
+	return dups, nil
+}
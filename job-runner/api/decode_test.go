@@ -0,0 +1,96 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeJobChain(t *testing.T) {
+	// Jobs can omit their name, and unknown fields are ignored.
+	payload := `{"requestId":1,"jobs":{"a":{},"b":{"name":"b"}},"adjacencyList":{"a":["b"]},"foo":1}`
+	jc, err := decodeJobChain(strings.NewReader(payload))
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if len(jc.Jobs) != 2 {
+		t.Errorf("got %d jobs, expected 2", len(jc.Jobs))
+	}
+
+	// Duplicate jobs are always an error.
+	payload = `{"jobs":{"a":{},"b":{},"a":{},"c":{},"b":{}}}`
+	_, err = decodeJobChain(strings.NewReader(payload))
+	if err == nil || err.Error() != "duplicate job names: a, b" {
+		t.Errorf("err = %v, expected duplicate job names: a, b", err)
+	}
+}
+
+func TestDecodeJobChainStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     string // substring of the expected error, empty = no error
+	}{
+		{
+			name:    "valid",
+			payload: `{"requestId":1,"jobs":{"a":{"name":"a"},"b":{"name":"b"}},"adjacencyList":{"a":["b"]}}`,
+		},
+		{
+			name:    "job name omitted",
+			payload: `{"requestId":1,"jobs":{"a":{},"b":{"name":"b"}},"adjacencyList":{"a":["b"]}}`,
+		},
+		{
+			name:    "unknown field",
+			payload: `{"requestId":1,"jobz":{}}`,
+			err:     `unknown field "jobz"`,
+		},
+		{
+			name:    "trailing data",
+			payload: `{"requestId":1} {"requestId":2}`,
+			err:     "unexpected data",
+		},
+		{
+			name:    "duplicate job",
+			payload: `{"jobs":{"a":{"name":"a"},"b":{"name":"b"},"a":{"name":"a"}}}`,
+			err:     "duplicate job names: a",
+		},
+		{
+			name:    "job name does not match key",
+			payload: `{"jobs":{"a":{"name":"b"}}}`,
+			err:     `job a has name "b"`,
+		},
+		{
+			name:    "unknown job state",
+			payload: `{"jobs":{"a":{"name":"a","state":200}}}`,
+			err:     "job a has unknown state 200",
+		},
+		{
+			name:    "unknown chain state",
+			payload: `{"state":200}`,
+			err:     "chain has unknown state 200",
+		},
+		{
+			name:    "duplicate adjacency list entry",
+			payload: `{"jobs":{"a":{"name":"a"},"b":{"name":"b"}},"adjacencyList":{"a":["b"],"a":["b"]}}`,
+			err:     "duplicate adjacency list entries for jobs: a",
+		},
+		{
+			name:    "duplicate edge",
+			payload: `{"jobs":{"a":{"name":"a"},"b":{"name":"b"}},"adjacencyList":{"a":["b","b"]}}`,
+			err:     "duplicate edge a -> b",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := decodeJobChainStrict(strings.NewReader(test.payload))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: err = %s, expected nil", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: err = nil, expected %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: err = %s, expected %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/proto"
+)
+
+// GET <API_ROOT>/health
+// Check that the Job Runner is up. It always responds 200 OK with a
+// proto.JobRunnerHealth, even if the Job Runner isn't ready, so orchestrators
+// only restart a Job Runner that doesn't respond.
+func (api *API) healthHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		api.writeHealth(ctx, api.health(), http.StatusOK)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/ready
+// Check that the Job Runner is ready to take new chains: the chain repo can be
+// read, the runner factory is set, chains aren't waiting to run because too
+// many are running, and it isn't shutting down. It responds 200 OK if it's
+// ready, else 503 Service Unavailable, with a proto.JobRunnerHealth that says
+// why, so load balancers send new chains to other Job Runners.
+func (api *API) readyHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		health := api.health()
+		status := http.StatusOK
+		if !health.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		api.writeHealth(ctx, health, status)
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// health checks if the Job Runner is ready.
+func (api *API) health() proto.JobRunnerHealth {
+	running, waiting := api.queue.Len()
+	health := proto.JobRunnerHealth{
+		Problems:         []string{},
+		StartTime:        api.startTime,
+		Uptime:           time.Since(api.startTime).Round(time.Second).String(),
+		RunningChains:    running,
+		QueuedChains:     waiting,
+		MaxRunningChains: api.queue.Max(),
+	}
+	if _, err := api.chainRepo.GetAll(); err != nil {
+		health.Problems = append(health.Problems, fmt.Sprintf("can't read the chain repo: %s", err))
+	}
+	if api.runnerFactory == nil {
+		health.Problems = append(health.Problems, "no runner factory")
+	}
+	if waiting > 0 {
+		health.Problems = append(health.Problems, fmt.Sprintf("%d chains are waiting to run", waiting))
+	}
+	select {
+	case <-api.shutdownChan:
+		health.Problems = append(health.Problems, "shutting down")
+	default:
+	}
+	health.Ready = len(health.Problems) == 0
+	return health
+}
+
+func (api *API) writeHealth(ctx router.HTTPContext, health proto.JobRunnerHealth, status int) {
+	out, err := marshal(health)
+	if err != nil {
+		ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		return
+	}
+	ctx.Response.Header().Set("Content-Type", "application/json")
+	ctx.Response.WriteHeader(status)
+	fmt.Fprintln(ctx.Response, string(out))
+}
@@ -0,0 +1,122 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// progress sends a proto.JobChainProgress to the chain's progress URL, if it
+// has one, every time the state of the chain or one of its jobs changes, until
+// the chain is done running. It subscribes to the traverser's events before it
+// returns, so call it before running the traverser so no events are missed. It
+// returns a function to stop sending progress, like if the traverser doesn't
+// run.
+func (api *API) progress(requestId uint, traverser chain.Traverser) func() {
+	if api.Callbacks == nil {
+		return func() {}
+	}
+	c, err := api.chainRepo.Get(requestId)
+	if err != nil {
+		return func() {}
+	}
+	jc := c.Definition()
+	if jc.ProgressURL == "" {
+		return func() {}
+	}
+
+	events, unsubscribe := traverser.Subscribe()
+	go func() {
+		defer unsubscribe()
+		var seq uint
+		var last interface{} // chain in the last progress sent, nil if it failed
+		for event := range events {
+			jc := c.Definition()
+			doc, err := jsonValue(jc)
+			if err != nil {
+				log.Errorf("[chain=%d]: Can't encode progress (error: %s).", requestId, err)
+				continue
+			}
+			seq++
+			p := proto.JobChainProgress{
+				RequestId: requestId,
+				Seq:       seq,
+				Event:     event,
+			}
+			if jc.ProgressPatch && last != nil {
+				p.Patch = jsonPatch("", last, doc)
+			} else {
+				p.JobChain = &jc
+			}
+			if err := api.Callbacks.SendProgress(jc.ProgressURL, p); err != nil {
+				log.Warnf("[chain=%d]: Can't send progress %d to %s (error: %s).", requestId, seq, jc.ProgressURL, err)
+				last = nil
+				continue
+			}
+			last = doc
+		}
+	}()
+	return unsubscribe
+}
+
+// jsonValue returns v as decoded from JSON into an interface{}: objects are
+// map[string]interface{}, arrays are []interface{}, and so on.
+func jsonValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// jsonPointerEscaper escapes a key in a JSON Pointer (RFC 6901).
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// jsonPatch returns the JSON Patch operations that change from into to, both
+// JSON values (see jsonValue) at path. Objects are compared key by key; other
+// values, including arrays, are replaced whole if they differ.
+func jsonPatch(path string, from, to interface{}) []proto.JSONPatchOp {
+	fromObj, ok1 := from.(map[string]interface{})
+	toObj, ok2 := to.(map[string]interface{})
+	if !ok1 || !ok2 {
+		if reflect.DeepEqual(from, to) {
+			return nil
+		}
+		return []proto.JSONPatchOp{{Op: "replace", Path: path, Value: to}}
+	}
+
+	var ops []proto.JSONPatchOp
+	for _, k := range sortedKeys(fromObj) {
+		if _, ok := toObj[k]; !ok {
+			ops = append(ops, proto.JSONPatchOp{Op: "remove", Path: path + "/" + jsonPointerEscaper.Replace(k)})
+		}
+	}
+	for _, k := range sortedKeys(toObj) {
+		p := path + "/" + jsonPointerEscaper.Replace(k)
+		if fromValue, ok := fromObj[k]; ok {
+			ops = append(ops, jsonPatch(p, fromValue, toObj[k])...)
+		} else {
+			ops = append(ops, proto.JSONPatchOp{Op: "add", Path: p, Value: toObj[k]})
+		}
+	}
+	return ops
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
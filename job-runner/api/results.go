@@ -0,0 +1,221 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_MAX_FINISHED_CHAINS is how many chains that are done running the API
+// keeps by default.
+const DEFAULT_MAX_FINISHED_CHAINS = 1000
+
+// finishedChains keeps the results of the chains that are done running, up to
+// a max number. When there are more, the chains whose results were least
+// recently added or read are evicted.
+type finishedChains struct {
+	max uint
+	lru *list.List             // proto.JobChainResult, most recently used first
+	ids map[uint]*list.Element // request ID => element in lru
+	// --
+	*sync.Mutex // guards all fields
+}
+
+func newFinishedChains(max uint) *finishedChains {
+	return &finishedChains{
+		max:   max,
+		lru:   list.New(),
+		ids:   map[uint]*list.Element{},
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Add adds the result of a chain. It returns the request IDs of the chains
+// evicted to make room for it.
+func (f *finishedChains) Add(result proto.JobChainResult) []uint {
+	f.Lock()
+	defer f.Unlock()
+	if e, ok := f.ids[result.RequestId]; ok {
+		e.Value = result
+		f.lru.MoveToFront(e)
+		return nil
+	}
+	f.ids[result.RequestId] = f.lru.PushFront(result)
+	return f.evict()
+}
+
+// Get returns the result of a chain, and false if it isn't kept.
+func (f *finishedChains) Get(requestId uint) (proto.JobChainResult, bool) {
+	f.Lock()
+	defer f.Unlock()
+	e, ok := f.ids[requestId]
+	if !ok {
+		return proto.JobChainResult{}, false
+	}
+	f.lru.MoveToFront(e)
+	return e.Value.(proto.JobChainResult), true
+}
+
+// Remove removes the result of a chain, like a chain that's retried and
+// will have a new result.
+func (f *finishedChains) Remove(requestId uint) {
+	f.Lock()
+	defer f.Unlock()
+	if e, ok := f.ids[requestId]; ok {
+		f.lru.Remove(e)
+		delete(f.ids, requestId)
+	}
+}
+
+// SetMax sets how many results are kept. It returns the request IDs of the
+// chains evicted because there are more.
+func (f *finishedChains) SetMax(max uint) []uint {
+	f.Lock()
+	defer f.Unlock()
+	f.max = max
+	return f.evict()
+}
+
+// evict removes the least recently used results until there are at most max.
+// The caller must hold the lock.
+func (f *finishedChains) evict() []uint {
+	var evicted []uint
+	for uint(f.lru.Len()) > f.max {
+		e := f.lru.Back()
+		id := f.lru.Remove(e).(proto.JobChainResult).RequestId
+		delete(f.ids, id)
+		evicted = append(evicted, id)
+	}
+	return evicted
+}
+
+// -------------------------------------------------------------------------- //
+
+// GET <API_ROOT>/job-chains/{requestId}/result
+// Get the result of a chain that's done running (proto.JobChainResult), even
+// after it's no longer running. Results are kept for the chains that finished
+// most recently (see SetMaxFinishedChains). Older chains are read from the
+// chain repo, if it keeps them, without jobData.
+func (api *API) resultJobChainHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requestIdStr := ctx.Arguments[1]
+
+		result, ok := api.finishedChains.Get(requestId(requestIdStr))
+		if !ok {
+			c, err := api.chainRepo.Get(requestId(requestIdStr))
+			if err != nil {
+				ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_FOUND, "Can't retrieve chain from repo (error: %s).", err.Error())
+				return
+			}
+			report, ok := c.Report()
+			if !ok || !chainDone(report.State) {
+				ctx.APIErrorCode(router.ErrNotFound, proto.ERR_CHAIN_NOT_DONE, "Chain has no result because it is %s.", proto.StateName[c.State()])
+				return
+			}
+			result = chainResult(c.Definition(), report)
+		}
+
+		if out, err := marshal(result); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// SetMaxFinishedChains sets how many chains that are done running are kept,
+// with their results. Chains evicted are removed from the chain repo, which
+// might still keep them elsewhere, like a MySQL repo. Zero means none are
+// kept: chains are removed as soon as they're done.
+func (api *API) SetMaxFinishedChains(max uint) {
+	api.removeFinishedChains(api.finishedChains.SetMax(max))
+}
+
+// finish keeps the result of a chain when its traverser is done running.
+func (api *API) finish(requestId uint) {
+	c, err := api.chainRepo.Get(requestId)
+	if err != nil {
+		return
+	}
+	report, ok := c.Report()
+	if !ok || !chainDone(report.State) {
+		return // suspended
+	}
+	api.removeFinishedChains(api.finishedChains.Add(chainResult(c.Snapshot(), report)))
+}
+
+// removeFinishedChains removes chains evicted from finishedChains from the
+// chain repo, unless they were added again, like chains posted again.
+func (api *API) removeFinishedChains(requestIds []uint) {
+	for _, id := range requestIds {
+		c, err := api.chainRepo.Get(id)
+		if err != nil || !chainDone(c.State()) {
+			continue
+		}
+		log.Infof("[chain=%d]: Removing finished chain, its result is no longer kept.", id)
+		api.chainRepo.Remove(id)
+	}
+}
+
+// chainResult makes the result of a chain that's done running from the chain,
+// with its final jobData, and its report. The error of a job that failed is
+// the error of its last try.
+func chainResult(jc proto.JobChain, report proto.JobChainReport) proto.JobChainResult {
+	result := proto.JobChainResult{
+		RequestId:   jc.RequestId,
+		RequestType: report.RequestType,
+		State:       report.State,
+		StartTime:   report.StartTime,
+		EndTime:     report.EndTime,
+		Summary:     chain.Summarize(report),
+		Jobs:        map[string]proto.JobResult{},
+		Stopped:     jc.Stopped,
+	}
+	if report.EndTime.After(report.StartTime) && !report.StartTime.IsZero() {
+		result.Seconds = report.EndTime.Sub(report.StartTime).Seconds()
+	}
+	for _, jr := range report.Jobs {
+		r := proto.JobResult{
+			State: jr.State,
+			Tries: jr.Tries,
+		}
+		if jr.Tries > 0 && jr.EndTime.After(jr.StartTime) {
+			r.Seconds = jr.EndTime.Sub(jr.StartTime).Seconds()
+		}
+		if n := len(jr.TryHistory); n > 0 && jobFailed(jr.State) {
+			r.Error = jr.TryHistory[n-1].Error
+		}
+		if job, ok := jc.Jobs[jr.Name]; ok && len(job.Data) > 0 {
+			r.Data = job.Data
+		} else if job, ok := jc.RollbackJobs[jr.Name]; ok && len(job.Data) > 0 {
+			r.Data = job.Data
+		}
+		result.Jobs[jr.Name] = r
+	}
+	return result
+}
+
+// chainDone returns true if a chain in the state is done running.
+func chainDone(state byte) bool {
+	return state == proto.STATE_COMPLETE || state == proto.STATE_INCOMPLETE
+}
+
+// jobFailed returns true if a job in the final state failed.
+func jobFailed(state byte) bool {
+	switch state {
+	case proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED, proto.STATE_POLICY_VIOLATION:
+		return true
+	}
+	return false
+}
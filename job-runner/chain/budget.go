@@ -0,0 +1,71 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"sync"
+
+	"github.com/square/spincycle/proto"
+)
+
+// A budget keeps a chain's jobs within the chain's budget (proto.JobChain.Budget)
+// and counts what they spend. Every try of a job with a cost reserves its
+// estimated cost before it runs, which is replaced by its actual cost when
+// it's done, so jobs running at once can't together exceed the budget.
+type budget struct {
+	max       float64 // 0 = no budget
+	projected float64 // estimated cost of the tries that ran
+	actual    float64 // actual cost of the tries that are done
+	reserved  float64 // estimated cost of the tries that are running
+	refused   []string
+	hasCost   bool // true once a job with a cost is tried
+	// --
+	*sync.Mutex // guards all fields
+}
+
+func newBudget(max float64) *budget {
+	return &budget{
+		max:   max,
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Reserve reserves the estimated cost of a try of a job before it runs. It
+// returns false if the try would exceed the budget, in which case nothing is
+// reserved and the job must not run.
+func (b *budget) Reserve(jobName string, estimate float64) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.hasCost = true
+	if b.max > 0 && b.actual+b.reserved+estimate > b.max {
+		b.refused = append(b.refused, jobName)
+		return false
+	}
+	b.projected += estimate
+	b.reserved += estimate
+	return true
+}
+
+// Spent records the actual cost of a try that reserved estimate when it's done.
+func (b *budget) Spent(estimate, actual float64) {
+	b.Lock()
+	defer b.Unlock()
+	b.reserved -= estimate
+	b.actual += actual
+}
+
+// Spend returns what the chain spent, or nil if it has no budget and no job
+// with a cost was tried.
+func (b *budget) Spend() *proto.Spend {
+	b.Lock()
+	defer b.Unlock()
+	if b.max == 0 && !b.hasCost {
+		return nil
+	}
+	return &proto.Spend{
+		Budget:    b.max,
+		Projected: b.projected,
+		Actual:    b.actual,
+		Refused:   append([]string(nil), b.refused...),
+	}
+}
@@ -2,10 +2,19 @@
 
 // Package chain implements a job chain. It provides the ability to traverse a chain
 // and run all of the jobs in it.
+//
+// Only Hooks, NopHooks, and MultiHooks are a stable API, for deployments that
+// hook into the Job Runner; the rest of the package is internal to the Job
+// Runner and can change in any release.
 package chain
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,7 +23,8 @@ import (
 
 var (
 	// ErrFirstJob means the job chain doesn't have only one job with zero indegrees.
-	// This is usually an error in the adjacency list.
+	// This is usually an error in the adjacency list. If there are several, the
+	// others are unreachable from the first job.
 	ErrFirstJob = errors.New("chain does not have exactly one first job")
 
 	// ErrLastJob means the job chain doesn't have only one job with zero outdegrees.
@@ -24,8 +34,72 @@ var (
 	// ErrCyclic means the graph has a cycle.
 	ErrCyclic = errors.New("chain is cyclic")
 
+	// ErrJobNameMismatch means a job's name doesn't match its key in the chain's
+	// Jobs map, which would make two jobs have the same name.
+	ErrJobNameMismatch = errors.New("job name does not match its key in the chain")
+
+	// ErrInvalidCondition means an edge condition refers to an edge that isn't
+	// in the adjacency list, or its On isn't an EDGE_ON_* const.
+	ErrInvalidCondition = errors.New("chain has an invalid edge condition")
+
+	// ErrInvalidRollback means a job's rollback job or the chain's rollback job
+	// isn't in RollbackJobs, or a rollback job's name doesn't match its key or
+	// is the name of a job in the chain.
+	ErrInvalidRollback = errors.New("chain has an invalid rollback job")
+
 	// ErrInvalidAdjacencyList means the adjacency list refers to a nonexistent job.
 	ErrInvalidAdjacencyList = errors.New("chain does not have a valid adjacency list")
+
+	// ErrJobNotFound means the chain does not have a job with the given name.
+	ErrJobNotFound = errors.New("job not found in chain")
+
+	// ErrNotPending means the chain can't be started because it already was,
+	// or because it expired.
+	ErrNotPending = errors.New("chain is not pending")
+
+	// ErrInvalidTimeout means a job has a timeout that isn't a valid, positive
+	// duration.
+	ErrInvalidTimeout = errors.New("job has an invalid timeout")
+
+	// ErrInvalidHeartbeatTimeout means a job has a heartbeat timeout that
+	// isn't a valid, positive duration.
+	ErrInvalidHeartbeatTimeout = errors.New("job has an invalid heartbeat timeout")
+
+	// ErrInvalidEnv means the chain's env has a value that jobs can't parse,
+	// like a dry run flag that isn't true or false.
+	ErrInvalidEnv = errors.New("chain has an invalid env")
+
+	// ErrInvalidLimits means a job has resource limits with an unknown
+	// isolation mode or a negative number of CPUs.
+	ErrInvalidLimits = errors.New("job has invalid resource limits")
+
+	// ErrInvalidMirrors means a job is mirrored with an unknown divergence
+	// policy.
+	ErrInvalidMirrors = errors.New("job has invalid mirrors")
+
+	// ErrInvalidCallbackURL means the chain's callback or progress URL isn't
+	// an absolute http or https URL.
+	ErrInvalidCallbackURL = errors.New("chain has an invalid callback URL")
+
+	// ErrInvalidSequence means a sequence in SequenceRetries has no jobs, or
+	// it doesn't have one first job.
+	ErrInvalidSequence = errors.New("chain has an invalid sequence")
+
+	// ErrInvalidExpectedDuration means the chain's expected duration isn't a
+	// valid, positive duration, or its overrun factor is less than 1.
+	ErrInvalidExpectedDuration = errors.New("chain has an invalid expected duration")
+
+	// ErrInvalidSilence means the chain's silence has no matchers, a matcher
+	// that isn't a valid regexp, or a duration that isn't a valid, positive
+	// duration.
+	ErrInvalidSilence = errors.New("chain has an invalid silence")
+
+	// ErrInvalidBudget means the chain's budget is negative.
+	ErrInvalidBudget = errors.New("chain has an invalid budget")
+
+	// ErrNotRetryable means the chain can't be retried because it isn't
+	// INCOMPLETE, it has no failed jobs, or its rollback jobs ran.
+	ErrNotRetryable = errors.New("chain can't be retried")
 )
 
 // chain represents a job chain and some meta information about it.
@@ -33,23 +107,57 @@ type chain struct {
 	// The jobchain.
 	JobChain *proto.JobChain `json:"jobChain"`
 
+	// When the chain was created in the JR.
+	CreateTime time.Time `json:"createTime"`
+
+	// Hash of the job chain as it was received, to tell if a chain submitted
+	// again for the same request is the same chain.
+	Hash string `json:"hash"`
+
+	// The final report, set when the chain is done running.
+	FinalReport *proto.JobChainReport `json:"finalReport,omitempty"`
+
+	// The last checkpoint of the chain while it's running (see
+	// CheckpointInterval), removed when the chain is done.
+	Checkpoint *checkpoint `json:"checkpoint,omitempty"`
+
 	// Protection for the chain.
 	*sync.RWMutex
 }
 
 // NewChain takes a JobChain proto (from the RM) and turns it into a Chain that
-// the JR can use.
+// the JR can use. Jobs without a name are named by their key in the Jobs map.
 func NewChain(jc *proto.JobChain) *chain {
+	// Hash the chain before changing it.
+	hash := hashJobChain(jc)
+
 	// Set the state of all jobs in the chain to "Pending".
-	for _, job := range jc.Jobs {
+	for name, job := range jc.Jobs {
+		if job.Name == "" {
+			job.Name = name
+		}
+		job.State = proto.STATE_PENDING
+		job.Data = map[string]interface{}{}
+		jc.Jobs[name] = job
+	}
+
+	// Same for rollback jobs, which only run if the chain fails.
+	for name, job := range jc.RollbackJobs {
+		if job.Name == "" {
+			job.Name = name
+		}
 		job.State = proto.STATE_PENDING
 		job.Data = map[string]interface{}{}
-		jc.Jobs[job.Name] = job
+		jc.RollbackJobs[name] = job
 	}
 
+	jc.State = proto.STATE_PENDING
+
 	return &chain{
-		JobChain: jc,
-		RWMutex:  &sync.RWMutex{},
+		JobChain:   jc,
+		CreateTime: now(),
+		Hash:       hash,
+		RWMutex:    &sync.RWMutex{},
 	}
 }
 
@@ -70,6 +178,33 @@ func (c *chain) FirstJob() (proto.Job, error) {
 	return c.JobChain.Jobs[jobNames[0]], nil
 }
 
+// StartJobs returns the jobs to run when the chain starts: its first job, or,
+// if some jobs already ran because the chain is retried (see ResetFailed), the
+// pending jobs that are ready to run, sorted by name.
+func (c *chain) StartJobs() (proto.Jobs, error) {
+	var ready proto.Jobs
+	ran := false
+	for _, job := range c.JobChain.Jobs {
+		if job.State != proto.STATE_PENDING {
+			ran = true
+		} else if c.JobIsReady(job.Name) {
+			ready = append(ready, job)
+		}
+	}
+	if !ran {
+		first, err := c.FirstJob()
+		if err != nil {
+			return nil, err
+		}
+		return proto.Jobs{first}, nil
+	}
+	if len(ready) == 0 {
+		return nil, ErrNotRetryable
+	}
+	sort.Sort(ready)
+	return ready, nil
+}
+
 // LastJob finds the job in the chain with outdegree 0. If there is not
 // exactly one of these jobs, it returns an error.
 func (c *chain) LastJob() (proto.Job, error) {
@@ -115,16 +250,85 @@ func (c *chain) PreviousJobs(jobName string) proto.Jobs {
 }
 
 // JobIsReady returns whether or not a job is ready to run. A job is considered
-// ready to run if all of its previous jobs are complete. If any previous jobs
-// are not complete, the job is not ready to run.
+// ready to run if the edges from all of its previous jobs are resolved, none
+// are blocked, and at least one is taken. Without edge conditions, this means
+// the job is ready to run if all of its previous jobs are complete.
 func (c *chain) JobIsReady(jobName string) bool {
-	isReady := true
-	for _, job := range c.PreviousJobs(jobName) {
-		if job.State != proto.STATE_COMPLETE {
-			isReady = false
+	taken, resolved := c.resolveEdges(jobName)
+	return resolved && (taken || len(c.PreviousJobs(jobName)) == 0)
+}
+
+// JobIsSkipped returns whether or not a job will never run because the edges
+// from all of its previous jobs are resolved, none are blocked, but none were
+// taken.
+func (c *chain) JobIsSkipped(jobName string) bool {
+	taken, resolved := c.resolveEdges(jobName)
+	return resolved && !taken && len(c.PreviousJobs(jobName)) > 0
+}
+
+// Edge states, from a job to one of its next jobs.
+const (
+	edgeUnresolved = iota // previous job isn't done
+	edgeTaken             // previous job is done and the condition is met
+	edgeNotTaken          // previous job is done or skipped, and the edge can't be taken
+	edgeBlocked           // previous job isn't complete and the edge has no condition
+)
+
+// resolveEdges returns whether any edge to a job is taken, and whether all
+// edges to the job are resolved (taken or not taken, none unresolved or blocked).
+func (c *chain) resolveEdges(jobName string) (taken bool, resolved bool) {
+	resolved = true
+	for _, prevJob := range c.PreviousJobs(jobName) {
+		switch c.edgeState(prevJob, jobName) {
+		case edgeTaken:
+			taken = true
+		case edgeNotTaken:
+		default:
+			resolved = false
+		}
+	}
+	return taken, resolved
+}
+
+// edgeState returns the state of the edge from prevJob to the job named next.
+func (c *chain) edgeState(prevJob proto.Job, next string) int {
+	cond, hasCond := c.JobChain.Conditions[prevJob.Name][next]
+
+	switch prevJob.State {
+	case proto.STATE_SKIPPED:
+		return edgeNotTaken
+	case proto.STATE_COMPLETE, proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED,
+		proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
+	default:
+		return edgeUnresolved
+	}
+
+	if !hasCond {
+		if prevJob.State == proto.STATE_COMPLETE {
+			return edgeTaken
+		}
+		return edgeBlocked
+	}
+
+	switch cond.On {
+	case "", proto.EDGE_ON_SUCCESS:
+		if prevJob.State != proto.STATE_COMPLETE {
+			return edgeNotTaken
+		}
+	case proto.EDGE_ON_FAIL:
+		if prevJob.State == proto.STATE_COMPLETE {
+			return edgeNotTaken
+		}
+	}
+
+	if cond.Key != "" {
+		v, ok := prevJob.Data[cond.Key]
+		if !ok || fmt.Sprintf("%v", v) != cond.Value {
+			return edgeNotTaken
 		}
 	}
-	return isReady
+
+	return edgeTaken
 }
 
 // IsDone returns two booleans - the first one indicates whether or not the
@@ -135,7 +339,7 @@ func (c *chain) JobIsReady(jobName string) bool {
 // can happen if all of the jobs in the chain or complete, or if some or all
 // of the jobs in the chain failed.
 //
-// A chain is complete if every job in it completed successfully.
+// A chain is complete if every job in it completed successfully or was skipped.
 func (c *chain) IsDone() (done bool, complete bool) {
 	done = true
 	complete = true
@@ -151,13 +355,14 @@ LOOP:
 			// If any jobs are running, the chain can't be done
 			// or complete, so return false for both now.
 			return false, false
-		case proto.STATE_COMPLETE:
+		case proto.STATE_COMPLETE, proto.STATE_SKIPPED:
 			// Move on to the next job.
 			continue LOOP
-		case proto.STATE_FAIL:
+		case proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED,
+			proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
 			// do nothing
 		default:
-			// Any job that's not running, complete, or failed.
+			// Any job that's not running, complete, failed, timed out, or stopped.
 			pendingJobs = append(pendingJobs, job)
 		}
 
@@ -168,23 +373,13 @@ LOOP:
 		complete = false
 	}
 
-	// For each pending job, check to see if all of its previous jobs
-	// completed. If they did, there's no reason the pending job can't run.
+	// For each pending job, check to see if it's ready to run (without edge
+	// conditions, all of its previous jobs completed) or it can be skipped.
+	// If it is, the chain isn't done because the pending job can still run,
+	// or its next jobs can.
 	for _, job := range pendingJobs {
 		complete = false
-		allPrevComplete := true
-		for _, prevJob := range c.PreviousJobs(job.Name) {
-			if prevJob.State != proto.STATE_COMPLETE {
-				allPrevComplete = false
-				// We can break out of this loop if a single
-				// one of the previous jobs is not complete.
-				break
-			}
-		}
-
-		// If all of the previous jobs of a pending job are complete, the
-		// chain can't be complete because the pending job can still run.
-		if allPrevComplete == true {
+		if c.JobIsReady(job.Name) || c.JobIsSkipped(job.Name) {
 			return false, complete
 		}
 	}
@@ -192,83 +387,497 @@ LOOP:
 	return
 }
 
-// Validate checks if a job chain is valid. It returns an error if it's not.
-func (c *chain) Validate() error {
-	// Make sure the adjacency list is valid.
-	if !c.adjacencyListIsValid() {
-		return ErrInvalidAdjacencyList
-	}
+// RequestId returns the request id of the job chain.
+func (c *chain) RequestId() uint {
+	return c.JobChain.RequestId
+}
 
-	// Make sure there is one first job.
-	_, err := c.FirstJob()
-	if err != nil {
-		return err
-	}
+// Allows tests to mock the time.
+var now func() time.Time = time.Now
 
-	// Make sure there is one last job.
-	_, err = c.LastJob()
-	if err != nil {
-		return err
+// State returns the state of the chain.
+func (c *chain) State() byte {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	return c.JobChain.State
+}
+
+// Summary returns a summary of the chain.
+func (c *chain) Summary() proto.JobChainSummary {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	summary := proto.JobChainSummary{
+		RequestId: c.JobChain.RequestId,
+		State:     c.JobChain.State,
+		StartTime: c.JobChain.StartTime,
+		StartAt:   c.JobChain.StartAt,
+		TotalJobs: uint(len(c.JobChain.Jobs)),
+		Priority:  c.JobChain.Priority,
+		Metadata:  c.JobChain.Metadata,
+	}
+	for _, job := range c.JobChain.Jobs {
+		if job.State == proto.STATE_RUNNING {
+			summary.RunningJobs++
+		}
 	}
+	return summary
+}
 
-	// Make sure there are no cycles.
-	if !c.isAcyclic() {
-		return ErrCyclic
+// Job returns the job with the given name. It returns ErrJobNotFound if the
+// chain does not have the job.
+func (c *chain) Job(jobName string) (proto.Job, error) {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	job, ok := c.JobChain.Jobs[jobName]
+	if !ok {
+		return proto.Job{}, ErrJobNotFound
 	}
+	return job, nil
+}
 
-	return nil
+// JobState returns the state of a given job or rollback job.
+func (c *chain) JobState(jobName string) byte {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	return c.jobs(jobName)[jobName].State
 }
 
-// RequestId returns the request id of the job chain.
-func (c *chain) RequestId() uint {
-	return c.JobChain.RequestId
+// Set the state of a job or rollback job in the chain.
+func (c *chain) SetJobState(jobName string, state byte) {
+	c.Lock() // -- lock
+	jobs := c.jobs(jobName)
+	j := jobs[jobName]
+	j.State = state
+	jobs[jobName] = j
+	c.Unlock() // -- unlock
 }
 
-// Allows tests to mock the time.
-var now func() time.Time = time.Now
+// IsRollbackJob returns whether or not a job is one of the chain's rollback jobs.
+func (c *chain) IsRollbackJob(jobName string) bool {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	_, ok := c.JobChain.RollbackJobs[jobName]
+	return ok
+}
 
-// JobState returns the state of a given job.
-func (c *chain) JobState(jobName string) byte {
+// RollbackJobs returns the rollback jobs to run if the chain fails, given the
+// names of the jobs that completed in the order they completed: the rollback
+// job of each completed job in reverse order, then the chain's rollback job.
+// A rollback job shared by several jobs is only returned once.
+func (c *chain) RollbackJobs(completed []string) proto.Jobs {
 	c.RLock()         // -- lock
 	defer c.RUnlock() // -- unlock
-	return c.JobChain.Jobs[jobName].State
+	var rollbackJobs proto.Jobs
+	seen := map[string]bool{}
+	add := func(name string) {
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		rollbackJobs = append(rollbackJobs, c.JobChain.RollbackJobs[name])
+	}
+	for i := len(completed) - 1; i >= 0; i-- {
+		add(c.JobChain.Jobs[completed[i]].Rollback)
+	}
+	add(c.JobChain.RollbackJob)
+	return rollbackJobs
 }
 
-// Set the state of a job in the chain.
-func (c *chain) SetJobState(jobName string, state byte) {
+// SetRollbackData copies the jobData of a completed job to its rollback job,
+// if it has one, so the rollback job knows what to undo even after the job's
+// jobData is released.
+func (c *chain) SetRollbackData(job proto.Job) {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	rollbackJob, ok := c.JobChain.RollbackJobs[job.Rollback]
+	if !ok {
+		return
+	}
+	if rollbackJob.Data == nil {
+		rollbackJob.Data = map[string]interface{}{}
+	}
+	for k, v := range job.Data {
+		rollbackJob.Data[k] = v
+	}
+	c.JobChain.RollbackJobs[job.Rollback] = rollbackJob
+}
+
+// ResetJob sets the state of a job in the chain to PENDING and its jobData to
+// jobData, so it can run again.
+func (c *chain) ResetJob(jobName string, jobData map[string]interface{}) {
 	c.Lock() // -- lock
 	j := c.JobChain.Jobs[jobName]
-	j.State = state
+	j.State = proto.STATE_PENDING
+	j.Data = jobData
 	c.JobChain.Jobs[jobName] = j
 	c.Unlock() // -- unlock
 }
 
-// Set the start time of the chain, and set the chain's state to RUNNING.
-func (c *chain) SetStart() {
+// SequenceJobs returns the names of the jobs in a sequence, sorted, and the
+// names of its first jobs: jobs whose previous jobs are all outside the
+// sequence.
+func (c *chain) SequenceJobs(sequence string) (jobs []string, first []string) {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	return c.sequenceJobs(sequence)
+}
+
+func (c *chain) sequenceJobs(sequence string) (jobs []string, first []string) {
+	in := map[string]bool{}
+	for name, job := range c.JobChain.Jobs {
+		if job.Sequence == sequence {
+			in[name] = true
+		}
+	}
+	jobs = sortedKeys(in)
+	for _, name := range jobs {
+		isFirst := true
+		for prev, next := range c.JobChain.AdjacencyList {
+			if !in[prev] {
+				continue
+			}
+			for _, n := range next {
+				if n == name {
+					isFirst = false
+				}
+			}
+		}
+		if isFirst {
+			first = append(first, name)
+		}
+	}
+	return jobs, first
+}
+
+// ReleaseJobData releases the jobData of a job in the chain.
+func (c *chain) ReleaseJobData(jobName string) {
 	c.Lock() // -- lock
+	j := c.JobChain.Jobs[jobName]
+	j.Data = nil
+	c.JobChain.Jobs[jobName] = j
+	c.Unlock() // -- unlock
+}
+
+// Set the start time of the chain, and set the chain's state to RUNNING. The
+// chain must be pending, else ErrNotPending is returned and nothing is changed.
+func (c *chain) SetStart() error {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_PENDING {
+		return ErrNotPending
+	}
 	c.JobChain.StartTime = now()
 	c.JobChain.State = proto.STATE_RUNNING
+	return nil
+}
+
+// Schedule sets when the chain is scheduled to start, if the chain is pending.
+// It returns false if the chain isn't pending. It doesn't start the chain.
+func (c *chain) Schedule(at time.Time) bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_PENDING {
+		return false
+	}
+	c.JobChain.StartAt = at
+	return true
+}
+
+// Expire sets the end time of the chain and sets the chain's state to EXPIRED
+// if the chain is pending, not scheduled to start, and was created more than
+// ttl ago. It returns true if the chain expired. An expired chain can't be
+// started.
+func (c *chain) Expire(ttl time.Duration) bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_PENDING || !c.JobChain.StartAt.IsZero() || now().Sub(c.CreateTime) < ttl {
+		return false
+	}
+	c.JobChain.EndTime = now()
+	c.JobChain.State = proto.STATE_EXPIRED
+	return true
+}
+
+// Delete sets the end time of the chain and sets the chain's state to DELETED
+// if the chain is pending. It returns true if the chain was pending. A deleted
+// chain can't be started.
+func (c *chain) Delete() bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_PENDING {
+		return false
+	}
+	c.JobChain.EndTime = now()
+	c.JobChain.State = proto.STATE_DELETED
+	return true
+}
+
+// SuspendPending sets the chain's state to SUSPENDED if the chain is pending.
+// It returns true if the chain was pending. A suspended chain can't be started.
+func (c *chain) SuspendPending() bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_PENDING {
+		return false
+	}
+	c.JobChain.State = proto.STATE_SUSPENDED
+	return true
+}
+
+// Set the chain's state to ROLLING_BACK.
+func (c *chain) SetRollingBack() {
+	c.Lock() // -- lock
+	c.JobChain.State = proto.STATE_ROLLING_BACK
+	c.Unlock() // -- unlock
+}
+
+// Set the chain's state to SUSPENDED.
+func (c *chain) SetSuspended() {
+	c.Lock() // -- lock
+	c.JobChain.State = proto.STATE_SUSPENDED
+	c.Unlock() // -- unlock
+}
+
+// SetQuarantined sets the chain's state to QUARANTINED because its traverser
+// panicked.
+func (c *chain) SetQuarantined(q proto.Quarantine) {
+	c.Lock() // -- lock
+	c.JobChain.State = proto.STATE_QUARANTINED
+	c.JobChain.Quarantine = &q
+	c.Unlock() // -- unlock
+}
+
+// SetStopped records who stopped the chain and why.
+func (c *chain) SetStopped(stop proto.StopInfo) {
+	c.Lock() // -- lock
+	c.JobChain.Stopped = &stop
 	c.Unlock() // -- unlock
 }
 
-// Set the end time of the chain, and set the chain's state to COMPLETE.
+// Stopped returns who stopped the chain and why, or nil if it wasn't stopped.
+func (c *chain) Stopped() *proto.StopInfo {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	return c.JobChain.Stopped
+}
+
+// SetRecovered sets the state of a quarantined chain to SUSPENDED so it can be
+// resumed, and the state of its jobs that were left RUNNING to PENDING. It
+// returns false if the chain isn't quarantined.
+func (c *chain) SetRecovered() bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_QUARANTINED {
+		return false
+	}
+	for name, job := range c.JobChain.Jobs {
+		if job.State == proto.STATE_RUNNING {
+			job.State = proto.STATE_PENDING
+			c.JobChain.Jobs[name] = job
+		}
+	}
+	c.JobChain.State = proto.STATE_SUSPENDED
+	return true
+}
+
+// ResetFailed makes an INCOMPLETE chain pending again so it can be retried
+// from where it failed: its failed jobs, and the jobs after them that didn't
+// complete, are PENDING, and jobs that completed don't run again. Failed jobs
+// keep their jobData, so they run again with the jobData they last ran with.
+// It returns the names of the failed jobs, sorted, or ErrNotRetryable if the
+// chain isn't INCOMPLETE, it has no failed jobs, or any of its rollback jobs
+// ran, because what the completed jobs did was undone.
+func (c *chain) ResetFailed() ([]string, error) {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		return nil, ErrNotRetryable
+	}
+	for _, job := range c.JobChain.RollbackJobs {
+		if job.State != proto.STATE_PENDING {
+			return nil, ErrNotRetryable
+		}
+	}
+
+	failed := map[string]bool{}
+	for name, job := range c.JobChain.Jobs {
+		switch job.State {
+		case proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED,
+			proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
+			failed[name] = true
+		}
+	}
+	if len(failed) == 0 {
+		return nil, ErrNotRetryable
+	}
+
+	// Reset the failed jobs and every job after them that didn't complete,
+	// like jobs skipped because a failed job didn't take the edge to them.
+	reset := map[string]bool{}
+	next := sortedKeys(failed)
+	for len(next) > 0 {
+		name := next[0]
+		next = next[1:]
+		job := c.JobChain.Jobs[name]
+		if reset[name] || (job.State == proto.STATE_COMPLETE && !failed[name]) {
+			continue
+		}
+		reset[name] = true
+		job.State = proto.STATE_PENDING
+		if job.Data == nil {
+			job.Data = map[string]interface{}{}
+		}
+		c.JobChain.Jobs[name] = job
+		next = append(next, c.JobChain.AdjacencyList[name]...)
+	}
+
+	c.JobChain.State = proto.STATE_PENDING
+	c.JobChain.StartTime = time.Time{}
+	c.JobChain.EndTime = time.Time{}
+	c.JobChain.Stopped = nil
+	c.FinalReport = nil
+	return sortedKeys(failed), nil
+}
+
+// Snapshot returns a copy of the job chain that is safe to use while the chain
+// is being traversed. jobData is not deep copied.
+func (c *chain) Snapshot() proto.JobChain {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	jc := *c.JobChain
+	jc.Jobs = make(map[string]proto.Job, len(c.JobChain.Jobs))
+	for name, job := range c.JobChain.Jobs {
+		jc.Jobs[name] = job
+	}
+	if c.JobChain.RollbackJobs != nil {
+		jc.RollbackJobs = make(map[string]proto.Job, len(c.JobChain.RollbackJobs))
+		for name, job := range c.JobChain.RollbackJobs {
+			jc.RollbackJobs[name] = job
+		}
+	}
+	jc.AdjacencyList = make(map[string][]string, len(c.JobChain.AdjacencyList))
+	for name, next := range c.JobChain.AdjacencyList {
+		jc.AdjacencyList[name] = append([]string{}, next...)
+	}
+	if c.JobChain.Scratch != nil {
+		jc.Scratch = make(map[string]string, len(c.JobChain.Scratch))
+		for k, v := range c.JobChain.Scratch {
+			jc.Scratch[k] = v
+		}
+	}
+	return jc
+}
+
+// Definition returns a copy of the job chain with the current state of the
+// chain and its jobs, but without jobData, which is only for the jobs and
+// might be written by running jobs. Unlike the traverser, it's available after
+// the chain is done running.
+func (c *chain) Definition() proto.JobChain {
+	jc := c.Snapshot()
+	for _, jobs := range []map[string]proto.Job{jc.Jobs, jc.RollbackJobs} {
+		for name, job := range jobs {
+			job.Data = nil
+			jobs[name] = job
+		}
+	}
+	return jc
+}
+
+// Report returns the final report of the chain. It returns false if the chain
+// isn't done running, so it doesn't have a report yet.
+func (c *chain) Report() (proto.JobChainReport, bool) {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	if c.FinalReport == nil {
+		return proto.JobChainReport{}, false
+	}
+	return *c.FinalReport, true
+}
+
+// Set the final report of the chain.
+func (c *chain) SetReport(report proto.JobChainReport) {
+	c.Lock() // -- lock
+	c.FinalReport = &report
+	c.Unlock() // -- unlock
+}
+
+// Set the end time of the chain, and set the chain's state to COMPLETE. The
+// chain's scratch and checkpoint are removed.
 func (c *chain) SetComplete() {
 	c.Lock() // -- lock
 	c.JobChain.EndTime = now()
 	c.JobChain.State = proto.STATE_COMPLETE
+	c.JobChain.Scratch = nil
+	c.Checkpoint = nil
 	c.Unlock() // -- unlock
 }
 
-// Set the end time of the chain, and set the chain's state to INCOMPLETE.
+// Set the end time of the chain, and set the chain's state to INCOMPLETE. The
+// chain's scratch and checkpoint are removed.
 func (c *chain) SetIncomplete() {
 	c.Lock() // -- lock
 	c.JobChain.EndTime = now()
 	c.JobChain.State = proto.STATE_INCOMPLETE
+	c.JobChain.Scratch = nil
+	c.Checkpoint = nil
 	c.Unlock() // -- unlock
 }
 
+// ScratchValue returns the value of the key in the chain's scratch.
+func (c *chain) ScratchValue(key string) (string, bool) {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	v, ok := c.JobChain.Scratch[key]
+	return v, ok
+}
+
+// SetScratchValue sets the key in the chain's scratch. It returns false if
+// the keys and values of the scratch would be more than maxSize bytes, unless
+// maxSize is zero.
+func (c *chain) SetScratchValue(key, value string, maxSize int) bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if maxSize > 0 {
+		size := len(key) + len(value)
+		for k, v := range c.JobChain.Scratch {
+			if k != key {
+				size += len(k) + len(v)
+			}
+		}
+		if size > maxSize {
+			return false
+		}
+	}
+	if c.JobChain.Scratch == nil {
+		c.JobChain.Scratch = map[string]string{}
+	}
+	c.JobChain.Scratch[key] = value
+	return true
+}
+
+// DeleteScratchValue deletes the key from the chain's scratch. It returns
+// false if the key wasn't in it.
+func (c *chain) DeleteScratchValue(key string) bool {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if _, ok := c.JobChain.Scratch[key]; !ok {
+		return false
+	}
+	delete(c.JobChain.Scratch, key)
+	return true
+}
+
 // -------------------------------------------------------------------------- //
 
+// jobs returns the map that has the job: RollbackJobs if it's a rollback job,
+// else Jobs. The caller must hold the lock.
+func (c *chain) jobs(jobName string) map[string]proto.Job {
+	if _, ok := c.JobChain.RollbackJobs[jobName]; ok {
+		return c.JobChain.RollbackJobs
+	}
+	return c.JobChain.Jobs
+}
+
 // indegreeCounts finds the indegree for each job in the chain.
 func (c *chain) indegreeCounts() map[string]int {
 	indegreeCounts := make(map[string]int)
@@ -303,6 +912,12 @@ func (c *chain) outdegreeCounts() map[string]int {
 // chain (dependencies that go in the opposite direction...i.e., bottom to
 // top), it returns false.
 func (c *chain) isAcyclic() bool {
+	return len(c.cyclicJobs()) == 0
+}
+
+// cyclicJobs returns the names of the jobs that isAcyclic can't visit because
+// they are in or after a cycle, sorted by name.
+func (c *chain) cyclicJobs() []string {
 	indegreeCounts := c.indegreeCounts()
 	queue := make(map[string]struct{})
 
@@ -314,7 +929,7 @@ func (c *chain) isAcyclic() bool {
 		}
 	}
 
-	jobsVisited := 0
+	visited := make(map[string]bool)
 	for {
 		// Break when there are no more jobs in the queue. This happens
 		// when either there are no first jobs, or when a cycle
@@ -344,34 +959,97 @@ func (c *chain) isAcyclic() bool {
 			}
 		}
 
-		// Keep track of the number of jobs we've visited. If there is
-		// a cycle in the chain, we won't end up visiting some jobs.
-		jobsVisited += 1
+		// Keep track of the jobs we've visited. If there is a cycle in
+		// the chain, we won't end up visiting some jobs.
+		visited[curJob] = true
 	}
 
-	if jobsVisited != len(c.JobChain.Jobs) {
-		return false
+	var notVisited []string
+	for job := range c.JobChain.Jobs {
+		if !visited[job] {
+			notVisited = append(notVisited, job)
+		}
 	}
-
-	return true
+	sort.Strings(notVisited)
+	return notVisited
 }
 
 // adjacencyListIsValid returns whether or not the chain's adjacency list is
 // not valid. An adjacency list is not valid if any of the jobs in it do not
 // exist in chain.Jobs.
 func (c *chain) adjacencyListIsValid() bool {
+	return len(c.unknownAdjacentJobs()) == 0
+}
+
+// unknownAdjacentJobs returns the names of the jobs in the adjacency list that
+// do not exist in chain.Jobs, sorted by name.
+func (c *chain) unknownAdjacentJobs() []string {
+	unknown := map[string]bool{}
 	for job, adjJobs := range c.JobChain.AdjacencyList {
 		if _, ok := c.JobChain.Jobs[job]; !ok {
-			return false
+			unknown[job] = true
 		}
 
 		for _, adjJob := range adjJobs {
 			if _, ok := c.JobChain.Jobs[adjJob]; !ok {
-				return false
+				unknown[adjJob] = true
 			}
 		}
 	}
-	return true
+	return sortedKeys(unknown)
+}
+
+// invalidCondition describes an edge condition that isn't on an edge in the
+// adjacency list or doesn't have a valid On. It returns an empty string if all
+// edge conditions are valid.
+func (c *chain) invalidCondition() string {
+	for jobName, conds := range c.JobChain.Conditions {
+		for next, cond := range conds {
+			if !contains(c.JobChain.AdjacencyList[jobName], next) {
+				return fmt.Sprintf("condition on %s -> %s, which is not an edge", jobName, next)
+			}
+			switch cond.On {
+			case "", proto.EDGE_ON_SUCCESS, proto.EDGE_ON_FAIL, proto.EDGE_ON_DONE:
+			default:
+				return fmt.Sprintf("condition on %s -> %s has invalid on %q", jobName, next, cond.On)
+			}
+		}
+	}
+	return ""
+}
+
+// invalidRollback describes a rollback job referenced by a job or the chain
+// that isn't in RollbackJobs, or a rollback job that isn't identified by its
+// name or has the name of a job in the chain. It returns an empty string if
+// all rollback jobs are valid.
+func (c *chain) invalidRollback() string {
+	for name, job := range c.JobChain.RollbackJobs {
+		if job.Name != "" && job.Name != name {
+			return fmt.Sprintf("rollback job %s is named %s", name, job.Name)
+		}
+		if _, ok := c.JobChain.Jobs[name]; ok {
+			return fmt.Sprintf("rollback job %s has the name of a job", name)
+		}
+	}
+	for _, job := range c.JobChain.Jobs {
+		if _, ok := c.JobChain.RollbackJobs[job.Rollback]; job.Rollback != "" && !ok {
+			return fmt.Sprintf("job %s has unknown rollback job %s", job.Name, job.Rollback)
+		}
+	}
+	if _, ok := c.JobChain.RollbackJobs[c.JobChain.RollbackJob]; c.JobChain.RollbackJob != "" && !ok {
+		return fmt.Sprintf("chain has unknown rollback job %s", c.JobChain.RollbackJob)
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of a set of strings, sorted.
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 // contains returns whether or not a slice of strings contains a specific string.
@@ -383,3 +1061,52 @@ func contains(s []string, t string) bool {
 	}
 	return false
 }
+
+// hashJobChain returns the hex-encoded SHA-256 of the JSON encoding of a job
+// chain. Maps are encoded with sorted keys, so equal chains have equal hashes.
+// It returns an empty string if the chain can't be encoded.
+func hashJobChain(jc *proto.JobChain) string {
+	bytes, err := json.Marshal(jc)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// overrunAfter returns how long the chain can run before it's overrunning its
+// expected duration, zero if it doesn't have one.
+func overrunAfter(jc *proto.JobChain) time.Duration {
+	if jc.ExpectedDuration == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(jc.ExpectedDuration)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	factor := jc.OverrunFactor
+	if factor == 0 {
+		factor = DEFAULT_OVERRUN_FACTOR
+	}
+	return time.Duration(float64(d) * factor)
+}
+
+// validTimeout returns whether or not a job's timeout is valid: empty (no
+// timeout) or a positive duration.
+func validTimeout(job proto.Job) bool {
+	return validDuration(job.Timeout)
+}
+
+// validHeartbeatTimeout returns whether or not a job's heartbeat timeout is
+// valid: empty (heartbeats aren't checked) or a positive duration.
+func validHeartbeatTimeout(job proto.Job) bool {
+	return validDuration(job.HeartbeatTimeout)
+}
+
+func validDuration(s string) bool {
+	if s == "" {
+		return true
+	}
+	d, err := time.ParseDuration(s)
+	return err == nil && d > 0
+}
@@ -265,13 +265,67 @@ func TestSetStart(t *testing.T) {
 	c := NewChain(jc)
 	now := time.Now()
 
-	c.SetStart()
+	err := c.SetStart()
+	if err != nil {
+		t.Errorf("err = %s, want nil", err)
+	}
 	if c.JobChain.StartTime.Unix() != now.Unix() {
 		t.Errorf("StartTime unix = %d, want %d", c.JobChain.StartTime.Unix(), now.Unix())
 	}
 	if c.JobChain.State != proto.STATE_RUNNING {
 		t.Errorf("State = %d, want %d", c.JobChain.State, proto.STATE_RUNNING)
 	}
+
+	// Can't start a chain twice.
+	err = c.SetStart()
+	if err != ErrNotPending {
+		t.Errorf("err = %v, want %s", err, ErrNotPending)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	jc := &proto.JobChain{}
+	c := NewChain(jc)
+
+	// Not expired yet.
+	if c.Expire(time.Hour) {
+		t.Error("chain expired, want not expired")
+	}
+	if c.JobChain.State != proto.STATE_PENDING {
+		t.Errorf("State = %d, want %d", c.JobChain.State, proto.STATE_PENDING)
+	}
+
+	// Expired.
+	c.CreateTime = c.CreateTime.Add(-2 * time.Hour)
+	if !c.Expire(time.Hour) {
+		t.Error("chain not expired, want expired")
+	}
+	if c.JobChain.State != proto.STATE_EXPIRED {
+		t.Errorf("State = %d, want %d", c.JobChain.State, proto.STATE_EXPIRED)
+	}
+
+	// An expired chain can't be started.
+	if err := c.SetStart(); err != ErrNotPending {
+		t.Errorf("err = %v, want %s", err, ErrNotPending)
+	}
+
+	// A running chain doesn't expire.
+	c = NewChain(&proto.JobChain{})
+	c.CreateTime = c.CreateTime.Add(-2 * time.Hour)
+	c.SetStart()
+	if c.Expire(time.Hour) {
+		t.Error("running chain expired, want not expired")
+	}
+
+	// A chain scheduled to start doesn't expire.
+	c = NewChain(&proto.JobChain{})
+	c.CreateTime = c.CreateTime.Add(-2 * time.Hour)
+	if !c.Schedule(time.Now().Add(time.Hour)) {
+		t.Error("pending chain not scheduled, want scheduled")
+	}
+	if c.Expire(time.Hour) {
+		t.Error("scheduled chain expired, want not expired")
+	}
 }
 
 func TestSetComplete(t *testing.T) {
@@ -493,3 +547,41 @@ func TestValidateAdjacencyList(t *testing.T) {
 		t.Errorf("valid = %t, expected %t", valid, expectedValid)
 	}
 }
+
+func TestNewChainJobNames(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: map[string]proto.Job{
+			"job1": {},
+			"job2": {Name: "job2"},
+		},
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	c := NewChain(jc)
+
+	// A job without a name is named by its key.
+	if c.JobChain.Jobs["job1"].Name != "job1" {
+		t.Errorf("job1 name = %q, expected job1", c.JobChain.Jobs["job1"].Name)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+}
+
+func TestValidateJobNameMismatch(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: map[string]proto.Job{
+			"job1": {Name: "job1"},
+			"job2": {Name: "job1"},
+		},
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	c := NewChain(jc)
+
+	if err := c.Validate(); err != ErrJobNameMismatch {
+		t.Errorf("err = %v, expected %s", err, ErrJobNameMismatch)
+	}
+}
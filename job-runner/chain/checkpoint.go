@@ -0,0 +1,55 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"time"
+)
+
+// A checkpoint is the jobData of a chain's jobs at a point in time while the
+// chain is running. The state of jobs is saved whenever it changes, but their
+// jobData only when a job is done, so without checkpoints a chain read back
+// from the repo after a crash would have lost the jobData of its jobs, and a
+// long-running job would lose all it had done. A checkpoint is never changed
+// after it's set, so it can be shared.
+type checkpoint struct {
+	Time    time.Time                         `json:"time"`
+	JobData map[string]map[string]interface{} `json:"jobData"` // job name => jobData
+}
+
+// LastCheckpoint returns the last checkpoint of the chain, or nil if it has
+// none.
+func (c *chain) LastCheckpoint() *checkpoint {
+	c.RLock()         // -- lock
+	defer c.RUnlock() // -- unlock
+	return c.Checkpoint
+}
+
+// SetCheckpoint sets the last checkpoint of the chain.
+func (c *chain) SetCheckpoint(cp *checkpoint) {
+	c.Lock() // -- lock
+	c.Checkpoint = cp
+	c.Unlock() // -- unlock
+}
+
+// RestoreCheckpoint sets the jobData of the chain's jobs to their jobData at
+// the last checkpoint, for a chain that was read back without jobData. Jobs
+// that aren't in the checkpoint are not changed.
+func (c *chain) RestoreCheckpoint() {
+	c.Lock()         // -- lock
+	defer c.Unlock() // -- unlock
+	if c.Checkpoint == nil {
+		return
+	}
+	for name, data := range c.Checkpoint.JobData {
+		job, ok := c.JobChain.Jobs[name]
+		if !ok {
+			continue
+		}
+		job.Data = make(map[string]interface{}, len(data))
+		for k, v := range data {
+			job.Data[k] = v
+		}
+		c.JobChain.Jobs[name] = job
+	}
+}
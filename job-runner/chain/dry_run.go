@@ -0,0 +1,83 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+)
+
+// DryRun checks that a job chain could run without running it. It validates
+// the chain, makes a runner for every job and rollback job, which re-creates
+// the job and resolves its args like it would right before running it, and
+// works out the order in which the jobs would run. The runners are discarded.
+// If ctx is done before every runner is made, like when the client that asked
+// for the dry run went away, the dry run isn't valid and ctx.Err() is its last
+// error.
+func DryRun(ctx context.Context, jc proto.JobChain, rf runner.RunnerFactory) proto.JobChainDryRun {
+	dr := proto.JobChainDryRun{
+		RequestId: jc.RequestId,
+		Errors:    []string{},
+		Steps:     [][]string{},
+	}
+
+	// Without a valid graph, there's no order to work out.
+	if err := Validate(jc); err != nil {
+		dr.Errors = append(dr.Errors, err.Error())
+		return dr
+	}
+
+	for _, jobs := range []map[string]proto.Job{jc.Jobs, jc.RollbackJobs} {
+		names := make([]string, 0, len(jobs))
+		for name := range jobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := ctx.Err(); err != nil {
+				dr.Errors = append(dr.Errors, err.Error())
+				return dr
+			}
+			job := jobs[name]
+			job.Name = name  // like NewChain
+			job.Env = jc.Env // like the traverser
+			if _, err := rf.Make(job, jc.RequestId); err != nil {
+				dr.Errors = append(dr.Errors, fmt.Sprintf("job %s: %s", name, err))
+			}
+		}
+	}
+
+	c := &chain{JobChain: &jc}
+	dr.Steps = c.steps()
+	dr.Valid = len(dr.Errors) == 0
+	return dr
+}
+
+// steps returns the names of the jobs in the order they would run if every
+// job completed: the first job, then the jobs whose previous jobs are all in
+// earlier steps, and so on. Names in a step are sorted. The chain must be
+// acyclic.
+func (c *chain) steps() [][]string {
+	indegreeCounts := c.indegreeCounts()
+	step := jobsWithDegree(indegreeCounts, 0)
+	steps := [][]string{}
+	for len(step) > 0 {
+		steps = append(steps, step)
+		next := []string{}
+		for _, name := range step {
+			for _, nextJob := range c.JobChain.AdjacencyList[name] {
+				indegreeCounts[nextJob] -= 1
+				if indegreeCounts[nextJob] == 0 {
+					next = append(next, nextJob)
+				}
+			}
+		}
+		sort.Strings(next)
+		step = next
+	}
+	return steps
+}
@@ -0,0 +1,58 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestDryRun(t *testing.T) {
+	jc := proto.JobChain{
+		RequestId: 4,
+		Jobs:      mock.InitJobs(5),
+		AdjacencyList: map[string][]string{
+			"job1": {"job3", "job2"},
+			"job2": {"job4"},
+			"job3": {"job5"},
+			"job4": {"job5"},
+		},
+	}
+
+	dr := DryRun(context.Background(), jc, &mock.RunnerFactory{})
+	if !dr.Valid || len(dr.Errors) != 0 {
+		t.Errorf("valid = %t, errors = %v; expected valid", dr.Valid, dr.Errors)
+	}
+	expect := [][]string{{"job1"}, {"job2", "job3"}, {"job4"}, {"job5"}}
+	if !reflect.DeepEqual(dr.Steps, expect) {
+		t.Errorf("steps = %v, expected %v", dr.Steps, expect)
+	}
+
+	// Jobs that can't be made are reported by name.
+	dr = DryRun(context.Background(), jc, &mock.RunnerFactory{MakeErr: mock.ErrRunner})
+	if dr.Valid || len(dr.Errors) != 5 {
+		t.Errorf("valid = %t, errors = %v; expected an error for every job", dr.Valid, dr.Errors)
+	}
+	if dr.Errors[0] != "job job1: "+mock.ErrRunner.Error() {
+		t.Errorf("errors[0] = %q, expected job1 error", dr.Errors[0])
+	}
+
+	// A dry run that's canceled, like when its client goes away, stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dr = DryRun(ctx, jc, &mock.RunnerFactory{})
+	if dr.Valid || len(dr.Errors) != 1 || dr.Errors[0] != context.Canceled.Error() {
+		t.Errorf("valid = %t, errors = %v; expected it canceled", dr.Valid, dr.Errors)
+	}
+
+	// An invalid chain has no steps.
+	jc.AdjacencyList["job5"] = []string{"job1"}
+	dr = DryRun(context.Background(), jc, &mock.RunnerFactory{})
+	if dr.Valid || len(dr.Errors) != 1 || len(dr.Steps) != 0 {
+		t.Errorf("valid = %t, errors = %v, steps = %v; expected one error and no steps", dr.Valid, dr.Errors, dr.Steps)
+	}
+}
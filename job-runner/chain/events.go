@@ -0,0 +1,85 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"sync"
+
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind before
+// events are dropped for it.
+const eventBufferSize = 100
+
+// eventBroadcaster sends job chain events to all subscribers.
+type eventBroadcaster struct {
+	subscribers map[chan proto.JobChainEvent]struct{}
+	closed      bool
+	// --
+	*sync.Mutex // guards all fields
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{
+		subscribers: make(map[chan proto.JobChainEvent]struct{}),
+		Mutex:       &sync.Mutex{},
+	}
+}
+
+// Subscribe returns a channel on which all events published after this call
+// are received, and a function to unsubscribe. The channel is closed when
+// unsubscribed or when the broadcaster is closed. If the broadcaster is
+// already closed, the channel is closed immediately.
+func (b *eventBroadcaster) Subscribe() (<-chan proto.JobChainEvent, func()) {
+	b.Lock()
+	defer b.Unlock()
+
+	c := make(chan proto.JobChainEvent, eventBufferSize)
+	if b.closed {
+		close(c)
+		return c, func() {}
+	}
+	b.subscribers[c] = struct{}{}
+
+	unsubscribe := func() {
+		b.Lock()
+		defer b.Unlock()
+		if _, ok := b.subscribers[c]; ok {
+			delete(b.subscribers, c)
+			close(c)
+		}
+	}
+	return c, unsubscribe
+}
+
+// Publish sends an event to all subscribers. It never blocks: if a subscriber
+// isn't keeping up, the event is dropped for it.
+func (b *eventBroadcaster) Publish(event proto.JobChainEvent) {
+	b.Lock()
+	defer b.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- event:
+		default:
+			log.Warnf("[chain=%d]: Event subscriber is not keeping up, dropped event %+v.",
+				event.RequestId, event)
+		}
+	}
+}
+
+// Close closes all subscriber channels. No more events can be published.
+func (b *eventBroadcaster) Close() {
+	b.Lock()
+	defer b.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for c := range b.subscribers {
+		delete(b.subscribers, c)
+		close(c)
+	}
+}
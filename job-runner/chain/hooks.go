@@ -0,0 +1,70 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"github.com/square/spincycle/proto"
+)
+
+// Hooks are called by a traverser as its chain runs, so deployments can
+// integrate with chat notifications, CMDBs, custom metrics, etc. without
+// changing the traverser. Hooks are called synchronously by the traverser, so
+// they must return quickly: a hook that calls a slow service should do so in a
+// goroutine. Embed NopHooks to implement only some hooks.
+type Hooks interface {
+	// OnChainStart is called when the chain starts running.
+	OnChainStart(jc proto.JobChain)
+
+	// OnJobStart is called when a try of a job starts, including tries of
+	// rollback jobs. try starts at 1.
+	OnJobStart(requestId uint, job proto.Job, try uint)
+
+	// OnJobDone is called when a job is done, after its last try, or when the
+	// chain is stopped or suspended before it runs. job.State is its final
+	// state, or PENDING if it will run when the chain is resumed.
+	OnJobDone(requestId uint, job proto.Job)
+
+	// OnChainDone is called when the chain is done running or suspended.
+	// jc.State is its final state: COMPLETE, INCOMPLETE, or SUSPENDED.
+	OnChainDone(jc proto.JobChain)
+}
+
+// NopHooks are Hooks that do nothing.
+type NopHooks struct{}
+
+func (NopHooks) OnChainStart(proto.JobChain)      {}
+func (NopHooks) OnJobStart(uint, proto.Job, uint) {}
+func (NopHooks) OnJobDone(uint, proto.Job)        {}
+func (NopHooks) OnChainDone(proto.JobChain)       {}
+
+// MultiHooks calls every Hooks in order.
+type MultiHooks []Hooks
+
+var (
+	_ Hooks = NopHooks{}
+	_ Hooks = MultiHooks{}
+)
+
+func (m MultiHooks) OnChainStart(jc proto.JobChain) {
+	for _, h := range m {
+		h.OnChainStart(jc)
+	}
+}
+
+func (m MultiHooks) OnJobStart(requestId uint, job proto.Job, try uint) {
+	for _, h := range m {
+		h.OnJobStart(requestId, job, try)
+	}
+}
+
+func (m MultiHooks) OnJobDone(requestId uint, job proto.Job) {
+	for _, h := range m {
+		h.OnJobDone(requestId, job)
+	}
+}
+
+func (m MultiHooks) OnChainDone(jc proto.JobChain) {
+	for _, h := range m {
+		h.OnChainDone(jc)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"encoding/json"
+	"expvar"
+
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	// retainedBytes is the approximate number of bytes of jobData, across all
+	// chains, retained for next jobs that haven't completed yet.
+	retainedBytes = expvar.NewInt("jobDataRetainedBytes")
+
+	// releasedBytes is the approximate number of bytes of jobData, across all
+	// chains, released because no more jobs needed it.
+	releasedBytes = expvar.NewInt("jobDataReleasedBytes")
+)
+
+// jobDataRefs counts references to the jobData of completed jobs. A completed
+// job's jobData is referenced by each of its next jobs until that job completes.
+// When a job has no more references, its jobData is released from the chain
+// so big outputs don't live for the whole chain. Jobs with no next jobs are
+// never referenced, so their jobData is never released. A chain that's done
+// but can run again, like a chain that's retried from the jobs that failed,
+// keeps its jobData (see Keep).
+//
+// jobDataRefs is not thread-safe. It's only used by traverser.Run.
+type jobDataRefs struct {
+	chain *chain
+	refs  map[string]int   // job name => number of next jobs not complete
+	bytes map[string]int64 // job name => approx size of retained jobData
+}
+
+func newJobDataRefs(c *chain) *jobDataRefs {
+	refs := make(map[string]int)
+	for jobName := range c.JobChain.Jobs {
+		refs[jobName] = len(c.NextJobs(jobName))
+	}
+	r := &jobDataRefs{
+		chain: c,
+		refs:  refs,
+		bytes: make(map[string]int64),
+	}
+
+	// Jobs that completed before the chain ran again, like before it was
+	// retried, are referenced by their next jobs that haven't completed.
+	for _, step := range c.steps() {
+		for _, jobName := range step {
+			if job := c.JobChain.Jobs[jobName]; job.State == proto.STATE_COMPLETE {
+				r.Completed(job)
+			}
+		}
+	}
+	return r
+}
+
+// Completed updates references for a job that just completed: its jobData is
+// retained for its next jobs, and it releases its references to the jobData
+// of its previous jobs.
+func (r *jobDataRefs) Completed(job proto.Job) {
+	if r.refs[job.Name] > 0 {
+		n := dataSize(job.Data)
+		r.bytes[job.Name] = n
+		retainedBytes.Add(n)
+	}
+
+	for _, prevJob := range r.chain.PreviousJobs(job.Name) {
+		if r.refs[prevJob.Name] == 0 {
+			continue
+		}
+		r.refs[prevJob.Name]--
+		if r.refs[prevJob.Name] == 0 {
+			r.release(prevJob.Name)
+		}
+	}
+}
+
+// Reset resets the references of jobs that were reset to run again, like the
+// jobs of a sequence that's retried: the jobData they made is no longer
+// retained, and they're referenced by their next jobs again once they complete.
+func (r *jobDataRefs) Reset(jobNames []string) {
+	for _, jobName := range jobNames {
+		retainedBytes.Add(-r.bytes[jobName])
+		delete(r.bytes, jobName)
+		r.refs[jobName] = len(r.chain.NextJobs(jobName))
+	}
+}
+
+// ReleaseAll releases the jobData of all jobs that are still referenced. It is
+// called when the chain is done because no more jobs will run to use it.
+func (r *jobDataRefs) ReleaseAll() {
+	for jobName := range r.bytes {
+		r.refs[jobName] = 0
+		r.release(jobName)
+	}
+}
+
+// Keep stops counting the jobData that's still referenced without releasing
+// it. It is called when the chain is done but can run again: retried from the
+// jobs that failed, or resumed after it's suspended. Next jobs that run then
+// need it, and it's counted again when the chain runs again.
+func (r *jobDataRefs) Keep() {
+	for jobName, n := range r.bytes {
+		retainedBytes.Add(-n)
+		delete(r.bytes, jobName)
+	}
+}
+
+// -------------------------------------------------------------------------- //
+
+func (r *jobDataRefs) release(jobName string) {
+	r.chain.ReleaseJobData(jobName)
+	n := r.bytes[jobName]
+	delete(r.bytes, jobName)
+	retainedBytes.Add(-n)
+	releasedBytes.Add(n)
+}
+
+// dataSize returns the approximate size of jobData in bytes, which is the size
+// of its JSON encoding. It returns zero if jobData can't be encoded.
+func dataSize(jobData map[string]interface{}) int64 {
+	bytes, err := json.Marshal(jobData)
+	if err != nil {
+		return 0
+	}
+	return int64(len(bytes))
+}
+
+// copyJobData returns a copy of jobData that can be changed without changing
+// jobData. It's never nil.
+func copyJobData(jobData map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(jobData))
+	for k, v := range jobData {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,233 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/square/spincycle/proto"
+)
+
+// A Limiter limits how many jobs can run at once. A traverser acquires slots
+// before running each job and releases them when the job is done running. One
+// Limiter is shared by all traversers to limit jobs across all chains, and
+// every traverser has its own Limiter for the chain's MaxConcurrentJobs.
+//
+// A job uses Job.Cost slots (default 1), so the limit is a budget: a
+// heavyweight job can count as several jobs while trivial jobs count as one.
+type Limiter interface {
+	// Acquire blocks until enough slots are available for the job, returning
+	// true, or until stopChan is closed, returning false.
+	Acquire(job proto.Job, stopChan <-chan struct{}) bool
+
+	// Release releases the slots acquired for the job.
+	Release(job proto.Job)
+}
+
+// limiter is a Limiter that counts the slots used.
+type limiter struct {
+	max     uint          // 0 if no limit
+	used    uint          // slots acquired
+	changed chan struct{} // closed and replaced on every Release
+	// --
+	*sync.Mutex // guards used and changed
+}
+
+// NewLimiter returns a Limiter that allows jobs using at most max slots to run
+// at once. If max is zero, there is no limit.
+func NewLimiter(max uint) Limiter {
+	return &limiter{
+		max:     max,
+		changed: make(chan struct{}),
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+func (l *limiter) Acquire(job proto.Job, stopChan <-chan struct{}) bool {
+	if l.max == 0 {
+		select {
+		case <-stopChan:
+			return false
+		default:
+			return true
+		}
+	}
+
+	cost := l.cost(job)
+	for {
+		l.Lock()
+		if l.used+cost <= l.max {
+			l.used += cost
+			l.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.Unlock()
+
+		// Wait for slots to be released, then try again.
+		select {
+		case <-changed:
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+func (l *limiter) Release(job proto.Job) {
+	if l.max == 0 {
+		return
+	}
+	l.Lock()
+	l.used -= l.cost(job)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.Unlock()
+}
+
+// cost returns the slots a job uses. A job that costs more than the limit
+// uses all slots, so it can still run, but only by itself.
+func (l *limiter) cost(job proto.Job) uint {
+	cost := jobCost(job)
+	if cost > l.max {
+		return l.max
+	}
+	return cost
+}
+
+// jobCost returns the number of slots a job uses: its Cost, or 1 if not set.
+func jobCost(job proto.Job) uint {
+	if job.Cost == 0 {
+		return 1
+	}
+	return job.Cost
+}
+
+// Limiters is a Limiter made of other Limiters, like a limit on all jobs and a
+// TypeLimiter. A job acquires slots from every Limiter, in order.
+type Limiters []Limiter
+
+func (ls Limiters) Acquire(job proto.Job, stopChan <-chan struct{}) bool {
+	for i, l := range ls {
+		if !l.Acquire(job, stopChan) {
+			for _, acquired := range ls[:i] {
+				acquired.Release(job)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (ls Limiters) Release(job proto.Job) {
+	for _, l := range ls {
+		l.Release(job)
+	}
+}
+
+// A TypeLimiter is a Limiter that limits how many jobs of a type run at once
+// across all chains, like at most 3 restart-db jobs. Every job counts as one,
+// whatever its cost. Jobs of a type without a limit aren't limited. The limits
+// can be changed with SetLimits while jobs run.
+type TypeLimiter struct {
+	// --
+	max         map[string]uint // job type => max jobs running at once
+	running     map[string]uint // job type => jobs running
+	changed     chan struct{}   // closed and replaced on every Release and SetLimits
+	*sync.Mutex                 // guards max, running, and changed
+}
+
+// NewTypeLimiter returns a TypeLimiter with max jobs running at once per job
+// type.
+func NewTypeLimiter(max map[string]uint) *TypeLimiter {
+	l := &TypeLimiter{
+		running: map[string]uint{},
+		changed: make(chan struct{}),
+		Mutex:   &sync.Mutex{},
+	}
+	l.SetLimits(max)
+	return l
+}
+
+// SetLimits replaces the limits. Running jobs keep running; if a limit is
+// lowered, jobs of the type wait until fewer than the new limit are running.
+func (l *TypeLimiter) SetLimits(max map[string]uint) {
+	l.Lock()
+	defer l.Unlock()
+	l.max = map[string]uint{}
+	for jobType, n := range max {
+		if n > 0 {
+			l.max[jobType] = n
+		}
+	}
+	l.notify()
+}
+
+// Limits returns the limits, job type => max jobs running at once.
+func (l *TypeLimiter) Limits() map[string]uint {
+	l.Lock()
+	defer l.Unlock()
+	max := make(map[string]uint, len(l.max))
+	for jobType, n := range l.max {
+		max[jobType] = n
+	}
+	return max
+}
+
+func (l *TypeLimiter) Acquire(job proto.Job, stopChan <-chan struct{}) bool {
+	for {
+		l.Lock()
+		if max, ok := l.max[job.Type]; !ok || l.running[job.Type] < max {
+			l.running[job.Type]++
+			l.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.Unlock()
+
+		// Wait for a job to be released or the limits to change, then try again.
+		select {
+		case <-changed:
+		case <-stopChan:
+			return false
+		}
+	}
+}
+
+func (l *TypeLimiter) Release(job proto.Job) {
+	l.Lock()
+	defer l.Unlock()
+	if l.running[job.Type] > 0 {
+		l.running[job.Type]--
+	}
+	l.notify()
+}
+
+// notify wakes up jobs waiting in Acquire. The caller must hold the lock.
+func (l *TypeLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// ParseTypeLimits parses job type limits, like "restart-db=3,drain-host=10",
+// into job type => max jobs running at once. An empty string is no limits.
+func ParseTypeLimits(s string) (map[string]uint, error) {
+	max := map[string]uint{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid job type limit %q, expected type=max", kv)
+		}
+		n, err := strconv.ParseUint(p[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job type limit %q: %s", kv, err)
+		}
+		max[p[0]] = uint(n)
+	}
+	return max, nil
+}
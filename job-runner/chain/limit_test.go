@@ -0,0 +1,198 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+func TestLimiter(t *testing.T) {
+	job := proto.Job{Name: "job1"}
+	stopChan := make(chan struct{})
+	l := NewLimiter(1)
+
+	if !l.Acquire(job, stopChan) {
+		t.Fatal("first Acquire returned false, expected true")
+	}
+
+	// No slots left, so Acquire blocks until stopChan is closed.
+	acquired := make(chan bool)
+	go func() { acquired <- l.Acquire(job, stopChan) }()
+	select {
+	case <-acquired:
+		t.Fatal("second Acquire returned, expected it to block")
+	default:
+	}
+	close(stopChan)
+	if <-acquired {
+		t.Error("second Acquire returned true after stop, expected false")
+	}
+
+	// Releasing the slot lets the next job acquire it.
+	l.Release(job)
+	if !l.Acquire(job, make(chan struct{})) {
+		t.Error("Acquire after Release returned false, expected true")
+	}
+}
+
+func TestLimiterNoLimit(t *testing.T) {
+	job := proto.Job{Name: "job1"}
+	stopChan := make(chan struct{})
+	l := NewLimiter(0)
+
+	for i := 0; i < 100; i++ {
+		if !l.Acquire(job, stopChan) {
+			t.Fatal("Acquire returned false, expected true")
+		}
+	}
+	l.Release(job)
+
+	close(stopChan)
+	if l.Acquire(job, stopChan) {
+		t.Error("Acquire returned true after stop, expected false")
+	}
+}
+
+func TestLimiterCost(t *testing.T) {
+	heavy := proto.Job{Name: "heavy", Cost: 3}
+	light := proto.Job{Name: "light"}
+	huge := proto.Job{Name: "huge", Cost: 10}
+	stopChan := make(chan struct{})
+	l := NewLimiter(4)
+
+	// 3 + 1 slots fit, but not another light job.
+	if !l.Acquire(heavy, stopChan) || !l.Acquire(light, stopChan) {
+		t.Fatal("Acquire returned false, expected true")
+	}
+	acquired := make(chan bool)
+	go func() { acquired <- l.Acquire(light, stopChan) }()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire returned, expected it to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Releasing the heavy job frees enough slots for the waiting job.
+	l.Release(heavy)
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Error("Acquire returned false, expected true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire blocked after Release, expected it to return")
+	}
+	l.Release(light)
+	l.Release(light)
+
+	// A job that costs more than the limit runs by itself.
+	if !l.Acquire(huge, stopChan) {
+		t.Fatal("Acquire returned false for a job costing more than the limit, expected true")
+	}
+	go func() { acquired <- l.Acquire(light, stopChan) }()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire returned while the huge job is running, expected it to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(stopChan)
+	if <-acquired {
+		t.Error("Acquire returned true after stop, expected false")
+	}
+}
+
+func TestTypeLimiter(t *testing.T) {
+	db1 := proto.Job{Name: "db1", Type: "restart-db"}
+	db2 := proto.Job{Name: "db2", Type: "restart-db"}
+	other := proto.Job{Name: "other", Type: "drain-host", Cost: 5}
+	stopChan := make(chan struct{})
+	l := NewTypeLimiter(map[string]uint{"restart-db": 1})
+
+	// Jobs of other types aren't limited
+	if !l.Acquire(db1, stopChan) || !l.Acquire(other, stopChan) || !l.Acquire(other, stopChan) {
+		t.Fatal("Acquire returned false, expected true")
+	}
+	acquired := make(chan bool)
+	go func() { acquired <- l.Acquire(db2, stopChan) }()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire returned, expected it to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Raising the limit lets the waiting job run
+	l.SetLimits(map[string]uint{"restart-db": 2})
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Error("Acquire returned false, expected true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still blocked after the limit was raised")
+	}
+
+	// Lowering it, jobs wait until fewer than the new limit are running
+	l.SetLimits(map[string]uint{"restart-db": 1})
+	l.Release(db1)
+	go func() { acquired <- l.Acquire(db1, stopChan) }()
+	select {
+	case <-acquired:
+		t.Fatal("Acquire returned, expected it to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Release(db2)
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Error("Acquire returned false, expected true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still blocked after a job was released")
+	}
+	close(stopChan)
+	if l.Acquire(db2, stopChan) {
+		t.Error("Acquire returned true after stop, expected false")
+	}
+}
+
+func TestLimiters(t *testing.T) {
+	db := proto.Job{Name: "db", Type: "restart-db"}
+	stopChan := make(chan struct{})
+	typeLimiter := NewTypeLimiter(map[string]uint{"restart-db": 2})
+	l := Limiters{typeLimiter, NewLimiter(1)}
+
+	if !l.Acquire(db, stopChan) {
+		t.Fatal("Acquire returned false, expected true")
+	}
+
+	// A job that can't get a global slot releases its slot of its type
+	close(stopChan)
+	if l.Acquire(db, stopChan) {
+		t.Fatal("Acquire returned true, expected false")
+	}
+	if typeLimiter.running["restart-db"] != 1 {
+		t.Errorf("%d restart-db jobs running, expected 1", typeLimiter.running["restart-db"])
+	}
+	l.Release(db)
+	if typeLimiter.running["restart-db"] != 0 {
+		t.Errorf("%d restart-db jobs running, expected 0", typeLimiter.running["restart-db"])
+	}
+}
+
+func TestParseTypeLimits(t *testing.T) {
+	max, err := ParseTypeLimits("restart-db=3, drain-host=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(max) != 2 || max["restart-db"] != 3 || max["drain-host"] != 10 {
+		t.Errorf("limits = %v, expected restart-db=3, drain-host=10", max)
+	}
+	for _, s := range []string{"restart-db", "=3", "restart-db=-1"} {
+		if _, err := ParseTypeLimits(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
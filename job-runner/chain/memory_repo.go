@@ -33,6 +33,21 @@ func (m *memoryRepo) Get(id uint) (*chain, error) {
 	return chain, nil
 }
 
+func (m *memoryRepo) GetAll() (map[uint]*chain, error) {
+	vals := m.Store.GetAll()
+
+	allChains := make(map[uint]*chain)
+	for _, val := range vals {
+		chain, ok := val.(*chain) // make sure we got a chain from the repo
+		if !ok {
+			return allChains, ErrNotFound
+		}
+		allChains[chain.RequestId()] = chain
+	}
+
+	return allChains, nil
+}
+
 func (m *memoryRepo) Add(chain *chain) error {
 	err := m.Store.Add(uintToStr(chain.RequestId()), chain)
 	if err != nil {
@@ -0,0 +1,115 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	// requestTypeMetrics are metrics of chains that are done running, by
+	// JobChain.RequestType: request type => chains, failed (chains that didn't
+	// complete), retries (of all jobs), and seconds (total run time).
+	requestTypeMetrics = expvar.NewMap("requestTypes")
+
+	// sequenceMetrics are metrics of the sequences (Job.Sequence) of chains
+	// that are done running, by request type: "<request type>/<sequence>" =>
+	// runs, failed (runs with a job that ran and didn't complete), retries, and
+	// seconds (total time from the first job starting to the last job ending).
+	sequenceMetrics = expvar.NewMap("sequences")
+
+	// quarantinedChains is the number of chains quarantined because their
+	// traverser panicked.
+	quarantinedChains = expvar.NewInt("quarantinedChains")
+
+	metricsMux = &sync.Mutex{} // guards making the map of a key
+)
+
+// recordMetrics records the metrics of a chain that's done running from its
+// final report. Chains without a request type are recorded as "unknown".
+// Rollback jobs are not part of their sequence's metrics.
+func recordMetrics(report proto.JobChainReport) {
+	requestType := report.RequestType
+	if requestType == "" {
+		requestType = "unknown"
+	}
+
+	type sequence struct {
+		start, end time.Time
+		failed     bool
+		retries    int64
+	}
+	sequences := map[string]*sequence{}
+	var retries int64
+	for _, jr := range report.Jobs {
+		if jr.Tries == 0 {
+			continue // didn't run
+		}
+		retries += int64(jr.Tries - 1)
+		if jr.Sequence == "" || jr.Rollback {
+			continue
+		}
+		s, ok := sequences[jr.Sequence]
+		if !ok {
+			s = &sequence{start: jr.StartTime, end: jr.EndTime}
+			sequences[jr.Sequence] = s
+		}
+		if jr.StartTime.Before(s.start) {
+			s.start = jr.StartTime
+		}
+		if jr.EndTime.After(s.end) {
+			s.end = jr.EndTime
+		}
+		if jr.State != proto.STATE_COMPLETE {
+			s.failed = true
+		}
+		s.retries += int64(jr.Tries - 1)
+	}
+
+	m := metricsFor(requestTypeMetrics, requestType, "chains", "failed", "retries")
+	m.Add("chains", 1)
+	if report.State != proto.STATE_COMPLETE {
+		m.Add("failed", 1)
+	}
+	m.Add("retries", retries)
+	m.AddFloat("seconds", seconds(report.StartTime, report.EndTime))
+
+	for name, s := range sequences {
+		m := metricsFor(sequenceMetrics, requestType+"/"+name, "runs", "failed", "retries")
+		m.Add("runs", 1)
+		if s.failed {
+			m.Add("failed", 1)
+		}
+		m.Add("retries", s.retries)
+		m.AddFloat("seconds", seconds(s.start, s.end))
+	}
+}
+
+// metricsFor returns the metrics of a key in m, making them with zero values
+// of the counters and seconds if needed, so they're all published.
+func metricsFor(m *expvar.Map, key string, counters ...string) *expvar.Map {
+	metricsMux.Lock()
+	defer metricsMux.Unlock()
+	if km, ok := m.Get(key).(*expvar.Map); ok {
+		return km
+	}
+	km := new(expvar.Map).Init()
+	for _, c := range counters {
+		km.Add(c, 0)
+	}
+	km.AddFloat("seconds", 0)
+	m.Set(key, km)
+	return km
+}
+
+// seconds returns the seconds from start to end, zero if either isn't set.
+func seconds(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
@@ -0,0 +1,83 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"expvar"
+	"testing"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job3": mock.NewRunner(false, "", nil, nil, noJobData),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId:   7,
+		RequestType: "test-record-metrics",
+		Jobs:        mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+			"job3": {"job4"},
+		},
+	}
+	for name, seq := range map[string]string{"job1": "drain", "job2": "drain", "job3": "restart", "job4": "restart"} {
+		j := jc.Jobs[name]
+		j.Sequence = seq
+		if name == "job3" {
+			j.Retry = 2
+		}
+		jc.Jobs[name] = j
+	}
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), NewChain(jc))
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	get := func(m *expvar.Map, key, metric string) string {
+		km, ok := m.Get(key).(*expvar.Map)
+		if !ok {
+			t.Fatalf("no metrics for %s", key)
+		}
+		if v := km.Get(metric); v != nil {
+			return v.String()
+		}
+		return ""
+	}
+	expect := []struct {
+		m      *expvar.Map
+		key    string
+		metric string
+		value  string
+	}{
+		{requestTypeMetrics, "test-record-metrics", "chains", "1"},
+		{requestTypeMetrics, "test-record-metrics", "failed", "1"},
+		{requestTypeMetrics, "test-record-metrics", "retries", "2"},
+		{sequenceMetrics, "test-record-metrics/drain", "runs", "1"},
+		{sequenceMetrics, "test-record-metrics/drain", "failed", "0"},
+		{sequenceMetrics, "test-record-metrics/drain", "retries", "0"},
+		{sequenceMetrics, "test-record-metrics/restart", "runs", "1"},
+		{sequenceMetrics, "test-record-metrics/restart", "failed", "1"},
+		{sequenceMetrics, "test-record-metrics/restart", "retries", "2"},
+	}
+	for _, e := range expect {
+		if v := get(e.m, e.key, e.metric); v != e.value {
+			t.Errorf("%s %s = %s, expected %s", e.key, e.metric, v, e.value)
+		}
+	}
+	if get(sequenceMetrics, "test-record-metrics/drain", "seconds") == "" {
+		t.Error("drain has no seconds")
+	}
+}
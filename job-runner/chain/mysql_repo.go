@@ -0,0 +1,181 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/kv"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MYSQL_SCHEMA is the schema of the tables of a MySQL repo. job_chains has the
+// latest copy of every chain, without jobData except in its last checkpoint,
+// and its final report once it's done running. job_chain_states has every state the chain has been in.
+const MYSQL_SCHEMA = `
+CREATE TABLE IF NOT EXISTS job_chains (
+  request_id  BIGINT UNSIGNED NOT NULL PRIMARY KEY,
+  state       TINYINT UNSIGNED NOT NULL,
+  chain       MEDIUMBLOB NOT NULL,
+  updated_at  DATETIME(6) NOT NULL,
+  KEY (state, updated_at)
+);
+CREATE TABLE IF NOT EXISTS job_chain_states (
+  request_id  BIGINT UNSIGNED NOT NULL,
+  state       TINYINT UNSIGNED NOT NULL,
+  ts          DATETIME(6) NOT NULL,
+  KEY (request_id, ts)
+);
+`
+
+// mysqlRepo is a Repo that keeps chains in memory, like a memory repo, and
+// saves every change to a chain in MySQL, so chains outlive the Job Runner. A
+// chain that isn't in memory, like one that was done before the Job Runner
+// restarted, is read from MySQL. Chains removed from the repo are only removed
+// from memory: they're removed from MySQL by Purge.
+type mysqlRepo struct {
+	*memoryRepo
+	db *sql.DB
+	// --
+	states    map[uint]byte // last state saved of every chain
+	statesMux *sync.Mutex   // guards states
+}
+
+// NewMySQLRepo returns a repo that saves chains in the MySQL database db,
+// which must have the tables in MYSQL_SCHEMA.
+func NewMySQLRepo(db *sql.DB) *mysqlRepo {
+	return &mysqlRepo{
+		memoryRepo: NewMemoryRepo(),
+		db:         db,
+		states:     map[uint]byte{},
+		statesMux:  &sync.Mutex{},
+	}
+}
+
+// Get gets a chain from memory or, if it isn't there, from MySQL. A chain read
+// from MySQL has the jobData of its last checkpoint (see CheckpointInterval),
+// if it has one.
+func (m *mysqlRepo) Get(id uint) (*chain, error) {
+	c, err := m.memoryRepo.Get(id)
+	if err != kv.ErrKeyNotFound {
+		return c, err
+	}
+	var data []byte
+	err = m.db.QueryRow("SELECT chain FROM job_chains WHERE request_id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c = &chain{RWMutex: &sync.RWMutex{}}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	c.RestoreCheckpoint()
+	return c, nil
+}
+
+func (m *mysqlRepo) Add(c *chain) error {
+	if err := m.memoryRepo.Add(c); err != nil {
+		return err
+	}
+	return m.save(c)
+}
+
+func (m *mysqlRepo) Set(c *chain) error {
+	m.memoryRepo.Set(c)
+	return m.save(c)
+}
+
+func (m *mysqlRepo) Remove(id uint) error {
+	m.statesMux.Lock()
+	delete(m.states, id)
+	m.statesMux.Unlock()
+	return m.memoryRepo.Remove(id)
+}
+
+// Purge removes chains that are done (complete, incomplete, or expired) and
+// were last saved before the given time from MySQL. It returns how many were
+// removed.
+func (m *mysqlRepo) Purge(before time.Time) (int64, error) {
+	done := []interface{}{proto.STATE_COMPLETE, proto.STATE_INCOMPLETE, proto.STATE_EXPIRED, before}
+	_, err := m.db.Exec("DELETE s FROM job_chain_states s JOIN job_chains c USING (request_id)"+
+		" WHERE c.state IN (?, ?, ?) AND c.updated_at < ?", done...)
+	if err != nil {
+		return 0, err
+	}
+	res, err := m.db.Exec("DELETE FROM job_chains WHERE state IN (?, ?, ?) AND updated_at < ?", done...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PurgeHistory purges chains that have been done for longer than retention
+// every interval until stopChan is closed, so it should be run in a goroutine.
+func (m *mysqlRepo) PurgeHistory(retention, interval time.Duration, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := m.Purge(now().Add(-retention))
+			if err != nil {
+				log.Errorf("Can't purge chains done for more than %s from MySQL (error: %s).", retention, err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Purged %d chains done for more than %s from MySQL.", n, retention)
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// save saves the chain, without jobData, and its state if it changed.
+func (m *mysqlRepo) save(c *chain) error {
+	report, ok := c.Report()
+	saved := &chain{
+		JobChain:   new(proto.JobChain),
+		CreateTime: c.CreateTime,
+		Hash:       c.Hash,
+		Checkpoint: c.LastCheckpoint(),
+	}
+	*saved.JobChain = c.Definition()
+	if ok {
+		saved.FinalReport = &report
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	id, state, ts := c.RequestId(), saved.JobChain.State, now().UTC()
+	_, err = m.db.Exec("INSERT INTO job_chains (request_id, state, chain, updated_at) VALUES (?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE state = VALUES(state), chain = VALUES(chain), updated_at = VALUES(updated_at)",
+		id, state, data, ts)
+	if err != nil {
+		log.Errorf("[chain=%d]: Can't save chain in MySQL (error: %s).", id, err)
+		return err
+	}
+
+	m.statesMux.Lock()
+	defer m.statesMux.Unlock()
+	if last, ok := m.states[id]; ok && last == state {
+		return nil
+	}
+	_, err = m.db.Exec("INSERT INTO job_chain_states (request_id, state, ts) VALUES (?, ?, ?)", id, state, ts)
+	if err != nil {
+		log.Errorf("[chain=%d]: Can't save chain state %s in MySQL (error: %s).", id, proto.StateName[state], err)
+		return err
+	}
+	m.states[id] = state
+	return nil
+}
@@ -0,0 +1,336 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// fakeMySQL is a database/sql driver that keeps the tables of a MySQL repo in
+// memory. It only knows the queries that mysqlRepo makes.
+type fakeMySQL struct {
+	chains  map[int64]fakeChainRow
+	states  []fakeStateRow
+	execErr error // returned by every Exec, if set
+	*sync.Mutex
+}
+
+type fakeChainRow struct {
+	state     int64
+	chain     []byte
+	updatedAt time.Time
+}
+
+type fakeStateRow struct {
+	requestId int64
+	state     int64
+}
+
+var (
+	fakeDBs    = map[string]*fakeMySQL{}
+	fakeDBsMux = &sync.Mutex{}
+)
+
+func init() {
+	sql.Register("fakemysql", fakeDriver{})
+}
+
+// newFakeMySQL returns a fake MySQL database and a *sql.DB connected to it.
+func newFakeMySQL(t *testing.T) (*fakeMySQL, *sql.DB) {
+	f := &fakeMySQL{chains: map[int64]fakeChainRow{}, Mutex: &sync.Mutex{}}
+	fakeDBsMux.Lock()
+	fakeDBs[t.Name()] = f
+	fakeDBsMux.Unlock()
+	db, err := sql.Open("fakemysql", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, db
+}
+
+// stateHistory returns the states saved of a chain, in order.
+func (f *fakeMySQL) stateHistory(id int64) []byte {
+	f.Lock()
+	defer f.Unlock()
+	states := []byte{}
+	for _, s := range f.states {
+		if s.requestId == id {
+			states = append(states, byte(s.state))
+		}
+	}
+	return states
+}
+
+func (f *fakeMySQL) setExecErr(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.execErr = err
+}
+
+func (f *fakeMySQL) hasChain(id int64) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.chains[id]
+	return ok
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMux.Lock()
+	defer fakeDBsMux.Unlock()
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %s", name)
+	}
+	return fakeConn{f}, nil
+}
+
+type fakeConn struct {
+	db *fakeMySQL
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions not supported") }
+
+type fakeStmt struct {
+	db    *fakeMySQL
+	query string
+}
+
+func (s fakeStmt) Close() error { return nil }
+
+func (s fakeStmt) NumInput() int { return strings.Count(s.query, "?") }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.db
+	f.Lock()
+	defer f.Unlock()
+	if f.execErr != nil {
+		return nil, f.execErr
+	}
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO job_chains "):
+		f.chains[args[0].(int64)] = fakeChainRow{state: args[1].(int64), chain: args[2].([]byte), updatedAt: args[3].(time.Time)}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "INSERT INTO job_chain_states "):
+		f.states = append(f.states, fakeStateRow{requestId: args[0].(int64), state: args[1].(int64)})
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE s FROM job_chain_states "):
+		kept := []fakeStateRow{}
+		for _, row := range f.states {
+			if c, ok := f.chains[row.requestId]; !ok || !purge(c, args) {
+				kept = append(kept, row)
+			}
+		}
+		n := len(f.states) - len(kept)
+		f.states = kept
+		return driver.RowsAffected(n), nil
+	case strings.HasPrefix(s.query, "DELETE FROM job_chains "):
+		var n int64
+		for id, c := range f.chains {
+			if purge(c, args) {
+				delete(f.chains, id)
+				n++
+			}
+		}
+		return driver.RowsAffected(n), nil
+	}
+	return nil, fmt.Errorf("unknown exec: %s", s.query)
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	f := s.db
+	f.Lock()
+	defer f.Unlock()
+	if !strings.HasPrefix(s.query, "SELECT chain FROM job_chains ") {
+		return nil, fmt.Errorf("unknown query: %s", s.query)
+	}
+	rows := &fakeRows{}
+	if c, ok := f.chains[args[0].(int64)]; ok {
+		rows.values = append(rows.values, c.chain)
+	}
+	return rows, nil
+}
+
+// purge returns true if the chain is purged by a DELETE with args: the chain
+// is in one of the states and was updated before the time.
+func purge(c fakeChainRow, args []driver.Value) bool {
+	for _, state := range args[:len(args)-1] {
+		if c.state == state.(int64) && c.updatedAt.Before(args[len(args)-1].(time.Time)) {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeRows struct {
+	values [][]byte
+}
+
+func (r *fakeRows) Columns() []string { return []string{"chain"} }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+// -------------------------------------------------------------------------- //
+
+func TestMySQLRepoGet(t *testing.T) {
+	_, db := newFakeMySQL(t)
+	repo := NewMySQLRepo(db)
+
+	c := NewChain(&proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(2), AdjacencyList: map[string][]string{"job1": {"job2"}}})
+	if err := repo.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	c.SetStart()
+	c.SetComplete()
+	if err := repo.Set(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// A chain in memory is got from memory
+	got, err := repo.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Error("got a different chain, expected the one in memory")
+	}
+
+	// A chain removed from memory, like after a restart, is read from MySQL
+	if err := repo.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	got, err = repo.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == c || got.RequestId() != 1 || got.State() != proto.STATE_COMPLETE || len(got.JobChain.Jobs) != 2 {
+		t.Errorf("chain = %+v, expected chain 1 COMPLETE read from MySQL", got.JobChain)
+	}
+
+	if _, err := repo.Get(2); err != ErrNotFound {
+		t.Errorf("err = %v, expected ErrNotFound", err)
+	}
+}
+
+func TestMySQLRepoSet(t *testing.T) {
+	f, db := newFakeMySQL(t)
+	repo := NewMySQLRepo(db)
+
+	c := NewChain(&proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(1)})
+	if err := repo.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	c.SetStart()
+	for i := 0; i < 2; i++ {
+		if err := repo.Set(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.SetComplete()
+	if err := repo.Set(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// A state is saved once, when the chain changes to it
+	expect := []byte{proto.STATE_PENDING, proto.STATE_RUNNING, proto.STATE_COMPLETE}
+	if got := f.stateHistory(1); !reflect.DeepEqual(got, expect) {
+		t.Errorf("states = %v, expected %v", got, expect)
+	}
+
+	// An error saving the chain is returned, and its state isn't recorded
+	// as saved, so it's saved by the next Set
+	c2 := NewChain(&proto.JobChain{RequestId: 2, Jobs: mock.InitJobs(1)})
+	f.setExecErr(errors.New("connection refused"))
+	if err := repo.Add(c2); err == nil {
+		t.Error("err = nil, expected an error")
+	}
+	f.setExecErr(nil)
+	if err := repo.Set(c2); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.stateHistory(2); !reflect.DeepEqual(got, []byte{proto.STATE_PENDING}) {
+		t.Errorf("states = %v, expected [PENDING]", got)
+	}
+}
+
+func TestMySQLRepoPurgeHistory(t *testing.T) {
+	f, db := newFakeMySQL(t)
+	repo := NewMySQLRepo(db)
+
+	// Chain 1 was done long ago, chain 2 has been running since long ago,
+	// and chain 3 was done recently
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(-48 * time.Hour) }
+	c1 := NewChain(&proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(1)})
+	c1.SetStart()
+	c1.SetComplete()
+	c2 := NewChain(&proto.JobChain{RequestId: 2, Jobs: mock.InitJobs(1)})
+	c2.SetStart()
+	for _, c := range []*chain{c1, c2} {
+		if err := repo.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = time.Now
+	c3 := NewChain(&proto.JobChain{RequestId: 3, Jobs: mock.InitJobs(1)})
+	c3.SetStart()
+	c3.SetComplete()
+	if err := repo.Add(c3); err != nil {
+		t.Fatal(err)
+	}
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	go func() {
+		repo.PurgeHistory(24*time.Hour, 10*time.Millisecond, stopChan)
+		close(doneChan)
+	}()
+	timeout := time.After(2 * time.Second)
+	for f.hasChain(1) {
+		select {
+		case <-timeout:
+			t.Fatal("chain 1 not purged")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(stopChan)
+	<-doneChan
+
+	if len(f.stateHistory(1)) != 0 {
+		t.Errorf("states of chain 1 = %v, expected them purged", f.stateHistory(1))
+	}
+	if !f.hasChain(2) || !f.hasChain(3) {
+		t.Error("chains 2 and 3 purged, expected them kept")
+	}
+	if len(f.stateHistory(2)) == 0 || len(f.stateHistory(3)) == 0 {
+		t.Error("states of chains 2 and 3 purged, expected them kept")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"sort"
+	"sync"
+)
+
+// A Queue limits how many chains run at once. A chain waits in the queue until
+// fewer than the max chains are running. Waiting chains run in order of their
+// priority (JobChain.Priority), highest first, then in the order they were
+// started, so a higher-priority chain goes ahead of chains already waiting.
+// Running chains are not preempted.
+type Queue struct {
+	max     uint          // 0 if no limit
+	running uint          // chains running
+	waiting []*queuedItem // sorted by priority, then the order they were added
+	// --
+	*sync.Mutex // guards all fields
+}
+
+type queuedItem struct {
+	requestId uint
+	priority  int
+	ready     chan bool // true when the chain can run, false if canceled
+}
+
+// NewQueue returns a Queue that runs at most max chains at once. If max is
+// zero, there is no limit and chains never wait.
+func NewQueue(max uint) *Queue {
+	return &Queue{
+		max:     max,
+		waiting: []*queuedItem{},
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// Wait blocks until the chain can run, returning true, or until its wait is
+// canceled with Cancel, returning false. If it returns true, the caller must
+// call Done when the chain is done running.
+func (q *Queue) Wait(requestId uint, priority int) bool {
+	q.Lock()
+	item := &queuedItem{
+		requestId: requestId,
+		priority:  priority,
+		ready:     make(chan bool, 1),
+	}
+	// After the chains with the same or a higher priority
+	i := sort.Search(len(q.waiting), func(i int) bool {
+		return q.waiting[i].priority < priority
+	})
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = item
+	q.dispatch()
+	q.Unlock()
+	return <-item.ready
+}
+
+// Done frees the slot of a chain that's done running, so the next chain in the
+// queue can run.
+func (q *Queue) Done() {
+	q.Lock()
+	q.running--
+	q.dispatch()
+	q.Unlock()
+}
+
+// Cancel removes a waiting chain from the queue; its Wait returns false. It
+// returns false if the chain isn't waiting.
+func (q *Queue) Cancel(requestId uint) bool {
+	q.Lock()
+	defer q.Unlock()
+	for i, item := range q.waiting {
+		if item.requestId == requestId {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			item.ready <- false
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the position of a waiting chain in the queue, starting at
+// 1 for the next chain to run. It returns 0 if the chain isn't waiting.
+func (q *Queue) Position(requestId uint) uint {
+	q.Lock()
+	defer q.Unlock()
+	for i, item := range q.waiting {
+		if item.requestId == requestId {
+			return uint(i + 1)
+		}
+	}
+	return 0
+}
+
+// Len returns the number of chains running and waiting.
+func (q *Queue) Len() (running, waiting uint) {
+	q.Lock()
+	defer q.Unlock()
+	return q.running, uint(len(q.waiting))
+}
+
+// Max returns the max chains that run at once, 0 if there is no limit.
+func (q *Queue) Max() uint {
+	q.Lock()
+	defer q.Unlock()
+	return q.max
+}
+
+// SetMax changes the max chains that run at once. If it's raised, waiting
+// chains that fit under the new max run now. If it's lowered, running chains
+// keep running, and waiting chains wait until fewer than max are running.
+func (q *Queue) SetMax(max uint) {
+	q.Lock()
+	q.max = max
+	q.dispatch()
+	q.Unlock()
+}
+
+// dispatch runs the waiting chains that fit under the max. The caller must
+// hold the lock.
+func (q *Queue) dispatch() {
+	for len(q.waiting) > 0 && (q.max == 0 || q.running < q.max) {
+		item := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		item.ready <- true
+	}
+}
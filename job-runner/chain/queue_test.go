@@ -0,0 +1,99 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(1)
+
+	// The first chain runs right away
+	if !q.Wait(1, 0) {
+		t.Fatal("Wait returned false, expected true")
+	}
+
+	// The others wait: chain 4 has a higher priority, so it goes ahead of
+	// chains 2 and 3, which were started first
+	ran := make(chan uint, 10)
+	wait := func(requestId uint, priority int) {
+		go func() {
+			if q.Wait(requestId, priority) {
+				ran <- requestId
+			}
+		}()
+		for q.Position(requestId) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait(2, 0)
+	wait(3, 0)
+	wait(4, 10)
+	wait(5, 0)
+	if pos := q.Position(4); pos != 1 {
+		t.Errorf("chain 4 position = %d, expected 1", pos)
+	}
+	if running, waiting := q.Len(); running != 1 || waiting != 4 {
+		t.Errorf("running = %d, waiting = %d, expected 1 and 4", running, waiting)
+	}
+
+	// A canceled chain never runs
+	if !q.Cancel(3) {
+		t.Error("Cancel returned false, expected true")
+	}
+	if q.Cancel(3) {
+		t.Error("Cancel returned true for a canceled chain, expected false")
+	}
+
+	order := []uint{}
+	for i := 0; i < 3; i++ {
+		q.Done()
+		select {
+		case requestId := <-ran:
+			order = append(order, requestId)
+		case <-time.After(time.Second):
+			t.Fatalf("no chain ran after Done, ran %v", order)
+		}
+	}
+	if !reflect.DeepEqual(order, []uint{4, 2, 5}) {
+		t.Errorf("chains ran in order %v, expected [4 2 5]", order)
+	}
+}
+
+func TestQueueNoLimit(t *testing.T) {
+	q := NewQueue(0)
+	for i := uint(1); i <= 3; i++ {
+		if !q.Wait(i, 0) {
+			t.Fatalf("Wait returned false for chain %d, expected true", i)
+		}
+	}
+	if running, waiting := q.Len(); running != 3 || waiting != 0 {
+		t.Errorf("running = %d, waiting = %d, expected 3 and 0", running, waiting)
+	}
+}
+
+func TestQueueSetMax(t *testing.T) {
+	q := NewQueue(1)
+	q.Wait(1, 0)
+	readyChan := make(chan bool)
+	go func() { readyChan <- q.Wait(2, 0) }()
+	for _, waiting := q.Len(); waiting != 1; _, waiting = q.Len() {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.SetMax(2)
+	select {
+	case ready := <-readyChan:
+		if !ready {
+			t.Error("Wait returned false, expected true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chain still waiting after raising the max")
+	}
+	if running, waiting := q.Len(); running != 2 || waiting != 0 {
+		t.Errorf("running = %d, waiting = %d, expected 2 and 0", running, waiting)
+	}
+}
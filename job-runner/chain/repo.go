@@ -14,6 +14,7 @@ var (
 // Repo stores and provides thread-safe access to job chains.
 type Repo interface {
 	Get(uint) (*chain, error)
+	GetAll() (map[uint]*chain, error)
 	Add(*chain) error
 	Set(*chain) error
 	Remove(uint) error
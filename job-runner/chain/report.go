@@ -0,0 +1,303 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+// reportBuilder records what happens while a traverser runs a chain so that
+// the final report can be made when the chain is done.
+type reportBuilder struct {
+	timeline      []proto.JobChainEvent
+	interventions []proto.Intervention
+	jobs          map[string]*proto.JobReport // job name => what happened so far
+	// --
+	*sync.Mutex // guards all fields
+}
+
+func newReportBuilder() *reportBuilder {
+	return &reportBuilder{
+		timeline:      []proto.JobChainEvent{},
+		interventions: []proto.Intervention{},
+		jobs:          make(map[string]*proto.JobReport),
+		Mutex:         &sync.Mutex{},
+	}
+}
+
+// Event records a change in the state of a job or the chain.
+func (b *reportBuilder) Event(event proto.JobChainEvent) {
+	b.Lock()
+	defer b.Unlock()
+	b.timeline = append(b.timeline, event)
+}
+
+// Intervention records an INTERVENTION_* action taken on the chain, and who
+// took it and why, if known.
+func (b *reportBuilder) Intervention(action, requester, reason string) {
+	b.Lock()
+	defer b.Unlock()
+	b.interventions = append(b.interventions, proto.Intervention{
+		Action:    action,
+		Time:      now(),
+		Requester: requester,
+		Reason:    reason,
+	})
+}
+
+// JobTry records that a job is about to run, once per try, and the ID of the
+// try.
+func (b *reportBuilder) JobTry(jobName, tryId string) {
+	b.Lock()
+	defer b.Unlock()
+	jr, ok := b.jobs[jobName]
+	if !ok {
+		jr = &proto.JobReport{StartTime: now()}
+		b.jobs[jobName] = jr
+	}
+	jr.Tries++
+	jr.TryIds = append(jr.TryIds, tryId)
+	jr.TryHistory = append(jr.TryHistory, proto.JobTry{
+		Try:       jr.Tries,
+		Id:        tryId,
+		State:     proto.STATE_RUNNING,
+		StartTime: now(),
+	})
+}
+
+// JobTryDone records that a try of a job is done: its final state, the error
+// if it failed, and the path of its log if it's kept.
+func (b *reportBuilder) JobTryDone(jobName string, state byte, err, log string) {
+	b.Lock()
+	defer b.Unlock()
+	jr, ok := b.jobs[jobName]
+	if !ok || len(jr.TryHistory) == 0 {
+		return
+	}
+	try := &jr.TryHistory[len(jr.TryHistory)-1]
+	try.State = state
+	try.EndTime = now()
+	try.Error = err
+	try.Log = log
+}
+
+// JobTries returns a copy of the tries of a job so far.
+func (b *reportBuilder) JobTries(jobName string) []proto.JobTry {
+	b.Lock()
+	defer b.Unlock()
+	if jr, ok := b.jobs[jobName]; ok {
+		return append([]proto.JobTry{}, jr.TryHistory...)
+	}
+	return []proto.JobTry{}
+}
+
+// JobDone records that a job is done running, after its last try.
+func (b *reportBuilder) JobDone(jobName string) {
+	b.Lock()
+	defer b.Unlock()
+	if jr, ok := b.jobs[jobName]; ok {
+		jr.EndTime = now()
+	}
+}
+
+// JobStartTime returns when a job first started running, or the zero time if
+// it hasn't run.
+func (b *reportBuilder) JobStartTime(jobName string) time.Time {
+	b.Lock()
+	defer b.Unlock()
+	if jr, ok := b.jobs[jobName]; ok {
+		return jr.StartTime
+	}
+	return time.Time{}
+}
+
+// Report makes the report of the chain from what was recorded and the final
+// state of the chain and its jobs.
+func (b *reportBuilder) Report(c *chain) proto.JobChainReport {
+	jc := c.Snapshot()
+
+	b.Lock()
+	defer b.Unlock()
+
+	report := proto.JobChainReport{
+		RequestId:     jc.RequestId,
+		RequestType:   jc.RequestType,
+		State:         jc.State,
+		StartTime:     jc.StartTime,
+		EndTime:       jc.EndTime,
+		Jobs:          []proto.JobReport{},
+		Interventions: append([]proto.Intervention{}, b.interventions...),
+		Timeline:      append([]proto.JobChainEvent{}, b.timeline...),
+		Metadata:      jc.Metadata,
+	}
+	for _, jobs := range []map[string]proto.Job{jc.Jobs, jc.RollbackJobs} {
+		for name, job := range jobs {
+			jr := proto.JobReport{}
+			if ran, ok := b.jobs[name]; ok {
+				jr = *ran
+				jr.TryIds = append([]string{}, ran.TryIds...)
+				jr.TryHistory = append([]proto.JobTry{}, ran.TryHistory...)
+			}
+			jr.Name = name
+			jr.Type = job.Type
+			jr.Sequence = job.Sequence
+			jr.State = job.State
+			_, jr.Rollback = jc.RollbackJobs[name]
+			report.Jobs = append(report.Jobs, jr)
+		}
+	}
+
+	// Jobs that ran in the order they started, then jobs that didn't run
+	// sorted by name.
+	sort.Slice(report.Jobs, func(i, j int) bool {
+		a, b := report.Jobs[i], report.Jobs[j]
+		if a.StartTime.IsZero() != b.StartTime.IsZero() {
+			return !a.StartTime.IsZero()
+		}
+		if !a.StartTime.Equal(b.StartTime) {
+			return a.StartTime.Before(b.StartTime)
+		}
+		return a.Name < b.Name
+	})
+
+	return report
+}
+
+// SLOWEST_JOBS is the number of slowest jobs in a CompletionSummary.
+const SLOWEST_JOBS = 3
+
+// Summarize makes the completion summary of a chain from its final report.
+func Summarize(report proto.JobChainReport) proto.CompletionSummary {
+	summary := proto.CompletionSummary{
+		Seconds:     seconds(report.StartTime, report.EndTime),
+		SlowestJobs: []proto.JobRunTime{},
+	}
+	for _, jr := range report.Jobs {
+		if jr.Rollback {
+			continue
+		}
+		summary.TotalJobs++
+		switch jr.State {
+		case proto.STATE_COMPLETE:
+			summary.Completed++
+		case proto.STATE_SKIPPED:
+			summary.Skipped++
+		case proto.STATE_STOPPED, proto.STATE_FORCE_KILLED:
+			summary.Stopped++
+		case proto.STATE_PENDING:
+			summary.NotRun++
+		default:
+			summary.Failed++
+		}
+		if jr.Tries > 0 {
+			summary.SlowestJobs = append(summary.SlowestJobs, proto.JobRunTime{
+				Name:    jr.Name,
+				Seconds: seconds(jr.StartTime, jr.EndTime),
+			})
+		}
+	}
+	sort.SliceStable(summary.SlowestJobs, func(i, j int) bool {
+		return summary.SlowestJobs[i].Seconds > summary.SlowestJobs[j].Seconds
+	})
+	if len(summary.SlowestJobs) > SLOWEST_JOBS {
+		summary.SlowestJobs = summary.SlowestJobs[:SLOWEST_JOBS]
+	}
+	return summary
+}
+
+// FormatReport writes a human-readable rendering of a job chain report to w.
+func FormatReport(w io.Writer, report proto.JobChainReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Request:\t%d\n", report.RequestId)
+	fmt.Fprintf(tw, "State:\t%s\n", proto.StateName[report.State])
+	fmt.Fprintf(tw, "Started:\t%s\n", formatTime(report.StartTime))
+	fmt.Fprintf(tw, "Ended:\t%s\n", formatTime(report.EndTime))
+	fmt.Fprintf(tw, "Duration:\t%s\n", formatDuration(report.StartTime, report.EndTime))
+	keys := make([]string, 0, len(report.Metadata))
+	for k := range report.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s:\t%s\n", k, report.Metadata[k])
+	}
+	if s := report.Spend; s != nil {
+		if s.Budget > 0 {
+			fmt.Fprintf(tw, "Budget:\t%g\n", s.Budget)
+		}
+		fmt.Fprintf(tw, "Spend:\t%g projected, %g actual\n", s.Projected, s.Actual)
+		if len(s.Refused) > 0 {
+			fmt.Fprintf(tw, "Over budget:\t%s\n", strings.Join(s.Refused, ", "))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nJOB\tTYPE\tSTATE\tTRIES\tDURATION\n")
+	for _, jr := range report.Jobs {
+		name := jr.Name
+		if jr.Rollback {
+			name += " (rollback)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", name, jr.Type, proto.StateName[jr.State],
+			jr.Tries, formatDuration(jr.StartTime, jr.EndTime))
+	}
+
+	// Every try of the jobs that were tried more than once, so it's clear
+	// why the tries before the last one failed.
+	retried := false
+	for _, jr := range report.Jobs {
+		if len(jr.TryHistory) < 2 {
+			continue
+		}
+		if !retried {
+			fmt.Fprintf(tw, "\nJOB\tTRY\tSTATE\tDURATION\tERROR\n")
+			retried = true
+		}
+		for _, try := range jr.TryHistory {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", jr.Name, try.Try, proto.StateName[try.State],
+				formatDuration(try.StartTime, try.EndTime), try.Error)
+		}
+	}
+
+	if len(report.Interventions) > 0 {
+		fmt.Fprintf(tw, "\nINTERVENTION\tTIME\tREQUESTER\tREASON\n")
+		for _, i := range report.Interventions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", i.Action, formatTime(i.Time), i.Requester, i.Reason)
+		}
+	}
+
+	fmt.Fprintf(tw, "\nTIME\tJOB\tSTATE\n")
+	for _, e := range report.Timeline {
+		job := e.Job
+		if job == "" {
+			job = "(chain)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", formatTime(e.Time), job, proto.StateName[e.State])
+	}
+
+	return tw.Flush()
+}
+
+// -------------------------------------------------------------------------- //
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatDuration(start, end time.Time) string {
+	if start.IsZero() || end.IsZero() {
+		return "-"
+	}
+	return end.Sub(start).String()
+}
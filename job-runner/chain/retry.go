@@ -0,0 +1,77 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	// ErrInvalidRetryPolicy means a job has a retry wait that isn't a valid
+	// duration or a retry backoff that isn't a RETRY_BACKOFF_* const.
+	ErrInvalidRetryPolicy = errors.New("job has an invalid retry policy")
+)
+
+// maxRetryWait caps the wait between tries of a job, which can otherwise grow
+// very large with exponential backoff.
+var maxRetryWait = 1 * time.Hour
+
+// Allows tests to mock the jitter.
+var jitter func(time.Duration) time.Duration = func(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// RetryWait returns how long to wait before the next try of a job that just
+// failed its try-th try (starting at 1). It assumes the job's retry policy
+// has already been validated by validRetryPolicy.
+func RetryWait(job proto.Job, try uint) time.Duration {
+	if job.RetryWait == "" {
+		return 0
+	}
+	wait, err := time.ParseDuration(job.RetryWait)
+	if err != nil {
+		return 0
+	}
+
+	switch job.RetryBackoff {
+	case proto.RETRY_BACKOFF_EXPONENTIAL, proto.RETRY_BACKOFF_JITTER:
+		// Double the wait for every try after the first, but stop doubling
+		// once the max is hit to avoid overflowing.
+		for i := uint(1); i < try && wait < maxRetryWait; i++ {
+			wait *= 2
+		}
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+		if job.RetryBackoff == proto.RETRY_BACKOFF_JITTER {
+			// "Equal jitter": wait at least half, plus a random amount
+			// up to the other half.
+			wait = wait/2 + jitter(wait/2)
+		}
+	}
+
+	return wait
+}
+
+// validRetryPolicy returns whether or not a job's retry policy is valid.
+func validRetryPolicy(job proto.Job) bool {
+	if job.RetryWait != "" {
+		wait, err := time.ParseDuration(job.RetryWait)
+		if err != nil || wait < 0 {
+			return false
+		}
+	}
+
+	switch job.RetryBackoff {
+	case "", proto.RETRY_BACKOFF_FIXED, proto.RETRY_BACKOFF_EXPONENTIAL, proto.RETRY_BACKOFF_JITTER:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+func TestRetryWait(t *testing.T) {
+	// Mock the jitter so it always returns the max.
+	defer func(f func(time.Duration) time.Duration) { jitter = f }(jitter)
+	jitter = func(d time.Duration) time.Duration { return d }
+
+	tests := []struct {
+		job    proto.Job
+		try    uint
+		expect time.Duration
+	}{
+		{proto.Job{}, 1, 0},
+		{proto.Job{RetryWait: "2s"}, 1, 2 * time.Second},
+		{proto.Job{RetryWait: "2s"}, 3, 2 * time.Second},
+		{proto.Job{RetryWait: "2s", RetryBackoff: proto.RETRY_BACKOFF_FIXED}, 3, 2 * time.Second},
+		{proto.Job{RetryWait: "2s", RetryBackoff: proto.RETRY_BACKOFF_EXPONENTIAL}, 1, 2 * time.Second},
+		{proto.Job{RetryWait: "2s", RetryBackoff: proto.RETRY_BACKOFF_EXPONENTIAL}, 3, 8 * time.Second},
+		{proto.Job{RetryWait: "2s", RetryBackoff: proto.RETRY_BACKOFF_EXPONENTIAL}, 100, maxRetryWait},
+		{proto.Job{RetryWait: "2s", RetryBackoff: proto.RETRY_BACKOFF_JITTER}, 3, 8 * time.Second},
+	}
+
+	for _, test := range tests {
+		wait := RetryWait(test.job, test.try)
+		if wait != test.expect {
+			t.Errorf("wait = %s, expected %s (job: %+v, try %d)", wait, test.expect, test.job, test.try)
+		}
+	}
+}
+
+func TestValidRetryPolicy(t *testing.T) {
+	tests := []struct {
+		job    proto.Job
+		expect bool
+	}{
+		{proto.Job{}, true},
+		{proto.Job{Retry: 3, RetryWait: "500ms", RetryBackoff: proto.RETRY_BACKOFF_JITTER}, true},
+		{proto.Job{Retry: 3, RetryWait: "five seconds"}, false},
+		{proto.Job{Retry: 3, RetryWait: "-1s"}, false},
+		{proto.Job{Retry: 3, RetryBackoff: "linear"}, false},
+	}
+
+	for _, test := range tests {
+		valid := validRetryPolicy(test.job)
+		if valid != test.expect {
+			t.Errorf("valid = %t, expected %t (job: %+v)", valid, test.expect, test.job)
+		}
+	}
+}
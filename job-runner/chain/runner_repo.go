@@ -42,7 +42,7 @@ func (r *runnerRepo) Get(jobName string) (runner.Runner, error) {
 
 	runner, ok := val.(runner.Runner)
 	if !ok {
-		return nil, err
+		return nil, ErrInvalidRunner
 	}
 
 	return runner, nil
@@ -0,0 +1,75 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"github.com/square/spincycle/job"
+)
+
+// DEFAULT_SCRATCH_MAX_SIZE is the default max size of the keys and values in
+// the scratch of a chain, in bytes.
+const DEFAULT_SCRATCH_MAX_SIZE = 64 * 1024
+
+// A ScratchStore provides the scratch of the chains in a repo to their jobs
+// (see job.Scratch). The scratch of a chain is JobChain.Scratch, so every
+// change to it is saved with the chain, like in MySQL, and it's sent with the
+// chain when it's suspended.
+type ScratchStore struct {
+	repo    Repo
+	maxSize int
+}
+
+// NewScratchStore makes a ScratchStore of the chains in repo with scratches
+// of at most maxSize bytes of keys and values, 0 = no limit.
+func NewScratchStore(repo Repo, maxSize int) *ScratchStore {
+	return &ScratchStore{
+		repo:    repo,
+		maxSize: maxSize,
+	}
+}
+
+// Scratch returns the scratch of the chain of the request.
+func (s *ScratchStore) Scratch(requestId uint) job.Scratch {
+	return &scratch{
+		store:     s,
+		requestId: requestId,
+	}
+}
+
+type scratch struct {
+	store     *ScratchStore
+	requestId uint
+}
+
+func (s *scratch) Get(key string) (string, bool) {
+	c, err := s.store.repo.Get(s.requestId)
+	if err != nil {
+		return "", false
+	}
+	return c.ScratchValue(key)
+}
+
+// Set sets the key and saves the chain. If the chain can't be saved, the key
+// is set in memory, so the job can keep running, but the error is returned
+// because the value won't survive a restart.
+func (s *scratch) Set(key, value string) error {
+	c, err := s.store.repo.Get(s.requestId)
+	if err != nil {
+		return err
+	}
+	if !c.SetScratchValue(key, value, s.store.maxSize) {
+		return job.ErrScratchFull
+	}
+	return s.store.repo.Set(c)
+}
+
+func (s *scratch) Delete(key string) error {
+	c, err := s.store.repo.Get(s.requestId)
+	if err != nil {
+		return err
+	}
+	if !c.DeleteScratchValue(key) {
+		return nil
+	}
+	return s.store.repo.Set(c)
+}
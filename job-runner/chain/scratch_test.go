@@ -0,0 +1,63 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"testing"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestScratch(t *testing.T) {
+	repo := NewMemoryRepo()
+	c := NewChain(&proto.JobChain{
+		RequestId:     1,
+		Jobs:          mock.InitJobs(1),
+		AdjacencyList: map[string][]string{},
+	})
+	if err := repo.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	s := NewScratchStore(repo, 16).Scratch(1)
+
+	if err := s.Set("cursor", "42"); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if v, ok := s.Get("cursor"); !ok || v != "42" {
+		t.Errorf("cursor = %q, %t; expected 42, true", v, ok)
+	}
+
+	// Keys and values count toward the max size, but a key's old value doesn't
+	if err := s.Set("host", "db1.local"); err != job.ErrScratchFull {
+		t.Errorf("err = %v, expected ErrScratchFull", err)
+	}
+	if err := s.Set("cursor", "1234567890"); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	// It's saved with the chain, so it's in the definition saved in MySQL
+	if jc := c.Definition(); jc.Scratch["cursor"] != "1234567890" {
+		t.Errorf("scratch = %v, expected cursor in it", jc.Scratch)
+	}
+
+	if err := s.Delete("cursor"); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if _, ok := s.Get("cursor"); ok {
+		t.Error("cursor is set, expected it deleted")
+	}
+
+	// It's removed when the chain is done
+	s.Set("cursor", "42")
+	c.SetComplete()
+	if _, ok := s.Get("cursor"); ok {
+		t.Error("cursor is set, expected the scratch removed when the chain is done")
+	}
+
+	// A chain that isn't in the repo doesn't have a scratch
+	if err := NewScratchStore(repo, 0).Scratch(2).Set("cursor", "42"); err == nil {
+		t.Error("err = nil, expected an error for a chain not in the repo")
+	}
+}
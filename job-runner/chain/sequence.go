@@ -0,0 +1,127 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"github.com/square/spincycle/proto"
+)
+
+// sequenceRetries keeps track of the sequences of a chain that are retried as a
+// whole (JobChain.SequenceRetries). When a job in a sequence fails, the
+// sequence is failed: none of its jobs enqueue their next jobs, and once none
+// of them are running, the sequence is reset and runs again from its first
+// job, until it runs out of retries.
+//
+// sequenceRetries is not thread-safe. It's only used by traverser.Run.
+type sequenceRetries struct {
+	chain  *chain
+	tries  map[string]uint                   // sequence => retries used
+	failed map[string]bool                   // sequence => failed, waiting for its jobs to finish
+	held   map[string][]proto.Job            // sequence => jobs done since it failed, next jobs not enqueued
+	inputs map[string]map[string]interface{} // job name => copy of its jobData when first enqueued
+}
+
+func newSequenceRetries(c *chain) *sequenceRetries {
+	return &sequenceRetries{
+		chain:  c,
+		tries:  make(map[string]uint),
+		failed: make(map[string]bool),
+		held:   make(map[string][]proto.Job),
+		inputs: make(map[string]map[string]interface{}),
+	}
+}
+
+// Enqueued saves a copy of the jobData that a job in a sequence that can be
+// retried is given, so it's given the same jobData when the sequence is
+// retried, even if the jobData of its previous jobs was released.
+func (s *sequenceRetries) Enqueued(job proto.Job) {
+	if s.chain.JobChain.SequenceRetries[job.Sequence] == 0 {
+		return
+	}
+	if _, ok := s.inputs[job.Name]; ok {
+		return
+	}
+	input := make(map[string]interface{}, len(job.Data))
+	for k, v := range job.Data {
+		input[k] = v
+	}
+	s.inputs[job.Name] = input
+}
+
+// Done returns true if the sequence of a job that's done is failed, so the
+// job's next jobs must not be enqueued. The sequence fails if the job didn't
+// complete and the sequence has retries left, unless the job was stopped.
+func (s *sequenceRetries) Done(job proto.Job) bool {
+	if !s.failed[job.Sequence] {
+		switch job.State {
+		case proto.STATE_COMPLETE, proto.STATE_SKIPPED, proto.STATE_STOPPED, proto.STATE_FORCE_KILLED:
+			return false
+		}
+		if s.tries[job.Sequence] >= s.chain.JobChain.SequenceRetries[job.Sequence] {
+			return false // no retries left, or not retried
+		}
+		s.failed[job.Sequence] = true
+	}
+	s.held[job.Sequence] = append(s.held[job.Sequence], job)
+	return true
+}
+
+// Release gives up retrying failed sequences, like when the chain is stopped.
+// It returns the jobs whose next jobs weren't enqueued, so they can be.
+func (s *sequenceRetries) Release() []proto.Job {
+	var held []proto.Job
+	for sequence, jobs := range s.held {
+		held = append(held, jobs...)
+		delete(s.held, sequence)
+		s.failed[sequence] = false
+	}
+	return held
+}
+
+// Reset resets a failed sequence if none of its jobs are running: every job in
+// the sequence is PENDING, with the jobData it was first given. It returns the
+// names of the jobs and the first job, ready to be enqueued. It returns false
+// if the sequence isn't failed or some of its jobs are still running.
+func (s *sequenceRetries) Reset(sequence string) ([]string, proto.Job, bool) {
+	if !s.failed[sequence] {
+		return nil, proto.Job{}, false
+	}
+	jobs, first := s.chain.SequenceJobs(sequence)
+	for _, name := range jobs {
+		if s.chain.JobState(name) == proto.STATE_RUNNING {
+			return nil, proto.Job{}, false
+		}
+	}
+	for _, name := range jobs {
+		jobData := make(map[string]interface{}, len(s.inputs[name]))
+		for k, v := range s.inputs[name] {
+			jobData[k] = v
+		}
+		s.chain.ResetJob(name, jobData)
+	}
+	s.failed[sequence] = false
+	delete(s.held, sequence)
+	s.tries[sequence]++
+	job, _ := s.chain.Job(first[0])
+	return jobs, job, true
+}
+
+// Tries returns the number of times a sequence was retried.
+func (s *sequenceRetries) Tries(sequence string) uint {
+	return s.tries[sequence]
+}
+
+// removeJobs returns the job names in names that aren't in remove.
+func removeJobs(names, remove []string) []string {
+	removed := map[string]bool{}
+	for _, name := range remove {
+		removed[name] = true
+	}
+	kept := []string{}
+	for _, name := range names {
+		if !removed[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
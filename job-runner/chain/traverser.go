@@ -3,28 +3,131 @@
 package chain
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/idgen"
 	"github.com/square/spincycle/job-runner/runner"
 	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/trace"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+var (
+	// ErrTraverserStopped means a job was not run because the traverser was stopped.
+	ErrTraverserStopped = errors.New("traverser was stopped")
+
+	// ErrTraverserSuspended means a job was not run because the traverser was
+	// suspended. The job will run when the chain is resumed.
+	ErrTraverserSuspended = errors.New("traverser was suspended")
+
+	// ErrJobsForceKilled means the traverser was stopped but some jobs didn't
+	// stop within the grace period, so they were abandoned.
+	ErrJobsForceKilled = errors.New("jobs did not stop within the grace period and were abandoned")
+
+	// ErrQuarantined means the traverser panicked, so the chain was
+	// quarantined instead of finishing.
+	ErrQuarantined = errors.New("traverser panicked, chain is quarantined")
+
+	// ErrNotQuarantined means a chain can't be recovered because it's not
+	// quarantined, or because its jobs are still running.
+	ErrNotQuarantined = errors.New("chain is not quarantined or its jobs are still running")
+
+	// ErrOverBudget means a job was not run because its estimated cost would
+	// exceed the chain's budget.
+	ErrOverBudget = errors.New("estimated cost of the job exceeds the chain's budget")
+)
+
+// DEFAULT_OVERRUN_FACTOR is the overrun factor of chains with an expected
+// duration and no OverrunFactor: they're overrunning once they've run twice as
+// long as expected.
+const DEFAULT_OVERRUN_FACTOR = 2
+
+// What a traverser does when it can't save its chain to the chain repo. Either
+// way, the chain is degraded until a write succeeds, and writes are retried
+// every RepoRetryInterval. The chain is kept in memory, so the first write that
+// succeeds saves every change made while the repo was unavailable.
+const (
+	REPO_FAILURE_CONTINUE = "continue" // keep running jobs, with the chain only in memory
+	REPO_FAILURE_PAUSE    = "pause"    // don't start jobs until the chain can be saved
+)
+
+// MAX_TRY_ERROR_LENGTH is the max length of the error of a try of a job
+// (proto.JobTry.Error).
+const MAX_TRY_ERROR_LENGTH = 1024
+
+var (
+	// HeartbeatInterval is how often a running traverser heartbeats.
+	HeartbeatInterval = 5 * time.Second
+
+	// StaleHeartbeatAge is how old the heartbeat of a running traverser can
+	// be before its status is stale because the traverser is wedged.
+	StaleHeartbeatAge = 3 * HeartbeatInterval
+
+	// TryIdGenerator makes the unique ID of every try of a job, which is
+	// logged and recorded in the final report.
+	TryIdGenerator idgen.Generator = idgen.NewULID()
+
+	// Tracer records a span for every chain and every try of a job, in the
+	// distributed trace of the chain's Traceparent.
+	Tracer trace.Tracer = trace.Nop{}
+
+	// RepoFailurePolicy is what traversers do when they can't save their
+	// chain: a REPO_FAILURE_* const.
+	RepoFailurePolicy = REPO_FAILURE_CONTINUE
+
+	// RepoRetryInterval is how often a degraded traverser retries saving its
+	// chain.
+	RepoRetryInterval = 5 * time.Second
+
+	// CheckpointInterval is how often a running traverser saves a checkpoint
+	// of its chain's jobData to the chain repo, so a crash loses at most this
+	// much of it. 0 means the chain is only saved when jobs start and finish.
+	CheckpointInterval = time.Minute
+)
+
 // A Traverser provides the ability to run a job chain while respecting the
 // dependencies between the jobs.
 type Traverser interface {
 	// Run traverses a job chain and runs all of the jobs in it. It starts by
-	// running the first job in the chain, and then, if the job completed,
-	// successfully, running its adjacent jobs. This process continues until there
+	// running the first job in the chain, or the jobs a retried chain failed
+	// at, and then, if the job completed, successfully, running its adjacent
+	// jobs. This process continues until there
 	// or no more jobs to run, or until the Stop method is called on the traverser.
+	// If the chain fails (and wasn't stopped), its rollback jobs are run before
+	// Run returns.
 	//
 	// It returns an error if it fails to start.
 	Run() error
 
 	// Stop makes a traverser stop traversing its job chain. It also sends a stop
-	// signal to all of the jobs that a traverser is running.
+	// signal to all of the jobs that a traverser is running, then it waits for
+	// them to stop. Jobs that stop within grace are STATE_STOPPED. Jobs that
+	// don't are abandoned and STATE_FORCE_KILLED.
 	//
-	// It returns an error if it fails to stop all running jobs.
-	Stop() error
+	// Who stopped the chain and why are kept with the chain (JobChain.Stopped)
+	// and its report; stop.Time is set by Stop.
+	//
+	// It returns ErrJobsForceKilled if any job was force-killed, or another
+	// error if it fails to stop all running jobs.
+	Stop(grace time.Duration, stop proto.StopInfo) error
+
+	// Suspend makes a traverser stop traversing its job chain at the next job
+	// boundary: jobs that are running are allowed to finish, but no new jobs
+	// are started. It blocks until no jobs are running, then it returns a copy
+	// of the chain that can be re-dispatched and resumed. If the chain was not
+	// started, it's suspended right away and can't be started. If the chain is
+	// done before it's suspended, the state of the returned chain is COMPLETE
+	// or INCOMPLETE rather than SUSPENDED.
+	Suspend() proto.SuspendedJobChain
 
 	// Status gets the status of all running and failed jobs. Since a job can only
 	// run when all of its ancestors have completed, the state of the entire chain
@@ -32,8 +135,35 @@ type Traverser interface {
 	// running or failed job must be complete, and every job in the chain after a
 	// running or failed job must be pending.
 	//
-	// It returns an error if it fails to get the status of all running jobs.
-	Status() (proto.JobChainStatus, error)
+	// It returns an error if it fails to get the status of all running jobs,
+	// or ctx.Err() if ctx is done before it gets them, like when the client
+	// that asked for the status went away.
+	Status(ctx context.Context) (proto.JobChainStatus, error)
+
+	// Log gets the log output captured from a job. Only running and failed
+	// jobs have log output, so it returns an error if the job is not one of
+	// these (i.e., it is pending or it completed). If try is greater than
+	// zero, it gets the log of that try of the job instead, which is only
+	// kept if the try failed.
+	Log(jobName string, try uint) (*runner.Log, error)
+
+	// Explain explains why a job in the chain hasn't started running: which
+	// previous jobs aren't complete, whether the chain was started or stopped,
+	// etc. It returns an error if the chain does not have the job.
+	Explain(jobName string) (proto.JobExplanation, error)
+
+	// Subscribe returns a channel that receives an event every time the state
+	// of a job in the chain, or the chain itself, changes, and a function to
+	// unsubscribe. The channel is closed when the chain is done running or
+	// when unsubscribed. The caller must call the unsubscribe function.
+	Subscribe() (<-chan proto.JobChainEvent, func())
+
+	// Recover makes a chain that was quarantined because the traverser
+	// panicked resumable: it's suspended, and jobs that were left running
+	// are pending. It returns a copy of the chain that can be re-dispatched
+	// and resumed, or ErrNotQuarantined if the chain isn't quarantined or
+	// Run hasn't returned because jobs are still running.
+	Recover() (proto.SuspendedJobChain, error)
 }
 
 // A traverser represents a job chain and everything needed to traverse it.
@@ -47,21 +177,93 @@ type traverser struct {
 	// Factory for creating Runners.
 	rf runner.RunnerFactory
 
+	// Limits jobs running at once across all chains (shared by all traversers)
+	// and in this chain (MaxConcurrentJobs).
+	globalLimiter Limiter
+	chainLimiter  Limiter
+
+	// Jobs waiting for a Limiter slot: job name => BLOCKED_* const.
+	waiting    map[string]string
+	waitingMux *sync.Mutex
+
 	// Repo for keeping track of active Runners.
 	runnerRepo RunnerRepo
 
+	// Logs of the tries of jobs that failed: job name => try => log.
+	tryLogs    map[string]map[uint]*runner.Log
+	tryLogsMux *sync.Mutex
+
 	// Used to stop a running traverser.
 	stopChan chan struct{}
+	stopOnce *sync.Once
+
+	// Used to suspend a running traverser.
+	suspendChan chan struct{}
+	suspendOnce *sync.Once
+
+	// Closed when the traverser is stopped or suspended, whichever is first.
+	// Jobs waiting to run wait on this.
+	haltChan chan struct{}
+	haltOnce *sync.Once
+
+	// Closed when Run returns, if it started the chain.
+	doneChan chan struct{}
 
 	// Queue for processing jobs that need to run.
 	runJobChan chan proto.Job
 
 	// Queue for processing jobs that are done running.
 	doneJobChan chan proto.Job
+
+	// Sends job and chain state changes to subscribers.
+	events *eventBroadcaster
+
+	// Records what happens for the chain's final report.
+	report *reportBuilder
+
+	// Keeps the chain's jobs within its budget and counts what they spend.
+	budget *budget
+
+	// Sequences retried as a whole, set when Run starts. Only used by Run.
+	sequences *sequenceRetries
+
+	// The chain's span in its distributed trace, set when Run starts. Jobs'
+	// spans are its children.
+	span *trace.Span
+
+	// When the Run loop last heartbeat, zero if it's not running.
+	heartbeat    time.Time
+	heartbeatMux *sync.Mutex
+
+	// Set when the chain has run longer than it's expected to.
+	overrun    bool
+	overrunMux *sync.Mutex
+
+	// Set while the chain can't be saved to chainRepo, with the gaps in the
+	// chain's history in the repo.
+	degraded bool
+	repoGaps []proto.RepoGap
+	repoMux  *sync.Mutex
+
+	// Called as the chain runs.
+	hooks MultiHooks
+
+	// Closed when the traverser panics and the chain is quarantined.
+	quarantineChan chan struct{}
+	quarantineOnce *sync.Once
+
+	// Job goroutines started by runJobs, which closes runJobsDone when it
+	// returns. Only used to wait for jobs after Run panics.
+	jobs        *sync.WaitGroup
+	runJobsDone chan struct{}
+	runJobsOnce *sync.Once // closes runJobChan
 }
 
-// NewTraverser creates a new traverser for a job chain.
-func NewTraverser(chainRepo Repo, rf runner.RunnerFactory, chain *chain) (*traverser, error) {
+// NewTraverser creates a new traverser for a job chain. The limiter limits
+// jobs running at once across all chains, so it should be shared by all
+// traversers. The hooks, if any, are called in order as the chain runs; nil
+// hooks are ignored.
+func NewTraverser(chainRepo Repo, rf runner.RunnerFactory, limiter Limiter, chain *chain, hooks ...Hooks) (*traverser, error) {
 	// Validate the chain.
 	log.Infof("[chain=%d]: Validating the chain.", chain.RequestId())
 	err := chain.Validate()
@@ -76,111 +278,322 @@ func NewTraverser(chainRepo Repo, rf runner.RunnerFactory, chain *chain) (*trave
 		return nil, err
 	}
 
+	multiHooks := MultiHooks{}
+	for _, h := range hooks {
+		if h != nil {
+			multiHooks = append(multiHooks, h)
+		}
+	}
+
 	return &traverser{
-		chain:       chain,
-		chainRepo:   chainRepo,
-		rf:          rf,
-		runnerRepo:  NewRunnerRepo(),
-		stopChan:    make(chan struct{}),
-		runJobChan:  make(chan proto.Job),
-		doneJobChan: make(chan proto.Job),
+		chain:          chain,
+		chainRepo:      chainRepo,
+		rf:             rf,
+		globalLimiter:  limiter,
+		chainLimiter:   NewLimiter(chain.JobChain.MaxConcurrentJobs),
+		waiting:        make(map[string]string),
+		waitingMux:     &sync.Mutex{},
+		runnerRepo:     NewRunnerRepo(),
+		tryLogs:        make(map[string]map[uint]*runner.Log),
+		tryLogsMux:     &sync.Mutex{},
+		stopChan:       make(chan struct{}),
+		stopOnce:       &sync.Once{},
+		suspendChan:    make(chan struct{}),
+		suspendOnce:    &sync.Once{},
+		haltChan:       make(chan struct{}),
+		haltOnce:       &sync.Once{},
+		doneChan:       make(chan struct{}),
+		runJobChan:     make(chan proto.Job),
+		doneJobChan:    make(chan proto.Job),
+		events:         newEventBroadcaster(),
+		report:         newReportBuilder(),
+		budget:         newBudget(chain.JobChain.Budget),
+		heartbeatMux:   &sync.Mutex{},
+		overrunMux:     &sync.Mutex{},
+		repoMux:        &sync.Mutex{},
+		hooks:          multiHooks,
+		quarantineChan: make(chan struct{}),
+		quarantineOnce: &sync.Once{},
+		jobs:           &sync.WaitGroup{},
+		runJobsOnce:    &sync.Once{},
 	}, nil
 }
 
 // Run runs all jobs in the chain and blocks until all jobs complete or a job fails.
-func (t *traverser) Run() error {
-	log.Infof("[chain=%d]: Starting the chain traverser.", t.chain.RequestId())
-	firstJob, err := t.chain.FirstJob()
+func (t *traverser) Run() (err error) {
+	log.Infof("[chain=%d]: Starting the chain traverser (metadata: %v).", t.chain.RequestId(), t.chain.JobChain.Metadata)
+	startJobs, err := t.chain.StartJobs()
 	if err != nil {
 		return err
 	}
 
-	// Set the starting state of the chain.
-	t.chain.SetStart()
-	t.chainRepo.Set(t.chain)
+	// Set the starting state of the chain. This fails if the chain was already
+	// started or it expired.
+	if err := t.chain.SetStart(); err != nil {
+		return err
+	}
+	defer close(t.doneChan)
+
+	// If the traverser panics, the chain is quarantined instead of crashing
+	// the Job Runner, and Run returns once no jobs are running.
+	defer func() {
+		if v := recover(); v != nil {
+			t.quarantine(v, debug.Stack())
+			t.drain()
+			err = ErrQuarantined
+		}
+	}()
+
+	t.save()
+	t.publish("", proto.STATE_RUNNING)
+	t.hooks.OnChainStart(t.chain.Snapshot())
+
+	// The chain is a span in the caller's trace, or the root of a new trace.
+	parent, _ := trace.ParseTraceparent(t.chain.JobChain.Traceparent)
+	t.span = trace.StartSpan("chain", parent)
+	t.span.Attributes["requestId"] = fmt.Sprintf("%d", t.chain.RequestId())
+	defer func() {
+		t.span.Attributes["state"] = proto.StateName[t.chain.State()]
+		t.span.Finish(Tracer)
+	}()
+
+	// Warn if the chain runs much longer than it's expected to, which usually
+	// means something it depends on is degraded. The chain keeps running.
+	if d := overrunAfter(t.chain.JobChain); d > 0 {
+		timer := time.AfterFunc(d, t.warnOverrun)
+		defer timer.Stop()
+	}
 
 	// Start a goroutine to run jobs. This consumes from the runJobChan. When
 	// jobs are done, they will be sent to the doneJobChan, which gets consumed
 	// from right below this.
+	t.runJobsDone = make(chan struct{})
 	go t.runJobs()
 
-	// Set the state of the first job in the chain to RUNNING.
-	t.chain.SetJobState(firstJob.Name, proto.STATE_RUNNING)
-	t.chainRepo.Set(t.chain)
+	// Set the state of the first job in the chain to RUNNING, or of the
+	// jobs it's retried from.
+	for _, job := range startJobs {
+		t.setJobState(job.Name, proto.STATE_RUNNING)
+	}
+	t.save()
+
+	// Add the first jobs to the runJobChan.
+	for _, job := range startJobs {
+		log.Infof("[chain=%d]: Sending the first job (%s) to runJobChan.",
+			t.chain.RequestId(), job.Name)
+		t.runJobChan <- job
+	}
+	running := len(startJobs) // number of jobs sent to runJobChan and not done yet
 
-	// Add the first job in the chain to the runJobChan.
-	log.Infof("[chain=%d]: Sending the first job (%s) to runJobChan.",
-		t.chain.RequestId(), firstJob.Name)
-	t.runJobChan <- firstJob
+	// Reference count the jobData of completed jobs so it's released once
+	// all of their next jobs have completed.
+	dataRefs := newJobDataRefs(t.chain)
+
+	// Names of completed jobs, in the order they completed, for rollback.
+	// Jobs that completed before the chain was retried are in the order
+	// they could have run.
+	completed := []string{}
+	for _, step := range t.chain.steps() {
+		for _, name := range step {
+			if t.chain.JobState(name) == proto.STATE_COMPLETE {
+				completed = append(completed, name)
+			}
+		}
+	}
+
+	// Sequences that are retried as a whole when one of their jobs fails.
+	sequences := newSequenceRetries(t.chain)
+	t.sequences = sequences
+	for _, job := range startJobs {
+		sequences.Enqueued(job)
+	}
+
+	// Heartbeat while waiting for jobs to finish so that Status can tell if
+	// this loop is wedged.
+	t.beat()
+	defer t.stopBeating()
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	// Retry saving the chain while the repo is unavailable, even if no job
+	// is done for a while.
+	repoTicker := time.NewTicker(RepoRetryInterval)
+	defer repoTicker.Stop()
+
+	// Checkpoint the chain's jobData while jobs run, even if no job is done
+	// for a long time.
+	var checkpointChan <-chan time.Time
+	if CheckpointInterval > 0 {
+		checkpointTicker := time.NewTicker(CheckpointInterval)
+		defer checkpointTicker.Stop()
+		checkpointChan = checkpointTicker.C
+	}
 
 	// When a job finishes, update the state of the chain and figure out what
 	// to do next (check to see if the entire chain is done running, and
 	// enqueue the next jobs if there are any).
-	for job := range t.doneJobChan {
+	for {
+		var job proto.Job
+		select {
+		case job = <-t.doneJobChan:
+		case <-ticker.C:
+			t.beat()
+			continue
+		case <-repoTicker.C:
+			if t.isDegraded() {
+				t.save()
+			}
+			continue
+		case <-checkpointChan:
+			t.checkpoint()
+			continue
+		}
+		t.beat()
+		running--
+
 		// Set the final state of the job in the chain.
-		t.chain.SetJobState(job.Name, job.State)
-		t.chainRepo.Set(t.chain)
+		t.setJobState(job.Name, job.State)
+		t.save()
+
+		// If a job goroutine panicked, the chain is quarantined once all
+		// running jobs are done. No more jobs start because it's halted.
+		if t.quarantined() {
+			if running == 0 {
+				t.closeRunJobs()
+				dataRefs.ReleaseAll()
+				t.finishReport()
+				t.events.Close()
+				return ErrQuarantined
+			}
+			continue
+		}
+
+		if job.State == proto.STATE_COMPLETE {
+			dataRefs.Completed(job)
+			completed = append(completed, job.Name)
+			t.chain.SetRollbackData(job)
+		}
+
+		// If the job's sequence failed and will be retried, its next jobs
+		// aren't enqueued. Once no job in the sequence is running, the
+		// sequence runs again from its first job. Sequences aren't retried
+		// once the chain is stopped.
+		if t.stopped() {
+			for _, held := range sequences.Release() {
+				running += t.enqueueNextJobs(held, held)
+			}
+		}
+		if !t.stopped() && sequences.Done(job) {
+			if jobs, first, ok := sequences.Reset(job.Sequence); ok {
+				log.Infof("[chain=%d,job=%s]: Sequence %s failed, retrying it from job %s (retry %d of %d).",
+					t.chain.RequestId(), job.Name, job.Sequence, first.Name,
+					sequences.Tries(job.Sequence), t.chain.JobChain.SequenceRetries[job.Sequence])
+				completed = removeJobs(completed, jobs)
+				dataRefs.Reset(jobs)
+				for _, name := range jobs {
+					t.runnerRepo.Remove(name) // failed runners, so they can run again
+					t.publish(name, proto.STATE_PENDING)
+				}
+				t.save()
+				if !t.suspended() {
+					t.setJobState(first.Name, proto.STATE_RUNNING)
+					t.runJobChan <- first
+					running++
+				}
+			}
+		} else {
+			// Once a job is done, its next jobs that are ready are enqueued, and
+			// its next jobs that will never run (no edge to them was taken) are
+			// skipped. Without edge conditions, next jobs are only ready when
+			// the job completed successfully.
+			switch job.State {
+			case proto.STATE_COMPLETE, proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED,
+				proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
+				running += t.enqueueNextJobs(job, job)
+			default:
+				log.Infof("[chain=%d,job=%s]: Job is %s, so not enqueuing its next jobs.",
+					t.chain.RequestId(), job.Name, proto.StateName[job.State])
+			}
+		}
 
 		// Check to see if the entire chain is done. If it is, break out of
 		// the loop on doneJobChan because there is no more work for us to do.
 		//
 		// A chain is done if no more jobs in it can run. A chain is
-		// complete if every job in it completed successfully.
+		// complete if every job in it completed successfully or was skipped.
 		done, complete := t.chain.IsDone()
 		if done {
-			close(t.runJobChan)
+			t.closeRunJobs()
 			if complete {
+				dataRefs.ReleaseAll()
 				log.Infof("[chain=%d]: Chain is done, all jobs finished successfully.", t.chain.RequestId())
 				t.chain.SetComplete()
 			} else {
+				// The jobData is kept so the chain can be retried from
+				// the jobs that failed (see chain.ResetFailed).
+				dataRefs.Keep()
 				log.Infof("[chain=%d]: Chain is done, some jobs failed.", t.chain.RequestId())
+				t.rollback(completed)
+				if t.quarantined() {
+					t.finishReport()
+					t.events.Close()
+					return ErrQuarantined // a rollback job goroutine panicked
+				}
 				t.chain.SetIncomplete()
 			}
+			t.publish("", t.chain.State())
+			t.finishReport()
+			t.hooks.OnChainDone(t.chain.Snapshot())
+			if report, ok := t.chain.Report(); ok {
+				recordMetrics(report)
+			}
+			t.events.Close()
 			break
 		}
 
-		// If the job completed successfully, add its next jobs to
-		// runJobChan. If it didn't complete successfully, do nothing.
-		// Also, pass a copy of the job's jobData to all next jobs.
-		//
-		// It is important to note that when a job has multiple parent
-		// jobs, it will get its jobData from whichever parent finishes
-		// last. Therefore, a job should never rely on jobData that was
-		// created during an unrelated sequence at any time earlier in
-		// the chain.
-		switch job.State {
-		case proto.STATE_COMPLETE:
-			for _, nextJob := range t.chain.NextJobs(job.Name) {
-				// Check to make sure the job is ready to run.
-				if t.chain.JobIsReady(nextJob.Name) {
-					log.Infof("[chain=%d,job=%s]: Next job %s is ready to run. Enqueuing it.",
-						t.chain.RequestId(), job.Name, nextJob.Name)
-					// Set the state of the job in the chain to "Running".
-					t.chain.SetJobState(nextJob.Name, proto.STATE_RUNNING)
-
-					// Copy the jobData from the job that just finished to the next job.
-					for k, v := range job.Data {
-						nextJob.Data[k] = v
-					}
-
-					t.runJobChan <- nextJob // add the job to the run queue
-				} else {
-					log.Infof("[chain=%d,job=%s]: Next job %s is not ready to run. "+
-						"Not enqueuing it.", t.chain.RequestId(), job.Name, nextJob.Name)
-				}
-			}
-		default:
-			log.Infof("[chain=%d,job=%s]: Job did not complete successfully, so not "+
-				"enqueuing its next jobs.", t.chain.RequestId(), job.Name)
+		// If the traverser is suspended, the chain is suspended once all
+		// running jobs are done.
+		if running == 0 && t.suspended() {
+			t.closeRunJobs()
+			dataRefs.Keep() // the chain's next jobs need it when it's resumed
+			log.Infof("[chain=%d]: Chain is suspended, no jobs are running.", t.chain.RequestId())
+			t.chain.SetSuspended()
+			t.save()
+			t.publish("", proto.STATE_SUSPENDED)
+			t.finishReport()
+			t.hooks.OnChainDone(t.chain.Snapshot())
+			t.events.Close()
+			break
 		}
 	}
 
 	return nil
 }
 
-// Stop stops the traverser if it's running.
-func (t *traverser) Stop() error {
-	log.Infof("[chain=%d]: Stopping the traverser and all jobs.", t.chain.RequestId())
+// Stop stops the traverser if it's running. Only the first call stops it;
+// later calls, like a stop racing stop-all, wait for it to stop and return nil.
+func (t *traverser) Stop(grace time.Duration, stop proto.StopInfo) error {
+	// Stop the traverser (i.e., stop running new jobs or retrying failed
+	// ones). This must happen before stopping the runners in the repo,
+	// else a job could be retried with a new runner that is never stopped.
+	first := false
+	t.stopOnce.Do(func() {
+		close(t.stopChan)
+		first = true
+	})
+	if !first {
+		log.Infof("[chain=%d]: Traverser is already stopping (requester: %s).", t.chain.RequestId(), stop.Requester)
+		if state := t.chain.State(); state == proto.STATE_RUNNING || state == proto.STATE_ROLLING_BACK {
+			<-t.doneChan
+		}
+		return nil
+	}
+	log.Infof("[chain=%d]: Stopping the traverser and all jobs (requester: %s, reason: %s).",
+		t.chain.RequestId(), stop.Requester, stop.Reason)
+	t.halt()
+	stop.Time = now()
+	t.chain.SetStopped(stop)
+	t.report.Intervention(proto.INTERVENTION_STOP, stop.Requester, stop.Reason)
 
 	// Get all of the runners for this traverser from the repo. Only runners that are
 	// in the repo will be stopped.
@@ -189,19 +602,68 @@ func (t *traverser) Stop() error {
 		return err
 	}
 
-	// Call Stop on each runner, and then remove it from the repo.
+	// Call Stop on each runner, and then remove it from the repo. Runners are
+	// stopped in parallel because a job that doesn't stop quickly would block
+	// stopping the others.
 	for jobName, runner := range activeRunners {
-		runner.Stop() // this should return quickly
+		go runner.Stop(grace)
 		t.runnerRepo.Remove(jobName)
 	}
 
-	// Stop the traverser (i.e., stop running new jobs).
-	close(t.stopChan)
+	// Wait for the jobs to stop or be force-killed and Run to return. That
+	// takes at most about grace because runners don't wait for jobs longer.
+	// A chain that isn't running is saved now so who stopped it is kept; one
+	// that is running is saved when Run returns.
+	if state := t.chain.State(); state != proto.STATE_RUNNING && state != proto.STATE_ROLLING_BACK {
+		t.save()
+		return nil
+	}
+	<-t.doneChan
+
+	forceKilled := []string{}
+	for jobName := range activeRunners {
+		if t.chain.JobState(jobName) == proto.STATE_FORCE_KILLED {
+			forceKilled = append(forceKilled, jobName)
+		}
+	}
+	if len(forceKilled) > 0 {
+		sort.Strings(forceKilled)
+		log.Errorf("[chain=%d]: Jobs did not stop within %s and were abandoned: %s.",
+			t.chain.RequestId(), grace, strings.Join(forceKilled, ", "))
+		return ErrJobsForceKilled
+	}
 	return nil
 }
 
+// Suspend suspends the traverser at the next job boundary.
+func (t *traverser) Suspend() proto.SuspendedJobChain {
+	log.Infof("[chain=%d]: Suspending the traverser.", t.chain.RequestId())
+	t.suspendOnce.Do(func() {
+		close(t.suspendChan)
+		t.report.Intervention(proto.INTERVENTION_SUSPEND, "", "")
+	})
+	t.halt()
+
+	if t.chain.SuspendPending() {
+		log.Infof("[chain=%d]: Chain is suspended, it was not started.", t.chain.RequestId())
+		t.save()
+		t.publish("", proto.STATE_SUSPENDED)
+		t.events.Close()
+	} else if state := t.chain.State(); state == proto.STATE_RUNNING || state == proto.STATE_ROLLING_BACK {
+		// Wait for running jobs to finish and Run to return.
+		<-t.doneChan
+	}
+
+	jc := t.chain.Snapshot()
+	return proto.SuspendedJobChain{
+		RequestId:     jc.RequestId,
+		JobChain:      &jc,
+		SuspendedTime: now(),
+	}
+}
+
 // Status returns the status of currently running jobs in the chain.
-func (t *traverser) Status() (proto.JobChainStatus, error) {
+func (t *traverser) Status(ctx context.Context) (proto.JobChainStatus, error) {
 	log.Infof("[chain=%d]: Getting the status of all running jobs.", t.chain.RequestId())
 	var jobChainStatus proto.JobChainStatus
 	var jobStatuses []proto.JobStatus
@@ -214,79 +676,889 @@ func (t *traverser) Status() (proto.JobChainStatus, error) {
 	}
 
 	// Get the Status of each runner, as well as the state of the job it represents.
+	serverTime := now()
 	for jobName, runner := range activeRunners {
+		if err := ctx.Err(); err != nil {
+			return jobChainStatus, err
+		}
 		jobStatus := proto.JobStatus{
-			Name:   jobName,
-			Status: runner.Status(),           // get the job status. this should return quickly
-			State:  t.chain.JobState(jobName), // get the state of the job
+			Name:      jobName,
+			Status:    runner.Status(),                // get the job status. this should return quickly
+			State:     t.chain.JobState(jobName),      // get the state of the job
+			Rollback:  t.chain.IsRollbackJob(jobName), // rollback progress, not forward progress
+			StartTime: t.report.JobStartTime(jobName), // first try, not the current try
+			Progress:  runner.Progress(),
+
+			TryHistory: t.report.JobTries(jobName),
+		}
+		if !jobStatus.StartTime.IsZero() {
+			jobStatus.Elapsed = serverTime.Sub(jobStatus.StartTime).String()
 		}
 		jobStatuses = append(jobStatuses, jobStatus)
 	}
 
-	return proto.JobChainStatus{
+	jobChainStatus = proto.JobChainStatus{
 		RequestId:   t.chain.RequestId(),
 		JobStatuses: jobStatuses,
+		Metadata:    t.chain.JobChain.Metadata,
+		ServerTime:  serverTime,
+		Stopped:     t.chain.Stopped(),
+	}
+
+	// The heartbeat is zero if Run isn't running, so it can't be wedged.
+	t.heartbeatMux.Lock()
+	heartbeat := t.heartbeat
+	t.heartbeatMux.Unlock()
+	if !heartbeat.IsZero() {
+		age := jobChainStatus.ServerTime.Sub(heartbeat)
+		jobChainStatus.HeartbeatAge = age.String()
+		if age > StaleHeartbeatAge {
+			log.Warnf("[chain=%d]: Traverser heartbeat is %s old, it might be wedged.", t.chain.RequestId(), age)
+			jobChainStatus.Stale = true
+		}
+	}
+
+	t.overrunMux.Lock()
+	jobChainStatus.Overrun = t.overrun
+	t.overrunMux.Unlock()
+
+	t.repoMux.Lock()
+	jobChainStatus.Degraded = t.degraded
+	if len(t.repoGaps) > 0 {
+		jobChainStatus.RepoGaps = make([]proto.RepoGap, len(t.repoGaps))
+		copy(jobChainStatus.RepoGaps, t.repoGaps)
+	}
+	t.repoMux.Unlock()
+
+	return jobChainStatus, nil
+}
+
+// Log returns the log output of a running or failed job in the chain, or of a
+// try of a job that failed.
+func (t *traverser) Log(jobName string, try uint) (*runner.Log, error) {
+	if try > 0 {
+		t.tryLogsMux.Lock()
+		defer t.tryLogsMux.Unlock()
+		if l, ok := t.tryLogs[jobName][try]; ok {
+			return l, nil
+		}
+		return nil, fmt.Errorf("no log of try %d of job %s, only tries that failed have one", try, jobName)
+	}
+	jr, err := t.runnerRepo.Get(jobName)
+	if err != nil {
+		return nil, err
+	}
+	return jr.Log(), nil
+}
+
+// Explain returns the reasons a job in the chain hasn't started running.
+func (t *traverser) Explain(jobName string) (proto.JobExplanation, error) {
+	if _, err := t.chain.Job(jobName); err != nil {
+		return proto.JobExplanation{}, err
+	}
+
+	exp := proto.JobExplanation{
+		RequestId: t.chain.RequestId(),
+		Name:      jobName,
+		State:     t.chain.JobState(jobName),
+		Blockers:  []proto.JobBlocker{},
+	}
+
+	// A "running" job might still be waiting for a slot to run. Nothing else
+	// blocks a job that has already started.
+	switch exp.State {
+	case proto.STATE_RUNNING:
+		t.waitingMux.Lock()
+		reason, ok := t.waiting[jobName]
+		t.waitingMux.Unlock()
+		switch {
+		case !ok:
+		case reason == proto.BLOCKED_CHAIN_CONCURRENCY_LIMIT:
+			exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+				Reason:  reason,
+				Message: fmt.Sprintf("chain is using its max of %d job slots at once", t.chain.JobChain.MaxConcurrentJobs),
+			})
+		case reason == proto.BLOCKED_REPO_UNAVAILABLE:
+			exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+				Reason:  reason,
+				Message: "chain can't be saved to the chain repo, jobs start once it can",
+			})
+		default:
+			exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+				Reason:  reason,
+				Message: "Job Runner is using its max number of job slots at once",
+			})
+		}
+		return exp, nil
+	case proto.STATE_COMPLETE, proto.STATE_FAIL, proto.STATE_TIMEOUT, proto.STATE_STALLED, proto.STATE_SKIPPED,
+		proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
+		return exp, nil
+	}
+
+	select {
+	case <-t.stopChan:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_STOPPED,
+			Message: "chain was stopped",
+		})
+	default:
+	}
+
+	switch t.chain.State() {
+	case proto.STATE_UNKNOWN, proto.STATE_PENDING:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_NOT_STARTED,
+			Message: "chain has not been started",
+		})
+	case proto.STATE_COMPLETE, proto.STATE_INCOMPLETE:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_DONE,
+			Message: "chain is done running, job will not run",
+		})
+	case proto.STATE_ROLLING_BACK:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_DONE,
+			Message: "chain failed and is rolling back, job will not run",
+		})
+	case proto.STATE_SUSPENDED:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_SUSPENDED,
+			Message: "chain was suspended, job will run when the chain is resumed",
+		})
+	case proto.STATE_QUARANTINED:
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_CHAIN_QUARANTINED,
+			Message: "traverser panicked and the chain is quarantined, job will not run until the chain is recovered",
+		})
+	}
+
+	prevJobs := t.chain.PreviousJobs(jobName)
+	sort.Sort(prevJobs)
+	for _, prevJob := range prevJobs {
+		state := t.chain.JobState(prevJob.Name)
+		if state == proto.STATE_COMPLETE {
+			continue
+		}
+		exp.Blockers = append(exp.Blockers, proto.JobBlocker{
+			Reason:  proto.BLOCKED_DEPENDENCY,
+			Message: fmt.Sprintf("previous job %s is %s", prevJob.Name, proto.StateName[state]),
+			Job:     prevJob.Name,
+			State:   state,
+		})
+	}
+
+	return exp, nil
+}
+
+// Subscribe subscribes to job and chain state changes.
+func (t *traverser) Subscribe() (<-chan proto.JobChainEvent, func()) {
+	return t.events.Subscribe()
+}
+
+// Recover makes a quarantined chain resumable once Run has returned.
+func (t *traverser) Recover() (proto.SuspendedJobChain, error) {
+	if !t.quarantined() {
+		return proto.SuspendedJobChain{}, ErrNotQuarantined
+	}
+	select {
+	case <-t.doneChan:
+	default:
+		return proto.SuspendedJobChain{}, ErrNotQuarantined // jobs still running
+	}
+	if !t.chain.SetRecovered() {
+		return proto.SuspendedJobChain{}, ErrNotQuarantined // already recovered
+	}
+	log.Infof("[chain=%d]: Recovered the quarantined chain, it's suspended.", t.chain.RequestId())
+	t.save()
+
+	jc := t.chain.Snapshot()
+	return proto.SuspendedJobChain{
+		RequestId:     jc.RequestId,
+		JobChain:      &jc,
+		SuspendedTime: now(),
 	}, nil
 }
 
 // -------------------------------------------------------------------------- //
 
+// enqueueNextJobs enqueues the next jobs of a job that is done if they are ready
+// to run, and it skips the next jobs that will never run, recursively skipping
+// or enqueuing their next jobs too. The jobData of the previous jobs of a next
+// job is merged into its jobData (see mergeJobData). from is the job that
+// finished. It returns the number of jobs enqueued.
+func (t *traverser) enqueueNextJobs(job, from proto.Job) int {
+	enqueued := 0
+	for _, nextJob := range t.chain.NextJobs(job.Name) {
+		if nextJob.State != proto.STATE_PENDING {
+			continue // already enqueued or skipped through another job
+		}
+
+		if t.chain.JobIsSkipped(nextJob.Name) {
+			log.Infof("[chain=%d,job=%s]: Next job %s will never run (no edge to it was taken). "+
+				"Skipping it.", t.chain.RequestId(), job.Name, nextJob.Name)
+			t.setJobState(nextJob.Name, proto.STATE_SKIPPED)
+			nextJob.State = proto.STATE_SKIPPED
+			enqueued += t.enqueueNextJobs(nextJob, from)
+			continue
+		}
+
+		if !t.chain.JobIsReady(nextJob.Name) {
+			log.Infof("[chain=%d,job=%s]: Next job %s is not ready to run. "+
+				"Not enqueuing it.", t.chain.RequestId(), job.Name, nextJob.Name)
+			continue
+		}
+
+		// Merge the jobData of the previous jobs into the next job.
+		t.mergeJobData(nextJob, from)
+		t.sequences.Enqueued(nextJob)
+
+		// Don't start new jobs if the traverser is suspended. The
+		// job stays pending and runs when the chain is resumed.
+		if t.suspended() {
+			log.Infof("[chain=%d,job=%s]: Next job %s is ready to run, but the "+
+				"traverser is suspended. Not enqueuing it.", t.chain.RequestId(), job.Name, nextJob.Name)
+			continue
+		}
+
+		log.Infof("[chain=%d,job=%s]: Next job %s is ready to run. Enqueuing it.",
+			t.chain.RequestId(), job.Name, nextJob.Name)
+		// Set the state of the job in the chain to "Running".
+		t.setJobState(nextJob.Name, proto.STATE_RUNNING)
+
+		t.runJobChan <- nextJob // add the job to the run queue
+		enqueued++
+	}
+	return enqueued
+}
+
+// rollback runs the chain's rollback jobs after it failed, given the names of
+// the jobs that completed in the order they completed. Rollback jobs run one
+// at a time, in reverse order, so each job is undone before the jobs it
+// depended on. Rollback stops at the first rollback job that doesn't complete
+// because the jobs before it might depend on it being undone. Nothing is
+// rolled back if the traverser was stopped or suspended.
+func (t *traverser) rollback(completed []string) {
+	select {
+	case <-t.haltChan:
+		log.Infof("[chain=%d]: Traverser was stopped or suspended. Not rolling back.", t.chain.RequestId())
+		return
+	default:
+	}
+
+	rollbackJobs := t.chain.RollbackJobs(completed)
+	if len(rollbackJobs) == 0 {
+		return
+	}
+
+	log.Infof("[chain=%d]: Rolling back the chain (%d rollback jobs).", t.chain.RequestId(), len(rollbackJobs))
+	t.chain.SetRollingBack()
+	t.save()
+	t.publish("", proto.STATE_ROLLING_BACK)
+
+	for _, job := range rollbackJobs {
+		log.Infof("[chain=%d,job=%s]: Running rollback job.", t.chain.RequestId(), job.Name)
+		t.setJobState(job.Name, proto.STATE_RUNNING)
+		state := t.runRollbackJob(job)
+		t.report.JobDone(job.Name)
+		job.State = state
+		t.hooks.OnJobDone(t.chain.RequestId(), job)
+		t.setJobState(job.Name, state)
+		t.save()
+		if state != proto.STATE_COMPLETE {
+			log.Errorf("[chain=%d,job=%s]: Rollback job is %s. Not running the remaining rollback jobs.",
+				t.chain.RequestId(), job.Name, proto.StateName[state])
+			return
+		}
+	}
+}
+
+// mergeJobData merges the jobData of the previous jobs of a job that is ready
+// to run into its jobData, so it gets the outputs of all sequences that led to
+// it. from, the job that finished and made the job ready, is merged last, so
+// its values win if previous jobs set the same key; other previous jobs are
+// merged in order of job name. Since a skipped job never runs, from is
+// merged even if it's not a previous job.
+//
+// A job should never rely on jobData that was created during an unrelated
+// sequence earlier in the chain; its jobData might be released by then.
+func (t *traverser) mergeJobData(job, from proto.Job) {
+	prevJobs := t.chain.PreviousJobs(job.Name)
+	sort.Sort(prevJobs)
+	for _, prevJob := range prevJobs {
+		if prevJob.Name == from.Name || prevJob.State != proto.STATE_COMPLETE {
+			continue
+		}
+		for k, v := range prevJob.Data {
+			job.Data[k] = v
+		}
+	}
+	for k, v := range from.Data {
+		job.Data[k] = v
+	}
+}
+
+// beat records a heartbeat of the Run loop.
+func (t *traverser) beat() {
+	t.heartbeatMux.Lock()
+	t.heartbeat = now()
+	t.heartbeatMux.Unlock()
+}
+
+// stopBeating clears the heartbeat when Run returns.
+func (t *traverser) stopBeating() {
+	t.heartbeatMux.Lock()
+	t.heartbeat = time.Time{}
+	t.heartbeatMux.Unlock()
+}
+
+// runRollbackJob runs a rollback job and returns its final state. Rollback
+// jobs run in the Run loop, so it heartbeats while the job runs.
+func (t *traverser) runRollbackJob(job proto.Job) byte {
+	stateChan := make(chan byte, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				t.quarantine(v, debug.Stack())
+				stateChan <- proto.STATE_FAIL
+			}
+		}()
+		stateChan <- t.runJob(job)
+	}()
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case state := <-stateChan:
+			return state
+		case <-ticker.C:
+			t.beat()
+		}
+	}
+}
+
+// halt makes jobs waiting to run stop waiting. It's called when the traverser
+// is stopped, suspended, or quarantined.
+func (t *traverser) halt() {
+	t.haltOnce.Do(func() { close(t.haltChan) })
+}
+
+// suspended returns true if the traverser was suspended.
+func (t *traverser) suspended() bool {
+	select {
+	case <-t.suspendChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopped returns true if the traverser was stopped.
+func (t *traverser) stopped() bool {
+	select {
+	case <-t.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// haltedState returns the state of a job that was not run because the
+// traverser was halted: FAIL if it was stopped, else PENDING because it was
+// suspended and the job will run when the chain is resumed.
+func (t *traverser) haltedState() byte {
+	select {
+	case <-t.stopChan:
+		return proto.STATE_FAIL
+	default:
+		return proto.STATE_PENDING
+	}
+}
+
+// setJobState sets the state of a job in the chain and publishes the change.
+func (t *traverser) setJobState(jobName string, state byte) {
+	t.chain.SetJobState(jobName, state)
+	t.publish(jobName, state)
+}
+
+// publish publishes a state change of a job, or of the chain if jobName is
+// empty, and records it for the final report.
+func (t *traverser) publish(jobName string, state byte) {
+	event := proto.JobChainEvent{
+		RequestId: t.chain.RequestId(),
+		Job:       jobName,
+		State:     state,
+		Time:      now(),
+	}
+	t.report.Event(event)
+	t.events.Publish(event)
+}
+
+// warnOverrun warns that the chain is overrunning its expected duration. It's
+// called once, by a timer started by Run.
+func (t *traverser) warnOverrun() {
+	t.overrunMux.Lock()
+	t.overrun = true
+	t.overrunMux.Unlock()
+
+	elapsed := now().Sub(t.chain.JobChain.StartTime).Round(time.Second)
+	warning := fmt.Sprintf("chain has run %s, expected to run %s", elapsed, t.chain.JobChain.ExpectedDuration)
+	log.Warnf("[chain=%d]: Chain is overrunning: %s.", t.chain.RequestId(), warning)
+	event := proto.JobChainEvent{
+		RequestId: t.chain.RequestId(),
+		State:     t.chain.State(),
+		Time:      now(),
+		Warning:   warning,
+	}
+	t.report.Event(event)
+	t.events.Publish(event)
+}
+
+// warnDivergence sends an event with a warning that the mirrors of a job
+// diverged, whether the job failed or the divergence was only flagged.
+func (t *traverser) warnDivergence(jobName string, state byte, divergence string) {
+	event := proto.JobChainEvent{
+		RequestId: t.chain.RequestId(),
+		Job:       jobName,
+		State:     state,
+		Time:      now(),
+		Warning:   "mirrors diverged: " + divergence,
+	}
+	t.report.Event(event)
+	t.events.Publish(event)
+}
+
+// save saves the chain to the chain repo. If that fails, the chain is degraded:
+// the traverser logs an error, sends an event with a warning, and records a gap
+// in the chain's history in the repo until a write succeeds. It returns false
+// if the chain wasn't saved.
+func (t *traverser) save() bool {
+	err := t.chainRepo.Set(t.chain)
+
+	t.repoMux.Lock()
+	if err == nil && !t.degraded {
+		t.repoMux.Unlock()
+		return true
+	}
+	var warning string
+	if err != nil {
+		if !t.degraded {
+			t.degraded = true
+			t.repoGaps = append(t.repoGaps, proto.RepoGap{Start: now()})
+			warning = fmt.Sprintf("chain can't be saved to the chain repo (policy: %s): %s", RepoFailurePolicy, err)
+			log.Errorf("[chain=%d]: Error saving the chain, it's degraded until it's saved (policy: %s) (error: %s).",
+				t.chain.RequestId(), RepoFailurePolicy, err)
+		}
+		gap := &t.repoGaps[len(t.repoGaps)-1]
+		gap.FailedWrites++
+		gap.Error = err.Error()
+	} else {
+		t.degraded = false
+		gap := &t.repoGaps[len(t.repoGaps)-1]
+		gap.End = now()
+		warning = fmt.Sprintf("chain is saved to the chain repo again after %d failed writes since %s",
+			gap.FailedWrites, gap.Start.Format(time.RFC3339))
+		log.Warnf("[chain=%d]: Chain is saved again after %d failed writes in %s.",
+			t.chain.RequestId(), gap.FailedWrites, gap.End.Sub(gap.Start).Round(time.Millisecond))
+	}
+	t.repoMux.Unlock()
+
+	if warning != "" {
+		event := proto.JobChainEvent{
+			RequestId: t.chain.RequestId(),
+			State:     t.chain.State(),
+			Time:      now(),
+			Warning:   warning,
+		}
+		t.report.Event(event)
+		t.events.Publish(event)
+	}
+	return err == nil
+}
+
+// checkpoint saves a checkpoint of the jobData of the chain's jobs. The jobData
+// of a running job is being written by the job, so it's not read: it's the
+// job's jobData at the last checkpoint, plus what the job checkpoints itself
+// if its runner is a runner.Checkpointer. The jobData of other jobs is only
+// changed by the Run loop, which calls this.
+func (t *traverser) checkpoint() {
+	last := t.chain.LastCheckpoint()
+	cp := &checkpoint{
+		Time:    now(),
+		JobData: map[string]map[string]interface{}{},
+	}
+	for name, job := range t.chain.Snapshot().Jobs {
+		var data map[string]interface{}
+		if job.State != proto.STATE_RUNNING {
+			data = copyJobData(job.Data)
+		} else {
+			if last != nil {
+				data = last.JobData[name]
+			}
+			if jr, err := t.runnerRepo.Get(name); err == nil {
+				if c, ok := jr.(runner.Checkpointer); ok {
+					if set, ok := c.Checkpoint(); ok {
+						data = copyJobData(data)
+						for k, v := range set {
+							data[k] = v
+						}
+					}
+				}
+			}
+		}
+		if len(data) > 0 {
+			cp.JobData[name] = data
+		}
+	}
+	t.chain.SetCheckpoint(cp)
+	t.save()
+}
+
+// isDegraded returns true if the chain can't be saved to the chain repo.
+func (t *traverser) isDegraded() bool {
+	t.repoMux.Lock()
+	defer t.repoMux.Unlock()
+	return t.degraded
+}
+
+// waitRepo waits to run a job until the chain can be saved, if the chain is
+// degraded and RepoFailurePolicy is REPO_FAILURE_PAUSE. It returns false if the
+// traverser is stopped or suspended while waiting.
+func (t *traverser) waitRepo(j proto.Job) bool {
+	if RepoFailurePolicy != REPO_FAILURE_PAUSE || !t.isDegraded() {
+		return true
+	}
+	t.setWaiting(j.Name, proto.BLOCKED_REPO_UNAVAILABLE)
+	defer t.setWaiting(j.Name, "")
+	for {
+		select {
+		case <-t.haltChan:
+			return false
+		case <-time.After(RepoRetryInterval):
+		}
+		if t.save() {
+			return true
+		}
+	}
+}
+
+// quarantine quarantines the chain because the traverser panicked: it's halted,
+// so no more jobs start, and its state is QUARANTINED with the panic and its
+// stack trace, which are saved, logged, and sent as an event with a warning so
+// operators are notified. Only the first panic is recorded.
+func (t *traverser) quarantine(v interface{}, stack []byte) {
+	t.quarantineOnce.Do(func() {
+		q := proto.Quarantine{
+			Time:  now(),
+			Panic: fmt.Sprint(v),
+			Stack: string(stack),
+		}
+		log.Errorf("[chain=%d]: Traverser panicked, quarantining the chain: %s\n%s", t.chain.RequestId(), q.Panic, q.Stack)
+		quarantinedChains.Add(1)
+		close(t.quarantineChan)
+		t.halt()
+		t.chain.SetQuarantined(q)
+		t.save()
+		event := proto.JobChainEvent{
+			RequestId: t.chain.RequestId(),
+			State:     proto.STATE_QUARANTINED,
+			Time:      now(),
+			Warning:   "traverser panicked, chain is quarantined: " + q.Panic,
+		}
+		t.report.Event(event)
+		t.events.Publish(event)
+	})
+}
+
+// quarantined returns true if the chain was quarantined.
+func (t *traverser) quarantined() bool {
+	select {
+	case <-t.quarantineChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits for running jobs after Run panicked, saving their final state
+// because the Run loop no longer does.
+func (t *traverser) drain() {
+	t.closeRunJobs()
+	drained := make(chan struct{})
+	go func() {
+		if t.runJobsDone != nil {
+			<-t.runJobsDone
+		}
+		t.jobs.Wait()
+		close(drained)
+	}()
+	for {
+		select {
+		case job := <-t.doneJobChan:
+			t.setJobState(job.Name, job.State)
+			t.save()
+		case <-drained:
+			t.finishReport()
+			t.events.Close()
+			return
+		}
+	}
+}
+
+// closeRunJobs closes runJobChan, which makes runJobs return.
+func (t *traverser) closeRunJobs() {
+	t.runJobsOnce.Do(func() { close(t.runJobChan) })
+}
+
+// finishReport makes the final report of the chain and saves it with the
+// chain. It's called when the chain is done running or suspended.
+func (t *traverser) finishReport() {
+	report := t.report.Report(t.chain)
+	report.Spend = t.budget.Spend()
+	t.chain.SetReport(report)
+	t.save()
+}
+
 // runJobs loops on the runJobChannel and runs each job that comes through it in
 // a goroutine. When it is done, it sends the job out through the doneJobChannel.
 func (t *traverser) runJobs() {
+	defer close(t.runJobsDone)
 	for job := range t.runJobChan {
+		t.jobs.Add(1)
 		go func(j proto.Job) {
+			defer t.jobs.Done()
 			defer func() { t.doneJobChan <- j }() // send the job to doneJobChan when done
+			defer func() {
+				// The job's outcome is unknown, so it failed.
+				if v := recover(); v != nil {
+					t.quarantine(v, debug.Stack())
+					j.State = proto.STATE_FAIL
+				}
+			}()
+			j.State = t.runJob(j)
+			t.report.JobDone(j.Name)
+			t.hooks.OnJobDone(t.chain.RequestId(), j)
+		}(job)
+	}
+}
 
-			// Create a job runner.
-			jr, err := t.rf.Make(j.Type, j.Name, j.Bytes, t.chain.RequestId())
-			if err != nil {
-				log.Errorf("[chain=%d,job=%s]: Error creating runner (error: %s).",
-					t.chain.RequestId(), j.Name, err)
-				j.State = proto.STATE_FAIL
-				return
-			}
+// runJob runs a job, retrying it according to its retry policy until it
+// completes, it runs out of retries, or the traverser is stopped. It returns
+// the final state of the job.
+func (t *traverser) runJob(j proto.Job) byte {
+	for try := uint(1); ; try++ {
+		// Wait for a slot to run the job, after the chain can be saved if
+		// it's paused. The chain slot is acquired first so that a chain at
+		// its limit doesn't hold global slots.
+		if !t.waitRepo(j) || !t.acquire(j) {
+			log.Errorf("[chain=%d,job=%s]: Traverser was stopped or suspended. Bailing out before running.",
+				t.chain.RequestId(), j.Name)
+			return t.haltedState()
+		}
+		tryId, err := TryIdGenerator.UID()
+		if err != nil {
+			log.Errorf("[chain=%d,job=%s]: Error making try ID (error: %s).", t.chain.RequestId(), j.Name, err)
+		}
+		log.Infof("[chain=%d,job=%s]: Running try %d (id %s).", t.chain.RequestId(), j.Name, try, tryId)
+		t.report.JobTry(j.Name, tryId)
+		span := t.jobSpan(j, try, tryId)
+		j.Traceparent = span.Context.Traceparent()
+		j.Env = t.chain.JobChain.Env
+		t.hooks.OnJobStart(t.chain.RequestId(), j, try)
+		state, err := t.tryJob(j)
+		span.Attributes["state"] = proto.StateName[state]
+		span.Finish(Tracer)
+		t.release(j)
+		t.tryDone(j.Name, try, state, err)
+		switch state {
+		case proto.STATE_COMPLETE, proto.STATE_STOPPED, proto.STATE_FORCE_KILLED, proto.STATE_POLICY_VIOLATION:
+			// Jobs that were stopped or broke a policy are not retried.
+			return state
+		}
 
-			// Add the runner to the repo. Runners in the repo are used by the Status and
-			// methods on the traverser.
-			err = t.runnerRepo.Add(j.Name, jr)
-			if err != nil {
-				log.Errorf("[chain=%d,job=%s]: Error adding runner to the repo (error: %s).",
-					t.chain.RequestId(), j.Name, err)
-				j.State = proto.STATE_FAIL
-				return
-			}
+		// Errors before the job runs (e.g., making the runner) are not
+		// transient, so retrying the job won't help. The state is FAIL, or
+		// PENDING if the traverser was suspended before the job ran.
+		if err != nil {
+			return state
+		}
 
-			// Bail out if the traverser was stopped. It is important that we check this
-			// AFTER the runner is added to the repo, because traverser.Stop only stops
-			// runners in the repo. If we do not add this extra check, the following
-			// sequence would cause a problem: 1) runner A gets created, 2) traverser.Stop
-			// gets called, 3) runner A gets added to the repo, 4) runner A runs
-			// unbounded even though we want to stop the traverser.
-			select {
-			case <-t.stopChan:
-				log.Errorf("[chain=%d,job=%s]: stopChan was closed. Bailing out before running.",
-					t.chain.RequestId(), j.Name)
-				j.State = proto.STATE_FAIL
-				return
-			default:
+		// A job that timed out or stalled is retried like a job that failed,
+		// but if it runs out of retries its final state is STATE_TIMEOUT or
+		// STATE_STALLED.
+		if try > j.Retry {
+			if j.Retry > 0 {
+				log.Errorf("[chain=%d,job=%s]: Job failed on try %d, no retries left.",
+					t.chain.RequestId(), j.Name, try)
 			}
+			return state
+		}
 
-			// Run the job. This is a blocking operation that could take a long time.
-			completed := jr.Run(j.Data)
+		wait := RetryWait(j, try)
+		log.Infof("[chain=%d,job=%s]: Job failed on try %d, retrying in %s (%d of %d retries).",
+			t.chain.RequestId(), j.Name, try, wait, try, j.Retry)
+		select {
+		case <-t.haltChan:
+			log.Errorf("[chain=%d,job=%s]: Traverser was stopped or suspended. Not retrying the job.",
+				t.chain.RequestId(), j.Name)
+			t.runnerRepo.Remove(j.Name)
+			return t.haltedState()
+		case <-time.After(wait):
+		}
 
-			if completed {
-				j.State = proto.STATE_COMPLETE
+		// The failed runner is left in the repo for Status until the next
+		// try, which needs a new runner.
+		t.runnerRepo.Remove(j.Name)
+	}
+}
 
-				// Remove the runner from the repo.
-				//
-				// Since the runner repo is used by the traverser's Status method,
-				// and that method cares about failed runners, only remove from the
-				// repo if the runner completed (i.e., leave failed runners in it).
-				t.runnerRepo.Remove(j.Name)
-			} else {
-				j.State = proto.STATE_FAIL
-			}
-		}(job)
+// tryDone records that a try of a job is done. If it failed, the error is the
+// error running it or the last line of its log, and its log is kept so it can
+// be read after the job is retried.
+func (t *traverser) tryDone(jobName string, try uint, state byte, err error) {
+	var errMsg, logPath string
+	switch {
+	case err != nil:
+		errMsg = err.Error()
+	case state != proto.STATE_COMPLETE:
+		jr, err := t.runnerRepo.Get(jobName)
+		if err != nil {
+			break
+		}
+		errMsg = jr.Log().LastLine(MAX_TRY_ERROR_LENGTH)
+		t.tryLogsMux.Lock()
+		if t.tryLogs[jobName] == nil {
+			t.tryLogs[jobName] = make(map[uint]*runner.Log)
+		}
+		t.tryLogs[jobName][try] = jr.Log()
+		t.tryLogsMux.Unlock()
+		logPath = fmt.Sprintf("job-chains/%d/jobs/%s/log?try=%d", t.chain.RequestId(), url.PathEscape(jobName), try)
+	}
+	t.report.JobTryDone(jobName, state, errMsg, logPath)
+}
+
+// jobSpan starts the span of one try of a job, a child of the chain's span.
+func (t *traverser) jobSpan(j proto.Job, try uint, tryId string) *trace.Span {
+	var parent trace.SpanContext
+	if t.span != nil {
+		parent = t.span.Context
+	}
+	span := trace.StartSpan("job "+j.Name, parent)
+	span.Attributes["requestId"] = fmt.Sprintf("%d", t.chain.RequestId())
+	span.Attributes["job"] = j.Name
+	span.Attributes["type"] = j.Type
+	span.Attributes["try"] = fmt.Sprintf("%d", try)
+	span.Attributes["tryId"] = tryId
+	return span
+}
+
+// acquire acquires a slot from the chain and global limiters to run the job.
+// It returns false if the traverser is stopped or suspended while waiting.
+func (t *traverser) acquire(j proto.Job) bool {
+	t.setWaiting(j.Name, proto.BLOCKED_CHAIN_CONCURRENCY_LIMIT)
+	defer t.setWaiting(j.Name, "")
+	if !t.chainLimiter.Acquire(j, t.haltChan) {
+		return false
+	}
+
+	t.setWaiting(j.Name, proto.BLOCKED_CONCURRENCY_LIMIT)
+	if !t.globalLimiter.Acquire(j, t.haltChan) {
+		t.chainLimiter.Release(j)
+		return false
+	}
+
+	return true
+}
+
+// release releases the slots acquired to run the job.
+func (t *traverser) release(j proto.Job) {
+	t.globalLimiter.Release(j)
+	t.chainLimiter.Release(j)
+}
+
+// setWaiting sets why a job is waiting to run. An empty reason means it's not.
+func (t *traverser) setWaiting(jobName, reason string) {
+	t.waitingMux.Lock()
+	defer t.waitingMux.Unlock()
+	if reason == "" {
+		delete(t.waiting, jobName)
+	} else {
+		t.waiting[jobName] = reason
+	}
+}
+
+// tryJob makes a runner for the job and runs it once. It returns the final
+// state of the job (see runner.Runner.Run). A non-nil error is returned if the
+// job could not be run.
+func (t *traverser) tryJob(j proto.Job) (byte, error) {
+	// Create a job runner, or a runner for each mirror of a mirrored job.
+	jr, err := runner.MakeMirrors(t.rf, j, t.chain.RequestId())
+	if err != nil {
+		log.Errorf("[chain=%d,job=%s]: Error creating runner (error: %s).",
+			t.chain.RequestId(), j.Name, err)
+		return proto.STATE_FAIL, err
+	}
+
+	// Add the runner to the repo. Runners in the repo are used by the Status and
+	// methods on the traverser.
+	err = t.runnerRepo.Add(j.Name, jr)
+	if err != nil {
+		log.Errorf("[chain=%d,job=%s]: Error adding runner to the repo (error: %s).",
+			t.chain.RequestId(), j.Name, err)
+		return proto.STATE_FAIL, err
+	}
+
+	// Bail out if the traverser was stopped. It is important that we check this
+	// AFTER the runner is added to the repo, because traverser.Stop only stops
+	// runners in the repo. If we do not add this extra check, the following
+	// sequence would cause a problem: 1) runner A gets created, 2) traverser.Stop
+	// gets called, 3) runner A gets added to the repo, 4) runner A runs
+	// unbounded even though we want to stop the traverser.
+	select {
+	case <-t.haltChan:
+		log.Errorf("[chain=%d,job=%s]: Traverser was stopped or suspended. Bailing out before running.",
+			t.chain.RequestId(), j.Name)
+		if state := t.haltedState(); state == proto.STATE_PENDING {
+			t.runnerRepo.Remove(j.Name) // not run, so not failed
+			return state, ErrTraverserSuspended
+		}
+		return proto.STATE_FAIL, ErrTraverserStopped
+	default:
 	}
+
+	// Reserve the estimated cost of a job that has one. A job that would
+	// exceed the chain's budget is not run, and not retried.
+	estimate, hasCost := 0.0, false
+	if c, ok := jr.(runner.Coster); ok {
+		estimate, hasCost = c.EstimatedCost()
+	}
+	if hasCost {
+		if !t.budget.Reserve(j.Name, estimate) {
+			log.Errorf("[chain=%d,job=%s]: Not running the job, its estimated cost %g would exceed the chain's budget %g.",
+				t.chain.RequestId(), j.Name, estimate, t.budget.max)
+			t.runnerRepo.Remove(j.Name) // not run, so not failed
+			return proto.STATE_POLICY_VIOLATION, ErrOverBudget
+		}
+	}
+
+	// Run the job. This is a blocking operation that could take a long time.
+	state := jr.Run(j.Data)
+	if hasCost {
+		t.budget.Spent(estimate, jr.(runner.Coster).ActualCost())
+	}
+
+	if mr, ok := jr.(*runner.MirrorRunner); ok && mr.Divergence() != "" {
+		t.warnDivergence(j.Name, state, mr.Divergence())
+	}
+
+	if state == proto.STATE_COMPLETE {
+		// Remove the runner from the repo.
+		//
+		// Since the runner repo is used by the traverser's Status method,
+		// and that method cares about failed runners, only remove from the
+		// repo if the runner completed (i.e., leave failed runners in it).
+		t.runnerRepo.Remove(j.Name)
+	}
+
+	return state, nil
 }
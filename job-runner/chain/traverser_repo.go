@@ -15,6 +15,7 @@ var (
 type TraverserRepo interface {
 	Add(string, Traverser) error
 	Get(string) (Traverser, error)
+	GetAll() (map[string]Traverser, error)
 	Remove(string)
 }
 
@@ -46,6 +47,21 @@ func (r *traverserRepo) Get(requestId string) (Traverser, error) {
 	return traverser, nil
 }
 
+func (r *traverserRepo) GetAll() (map[string]Traverser, error) {
+	vals := r.Store.GetAll()
+
+	allTraversers := make(map[string]Traverser)
+	for requestId, val := range vals {
+		traverser, ok := val.(Traverser) // make sure we got a Traverser from the repo
+		if !ok {
+			return allTraversers, ErrInvalidTraverser
+		}
+		allTraversers[requestId] = traverser
+	}
+
+	return allTraversers, nil
+}
+
 func (r *traverserRepo) Remove(requestId string) {
 	r.Store.Delete(requestId)
 }
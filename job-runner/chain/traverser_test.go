@@ -3,12 +3,18 @@
 package chain
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/square/spincycle/proto"
 	"github.com/square/spincycle/test/mock"
+	"github.com/square/spincycle/trace"
 )
 
 var noJobData = map[string]interface{}{}
@@ -27,7 +33,7 @@ func TestRunErrorNoFirstJob(t *testing.T) {
 		AdjacencyList: map[string][]string{},
 	}
 	c := NewChain(jc)
-	_, err := NewTraverser(chainRepo, rf, c)
+	_, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
@@ -53,7 +59,7 @@ func TestRunComplete(t *testing.T) {
 		},
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -87,7 +93,7 @@ func TestRunNotComplete(t *testing.T) {
 		},
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -104,6 +110,128 @@ func TestRunNotComplete(t *testing.T) {
 	}
 }
 
+// A chain that failed is retried from the jobs that failed.
+func TestRunRetryChain(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job3 := mock.NewRunner(true, "", nil, nil, map[string]interface{}{"k": "v"})
+	job3.FailRuns = 1
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job3": job3,
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Fatalf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+
+	failed, err := c.ResetFailed()
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if !reflect.DeepEqual(failed, []string{"job3"}) {
+		t.Errorf("failed = %v, expected [job3]", failed)
+	}
+	traverser, err = NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
+	}
+
+	// Only the failed job and the job after it ran again
+	expect := map[string]int{"job1": 1, "job2": 1, "job3": 2, "job4": 1}
+	for name, runs := range expect {
+		if n := rf.RunnersToReturn[name].Runs(); n != runs {
+			t.Errorf("%s ran %d times, expected %d", name, n, runs)
+		}
+	}
+	if c.JobChain.Jobs["job4"].Data["k"] != "v" {
+		t.Errorf("job4 jobData = %v, expected k=v from job3", c.JobChain.Jobs["job4"].Data)
+	}
+
+	// A chain that completed can't be retried
+	if _, err := c.ResetFailed(); err != ErrNotRetryable {
+		t.Errorf("err = %v, expected ErrNotRetryable", err)
+	}
+}
+
+// A job after the jobs that are retried gets the jobData of every job before
+// it, including jobs that completed before the chain was retried.
+func TestRunRetryChainJobData(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job2 := mock.NewRunner(true, "", nil, nil, map[string]interface{}{"b": 2})
+	job2.FailRuns = 1
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"a": 1}),
+			"job2": job2,
+			"job3": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"c": 3}),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Fatalf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+
+	if _, err := c.ResetFailed(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	traverser, err = NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_COMPLETE {
+		t.Fatalf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
+	}
+
+	expect := map[string]interface{}{"a": 1, "b": 2, "c": 3}
+	if got := c.JobChain.Jobs["job4"].Data; !reflect.DeepEqual(got, expect) {
+		t.Errorf("job4 jobData = %v, expected %v", got, expect)
+	}
+}
+
 // Unknown job state should not cause the traverser to panic when running.
 func TestJobUnknownState(t *testing.T) {
 	chainRepo := NewMemoryRepo()
@@ -127,7 +255,7 @@ func TestJobUnknownState(t *testing.T) {
 	for _, job := range c.JobChain.Jobs {
 		job.State = proto.STATE_UNKNOWN
 	}
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -160,7 +288,7 @@ func TestJobData(t *testing.T) {
 		},
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -176,6 +304,41 @@ func TestJobData(t *testing.T) {
 	}
 }
 
+// A job with several previous jobs gets the merged jobData of all of them.
+func TestJobDataMerge(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"k1": "v1"}),
+			"job2": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"host": "db1"}),
+			"job3": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"vip": "10.0.0.1"}),
+			"job4": mock.NewRunner(true, "", nil, nil, map[string]interface{}{}),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	expectedJobData := map[string]interface{}{"k1": "v1", "host": "db1", "vip": "10.0.0.1"}
+	if !reflect.DeepEqual(jc.Jobs["job4"].Data, expectedJobData) {
+		t.Errorf("job4 data = %v, expected %v", jc.Jobs["job4"].Data, expectedJobData)
+	}
+}
+
 // Stop the traverser and all running jobs.
 func TestStop(t *testing.T) {
 	chainRepo := NewMemoryRepo()
@@ -198,7 +361,7 @@ func TestStop(t *testing.T) {
 		},
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -218,26 +381,219 @@ func TestStop(t *testing.T) {
 		}
 	}
 
-	traverser.Stop()
+	stop := proto.StopInfo{Requester: "alice", Reason: "wrong cluster"}
+	if err := traverser.Stop(time.Second, stop); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
 
-	// Wait for the traverser to finish.
-	<-doneChan
+	// Stop waits for the traverser to finish.
+	select {
+	case <-traverser.doneChan:
+	default:
+		t.Error("Stop returned before the traverser finished")
+	}
 
 	if c.JobChain.State != proto.STATE_INCOMPLETE {
 		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
 	}
-	if c.JobChain.Jobs["job2"].State != proto.STATE_FAIL {
-		t.Errorf("job2 state = %d, expected %d", c.JobChain.Jobs["job2"].State, proto.STATE_FAIL)
+	if c.JobChain.Jobs["job2"].State != proto.STATE_STOPPED {
+		t.Errorf("job2 state = %d, expected %d", c.JobChain.Jobs["job2"].State, proto.STATE_STOPPED)
 	}
-	if c.JobChain.Jobs["job3"].State != proto.STATE_FAIL {
-		t.Errorf("job3 state = %d, expected %d", c.JobChain.Jobs["job3"].State, proto.STATE_FAIL)
+	if c.JobChain.Jobs["job3"].State != proto.STATE_STOPPED {
+		t.Errorf("job3 state = %d, expected %d", c.JobChain.Jobs["job3"].State, proto.STATE_STOPPED)
 	}
 	if c.JobChain.Jobs["job4"].State != proto.STATE_PENDING {
 		t.Errorf("job4 state = %d, expected %d", c.JobChain.Jobs["job4"].State, proto.STATE_PENDING)
 	}
+	<-doneChan
+
+	// Who stopped the chain and why are kept with it and in its report
+	stopped := c.Stopped()
+	if stopped == nil || stopped.Requester != "alice" || stopped.Reason != "wrong cluster" || stopped.Time.IsZero() {
+		t.Errorf("stopped = %+v, expected alice, wrong cluster, and a time", stopped)
+	}
+	report, _ := c.Report()
+	if len(report.Interventions) != 1 || report.Interventions[0].Requester != "alice" ||
+		report.Interventions[0].Reason != "wrong cluster" {
+		t.Errorf("interventions = %+v, expected a stop by alice", report.Interventions)
+	}
+}
+
+// Stop the same chain twice at once, like a stop racing stop-all.
+func TestStopTwice(t *testing.T) {
+	runBlock := make(chan struct{})
+	stopChan := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, stopChan, noJobData),
+			"job2": mock.NewRunner(true, "", nil, stopChan, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs:          mock.InitJobs(2),
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(NewMemoryRepo(), rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	traverser.stopChan = stopChan
+
+	go traverser.Run()
+	for !rf.RunnersToReturn["job1"].Running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = traverser.Stop(time.Second, proto.StopInfo{Requester: fmt.Sprintf("user%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Stop %d: err = %s, expected nil", i, err)
+		}
+	}
+	select {
+	case <-traverser.doneChan:
+	default:
+		t.Error("Stop returned before the traverser finished")
+	}
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+	report, _ := c.Report()
+	if len(report.Interventions) != 1 {
+		t.Errorf("interventions = %+v, expected one stop", report.Interventions)
+	}
+}
+
+// Stop a job that doesn't stop within the grace period.
+func TestStopForceKilled(t *testing.T) {
+	stopChan := make(chan struct{})
+	runBlock := make(chan struct{})
+	defer close(runBlock)
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, stopChan, noJobData),
+		},
+	}
+	rf.RunnersToReturn["job1"].StopState = proto.STATE_FORCE_KILLED
+	c := NewChain(&proto.JobChain{Jobs: mock.InitJobs(1)})
+	traverser, err := NewTraverser(NewMemoryRepo(), rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	traverser.stopChan = stopChan
+
+	go traverser.Run()
+	for !rf.RunnersToReturn["job1"].Running() {
+	}
+
+	err = traverser.Stop(0, proto.StopInfo{})
+	if err != ErrJobsForceKilled {
+		t.Errorf("err = %v, expected %s", err, ErrJobsForceKilled)
+	}
+	if state := c.JobState("job1"); state != proto.STATE_FORCE_KILLED {
+		t.Errorf("job1 state = %s, expected FORCE_KILLED", proto.StateName[state])
+	}
 }
 
 // Error getting a runner from the repo when calling Stop.
+func TestSuspend(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// Start the traverser.
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- traverser.Run()
+	}()
+
+	// Wait until job1 is running. It will run until we close the runBlock chan.
+	for !rf.RunnersToReturn["job1"].Running() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Suspend blocks until job1 is done, so let it finish in a moment.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(runBlock)
+	}()
+	sjc := traverser.Suspend()
+
+	if err := <-runErr; err != nil {
+		t.Errorf("Run err = %s, expected nil", err)
+	}
+	if sjc.RequestId != 1 {
+		t.Errorf("request id = %d, expected 1", sjc.RequestId)
+	}
+	if sjc.JobChain.State != proto.STATE_SUSPENDED {
+		t.Errorf("chain state = %d, expected %d", sjc.JobChain.State, proto.STATE_SUSPENDED)
+	}
+	expect := map[string]byte{
+		"job1": proto.STATE_COMPLETE, // was running, allowed to finish
+		"job2": proto.STATE_PENDING,  // not started
+		"job3": proto.STATE_PENDING,
+	}
+	for name, state := range expect {
+		if sjc.JobChain.Jobs[name].State != state {
+			t.Errorf("%s state = %d, expected %d", name, sjc.JobChain.Jobs[name].State, state)
+		}
+	}
+	if rf.RunnersToReturn["job2"].Runs() != 0 {
+		t.Error("job2 ran after the traverser was suspended")
+	}
+}
+
+func TestSuspendNotStarted(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	sjc := traverser.Suspend()
+	if sjc.JobChain.State != proto.STATE_SUSPENDED {
+		t.Errorf("chain state = %d, expected %d", sjc.JobChain.State, proto.STATE_SUSPENDED)
+	}
+
+	// A suspended chain can't be started.
+	if err := traverser.Run(); err != ErrNotPending {
+		t.Errorf("err = %v, expected %s", err, ErrNotPending)
+	}
+}
+
 func TestStopRepoError(t *testing.T) {
 	chainRepo := NewMemoryRepo()
 	runBlock := make(chan struct{})
@@ -255,7 +611,7 @@ func TestStopRepoError(t *testing.T) {
 	runnerRepo.Store = &mock.KVStore{
 		GetAllResp: map[string]interface{}{"not a": "runner"},
 	}
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -272,7 +628,7 @@ func TestStopRepoError(t *testing.T) {
 		}
 	}
 
-	err = traverser.Stop()
+	err = traverser.Stop(0, proto.StopInfo{})
 
 	if err == nil {
 		t.Errorf("err = nil, expected %s", ErrInvalidRunner)
@@ -291,6 +647,8 @@ func TestStatus(t *testing.T) {
 			"job4": mock.NewRunner(true, "job4 running", nil, nil, noJobData),
 		},
 	}
+	rf.RunnersToReturn["job2"].ProgressResp = 50
+	rf.RunnersToReturn["job3"].ProgressResp = -1 // doesn't report progress
 	jc := &proto.JobChain{
 		Jobs: mock.InitJobs(4),
 		AdjacencyList: map[string][]string{
@@ -300,7 +658,7 @@ func TestStatus(t *testing.T) {
 		},
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -321,16 +679,38 @@ func TestStatus(t *testing.T) {
 
 	expectedStatus := proto.JobChainStatus{
 		JobStatuses: proto.JobStatuses{
-			proto.JobStatus{"job2", "job2 running", proto.STATE_RUNNING},
-			proto.JobStatus{"job3", "job3 running", proto.STATE_RUNNING},
+			proto.JobStatus{Name: "job2", Status: "job2 running", State: proto.STATE_RUNNING, Progress: 50},
+			proto.JobStatus{Name: "job3", Status: "job3 running", State: proto.STATE_RUNNING, Progress: -1},
 		},
 	}
-	status, err := traverser.Status()
+	status, err := traverser.Status(context.Background())
 	sort.Sort(status.JobStatuses)
 
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
+
+	// The traverser is running, so it has a recent heartbeat.
+	if status.ServerTime.IsZero() || status.HeartbeatAge == "" || status.Stale {
+		t.Errorf("status server time = %s, heartbeat age = %q, stale = %t; expected a recent heartbeat",
+			status.ServerTime, status.HeartbeatAge, status.Stale)
+	}
+	status.ServerTime = time.Time{}
+	status.HeartbeatAge = ""
+
+	// Both jobs have been running since they started, on their first try.
+	for i, js := range status.JobStatuses {
+		if js.StartTime.IsZero() || js.Elapsed == "" {
+			t.Errorf("job %s start time = %s, elapsed = %q; expected them set", js.Name, js.StartTime, js.Elapsed)
+		}
+		if len(js.TryHistory) != 1 || js.TryHistory[0].Try != 1 || js.TryHistory[0].State != proto.STATE_RUNNING {
+			t.Errorf("job %s tries = %+v, expected try 1 running", js.Name, js.TryHistory)
+		}
+		status.JobStatuses[i].StartTime = time.Time{}
+		status.JobStatuses[i].Elapsed = ""
+		status.JobStatuses[i].TryHistory = nil
+	}
+
 	if !reflect.DeepEqual(status, expectedStatus) {
 		t.Errorf("status = %v, expected %v", status, expectedStatus)
 	}
@@ -345,6 +725,34 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+// The status is stale if the traverser hasn't heartbeat recently.
+func TestStatusStale(t *testing.T) {
+	c := NewChain(&proto.JobChain{Jobs: mock.InitJobs(1)})
+	traverser, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// Not running, so there's no heartbeat and it's not stale.
+	status, err := traverser.Status(context.Background())
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if status.HeartbeatAge != "" || status.Stale {
+		t.Errorf("heartbeat age = %q, stale = %t; expected no heartbeat", status.HeartbeatAge, status.Stale)
+	}
+
+	// Wedged: the last heartbeat is too old.
+	traverser.heartbeat = now().Add(-2 * StaleHeartbeatAge)
+	status, err = traverser.Status(context.Background())
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if !status.Stale {
+		t.Errorf("stale = false, expected true (heartbeat age %s)", status.HeartbeatAge)
+	}
+}
+
 // Error creating a job runner.
 func TestRunJobsRunnerError(t *testing.T) {
 	chainRepo := NewMemoryRepo()
@@ -358,7 +766,7 @@ func TestRunJobsRunnerError(t *testing.T) {
 		Jobs: mock.InitJobs(1),
 	}
 	c := NewChain(jc)
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -393,7 +801,7 @@ func TestRunJobsRepoAddError(t *testing.T) {
 	runnerRepo.Store = &mock.KVStore{
 		AddErr: mock.ErrKVStore,
 	}
-	traverser, err := NewTraverser(chainRepo, rf, c)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
 	if err != nil {
 		t.Fatalf("err = %s, expected nil", err)
 	}
@@ -412,3 +820,1472 @@ func TestRunJobsRepoAddError(t *testing.T) {
 		t.Errorf("job state = %d, expected %d", resp.State, proto.STATE_FAIL)
 	}
 }
+
+// A failed job is retried until it completes.
+func TestRunJobRetry(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job2 := mock.NewRunner(true, "", nil, nil, noJobData)
+	job2.FailRuns = 2
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": job2,
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	j := jc.Jobs["job2"]
+	j.Retry = 2
+	j.RetryWait = "1ms"
+	j.RetryBackoff = proto.RETRY_BACKOFF_EXPONENTIAL
+	jc.Jobs["job2"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	err = traverser.Run()
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
+	}
+	if job2.Runs() != 3 {
+		t.Errorf("job2 runs = %d, expected 3", job2.Runs())
+	}
+}
+
+// A sequence is retried from its first job when a job in it fails.
+func TestRunSequenceRetry(t *testing.T) {
+	for _, c := range []struct {
+		failRuns int
+		state    byte
+		runs     int // of job2 and job3
+	}{
+		{failRuns: 1, state: proto.STATE_COMPLETE, runs: 2},
+		{failRuns: 3, state: proto.STATE_INCOMPLETE, runs: 3},
+	} {
+		job3 := mock.NewRunner(true, "", nil, nil, noJobData)
+		job3.FailRuns = c.failRuns
+		runners := map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job3": job3,
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		}
+		jc := &proto.JobChain{
+			Jobs: mock.InitJobs(4),
+			AdjacencyList: map[string][]string{
+				"job1": {"job2"},
+				"job2": {"job3"},
+				"job3": {"job4"},
+			},
+			SequenceRetries: map[string]uint{"allocate": 2},
+		}
+		for _, name := range []string{"job2", "job3"} {
+			j := jc.Jobs[name]
+			j.Sequence = "allocate"
+			jc.Jobs[name] = j
+		}
+		ch := NewChain(jc)
+		traverser, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: runners}, NewLimiter(0), ch)
+		if err != nil {
+			t.Fatalf("err = %s, expected nil", err)
+		}
+
+		if err := traverser.Run(); err != nil {
+			t.Errorf("err = %s, expected nil", err)
+		}
+		if ch.State() != c.state {
+			t.Errorf("fail %d runs: chain state = %s, expected %s", c.failRuns, proto.StateName[ch.State()], proto.StateName[c.state])
+		}
+		expect := map[string]int{"job1": 1, "job2": c.runs, "job3": c.runs, "job4": 0}
+		if c.state == proto.STATE_COMPLETE {
+			expect["job4"] = 1
+		}
+		for name, runs := range expect {
+			if runners[name].Runs() != runs {
+				t.Errorf("fail %d runs: %s runs = %d, expected %d", c.failRuns, name, runners[name].Runs(), runs)
+			}
+		}
+	}
+}
+
+// A failed job that runs out of retries fails the chain.
+func TestRunJobRetryExhausted(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job2 := mock.NewRunner(true, "", nil, nil, noJobData)
+	job2.FailRuns = 3
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": job2,
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	j := jc.Jobs["job2"]
+	j.Retry = 2
+	jc.Jobs["job2"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	err = traverser.Run()
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+	if c.JobChain.Jobs["job2"].State != proto.STATE_FAIL {
+		t.Errorf("job2 state = %d, expected %d", c.JobChain.Jobs["job2"].State, proto.STATE_FAIL)
+	}
+	if job2.Runs() != 3 {
+		t.Errorf("job2 runs = %d, expected 3", job2.Runs())
+	}
+}
+
+// A stalled job is a failed job: it's retried, and if it runs out of retries,
+// its fail edges are taken.
+func TestRunJobStalled(t *testing.T) {
+	job2 := mock.NewRunner(true, "", nil, nil, noJobData)
+	job2.FailRuns = 2
+	job2.FailState = proto.STATE_STALLED
+	runners := map[string]*mock.Runner{
+		"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+		"job2": job2,
+		"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		"job5": mock.NewRunner(true, "", nil, nil, noJobData),
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(5),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3", "job4"},
+			"job3": {"job5"},
+			"job4": {"job5"},
+		},
+		Conditions: map[string]map[string]proto.EdgeCondition{
+			"job2": {"job4": {On: proto.EDGE_ON_FAIL}},
+		},
+	}
+	j := jc.Jobs["job2"]
+	j.Retry = 1
+	j.HeartbeatTimeout = "1m"
+	jc.Jobs["job2"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{RunnersToReturn: runners}, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if err := traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if state := c.JobState("job2"); state != proto.STATE_STALLED {
+		t.Errorf("job2 state = %s, expected STALLED", proto.StateName[state])
+	}
+	if job2.Runs() != 2 {
+		t.Errorf("job2 runs = %d, expected 2", job2.Runs())
+	}
+	if runners["job3"].Runs() != 0 || runners["job4"].Runs() != 1 {
+		t.Errorf("job3 runs = %d, job4 runs = %d, expected only job4 (on fail) to run", runners["job3"].Runs(), runners["job4"].Runs())
+	}
+}
+
+// An invalid heartbeat timeout is rejected when creating the traverser.
+func TestNewTraverserInvalidHeartbeatTimeout(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	j := jc.Jobs["job1"]
+	j.HeartbeatTimeout = "soon"
+	jc.Jobs["job1"] = j
+	c := NewChain(jc)
+	_, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != ErrInvalidHeartbeatTimeout {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidHeartbeatTimeout)
+	}
+}
+
+// An invalid retry policy is rejected when creating the traverser.
+func TestNewTraverserInvalidRetryPolicy(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	j := jc.Jobs["job1"]
+	j.Retry = 1
+	j.RetryWait = "soon"
+	jc.Jobs["job1"] = j
+	c := NewChain(jc)
+	_, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != ErrInvalidRetryPolicy {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidRetryPolicy)
+	}
+}
+
+// The jobData of a job is released once all of its next jobs complete.
+// A job that times out fails the chain, and its state is TIMEOUT.
+func TestRunJobTimeout(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job2 := mock.NewRunner(false, "", nil, nil, noJobData)
+	job2.FailState = proto.STATE_TIMEOUT
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": job2,
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	j := jc.Jobs["job2"]
+	j.Timeout = "1s"
+	jc.Jobs["job2"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	err = traverser.Run()
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+	if c.JobChain.Jobs["job2"].State != proto.STATE_TIMEOUT {
+		t.Errorf("job2 state = %d, expected %d", c.JobChain.Jobs["job2"].State, proto.STATE_TIMEOUT)
+	}
+	if c.JobChain.Jobs["job3"].State != proto.STATE_PENDING {
+		t.Errorf("job3 state = %d, expected %d", c.JobChain.Jobs["job3"].State, proto.STATE_PENDING)
+	}
+}
+
+// When a job fails, only the next jobs on its "fail" edges run, and the next
+// jobs on its other edges are skipped.
+func TestRunConditionOnFail(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(false, "", nil, nil, noJobData),
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job5": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(5),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3", "job4"},
+			"job3": {"job5"},
+			"job4": {"job5"},
+		},
+		Conditions: map[string]map[string]proto.EdgeCondition{
+			"job2": {
+				"job3": {On: proto.EDGE_ON_SUCCESS},
+				"job4": {On: proto.EDGE_ON_FAIL},
+			},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	// The failure was handled, but the chain is still incomplete.
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+	expect := map[string]byte{
+		"job1": proto.STATE_COMPLETE,
+		"job2": proto.STATE_FAIL,
+		"job3": proto.STATE_SKIPPED,
+		"job4": proto.STATE_COMPLETE,
+		"job5": proto.STATE_COMPLETE,
+	}
+	for name, state := range expect {
+		if c.JobChain.Jobs[name].State != state {
+			t.Errorf("%s state = %d, expected %d", name, c.JobChain.Jobs[name].State, state)
+		}
+	}
+}
+
+// The next jobs taken depend on the jobData of the previous job, and skipping a
+// job skips its next jobs that can't run because of it.
+func TestRunConditionJobData(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"env": "prod"}),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job5": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(5),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job5"},
+			"job3": {"job4"},
+			"job4": {"job5"},
+		},
+		Conditions: map[string]map[string]proto.EdgeCondition{
+			"job1": {
+				"job2": {Key: "env", Value: "prod"},
+				"job3": {Key: "env", Value: "staging"},
+			},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	if c.JobChain.State != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
+	}
+	expect := map[string]byte{
+		"job1": proto.STATE_COMPLETE,
+		"job2": proto.STATE_COMPLETE,
+		"job3": proto.STATE_SKIPPED,
+		"job4": proto.STATE_SKIPPED,
+		"job5": proto.STATE_COMPLETE,
+	}
+	for name, state := range expect {
+		if c.JobChain.Jobs[name].State != state {
+			t.Errorf("%s state = %d, expected %d", name, c.JobChain.Jobs[name].State, state)
+		}
+	}
+	if rf.RunnersToReturn["job3"].Runs() != 0 || rf.RunnersToReturn["job4"].Runs() != 0 {
+		t.Error("a skipped job ran")
+	}
+}
+
+func TestNewTraverserInvalidCondition(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+		Conditions: map[string]map[string]proto.EdgeCondition{
+			"job2": {"job1": {On: proto.EDGE_ON_FAIL}}, // not an edge
+		},
+	}
+	c := NewChain(jc)
+	_, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != ErrInvalidCondition {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidCondition)
+	}
+}
+
+func TestNewTraverserInvalidTimeout(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	j := jc.Jobs["job1"]
+	j.Timeout = "-1s"
+	jc.Jobs["job1"] = j
+	c := NewChain(jc)
+	_, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != ErrInvalidTimeout {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidTimeout)
+	}
+}
+
+// When the chain fails, the rollback jobs of the completed jobs run in reverse
+// order with their jobData, then the chain's rollback job runs.
+func TestRunRollback(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1":     mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2":     mock.NewRunner(true, "", nil, nil, map[string]interface{}{"host": "db1"}),
+			"job3":     mock.NewRunner(false, "", nil, nil, noJobData),
+			"job4":     mock.NewRunner(true, "", nil, nil, noJobData),
+			"undo1":    mock.NewRunner(true, "", nil, nil, noJobData),
+			"undo2":    mock.NewRunner(true, "", nil, nil, noJobData),
+			"cleanup":  mock.NewRunner(true, "", nil, nil, noJobData),
+			"undoNext": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+			"job3": {"job4"},
+		},
+		RollbackJobs: map[string]proto.Job{
+			"undo1":    {},
+			"undo2":    {},
+			"cleanup":  {},
+			"undoNext": {},
+		},
+		RollbackJob: "cleanup",
+	}
+	for name, rollback := range map[string]string{"job1": "undo1", "job2": "undo2", "job4": "undoNext"} {
+		j := jc.Jobs[name]
+		j.Rollback = rollback
+		jc.Jobs[name] = j
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	events, unsubscribe := traverser.Subscribe()
+	defer unsubscribe()
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+
+	var ran []string
+	rollingBack := false
+	for e := range events {
+		if e.Job == "" && e.State == proto.STATE_ROLLING_BACK {
+			rollingBack = true
+		}
+		if c.IsRollbackJob(e.Job) && e.State == proto.STATE_RUNNING {
+			ran = append(ran, e.Job)
+		}
+	}
+	if !rollingBack {
+		t.Error("chain state ROLLING_BACK was not published")
+	}
+	expectRan := []string{"undo2", "undo1", "cleanup"}
+	if !reflect.DeepEqual(ran, expectRan) {
+		t.Errorf("rollback jobs ran = %v, expected %v", ran, expectRan)
+	}
+
+	for _, name := range expectRan {
+		if state := c.JobChain.RollbackJobs[name].State; state != proto.STATE_COMPLETE {
+			t.Errorf("%s state = %d, expected %d", name, state, proto.STATE_COMPLETE)
+		}
+	}
+	if state := c.JobChain.RollbackJobs["undoNext"].State; state != proto.STATE_PENDING {
+		t.Errorf("undoNext state = %d, expected %d", state, proto.STATE_PENDING)
+	}
+	if host := c.JobChain.RollbackJobs["undo2"].Data["host"]; host != "db1" {
+		t.Errorf("undo2 jobData host = %v, expected db1", host)
+	}
+}
+
+// Rollback stops at the first rollback job that doesn't complete.
+func TestRunRollbackFail(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1":    mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2":    mock.NewRunner(false, "", nil, nil, noJobData),
+			"undo1":   mock.NewRunner(false, "", nil, nil, noJobData),
+			"cleanup": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+		RollbackJobs: map[string]proto.Job{
+			"undo1":   {},
+			"cleanup": {},
+		},
+		RollbackJob: "cleanup",
+	}
+	j := jc.Jobs["job1"]
+	j.Rollback = "undo1"
+	jc.Jobs["job1"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_INCOMPLETE)
+	}
+	if state := c.JobChain.RollbackJobs["undo1"].State; state != proto.STATE_FAIL {
+		t.Errorf("undo1 state = %d, expected %d", state, proto.STATE_FAIL)
+	}
+	if rf.RunnersToReturn["cleanup"].Runs() != 0 {
+		t.Error("cleanup ran after a rollback job failed")
+	}
+}
+
+func TestNewTraverserInvalidRollback(t *testing.T) {
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(1),
+		RollbackJobs: map[string]proto.Job{
+			"undo1": {},
+		},
+	}
+	j := jc.Jobs["job1"]
+	j.Rollback = "undo2" // not a rollback job
+	jc.Jobs["job1"] = j
+	c := NewChain(jc)
+	_, err := NewTraverser(NewMemoryRepo(), &mock.RunnerFactory{}, NewLimiter(0), c)
+	if err != ErrInvalidRollback {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidRollback)
+	}
+}
+
+// When the chain is done, its final report has the outcome of every job,
+// including retries and jobs that didn't run, and the timeline.
+func TestRunReport(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	job2 := mock.NewRunner(false, "", nil, nil, noJobData)
+	job2.Log().Write([]byte("some output\nerror: boom\n"))
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": job2,
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 7,
+		Jobs:      mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	j := jc.Jobs["job2"]
+	j.Retry = 1
+	j.RetryWait = "1ms"
+	jc.Jobs["job2"] = j
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	if _, ok := c.Report(); ok {
+		t.Error("chain has a report before it ran")
+	}
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	report, ok := c.Report()
+	if !ok {
+		t.Fatal("chain has no report after it ran")
+	}
+	if report.RequestId != 7 || report.State != proto.STATE_INCOMPLETE {
+		t.Errorf("report is for chain %d state %d, expected chain 7 state %d",
+			report.RequestId, report.State, proto.STATE_INCOMPLETE)
+	}
+
+	expectJobs := []struct {
+		name  string
+		state byte
+		tries uint
+	}{
+		{"job1", proto.STATE_COMPLETE, 1},
+		{"job2", proto.STATE_FAIL, 2},
+		{"job3", proto.STATE_PENDING, 0},
+	}
+	if len(report.Jobs) != len(expectJobs) {
+		t.Fatalf("report has %d jobs, expected %d", len(report.Jobs), len(expectJobs))
+	}
+	for i, expect := range expectJobs {
+		jr := report.Jobs[i]
+		if jr.Name != expect.name || jr.State != expect.state || jr.Tries != expect.tries {
+			t.Errorf("report job %d = %s state %d tries %d, expected %s state %d tries %d",
+				i, jr.Name, jr.State, jr.Tries, expect.name, expect.state, expect.tries)
+		}
+		if uint(len(jr.TryIds)) != expect.tries {
+			t.Errorf("report job %s has try IDs %v, expected %d", jr.Name, jr.TryIds, expect.tries)
+		}
+	}
+	if ids := report.Jobs[1].TryIds; len(ids) == 2 && ids[0] >= ids[1] {
+		t.Errorf("job2 try IDs %v, expected them unique and sorted", ids)
+	}
+
+	// Both tries of job2 failed with the last line of their log as the error,
+	// and their logs are kept
+	for i, try := range report.Jobs[1].TryHistory {
+		if try.Try != uint(i+1) || try.State != proto.STATE_FAIL || try.Error != "error: boom" || try.EndTime.IsZero() {
+			t.Errorf("job2 try %d = %+v, expected it to fail with error: boom", i+1, try)
+		}
+		if expect := fmt.Sprintf("job-chains/7/jobs/job2/log?try=%d", i+1); try.Log != expect {
+			t.Errorf("job2 try %d log = %s, expected %s", i+1, try.Log, expect)
+		}
+		if _, err := traverser.Log("job2", try.Try); err != nil {
+			t.Errorf("can't get the log of job2 try %d: %s", i+1, err)
+		}
+	}
+	if _, err := traverser.Log("job1", 1); err == nil {
+		t.Error("got the log of job1 try 1, expected an error because it completed")
+	}
+	if !report.Jobs[2].StartTime.IsZero() {
+		t.Error("job3 has a start time, expected zero because it didn't run")
+	}
+
+	last := report.Timeline[len(report.Timeline)-1]
+	if last.Job != "" || last.State != proto.STATE_INCOMPLETE {
+		t.Errorf("last event in timeline = %+v, expected chain INCOMPLETE", last)
+	}
+
+	summary := Summarize(report)
+	if summary.TotalJobs != 3 || summary.Completed != 1 || summary.Failed != 1 || summary.NotRun != 1 {
+		t.Errorf("summary = %+v, expected 3 jobs: 1 completed, 1 failed, 1 not run", summary)
+	}
+	if len(summary.SlowestJobs) != 2 || summary.SlowestJobs[0].Name != "job2" {
+		t.Errorf("slowest jobs = %+v, expected job2 then job1", summary.SlowestJobs)
+	}
+}
+
+func TestRunReleaseJobData(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"k1": "v1"}),
+			"job2": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"k2": "v2"}),
+			"job3": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"k3": "v3"}),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	retained := retainedBytes.Value()
+	released := releasedBytes.Value()
+
+	err = traverser.Run()
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	if jc.Jobs["job1"].Data != nil {
+		t.Errorf("job1 data = %v, expected nil", jc.Jobs["job1"].Data)
+	}
+	if jc.Jobs["job2"].Data != nil {
+		t.Errorf("job2 data = %v, expected nil", jc.Jobs["job2"].Data)
+	}
+	expectedJobData := map[string]interface{}{"k1": "v1", "k2": "v2", "k3": "v3"}
+	if !reflect.DeepEqual(jc.Jobs["job3"].Data, expectedJobData) {
+		t.Errorf("job3 data = %v, expected %v", jc.Jobs["job3"].Data, expectedJobData)
+	}
+	if retainedBytes.Value() != retained {
+		t.Errorf("retained bytes = %d, expected %d", retainedBytes.Value(), retained)
+	}
+	if releasedBytes.Value() <= released {
+		t.Errorf("released bytes = %d, expected > %d", releasedBytes.Value(), released)
+	}
+}
+
+type spanRecorder struct {
+	spans []trace.Span
+	*sync.Mutex
+}
+
+func (r *spanRecorder) Record(s trace.Span) {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+// The chain is a span in the trace of its traceparent, and every job try is a
+// child span of it.
+func TestRunTrace(t *testing.T) {
+	r := &spanRecorder{Mutex: &sync.Mutex{}}
+	defer func(tr trace.Tracer) { Tracer = tr }(Tracer)
+	Tracer = r
+
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+		Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	if len(r.spans) != 3 {
+		t.Fatalf("recorded %d spans, expected 3: %+v", len(r.spans), r.spans)
+	}
+	chainSpan := r.spans[2] // finished last
+	if chainSpan.Name != "chain" || chainSpan.ParentId != "00f067aa0ba902b7" ||
+		chainSpan.Context.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("chain span = %+v, expected a child of the chain's traceparent", chainSpan)
+	}
+	if chainSpan.Attributes["state"] != "COMPLETE" {
+		t.Errorf("chain span state = %s, expected COMPLETE", chainSpan.Attributes["state"])
+	}
+	for i, name := range []string{"job job1", "job job2"} {
+		s := r.spans[i]
+		if s.Name != name || s.ParentId != chainSpan.Context.SpanId || s.Context.TraceId != chainSpan.Context.TraceId {
+			t.Errorf("span %d = %+v, expected %s, a child of the chain span", i, s, name)
+		}
+		if s.Attributes["try"] != "1" || s.Attributes["state"] != "COMPLETE" {
+			t.Errorf("span %d attributes = %v, expected try 1 COMPLETE", i, s.Attributes)
+		}
+	}
+}
+
+// Explain why jobs haven't started running.
+func TestExplain(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", runBlock, nil, noJobData),
+			"job3": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// Unknown job.
+	_, err = traverser.Explain("job9")
+	if err != ErrJobNotFound {
+		t.Errorf("err = %v, expected %s", err, ErrJobNotFound)
+	}
+
+	// Chain not started.
+	exp, err := traverser.Explain("job2")
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	expectedExp := proto.JobExplanation{
+		RequestId: 1,
+		Name:      "job2",
+		State:     proto.STATE_PENDING,
+		Blockers: []proto.JobBlocker{
+			{
+				Reason:  proto.BLOCKED_CHAIN_NOT_STARTED,
+				Message: "chain has not been started",
+			},
+			{
+				Reason:  proto.BLOCKED_DEPENDENCY,
+				Message: "previous job job1 is PENDING",
+				Job:     "job1",
+				State:   proto.STATE_PENDING,
+			},
+		},
+	}
+	if !reflect.DeepEqual(exp, expectedExp) {
+		t.Errorf("explanation = %+v, expected %+v", exp, expectedExp)
+	}
+
+	// Start the traverser.
+	doneChan := make(chan struct{})
+	go func() {
+		traverser.Run()
+		close(doneChan)
+	}()
+
+	// Wait until job2 is running and job3 is done.
+	for {
+		if rf.RunnersToReturn["job2"].Running() && c.JobState("job3") == proto.STATE_COMPLETE {
+			break
+		}
+	}
+
+	// job2 is running, so nothing blocks it.
+	exp, err = traverser.Explain("job2")
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if len(exp.Blockers) != 0 {
+		t.Errorf("job2 blockers = %+v, expected none", exp.Blockers)
+	}
+
+	// job4 is blocked only by job2.
+	exp, err = traverser.Explain("job4")
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	expectedBlockers := []proto.JobBlocker{
+		{
+			Reason:  proto.BLOCKED_DEPENDENCY,
+			Message: "previous job job2 is RUNNING",
+			Job:     "job2",
+			State:   proto.STATE_RUNNING,
+		},
+	}
+	if !reflect.DeepEqual(exp.Blockers, expectedBlockers) {
+		t.Errorf("job4 blockers = %+v, expected %+v", exp.Blockers, expectedBlockers)
+	}
+
+	close(runBlock)
+	<-doneChan
+}
+
+// Subscribers get every job and chain state change.
+func TestSubscribe(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(false, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	events, unsubscribe := traverser.Subscribe()
+	defer unsubscribe()
+
+	if err = traverser.Run(); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	type change struct {
+		job   string
+		state byte
+	}
+	var changes []change
+	for event := range events { // closed when the chain is done
+		if event.RequestId != 1 {
+			t.Errorf("event request id = %d, expected 1", event.RequestId)
+		}
+		changes = append(changes, change{event.Job, event.State})
+	}
+	expectedChanges := []change{
+		{"", proto.STATE_RUNNING},
+		{"job1", proto.STATE_RUNNING},
+		{"job1", proto.STATE_COMPLETE},
+		{"job2", proto.STATE_RUNNING},
+		{"job2", proto.STATE_FAIL},
+		{"", proto.STATE_INCOMPLETE},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("changes = %v, expected %v", changes, expectedChanges)
+	}
+
+	// Subscribing after the chain is done returns a closed channel.
+	events, _ = traverser.Subscribe()
+	if _, ok := <-events; ok {
+		t.Error("events channel is open, expected it to be closed")
+	}
+}
+
+// Only MaxConcurrentJobs jobs in the chain run at once.
+func TestRunMaxConcurrentJobs(t *testing.T) {
+	testConcurrencyLimit(t, 1, 0, proto.BLOCKED_CHAIN_CONCURRENCY_LIMIT)
+}
+
+// Only max jobs across all chains run at once.
+func TestRunGlobalConcurrencyLimit(t *testing.T) {
+	testConcurrencyLimit(t, 0, 1, proto.BLOCKED_CONCURRENCY_LIMIT)
+}
+
+func testConcurrencyLimit(t *testing.T, chainMax, globalMax uint, expectedReason string) {
+	chainRepo := NewMemoryRepo()
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", runBlock, nil, noJobData),
+			"job3": mock.NewRunner(true, "", runBlock, nil, noJobData),
+			"job4": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+		MaxConcurrentJobs: chainMax,
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(globalMax), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	doneChan := make(chan struct{})
+	go func() {
+		traverser.Run()
+		close(doneChan)
+	}()
+
+	// Wait until job2 or job3 is running, and the other is waiting for a slot.
+	var running, waiting string
+	for running == "" {
+		if rf.RunnersToReturn["job2"].Running() {
+			running, waiting = "job2", "job3"
+		} else if rf.RunnersToReturn["job3"].Running() {
+			running, waiting = "job3", "job2"
+		}
+	}
+	for {
+		exp, err := traverser.Explain(waiting)
+		if err != nil {
+			t.Fatalf("err = %s, expected nil", err)
+		}
+		if len(exp.Blockers) > 0 {
+			if exp.Blockers[0].Reason != expectedReason {
+				t.Errorf("%s blocked by %s, expected %s", waiting, exp.Blockers[0].Reason, expectedReason)
+			}
+			break
+		}
+	}
+	if rf.RunnersToReturn[waiting].Running() {
+		t.Errorf("%s is running, expected only %s to be running", waiting, running)
+	}
+
+	close(runBlock)
+	<-doneChan
+
+	if c.JobChain.State != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %d, expected %d", c.JobChain.State, proto.STATE_COMPLETE)
+	}
+}
+
+// A chain that runs longer than it's expected to gets a warning, and it keeps
+// running.
+func TestRunOverrun(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		Jobs:             mock.InitJobs(1),
+		ExpectedDuration: "50ms",
+		OverrunFactor:    1.5,
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	events, unsubscribe := traverser.Subscribe()
+	defer unsubscribe()
+
+	doneChan := make(chan error)
+	go func() { doneChan <- traverser.Run() }()
+
+	var warning proto.JobChainEvent
+	timeout := time.After(5 * time.Second)
+	for warning.Warning == "" {
+		select {
+		case warning = <-events:
+		case <-timeout:
+			t.Fatal("no overrun warning")
+		}
+	}
+	if warning.State != proto.STATE_RUNNING || warning.Job != "" {
+		t.Errorf("warning = %+v, expected the chain, RUNNING", warning)
+	}
+	status, err := traverser.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Overrun {
+		t.Error("status not overrun, expected overrun")
+	}
+
+	close(runBlock)
+	if err := <-doneChan; err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if c.State() != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %s, expected COMPLETE", proto.StateName[c.State()])
+	}
+}
+
+// A chain repo that fails to save chains while err is set.
+type failingRepo struct {
+	Repo
+	err error
+	mux sync.Mutex
+}
+
+func (r *failingRepo) Set(c *chain) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.Repo.Set(c)
+}
+
+func (r *failingRepo) fail(err error) {
+	r.mux.Lock()
+	r.err = err
+	r.mux.Unlock()
+}
+
+// By default, a chain that can't be saved keeps running in memory, and it's
+// saved once the repo is back.
+func TestRunRepoFailureContinue(t *testing.T) {
+	chainRepo := &failingRepo{Repo: NewMemoryRepo()}
+	runBlock := make(chan struct{})
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", runBlock, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	events, unsubscribe := traverser.Subscribe()
+	defer unsubscribe()
+
+	chainRepo.fail(fmt.Errorf("db is down"))
+	doneChan := make(chan error)
+	go func() { doneChan <- traverser.Run() }()
+
+	var warning proto.JobChainEvent
+	timeout := time.After(5 * time.Second)
+	for warning.Warning == "" {
+		select {
+		case warning = <-events:
+		case <-timeout:
+			t.Fatal("no repo failure warning")
+		}
+	}
+	for !rf.RunnersToReturn["job1"].Running() {
+		time.Sleep(time.Millisecond)
+	}
+	status, err := traverser.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Degraded || len(status.RepoGaps) != 1 {
+		t.Fatalf("degraded = %t, gaps = %+v; expected degraded with 1 gap", status.Degraded, status.RepoGaps)
+	}
+	if gap := status.RepoGaps[0]; gap.FailedWrites == 0 || gap.Error != "db is down" || !gap.End.IsZero() {
+		t.Errorf("gap = %+v, expected an open gap with failed writes", gap)
+	}
+
+	chainRepo.fail(nil)
+	close(runBlock)
+	if err := <-doneChan; err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	status, err = traverser.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Degraded || len(status.RepoGaps) != 1 || status.RepoGaps[0].End.IsZero() {
+		t.Errorf("degraded = %t, gaps = %+v; expected 1 closed gap", status.Degraded, status.RepoGaps)
+	}
+	saved, err := chainRepo.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.State() != proto.STATE_COMPLETE {
+		t.Errorf("saved chain state = %s, expected COMPLETE", proto.StateName[saved.State()])
+	}
+}
+
+// With the pause policy, jobs don't start until the chain can be saved.
+func TestRunRepoFailurePause(t *testing.T) {
+	defer func(policy string, interval time.Duration) {
+		RepoFailurePolicy = policy
+		RepoRetryInterval = interval
+	}(RepoFailurePolicy, RepoRetryInterval)
+	RepoFailurePolicy = REPO_FAILURE_PAUSE
+	RepoRetryInterval = 10 * time.Millisecond
+
+	chainRepo := &failingRepo{Repo: NewMemoryRepo()}
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	c := NewChain(&proto.JobChain{Jobs: mock.InitJobs(1)})
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	chainRepo.fail(fmt.Errorf("db is down"))
+	doneChan := make(chan error)
+	go func() { doneChan <- traverser.Run() }()
+
+	var exp proto.JobExplanation
+	timeout := time.After(5 * time.Second)
+	for len(exp.Blockers) == 0 {
+		select {
+		case <-timeout:
+			t.Fatal("job1 not blocked by the repo")
+		case <-time.After(time.Millisecond):
+		}
+		if exp, err = traverser.Explain("job1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exp.Blockers[0].Reason != proto.BLOCKED_REPO_UNAVAILABLE {
+		t.Errorf("blockers = %+v, expected %s", exp.Blockers, proto.BLOCKED_REPO_UNAVAILABLE)
+	}
+	if rf.RunnersToReturn["job1"].Running() {
+		t.Error("job1 is running, expected it to wait for the repo")
+	}
+
+	chainRepo.fail(nil)
+	if err := <-doneChan; err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if c.State() != proto.STATE_COMPLETE {
+		t.Errorf("chain state = %s, expected COMPLETE", proto.StateName[c.State()])
+	}
+}
+
+// Records calls to the hooks it implements.
+type recordingHooks struct {
+	NopHooks
+	calls []string
+	mux   sync.Mutex
+}
+
+func (h *recordingHooks) record(call string) {
+	h.mux.Lock()
+	h.calls = append(h.calls, call)
+	h.mux.Unlock()
+}
+
+func (h *recordingHooks) OnChainStart(jc proto.JobChain) {
+	h.record(fmt.Sprintf("chain %d start", jc.RequestId))
+}
+
+func (h *recordingHooks) OnJobStart(requestId uint, job proto.Job, try uint) {
+	h.record(fmt.Sprintf("%s try %d", job.Name, try))
+}
+
+func (h *recordingHooks) OnJobDone(requestId uint, job proto.Job) {
+	h.record(fmt.Sprintf("%s %s", job.Name, proto.StateName[job.State]))
+}
+
+func (h *recordingHooks) OnChainDone(jc proto.JobChain) {
+	h.record(fmt.Sprintf("chain %d %s", jc.RequestId, proto.StateName[jc.State]))
+}
+
+// Hooks are called as the chain runs, and nil hooks are ignored.
+func TestRunHooks(t *testing.T) {
+	chainRepo := NewMemoryRepo()
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			"job2": mock.NewRunner(true, "", nil, nil, noJobData),
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 7,
+		Jobs:      mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	hooks := &recordingHooks{}
+	traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), NewChain(jc), hooks, nil)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	expect := []string{
+		"chain 7 start",
+		"job1 try 1",
+		"job1 COMPLETE",
+		"job2 try 1",
+		"job2 COMPLETE",
+		"chain 7 COMPLETE",
+	}
+	if !reflect.DeepEqual(hooks.calls, expect) {
+		t.Errorf("calls = %v, expected %v", hooks.calls, expect)
+	}
+}
+
+// Panics when the chain or a job starts, like a bug in the traverser.
+type panicHooks struct {
+	NopHooks
+	onChainStart bool
+}
+
+func (h panicHooks) OnChainStart(jc proto.JobChain) {
+	if h.onChainStart {
+		panic("chain start bug")
+	}
+}
+
+func (h panicHooks) OnJobStart(requestId uint, job proto.Job, try uint) {
+	if !h.onChainStart {
+		panic("job start bug")
+	}
+}
+
+// If the traverser panics, in Run or in a job's goroutine, the chain is
+// quarantined with the panic and its stack trace, and it can be recovered.
+func TestRunQuarantine(t *testing.T) {
+	for _, hooks := range []panicHooks{{onChainStart: true}, {onChainStart: false}} {
+		chainRepo := NewMemoryRepo()
+		rf := &mock.RunnerFactory{
+			RunnersToReturn: map[string]*mock.Runner{
+				"job1": mock.NewRunner(true, "", nil, nil, noJobData),
+			},
+		}
+		c := NewChain(&proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(1)})
+		traverser, err := NewTraverser(chainRepo, rf, NewLimiter(0), c, hooks)
+		if err != nil {
+			t.Fatalf("err = %s, expected nil", err)
+		}
+
+		if err := traverser.Run(); err != ErrQuarantined {
+			t.Fatalf("err = %v, expected %s", err, ErrQuarantined)
+		}
+		saved, err := chainRepo.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jc := saved.Snapshot()
+		if jc.State != proto.STATE_QUARANTINED || jc.Quarantine == nil {
+			t.Fatalf("chain state = %s, quarantine = %v; expected QUARANTINED with the panic", proto.StateName[jc.State], jc.Quarantine)
+		}
+		if jc.Quarantine.Panic != "chain start bug" && jc.Quarantine.Panic != "job start bug" {
+			t.Errorf("panic = %q, expected the hook's", jc.Quarantine.Panic)
+		}
+		if !strings.Contains(jc.Quarantine.Stack, "OnChainStart") && !strings.Contains(jc.Quarantine.Stack, "OnJobStart") {
+			t.Errorf("stack doesn't have the hook that panicked:\n%s", jc.Quarantine.Stack)
+		}
+		if rf.RunnersToReturn["job1"].Runs() != 0 {
+			t.Error("job1 ran, expected it not to")
+		}
+		exp, err := traverser.Explain("job1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hooks.onChainStart && (len(exp.Blockers) == 0 || exp.Blockers[0].Reason != proto.BLOCKED_CHAIN_QUARANTINED) {
+			t.Errorf("blockers = %+v, expected %s", exp.Blockers, proto.BLOCKED_CHAIN_QUARANTINED)
+		}
+
+		sjc, err := traverser.Recover()
+		if err != nil {
+			t.Fatalf("err = %s, expected nil", err)
+		}
+		if sjc.JobChain.State != proto.STATE_SUSPENDED || sjc.JobChain.Jobs["job1"].State == proto.STATE_RUNNING {
+			t.Errorf("recovered chain is %s with job1 %s, expected SUSPENDED and job1 not RUNNING",
+				proto.StateName[sjc.JobChain.State], proto.StateName[sjc.JobChain.Jobs["job1"].State])
+		}
+		if _, err := traverser.Recover(); err != ErrNotQuarantined {
+			t.Errorf("err = %v, expected %s recovering it again", err, ErrNotQuarantined)
+		}
+	}
+}
+
+func TestRunCheckpoint(t *testing.T) {
+	defer func(interval time.Duration) { CheckpointInterval = interval }(CheckpointInterval)
+	CheckpointInterval = 10 * time.Millisecond
+
+	runBlock := make(chan struct{})
+	job2 := mock.NewRunner(true, "", runBlock, nil, map[string]interface{}{"hosts": 10})
+	job2.CheckpointResp = map[string]interface{}{"drained": 4}
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"job1": mock.NewRunner(true, "", nil, nil, map[string]interface{}{"cluster": "db1"}),
+			"job2": job2,
+		},
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(2),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+		},
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(NewMemoryRepo(), rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	doneChan := make(chan error)
+	go func() { doneChan <- traverser.Run() }()
+
+	// The running job's jobData is what it checkpointed itself
+	var cp *checkpoint
+	timeout := time.After(5 * time.Second)
+	for cp == nil || cp.JobData["job2"] == nil {
+		select {
+		case <-timeout:
+			t.Fatalf("checkpoint = %+v, expected job2 in it", cp)
+		case <-time.After(time.Millisecond):
+		}
+		cp = c.LastCheckpoint()
+	}
+	expect := map[string]map[string]interface{}{
+		"job1": {"cluster": "db1"},
+		"job2": {"drained": 4},
+	}
+	if !reflect.DeepEqual(cp.JobData, expect) {
+		t.Errorf("checkpoint jobData = %v, expected %v", cp.JobData, expect)
+	}
+
+	// A chain read back without jobData gets it from its checkpoint
+	saved := NewChain(&proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(2)})
+	saved.SetCheckpoint(cp)
+	saved.RestoreCheckpoint()
+	if data := saved.JobChain.Jobs["job2"].Data; !reflect.DeepEqual(data, expect["job2"]) {
+		t.Errorf("restored job2 jobData = %v, expected %v", data, expect["job2"])
+	}
+
+	close(runBlock)
+	if err := <-doneChan; err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if cp := c.LastCheckpoint(); cp != nil {
+		t.Errorf("checkpoint = %+v, expected none once the chain is complete", cp)
+	}
+}
+
+func TestRunBudget(t *testing.T) {
+	rf := &mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{}}
+	for _, name := range []string{"job1", "job2", "job3"} {
+		jr := mock.NewRunner(true, "", nil, nil, nil)
+		jr.EstimatedCostResp = 10
+		jr.ActualCostResp = 8
+		rf.RunnersToReturn[name] = jr
+	}
+	jc := &proto.JobChain{
+		RequestId: 1,
+		Jobs:      mock.InitJobs(3),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2"},
+			"job2": {"job3"},
+		},
+		Budget: 25,
+	}
+	c := NewChain(jc)
+	traverser, err := NewTraverser(NewMemoryRepo(), rf, NewLimiter(0), c)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if err := traverser.Run(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// job3 would have spent 16 + 10 > 25, so it didn't run
+	if c.JobChain.State != proto.STATE_INCOMPLETE {
+		t.Errorf("chain state = %s, expected INCOMPLETE", proto.StateName[c.JobChain.State])
+	}
+	if state := c.JobChain.Jobs["job3"].State; state != proto.STATE_POLICY_VIOLATION {
+		t.Errorf("job3 state = %s, expected POLICY_VIOLATION", proto.StateName[state])
+	}
+	if runs := rf.RunnersToReturn["job3"].Runs(); runs != 0 {
+		t.Errorf("job3 ran %d times, expected 0", runs)
+	}
+
+	report, ok := c.Report()
+	if !ok {
+		t.Fatal("chain has no report")
+	}
+	expect := &proto.Spend{Budget: 25, Projected: 20, Actual: 16, Refused: []string{"job3"}}
+	if !reflect.DeepEqual(report.Spend, expect) {
+		t.Errorf("spend = %+v, expected %+v", report.Spend, expect)
+	}
+}
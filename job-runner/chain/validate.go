@@ -0,0 +1,192 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+// A ValidationError describes why a job chain is not valid. Err is one of the
+// Err* vars for the problem, like ErrCyclic, and Detail says which jobs have
+// the problem.
+type ValidationError struct {
+	Err    error
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Detail)
+}
+
+// Validate checks if a job chain is valid before it's made into a chain: the
+// adjacency list only refers to jobs in the chain, there is one first job from
+// which all jobs are reachable and one last job, there are no cycles, and
+// every job is identified by its name. Jobs without a name are named by their
+// key in NewChain, so they are valid. It also checks edge conditions, rollback
+// jobs, retry policies, timeouts, resource limits, mirrors, retried sequences,
+// the callback URL, the expected duration, the silence, and the budget. If the
+// chain is not valid, it returns a *ValidationError.
+func Validate(jc proto.JobChain) error {
+	c := &chain{JobChain: &jc}
+
+	// Make sure every job is identified by its name.
+	for name, job := range jc.Jobs {
+		if job.Name != "" && job.Name != name {
+			return &ValidationError{ErrJobNameMismatch, fmt.Sprintf("job %s is named %s", name, job.Name)}
+		}
+	}
+
+	// Make sure the adjacency list only refers to jobs in the chain.
+	if unknown := c.unknownAdjacentJobs(); len(unknown) > 0 {
+		return &ValidationError{ErrInvalidAdjacencyList, "unknown jobs " + strings.Join(unknown, ", ")}
+	}
+
+	// Make sure there is one first job. Other jobs with no previous jobs
+	// would never run.
+	if first := jobsWithDegree(c.indegreeCounts(), 0); len(first) != 1 {
+		return &ValidationError{ErrFirstJob, fmt.Sprintf("jobs with no previous jobs: [%s]", strings.Join(first, ", "))}
+	}
+
+	// Make sure there is one last job.
+	if last := jobsWithDegree(c.outdegreeCounts(), 0); len(last) != 1 {
+		return &ValidationError{ErrLastJob, fmt.Sprintf("jobs with no next jobs: [%s]", strings.Join(last, ", "))}
+	}
+
+	// Make sure there are no cycles.
+	if cyclic := c.cyclicJobs(); len(cyclic) > 0 {
+		return &ValidationError{ErrCyclic, "jobs in or after a cycle " + strings.Join(cyclic, ", ")}
+	}
+
+	// Make sure edge conditions are on edges in the adjacency list.
+	if detail := c.invalidCondition(); detail != "" {
+		return &ValidationError{ErrInvalidCondition, detail}
+	}
+
+	// Make sure rollback jobs exist and don't collide with jobs.
+	if detail := c.invalidRollback(); detail != "" {
+		return &ValidationError{ErrInvalidRollback, detail}
+	}
+
+	// Make sure jobs can parse the env.
+	if v, ok := jc.Env[proto.ENV_DRY_RUN]; ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return &ValidationError{ErrInvalidEnv, fmt.Sprintf("%s is %q, expected true or false", proto.ENV_DRY_RUN, v)}
+		}
+	}
+
+	// Make sure every job has a valid retry policy, timeouts, limits, and mirrors.
+	for _, jobs := range []map[string]proto.Job{jc.Jobs, jc.RollbackJobs} {
+		for name, job := range jobs {
+			if !validRetryPolicy(job) {
+				return &ValidationError{ErrInvalidRetryPolicy, "job " + name}
+			}
+			if !validTimeout(job) {
+				return &ValidationError{ErrInvalidTimeout, fmt.Sprintf("job %s has timeout %q", name, job.Timeout)}
+			}
+			if !validHeartbeatTimeout(job) {
+				return &ValidationError{ErrInvalidHeartbeatTimeout, fmt.Sprintf("job %s has heartbeat timeout %q", name, job.HeartbeatTimeout)}
+			}
+			if l := job.Limits; l != nil {
+				switch {
+				case l.Isolation != "" && l.Isolation != proto.ISOLATION_PROCESS && l.Isolation != proto.ISOLATION_CGROUP:
+					return &ValidationError{ErrInvalidLimits, fmt.Sprintf("job %s has isolation %q", name, l.Isolation)}
+				case l.CPUs < 0:
+					return &ValidationError{ErrInvalidLimits, fmt.Sprintf("job %s has %g CPUs", name, l.CPUs)}
+				}
+			}
+			switch job.MirrorDivergence {
+			case "", proto.MIRROR_DIVERGENCE_FAIL, proto.MIRROR_DIVERGENCE_FLAG:
+			default:
+				return &ValidationError{ErrInvalidMirrors, fmt.Sprintf("job %s has mirror divergence %q", name, job.MirrorDivergence)}
+			}
+		}
+	}
+
+	// Make sure sequences that can be retried have one first job to retry
+	// them from.
+	for sequence := range jc.SequenceRetries {
+		jobs, first := c.sequenceJobs(sequence)
+		if sequence == "" || len(jobs) == 0 {
+			return &ValidationError{ErrInvalidSequence, fmt.Sprintf("sequence %s has no jobs", sequence)}
+		}
+		if len(first) != 1 {
+			return &ValidationError{ErrInvalidSequence, fmt.Sprintf("sequence %s has first jobs [%s]", sequence, strings.Join(first, ", "))}
+		}
+	}
+
+	// Make sure the callback and progress URLs, if any, can be POSTed to.
+	for what, callbackURL := range map[string]string{"callback": jc.CallbackURL, "progress": jc.ProgressURL} {
+		if callbackURL == "" {
+			continue
+		}
+		u, err := url.Parse(callbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &ValidationError{ErrInvalidCallbackURL, fmt.Sprintf("%s URL %q", what, callbackURL)}
+		}
+	}
+
+	// Make sure the expected duration, if any, is a duration, and the overrun
+	// factor doesn't warn before the chain is expected to be done.
+	if jc.ExpectedDuration != "" || jc.OverrunFactor != 0 {
+		d, err := time.ParseDuration(jc.ExpectedDuration)
+		if err != nil || d <= 0 {
+			return &ValidationError{ErrInvalidExpectedDuration, fmt.Sprintf("expected duration %q", jc.ExpectedDuration)}
+		}
+		if jc.OverrunFactor != 0 && jc.OverrunFactor < 1 {
+			return &ValidationError{ErrInvalidExpectedDuration, fmt.Sprintf("overrun factor %g", jc.OverrunFactor)}
+		}
+	}
+
+	// Make sure the silence, if any, matches some alerts and ends.
+	if s := jc.Silence; s != nil {
+		if len(s.Matchers) == 0 {
+			return &ValidationError{ErrInvalidSilence, "no matchers"}
+		}
+		for label, expr := range s.Matchers {
+			if _, err := regexp.Compile(expr); label == "" || err != nil {
+				return &ValidationError{ErrInvalidSilence, fmt.Sprintf("matcher %s=%q", label, expr)}
+			}
+		}
+		if s.Duration != "" {
+			if d, err := time.ParseDuration(s.Duration); err != nil || d <= 0 {
+				return &ValidationError{ErrInvalidSilence, fmt.Sprintf("duration %q", s.Duration)}
+			}
+		}
+	}
+
+	if jc.Budget < 0 {
+		return &ValidationError{ErrInvalidBudget, fmt.Sprintf("budget %g", jc.Budget)}
+	}
+
+	return nil
+}
+
+// Validate checks if the chain is valid. If not, it returns one of the Err*
+// vars for the problem. Use the Validate function for a description of the
+// problem.
+func (c *chain) Validate() error {
+	if err := Validate(*c.JobChain); err != nil {
+		return err.(*ValidationError).Err
+	}
+	return nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// jobsWithDegree returns the names of the jobs with the given degree, sorted.
+func jobsWithDegree(degreeCounts map[string]int, degree int) []string {
+	jobs := map[string]bool{}
+	for job, count := range degreeCounts {
+		if count == degree {
+			jobs[job] = true
+		}
+	}
+	return sortedKeys(jobs)
+}
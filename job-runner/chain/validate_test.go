@@ -0,0 +1,261 @@
+// Copyright 2017, Square, Inc.
+
+package chain
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		adjList   map[string][]string
+		jobs      int
+		expectErr error
+		detail    string // must be in the error
+	}{
+		{
+			name:    "valid",
+			jobs:    3,
+			adjList: map[string][]string{"job1": {"job2"}, "job2": {"job3"}},
+		},
+		{
+			name:      "unknown job",
+			jobs:      2,
+			adjList:   map[string][]string{"job1": {"job2", "job7"}},
+			expectErr: ErrInvalidAdjacencyList,
+			detail:    "job7",
+		},
+		{
+			name:      "unreachable job",
+			jobs:      3,
+			adjList:   map[string][]string{"job1": {"job3"}, "job2": {"job3"}},
+			expectErr: ErrFirstJob,
+			detail:    "[job1, job2]",
+		},
+		{
+			name:      "two last jobs",
+			jobs:      3,
+			adjList:   map[string][]string{"job1": {"job2", "job3"}},
+			expectErr: ErrLastJob,
+			detail:    "[job2, job3]",
+		},
+		{
+			name:      "cycle",
+			jobs:      4,
+			adjList:   map[string][]string{"job1": {"job2"}, "job2": {"job3", "job4"}, "job3": {"job2"}},
+			expectErr: ErrCyclic,
+			detail:    "job2, job3, job4",
+		},
+	}
+	for _, test := range tests {
+		jc := proto.JobChain{
+			Jobs:          mock.InitJobs(test.jobs),
+			AdjacencyList: test.adjList,
+		}
+		err := Validate(jc)
+		if test.expectErr == nil {
+			if err != nil {
+				t.Errorf("%s: err = %s, expected nil", test.name, err)
+			}
+			continue
+		}
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: err = %v, expected a *ValidationError", test.name, err)
+			continue
+		}
+		if verr.Err != test.expectErr {
+			t.Errorf("%s: err = %s, expected %s", test.name, verr.Err, test.expectErr)
+		}
+		if !strings.Contains(verr.Error(), test.detail) {
+			t.Errorf("%s: error %q does not contain %q", test.name, verr.Error(), test.detail)
+		}
+	}
+}
+
+func TestValidateJobNames(t *testing.T) {
+	// Unnamed jobs are named by NewChain, so they're valid.
+	jc := proto.JobChain{
+		Jobs: map[string]proto.Job{
+			"job1": {},
+			"job2": {Name: "job2"},
+		},
+		AdjacencyList: map[string][]string{"job1": {"job2"}},
+	}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	jc.Jobs["job1"] = proto.Job{Name: "job2"}
+	err := Validate(jc)
+	if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrJobNameMismatch {
+		t.Errorf("err = %v, expected %s", err, ErrJobNameMismatch)
+	}
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs:        mock.InitJobs(1),
+		CallbackURL: "https://rm.example.com/api/v1/callbacks",
+	}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	for _, callbackURL := range []string{"rm.example.com/callbacks", "ftp://rm.example.com", "http://"} {
+		jc.CallbackURL = callbackURL
+		err := Validate(jc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidCallbackURL {
+			t.Errorf("%s: err = %v, expected %s", callbackURL, err, ErrInvalidCallbackURL)
+		}
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	job := jc.Jobs["job1"]
+	job.Limits = &proto.JobLimits{Isolation: proto.ISOLATION_CGROUP, MemoryMB: 512, CPUs: 0.5}
+	jc.Jobs["job1"] = job
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	for _, limits := range []proto.JobLimits{{Isolation: "container"}, {CPUs: -1}} {
+		job.Limits = &limits
+		jc.Jobs["job1"] = job
+		err := Validate(jc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidLimits {
+			t.Errorf("%+v: err = %v, expected %s", limits, err, ErrInvalidLimits)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs: mock.InitJobs(1),
+		Env:  map[string]string{proto.ENV_DATACENTER: "east", proto.ENV_DRY_RUN: "false"},
+	}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	jc.Env[proto.ENV_DRY_RUN] = "yes please"
+	err := Validate(jc)
+	if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidEnv {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidEnv)
+	}
+}
+
+func TestValidateExpectedDuration(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs:             mock.InitJobs(1),
+		ExpectedDuration: "30m",
+		OverrunFactor:    1.5,
+	}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	for _, d := range []struct {
+		expected string
+		factor   float64
+	}{{"30", 0}, {"-1m", 0}, {"", 2}, {"30m", 0.5}} {
+		jc.ExpectedDuration = d.expected
+		jc.OverrunFactor = d.factor
+		err := Validate(jc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidExpectedDuration {
+			t.Errorf("%+v: err = %v, expected %s", d, err, ErrInvalidExpectedDuration)
+		}
+	}
+}
+
+func TestValidateSequenceRetries(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs: mock.InitJobs(4),
+		AdjacencyList: map[string][]string{
+			"job1": {"job2", "job3"},
+			"job2": {"job4"},
+			"job3": {"job4"},
+		},
+		SequenceRetries: map[string]uint{"s": 1},
+	}
+	job := jc.Jobs["job2"]
+	job.Sequence = "s"
+	jc.Jobs["job2"] = job
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	// Two first jobs, and no jobs
+	job = jc.Jobs["job3"]
+	job.Sequence = "s"
+	jc.Jobs["job3"] = job
+	for _, retries := range []map[string]uint{{"s": 1}, {"t": 1}} {
+		jc.SequenceRetries = retries
+		err := Validate(jc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidSequence {
+			t.Errorf("%v: err = %v, expected %s", retries, err, ErrInvalidSequence)
+		}
+	}
+}
+
+func TestValidateMirrors(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs: mock.InitJobs(1),
+	}
+	job := jc.Jobs["job1"]
+	job.Mirrors = 2
+	job.MirrorDivergence = proto.MIRROR_DIVERGENCE_FLAG
+	jc.Jobs["job1"] = job
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	job.MirrorDivergence = "ignore"
+	jc.Jobs["job1"] = job
+	err := Validate(jc)
+	if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidMirrors {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidMirrors)
+	}
+}
+
+func TestValidateSilence(t *testing.T) {
+	jc := proto.JobChain{
+		Jobs:    mock.InitJobs(1),
+		Silence: &proto.Silence{Matchers: map[string]string{"instance": "db1-.*"}, Duration: "2h"},
+	}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+
+	for _, s := range []proto.Silence{
+		{},
+		{Matchers: map[string]string{"instance": "db1-("}},
+		{Matchers: map[string]string{"instance": "db1"}, Duration: "-1h"},
+	} {
+		jc.Silence = &s
+		err := Validate(jc)
+		if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidSilence {
+			t.Errorf("%+v: err = %v, expected %s", s, err, ErrInvalidSilence)
+		}
+	}
+}
+
+func TestValidateBudget(t *testing.T) {
+	jc := proto.JobChain{RequestId: 1, Jobs: mock.InitJobs(1), Budget: 100}
+	if err := Validate(jc); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	jc.Budget = -1
+	err := Validate(jc)
+	if verr, ok := err.(*ValidationError); !ok || verr.Err != ErrInvalidBudget {
+		t.Errorf("err = %v, expected %s", err, ErrInvalidBudget)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017, Square, Inc.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/payload"
+	"github.com/square/spincycle/proto"
+)
+
+// An AgentClient is an HTTP client used by a spincycle-agent to get work from
+// the JR and send updates for it.
+type AgentClient interface {
+	// Register registers the agent with the JR and returns the JR's response
+	// to the version handshake. It negotiates the payload options used after
+	// it.
+	Register(proto.Agent) (proto.AgentRegistration, error)
+	// Next waits up to wait for work for the agent. It returns false if there
+	// is no work.
+	Next(agentName string, wait time.Duration) (proto.AgentWork, bool, error)
+	// Update sends an update for work running on the agent.
+	Update(agentName, workId string, u proto.AgentUpdate) (proto.AgentUpdateResponse, error)
+	// Download downloads a file from an API path, like proto.AgentUpgrade.Path.
+	Download(path string) ([]byte, error)
+}
+
+type agentClient struct {
+	*http.Client
+	baseUrl string
+	token   string
+	want    payload.Codec // payload options the agent uses if the JR supports them
+	// --
+	codec       payload.Codec // payload options negotiated by Register
+	*sync.Mutex               // guards codec
+}
+
+// NewAgentClient takes an http.Client and base API URL and creates an
+// AgentClient. If token is set, it's sent as a bearer token on every request.
+// The http.Client timeout, if any, must be longer than the wait given to Next.
+func NewAgentClient(c *http.Client, baseUrl, token string) AgentClient {
+	return &agentClient{
+		Client:  c,
+		baseUrl: baseUrl,
+		token:   token,
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// NewAgentClientWithPayload creates an AgentClient like NewAgentClient that
+// encodes payloads with the options of want (see package payload), negotiated
+// when the agent registers: payloads are compressed if want.Gzip and the JR
+// supports it. If want.Cipher is set, payloads are always encrypted, and
+// Register returns an error if the JR has no key for the agent's pool.
+func NewAgentClientWithPayload(c *http.Client, baseUrl, token string, want payload.Codec) AgentClient {
+	ac := NewAgentClient(c, baseUrl, token).(*agentClient)
+	ac.want = want
+	ac.codec = payload.Codec{Cipher: want.Cipher} // never plain before Register
+	return ac
+}
+
+func (c *agentClient) Register(a proto.Agent) (proto.AgentRegistration, error) {
+	// POST /api/v1/agents
+	var reg proto.AgentRegistration
+	p, err := json.Marshal(a)
+	if err != nil {
+		return reg, err
+	}
+	resp, body, err := c.send("POST", c.baseUrl+"/api/v1/agents", payload.Codec{}, p)
+	if err != nil {
+		return reg, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return reg, apiError(resp, body)
+	}
+	if err := json.Unmarshal(body, &reg); err != nil {
+		return reg, err
+	}
+
+	// Negotiate the payload options
+	codec := c.want
+	supported := map[string]bool{}
+	for _, o := range reg.Payload {
+		supported[o] = true
+	}
+	codec.Gzip = codec.Gzip && supported[payload.GZIP]
+	if codec.Cipher != nil && !supported[payload.AES_GCM] {
+		return reg, fmt.Errorf("the JR can't decrypt payloads from this agent: it has no key for pool %s", a.Pool)
+	}
+	c.Lock()
+	c.codec = codec
+	c.Unlock()
+	return reg, nil
+}
+
+func (c *agentClient) Next(agentName string, wait time.Duration) (proto.AgentWork, bool, error) {
+	// GET /api/v1/agents/${agentName}/work?wait=${wait}
+	reqUrl := fmt.Sprintf(c.baseUrl+"/api/v1/agents/%s/work?wait=%s", url.PathEscape(agentName), wait)
+	var work proto.AgentWork
+	resp, body, err := c.send("GET", reqUrl, c.negotiated(), nil)
+	if err != nil {
+		return work, false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return work, false, nil
+	default:
+		return work, false, apiError(resp, body)
+	}
+	if err := json.Unmarshal(body, &work); err != nil {
+		return work, false, err
+	}
+	return work, true, nil
+}
+
+func (c *agentClient) Update(agentName, workId string, u proto.AgentUpdate) (proto.AgentUpdateResponse, error) {
+	// POST /api/v1/agents/${agentName}/work/${workId}
+	reqUrl := fmt.Sprintf(c.baseUrl+"/api/v1/agents/%s/work/%s", url.PathEscape(agentName), url.PathEscape(workId))
+	var res proto.AgentUpdateResponse
+	p, err := json.Marshal(u)
+	if err != nil {
+		return res, err
+	}
+	resp, body, err := c.send("POST", reqUrl, c.negotiated(), p)
+	if err != nil {
+		return res, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res, apiError(resp, body)
+	}
+	err = json.Unmarshal(body, &res)
+	return res, err
+}
+
+func (c *agentClient) Download(path string) ([]byte, error) {
+	// GET /api/v1/${path}
+	resp, body, err := c.send("GET", c.baseUrl+"/api/v1/"+strings.TrimPrefix(path, "/"), payload.Codec{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp, body)
+	}
+	return body, nil
+}
+
+// ------------------------------------------------------------------------- //
+
+// negotiated returns the payload codec negotiated by Register.
+func (c *agentClient) negotiated() payload.Codec {
+	c.Lock()
+	defer c.Unlock()
+	return c.codec
+}
+
+// send sends a request with a body encoded with the codec, and returns the
+// response with its body decoded. A response without the X-Spincycle-Payload
+// header, like an error, isn't decoded, but a successful response must be
+// encrypted if the request was.
+func (c *agentClient) send(method, reqUrl string, codec payload.Codec, p []byte) (*http.Response, []byte, error) {
+	if p != nil && !codec.Plain() {
+		var err error
+		if p, err = codec.Encode(p); err != nil {
+			return nil, nil, err
+		}
+	}
+	req, err := http.NewRequest(method, reqUrl, bytes.NewReader(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if !codec.Plain() {
+		req.Header.Set(payload.HEADER, codec.Header())
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("http.Client.Do: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, fmt.Errorf("ioutil.ReadAll: %s", err)
+	}
+	if codec.Plain() {
+		return resp, body, nil
+	}
+	if resp.Header.Get(payload.HEADER) == "" {
+		if codec.Cipher != nil && resp.StatusCode == http.StatusOK {
+			return resp, nil, fmt.Errorf("response from the JR is not encrypted")
+		}
+		return resp, body, nil
+	}
+	if body, err = codec.Decode(body); err != nil {
+		return resp, nil, fmt.Errorf("can't decode response: %s", err)
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,76 @@
+package client_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+)
+
+func TestAgentNext(t *testing.T) {
+	var auth, query string
+	work := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		query = r.URL.RawQuery
+		if r.URL.Path != "/api/v1/agents/host1/work" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !work {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprintln(w, `{"id":"w1","requestId":3,"job":{"name":"job1"}}`)
+	}))
+	defer ts.Close()
+	c := client.NewAgentClient(&http.Client{}, ts.URL, "tok")
+
+	got, ok, err := c.Next("host1", 5*time.Second)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v, expected work", ok, err)
+	}
+	if got.Id != "w1" || got.RequestId != 3 || got.Job.Name != "job1" {
+		t.Errorf("work = %+v, expected w1", got)
+	}
+	if auth != "Bearer tok" {
+		t.Errorf("Authorization = %q, expected Bearer tok", auth)
+	}
+	if query != "wait=5s" {
+		t.Errorf("query = %q, expected wait=5s", query)
+	}
+
+	work = false
+	if _, ok, err := c.Next("host1", time.Second); ok || err != nil {
+		t.Errorf("got %t, %v, expected no work", ok, err)
+	}
+	if _, ok, err := c.Next("host2", time.Second); ok || err == nil {
+		t.Errorf("got %t, %v, expected an error", ok, err)
+	}
+}
+
+func TestAgentUpdate(t *testing.T) {
+	var method, path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		fmt.Fprintln(w, `{"stop":true}`)
+	}))
+	defer ts.Close()
+	c := client.NewAgentClient(&http.Client{}, ts.URL, "")
+
+	res, err := c.Update("host1", "w1", proto.AgentUpdate{Status: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Stop {
+		t.Error("Stop = false, expected true")
+	}
+	if method != "POST" || path != "/api/v1/agents/host1/work/w1" {
+		t.Errorf("request = %s %s, expected POST /api/v1/agents/host1/work/w1", method, path)
+	}
+}
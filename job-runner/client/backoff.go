@@ -0,0 +1,94 @@
+// Copyright 2017, Square, Inc.
+
+package client
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// HostBackoff is backoff state shared by every request to the same JR host,
+// across goroutines and clients. When requests to a host fail, all requests
+// to it wait for the backoff, which grows with every consecutive failure,
+// instead of each request retrying on its own schedule. This keeps a JR that
+// is down from being flooded with retries when it comes back.
+type HostBackoff struct {
+	hosts map[string]*hostBackoff
+	// --
+	*sync.Mutex // guards hosts
+}
+
+type hostBackoff struct {
+	failures uint      // consecutive failed requests
+	until    time.Time // requests wait until this time
+}
+
+// NewHostBackoff returns a HostBackoff for Retry.Backoff. Share it between all
+// clients that send requests to the same JRs.
+func NewHostBackoff() *HostBackoff {
+	return &HostBackoff{
+		hosts: make(map[string]*hostBackoff),
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Wait returns how long requests to the host must wait before they are sent.
+func (b *HostBackoff) Wait(host string) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	h, ok := b.hosts[host]
+	if !ok {
+		return 0
+	}
+	if wait := h.until.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Failure records a failed request to the host and backs off the host
+// according to the retry policy.
+func (b *HostBackoff) Failure(host string, retry Retry) {
+	b.Lock()
+	defer b.Unlock()
+	h, ok := b.hosts[host]
+	if !ok {
+		h = &hostBackoff{}
+		b.hosts[host] = h
+	}
+	h.failures++
+	until := time.Now().Add(retry.delay(h.failures))
+	if until.After(h.until) {
+		h.until = until
+	}
+}
+
+// Success records a successful request to the host, which resets its backoff.
+func (b *HostBackoff) Success(host string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.hosts, host)
+}
+
+// -------------------------------------------------------------------------- //
+
+// delay returns how long to wait after the given number of consecutive failed
+// tries: Wait doubled after every failure, capped at MaxWait, with random
+// jitter of up to half the wait so that clients don't retry in lockstep.
+func (r Retry) delay(failures uint) time.Duration {
+	wait := r.Wait
+	for i := uint(1); i < failures; i++ {
+		if r.MaxWait > 0 && wait >= r.MaxWait {
+			break
+		}
+		wait *= 2
+	}
+	if r.MaxWait > 0 && wait > r.MaxWait {
+		wait = r.MaxWait
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
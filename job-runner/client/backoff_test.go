@@ -0,0 +1,35 @@
+// Copyright 2017, Square, Inc.
+
+package client_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/client"
+)
+
+func TestHostBackoff(t *testing.T) {
+	b := client.NewHostBackoff()
+	retry := client.Retry{Wait: time.Hour, MaxWait: time.Minute}
+
+	if wait := b.Wait("jr1"); wait != 0 {
+		t.Errorf("wait = %s, expected 0 before any failures", wait)
+	}
+
+	// The wait is capped at MaxWait, and it's only for the host that failed.
+	for i := 0; i < 3; i++ {
+		b.Failure("jr1", retry)
+	}
+	if wait := b.Wait("jr1"); wait <= 0 || wait > time.Minute {
+		t.Errorf("wait = %s, expected between 0 and 1m", wait)
+	}
+	if wait := b.Wait("jr2"); wait != 0 {
+		t.Errorf("jr2 wait = %s, expected 0", wait)
+	}
+
+	b.Success("jr1")
+	if wait := b.Wait("jr1"); wait != 0 {
+		t.Errorf("wait = %s, expected 0 after a success", wait)
+	}
+}
@@ -1,42 +1,138 @@
 // Package client provides an HTTP client for interacting with the Job Runner (JR) API.
+//
+// This package is a stable API, like package proto: exported names aren't
+// removed or changed except in a major release. New methods can be added to
+// JRClient and AgentClient, so implementations outside Spin Cycle should embed
+// one to keep compiling.
 package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/square/spincycle/proto"
 )
 
-// A JRClient is an HTTP client used for interacting with the JR API.
+// A JRClient is an HTTP client used for interacting with the JR API. An error
+// response from the JR is returned as a proto.Error, so callers can switch on
+// its Code. If ctx is done before the JR responds, like when the caller's own
+// client went away, the request and its retries are canceled.
 type JRClient interface {
 	// NewJobChain takes a job chain and sends it to the JR.
-	NewJobChain(proto.JobChain) error
+	NewJobChain(context.Context, proto.JobChain) error
+	// NewJobChains sends many job chains to the JR in one call, at most 100,
+	// and returns whether each one was added.
+	NewJobChains(context.Context, proto.JobChainBatch) (proto.JobChainBatchResult, error)
 	// StartRequest starts the job chain that corresponds to a given request Id.
-	StartRequest(uint) error
+	StartRequest(context.Context, uint) error
+	// StartRequestLocation starts the job chain like StartRequest and returns
+	// its location: the Location header of the response, which is the URL of
+	// the chain on the JR that runs it, like jr1/api/v1/job-chains/1.
+	StartRequestLocation(context.Context, uint) (string, error)
 	// StopRequest stops the job chain that corresponds to a given request Id.
-	StopRequest(uint) error
+	StopRequest(context.Context, uint) error
 	// RequestStatus gets the status of the job chain that corresponds to a given request Id.
-	RequestStatus(uint) (*proto.JobChainStatus, error)
+	RequestStatus(context.Context, uint) (*proto.JobChainStatus, error)
+	// RequestStatuses gets the status of the job chains of many request Ids
+	// in one call, at most 100. Chains the JR doesn't have are in NotFound.
+	RequestStatuses(context.Context, []uint) (proto.JobChainStatuses, error)
+	// Health gets the health of the JR, with the chains running and queued on it.
+	Health(context.Context) (proto.JobRunnerHealth, error)
+}
+
+// Retry configures how a JRClient retries requests. A request is retried if
+// the JR can't be reached or it responds 502, 503, or 504. Sending a job chain
+// again is safe because the JR ignores a chain it already has, but if the
+// response to a start or stop request is lost, its retry fails because the
+// chain was already started or stopped.
+//
+// The wait between tries doubles after every failed try, up to MaxWait, with
+// random jitter. If Backoff is set, the wait is shared by all requests to the
+// same host (see HostBackoff). If Hedge is set, a GET request that hasn't
+// gotten a response after Hedge is sent again, and the first response wins.
+type Retry struct {
+	Retries uint          // max number of times to retry a request, 0 for none
+	Wait    time.Duration // wait after the first failed try
+	MaxWait time.Duration // max wait between tries, 0 for no max
+	Backoff *HostBackoff  // backoff shared by requests to the same host, if set
+	Hedge   time.Duration // send a GET request again if it takes this long, 0 to not hedge
 }
 
 type jrClient struct {
 	*http.Client
 	baseUrl string
+	retry   Retry
 }
 
 // NewJRClient takes an http.Client and base API URL and creates a JRClient.
+// Requests are not retried.
 func NewJRClient(c *http.Client, baseUrl string) JRClient {
+	return NewJRClientWithRetry(c, baseUrl, Retry{})
+}
+
+// NewJRClientWithRetry creates a JRClient like NewJRClient that retries
+// requests.
+func NewJRClientWithRetry(c *http.Client, baseUrl string, retry Retry) JRClient {
 	return &jrClient{
 		Client:  c,
 		baseUrl: baseUrl,
+		retry:   retry,
+	}
+}
+
+// NewHTTPClient makes an http.Client for NewJRClient. timeout limits every
+// request, including reading the response; zero means no timeout. If tlsConfig
+// is not nil, it's used to connect to a JR at an https base URL, e.g. to trust
+// the CA of the JR's certificate or to present a client certificate.
+func NewHTTPClient(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	c := &http.Client{
+		Timeout: timeout,
+	}
+	if tlsConfig != nil {
+		c.Transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	return c
+}
+
+// WithToken returns a copy of the http.Client c that sends token as a bearer
+// token on every request, like the JR's -operator-token when it runs with
+// -require-auth. Don't use it for requests to anything but JRs.
+func WithToken(c *http.Client, token string) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
 	}
+	withToken := *c
+	withToken.Transport = tokenTransport{token: token, next: next}
+	return &withToken
 }
 
-func (c *jrClient) NewJobChain(jobChain proto.JobChain) error {
+// tokenTransport sets the Authorization header of every request.
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context()) // a RoundTripper must not modify the request
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
+func (c *jrClient) NewJobChain(ctx context.Context, jobChain proto.JobChain) error {
 	// POST /api/v1/job-chains
 	url := c.baseUrl + "/api/v1/job-chains"
 
@@ -47,67 +143,93 @@ func (c *jrClient) NewJobChain(jobChain proto.JobChain) error {
 	}
 
 	// Make the request.
-	resp, body, err := c.post(url, payload)
+	resp, body, err := c.post(ctx, url, payload)
 	if err != nil {
 		return err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unsuccessful status code: %d (response body: %s)",
-			resp.StatusCode, string(body))
+		return apiError(resp, body)
 	}
 
 	return nil
 }
 
-func (c *jrClient) StartRequest(requestId uint) error {
+func (c *jrClient) NewJobChains(ctx context.Context, batch proto.JobChainBatch) (proto.JobChainBatchResult, error) {
+	// POST /api/v1/job-chains/batch
+	url := c.baseUrl + "/api/v1/job-chains/batch"
+
+	var result proto.JobChainBatchResult
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return result, err
+	}
+
+	resp, body, err := c.post(ctx, url, payload)
+	if err != nil {
+		return result, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return result, apiError(resp, body)
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+func (c *jrClient) StartRequest(ctx context.Context, requestId uint) error {
+	_, err := c.StartRequestLocation(ctx, requestId)
+	return err
+}
+
+func (c *jrClient) StartRequestLocation(ctx context.Context, requestId uint) (string, error) {
 	// PUT /api/v1/job-chains/${requestId}/start
 	url := fmt.Sprintf(c.baseUrl+"/api/v1/job-chains/%d/start", requestId)
 
 	// Make the request.
-	resp, body, err := c.put(url)
+	resp, body, err := c.put(ctx, url)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unsuccessful status code: %d (response body: %s)",
-			resp.StatusCode, string(body))
+		return "", apiError(resp, body)
 	}
 
-	return nil
+	return resp.Header.Get("Location"), nil
 }
 
-func (c *jrClient) StopRequest(requestId uint) error {
+func (c *jrClient) StopRequest(ctx context.Context, requestId uint) error {
 	// PUT /api/v1/job-chains/${requestId}/stop
 	url := fmt.Sprintf(c.baseUrl+"/api/v1/job-chains/%d/stop", requestId)
 
 	// Make the request.
-	resp, body, err := c.put(url)
+	resp, body, err := c.put(ctx, url)
 	if err != nil {
 		return err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unsuccessful status code: %d (response body: %s)",
-			resp.StatusCode, string(body))
+		return apiError(resp, body)
 	}
 	return nil
 }
 
-func (c *jrClient) RequestStatus(requestId uint) (*proto.JobChainStatus, error) {
+func (c *jrClient) RequestStatus(ctx context.Context, requestId uint) (*proto.JobChainStatus, error) {
 	// GET /api/v1/job-chains/${requestId}/status
 	url := fmt.Sprintf(c.baseUrl+"/api/v1/job-chains/%d/status", requestId)
 
 	// Make the request.
-	resp, body, err := c.get(url)
+	resp, body, err := c.get(ctx, url)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unsuccessful status code: %d (response body: %s)",
-			resp.StatusCode, string(body))
+		return nil, apiError(resp, body)
 	}
 
 	// Unmarshal the response.
@@ -120,49 +242,170 @@ func (c *jrClient) RequestStatus(requestId uint) (*proto.JobChainStatus, error)
 	return status, nil
 }
 
-// ------------------------------------------------------------------------- //
+func (c *jrClient) RequestStatuses(ctx context.Context, requestIds []uint) (proto.JobChainStatuses, error) {
+	// GET /api/v1/job-chains/status?ids=${requestId},...
+	ids := make([]string, len(requestIds))
+	for i, id := range requestIds {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	url := c.baseUrl + "/api/v1/job-chains/status?ids=" + strings.Join(ids, ",")
 
-func (c *jrClient) get(url string) (*http.Response, []byte, error) {
-	// Create the request.
-	req, err := http.NewRequest("GET", url, nil)
+	// Make the request.
+	var statuses proto.JobChainStatuses
+	resp, body, err := c.get(ctx, url)
 	if err != nil {
-		return nil, nil, err
+		return statuses, err
 	}
 
-	// Send the request.
-	resp, body, err := c.do(req)
-	if err != nil {
-		return nil, nil, err
+	if resp.StatusCode != http.StatusOK {
+		return statuses, apiError(resp, body)
 	}
 
-	return resp, body, nil
+	// Unmarshal the response.
+	err = json.Unmarshal(body, &statuses)
+	return statuses, err
 }
 
-func (c *jrClient) put(url string) (*http.Response, []byte, error) {
-	// Create the request.
-	req, err := http.NewRequest("PUT", url, nil)
+func (c *jrClient) Health(ctx context.Context) (proto.JobRunnerHealth, error) {
+	// GET /api/v1/health
+	url := c.baseUrl + "/api/v1/health"
+
+	// Make the request.
+	resp, body, err := c.get(ctx, url)
 	if err != nil {
-		return nil, nil, err
+		return proto.JobRunnerHealth{}, err
 	}
 
-	// Send the request.
-	resp, body, err := c.do(req)
-	if err != nil {
-		return nil, nil, err
+	if resp.StatusCode != http.StatusOK {
+		return proto.JobRunnerHealth{}, apiError(resp, body)
 	}
 
-	return resp, body, nil
+	// Unmarshal the response.
+	var health proto.JobRunnerHealth
+	if err := json.Unmarshal(body, &health); err != nil {
+		return proto.JobRunnerHealth{}, err
+	}
+
+	return health, nil
 }
 
-func (c *jrClient) post(url string, payload []byte) (*http.Response, []byte, error) {
+// ------------------------------------------------------------------------- //
+
+func (c *jrClient) get(ctx context.Context, url string) (*http.Response, []byte, error) {
+	return c.send(ctx, "GET", url, nil)
+}
+
+func (c *jrClient) put(ctx context.Context, url string) (*http.Response, []byte, error) {
+	return c.send(ctx, "PUT", url, nil)
+}
+
+func (c *jrClient) post(ctx context.Context, url string, payload []byte) (*http.Response, []byte, error) {
+	return c.send(ctx, "POST", url, payload)
+}
+
+// send sends a request, retrying it according to the client's retry policy,
+// until ctx is done.
+func (c *jrClient) send(ctx context.Context, method, reqUrl string, payload []byte) (*http.Response, []byte, error) {
+	var host string
+	if u, err := url.Parse(reqUrl); err == nil {
+		host = u.Host
+	}
+
+	for try := uint(1); ; try++ {
+		// Wait if requests to the host are backing off.
+		if c.retry.Backoff != nil {
+			if err := sleep(ctx, c.retry.Backoff.Wait(host)); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// Send the request.
+		var resp *http.Response
+		var body []byte
+		var err error
+		if method == "GET" && c.retry.Hedge > 0 {
+			resp, body, err = c.hedge(ctx, method, reqUrl, payload)
+		} else {
+			resp, body, err = c.try(ctx, method, reqUrl, payload)
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		if !retryable(resp, err) {
+			if c.retry.Backoff != nil {
+				c.retry.Backoff.Success(host)
+			}
+			return resp, body, err
+		}
+
+		if c.retry.Backoff != nil {
+			c.retry.Backoff.Failure(host, c.retry)
+		}
+		if try > c.retry.Retries {
+			return resp, body, err
+		}
+		if c.retry.Backoff == nil {
+			if err := sleep(ctx, c.retry.delay(try)); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// sleep sleeps for d, or returns ctx.Err() if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hedge sends a request, and sends it again if it hasn't gotten a response
+// after the hedge delay. It returns the first response and cancels the other
+// request.
+func (c *jrClient) hedge(ctx context.Context, method, reqUrl string, payload []byte) (*http.Response, []byte, error) {
+	type result struct {
+		resp *http.Response
+		body []byte
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	send := func() {
+		resp, body, err := c.try(ctx, method, reqUrl, payload)
+		results <- result{resp, body, err}
+	}
+
+	go send()
+	select {
+	case r := <-results:
+		return r.resp, r.body, r.err
+	case <-time.After(c.retry.Hedge):
+	}
+
+	go send()
+	r := <-results
+	return r.resp, r.body, r.err
+}
+
+// try makes a request and sends it once. The request is made again for every
+// try because its body is consumed.
+func (c *jrClient) try(ctx context.Context, method, reqUrl string, payload []byte) (*http.Response, []byte, error) {
 	// Create the request.
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	req, err := http.NewRequest(method, reqUrl, bytes.NewReader(payload))
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Send the request.
-	resp, body, err := c.do(req)
+	resp, body, err := c.do(req.WithContext(ctx))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -170,6 +413,30 @@ func (c *jrClient) post(url string, payload []byte) (*http.Response, []byte, err
 	return resp, body, nil
 }
 
+// apiError returns the error of an unsuccessful response: the proto.Error in
+// the body, so callers can switch on its Code, or an error with the status
+// code and body if the body isn't one, like from a proxy.
+func apiError(resp *http.Response, body []byte) error {
+	var e proto.Error
+	if err := json.Unmarshal(body, &e); err == nil && e.Code != "" {
+		return e
+	}
+	return fmt.Errorf("unsuccessful status code: %d (response body: %s)", resp.StatusCode, string(body))
+}
+
+// retryable returns true if a request that got resp or err should be retried
+// because the JR couldn't be reached or is temporarily unavailable.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
 func (c *jrClient) do(req *http.Request) (*http.Response, []byte, error) {
 	resp, err := c.Client.Do(req)
 	if err != nil {
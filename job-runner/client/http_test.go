@@ -1,12 +1,17 @@
 package client_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/square/spincycle/job-runner/client"
@@ -20,7 +25,7 @@ func TestStartRequest(t *testing.T) {
 	}))
 	c := client.NewJRClient(&http.Client{}, ts.URL)
 
-	err := c.StartRequest(3)
+	err := c.StartRequest(context.Background(), 3)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
@@ -36,7 +41,7 @@ func TestStartRequest(t *testing.T) {
 	}))
 	c = client.NewJRClient(&http.Client{}, ts.URL)
 
-	err = c.StartRequest(3)
+	err = c.StartRequest(context.Background(), 3)
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
@@ -52,6 +57,22 @@ func TestStartRequest(t *testing.T) {
 	}
 }
 
+func TestStartRequestLocation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "jr1/api/v1/job-chains/3")
+	}))
+	defer ts.Close()
+	c := client.NewJRClient(&http.Client{}, ts.URL)
+
+	location, err := c.StartRequestLocation(context.Background(), 3)
+	if err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if location != "jr1/api/v1/job-chains/3" {
+		t.Errorf("location = %s, expected jr1/api/v1/job-chains/3", location)
+	}
+}
+
 func TestStopRequest(t *testing.T) {
 	// Unsuccessful response status code.
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,12 +80,25 @@ func TestStopRequest(t *testing.T) {
 	}))
 	c := client.NewJRClient(&http.Client{}, ts.URL)
 
-	err := c.StopRequest(3)
+	err := c.StopRequest(context.Background(), 3)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
 	ts.Close()
 
+	// An API error is returned as a proto.Error.
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, `{"code": "ERR_CHAIN_NOT_FOUND", "type": "not_found", "message": "Chain not found."}`)
+	}))
+	c = client.NewJRClient(&http.Client{}, ts.URL)
+
+	err = c.StopRequest(context.Background(), 3)
+	if e, ok := err.(proto.Error); !ok || e.Code != proto.ERR_CHAIN_NOT_FOUND {
+		t.Errorf("err = %#v, expected a proto.Error with code %s", err, proto.ERR_CHAIN_NOT_FOUND)
+	}
+	ts.Close()
+
 	// Successful response status code.
 	var path string
 	var method string
@@ -75,7 +109,7 @@ func TestStopRequest(t *testing.T) {
 	}))
 	c = client.NewJRClient(&http.Client{}, ts.URL)
 
-	err = c.StopRequest(3)
+	err = c.StopRequest(context.Background(), 3)
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
@@ -98,7 +132,7 @@ func TestRequestStatus(t *testing.T) {
 	}))
 	c := client.NewJRClient(&http.Client{}, ts.URL)
 
-	_, err := c.RequestStatus(3)
+	_, err := c.RequestStatus(context.Background(), 3)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
@@ -112,7 +146,7 @@ func TestRequestStatus(t *testing.T) {
 	}))
 	c = client.NewJRClient(&http.Client{}, ts.URL)
 
-	_, err = c.RequestStatus(3)
+	_, err = c.RequestStatus(context.Background(), 3)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
@@ -130,7 +164,7 @@ func TestRequestStatus(t *testing.T) {
 	}))
 	c = client.NewJRClient(&http.Client{}, ts.URL)
 
-	status, err := c.RequestStatus(3)
+	status, err := c.RequestStatus(context.Background(), 3)
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
@@ -160,6 +194,55 @@ func TestRequestStatus(t *testing.T) {
 	}
 }
 
+func TestRequestStatuses(t *testing.T) {
+	var requestURI string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.URL.RequestURI()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, "{\"statuses\":[{\"requestId\":3,\"jobStatuses\":[]}],\"notFound\":[4]}")
+	}))
+	defer ts.Close()
+	c := client.NewJRClient(&http.Client{}, ts.URL)
+
+	statuses, err := c.RequestStatuses(context.Background(), []uint{3, 4})
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if requestURI != "/api/v1/job-chains/status?ids=3,4" {
+		t.Errorf("request URI = %s, expected /api/v1/job-chains/status?ids=3,4", requestURI)
+	}
+	expectedStatuses := proto.JobChainStatuses{
+		Statuses: []proto.JobChainStatus{{RequestId: 3, JobStatuses: proto.JobStatuses{}}},
+		NotFound: []uint{4},
+	}
+	if diff := deep.Equal(statuses, expectedStatuses); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, "{\"ready\":true,\"runningChains\":4,\"queuedChains\":2}")
+	}))
+	defer ts.Close()
+	c := client.NewJRClient(&http.Client{}, ts.URL)
+
+	health, err := c.Health(context.Background())
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if path != "/api/v1/health" {
+		t.Errorf("url path = %s, expected /api/v1/health", path)
+	}
+	expectedHealth := proto.JobRunnerHealth{Ready: true, RunningChains: 4, QueuedChains: 2}
+	if diff := deep.Equal(health, expectedHealth); diff != nil {
+		t.Error(diff)
+	}
+}
+
 func TestNewJobChain(t *testing.T) {
 	// Make a job chain.
 	jc := proto.JobChain{
@@ -184,7 +267,7 @@ func TestNewJobChain(t *testing.T) {
 	}))
 	c := client.NewJRClient(&http.Client{}, ts.URL)
 
-	err := c.NewJobChain(jc)
+	err := c.NewJobChain(context.Background(), jc)
 	if err == nil {
 		t.Errorf("expected an error but did not get one")
 	}
@@ -212,7 +295,7 @@ func TestNewJobChain(t *testing.T) {
 	}))
 	c = client.NewJRClient(&http.Client{}, ts.URL)
 
-	err = c.NewJobChain(jc)
+	err = c.NewJobChain(context.Background(), jc)
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
@@ -231,3 +314,208 @@ func TestNewJobChain(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestNewJobChains(t *testing.T) {
+	batch := proto.JobChainBatch{
+		Mode:   proto.BATCH_MODE_ATOMIC,
+		Chains: []proto.JobChain{{RequestId: 3}, {RequestId: 4}},
+	}
+	expect := proto.JobChainBatchResult{
+		Mode: proto.BATCH_MODE_ATOMIC,
+		Results: []proto.AddedJobChain{
+			{RequestId: 3, Accepted: false, Code: proto.ERR_INVALID_DAG, Error: "cyclic"},
+			{RequestId: 4, Accepted: false, Code: proto.ERR_BATCH_REJECTED, Error: "rejected"},
+		},
+	}
+
+	var path string
+	var payload proto.JobChainBatch
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(expect)
+	}))
+	defer ts.Close()
+	c := client.NewJRClient(&http.Client{}, ts.URL)
+
+	result, err := c.NewJobChains(context.Background(), batch)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if path != "/api/v1/job-chains/batch" {
+		t.Errorf("url path = %s, expected /api/v1/job-chains/batch", path)
+	}
+	if diff := deep.Equal(payload, batch); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(result, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// The JR is unavailable for the first 2 tries.
+	tries := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := client.NewJRClientWithRetry(&http.Client{}, ts.URL, client.Retry{Retries: 1, Wait: time.Millisecond})
+	if err := c.NewJobChain(context.Background(), proto.JobChain{RequestId: 3}); err == nil {
+		t.Errorf("expected an error but did not get one")
+	}
+	if tries != 2 {
+		t.Errorf("tries = %d, expected 2", tries)
+	}
+
+	tries = 0
+	c = client.NewJRClientWithRetry(&http.Client{}, ts.URL, client.Retry{Retries: 2, Wait: time.Millisecond})
+	if err := c.NewJobChain(context.Background(), proto.JobChain{RequestId: 3}); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+	if tries != 3 {
+		t.Errorf("tries = %d, expected 3", tries)
+	}
+
+	// Client errors are not retried.
+	tries = 0
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	if err := c.StartRequest(context.Background(), 3); err == nil {
+		t.Errorf("expected an error but did not get one")
+	}
+	if tries != 1 {
+		t.Errorf("tries = %d, expected 1", tries)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	// The caller going away stops the retries, which would wait minutes.
+	c := client.NewJRClientWithRetry(&http.Client{}, ts.URL, client.Retry{Retries: 5, Wait: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.StopRequest(ctx, 3); err != context.DeadlineExceeded {
+		t.Errorf("err = %v, expected %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("StopRequest returned after %s, expected it canceled", elapsed)
+	}
+}
+
+func TestNewHTTPClientTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// Without the server's certificate, the client can't connect.
+	c := client.NewJRClient(client.NewHTTPClient(time.Second, &tls.Config{}), ts.URL)
+	if err := c.StartRequest(context.Background(), 3); err == nil {
+		t.Errorf("expected an error but did not get one")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	c = client.NewJRClient(client.NewHTTPClient(time.Second, &tls.Config{RootCAs: roots}), ts.URL)
+	if err := c.StartRequest(context.Background(), 3); err != nil {
+		t.Errorf("err = %s, expected nil", err)
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	httpClient := &http.Client{Timeout: time.Second}
+	c := client.NewJRClient(client.WithToken(httpClient, "op"), ts.URL)
+	if err := c.StartRequest(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer op" {
+		t.Errorf("Authorization = %q, expected Bearer op", auth)
+	}
+
+	// The client it was made from doesn't send the token
+	if _, err := httpClient.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		t.Errorf("Authorization = %q, expected none", auth)
+	}
+}
+
+func TestRetrySharedBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	// A request that fails backs off the host for other clients too.
+	backoff := client.NewHostBackoff()
+	retry := client.Retry{Wait: time.Minute, Backoff: backoff}
+	c := client.NewJRClientWithRetry(&http.Client{}, ts.URL, retry)
+	if err := c.StartRequest(context.Background(), 3); err == nil {
+		t.Errorf("expected an error but did not get one")
+	}
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := backoff.Wait(u.Host); wait < 30*time.Second {
+		t.Errorf("wait = %s, expected at least 30s", wait)
+	}
+}
+
+func TestRetryHedge(t *testing.T) {
+	// The first request hangs, the second one responds right away.
+	requests := make(chan struct{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		if len(requests) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fmt.Fprintln(w, `{"requestId":3}`)
+	}))
+	defer ts.Close()
+
+	c := client.NewJRClientWithRetry(&http.Client{}, ts.URL, client.Retry{Hedge: 10 * time.Millisecond})
+	start := time.Now()
+	status, err := c.RequestStatus(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if status.RequestId != 3 {
+		t.Errorf("request id = %d, expected 3", status.RequestId)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request took %s, expected the hedged request to respond quickly", d)
+	}
+	if len(requests) != 2 {
+		t.Errorf("got %d requests, expected 2", len(requests))
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2017, Square, Inc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/square/spincycle/job-runner/api"
+	"github.com/square/spincycle/job-runner/chain"
+)
+
+// reloadable are the flags that are reloaded from the config file on SIGHUP.
+// Changes to other flags in the config file need a restart.
+var reloadable = map[string]bool{
+	"log-level":          true,
+	"max-running-chains": true,
+	"job-type-limits":    true,
+}
+
+// commandLine are the flags set on the command line, which override the config
+// file. It's set by loadConfig.
+var commandLine = map[string]bool{}
+
+// readConfig reads a config file: a JSON object of flag names to values, like
+// {"max-running-chains": 10, "stop-grace": "1m"}. Values are strings,
+// numbers, or booleans. It returns an error if a flag is unknown.
+func readConfig(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber() // keep numbers as written
+	var values map[string]interface{}
+	if err := d.Decode(&values); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", file, err)
+	}
+	config := map[string]string{}
+	for name, v := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("invalid config file %s: unknown flag %s", file, name)
+		}
+		switch v.(type) {
+		case string, json.Number, bool:
+			config[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("invalid config file %s: %s is not a string, number, or boolean", file, name)
+		}
+	}
+	return config, nil
+}
+
+// loadConfig sets the flags in the config file, except flags set on the
+// command line, which override the config file.
+func loadConfig(file string) error {
+	config, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+	for name, value := range config {
+		if commandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %s", file, name, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig reads the config file again and applies the reloadable flags to
+// the running Job Runner. Flags set on the command line still override the
+// config file. Other flags that changed are logged and ignored.
+func reloadConfig(file string, jrAPI *api.API, typeLimiter *chain.TypeLimiter) error {
+	config, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	for name, value := range config {
+		if commandLine[name] {
+			continue
+		}
+		v, err := parseFlag(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %s", file, name, err)
+		}
+		if !reloadable[name] {
+			if v.String() != flag.Lookup(name).Value.String() {
+				log.Printf("Config file changed %s, restart to apply it", name)
+			}
+			continue
+		}
+		switch name {
+		case "log-level":
+			level, err := logrus.ParseLevel(value)
+			if err != nil {
+				return fmt.Errorf("invalid config file %s: %s: %s", file, name, err)
+			}
+			logrus.SetLevel(level)
+		case "max-running-chains":
+			jrAPI.SetMaxRunningChains(v.(flag.Getter).Get().(uint))
+		case "job-type-limits":
+			max, err := chain.ParseTypeLimits(value)
+			if err != nil {
+				return fmt.Errorf("invalid config file %s: %s: %s", file, name, err)
+			}
+			typeLimiter.SetLimits(max)
+		}
+		log.Printf("Reloaded %s = %s from config file", name, value)
+	}
+	return nil
+}
+
+// parseFlag parses the value of a flag into a new value of the same type, so
+// the flag itself isn't written while it might be read.
+func parseFlag(name, value string) (flag.Value, error) {
+	v := reflect.New(reflect.TypeOf(flag.Lookup(name).Value).Elem()).Interface().(flag.Value)
+	if err := v.Set(value); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017, Square, Inc.
+
+// Package deadletter keeps what the Job Runner couldn't deliver after every try,
+// like a chain's callback, so that it's never silently dropped. Admins list the
+// dead letters and retry or discard them with the API.
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/idgen"
+	"github.com/square/spincycle/proto"
+)
+
+// A Store keeps dead letters until they're removed. If Dir is set, every dead
+// letter is saved in Dir, so dead letters survive restarts: when the Job Runner
+// starts, it loads the saved ones with Load.
+type Store struct {
+	Dir string // where dead letters are saved, "" = not saved
+	// --
+	ids         idgen.Generator
+	letters     map[string]proto.DeadLetter // ID => dead letter
+	*sync.Mutex                             // guards letters
+}
+
+// NewStore makes an empty Store.
+func NewStore() *Store {
+	return &Store{
+		ids:     idgen.NewULID(),
+		letters: map[string]proto.DeadLetter{},
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// Add adds a dead letter, setting its ID and time, and saves it in Dir, if set.
+// It returns the dead letter as it was added. The dead letter is kept even if
+// it can't be saved.
+func (s *Store) Add(dl proto.DeadLetter) (proto.DeadLetter, error) {
+	id, err := s.ids.UID()
+	if err != nil {
+		return dl, err
+	}
+	dl.Id = id
+	dl.Time = time.Now()
+	s.Lock()
+	defer s.Unlock()
+	s.letters[dl.Id] = dl
+	return dl, s.save(dl)
+}
+
+// Update replaces a dead letter that's kept, like after a retry failed, and
+// saves it in Dir, if set. It returns false if the dead letter isn't kept.
+func (s *Store) Update(dl proto.DeadLetter) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.letters[dl.Id]; !ok {
+		return false, nil
+	}
+	s.letters[dl.Id] = dl
+	return true, s.save(dl)
+}
+
+// Get returns a dead letter, and false if it isn't kept.
+func (s *Store) Get(id string) (proto.DeadLetter, bool) {
+	s.Lock()
+	defer s.Unlock()
+	dl, ok := s.letters[id]
+	return dl, ok
+}
+
+// List returns every dead letter, oldest first.
+func (s *Store) List() []proto.DeadLetter {
+	s.Lock()
+	defer s.Unlock()
+	letters := make([]proto.DeadLetter, 0, len(s.letters))
+	for _, dl := range s.letters {
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Id < letters[j].Id })
+	return letters
+}
+
+// Remove removes a dead letter, and from Dir, if set. It returns false if the
+// dead letter isn't kept.
+func (s *Store) Remove(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.letters[id]; !ok {
+		return false
+	}
+	delete(s.letters, id)
+	if s.Dir != "" {
+		os.Remove(s.file(id))
+	}
+	return true
+}
+
+// Load loads the dead letters saved in Dir and returns how many there are. It
+// loads none if Dir is not set or doesn't exist yet.
+func (s *Store) Load() (int, error) {
+	if s.Dir == "" {
+		return 0, nil
+	}
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			return 0, err
+		}
+		var dl proto.DeadLetter
+		if err := json.Unmarshal(bytes, &dl); err != nil {
+			return 0, fmt.Errorf("can't decode dead letter %s: %s", f.Name(), err)
+		}
+		s.letters[dl.Id] = dl
+	}
+	return len(s.letters), nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// save writes the dead letter to Dir, if set, replacing it atomically. The
+// caller must hold the lock.
+func (s *Store) save(dl proto.DeadLetter) error {
+	if s.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	file := s.file(dl.Id)
+	if err := ioutil.WriteFile(file+".tmp", bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func (s *Store) file(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
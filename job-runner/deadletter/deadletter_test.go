@@ -0,0 +1,77 @@
+// Copyright 2017, Square, Inc.
+
+package deadletter_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/deadletter"
+	"github.com/square/spincycle/proto"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spincycle-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := deadletter.NewStore()
+	s.Dir = dir
+	dl1, err := s.Add(proto.DeadLetter{
+		Kind:      proto.DEAD_LETTER_CALLBACK,
+		RequestId: 1,
+		URL:       "http://rm/callback",
+		Body:      json.RawMessage(`{"requestId":1}`),
+		Error:     "unsuccessful status code: 503",
+		Tries:     5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl1.Id == "" || dl1.Time.IsZero() {
+		t.Errorf("dead letter = %+v, expected an ID and time", dl1)
+	}
+	dl2, err := s.Add(proto.DeadLetter{Kind: proto.DEAD_LETTER_SUSPENDED_CHAIN, RequestId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Oldest first
+	letters := s.List()
+	if len(letters) != 2 || letters[0].Id != dl1.Id || letters[1].Id != dl2.Id {
+		t.Errorf("dead letters = %+v, expected %s then %s", letters, dl1.Id, dl2.Id)
+	}
+
+	dl1.Tries++
+	if ok, err := s.Update(dl1); !ok || err != nil {
+		t.Errorf("Update = %t, %v; expected true, nil", ok, err)
+	}
+	if !s.Remove(dl2.Id) {
+		t.Errorf("Remove = false, expected true")
+	}
+	if s.Remove(dl2.Id) {
+		t.Errorf("Remove = true, expected false for a dead letter that was removed")
+	}
+
+	// Dead letters that are kept are loaded after a restart
+	s = deadletter.NewStore()
+	s.Dir = dir
+	n, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("loaded %d dead letters, expected 1", n)
+	}
+	got, ok := s.Get(dl1.Id)
+	if !ok {
+		t.Fatalf("dead letter %s not loaded", dl1.Id)
+	}
+	if got.Tries != 6 || got.URL != dl1.URL || string(got.Body) != string(dl1.Body) || !got.Time.Equal(dl1.Time) {
+		t.Errorf("dead letter = %+v, expected %+v", got, dl1)
+	}
+}
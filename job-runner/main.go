@@ -3,27 +3,517 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"expvar"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/square/spincycle/idgen"
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/agent"
 	"github.com/square/spincycle/job-runner/api"
 	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/job-runner/payload"
 	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/job-runner/schedule"
+	"github.com/square/spincycle/job-runner/silence"
 	"github.com/square/spincycle/job/external"
-	"github.com/square/spincycle/router"
+	"github.com/square/spincycle/job/plugin"
+	"github.com/square/spincycle/trace"
+
+	_ "github.com/go-sql-driver/mysql" // -mysql-dsn
+)
+
+var (
+	configFile        = flag.String("config", "", "JSON file of flag names to values (e.g. {\"max-running-chains\": 10}); flags on the command line override it, and SIGHUP reloads log-level, max-running-chains, and job-type-limits")
+	addr              = flag.String("addr", ":9999", "Address to listen on")
+	tlsCert           = flag.String("tls-cert", "", "Serve HTTPS with this certificate file (requires -tls-key)")
+	tlsKey            = flag.String("tls-key", "", "Private key file of -tls-cert")
+	tlsClientCA       = flag.String("tls-client-ca", "", "Verify client certificates (mTLS) given to the HTTPS server with the CAs in this file, and authenticate callers by them")
+	tlsRequireCert    = flag.Bool("tls-require-client-cert", true, "With -tls-client-ca, reject clients without a certificate; false = verify certificates only if given, so clients can use a token instead")
+	tlsReload         = flag.Duration("tls-reload-interval", time.Minute, "How often to reload -tls-cert, -tls-key, and -tls-client-ca if the files changed")
+	logLevel          = flag.String("log-level", "info", "Log level: debug, info, warning, error, fatal, or panic")
+	maxConcurrentJobs = flag.Uint("max-concurrent-jobs", 0, "Max job slots used at once across all chains (a job uses its cost in slots, default 1), 0 = no limit")
+	jobTypeLimits     = flag.String("job-type-limits", "", "Max jobs of a type running at once across all chains, like restart-db=3,drain-host=10")
+	maxRunningChains  = flag.Uint("max-running-chains", 0, "Max chains running at once, others wait in a queue by priority, 0 = no limit")
+	maxFinished       = flag.Uint("max-finished-chains", api.DEFAULT_MAX_FINISHED_CHAINS, "Max chains done running kept in memory with their results, least recently used are removed")
+	chainTTL          = flag.Duration("chain-ttl", 0, "Evict chains not started within this duration, 0 = never")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 5*time.Minute, "On shutdown, max time to wait for running jobs before stopping them")
+	stopGrace         = flag.Duration("stop-grace", api.DEFAULT_STOP_GRACE, "When a chain is stopped, max time to wait for each running job to stop before abandoning it")
+	strict            = flag.Bool("strict", false, "Reject job chains with unknown fields, duplicate jobs or edges, or unknown states")
+	scheduleDir       = flag.String("schedule-dir", "", "Save chains scheduled to start later in this directory so the schedules survive restarts")
+	scheduleTolerance = flag.Duration("schedule-tolerance", schedule.DEFAULT_TOLERANCE, "Max time a scheduled chain starts late if the system clock is set forward")
+	callbackSecret    = flag.String("callback-secret", "", "Sign callbacks to chains' callback URLs with HMAC-SHA256 using this secret (default: $SPINCYCLE_CALLBACK_SECRET)")
+	rmURL             = flag.String("rm-url", "", "On shutdown, send suspended chains to the Request Manager at this URL to be re-dispatched")
+	deadLetterDir     = flag.String("dead-letter-dir", "", "Save callbacks and suspended chains that couldn't be delivered in this directory so they survive restarts and can be retried")
+	idGenerator       = flag.String("id-generator", idgen.ULID, "Job try ID generator: ulid, ksuid, or snowflake")
+	nodeId            = flag.Uint("node-id", 0, "Unique ID of this Job Runner (0-1023) for the snowflake ID generator")
+	vaultAddr         = flag.String("vault-addr", "", "Resolve vault: job args from Vault at this address, using the token in $VAULT_TOKEN")
+	refAllowedPaths   = flag.String("ref-allowed-paths", "", "Comma-separated paths, like secret/jobs,kv/data/app, that vault: and consul: job args can refer to, and paths under them; \"\" = any path")
+	consulAddr        = flag.String("consul-addr", "", "Resolve consul: job args from the Consul KV store at this address")
+	envConfig         = flag.String("env-config", "", "JSON file of env label => config bundle (e.g. {\"prod\": {\"db_host\": \"db.prod\"}}) that jobs get by their chain's env label, resolved like job args")
+	agentToken        = flag.String("agent-token", "", "Enable spincycle-agents, which authenticate with this API token (default: $SPINCYCLE_AGENT_TOKEN)")
+	adminToken        = flag.String("admin-token", "", "API token of admins, who can stop all chains (default: $SPINCYCLE_ADMIN_TOKEN)")
+	operatorToken     = flag.String("operator-token", "", "API token of operators, like the Request Manager, which can make, start, stop, retry, and delete chains (default: $SPINCYCLE_OPERATOR_TOKEN)")
+	requireAuth       = flag.Bool("require-auth", false, "Only let operators, automation accounts, and admins make, start, stop, retry, and delete chains; reject anonymous callers")
+	automationToken   = flag.String("automation-token", "", "API token of automation accounts, like chatops or a portal, which can act on behalf of operators with the Spincycle-On-Behalf-Of header (default: $SPINCYCLE_AUTOMATION_TOKEN)")
+	agentPayloadKeys  = flag.String("agent-payload-keys", "", "Keys of agent pools that encrypt work and updates, like pool1=<key>,pool2=<key> with base64 32-byte keys (default: $SPINCYCLE_AGENT_PAYLOAD_KEYS)")
+	agentUpdateDir    = flag.String("agent-update-dir", "", "Directory of signed spincycle-agent binaries to upgrade agents with")
+	agentUpdateTo     = flag.String("agent-update-version", "", "Upgrade agents older than this version with the binaries in -agent-update-dir")
+	agentMaxUpgrades  = flag.Uint("agent-max-upgrades", 10, "Max agents upgrading at once, 0 = no limit")
+	rateLimit         = flag.String("rate-limit", "", "Max requests/second of each client to each endpoint, like 10 or 10:20 (rate:burst)")
+	routeRateLimits   = flag.String("route-rate-limits", "", "Max requests/second of all clients to some endpoints, like api-new-job-chain=5:10,api-start-job-chain=5")
+	logSpans          = flag.Bool("log-spans", false, "Log the distributed tracing span of every chain and job try")
+	artifactDir       = flag.String("artifact-dir", "", "Store artifacts output by jobs in this directory, served by the API")
+	artifactS3URL     = flag.String("artifact-s3-url", "", "Store artifacts output by jobs in this S3 bucket and key prefix, like https://s3.us-east-1.amazonaws.com/bucket/prefix, with the credentials in $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN")
+	artifactS3Region  = flag.String("artifact-s3-region", "us-east-1", "AWS region of -artifact-s3-url")
+	maxLogSize        = flag.Int("max-log-size", runner.MaxLogSize, "Max bytes of output kept in memory for each try of a job, older output is dropped, 0 = no limit")
+	cgroupRoot        = flag.String("cgroup-root", runner.CgroupRoot, "Cgroup (v2) in which jobs with cgroup isolation get a cgroup of their own")
+	cgroupFallback    = flag.Bool("cgroup-fallback", false, "Run jobs with cgroup isolation that can't get a cgroup with process limits only, which don't limit CPUs, instead of failing them")
+	chaosConfig       = flag.String("chaos-config", "", "JSON file of failures to inject into jobs (see runner.ChaosConfig), for test environments only")
+	runJob            = flag.Bool("run-job", false, "Run one job with resource limits, read from stdin, instead of the Job Runner (used by the Job Runner itself)")
+	mysqlDSN          = flag.String("mysql-dsn", "", "Save chains and their state changes in the MySQL database with this DSN (see chain.MYSQL_SCHEMA)")
+	repoFailure       = flag.String("repo-failure", chain.REPO_FAILURE_CONTINUE, "When a chain can't be saved to MySQL: continue running its jobs with the chain in memory, or pause them until it can be saved")
+	checkpointEvery   = flag.Duration("checkpoint-interval", chain.CheckpointInterval, "Save the jobData of running chains to the chain repo this often, not only when jobs finish, 0 = only when jobs finish")
+	scratchMaxSize    = flag.Int("scratch-max-size", chain.DEFAULT_SCRATCH_MAX_SIZE, "Max bytes of keys and values in the scratch of a request, which its jobs use for state that survives retries and restarts, 0 = no limit")
+	mysqlRetention    = flag.Duration("mysql-retention", 30*24*time.Hour, "Purge chains done for longer than this from MySQL, 0 = never")
+	alertmanagerURL   = flag.String("alertmanager-url", "", "Silence alerts about the targets of chains that have a silence while they run, in the Alertmanager at this URL")
+	auditLog          = flag.String("audit-log", "", "Record new, start, stop, status, and delete calls on chains in this file (JSON lines), or \"syslog\"")
+	jobPlugins        = flag.String("job-plugins", "", "Comma-separated Go plugins (.so) and directories of executables with more job types")
 )
 
 func main() {
-	// Make the API
-	runnerFactory := runner.NewRunnerFactory(external.JobFactory)
-	chainRepo := chain.NewMemoryRepo()
-	api := api.NewAPI(&router.Router{}, chainRepo, runnerFactory)
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logrus.SetLevel(level)
+
+	// Make job try IDs
+	tryIdGenerator, err := idgen.New(*idGenerator, *nodeId)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chain.TryIdGenerator = tryIdGenerator
+
+	// Record spans of chains and jobs. To export them to a tracing system,
+	// set chain.Tracer to a trace.Tracer for it here.
+	if *logSpans {
+		chain.Tracer = trace.LogTracer{}
+	}
+
+	// Jobs compiled in, then job types loaded from plugins, if any
+	jobFactory := plugin.Factories{external.JobFactory}
+	if *jobPlugins != "" {
+		loaded, err := plugin.Load(strings.Split(*jobPlugins, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		jobFactory = append(jobFactory, loaded...)
+	}
+
+	// Resolve job arg references, like secrets, right before jobs run. Chains
+	// can only refer to the allowed paths, if set.
+	resolvers := runner.ArgResolvers{}
+	resolverClient := &http.Client{Timeout: 10 * time.Second}
+	var allowedPaths []string
+	if *refAllowedPaths != "" {
+		allowedPaths = strings.Split(*refAllowedPaths, ",")
+	}
+	if *vaultAddr != "" {
+		if len(allowedPaths) == 0 {
+			log.Printf("WARNING: vault: job args can refer to any secret the Vault token can read; use -ref-allowed-paths to limit them")
+		}
+		resolvers = append(resolvers, runner.NewVaultResolver(resolverClient, *vaultAddr, os.Getenv("VAULT_TOKEN"), allowedPaths))
+	}
+	if *consulAddr != "" {
+		resolvers = append(resolvers, runner.NewConsulResolver(resolverClient, *consulAddr, allowedPaths))
+	}
+
+	// Give jobs the config of their chain's environment, like staging or prod
+	var configs runner.ConfigProvider
+	if *envConfig != "" {
+		bundles, err := runner.ReadConfigBundles(*envConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configs = bundles
+	}
+
+	// Keep artifacts output by jobs, like reports and diffs, in a directory
+	// or S3. Jobs run with -run-job store them in the same place.
+	var artifacts runner.ArtifactStore
+	switch {
+	case *artifactDir != "" && *artifactS3URL != "":
+		log.Fatal("Only one of -artifact-dir and -artifact-s3-url can be set")
+	case *artifactDir != "":
+		artifacts = runner.NewDirArtifactStore(*artifactDir)
+	case *artifactS3URL != "":
+		creds := runner.S3Credentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		s3, err := runner.NewS3ArtifactStore(&http.Client{Timeout: 30 * time.Second}, *artifactS3URL, *artifactS3Region, creds)
+		if err != nil {
+			log.Fatal(err)
+		}
+		artifacts = s3
+	}
+
+	// Run one job with resource limits in this process, started by the Job
+	// Runner below with the same flags
+	if *runJob {
+		stopChan := make(chan struct{})
+		go func() {
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+			<-sigChan
+			close(stopChan)
+		}()
+		rf := runner.NewRunnerFactory(jobFactory, nil, resolvers, configs, nil, artifacts)
+		if err := runner.RunProcess(rf, os.Stdin, os.Stdout, stopChan); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Warm up job types with expensive setup, and check their health
+	warmups := runner.NewWarmups(jobFactory)
+	if err := warmups.Warm(); err != nil {
+		log.Fatal(err)
+	}
+	go warmups.CheckHealth(30*time.Second, make(chan struct{}))
+	expvar.Publish("jobTypeHealth", expvar.Func(warmups.Health))
+
+	// Chains are kept in memory and, with -mysql-dsn, saved in MySQL so they
+	// outlive the Job Runner. The binary must be built with a MySQL driver
+	// registered as "mysql", like github.com/go-sql-driver/mysql.
+	var chainRepo chain.Repo = chain.NewMemoryRepo()
+	switch *repoFailure {
+	case chain.REPO_FAILURE_CONTINUE, chain.REPO_FAILURE_PAUSE:
+		chain.RepoFailurePolicy = *repoFailure
+	default:
+		log.Fatalf("Invalid -repo-failure %s: expected %s or %s", *repoFailure, chain.REPO_FAILURE_CONTINUE, chain.REPO_FAILURE_PAUSE)
+	}
+	if *checkpointEvery < 0 {
+		log.Fatalf("Invalid -checkpoint-interval %s: must not be negative", *checkpointEvery)
+	}
+	chain.CheckpointInterval = *checkpointEvery
+	if *mysqlDSN != "" {
+		db, err := sql.Open("mysql", *mysqlDSN)
+		if err != nil {
+			log.Fatalf("Can't open MySQL chain repo: %s", err)
+		}
+		mysqlRepo := chain.NewMySQLRepo(db)
+		if *mysqlRetention > 0 {
+			go mysqlRepo.PurgeHistory(*mysqlRetention, time.Hour, make(chan struct{}))
+		}
+		chainRepo = mysqlRepo
+	}
+
+	// Make the API. Jobs get the scratch of their request, saved with its
+	// chain.
+	scratches := chain.NewScratchStore(chainRepo, *scratchMaxSize)
+	runnerFactory := runner.NewRunnerFactory(jobFactory, warmups, resolvers, configs, scratches, artifacts)
+
+	// Run jobs with resource limits in a process of their own: this program
+	// with -run-job
+	runner.CgroupRoot = *cgroupRoot
+	runner.CgroupFallback = *cgroupFallback
+	if *maxLogSize < 0 {
+		log.Fatalf("Invalid -max-log-size %d: must not be negative", *maxLogSize)
+	}
+	runner.MaxLogSize = *maxLogSize
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	runnerFactory = runner.NewProcessRunnerFactory(runnerFactory, append([]string{exe, "-run-job"}, os.Args[1:]...))
+
+	// Limit jobs running at once across all chains, and jobs of some types.
+	// A job waiting for a slot of its type doesn't hold a global slot.
+	typeLimits, err := chain.ParseTypeLimits(*jobTypeLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	typeLimiter := chain.NewTypeLimiter(typeLimits)
+	limiter := chain.Limiters{typeLimiter, chain.NewLimiter(*maxConcurrentJobs)}
+	jrRouter := &router.Router{}
+
+	// Rate limit clients, like a Request Manager stuck retrying, with 429
+	// Too Many Requests
+	if *rateLimit != "" || *routeRateLimits != "" {
+		rateLimiter := router.NewTokenBucketLimiter()
+		if *rateLimit != "" {
+			if rateLimiter.PerClient, err = router.ParseRate(*rateLimit); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if rateLimiter.Routes, err = router.ParseRates(*routeRateLimits); err != nil {
+			log.Fatal(err)
+		}
+		jrRouter.RateLimiter = rateLimiter
+	}
+
+	// Only admins, which have the admin token, can stop all chains. Other
+	// callers are authenticated below.
+	tokens := router.TokenAuthenticator{}
+	roles := router.RoleAuthorizer{
+		"api-stop-all-job-chains":    {"admin"},
+		"api-quarantined-job-chains": {"admin"},
+		"api-recover-job-chain":      {"admin"},
+		"api-dead-letters":           {"admin"},
+		"api-dead-letter":            {"admin"},
+		"api-retry-dead-letter":      {"admin"},
+	}
+	jrRouter.Authorizer = roles
+	if *adminToken == "" {
+		*adminToken = os.Getenv("SPINCYCLE_ADMIN_TOKEN")
+	}
+	if *adminToken != "" {
+		tokens[*adminToken] = router.Caller{Name: "spincycle-admin", Roles: []string{"admin"}}
+	}
+
+	// Operators, which have the operator token or a client certificate with
+	// the operator role, can control chains. With -require-auth, only they,
+	// automation accounts, and admins can.
+	if *operatorToken == "" {
+		*operatorToken = os.Getenv("SPINCYCLE_OPERATOR_TOKEN")
+	}
+	if *operatorToken != "" {
+		tokens[*operatorToken] = router.Caller{Name: "spincycle-operator", Roles: []string{"operator"}}
+	}
+	if *requireAuth {
+		api.RequireAuth(roles)
+	}
+
+	// Automation accounts, which have the automation token, can act on behalf
+	// of operators. The audit log records both the account and the operator.
+	jrRouter.Impersonator = router.RoleImpersonator{"automation"}
+	if *automationToken == "" {
+		*automationToken = os.Getenv("SPINCYCLE_AUTOMATION_TOKEN")
+	}
+	if *automationToken != "" {
+		tokens[*automationToken] = router.Caller{Name: "spincycle-automation", Roles: []string{"automation"}}
+	}
+
+	// Run jobs with an agent pool on spincycle-agents. Only agents, which have
+	// the agent token, can call the agent endpoints.
+	var agents *agent.Registry
+	if *agentToken == "" {
+		*agentToken = os.Getenv("SPINCYCLE_AGENT_TOKEN")
+	}
+	if *agentToken != "" {
+		agents = agent.NewRegistry()
+		runnerFactory = agent.NewRunnerFactory(runnerFactory, agents)
+		if *agentPayloadKeys == "" {
+			*agentPayloadKeys = os.Getenv("SPINCYCLE_AGENT_PAYLOAD_KEYS")
+		}
+		if *agentPayloadKeys != "" {
+			keys, err := payload.ParseKeys(*agentPayloadKeys)
+			if err != nil {
+				log.Fatalf("invalid -agent-payload-keys: %s", err)
+			}
+			agents.SetPayloadKeys(keys)
+		}
+		if *agentUpdateDir != "" && *agentUpdateTo != "" {
+			agents.SetUpdateChannel(&agent.UpdateChannel{
+				Version:     *agentUpdateTo,
+				Dir:         *agentUpdateDir,
+				MaxUpgrades: *agentMaxUpgrades,
+			})
+		}
+		tokens[*agentToken] = router.Caller{Name: "spincycle-agent", Roles: []string{"agent"}}
+		for _, route := range []string{"api-agents", "api-agent-work", "api-agent-update", "api-agent-updates"} {
+			roles[route] = []string{"agent"}
+		}
+	}
+	if len(tokens) > 0 {
+		jrRouter.Authenticator = tokens
+	}
+
+	// Serve HTTPS with certificates that are reloaded when they're rotated.
+	// With a client CA, callers must have a client certificate (common name =
+	// caller name, organizational units = roles), unless
+	// -tls-require-client-cert=false lets them use a token instead.
+	var tlsLoader *router.TLSLoader
+	if *tlsCert != "" {
+		tlsLoader, err = router.NewTLSLoader(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireCert)
+		if err != nil {
+			log.Fatalf("Can't load TLS certificate: %s", err)
+		}
+		if *tlsClientCA != "" {
+			jrRouter.Authenticator = router.MultiAuthenticator{router.CertAuthenticator{}, tokens}
+		}
+	} else if *tlsClientCA != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert")
+	}
+	if *requireAuth && jrRouter.Authenticator == nil {
+		log.Fatal("-require-auth requires -operator-token, -automation-token, -admin-token, or -tls-client-ca, else nobody can control chains")
+	}
+	if !*requireAuth && jrRouter.Authenticator != nil {
+		log.Printf("WARNING: anonymous callers can make, start, stop, retry, and delete chains; use -require-auth to reject them")
+	}
+
+	// Inject failures into jobs to test how chains and requests handle them
+	if *chaosConfig != "" {
+		config, err := runner.ReadChaosConfig(*chaosConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if runnerFactory, err = runner.NewChaosRunnerFactory(runnerFactory, config); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("CHAOS MODE: injecting failures into jobs: %+v", config)
+	}
+
+	jrAPI := api.NewAPI(jrRouter, chainRepo, runnerFactory, limiter)
+	jrAPI.Strict = *strict
+	jrAPI.StopGrace = *stopGrace
+	jrAPI.SetMaxRunningChains(*maxRunningChains)
+	jrAPI.SetMaxFinishedChains(*maxFinished)
+	jrAPI.SetScheduleTolerance(*scheduleTolerance)
+	jrAPI.Agents = agents
+	jrAPI.JobDocs = job.Describe(jobFactory)
+	jrAPI.Artifacts = artifacts
+
+	// Silence alerts about the targets of chains while they run
+	if *alertmanagerURL != "" {
+		silencer := silence.NewAlertmanager(&http.Client{Timeout: 5 * time.Second}, *alertmanagerURL)
+		jrAPI.Hooks = silence.NewHooks(silencer)
+	}
+
+	// Record who did what to which chain
+	switch *auditLog {
+	case "":
+	case "syslog":
+		jrAPI.AuditLogger, err = api.NewSyslogAuditLogger("spincycle-job-runner")
+	default:
+		jrAPI.AuditLogger, err = api.NewFileAuditLogger(*auditLog)
+	}
+	if err != nil {
+		log.Fatalf("Can't open audit log: %s", err)
+	}
+
+	// Sign callbacks so receivers know they're from a Job Runner
+	if *callbackSecret == "" {
+		*callbackSecret = os.Getenv("SPINCYCLE_CALLBACK_SECRET")
+	}
+	if *callbackSecret != "" {
+		jrAPI.Callbacks.Secret = []byte(*callbackSecret)
+	}
+
+	// Keep what couldn't be delivered, and load what wasn't delivered before
+	// a restart, so admins can retry it
+	if *deadLetterDir != "" {
+		jrAPI.DeadLetters.Dir = *deadLetterDir
+		n, err := jrAPI.DeadLetters.Load()
+		if err != nil {
+			log.Fatalf("Can't load dead letters: %s", err)
+		}
+		if n > 0 {
+			log.Printf("Loaded %d dead letters, list them with GET dead-letters", n)
+		}
+	}
+
+	// Chains started with a future time are saved until they start, and ones
+	// saved before a restart are scheduled again
+	if *scheduleDir != "" {
+		n, err := jrAPI.RestoreScheduledChains(*scheduleDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Restored %d scheduled chains", n)
+	}
+
+	// Evict chains that are never started
+	if *chainTTL > 0 {
+		interval := time.Minute
+		if *chainTTL < 2*interval {
+			interval = *chainTTL / 2
+		}
+		go jrAPI.ExpireChains(*chainTTL, interval, make(chan struct{}))
+	}
 
 	// Make an HTTP server using API
 	h := http.NewServeMux()
-	h.Handle("/api/", api.Router)
+	h.Handle("/api/", jrAPI.Router)
+	h.Handle("/debug/vars", expvar.Handler()) // metrics
+
+	// On SIGINT or SIGTERM, suspend all chains before exiting so they can be
+	// resumed by another Job Runner (zero-downtime deploys). Then requests in
+	// flight, like long polls and log streams, are canceled so the server can
+	// shut down.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        *addr,
+		Handler:     h,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	doneChan := make(chan struct{})
+	if tlsLoader != nil {
+		server.TLSConfig = tlsLoader.Config()
+		go tlsLoader.Watch(*tlsReload, doneChan)
+	}
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		suspended := jrAPI.Shutdown(*shutdownTimeout)
+		log.Printf("Suspended %d chains", len(suspended))
+		if *rmURL != "" && len(suspended) > 0 {
+			client := &http.Client{Timeout: 10 * time.Second}
+			if err := api.PostSuspendedJobChains(client, *rmURL, suspended, jrAPI.DeadLetters); err != nil {
+				log.Print(err)
+			}
+		}
+
+		cancelRequests()
+		server.Shutdown(context.Background())
+		warmups.Close()
+		close(doneChan)
+	}()
+
+	// On SIGHUP, reload the settings in the config file that can change while
+	// running
+	if *configFile != "" {
+		go func() {
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, syscall.SIGHUP)
+			for range sigChan {
+				if err := reloadConfig(*configFile, jrAPI, typeLimiter); err != nil {
+					log.Printf("Can't reload config file: %s", err)
+				}
+			}
+		}()
+	}
 
 	// Listen and serve
-	err := http.ListenAndServe(":9999", h)
-	log.Fatal(err)
+	if tlsLoader != nil {
+		err = server.ListenAndServeTLS("", "") // files are in server.TLSConfig
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-doneChan
 }
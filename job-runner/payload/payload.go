@@ -0,0 +1,215 @@
+// Copyright 2017, Square, Inc.
+
+// Package payload encodes the bodies of requests and responses between the Job
+// Runner and spincycle-agents: compressed with gzip, encrypted with
+// AES-256-GCM, or both. This is independent of TLS, for links between
+// datacenters that are slow or where TLS terminates before the Job Runner.
+//
+// The agent sends the options it uses in the X-Spincycle-Payload header, like
+// "gzip,aes-256-gcm". The request body, if any, is encoded with them, and the
+// Job Runner encodes the response with them and sends the same header. The Job
+// Runner tells the agent which options it supports when the agent registers
+// (proto.AgentRegistration.Payload). Registration itself is never encoded.
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	HEADER  = "X-Spincycle-Payload"
+	GZIP    = "gzip"
+	AES_GCM = "aes-256-gcm"
+
+	// MAX_SIZE is the max bytes of a decoded payload, so a small compressed
+	// payload can't decompress into more than the Job Runner can hold.
+	MAX_SIZE = 64 << 20
+)
+
+var (
+	// ErrNoKey is returned by NewCodec if AES_GCM is given without a cipher.
+	ErrNoKey = errors.New("no key to encrypt payloads")
+
+	// ErrDecrypt is returned by Decode if a payload can't be decrypted: it was
+	// encrypted with another key or changed.
+	ErrDecrypt = errors.New("can't decrypt payload")
+
+	// ErrNotEncrypted is returned by NewCodec if a cipher is given but
+	// AES_GCM isn't: payloads that must be encrypted would be sent as-is.
+	ErrNotEncrypted = errors.New("payloads must be encrypted with " + AES_GCM)
+
+	// ErrTooLarge is returned by Decode if a payload decodes into more than
+	// MAX_SIZE bytes.
+	ErrTooLarge = errors.New("payload too large")
+)
+
+// A Codec encodes and decodes payloads. The zero value is plain: payloads are
+// sent as-is.
+type Codec struct {
+	Gzip   bool        // compress payloads with gzip
+	Cipher cipher.AEAD // if set, encrypt payloads (after compressing them)
+}
+
+// NewCodec returns the Codec for options, like ParseOptions returns. The
+// cipher is used for AES_GCM. It returns an error if an option is unknown,
+// ErrNoKey if AES_GCM is given and cipher is nil, or ErrNotEncrypted if cipher
+// is set and AES_GCM isn't given, so payloads can't be downgraded to plain by
+// leaving out the option.
+func NewCodec(options []string, c cipher.AEAD) (Codec, error) {
+	var codec Codec
+	for _, o := range options {
+		switch o {
+		case GZIP:
+			codec.Gzip = true
+		case AES_GCM:
+			if c == nil {
+				return Codec{}, ErrNoKey
+			}
+			codec.Cipher = c
+		default:
+			return Codec{}, fmt.Errorf("unknown payload option: %s", o)
+		}
+	}
+	if c != nil && codec.Cipher == nil {
+		return Codec{}, ErrNotEncrypted
+	}
+	return codec, nil
+}
+
+// ParseOptions parses the X-Spincycle-Payload header into options. It returns
+// nil for an empty header.
+func ParseOptions(header string) []string {
+	var options []string
+	for _, o := range strings.Split(header, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// Options returns the options of the codec, nil if it's plain.
+func (c Codec) Options() []string {
+	var options []string
+	if c.Gzip {
+		options = append(options, GZIP)
+	}
+	if c.Cipher != nil {
+		options = append(options, AES_GCM)
+	}
+	return options
+}
+
+// Header returns the X-Spincycle-Payload header of the codec, empty if it's
+// plain.
+func (c Codec) Header() string {
+	return strings.Join(c.Options(), ",")
+}
+
+// Plain returns true if the codec doesn't encode payloads.
+func (c Codec) Plain() bool {
+	return !c.Gzip && c.Cipher == nil
+}
+
+// Encode compresses and encrypts a payload. An encrypted payload is a random
+// nonce followed by the sealed data.
+func (c Codec) Encode(data []byte) ([]byte, error) {
+	if c.Gzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	if c.Cipher != nil {
+		nonce := make([]byte, c.Cipher.NonceSize(), c.Cipher.NonceSize()+len(data)+c.Cipher.Overhead())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		data = c.Cipher.Seal(nonce, nonce, data, nil)
+	}
+	return data, nil
+}
+
+// Decode decrypts and decompresses a payload encoded by Encode. It returns
+// ErrTooLarge if the payload decompresses into more than MAX_SIZE bytes.
+func (c Codec) Decode(data []byte) ([]byte, error) {
+	if c.Cipher != nil {
+		n := c.Cipher.NonceSize()
+		if len(data) < n {
+			return nil, ErrDecrypt
+		}
+		var err error
+		if data, err = c.Cipher.Open(nil, data[:n], data[n:], nil); err != nil {
+			return nil, ErrDecrypt
+		}
+	}
+	if c.Gzip {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if data, err = ioutil.ReadAll(io.LimitReader(r, MAX_SIZE+1)); err != nil {
+			return nil, err
+		}
+		if len(data) > MAX_SIZE {
+			return nil, ErrTooLarge
+		}
+	}
+	return data, nil
+}
+
+// NewCipher returns the AES-256-GCM cipher of a 32-byte key.
+func NewCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key: %d bytes, expected 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseKey returns the cipher of a base64 32-byte key.
+func ParseKey(s string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	return NewCipher(key)
+}
+
+// ParseKeys parses the keys of agent pools, like "pool1=<key>,pool2=<key>",
+// where every key is a base64 32-byte key. It returns the cipher of every
+// pool.
+func ParseKeys(s string) (map[string]cipher.AEAD, error) {
+	ciphers := map[string]cipher.AEAD{}
+	for _, kv := range strings.Split(s, ",") {
+		p := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("invalid pool key, expected pool=key")
+		}
+		c, err := ParseKey(p[1])
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %s", p[0], err)
+		}
+		ciphers[p[0]] = c
+	}
+	return ciphers, nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2017, Square, Inc.
+
+package payload_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/payload"
+)
+
+func TestCodec(t *testing.T) {
+	key1, err := payload.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := payload.NewCipher(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte(`{"status":"copying"}`), 100)
+
+	for _, c := range []payload.Codec{
+		{},
+		{Gzip: true},
+		{Cipher: key1},
+		{Gzip: true, Cipher: key1},
+	} {
+		encoded, err := c.Encode(data)
+		if err != nil {
+			t.Fatalf("%s: %s", c.Header(), err)
+		}
+		if c.Gzip && len(encoded) >= len(data) {
+			t.Errorf("%s: encoded %d bytes into %d, expected fewer", c.Header(), len(data), len(encoded))
+		}
+		if c.Cipher != nil && bytes.Contains(encoded, []byte("copying")) {
+			t.Errorf("%s: encoded payload is not encrypted", c.Header())
+		}
+		decoded, err := c.Decode(encoded)
+		if err != nil {
+			t.Fatalf("%s: %s", c.Header(), err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("%s: decoded payload is not the original", c.Header())
+		}
+
+		// Another key can't decrypt it, and changes are detected
+		if c.Cipher != nil {
+			if _, err := (payload.Codec{Gzip: c.Gzip, Cipher: key2}).Decode(encoded); err != payload.ErrDecrypt {
+				t.Errorf("%s: err = %v, expected ErrDecrypt with another key", c.Header(), err)
+			}
+			encoded[len(encoded)-1] ^= 1
+			if _, err := c.Decode(encoded); err != payload.ErrDecrypt {
+				t.Errorf("%s: err = %v, expected ErrDecrypt for a changed payload", c.Header(), err)
+			}
+		}
+	}
+}
+
+func TestNewCodec(t *testing.T) {
+	key, err := payload.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := payload.ParseOptions(" gzip, aes-256-gcm")
+	if !reflect.DeepEqual(options, []string{payload.GZIP, payload.AES_GCM}) {
+		t.Errorf("options = %q, expected gzip and aes-256-gcm", options)
+	}
+	c, err := payload.NewCodec(options, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Header() != "gzip,aes-256-gcm" {
+		t.Errorf("header = %s, expected gzip,aes-256-gcm", c.Header())
+	}
+	if payload.ParseOptions("") != nil {
+		t.Error("options of an empty header are not nil")
+	}
+
+	if _, err := payload.NewCodec(options, nil); err != payload.ErrNoKey {
+		t.Errorf("err = %v, expected ErrNoKey", err)
+	}
+	if _, err := payload.NewCodec([]string{"zstd"}, key); err == nil {
+		t.Error("no error for an unknown option")
+	}
+
+	// With a key, payloads can't be sent plain or only compressed
+	for _, options := range [][]string{nil, {payload.GZIP}} {
+		if _, err := payload.NewCodec(options, key); err != payload.ErrNotEncrypted {
+			t.Errorf("options %v: err = %v, expected ErrNotEncrypted", options, err)
+		}
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	c := payload.Codec{Gzip: true}
+	encoded, err := c.Encode(make([]byte, payload.MAX_SIZE+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) > 1<<20 {
+		t.Fatalf("encoded %d bytes, expected zeros to compress well", len(encoded))
+	}
+	if _, err := c.Decode(encoded); err != payload.ErrTooLarge {
+		t.Errorf("err = %v, expected ErrTooLarge", err)
+	}
+
+	encoded, err = c.Encode(make([]byte, payload.MAX_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Decode(encoded); err != nil || len(data) != payload.MAX_SIZE {
+		t.Errorf("got %d bytes, %v; expected MAX_SIZE bytes, nil", len(data), err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	keys, err := payload.ParseKeys("db=" + key + ", web=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys["db"] == nil || keys["web"] == nil {
+		t.Errorf("keys = %v, expected db and web", keys)
+	}
+
+	for _, s := range []string{"db", "=" + key, "db=notbase64!", "db=" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := payload.ParseKeys(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
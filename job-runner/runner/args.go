@@ -0,0 +1,194 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrArgNotFound is returned by an ArgResolver when the value an arg
+	// refers to does not exist.
+	ErrArgNotFound = errors.New("arg reference not found")
+)
+
+// An ArgResolver resolves job arg references (see proto.Job.Args), like
+// "vault:secret/db/password", to the values they refer to.
+type ArgResolver interface {
+	// Resolve returns the value that arg refers to and true. It returns false
+	// if arg is not a reference that it resolves.
+	Resolve(arg string) (value string, ok bool, err error)
+}
+
+// ArgResolvers is a chain of ArgResolver. For each arg, the resolvers are tried
+// in order and the first one that resolves it wins. Args that no resolver
+// resolves are literal values.
+type ArgResolvers []ArgResolver
+
+// Resolve returns args with every reference resolved. Error messages name the
+// arg and its reference but never a resolved value.
+func (c ArgResolvers) Resolve(args map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(args))
+ARGS:
+	for name, arg := range args {
+		for _, r := range c {
+			value, ok, err := r.Resolve(arg)
+			if err != nil {
+				return nil, fmt.Errorf("can't resolve arg %s (%s): %s", name, arg, err)
+			}
+			if ok {
+				resolved[name] = value
+				continue ARGS
+			}
+		}
+		resolved[name] = arg
+	}
+	return resolved, nil
+}
+
+// PrefixResolver returns an ArgResolver for args that start with prefix, like
+// "vault:". It calls lookup with the rest of the arg to get the value.
+func PrefixResolver(prefix string, lookup func(ref string) (string, error)) ArgResolver {
+	return prefixResolver{prefix: prefix, lookup: lookup}
+}
+
+type prefixResolver struct {
+	prefix string
+	lookup func(string) (string, error)
+}
+
+func (r prefixResolver) Resolve(arg string) (string, bool, error) {
+	if !strings.HasPrefix(arg, r.prefix) {
+		return "", false, nil
+	}
+	value, err := r.lookup(strings.TrimPrefix(arg, r.prefix))
+	return value, true, err
+}
+
+// -------------------------------------------------------------------------- //
+
+// NewVaultResolver returns an ArgResolver for "vault:" references to secrets
+// in HashiCorp Vault at addr (e.g. "https://vault:8200"). The last element of
+// the reference is the field of the secret at the path before it, so
+// "vault:secret/db/password" is the password field of secret/db. Secrets in KV
+// version 1 and 2 engines are supported. If allowed is set, only secrets under
+// one of its paths, like "secret/jobs", can be referenced (see AllowedRef).
+func NewVaultResolver(client *http.Client, addr, token string, allowed []string) ArgResolver {
+	v := vault{client: client, addr: strings.TrimSuffix(addr, "/"), token: token, allowed: allowed}
+	return PrefixResolver("vault:", v.lookup)
+}
+
+type vault struct {
+	client  *http.Client
+	addr    string
+	token   string
+	allowed []string
+}
+
+func (v vault) lookup(ref string) (string, error) {
+	secretPath, field := path.Split(ref)
+	secretPath = strings.TrimSuffix(secretPath, "/")
+	if secretPath == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference, expected path/field")
+	}
+	if err := AllowedRef(secretPath, v.allowed); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+(&url.URL{Path: secretPath}).EscapedPath(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	body, err := get(v.client, req)
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("can't decode vault response: %s", err)
+	}
+	data := secret.Data
+	if _, ok := data["metadata"]; ok { // KV version 2 nests the secret
+		if inner, ok := data["data"].(map[string]interface{}); ok {
+			data = inner
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", ErrArgNotFound
+	}
+	return value, nil
+}
+
+// NewConsulResolver returns an ArgResolver for "consul:" references to keys in
+// the Consul KV store at addr (e.g. "http://localhost:8500"), so
+// "consul:key/path" is the value of key/path. If allowed is set, only keys
+// under one of its paths can be referenced (see AllowedRef).
+func NewConsulResolver(client *http.Client, addr string, allowed []string) ArgResolver {
+	addr = strings.TrimSuffix(addr, "/")
+	return PrefixResolver("consul:", func(key string) (string, error) {
+		if err := AllowedRef(key, allowed); err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest("GET", addr+"/v1/kv/"+(&url.URL{Path: key}).EscapedPath()+"?raw", nil)
+		if err != nil {
+			return "", err
+		}
+		body, err := get(client, req)
+		return string(body), err
+	})
+}
+
+// AllowedRef returns an error if the path of a reference has a "." or ".."
+// element, which could refer outside the path it appears to be under, or if
+// allowed is set and the path isn't one of its paths or under one of them.
+// Paths are matched by element, so "secret/jobs" allows "secret/jobs/db" but
+// not "secret/jobs-admin".
+func AllowedRef(p string, allowed []string) error {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "." || elem == ".." {
+			return fmt.Errorf("invalid reference path %s: it has a %s element", p, elem)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, a := range allowed {
+		a = strings.TrimSuffix(a, "/")
+		if p == a || strings.HasPrefix(p, a+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("reference path %s is not under an allowed path (%s)", p, strings.Join(allowed, ", "))
+}
+
+// get sends a GET request and returns the response body if the status is 200.
+func get(client *http.Client, req *http.Request) ([]byte, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, ErrArgNotFound
+	}
+	return nil, fmt.Errorf("%s returned status %d", req.URL.Host, res.StatusCode)
+}
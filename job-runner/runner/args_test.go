@@ -0,0 +1,193 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestArgResolvers(t *testing.T) {
+	lookups := []string{}
+	resolvers := runner.ArgResolvers{
+		runner.PrefixResolver("a:", func(ref string) (string, error) {
+			lookups = append(lookups, "a:"+ref)
+			return "A-" + ref, nil
+		}),
+		runner.PrefixResolver("b:", func(ref string) (string, error) {
+			return "", runner.ErrArgNotFound
+		}),
+	}
+
+	args, err := resolvers.Resolve(map[string]string{
+		"x": "a:one",
+		"y": "literal",
+	})
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	expect := map[string]string{"x": "A-one", "y": "literal"}
+	if !reflect.DeepEqual(args, expect) {
+		t.Errorf("args = %v, expected %v", args, expect)
+	}
+	if len(lookups) != 1 {
+		t.Errorf("lookups = %v, expected only a:one", lookups)
+	}
+
+	// The error names the arg and reference.
+	_, err = resolvers.Resolve(map[string]string{"z": "b:missing"})
+	if err == nil || !strings.Contains(err.Error(), "z (b:missing)") {
+		t.Errorf("err = %v, expected an error about arg z", err)
+	}
+}
+
+func TestVaultResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/db":
+			fmt.Fprintln(w, `{"data":{"password":"hunter2"}}`)
+		case "/v1/kv/data/app":
+			fmt.Fprintln(w, `{"data":{"data":{"key":"v2"},"metadata":{"version":3}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	r := runner.NewVaultResolver(http.DefaultClient, ts.URL, "tok", nil)
+	tests := []struct {
+		arg   string
+		value string
+		ok    bool
+		err   bool
+	}{
+		{"vault:secret/db/password", "hunter2", true, false},
+		{"vault:kv/data/app/key", "v2", true, false},
+		{"vault:secret/db/user", "", true, true},        // no such field
+		{"vault:secret/nope/user", "", true, true},      // no such secret
+		{"consul:secret/db/password", "", false, false}, // not a vault reference
+	}
+	for _, test := range tests {
+		value, ok, err := r.Resolve(test.arg)
+		if value != test.value || ok != test.ok || (err != nil) != test.err {
+			t.Errorf("%s: got %q, %t, %v; expected %q, %t, error %t",
+				test.arg, value, ok, err, test.value, test.ok, test.err)
+		}
+	}
+
+	// Wrong token
+	r = runner.NewVaultResolver(http.DefaultClient, ts.URL, "bad", nil)
+	if _, _, err := r.Resolve("vault:secret/db/password"); err == nil {
+		t.Error("err = nil, expected an error for status 403")
+	}
+}
+
+func TestVaultResolverPaths(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		fmt.Fprintln(w, `{"data":{"password":"hunter2"}}`)
+	}))
+	defer ts.Close()
+
+	r := runner.NewVaultResolver(http.DefaultClient, ts.URL, "tok", []string{"secret/jobs/", "kv/data/app"})
+	tests := []struct {
+		arg string
+		err bool
+	}{
+		{"vault:secret/jobs/db/password", false},
+		{"vault:kv/data/app/password", false},
+		{"vault:secret/jobs/../admin/password", true}, // escapes the allowed path
+		{"vault:secret/jobs/./db/password", true},
+		{"vault:secret/jobs-admin/password", true},         // not under secret/jobs
+		{"vault:secret/admin/password", true},              // not allowed
+		{"vault:sys/raw/password", true},                   // not allowed
+		{"vault:secret/jobs/db?list=true/password", false}, // escaped, not a query
+	}
+	for _, test := range tests {
+		_, ok, err := r.Resolve(test.arg)
+		if !ok || (err != nil) != test.err {
+			t.Errorf("%s: got %t, %v; expected true, error %t", test.arg, ok, err, test.err)
+		}
+	}
+	expect := []string{"/v1/secret/jobs/db", "/v1/kv/data/app", "/v1/secret/jobs/db%3Flist=true"}
+	if !reflect.DeepEqual(paths, expect) {
+		t.Errorf("requested %v, expected %v", paths, expect)
+	}
+}
+
+func TestConsulResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/app/db host" && r.URL.RawQuery == "raw" {
+			fmt.Fprint(w, "db1.local")
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	r := runner.NewConsulResolver(http.DefaultClient, ts.URL, nil)
+	value, ok, err := r.Resolve("consul:app/db host")
+	if value != "db1.local" || !ok || err != nil {
+		t.Errorf("got %q, %t, %v; expected db1.local, true, nil", value, ok, err)
+	}
+	if _, _, err := r.Resolve("consul:app/missing"); err != runner.ErrArgNotFound {
+		t.Errorf("err = %v, expected %s", err, runner.ErrArgNotFound)
+	}
+
+	r = runner.NewConsulResolver(http.DefaultClient, ts.URL, []string{"app"})
+	for _, arg := range []string{"consul:app/../admin/token", "consul:admin/token"} {
+		if _, _, err := r.Resolve(arg); err == nil || err == runner.ErrArgNotFound {
+			t.Errorf("%s: err = %v, expected it rejected", arg, err)
+		}
+	}
+}
+
+// The factory resolves job args and gives them to the job.
+func TestFactoryArgs(t *testing.T) {
+	job := &mock.Job{}
+	jf := &mock.JobFactory{JobToReturn: job}
+	resolvers := runner.ArgResolvers{
+		runner.PrefixResolver("secret:", func(ref string) (string, error) {
+			if ref == "missing" {
+				return "", runner.ErrArgNotFound
+			}
+			return "s3cr3t", nil
+		}),
+	}
+	rf := runner.NewRunnerFactory(jf, nil, resolvers, nil, nil, nil)
+
+	pJob := proto.Job{
+		Type: "jtype",
+		Name: "jname",
+		Args: map[string]string{"password": "secret:db", "host": "db1"},
+	}
+	if _, err := rf.Make(pJob, 3); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	expect := map[string]string{"password": "s3cr3t", "host": "db1"}
+	if !reflect.DeepEqual(job.Args, expect) {
+		t.Errorf("job args = %v, expected %v", job.Args, expect)
+	}
+
+	pJob.Args["password"] = "secret:missing"
+	jr, err := rf.Make(pJob, 3)
+	if err == nil {
+		t.Error("err = nil, expected an error for the missing secret")
+	}
+	if jr != nil {
+		t.Error("got a JobRunner, expected nil")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_CONTENT_TYPE is the content type of artifacts that don't have one.
+const DEFAULT_CONTENT_TYPE = "application/octet-stream"
+
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// An ArtifactStore stores the artifacts output by jobs (see job.Artifact), so
+// they can be served after the job and its chain are done. Put replaces an
+// artifact with the same name. List returns the artifacts of a job sorted by
+// name, or an empty list if the job has none. Get returns ErrArtifactNotFound
+// if the job has no artifact with the name.
+type ArtifactStore interface {
+	Put(requestId uint, jobName string, a job.Artifact) error
+	Get(requestId uint, jobName, name string) (job.Artifact, error)
+	List(requestId uint, jobName string) ([]proto.JobArtifact, error)
+}
+
+// ValidArtifactName returns an error if the name of an artifact can't be
+// stored: it must not be empty, contain "/", or start with ".".
+func ValidArtifactName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid artifact name %q: must not be empty, contain /, or start with .", name)
+	}
+	return nil
+}
+
+// storeArtifacts stores the artifacts of a job that outputs them, if the Job
+// Runner has an ArtifactStore. Artifacts that can't be stored are logged in the
+// job's log but don't fail the job, which is done.
+func (r *JobRunner) storeArtifacts() {
+	producer, ok := r.job.(job.ArtifactProducer)
+	if !ok || r.artifacts == nil {
+		return
+	}
+	for _, a := range producer.Artifacts() {
+		if a.ContentType == "" {
+			a.ContentType = DEFAULT_CONTENT_TYPE
+		}
+		err := ValidArtifactName(a.Name)
+		if err == nil {
+			err = r.artifacts.Put(r.requestId, r.job.Name(), a)
+		}
+		if err != nil {
+			log.Errorf("[chain=%d,job=%s]: Can't store artifact %s (error: %s).", r.requestId, r.job.Name(), a.Name, err)
+			fmt.Fprintf(r.log, "error: can't store artifact %s: %s\n", a.Name, err)
+		}
+	}
+}
+
+// -------------------------------------------------------------------------- //
+
+// NewDirArtifactStore returns an ArtifactStore that stores artifacts in files
+// in dir, in a directory per request and job. A job's directory has an index
+// of its artifacts, with their content types.
+func NewDirArtifactStore(dir string) *DirArtifactStore {
+	return &DirArtifactStore{
+		dir:   dir,
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// DirArtifactStore is an ArtifactStore of files in a local directory.
+type DirArtifactStore struct {
+	dir string
+	// --
+	*sync.Mutex // guards indexes
+}
+
+const artifactIndex = ".index.json"
+
+func (s *DirArtifactStore) Put(requestId uint, jobName string, a job.Artifact) error {
+	if err := ValidArtifactName(a.Name); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	jobDir := s.jobDir(requestId, jobName)
+	if err := os.MkdirAll(jobDir, 0755); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(jobDir, url.PathEscape(a.Name)), a.Data); err != nil {
+		return err
+	}
+	index, err := s.index(jobDir)
+	if err != nil {
+		return err
+	}
+	artifact := proto.JobArtifact{Name: a.Name, ContentType: a.ContentType, Size: int64(len(a.Data))}
+	i := 0
+	for i < len(index) && index[i].Name < a.Name {
+		i++
+	}
+	if i < len(index) && index[i].Name == a.Name {
+		index[i] = artifact
+	} else {
+		index = append(index[:i], append([]proto.JobArtifact{artifact}, index[i:]...)...)
+	}
+	bytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(jobDir, artifactIndex), bytes)
+}
+
+func (s *DirArtifactStore) Get(requestId uint, jobName, name string) (job.Artifact, error) {
+	if ValidArtifactName(name) != nil {
+		return job.Artifact{}, ErrArtifactNotFound
+	}
+	s.Lock()
+	defer s.Unlock()
+	jobDir := s.jobDir(requestId, jobName)
+	index, err := s.index(jobDir)
+	if err != nil {
+		return job.Artifact{}, err
+	}
+	for _, artifact := range index {
+		if artifact.Name != name {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(jobDir, url.PathEscape(name)))
+		if err != nil {
+			return job.Artifact{}, err
+		}
+		return job.Artifact{Name: name, ContentType: artifact.ContentType, Data: data}, nil
+	}
+	return job.Artifact{}, ErrArtifactNotFound
+}
+
+func (s *DirArtifactStore) List(requestId uint, jobName string) ([]proto.JobArtifact, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.index(s.jobDir(requestId, jobName))
+}
+
+// jobDir returns the directory of a job's artifacts. The job name is escaped so
+// that it's one directory in the request's directory, whatever it is.
+func (s *DirArtifactStore) jobDir(requestId uint, jobName string) string {
+	name := url.PathEscape(jobName)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(requestId), 10), name)
+}
+
+// index reads the index of a job's artifacts. The caller must hold the lock.
+func (s *DirArtifactStore) index(jobDir string) ([]proto.JobArtifact, error) {
+	index := []proto.JobArtifact{}
+	bytes, err := ioutil.ReadFile(filepath.Join(jobDir, artifactIndex))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &index); err != nil {
+		return nil, fmt.Errorf("invalid artifact index in %s: %s", jobDir, err)
+	}
+	return index, nil
+}
+
+// writeFile writes a file atomically, so a reader never sees part of it. The
+// temp file starts with "." so it's never the file of an artifact.
+func writeFile(file string, data []byte) error {
+	dir, base := filepath.Split(file)
+	tmp := filepath.Join(dir, ".tmp-"+base)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,88 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runner-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := runner.NewDirArtifactStore(dir)
+
+	j := &mock.Job{
+		NameResp: "../diff hosts",
+		RunReturn: job.Return{
+			State: proto.STATE_COMPLETE,
+		},
+		ArtifactsResp: []job.Artifact{
+			{Name: "report.html", ContentType: "text/html", Data: []byte("<p>ok</p>")},
+			{Name: "changes.diff", Data: []byte("+host3\n")},
+			{Name: "../../etc/passwd", Data: []byte("root")},
+		},
+	}
+	jr := runner.NewJobRunner(j, 1, 0)
+	jr.SetArtifactStore(store)
+	if state := jr.Run(noJobData); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+
+	// Artifacts that can't be stored don't fail the job, but are in its log
+	if line := jr.Log().LastLine(100); !strings.Contains(line, "../../etc/passwd") {
+		t.Errorf("last log line = %q, expected the invalid artifact", line)
+	}
+
+	list, err := store.List(1, "../diff hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []proto.JobArtifact{
+		{Name: "changes.diff", ContentType: runner.DEFAULT_CONTENT_TYPE, Size: 7},
+		{Name: "report.html", ContentType: "text/html", Size: 9},
+	}
+	if !reflect.DeepEqual(list, expect) {
+		t.Errorf("artifacts = %+v, expected %+v", list, expect)
+	}
+
+	// An artifact of a later try replaces the one of an earlier try
+	err = store.Put(1, "../diff hosts", job.Artifact{Name: "report.html", ContentType: "text/plain", Data: []byte("ok")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := store.Get(1, "../diff hosts", "report.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ContentType != "text/plain" || string(a.Data) != "ok" {
+		t.Errorf("artifact = %s %q, expected text/plain ok", a.ContentType, a.Data)
+	}
+
+	if _, err := store.Get(1, "../diff hosts", "nope.txt"); err != runner.ErrArtifactNotFound {
+		t.Errorf("err = %v, expected ErrArtifactNotFound", err)
+	}
+	if list, err := store.List(2, "../diff hosts"); err != nil || len(list) != 0 {
+		t.Errorf("artifacts = %v, err = %v; expected none for another request", list, err)
+	}
+
+	// Every file is in the request's directory, whatever the job's name
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "1" {
+		t.Errorf("files in store = %v, expected only the request's directory", files)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/proto"
+)
+
+// ChaosConfig injects deterministic failures into jobs to test how chains and
+// requests handle them end to end, like retries, sequence retries, rollback,
+// timeouts, and status polling. Each setting applies to jobs whose name matches
+// a regexp, "" = no jobs. It's for test environments only.
+type ChaosConfig struct {
+	// Fail is a regexp of job names that fail without running. If FailTries
+	// is set, only the first FailTries tries of a job fail, so a job with
+	// retries completes after it's retried.
+	Fail      string `json:"fail"`
+	FailTries uint   `json:"failTries"`
+
+	// Delay is a regexp of job names that wait Latency (like "30s") before
+	// they run, which counts toward their timeout.
+	Delay   string `json:"delay"`
+	Latency string `json:"latency"`
+
+	// DropStatus is a regexp of job names whose status and progress are
+	// never reported, like a job that hangs.
+	DropStatus string `json:"dropStatus"`
+}
+
+// ReadChaosConfig reads a ChaosConfig from a JSON file, like:
+//
+//	{"fail": "^deploy-", "failTries": 2, "delay": "drain", "latency": "10s"}
+func ReadChaosConfig(file string) (ChaosConfig, error) {
+	var config ChaosConfig
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return config, fmt.Errorf("invalid chaos config %s: %s", file, err)
+	}
+	return config, nil
+}
+
+// NewChaosRunnerFactory returns a RunnerFactory that uses rf to make runners,
+// and injects the failures in config into the jobs it matches. It returns an
+// error if config is invalid.
+func NewChaosRunnerFactory(rf RunnerFactory, config ChaosConfig) (RunnerFactory, error) {
+	f := &chaosRunnerFactory{
+		rf:        rf,
+		failTries: config.FailTries,
+		tries:     make(map[string]uint),
+		Mutex:     &sync.Mutex{},
+	}
+	var err error
+	if f.fail, err = compile("fail", config.Fail); err != nil {
+		return nil, err
+	}
+	if f.delay, err = compile("delay", config.Delay); err != nil {
+		return nil, err
+	}
+	if f.dropStatus, err = compile("dropStatus", config.DropStatus); err != nil {
+		return nil, err
+	}
+	if f.delay != nil {
+		if f.latency, err = time.ParseDuration(config.Latency); err != nil || f.latency <= 0 {
+			return nil, fmt.Errorf("invalid chaos latency %q: must be a duration greater than zero", config.Latency)
+		}
+	}
+	return f, nil
+}
+
+// compile compiles a regexp of the chaos config, or returns nil if it's empty.
+func compile(name, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chaos %s regexp: %s", name, err)
+	}
+	return re, nil
+}
+
+type chaosRunnerFactory struct {
+	rf         RunnerFactory
+	fail       *regexp.Regexp
+	failTries  uint
+	delay      *regexp.Regexp
+	latency    time.Duration
+	dropStatus *regexp.Regexp
+	// --
+	tries       map[string]uint // "<request ID>/<job name>" => tries made
+	*sync.Mutex                 // guards tries
+}
+
+func (f *chaosRunnerFactory) Make(pJob proto.Job, requestId uint) (Runner, error) {
+	r, err := f.rf.Make(pJob, requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &chaosRunner{
+		Runner:   r,
+		log:      r.Log(),
+		stopChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+	if f.fail != nil && f.fail.MatchString(pJob.Name) {
+		key := fmt.Sprintf("%d/%s", requestId, pJob.Name)
+		f.Lock()
+		f.tries[key]++
+		try := f.tries[key]
+		f.Unlock()
+		cr.fail = f.failTries == 0 || try <= f.failTries
+	}
+	if f.delay != nil && f.delay.MatchString(pJob.Name) {
+		cr.latency = f.latency
+	}
+	cr.dropStatus = f.dropStatus != nil && f.dropStatus.MatchString(pJob.Name)
+	return cr, nil
+}
+
+// chaosRunner is a Runner with injected failures.
+type chaosRunner struct {
+	Runner
+	fail       bool
+	latency    time.Duration
+	dropStatus bool
+	log        *Log
+	stopChan   chan struct{} // closed on Stop
+	stopOnce   *sync.Once
+}
+
+func (r *chaosRunner) Run(jobData map[string]interface{}) byte {
+	if r.latency > 0 {
+		fmt.Fprintf(r.log, "chaos: delaying the job %s\n", r.latency)
+		select {
+		case <-time.After(r.latency):
+		case <-r.stopChan:
+			r.log.Close()
+			return proto.STATE_STOPPED
+		}
+	}
+	if r.fail {
+		fmt.Fprintln(r.log, "chaos: failing the job without running it")
+		r.log.Close()
+		return proto.STATE_FAIL
+	}
+	return r.Runner.Run(jobData)
+}
+
+func (r *chaosRunner) Stop(grace time.Duration) error {
+	r.stopOnce.Do(func() { close(r.stopChan) })
+	return r.Runner.Stop(grace)
+}
+
+func (r *chaosRunner) Status() string {
+	if r.dropStatus {
+		return ""
+	}
+	return r.Runner.Status()
+}
+
+func (r *chaosRunner) Progress() int {
+	if r.dropStatus {
+		return -1
+	}
+	return r.Runner.Progress()
+}
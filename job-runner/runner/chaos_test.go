@@ -0,0 +1,101 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestChaosRunnerFactory(t *testing.T) {
+	rf := &mock.RunnerFactory{
+		RunnersToReturn: map[string]*mock.Runner{
+			"deploy-web": mock.NewRunner(true, "deploying", nil, nil, nil),
+			"drain":      mock.NewRunner(true, "draining", nil, nil, nil),
+			"check":      mock.NewRunner(true, "checking", nil, nil, nil),
+		},
+	}
+	config := runner.ChaosConfig{
+		Fail:       "^deploy-",
+		FailTries:  2,
+		Delay:      "drain",
+		Latency:    "50ms",
+		DropStatus: "check",
+	}
+	crf, err := runner.NewChaosRunnerFactory(rf, config)
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// The first 2 tries of deploy-web fail without running it, then it runs
+	for try, expect := range []byte{proto.STATE_FAIL, proto.STATE_FAIL, proto.STATE_COMPLETE} {
+		r, err := crf.Make(proto.Job{Name: "deploy-web"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state := r.Run(map[string]interface{}{}); state != expect {
+			t.Errorf("try %d state = %s, expected %s", try+1, proto.StateName[state], proto.StateName[expect])
+		}
+	}
+	if runs := rf.RunnersToReturn["deploy-web"].Runs(); runs != 1 {
+		t.Errorf("deploy-web ran %d times, expected 1", runs)
+	}
+	if line := rf.RunnersToReturn["deploy-web"].Log().LastLine(100); !strings.HasPrefix(line, "chaos:") {
+		t.Errorf("last log line = %q, expected the chaos failure", line)
+	}
+
+	// Tries are counted per request
+	r, err := crf.Make(proto.Job{Name: "deploy-web"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := r.Run(map[string]interface{}{}); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL on the first try of another request", proto.StateName[state])
+	}
+
+	// drain is delayed, and it can be stopped while it waits
+	r, err = crf.Make(proto.Job{Name: "drain"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if state := r.Run(map[string]interface{}{}); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("drain ran in %s, expected it delayed 50ms", elapsed)
+	}
+	r, err = crf.Make(proto.Job{Name: "drain"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Stop(0)
+	if state := r.Run(map[string]interface{}{}); state != proto.STATE_STOPPED {
+		t.Errorf("state = %s, expected STOPPED", proto.StateName[state])
+	}
+
+	// check's status is dropped
+	r, err = crf.Make(proto.Job{Name: "check"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, progress := r.Status(), r.Progress(); status != "" || progress != -1 {
+		t.Errorf("status = %q, progress = %d; expected none", status, progress)
+	}
+
+	// Invalid configs
+	for _, config := range []runner.ChaosConfig{
+		{Fail: "("},
+		{Delay: "drain"},
+		{Delay: "drain", Latency: "soon"},
+	} {
+		if _, err := runner.NewChaosRunnerFactory(rf, config); err == nil {
+			t.Errorf("err = nil, expected an error for %+v", config)
+		}
+	}
+}
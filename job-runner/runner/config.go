@@ -0,0 +1,60 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	// ErrNoConfig is returned by a ConfigProvider for an env label that has
+	// no config bundle.
+	ErrNoConfig = errors.New("no config bundle for env label")
+)
+
+// A ConfigProvider returns the config bundle of an env label (see
+// proto.ENV_LABEL), like "staging" or "prod": the endpoints, flags, and
+// credentials that jobs use in that environment. Values are resolved like job
+// args, so credentials are references, like "vault:secret/db password", not
+// values. Jobs get the resolved bundle of their chain's label in
+// job.Context.Config, so one Job Runner can run chains of every environment.
+type ConfigProvider interface {
+	// Config returns the bundle of the label, or ErrNoConfig if there is none.
+	Config(label string) (map[string]string, error)
+}
+
+// ConfigBundles is a ConfigProvider of env label => config bundle.
+type ConfigBundles map[string]map[string]string
+
+func (b ConfigBundles) Config(label string) (map[string]string, error) {
+	bundle, ok := b[label]
+	if !ok {
+		return nil, ErrNoConfig
+	}
+	config := make(map[string]string, len(bundle))
+	for k, v := range bundle {
+		config[k] = v
+	}
+	return config, nil
+}
+
+// ReadConfigBundles reads ConfigBundles from a JSON file, like:
+//
+//	{
+//	  "staging": {"db_host": "db.staging", "db_password": "vault:secret/staging/db password"},
+//	  "prod":    {"db_host": "db.prod", "db_password": "vault:secret/prod/db password"}
+//	}
+func ReadConfigBundles(file string) (ConfigBundles, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var bundles ConfigBundles
+	if err := json.Unmarshal(bytes, &bundles); err != nil {
+		return nil, fmt.Errorf("invalid config bundles %s: %s", file, err)
+	}
+	return bundles, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// Jobs get the config bundle of their chain's env label, with references
+// resolved.
+func TestFactoryConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runner-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "env.json")
+	bundles := `{
+		"staging": {"db_host": "db.staging", "db_password": "secret:staging"},
+		"prod": {"db_host": "db.prod", "db_password": "secret:prod"}
+	}`
+	if err := ioutil.WriteFile(file, []byte(bundles), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configs, err := runner.ReadConfigBundles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &mock.Job{}
+	resolvers := runner.ArgResolvers{
+		runner.PrefixResolver("secret:", func(ref string) (string, error) { return ref + "-pw", nil }),
+	}
+	rf := runner.NewRunnerFactory(&mock.JobFactory{JobToReturn: job}, nil, resolvers, configs, nil, nil)
+
+	for _, label := range []string{"staging", "prod"} {
+		pJob := proto.Job{Type: "jtype", Name: "jname", Env: map[string]string{proto.ENV_LABEL: label}}
+		if _, err := rf.Make(pJob, 1); err != nil {
+			t.Fatal(err)
+		}
+		expect := map[string]string{"db_host": "db." + label, "db_password": label + "-pw"}
+		if job.Context.Label != label || !reflect.DeepEqual(job.Context.Config, expect) {
+			t.Errorf("context = %+v, expected %s with config %v", job.Context, label, expect)
+		}
+	}
+
+	// A chain without a label gets no config, and one with an unknown label
+	// doesn't run
+	if _, err := rf.Make(proto.Job{Type: "jtype", Name: "jname"}, 1); err != nil || job.Context.Config != nil {
+		t.Errorf("config = %v (error: %v), expected nil", job.Context.Config, err)
+	}
+	pJob := proto.Job{Type: "jtype", Name: "jname", Env: map[string]string{proto.ENV_LABEL: "dev"}}
+	if jr, err := rf.Make(pJob, 1); err == nil || jr != nil {
+		t.Error("err = nil, expected an error for the label without config")
+	}
+}
@@ -3,41 +3,174 @@
 package runner
 
 import (
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
 )
 
-// A RunnerFactory makes a Runner for one job of the given type, re-created
-// with the given bytes, and associated with the given request ID. The job
-// name is only used for testing with a mock RunnerFactory. An error is returned
-// if the job fails to instantiate or re-create itself.
+// A RunnerFactory makes a Runner for one job, re-created from its type and
+// bytes, and associated with the given request ID. The Runner enforces the
+// job's timeout, if any. An error is returned if the job fails to instantiate
+// or re-create itself, or if its timeout is invalid.
 type RunnerFactory interface {
-	Make(jobType, jobName string, jobBytes []byte, requestId uint) (Runner, error)
+	Make(job proto.Job, requestId uint) (Runner, error)
 }
 
 type runnerFactory struct {
 	jobFactory job.Factory
+	warmups    *Warmups
+	resolvers  ArgResolvers
+	configs    ConfigProvider
+	scratches  ScratchProvider
+	artifacts  ArtifactStore
+}
+
+// A ScratchProvider provides the scratch of a request to its jobs.
+type ScratchProvider interface {
+	Scratch(requestId uint) job.Scratch
 }
 
-// NewRunnerFactory makes a RunnerFactory.
-func NewRunnerFactory(jobFactory job.Factory) RunnerFactory {
+// NewRunnerFactory makes a RunnerFactory. If warmups is not nil, Make returns
+// an error for jobs of a type that is not healthy, so they fail without running.
+// The resolvers resolve the args of each job when it's made, right before it
+// runs. If configs is not nil, jobs get the config bundle of their chain's env
+// label, resolved by the resolvers, and jobs of a chain with a label that has
+// no bundle fail without running. If scratches is not nil, jobs get the scratch
+// of their request with their context. If artifacts is not nil, the artifacts
+// output by jobs are stored in it.
+func NewRunnerFactory(jobFactory job.Factory, warmups *Warmups, resolvers ArgResolvers, configs ConfigProvider, scratches ScratchProvider, artifacts ArtifactStore) RunnerFactory {
 	return &runnerFactory{
 		jobFactory: jobFactory,
+		warmups:    warmups,
+		resolvers:  resolvers,
+		configs:    configs,
+		scratches:  scratches,
+		artifacts:  artifacts,
 	}
 }
 
-func (f *runnerFactory) Make(jobType, jobName string, jobBytes []byte, requestId uint) (Runner, error) {
+func (f *runnerFactory) Make(pJob proto.Job, requestId uint) (Runner, error) {
+	if f.warmups != nil {
+		if err := f.warmups.Healthy(pJob.Type); err != nil {
+			return nil, fmt.Errorf("job type %s is not healthy: %s", pJob.Type, err)
+		}
+	}
+
+	var timeout time.Duration
+	if pJob.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(pJob.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	var heartbeatTimeout time.Duration
+	if pJob.HeartbeatTimeout != "" {
+		var err error
+		if heartbeatTimeout, err = time.ParseDuration(pJob.HeartbeatTimeout); err != nil {
+			return nil, err
+		}
+	}
+
 	// Instantiate a "blank" job of the given type
-	job, err := f.jobFactory.Make(jobType, jobName)
+	j, err := f.jobFactory.Make(pJob.Type, pJob.Name)
 	if err != nil {
 		return nil, err
 	}
 
 	// Have the job re-create itself so it's no longer blank but rather
 	// what it was when first created in the Request Manager
-	if err := job.Deserialize(jobBytes); err != nil {
+	if err := j.Deserialize(pJob.Bytes); err != nil {
 		return nil, err
 	}
 
+	// Give the job its args, resolving references like secrets. They're only
+	// resolved now so that the values are never in the job chain.
+	if len(pJob.Args) > 0 {
+		setter, ok := j.(job.ArgsSetter)
+		if !ok {
+			return nil, fmt.Errorf("job type %s does not take args", pJob.Type)
+		}
+		args, err := f.resolvers.Resolve(pJob.Args)
+		if err != nil {
+			return nil, err
+		}
+		if err := setter.SetArgs(args); err != nil {
+			return nil, err
+		}
+	}
+
+	// Give the job the environment of its chain, with the config of its
+	// env label and the scratch of its request.
+	if setter, ok := j.(job.ContextSetter); ok {
+		ctx, err := newContext(requestId, pJob.Env)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.Config, err = f.config(ctx.Label); err != nil {
+			return nil, err
+		}
+		if f.scratches != nil {
+			ctx.Scratch = f.scratches.Scratch(requestId)
+		}
+		setter.SetContext(ctx)
+	}
+
+	// Make the job part of the request's trace.
+	if traced, ok := j.(job.Traced); ok && pJob.Traceparent != "" {
+		traced.SetTraceparent(pJob.Traceparent)
+	}
+
+	// A job with a heartbeat timeout must send heartbeats, else it would
+	// always stall.
+	if heartbeatTimeout > 0 {
+		if _, ok := j.(job.Heartbeater); !ok {
+			return nil, fmt.Errorf("job type %s does not send heartbeats", pJob.Type)
+		}
+	}
+
 	// Job should be ready to run. Create and return a runner for it.
-	return NewJobRunner(job, requestId), nil
+	jr := NewJobRunner(j, requestId, timeout)
+	jr.SetHeartbeatTimeout(heartbeatTimeout)
+	jr.SetArtifactStore(f.artifacts)
+	return jr, nil
+}
+
+// newContext returns the job.Context of a job in the chain with the env.
+func newContext(requestId uint, env map[string]string) (job.Context, error) {
+	ctx := job.Context{
+		RequestId:  requestId,
+		Datacenter: env[proto.ENV_DATACENTER],
+		Cluster:    env[proto.ENV_CLUSTER],
+		Requestor:  env[proto.ENV_REQUESTOR],
+		Label:      env[proto.ENV_LABEL],
+		Env:        make(map[string]string, len(env)),
+	}
+	for k, v := range env {
+		ctx.Env[k] = v
+	}
+	if v, ok := env[proto.ENV_DRY_RUN]; ok {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return job.Context{}, fmt.Errorf("invalid env %s: %q", proto.ENV_DRY_RUN, v)
+		}
+		ctx.DryRun = dryRun
+	}
+	return ctx, nil
+}
+
+// config returns the resolved config bundle of an env label, nil if there is no
+// label or config provider.
+func (f *runnerFactory) config(label string) (map[string]string, error) {
+	if label == "" || f.configs == nil {
+		return nil, nil
+	}
+	bundle, err := f.configs.Config(label)
+	if err != nil {
+		return nil, fmt.Errorf("can't get config of env %s: %s", label, err)
+	}
+	return f.resolvers.Resolve(bundle)
 }
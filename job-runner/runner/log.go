@@ -0,0 +1,134 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrLogClosed is returned when writing to a Log that is closed.
+	ErrLogClosed = errors.New("log is closed")
+
+	// MaxLogSize is the max number of bytes of output that a Log keeps. Once a
+	// job writes more, its oldest output is dropped, so a chatty job that runs
+	// for a long time doesn't use up the memory of the Job Runner. 0 means no
+	// limit. It applies to Logs made after it's set.
+	MaxLogSize = 10 << 20
+)
+
+// A Log captures the log output (e.g. stdout and stderr) of a job while it runs.
+// It is an io.Writer that jobs write to, and it can be read concurrently while
+// being written, which allows streaming the output of a running job. A Log is
+// closed when the job is done running, after which no more output is written.
+// A Log keeps the last MaxLogSize bytes of output.
+type Log struct {
+	buf     []byte
+	dropped int // bytes of output dropped from the start of buf
+	max     int // max bytes of output read, 0 = no limit
+	closed  bool
+	changed chan struct{} // closed and replaced on every Write and on Close
+	// --
+	*sync.Mutex // guards all fields
+}
+
+// NewLog returns a new, empty Log.
+func NewLog() *Log {
+	return &Log{
+		buf:     []byte{},
+		max:     MaxLogSize,
+		changed: make(chan struct{}),
+		Mutex:   &sync.Mutex{},
+	}
+}
+
+// Write appends p to the log. It returns an error if the log is closed.
+func (l *Log) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	l.buf = append(l.buf, p...)
+
+	// Drop the oldest output once there's a quarter more than max, so it's
+	// not copied on every write.
+	if l.max > 0 && len(l.buf) > l.max+l.max/4 {
+		drop := len(l.buf) - l.max
+		l.buf = l.buf[:copy(l.buf, l.buf[drop:])]
+		l.dropped += drop
+	}
+	l.notify()
+	return len(p), nil
+}
+
+// Close closes the log. It is safe to call more than once.
+func (l *Log) Close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.notify()
+}
+
+// Read returns a copy of the log output from offset onward, the offset to read
+// from next, a channel that is closed when the log changes (written to or
+// closed), and true if the log is closed. If output from offset was dropped
+// because the log has more than MaxLogSize bytes, the copy starts with a line
+// saying how many bytes were truncated. If the log is closed and all output
+// has been read, there will never be more output. To stream the log, keep
+// calling Read with the offset it returned, waiting on the channel in between.
+func (l *Log) Read(offset int) ([]byte, int, <-chan struct{}, bool) {
+	l.Lock()
+	defer l.Unlock()
+	end := l.dropped + len(l.buf)
+	if offset < 0 || offset > end {
+		offset = end
+	}
+	out := []byte{}
+	if start := end - len(l.tail()); offset < start {
+		out = append(out, fmt.Sprintf("... (%d bytes truncated)\n", start-offset)...)
+		offset = start
+	}
+	out = append(out, l.buf[offset-l.dropped:]...)
+	return out, end, l.changed, l.closed
+}
+
+// LastLine returns the last line of the log output that isn't empty, truncated
+// to max bytes. The runner writes the error of a job that failed as the last
+// line, so it's usually why the job failed.
+func (l *Log) LastLine(max int) string {
+	l.Lock()
+	defer l.Unlock()
+	out := bytes.TrimRight(l.tail(), "\r\n")
+	if i := bytes.LastIndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	if len(out) > max {
+		out = out[:max]
+	}
+	return string(out)
+}
+
+// -------------------------------------------------------------------------- //
+
+// tail returns the output that's read: the last max bytes. The caller must hold
+// the lock.
+func (l *Log) tail() []byte {
+	if l.max > 0 && len(l.buf) > l.max {
+		return l.buf[len(l.buf)-l.max:]
+	}
+	return l.buf
+}
+
+// notify wakes up all readers waiting on the changed channel. The caller must
+// hold the lock.
+func (l *Log) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
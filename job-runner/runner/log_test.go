@@ -0,0 +1,83 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/runner"
+)
+
+func TestLog(t *testing.T) {
+	l := runner.NewLog()
+
+	out, _, changed, closed := l.Read(0)
+	if len(out) != 0 || closed {
+		t.Errorf("out = %q, closed = %t, expected empty and not closed", out, closed)
+	}
+
+	l.Write([]byte("hello "))
+	select {
+	case <-changed:
+	default:
+		t.Error("changed chan not closed after Write")
+	}
+
+	out, _, _, _ = l.Read(0)
+	if string(out) != "hello " {
+		t.Errorf("out = %q, expected %q", out, "hello ")
+	}
+
+	l.Write([]byte("world"))
+	out, next, changed, closed := l.Read(len("hello "))
+	if string(out) != "world" || next != len("hello world") || closed {
+		t.Errorf("out = %q, next = %d, closed = %t, expected %q, %d, and not closed", out, next, closed, "world", len("hello world"))
+	}
+
+	l.Close()
+	select {
+	case <-changed:
+	default:
+		t.Error("changed chan not closed after Close")
+	}
+
+	if _, err := l.Write([]byte("more")); err != runner.ErrLogClosed {
+		t.Errorf("err = %v, expected %s", err, runner.ErrLogClosed)
+	}
+	out, _, _, closed = l.Read(0)
+	if string(out) != "hello world" || !closed {
+		t.Errorf("out = %q, closed = %t, expected %q and closed", out, closed, "hello world")
+	}
+}
+
+func TestLogMaxSize(t *testing.T) {
+	defer func(max int) { runner.MaxLogSize = max }(runner.MaxLogSize)
+	runner.MaxLogSize = 10
+	l := runner.NewLog()
+
+	// Write 100 lines, way past the max; only the tail is kept
+	for i := 0; i < 100; i++ {
+		l.Write([]byte(fmt.Sprintf("line%02d\n", i)))
+	}
+	out, next, _, _ := l.Read(0)
+	expect := "... (690 bytes truncated)\n" + "98\nline99\n"
+	if string(out) != expect || next != 700 {
+		t.Errorf("out = %q, next = %d, expected %q, 700", out, next, expect)
+	}
+	if line := l.LastLine(100); line != "line99" {
+		t.Errorf("last line = %q, expected line99", line)
+	}
+
+	// A reader streaming the log reads what's written next, and is told
+	// what it missed if it fell behind
+	l.Write([]byte("line100\n"))
+	if out, next, _, _ = l.Read(next); string(out) != "line100\n" || next != 708 {
+		t.Errorf("out = %q, next = %d, expected %q, 708", out, next, "line100\n")
+	}
+	out, _, _, _ = l.Read(650)
+	if !strings.HasPrefix(string(out), "... (48 bytes truncated)\n") || !strings.HasSuffix(string(out), "line100\n") {
+		t.Errorf("out = %q, expected 48 bytes truncated, then the tail", out)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MAX_MIRROR_ERROR_LENGTH is the max length of the error of a mirror that
+// didn't complete in the MirrorRunner's log.
+const MAX_MIRROR_ERROR_LENGTH = 500
+
+// A Placed runner runs its job somewhere other than the Job Runner, like on a
+// spincycle-agent. Where returns where the job ran, or "" if it hasn't started.
+// Mirrors of a job must not run in the same place.
+type Placed interface {
+	Where() string
+}
+
+// MakeMirrors makes a runner for the job with rf. If the job is mirrored (see
+// proto.Job.Mirrors), it makes a runner for each mirror and returns a
+// MirrorRunner that runs them all.
+func MakeMirrors(rf RunnerFactory, pJob proto.Job, requestId uint) (Runner, error) {
+	if pJob.Mirrors < 2 {
+		return rf.Make(pJob, requestId)
+	}
+	runners := make([]Runner, pJob.Mirrors)
+	for i := range runners {
+		r, err := rf.Make(pJob, requestId)
+		if err != nil {
+			return nil, fmt.Errorf("can't make mirror %d: %s", i+1, err)
+		}
+		runners[i] = r
+	}
+	return NewMirrorRunner(requestId, pJob.Name, runners, pJob.MirrorDivergence), nil
+}
+
+// NewMirrorRunner returns a MirrorRunner that runs the runners, which are
+// mirrors of the same job, with the divergence policy (a MIRROR_DIVERGENCE_*
+// const, default fail).
+func NewMirrorRunner(requestId uint, jobName string, runners []Runner, divergence string) *MirrorRunner {
+	if divergence == "" {
+		divergence = proto.MIRROR_DIVERGENCE_FAIL
+	}
+	return &MirrorRunner{
+		requestId: requestId,
+		jobName:   jobName,
+		runners:   runners,
+		policy:    divergence,
+		log:       NewLog(),
+		Mutex:     &sync.Mutex{},
+	}
+}
+
+// A MirrorRunner runs mirrors of a job at once and compares their results: it
+// completes only if every mirror completes with the same job data. Its log has
+// the result of every mirror; their own logs are not kept.
+type MirrorRunner struct {
+	requestId uint
+	jobName   string
+	runners   []Runner
+	policy    string
+	log       *Log
+	// --
+	divergence  string // why the mirrors diverged, "" if they didn't
+	*sync.Mutex        // guards divergence
+}
+
+var (
+	_ Runner = (*MirrorRunner)(nil)
+	_ Coster = (*MirrorRunner)(nil)
+)
+
+// Run runs every mirror with a copy of jobData and waits for them. If a mirror
+// doesn't complete, it returns the state of the first one that didn't. If the
+// mirrors complete with different job data, it returns proto.STATE_FAIL, or,
+// if the policy is to flag divergence, proto.STATE_COMPLETE; either way,
+// Divergence returns why. Else it returns proto.STATE_COMPLETE, and jobData
+// is the job data of the first mirror.
+func (r *MirrorRunner) Run(jobData map[string]interface{}) byte {
+	defer r.log.Close()
+
+	data := make([]map[string]interface{}, len(r.runners))
+	states := make([]byte, len(r.runners))
+	var wg sync.WaitGroup
+	for i := range r.runners {
+		data[i] = make(map[string]interface{}, len(jobData))
+		for k, v := range jobData {
+			data[i][k] = v
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			states[i] = r.runners[i].Run(data[i])
+		}(i)
+	}
+	wg.Wait()
+
+	failed := -1
+	for i, mr := range r.runners {
+		line := fmt.Sprintf("mirror %d: %s", i+1, proto.StateName[states[i]])
+		if p, ok := mr.(Placed); ok && p.Where() != "" {
+			line += " on " + p.Where()
+		}
+		if states[i] != proto.STATE_COMPLETE && failed == -1 {
+			failed = i
+		}
+		fmt.Fprintln(r.log, line)
+	}
+	if failed != -1 {
+		fmt.Fprintf(r.log, "error: mirror %d %s: %s\n", failed+1, proto.StateName[states[failed]],
+			r.runners[failed].Log().LastLine(MAX_MIRROR_ERROR_LENGTH))
+		return states[failed]
+	}
+
+	// Mirrors that ran in the same place aren't different vantage points.
+	where := map[string]int{} // place => first mirror that ran there
+	for i, mr := range r.runners {
+		p, ok := mr.(Placed)
+		if !ok || p.Where() == "" {
+			continue
+		}
+		if first, ok := where[p.Where()]; ok {
+			fmt.Fprintf(r.log, "error: mirrors %d and %d both ran on %s\n", first+1, i+1, p.Where())
+			return proto.STATE_FAIL
+		}
+		where[p.Where()] = i
+	}
+
+	for i := 1; i < len(data); i++ {
+		keys := diffKeys(data[0], data[i])
+		if len(keys) == 0 {
+			continue
+		}
+		divergence := fmt.Sprintf("mirror %d job data differs from mirror 1: %s", i+1, strings.Join(keys, ", "))
+		r.Lock()
+		r.divergence = divergence
+		r.Unlock()
+		if r.policy == proto.MIRROR_DIVERGENCE_FLAG {
+			log.Warnf("[chain=%d,job=%s]: Mirrors diverged, flagged: %s.", r.requestId, r.jobName, divergence)
+			fmt.Fprintf(r.log, "warning: %s\n", divergence)
+			break
+		}
+		log.Errorf("[chain=%d,job=%s]: Mirrors diverged, failing the job: %s.", r.requestId, r.jobName, divergence)
+		fmt.Fprintf(r.log, "error: %s\n", divergence)
+		return proto.STATE_FAIL
+	}
+
+	for k := range jobData {
+		delete(jobData, k)
+	}
+	for k, v := range data[0] {
+		jobData[k] = v
+	}
+	return proto.STATE_COMPLETE
+}
+
+// Stop stops every mirror. It returns the first error.
+func (r *MirrorRunner) Stop(grace time.Duration) error {
+	errs := make([]error, len(r.runners))
+	var wg sync.WaitGroup
+	for i := range r.runners {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = r.runners[i].Stop(grace)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status returns the status of every mirror, like "mirror 1: ...; mirror 2: ...".
+func (r *MirrorRunner) Status() string {
+	status := make([]string, len(r.runners))
+	for i, mr := range r.runners {
+		status[i] = fmt.Sprintf("mirror %d: %s", i+1, mr.Status())
+	}
+	return strings.Join(status, "; ")
+}
+
+// Progress returns the progress of the mirror that is least done, or -1 if no
+// mirror reports progress.
+func (r *MirrorRunner) Progress() int {
+	progress := -1
+	for _, mr := range r.runners {
+		if p := mr.Progress(); p >= 0 && (progress == -1 || p < progress) {
+			progress = p
+		}
+	}
+	return progress
+}
+
+func (r *MirrorRunner) Log() *Log {
+	return r.log
+}
+
+// EstimatedCost returns the sum of the estimated cost of the mirrors that have
+// one (see Coster), since every mirror creates its own resources.
+func (r *MirrorRunner) EstimatedCost() (float64, bool) {
+	var cost float64
+	hasCost := false
+	for _, mr := range r.runners {
+		if c, ok := mr.(Coster); ok {
+			if est, ok := c.EstimatedCost(); ok {
+				cost += est
+				hasCost = true
+			}
+		}
+	}
+	return cost, hasCost
+}
+
+// ActualCost returns the sum of what the mirrors cost.
+func (r *MirrorRunner) ActualCost() float64 {
+	var cost float64
+	for _, mr := range r.runners {
+		if c, ok := mr.(Coster); ok {
+			if _, ok := c.EstimatedCost(); ok {
+				cost += c.ActualCost()
+			}
+		}
+	}
+	return cost
+}
+
+// Divergence returns why the mirrors diverged, or "" if they didn't.
+func (r *MirrorRunner) Divergence() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.divergence
+}
+
+// diffKeys returns the sorted keys of the job data that differ between a and b.
+func diffKeys(a, b map[string]interface{}) []string {
+	keys := []string{}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
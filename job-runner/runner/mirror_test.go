@@ -0,0 +1,104 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// placedRunner is a mock.Runner that ran on a host.
+type placedRunner struct {
+	*mock.Runner
+	host string
+}
+
+func (r placedRunner) Where() string {
+	return r.host
+}
+
+func TestMirrorRunner(t *testing.T) {
+	check := func(jobData map[string]interface{}) *mock.Runner {
+		return mock.NewRunner(true, "checking", nil, nil, jobData)
+	}
+
+	// Mirrors that agree complete, with the job data of the first mirror
+	mr := runner.NewMirrorRunner(1, "check", []runner.Runner{
+		check(map[string]interface{}{"healthy": true}),
+		check(map[string]interface{}{"healthy": true}),
+	}, "")
+	jobData := map[string]interface{}{"hosts": 3}
+	if state := mr.Run(jobData); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	expect := map[string]interface{}{"hosts": 3, "healthy": true}
+	if !reflect.DeepEqual(jobData, expect) {
+		t.Errorf("job data = %v, expected %v", jobData, expect)
+	}
+	if d := mr.Divergence(); d != "" {
+		t.Errorf("divergence = %q, expected none", d)
+	}
+	if status := mr.Status(); status != "mirror 1: checking; mirror 2: checking" {
+		t.Errorf("status = %q, expected the status of both mirrors", status)
+	}
+
+	// Mirrors that diverge fail the job, and don't change its job data
+	mr = runner.NewMirrorRunner(1, "check", []runner.Runner{
+		check(map[string]interface{}{"healthy": true}),
+		check(map[string]interface{}{"healthy": false}),
+	}, proto.MIRROR_DIVERGENCE_FAIL)
+	jobData = map[string]interface{}{"hosts": 3}
+	if state := mr.Run(jobData); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+	if _, ok := jobData["healthy"]; ok {
+		t.Errorf("job data = %v, expected it unchanged", jobData)
+	}
+	if d := mr.Divergence(); d != "mirror 2 job data differs from mirror 1: healthy" {
+		t.Errorf("divergence = %q, expected healthy to differ", d)
+	}
+	if line := mr.Log().LastLine(100); !strings.HasPrefix(line, "error: mirror 2 job data differs") {
+		t.Errorf("last log line = %q, expected the divergence", line)
+	}
+
+	// Or are flagged
+	mr = runner.NewMirrorRunner(1, "check", []runner.Runner{
+		check(map[string]interface{}{"healthy": true}),
+		check(map[string]interface{}{}),
+	}, proto.MIRROR_DIVERGENCE_FLAG)
+	if state := mr.Run(map[string]interface{}{}); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	if d := mr.Divergence(); d == "" {
+		t.Error("divergence is empty, expected it flagged")
+	}
+
+	// A mirror that fails fails the job
+	failed := check(nil)
+	failed.FailRuns = 1
+	mr = runner.NewMirrorRunner(1, "check", []runner.Runner{check(nil), failed}, "")
+	if state := mr.Run(map[string]interface{}{}); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+	if line := mr.Log().LastLine(100); !strings.HasPrefix(line, "error: mirror 2 FAIL") {
+		t.Errorf("last log line = %q, expected mirror 2 failed", line)
+	}
+
+	// Mirrors must run in different places
+	mr = runner.NewMirrorRunner(1, "check", []runner.Runner{
+		placedRunner{check(nil), "host1"},
+		placedRunner{check(nil), "host2"},
+		placedRunner{check(nil), "host1"},
+	}, "")
+	if state := mr.Run(map[string]interface{}{}); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+	if line := mr.Log().LastLine(100); line != "error: mirrors 1 and 3 both ran on host1" {
+		t.Errorf("last log line = %q, expected mirrors 1 and 3 on host1", line)
+	}
+}
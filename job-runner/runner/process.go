@@ -0,0 +1,417 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// CgroupRoot is the cgroup (v2) under which jobs with ISOLATION_CGROUP get
+	// a cgroup of their own. The Job Runner must be able to create cgroups in
+	// it, and it must have the memory and cpu controllers enabled in its
+	// cgroup.subtree_control.
+	CgroupRoot = "/sys/fs/cgroup/spincycle"
+
+	// CgroupFallback runs jobs with ISOLATION_CGROUP that can't be put in a
+	// cgroup with process limits only, which don't limit their CPUs. The
+	// fallback is written to the job's log and shown in its status. If false,
+	// such jobs fail without running.
+	CgroupFallback = false
+
+	// ProcessUpdateInterval is how often a job running in its own process
+	// sends its status, progress, and log output to the Job Runner.
+	ProcessUpdateInterval = time.Second
+)
+
+// NewProcessRunnerFactory returns a RunnerFactory that makes runners which run
+// jobs with resource limits (proto.Job.Limits) in a process of their own, and
+// uses rf to make runners for other jobs. The process is started with cmd, the
+// command and args of a program that calls RunProcess, like the Job Runner
+// with -run-job.
+//
+// The process gets the job and its jobData on stdin, and sends updates on
+// stdout like a spincycle-agent (proto.AgentUpdate). Its stderr is written to
+// the job's log, so errors like running out of memory are in the log. If the
+// job uses more memory or CPU time than its limits, the process is killed and
+// the job fails. Stopping the job sends SIGTERM to the process, and if it
+// doesn't stop within the grace period, it's killed.
+func NewProcessRunnerFactory(rf RunnerFactory, cmd []string) RunnerFactory {
+	return &processRunnerFactory{
+		rf:  rf,
+		cmd: cmd,
+	}
+}
+
+type processRunnerFactory struct {
+	rf  RunnerFactory
+	cmd []string
+}
+
+func (f *processRunnerFactory) Make(pJob proto.Job, requestId uint) (Runner, error) {
+	if pJob.Limits == nil {
+		return f.rf.Make(pJob, requestId)
+	}
+	switch pJob.Limits.Isolation {
+	case "", proto.ISOLATION_PROCESS, proto.ISOLATION_CGROUP:
+	default:
+		return nil, fmt.Errorf("invalid isolation %q", pJob.Limits.Isolation)
+	}
+	return &processRunner{
+		job:       pJob,
+		requestId: requestId,
+		cmd:       f.cmd,
+		log:       NewLog(),
+		stopChan:  make(chan struct{}),
+		status:    "starting process",
+		progress:  -1,
+		Mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// processRunner is a Runner that runs a job in a process of its own.
+type processRunner struct {
+	job       proto.Job
+	requestId uint
+	cmd       []string
+	log       *Log          // log output sent by the process
+	stopChan  chan struct{} // closed on Stop
+	// --
+	process     *os.Process   // nil until started
+	status      string        // last status sent by the process
+	progress    int           // last progress sent by the process
+	grace       time.Duration // how long Run waits for the process after Stop
+	running     bool          // true when Run is running
+	stopped     bool          // true after Stop closes stopChan
+	fallback    string        // how the job is less isolated than it asked, "" if it isn't
+	*sync.Mutex               // guards fields after the separator
+}
+
+func (r *processRunner) Run(jobData map[string]interface{}) byte {
+	r.Lock()
+	r.running = true
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		r.running = false
+		r.Unlock()
+		r.log.Close()
+	}()
+
+	cmd := exec.Command(r.cmd[0], r.cmd[1:]...)
+	cmd.Stderr = r.log
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return r.fail("can't start process: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return r.fail("can't start process: %s", err)
+	}
+
+	r.Lock()
+	if r.stopped {
+		r.Unlock()
+		return proto.STATE_STOPPED // never ran
+	}
+	if err := cmd.Start(); err != nil {
+		r.Unlock()
+		return r.fail("can't start process: %s", err)
+	}
+	r.process = cmd.Process
+	r.status = "running in process " + strconv.Itoa(cmd.Process.Pid)
+	r.Unlock()
+	log.Infof("[chain=%d,job=%s]: Running the job in process %d with limits %+v.",
+		r.requestId, r.job.Name, cmd.Process.Pid, *r.job.Limits)
+
+	// Put the process in its cgroup before it gets the job, so the job never
+	// runs outside of it. If it can't be, the job doesn't run, unless
+	// CgroupFallback.
+	if r.job.Limits.Isolation == proto.ISOLATION_CGROUP {
+		cgroup, err := newCgroup(cmd.Process.Pid, *r.job.Limits)
+		switch {
+		case err == nil:
+			defer os.Remove(cgroup)
+		case CgroupFallback:
+			log.Warnf("[chain=%d,job=%s]: Can't put the job in a cgroup, running it with process limits only: %s",
+				r.requestId, r.job.Name, err)
+			fmt.Fprintf(r.log, "spincycle: can't put the job in a cgroup, running it with process limits only, which don't limit its CPUs: %s\n", err)
+			r.Lock()
+			r.fallback = "without a cgroup"
+			r.Unlock()
+		default:
+			cmd.Process.Kill()
+			stdin.Close()
+			cmd.Wait()
+			return r.fail("can't put the job in a cgroup for %s isolation: %s", proto.ISOLATION_CGROUP, err)
+		}
+	}
+
+	// Send the job, then read its updates until the process exits.
+	go func() {
+		json.NewEncoder(stdin).Encode(proto.AgentWork{
+			RequestId: r.requestId,
+			Job:       r.job,
+			JobData:   jobData,
+		})
+		stdin.Close()
+	}()
+	doneChan := make(chan *proto.AgentUpdate, 1)
+	go func() {
+		var last *proto.AgentUpdate
+		dec := json.NewDecoder(stdout)
+		for {
+			var u proto.AgentUpdate
+			if err := dec.Decode(&u); err != nil {
+				break
+			}
+			r.update(u)
+			if u.Done {
+				last = &u
+			}
+		}
+		io.Copy(ioutil.Discard, stdout)
+		doneChan <- last
+	}()
+
+	// Wait for the process to exit or a call to Stop
+	var last *proto.AgentUpdate
+	forceKilled := false
+	select {
+	case last = <-doneChan:
+	case <-r.stopChan:
+		r.Lock()
+		grace := r.grace
+		r.Unlock()
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case last = <-doneChan:
+		case <-timer.C:
+			log.Errorf("[chain=%d,job=%s]: Job process %d did not exit within %s after it was stopped, killing it.",
+				r.requestId, r.job.Name, cmd.Process.Pid, grace)
+			cmd.Process.Kill()
+			forceKilled = true
+			last = <-doneChan
+		}
+	}
+	err = cmd.Wait()
+
+	r.Lock()
+	stopped := r.stopped
+	r.Unlock()
+	switch {
+	case forceKilled:
+		return proto.STATE_FORCE_KILLED
+	case last == nil && stopped:
+		return proto.STATE_STOPPED
+	case last == nil:
+		// Killed for exceeding its limits, or it crashed
+		return r.fail("process exited without a result: %v", err)
+	}
+
+	for k, v := range last.JobData {
+		jobData[k] = v
+	}
+	if last.State == proto.STATE_COMPLETE {
+		log.Infof("[chain=%d,job=%s]: Job completed successfully.", r.requestId, r.job.Name)
+	} else {
+		log.Errorf("[chain=%d,job=%s]: Job did not complete successfully (state: %s).", r.requestId, r.job.Name, proto.StateName[last.State])
+	}
+	return last.State
+}
+
+func (r *processRunner) Stop(grace time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+	if !r.running || r.stopped {
+		return nil
+	}
+	r.grace = grace
+	r.stopped = true
+	close(r.stopChan)
+	if r.process == nil {
+		return nil
+	}
+	return r.process.Signal(syscall.SIGTERM)
+}
+
+func (r *processRunner) Status() string {
+	r.Lock()
+	defer r.Unlock()
+	if r.fallback != "" {
+		return r.status + " (" + r.fallback + ")"
+	}
+	return r.status
+}
+
+func (r *processRunner) Progress() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.progress
+}
+
+func (r *processRunner) Log() *Log {
+	return r.log
+}
+
+// update records an update from the process.
+func (r *processRunner) update(u proto.AgentUpdate) {
+	if u.Log != "" {
+		r.log.Write([]byte(u.Log))
+	}
+	r.Lock()
+	r.status = u.Status
+	r.progress = u.Progress
+	r.Unlock()
+}
+
+// fail logs why the job failed, sets it as its status, and returns STATE_FAIL.
+func (r *processRunner) fail(format string, args ...interface{}) byte {
+	msg := fmt.Sprintf(format, args...)
+	log.Errorf("[chain=%d,job=%s]: %s", r.requestId, r.job.Name, msg)
+	r.Lock()
+	r.status = msg
+	r.Unlock()
+	return proto.STATE_FAIL
+}
+
+// -------------------------------------------------------------------------- //
+
+// RunProcess runs one job in this process for a runner made by a process
+// runner factory: it reads the job and its jobData (proto.AgentWork) from in,
+// limits the resources of this process, makes a runner for the job with rf,
+// and runs it, writing updates (proto.AgentUpdate) to out. The last update has
+// the job's final state and jobData. Closing stopChan stops the job. rf must
+// not make runners that run jobs in another process.
+func RunProcess(rf RunnerFactory, in io.Reader, out io.Writer, stopChan <-chan struct{}) error {
+	var work proto.AgentWork
+	if err := json.NewDecoder(in).Decode(&work); err != nil {
+		return fmt.Errorf("can't decode job: %s", err)
+	}
+	if work.JobData == nil {
+		work.JobData = map[string]interface{}{}
+	}
+	enc := json.NewEncoder(out)
+
+	if work.Job.Limits != nil {
+		if err := setRlimits(*work.Job.Limits); err != nil {
+			enc.Encode(proto.AgentUpdate{
+				Status:   "can't set resource limits: " + err.Error(),
+				Progress: -1,
+				Done:     true,
+				State:    proto.STATE_FAIL,
+			})
+			return err
+		}
+	}
+
+	jr, err := rf.Make(work.Job, work.RequestId)
+	if err != nil {
+		enc.Encode(proto.AgentUpdate{
+			Status:   "can't make job runner: " + err.Error(),
+			Progress: -1,
+			Done:     true,
+			State:    proto.STATE_FAIL,
+		})
+		return err
+	}
+
+	stateChan := make(chan byte, 1)
+	go func() {
+		stateChan <- jr.Run(work.JobData)
+	}()
+
+	ticker := time.NewTicker(ProcessUpdateInterval)
+	defer ticker.Stop()
+	offset := 0
+	for {
+		select {
+		case state := <-stateChan:
+			output, _, _, _ := jr.Log().Read(offset)
+			return enc.Encode(proto.AgentUpdate{
+				Status:   jr.Status(),
+				Progress: jr.Progress(),
+				Log:      string(output),
+				Done:     true,
+				State:    state,
+				JobData:  work.JobData,
+			})
+		case <-stopChan:
+			// The Job Runner kills this process if the job doesn't stop
+			// within its grace period, so wait for it here as long as it takes.
+			go jr.Stop(24 * time.Hour)
+			stopChan = nil // don't select it again
+		case <-ticker.C:
+			output, next, _, _ := jr.Log().Read(offset)
+			offset = next
+			if err := enc.Encode(proto.AgentUpdate{
+				Status:   jr.Status(),
+				Progress: jr.Progress(),
+				Log:      string(output),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setRlimits limits the memory and CPU time of this process. Memory is limited
+// with RLIMIT_DATA rather than RLIMIT_AS because the Go runtime reserves much
+// more address space than it uses.
+func setRlimits(l proto.JobLimits) error {
+	if l.MemoryMB > 0 {
+		max := uint64(l.MemoryMB) << 20
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: max, Max: max}); err != nil {
+			return fmt.Errorf("RLIMIT_DATA: %s", err)
+		}
+	}
+	if l.CPUSeconds > 0 {
+		max := uint64(l.CPUSeconds)
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: max, Max: max}); err != nil {
+			return fmt.Errorf("RLIMIT_CPU: %s", err)
+		}
+	}
+	return nil
+}
+
+// newCgroup makes a cgroup under CgroupRoot with the limits and moves the
+// process into it. It returns the path of the cgroup, which the caller removes
+// when the process has exited.
+func newCgroup(pid int, l proto.JobLimits) (string, error) {
+	dir := filepath.Join(CgroupRoot, "job-"+strconv.Itoa(pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	files := [][2]string{} // name, value
+	if l.MemoryMB > 0 {
+		files = append(files, [2]string{"memory.max", strconv.FormatUint(uint64(l.MemoryMB)<<20, 10)})
+	}
+	if l.CPUs > 0 {
+		const period = 100000 // microseconds
+		files = append(files, [2]string{"cpu.max", fmt.Sprintf("%d %d", int(l.CPUs*period), period)})
+	}
+	files = append(files, [2]string{"cgroup.procs", strconv.Itoa(pid)})
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644); err != nil {
+			os.Remove(dir)
+			return "", fmt.Errorf("%s: %s", f[0], err)
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// typeFactory is a job.Factory that makes jobs by type.
+type typeFactory map[string]func() job.Job
+
+func (f typeFactory) Make(jobType, jobName string) (job.Job, error) {
+	if make, ok := f[jobType]; ok {
+		return make(), nil
+	}
+	return nil, job.ErrUnknownJobType
+}
+
+// stopJob is a job that blocks until it's stopped.
+type stopJob struct {
+	*mock.Job
+}
+
+func (j stopJob) Stop() error {
+	close(j.RunBlock)
+	return nil
+}
+
+// allocJob is a job that allocates 1 GiB.
+type allocJob struct {
+	*mock.Job
+}
+
+func (j allocJob) Run(jobData map[string]interface{}) (job.Return, error) {
+	mem := make([][]byte, 0, 1024)
+	for i := 0; i < 1024; i++ {
+		mem = append(mem, make([]byte, 1<<20))
+		mem[i][0] = 1
+	}
+	jobData["allocated"] = len(mem)
+	return job.Return{State: proto.STATE_COMPLETE}, nil
+}
+
+// TestProcessHelper is not a test: it's the process that the process runners
+// in these tests start to run a job.
+func TestProcessHelper(t *testing.T) {
+	if os.Getenv("SPINCYCLE_TEST_PROCESS") != "1" {
+		return
+	}
+	jf := typeFactory{
+		"ok": func() job.Job {
+			return &mock.Job{
+				RunReturn:    job.Return{State: proto.STATE_COMPLETE},
+				AddedJobData: map[string]interface{}{"out": "y"},
+				LogOutput:    "line1\n",
+				StatusResp:   "done",
+			}
+		},
+		"fail": func() job.Job {
+			return &mock.Job{RunReturn: job.Return{State: proto.STATE_FAIL, Exit: 1}}
+		},
+		"stop": func() job.Job {
+			return stopJob{&mock.Job{RunBlock: make(chan struct{}), RunReturn: job.Return{State: proto.STATE_STOPPED}}}
+		},
+		"hang": func() job.Job {
+			return &mock.Job{RunBlock: make(chan struct{})}
+		},
+		"alloc": func() job.Job {
+			return allocJob{&mock.Job{}}
+		},
+	}
+	stopChan := make(chan struct{})
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGTERM)
+		<-sigChan
+		close(stopChan)
+	}()
+	runner.RunProcess(runner.NewRunnerFactory(jf, nil, nil, nil, nil, nil), os.Stdin, os.Stdout, stopChan)
+	os.Exit(0)
+}
+
+func processRunner(t *testing.T, pJob proto.Job) runner.Runner {
+	os.Setenv("SPINCYCLE_TEST_PROCESS", "1")
+	rf := runner.NewProcessRunnerFactory(&mock.RunnerFactory{}, []string{os.Args[0], "-test.run=^TestProcessHelper$"})
+	jr, err := rf.Make(pJob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jr
+}
+
+func TestProcessRunner(t *testing.T) {
+	defer os.Unsetenv("SPINCYCLE_TEST_PROCESS")
+
+	jr := processRunner(t, proto.Job{Name: "job1", Type: "ok", Limits: &proto.JobLimits{MemoryMB: 1024}})
+	jobData := map[string]interface{}{"in": "x"}
+	if state := jr.Run(jobData); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	expect := map[string]interface{}{"in": "x", "out": "y"}
+	if !reflect.DeepEqual(jobData, expect) {
+		t.Errorf("jobData = %v, expected %v", jobData, expect)
+	}
+	if out, _, _, closed := jr.Log().Read(0); !strings.Contains(string(out), "line1\n") || !closed {
+		t.Errorf("log = %q (closed %t), expected line1 and closed", out, closed)
+	}
+	if jr.Status() != "done" {
+		t.Errorf("status = %q, expected done", jr.Status())
+	}
+
+	jr = processRunner(t, proto.Job{Name: "job2", Type: "fail", Limits: &proto.JobLimits{}})
+	if state := jr.Run(map[string]interface{}{}); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+
+	// The job type is unknown in the process
+	jr = processRunner(t, proto.Job{Name: "job3", Type: "unknown", Limits: &proto.JobLimits{}})
+	if state := jr.Run(map[string]interface{}{}); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+
+	// Jobs without limits are made by the wrapped factory
+	local := mock.NewRunner(true, "", nil, nil, nil)
+	rf := runner.NewProcessRunnerFactory(&mock.RunnerFactory{RunnersToReturn: map[string]*mock.Runner{"job4": local}}, nil)
+	if jr, _ := rf.Make(proto.Job{Name: "job4"}, 1); jr != local {
+		t.Errorf("got %v, expected the local runner", jr)
+	}
+}
+
+// A job that uses more memory than its limit is killed, and the Job Runner is
+// fine.
+func TestProcessRunnerMemoryLimit(t *testing.T) {
+	defer os.Unsetenv("SPINCYCLE_TEST_PROCESS")
+
+	jr := processRunner(t, proto.Job{Name: "job1", Type: "alloc", Limits: &proto.JobLimits{MemoryMB: 256}})
+	jobData := map[string]interface{}{}
+	if state := jr.Run(jobData); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+	if _, ok := jobData["allocated"]; ok {
+		t.Error("job allocated more memory than its limit")
+	}
+	if out, _, _, _ := jr.Log().Read(0); !strings.Contains(string(out), "out of memory") {
+		t.Errorf("log = %q, expected the process to run out of memory", out)
+	}
+}
+
+// A job with cgroup isolation that can't get a cgroup fails, unless the
+// fallback to process limits is enabled.
+func TestProcessRunnerCgroup(t *testing.T) {
+	defer os.Unsetenv("SPINCYCLE_TEST_PROCESS")
+	defer func(root string) {
+		runner.CgroupRoot = root
+		runner.CgroupFallback = false
+	}(runner.CgroupRoot)
+	runner.CgroupRoot = filepath.Join(t.TempDir(), "missing")
+
+	limits := &proto.JobLimits{MemoryMB: 1024, CPUs: 0.5, Isolation: proto.ISOLATION_CGROUP}
+	jr := processRunner(t, proto.Job{Name: "job1", Type: "ok", Limits: limits})
+	jobData := map[string]interface{}{}
+	if state := jr.Run(jobData); state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[state])
+	}
+	if len(jobData) != 0 {
+		t.Errorf("jobData = %v, expected the job not to run", jobData)
+	}
+	if !strings.Contains(jr.Status(), "can't put the job in a cgroup") {
+		t.Errorf("status = %q, expected why the job failed", jr.Status())
+	}
+
+	runner.CgroupFallback = true
+	jr = processRunner(t, proto.Job{Name: "job2", Type: "ok", Limits: limits})
+	if state := jr.Run(jobData); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[state])
+	}
+	if out, _, _, _ := jr.Log().Read(0); !strings.Contains(string(out), "can't put the job in a cgroup") {
+		t.Errorf("log = %q, expected the fallback", out)
+	}
+	if jr.Status() != "done (without a cgroup)" {
+		t.Errorf("status = %q, expected done (without a cgroup)", jr.Status())
+	}
+}
+
+func TestProcessRunnerStop(t *testing.T) {
+	defer os.Unsetenv("SPINCYCLE_TEST_PROCESS")
+
+	// The job stops
+	jr := processRunner(t, proto.Job{Name: "job1", Type: "stop", Limits: &proto.JobLimits{}})
+	stateChan := make(chan byte)
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	time.Sleep(500 * time.Millisecond)
+	jr.Stop(5 * time.Second)
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_STOPPED {
+			t.Errorf("state = %s, expected STOPPED", proto.StateName[state])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+
+	// The job ignores Stop, so its process is killed after the grace period
+	jr = processRunner(t, proto.Job{Name: "job2", Type: "hang", Limits: &proto.JobLimits{}})
+	go func() { stateChan <- jr.Run(map[string]interface{}{}) }()
+	time.Sleep(500 * time.Millisecond)
+	jr.Stop(100 * time.Millisecond)
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_FORCE_KILLED {
+			t.Errorf("state = %s, expected FORCE_KILLED", proto.StateName[state])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
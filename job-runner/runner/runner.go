@@ -4,7 +4,10 @@
 package runner
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/square/spincycle/job"
 	"github.com/square/spincycle/proto"
@@ -15,87 +18,233 @@ import (
 // A Runner runs and manages one job in a job chain. The job must implement
 // the Job interface (spincycle/job.Job).
 type Runner interface {
-	// Run runs the job, blocking until it has completed or when Stop is called.
-	// It returns true if the job completes, else false. Jobs are all or nothing
-	// so "completes" means the returns on its own (isn't stopped) with no error
-	// and a zero exit. jobData from the previous job is passed to the job, and
-	// the job is free to write to it.
-	Run(jobData map[string]interface{}) bool
+	// Run runs the job, blocking until it has completed, when Stop is called,
+	// or when the job times out. It returns the final state of the job:
+	// proto.STATE_COMPLETE if the job completes, proto.STATE_TIMEOUT if the job
+	// was stopped because it ran longer than its timeout, proto.STATE_STALLED
+	// if it was stopped because it didn't send a heartbeat in time (see
+	// proto.Job.HeartbeatTimeout), else another state
+	// (usually proto.STATE_FAIL). Jobs are all or nothing so "completes" means
+	// the job returns on its own (isn't stopped) with no error and a zero exit.
+	// jobData from the previous job is passed to the job, and the job is free
+	// to write to it.
+	Run(jobData map[string]interface{}) byte
 
 	// Stop stops the job if it's running. The job is responsible for stopping
-	// quickly because Stop blocks while waiting for the job to stop. Stop
-	// returns the error from calling Stop interface method of the job.
-	Stop() error
+	// quickly because Stop blocks while calling the Stop interface method of
+	// the job, and it returns the error from that call.
+	//
+	// After Stop is called, Run waits up to grace for the job to return, then
+	// it returns proto.STATE_STOPPED. If the job doesn't return in time, it is
+	// abandoned (left running) and Run returns proto.STATE_FORCE_KILLED.
+	Stop(grace time.Duration) error
 
 	// Status returns the status of the job as reported by the job. The job
 	// is responsible for handling status requests asynchronously while running.
 	Status() string
+
+	// Progress returns the percent done (0-100) last reported by the job, or
+	// -1 if the job doesn't implement the job.ProgressReporter interface.
+	Progress() int
+
+	// Log returns the log output captured from the job. Only jobs that
+	// implement the job.Logger interface write log output. The log is closed
+	// when Run returns.
+	Log() *Log
+}
+
+// A Checkpointer is a Runner that can checkpoint the jobData set by its job
+// while it runs (see job.Checkpointer). Checkpoint returns false if the job
+// can't be checkpointed.
+type Checkpointer interface {
+	Checkpoint() (map[string]interface{}, bool)
 }
 
+// A Coster is a Runner of a job that has a cost (see job.Coster). EstimatedCost
+// returns false if the job has none, in which case it isn't counted against
+// the chain's budget.
+type Coster interface {
+	EstimatedCost() (float64, bool)
+	ActualCost() float64
+}
+
+var (
+	_ Runner       = (*JobRunner)(nil)
+	_ Checkpointer = (*JobRunner)(nil)
+	_ Coster       = (*JobRunner)(nil)
+)
+
 // A JobRunner represents all information needed to run a job.
 type JobRunner struct {
-	job       job.Job // job to run
-	requestId uint    // for logging
+	job              job.Job       // job to run
+	requestId        uint          // for logging
+	timeout          time.Duration // max run time, 0 = no timeout
+	heartbeatTimeout time.Duration // max time between heartbeats, 0 = not checked
+	log              *Log          // log output captured from the job
+	heartbeatChan    chan struct{} // heartbeats from the job
+	artifacts        ArtifactStore // stores the job's artifacts, nil if not stored
 	// --
 	stopChan    chan struct{} // used on Stop
+	cancel      func()        // cancels the context of the job on Stop
+	grace       time.Duration // how long Run waits for the job after Stop
 	running     bool          // true when Run is running
-	*sync.Mutex               // guards running
+	stopped     bool          // true after Stop closes stopChan
+	progress    int           // percent done reported by the job, -1 if never
+	*sync.Mutex               // guards cancel, grace, running, stopped, and progress
 }
 
-// NewJobRunner returns a JobRunner for a job.
-func NewJobRunner(job job.Job, requestId uint) *JobRunner {
-	return &JobRunner{
-		job:       job,
-		requestId: requestId,
+// NewJobRunner returns a JobRunner for a job. If timeout is greater than zero,
+// the job is stopped if it runs longer than timeout.
+func NewJobRunner(j job.Job, requestId uint, timeout time.Duration) *JobRunner {
+	jobLog := NewLog()
+	if logger, ok := j.(job.Logger); ok {
+		logger.SetLog(jobLog)
+	}
+	r := &JobRunner{
+		job:           j,
+		requestId:     requestId,
+		timeout:       timeout,
+		log:           jobLog,
+		heartbeatChan: make(chan struct{}, 1),
 		// --
 		stopChan: make(chan struct{}),
 		running:  false,
+		progress: -1,
 		Mutex:    &sync.Mutex{},
 	}
+	if reporter, ok := j.(job.ProgressReporter); ok {
+		r.progress = 0
+		reporter.SetProgress(r.setProgress)
+	}
+	if heartbeater, ok := j.(job.Heartbeater); ok {
+		heartbeater.SetHeartbeat(r.heartbeat)
+	}
+	return r
+}
+
+// SetHeartbeatTimeout makes Run stop the job and return proto.STATE_STALLED if
+// the job doesn't send a heartbeat within d of when it starts or of its last
+// heartbeat. The job must implement job.Heartbeater. Call it before Run.
+func (r *JobRunner) SetHeartbeatTimeout(d time.Duration) {
+	r.heartbeatTimeout = d
+}
+
+// SetArtifactStore makes Run store the artifacts of a job that outputs them
+// (see job.ArtifactProducer) in the store when the job returns. Call it before
+// Run.
+func (r *JobRunner) SetArtifactStore(s ArtifactStore) {
+	r.artifacts = s
 }
 
-func (r *JobRunner) Run(jobData map[string]interface{}) bool {
+func (r *JobRunner) Run(jobData map[string]interface{}) byte {
+	// The job times out when the context deadline is exceeded. Without a
+	// timeout, ctx.Done() returns nil which blocks forever in the select.
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	// The job's context is also canceled on Stop, so a job.CancelableJob is
+	// stopped without relying on its Stop method.
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	r.Lock()
 	log.Infof("[chain=%d,job=%s]: Starting the job.", r.requestId, r.job.Name())
 	stateChan := make(chan byte, 1) // must be buffered!
-	go r.runJob(jobData, stateChan)
+	go r.runJob(jobCtx, jobData, stateChan)
 	r.running = true
+	r.cancel = cancel
 	r.Unlock()
 
 	defer func() {
 		r.Lock()
 		r.running = false
 		r.Unlock()
+		r.log.Close()
 	}()
 
-	// Wait for job to finish or a call to Stop
-	select {
-	case state := <-stateChan: // job finished
-		switch state {
-		case proto.STATE_COMPLETE:
-			log.Infof("[chain=%d,job=%s]: Job completed successfully.", r.requestId, r.job.Name())
-			return true
-		default:
-			log.Errorf("[chain=%d,job=%s]: Job did not complete successfully (state: %s).", r.requestId, r.job.Name(), proto.StateName[state])
-			return false
+	// The job stalls when it doesn't send a heartbeat in time. Without a
+	// heartbeat timeout, stalled and heartbeats are nil, which block forever
+	// in the select.
+	var stalled <-chan time.Time
+	var heartbeats <-chan struct{}
+	var stallTimer *time.Timer
+	if r.heartbeatTimeout > 0 {
+		stallTimer = time.NewTimer(r.heartbeatTimeout)
+		defer stallTimer.Stop()
+		stalled = stallTimer.C
+		heartbeats = r.heartbeatChan
+	}
+
+	// Wait for job to finish, a call to Stop, the timeout, or a stall
+	for {
+		select {
+		case state := <-stateChan: // job finished
+			switch state {
+			case proto.STATE_COMPLETE:
+				log.Infof("[chain=%d,job=%s]: Job completed successfully.", r.requestId, r.job.Name())
+				return proto.STATE_COMPLETE
+			case proto.STATE_POLICY_VIOLATION:
+				log.Errorf("[chain=%d,job=%s]: Job violated a policy.", r.requestId, r.job.Name())
+				return proto.STATE_POLICY_VIOLATION
+			default:
+				log.Errorf("[chain=%d,job=%s]: Job did not complete successfully (state: %s).", r.requestId, r.job.Name(), proto.StateName[state])
+				return proto.STATE_FAIL
+			}
+		case <-r.stopChan: // Stop called
+			r.Lock()
+			grace := r.grace
+			r.Unlock()
+
+			// Some jobs ignore Stop, so don't wait for them forever and don't
+			// pretend they stopped if they didn't.
+			timer := time.NewTimer(grace)
+			defer timer.Stop()
+			select {
+			case <-stateChan:
+				log.Infof("[chain=%d,job=%s]: Job returned after it was stopped.", r.requestId, r.job.Name())
+				return proto.STATE_STOPPED
+			case <-timer.C:
+				log.Errorf("[chain=%d,job=%s]: Job did not return within %s after it was stopped, abandoning it.",
+					r.requestId, r.job.Name(), grace)
+				return proto.STATE_FORCE_KILLED
+			}
+		case <-ctx.Done(): // timeout
+			log.Errorf("[chain=%d,job=%s]: Job timed out after %s, stopping it.", r.requestId, r.job.Name(), r.timeout)
+			r.Stop(0)
+			return proto.STATE_TIMEOUT
+		case <-heartbeats:
+			if !stallTimer.Stop() {
+				<-stallTimer.C
+			}
+			stallTimer.Reset(r.heartbeatTimeout)
+		case <-stalled: // no heartbeat
+			log.Errorf("[chain=%d,job=%s]: Job sent no heartbeat for %s, stopping it.", r.requestId, r.job.Name(), r.heartbeatTimeout)
+			r.Stop(0)
+			return proto.STATE_STALLED
 		}
-	case <-r.stopChan: // Stop called
-		return false
 	}
 }
 
-func (r *JobRunner) Stop() error {
+func (r *JobRunner) Stop(grace time.Duration) error {
 	r.Lock()
-	defer r.Unlock()
-
-	if !r.running {
+	if !r.running || r.stopped {
+		r.Unlock()
 		return nil
 	}
 
 	// Stop Run() which is waiting on either runJob() or this:
+	r.grace = grace
+	r.stopped = true
 	close(r.stopChan)
+	r.cancel()
+	r.Unlock()
 
-	// Stop is a blocking call that should return quickly.
+	// Stop is a blocking call that should return quickly. It's called without
+	// the lock so that Run can return after the grace period even if it doesn't.
 	err := r.job.Stop()
 	if err != nil {
 		log.Errorf("[chain=%d,job=%s]: Error stopping job (error: %s).", r.requestId, r.job.Name(), err)
@@ -111,12 +260,71 @@ func (r *JobRunner) Status() string {
 	return r.job.Status()
 }
 
+func (r *JobRunner) Progress() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.progress
+}
+
+func (r *JobRunner) Log() *Log {
+	return r.log
+}
+
+// Checkpoint returns the jobData checkpointed by the job if it implements
+// job.Checkpointer.
+func (r *JobRunner) Checkpoint() (map[string]interface{}, bool) {
+	c, ok := r.job.(job.Checkpointer)
+	if !ok {
+		return nil, false
+	}
+	return c.Checkpoint(), true
+}
+
+// EstimatedCost returns the estimated cost of the job if it implements
+// job.Coster.
+func (r *JobRunner) EstimatedCost() (float64, bool) {
+	c, ok := r.job.(job.Coster)
+	if !ok {
+		return 0, false
+	}
+	return c.EstimatedCost(), true
+}
+
+// ActualCost returns what the last run of the job cost, or 0 if it doesn't
+// implement job.Coster.
+func (r *JobRunner) ActualCost() float64 {
+	c, ok := r.job.(job.Coster)
+	if !ok {
+		return 0
+	}
+	return c.ActualCost()
+}
+
 // -------------------------------------------------------------------------- //
 
+// setProgress is the function given to jobs that implement job.ProgressReporter.
+func (r *JobRunner) setProgress(percent uint) {
+	if percent > 100 {
+		percent = 100
+	}
+	r.Lock()
+	r.progress = int(percent)
+	r.Unlock()
+}
+
+// heartbeat is the function given to jobs that implement job.Heartbeater.
+func (r *JobRunner) heartbeat() {
+	select {
+	case r.heartbeatChan <- struct{}{}:
+	default: // a heartbeat is already waiting
+	}
+}
+
 // runJob runs a job and creates a job log entry when it's done.
-func (r *JobRunner) runJob(jobData map[string]interface{}, stateChan chan byte) {
-	// job.Run is a blocking operation that could take a long time.
-	jobReturn, err := r.job.Run(jobData)
+func (r *JobRunner) runJob(ctx context.Context, jobData map[string]interface{}, stateChan chan byte) {
+	// job.Run is a blocking operation that could take a long time. Jobs that
+	// aren't a job.CancelableJob ignore ctx and are stopped by Stop.
+	jobReturn, err := job.Cancelable(r.job).RunContext(ctx, jobData)
 	if err != nil {
 		log.Errorf("[chain=%d,job=%s]: Error running job (error: %s).", r.requestId, r.job.Name(), err)
 	}
@@ -125,6 +333,20 @@ func (r *JobRunner) runJob(jobData map[string]interface{}, stateChan chan byte)
 		"stderr: %s.", r.requestId, r.job.Name(), proto.StateName[jobReturn.State], jobReturn.Exit,
 		jobReturn.Error, jobReturn.Stdout, jobReturn.Stderr)
 
+	// The error of a job that failed is the last line of its log, so it's
+	// kept with the chain's result. The log is closed if the job was
+	// abandoned, so the error is lost.
+	if jobReturn.State != proto.STATE_COMPLETE {
+		if err == nil {
+			err = jobReturn.Error
+		}
+		if err != nil {
+			fmt.Fprintf(r.log, "\nerror: %s\n", err)
+		}
+	}
+
+	r.storeArtifacts()
+
 	// create a JobLogEntry and ship it off
 	// jle := NewJLE(jobData, jobReturn, err)
 	// jle.Send()
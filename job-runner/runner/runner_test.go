@@ -3,6 +3,8 @@
 package runner_test
 
 import (
+	"context"
+	"reflect"
 	"testing"
 	"time"
 
@@ -22,26 +24,59 @@ func TestFactory(t *testing.T) {
 		JobToReturn: job,
 		MakeErr:     mock.ErrJob,
 	}
-	rf := runner.NewRunnerFactory(jf)
+	rf := runner.NewRunnerFactory(jf, nil, nil, nil, nil, nil)
 
-	jr, err := rf.Make("jtype", "jname", []byte{}, 3)
+	jr, err := rf.Make(proto.Job{Type: "jtype", Name: "jname"}, 3)
 	if err != mock.ErrJob {
 		t.Errorf("err = nil, expected %s", mock.ErrJob)
 	}
 	if jr != nil {
 		t.Error("got a JobRunner, expected nil")
 	}
+
+	// The job has an invalid timeout.
+	jf.MakeErr = nil
+	jr, err = rf.Make(proto.Job{Type: "jtype", Name: "jname", Timeout: "soon"}, 3)
+	if err == nil {
+		t.Error("err = nil, expected an error for the invalid timeout")
+	}
+	if jr != nil {
+		t.Error("got a JobRunner, expected nil")
+	}
+}
+
+// The factory gives the job the env of its chain.
+func TestFactoryContext(t *testing.T) {
+	job := &mock.Job{}
+	rf := runner.NewRunnerFactory(&mock.JobFactory{JobToReturn: job}, nil, nil, nil, nil, nil)
+
+	env := map[string]string{"datacenter": "east", "cluster": "db1", "dryRun": "true", "requestor": "finch", "ticket": "OPS-1"}
+	if _, err := rf.Make(proto.Job{Type: "jtype", Name: "jname", Env: env}, 3); err != nil {
+		t.Fatal(err)
+	}
+	ctx := job.Context
+	if ctx.RequestId != 3 || ctx.Datacenter != "east" || ctx.Cluster != "db1" || !ctx.DryRun || ctx.Requestor != "finch" {
+		t.Errorf("context = %+v, expected request 3, east, db1, dry run, finch", ctx)
+	}
+	if !reflect.DeepEqual(ctx.Env, env) {
+		t.Errorf("context env = %v, expected %v", ctx.Env, env)
+	}
+
+	env["dryRun"] = "maybe"
+	if _, err := rf.Make(proto.Job{Type: "jtype", Name: "jname", Env: env}, 3); err == nil {
+		t.Error("err = nil, expected an error for the invalid dry run flag")
+	}
 }
 
 func TestRunFail(t *testing.T) {
 	job := &mock.Job{
 		RunReturn: job.Return{State: proto.STATE_FAIL},
 	}
-	jr := runner.NewJobRunner(job, 3)
+	jr := runner.NewJobRunner(job, 3, 0)
 
-	completed := jr.Run(noJobData)
-	if completed != false {
-		t.Errorf("completed = %t, expected false", completed)
+	state := jr.Run(noJobData)
+	if state != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_FAIL])
 	}
 }
 
@@ -50,13 +85,13 @@ func TestRunSuccess(t *testing.T) {
 		RunReturn:    job.Return{State: proto.STATE_COMPLETE},
 		AddedJobData: map[string]interface{}{"some": "thing"},
 	}
-	jr := runner.NewJobRunner(job, 3)
+	jr := runner.NewJobRunner(job, 3, 0)
 
 	jobData := make(map[string]interface{})
 
-	completed := jr.Run(jobData)
-	if completed != true {
-		t.Errorf("completed = %t, expected true", completed)
+	state := jr.Run(jobData)
+	if state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_COMPLETE])
 	}
 
 	val, ok := jobData["some"]
@@ -65,30 +100,172 @@ func TestRunSuccess(t *testing.T) {
 	}
 }
 
+func TestRunPolicyViolation(t *testing.T) {
+	job := &mock.Job{
+		RunReturn: job.Return{State: proto.STATE_POLICY_VIOLATION},
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+
+	state := jr.Run(noJobData)
+	if state != proto.STATE_POLICY_VIOLATION {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_POLICY_VIOLATION])
+	}
+}
+
 func TestRunStop(t *testing.T) {
 	runBlock := make(chan struct{})
 	defer close(runBlock)
 	job := &mock.Job{
 		RunBlock: runBlock,
 	}
-	jr := runner.NewJobRunner(job, 3)
+	jr := runner.NewJobRunner(job, 3, 0)
 
 	// Run the job and let it block
-	completedChan := make(chan bool)
+	stateChan := make(chan byte)
 	go func() {
-		completedChan <- jr.Run(noJobData)
+		stateChan <- jr.Run(noJobData)
 	}()
 
 	// Sleep just a moment to let Run ^ run, then stop it
 	time.Sleep(200 * time.Millisecond)
-	err := jr.Stop()
+	err := jr.Stop(time.Second)
 	if err != nil {
 		t.Errorf("err = %s, expected nil", err)
 	}
 
-	completed := <-completedChan
-	if completed != false {
-		t.Errorf("completed = %t, expected false", completed)
+	// The mock job doesn't return on Stop, so it's abandoned after the grace period.
+	state := <-stateChan
+	if state != proto.STATE_FORCE_KILLED {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_FORCE_KILLED])
+	}
+}
+
+func TestRunStopGrace(t *testing.T) {
+	runBlock := make(chan struct{})
+	job := &mock.Job{
+		RunBlock: runBlock,
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+
+	stateChan := make(chan byte)
+	go func() {
+		stateChan <- jr.Run(noJobData)
+	}()
+
+	// Stop the job, and let it return within the grace period.
+	time.Sleep(200 * time.Millisecond)
+	jr.Stop(5 * time.Second)
+	close(runBlock)
+
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_STOPPED {
+			t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_STOPPED])
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Run did not return when the job returned")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	runBlock := make(chan struct{})
+	defer close(runBlock)
+	job := &mock.Job{
+		RunBlock: runBlock,
+	}
+	jr := runner.NewJobRunner(job, 3, 100*time.Millisecond)
+
+	// The job blocks until runBlock is closed, so it times out.
+	start := time.Now()
+	state := jr.Run(noJobData)
+	if state != proto.STATE_TIMEOUT {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_TIMEOUT])
+	}
+	if d := time.Now().Sub(start); d > 2*time.Second {
+		t.Errorf("Run returned after %s, expected it to return after the 100ms timeout", d)
+	}
+}
+
+// cancelableJob is a mock.Job that runs until its context is canceled and
+// ignores Stop.
+type cancelableJob struct {
+	*mock.Job
+	deadline chan bool // whether ctx had a deadline, sent when RunContext returns
+}
+
+func (j cancelableJob) RunContext(ctx context.Context, jobData map[string]interface{}) (job.Return, error) {
+	<-ctx.Done()
+	_, ok := ctx.Deadline()
+	j.deadline <- ok
+	return job.Return{State: proto.STATE_FAIL}, ctx.Err()
+}
+
+func TestRunCancel(t *testing.T) {
+	// A job stopped by canceling its context returns within the grace period.
+	j := cancelableJob{&mock.Job{}, make(chan bool, 1)}
+	jr := runner.NewJobRunner(j, 3, 0)
+	stateChan := make(chan byte)
+	go func() {
+		stateChan <- jr.Run(noJobData)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	jr.Stop(5 * time.Second)
+	select {
+	case state := <-stateChan:
+		if state != proto.STATE_STOPPED {
+			t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_STOPPED])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return when the job's context was canceled")
+	}
+	if <-j.deadline {
+		t.Error("ctx has a deadline, expected none without a timeout")
+	}
+
+	// A job that times out gets a context with its deadline.
+	j = cancelableJob{&mock.Job{}, make(chan bool, 1)}
+	jr = runner.NewJobRunner(j, 3, 100*time.Millisecond)
+	if state := jr.Run(noJobData); state != proto.STATE_TIMEOUT {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_TIMEOUT])
+	}
+	select {
+	case ok := <-j.deadline:
+		if !ok {
+			t.Error("ctx has no deadline, expected the job's timeout")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("job's context was not canceled when it timed out")
+	}
+}
+
+func TestRunHeartbeat(t *testing.T) {
+	// A job that sends heartbeats runs longer than its heartbeat timeout.
+	runBlock := make(chan struct{})
+	job := &mock.Job{
+		RunBlock:       runBlock,
+		HeartbeatEvery: 10 * time.Millisecond,
+		RunReturn:      job.Return{State: proto.STATE_COMPLETE},
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+	jr.SetHeartbeatTimeout(100 * time.Millisecond)
+	time.AfterFunc(300*time.Millisecond, func() { close(runBlock) })
+	if state := jr.Run(noJobData); state != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_COMPLETE])
+	}
+
+	// A job that hangs without sending heartbeats stalls.
+	runBlock = make(chan struct{})
+	defer close(runBlock)
+	job.RunBlock = runBlock
+	job.HeartbeatEvery = 0
+	jr = runner.NewJobRunner(job, 3, 0)
+	jr.SetHeartbeatTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if state := jr.Run(noJobData); state != proto.STATE_STALLED {
+		t.Errorf("state = %s, expected %s", proto.StateName[state], proto.StateName[proto.STATE_STALLED])
+	}
+	if d := time.Now().Sub(start); d > 2*time.Second {
+		t.Errorf("Run returned after %s, expected it to return after the 100ms heartbeat timeout", d)
 	}
 }
 
@@ -97,10 +274,65 @@ func TestRunStatus(t *testing.T) {
 	job := &mock.Job{
 		StatusResp: expectedStatus,
 	}
-	jr := runner.NewJobRunner(job, 3)
+	jr := runner.NewJobRunner(job, 3, 0)
 
 	status := jr.Status()
 	if status != expectedStatus {
 		t.Errorf("status = %s, expected %s", status, expectedStatus)
 	}
 }
+
+func TestRunLog(t *testing.T) {
+	job := &mock.Job{
+		RunReturn: job.Return{State: proto.STATE_COMPLETE},
+		LogOutput: "some output",
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+
+	jr.Run(noJobData)
+
+	out, _, _, closed := jr.Log().Read(0)
+	if string(out) != job.LogOutput {
+		t.Errorf("log = %q, expected %q", out, job.LogOutput)
+	}
+	if !closed {
+		t.Error("log not closed after Run returned")
+	}
+}
+
+func TestRunLogError(t *testing.T) {
+	job := &mock.Job{
+		RunReturn: job.Return{State: proto.STATE_FAIL},
+		RunErr:    mock.ErrJob,
+		LogOutput: "some output",
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+
+	jr.Run(noJobData)
+
+	// The error is the last line of the log of a job that failed
+	out, _, _, _ := jr.Log().Read(0)
+	expect := job.LogOutput + "\nerror: " + mock.ErrJob.Error() + "\n"
+	if string(out) != expect {
+		t.Errorf("log = %q, expected %q", out, expect)
+	}
+}
+
+func TestRunProgress(t *testing.T) {
+	job := &mock.Job{
+		RunReturn:      job.Return{State: proto.STATE_COMPLETE},
+		ProgressOutput: []uint{50, 150},
+	}
+	jr := runner.NewJobRunner(job, 3, 0)
+
+	if progress := jr.Progress(); progress != 0 {
+		t.Errorf("progress = %d before Run, expected 0", progress)
+	}
+
+	jr.Run(noJobData)
+
+	// Progress over 100% is capped.
+	if progress := jr.Progress(); progress != 100 {
+		t.Errorf("progress = %d, expected 100", progress)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+)
+
+// S3Credentials are the AWS credentials of an S3ArtifactStore, usually from
+// $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN.
+type S3Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // only for temporary credentials
+}
+
+// NewS3ArtifactStore returns an ArtifactStore that stores artifacts as objects
+// in S3, or a service compatible with it, at bucketURL: the URL of a bucket
+// and an optional key prefix, like "https://s3.us-east-1.amazonaws.com/bucket/prefix".
+// The key of an artifact is "<prefix>/<request ID>/<job name>/<name>", and its
+// content type is the object's. Requests are signed with AWS Signature
+// Version 4 for the region.
+func NewS3ArtifactStore(client *http.Client, bucketURL, region string, creds S3Credentials) (*S3ArtifactStore, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 bucket URL %q", bucketURL)
+	}
+	bucketPath := strings.Trim(u.Path, "/")
+	if bucketPath == "" {
+		return nil, fmt.Errorf("invalid S3 bucket URL %q: no bucket", bucketURL)
+	}
+	bucket, prefix := bucketPath, ""
+	if i := strings.Index(bucketPath, "/"); i > 0 {
+		bucket, prefix = bucketPath[:i], bucketPath[i+1:]+"/"
+	}
+	return &S3ArtifactStore{
+		client: client,
+		host:   u.Scheme + "://" + u.Host,
+		bucket: bucket,
+		prefix: prefix,
+		region: region,
+		creds:  creds,
+	}, nil
+}
+
+// S3ArtifactStore is an ArtifactStore of objects in an S3 bucket.
+type S3ArtifactStore struct {
+	client *http.Client
+	host   string // scheme://host[:port]
+	bucket string
+	prefix string // "" or ends with "/"
+	region string
+	creds  S3Credentials
+}
+
+func (s *S3ArtifactStore) Put(requestId uint, jobName string, a job.Artifact) error {
+	if err := ValidArtifactName(a.Name); err != nil {
+		return err
+	}
+	req, err := s.request("PUT", s.key(requestId, jobName)+a.Name, nil, a.Data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", a.ContentType)
+	_, _, err = s.do(req)
+	return err
+}
+
+func (s *S3ArtifactStore) Get(requestId uint, jobName, name string) (job.Artifact, error) {
+	if ValidArtifactName(name) != nil {
+		return job.Artifact{}, ErrArtifactNotFound
+	}
+	req, err := s.request("GET", s.key(requestId, jobName)+name, nil, nil)
+	if err != nil {
+		return job.Artifact{}, err
+	}
+	data, header, err := s.do(req)
+	if err != nil {
+		return job.Artifact{}, err
+	}
+	return job.Artifact{Name: name, ContentType: header.Get("Content-Type"), Data: data}, nil
+}
+
+// List lists the objects of the job's artifacts, and gets the content type of
+// each one.
+func (s *S3ArtifactStore) List(requestId uint, jobName string) ([]proto.JobArtifact, error) {
+	prefix := s.key(requestId, jobName)
+	artifacts := []proto.JobArtifact{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.request("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		body, _, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("can't decode S3 response: %s", err)
+		}
+		for _, object := range list.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if ValidArtifactName(name) != nil {
+				continue
+			}
+			artifacts = append(artifacts, proto.JobArtifact{Name: name, Size: object.Size})
+		}
+		if !list.IsTruncated {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	for i, artifact := range artifacts {
+		req, err := s.request("HEAD", prefix+artifact.Name, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, header, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		artifacts[i].ContentType = header.Get("Content-Type")
+	}
+	return artifacts, nil
+}
+
+// key returns the key prefix of the job's artifacts.
+func (s *S3ArtifactStore) key(requestId uint, jobName string) string {
+	return s.prefix + strconv.FormatUint(uint64(requestId), 10) + "/" + jobName + "/"
+}
+
+// request makes a signed request for the object with the key, or for the
+// bucket if key is "".
+func (s *S3ArtifactStore) request(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	objectPath := "/" + s.bucket + "/" + key
+	req, err := http.NewRequest(method, s.host+s3Escape(objectPath), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	s.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// do sends the request and returns the response body and header. It returns
+// ErrArtifactNotFound if there's no such object.
+func (s *S3ArtifactStore) do(req *http.Request) ([]byte, http.Header, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, res.Header, nil
+	case http.StatusNotFound:
+		return nil, nil, ErrArtifactNotFound
+	}
+	return nil, nil, fmt.Errorf("S3 %s %s returned status %d: %s", req.Method, req.URL.Path, res.StatusCode, body)
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (s *S3ArtifactStore) sign(req *http.Request, body []byte, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if s.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.SessionToken)
+		headers["x-amz-security-token"] = s.creds.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.creds.SecretKey)
+	for _, part := range []string{amzDate[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3Escape escapes every byte of a path except unreserved characters and "/",
+// as AWS Signature Version 4 requires.
+func s3Escape(path string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
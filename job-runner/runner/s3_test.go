@@ -0,0 +1,118 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+)
+
+// fakeS3 is enough of S3 for an S3ArtifactStore: it puts, gets, and lists
+// objects in one bucket.
+type fakeS3 struct {
+	objects map[string]job.Artifact // key => object
+	*sync.Mutex
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = job.Artifact{ContentType: r.Header.Get("Content-Type"), Data: data}
+	case key == "" && r.URL.Query().Get("list-type") == "2":
+		type object struct {
+			Key  string
+			Size int
+		}
+		var list struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []object
+		}
+		for k, o := range s.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				list.Contents = append(list.Contents, object{Key: k, Size: len(o.Data)})
+			}
+		}
+		sort.Slice(list.Contents, func(i, j int) bool { return list.Contents[i].Key < list.Contents[j].Key })
+		xml.NewEncoder(w).Encode(list)
+	default:
+		o, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", o.ContentType)
+		if r.Method == "GET" {
+			w.Write(o.Data)
+		}
+	}
+}
+
+func TestS3ArtifactStore(t *testing.T) {
+	s3 := &fakeS3{objects: map[string]job.Artifact{}, Mutex: &sync.Mutex{}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	creds := runner.S3Credentials{AccessKey: "AKID", SecretKey: "secret"}
+	store, err := runner.NewS3ArtifactStore(server.Client(), server.URL+"/bucket/spincycle", "us-west-2", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []job.Artifact{
+		{Name: "report.html", ContentType: "text/html", Data: []byte("<p>ok</p>")},
+		{Name: "changes.diff", ContentType: "text/x-diff", Data: []byte("+host3\n")},
+	} {
+		if err := store.Put(1, "diff hosts", a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := s3.objects["spincycle/1/diff hosts/report.html"]; !ok {
+		t.Errorf("objects = %v, expected spincycle/1/diff hosts/report.html", s3.objects)
+	}
+
+	list, err := store.List(1, "diff hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []proto.JobArtifact{
+		{Name: "changes.diff", ContentType: "text/x-diff", Size: 7},
+		{Name: "report.html", ContentType: "text/html", Size: 9},
+	}
+	if !reflect.DeepEqual(list, expect) {
+		t.Errorf("artifacts = %+v, expected %+v", list, expect)
+	}
+
+	a, err := store.Get(1, "diff hosts", "report.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ContentType != "text/html" || string(a.Data) != "<p>ok</p>" {
+		t.Errorf("artifact = %s %q, expected text/html <p>ok</p>", a.ContentType, a.Data)
+	}
+	if _, err := store.Get(1, "diff hosts", "nope.txt"); err != runner.ErrArtifactNotFound {
+		t.Errorf("err = %v, expected ErrArtifactNotFound", err)
+	}
+
+	if _, err := runner.NewS3ArtifactStore(server.Client(), server.URL, "us-west-2", creds); err == nil {
+		t.Error("err = nil, expected an error for a URL without a bucket")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Square, Inc.
+
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Warmups manages the lifecycle of the job.Warmups of a job factory: warming
+// them up at startup, checking their health, and closing them at shutdown.
+type Warmups struct {
+	warmups map[string]job.Warmup // job type => Warmup
+	health  map[string]error      // job type => error from last Health call
+	// --
+	*sync.RWMutex // guards health
+}
+
+// NewWarmups returns the Warmups of a job factory. If the factory does not
+// implement job.WarmFactory, it has no Warmups.
+func NewWarmups(jobFactory job.Factory) *Warmups {
+	warmups := map[string]job.Warmup{}
+	if wf, ok := jobFactory.(job.WarmFactory); ok {
+		warmups = wf.Warmups()
+	}
+	return &Warmups{
+		warmups: warmups,
+		health:  map[string]error{},
+		RWMutex: &sync.RWMutex{},
+	}
+}
+
+// Warm warms up every job type. If one fails, the job types already warmed up
+// are closed, and an error is returned.
+func (w *Warmups) Warm() error {
+	warmed := []string{}
+	for _, jobType := range w.jobTypes() {
+		log.Infof("Warming up job type %s.", jobType)
+		if err := w.warmups[jobType].Warm(); err != nil {
+			for _, t := range warmed {
+				w.warmups[t].Close()
+			}
+			return fmt.Errorf("can't warm up job type %s: %s", jobType, err)
+		}
+		warmed = append(warmed, jobType)
+	}
+	return nil
+}
+
+// CheckHealth checks the health of every job type every interval until
+// stopChan is closed, so it should be run in a goroutine.
+func (w *Warmups) CheckHealth(interval time.Duration, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.checkHealth()
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Healthy returns the error from the last health check of a job type, or nil
+// if it was healthy or the type has no Warmup.
+func (w *Warmups) Healthy(jobType string) error {
+	w.RLock()
+	defer w.RUnlock()
+	return w.health[jobType]
+}
+
+// Health returns job type => "ok" or the error from the last health check. It
+// can be published with expvar.Func.
+func (w *Warmups) Health() interface{} {
+	w.RLock()
+	defer w.RUnlock()
+	health := map[string]string{}
+	for jobType := range w.warmups {
+		if err := w.health[jobType]; err != nil {
+			health[jobType] = err.Error()
+		} else {
+			health[jobType] = "ok"
+		}
+	}
+	return health
+}
+
+// Close closes every job type. It returns the last error, if any.
+func (w *Warmups) Close() error {
+	var lastErr error
+	for _, jobType := range w.jobTypes() {
+		if err := w.warmups[jobType].Close(); err != nil {
+			log.Errorf("Error closing job type %s (error: %s).", jobType, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// -------------------------------------------------------------------------- //
+
+func (w *Warmups) checkHealth() {
+	health := map[string]error{}
+	for jobType, warmup := range w.warmups {
+		if err := warmup.Health(); err != nil {
+			log.Errorf("Job type %s is not healthy (error: %s).", jobType, err)
+			health[jobType] = err
+		}
+	}
+	w.Lock()
+	w.health = health
+	w.Unlock()
+}
+
+// jobTypes returns the job types with a Warmup, sorted so they are warmed up
+// in a consistent order.
+func (w *Warmups) jobTypes() []string {
+	types := make([]string, 0, len(w.warmups))
+	for jobType := range w.warmups {
+		types = append(types, jobType)
+	}
+	sort.Strings(types)
+	return types
+}
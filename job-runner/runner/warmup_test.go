@@ -0,0 +1,70 @@
+// Copyright 2017, Square, Inc.
+
+package runner_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestWarmupsWarmError(t *testing.T) {
+	a := &mock.Warmup{}
+	b := &mock.Warmup{WarmErr: mock.ErrJob}
+	w := runner.NewWarmups(&mock.JobFactory{
+		WarmupsToReturn: map[string]job.Warmup{"a": a, "b": b},
+	})
+
+	if err := w.Warm(); err == nil {
+		t.Error("err = nil, expected an error")
+	}
+
+	// Type a was warmed up before b failed, so it's closed.
+	if !a.Warmed || !a.Closed {
+		t.Errorf("a warmed = %t, closed = %t, expected both true", a.Warmed, a.Closed)
+	}
+}
+
+func TestWarmupsHealth(t *testing.T) {
+	a := &mock.Warmup{}
+	b := &mock.Warmup{HealthErr: errors.New("pool is empty")}
+	jf := &mock.JobFactory{
+		JobToReturn:     &mock.Job{},
+		WarmupsToReturn: map[string]job.Warmup{"a": a, "b": b},
+	}
+	w := runner.NewWarmups(jf)
+	if err := w.Warm(); err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+
+	// Check health once.
+	stopChan := make(chan struct{})
+	go w.CheckHealth(10*time.Millisecond, stopChan)
+	time.Sleep(50 * time.Millisecond)
+	close(stopChan)
+
+	expect := map[string]string{"a": "ok", "b": "pool is empty"}
+	if health := w.Health(); !reflect.DeepEqual(health, expect) {
+		t.Errorf("health = %v, expected %v", health, expect)
+	}
+
+	// Jobs of an unhealthy type can't be made.
+	rf := runner.NewRunnerFactory(jf, w, nil, nil, nil, nil)
+	if _, err := rf.Make(proto.Job{Type: "a", Name: "job1"}, 1); err != nil {
+		t.Errorf("err = %s, expected nil for healthy type a", err)
+	}
+	if _, err := rf.Make(proto.Job{Type: "b", Name: "job2"}, 1); err == nil {
+		t.Error("err = nil, expected an error for unhealthy type b")
+	}
+
+	w.Close()
+	if !a.Closed || !b.Closed {
+		t.Errorf("a closed = %t, b closed = %t, expected both true", a.Closed, b.Closed)
+	}
+}
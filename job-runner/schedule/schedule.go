@@ -0,0 +1,264 @@
+// Copyright 2017, Square, Inc.
+
+// Package schedule starts job chains at a scheduled time. Start times are
+// absolute wall clock times, saved as-is, so they survive restarts and clock
+// changes: a chain never starts before its start time by the wall clock, and,
+// while the Job Runner runs, no later than Tolerance after it.
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrStopped = errors.New("scheduler is stopped")
+)
+
+// DEFAULT_TOLERANCE is how late a chain can start by default if the wall clock
+// jumps forward.
+const DEFAULT_TOLERANCE = 30 * time.Second
+
+// A Clock tells the time and runs funcs after a duration. Timers measure
+// durations, like time.AfterFunc, which doesn't follow changes to the wall
+// clock (Now).
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a func waiting to run, like a *time.Timer.
+type Timer interface {
+	// Stop stops the timer. It returns false if the func already ran or the
+	// timer was stopped.
+	Stop() bool
+}
+
+// RealClock is the real time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// A Scheduler calls a start func for each job chain at the chain's StartAt time.
+// If Dir is set, every scheduled chain is saved in Dir until it starts or its
+// schedule is canceled, so schedules survive restarts: when the Job Runner
+// starts, it loads the saved chains with Load and schedules them again.
+//
+// Timers don't follow changes to the wall clock, so a timer wakes up at least
+// every Tolerance to check the wall clock: if the clock jumped forward, the
+// chain starts at most Tolerance late, and if the clock went back, the timer
+// waits longer. A chain that's already late when it's scheduled, like one
+// loaded after the Job Runner was down, starts now, and it's logged.
+type Scheduler struct {
+	Dir       string        // where scheduled chains are saved, "" = not saved
+	Clock     Clock         // default RealClock, set before scheduling chains
+	Tolerance time.Duration // max time a chain starts late, default DEFAULT_TOLERANCE
+	// --
+	start       func(requestId uint)
+	timers      map[uint]timer // request ID => timer that starts it
+	gen         uint64         // generation of the last timer
+	stopped     bool
+	*sync.Mutex // guards timers, gen, and stopped
+}
+
+type timer struct {
+	Timer
+	gen     uint64
+	startAt time.Time // by the wall clock
+}
+
+// NewScheduler makes a Scheduler that calls start in a goroutine for each chain
+// that is due.
+func NewScheduler(start func(requestId uint)) *Scheduler {
+	return &Scheduler{
+		Clock:     RealClock,
+		Tolerance: DEFAULT_TOLERANCE,
+		start:     start,
+		timers:    map[uint]timer{},
+		Mutex:     &sync.Mutex{},
+	}
+}
+
+// Schedule schedules the chain to start at jc.StartAt, replacing its schedule
+// if it was already scheduled. If StartAt is not in the future, the chain is
+// started now. The chain is saved in Dir, if set, before it's scheduled.
+func (s *Scheduler) Schedule(jc proto.JobChain) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	if err := s.save(jc); err != nil {
+		return err
+	}
+	if t, ok := s.timers[jc.RequestId]; ok {
+		t.Stop()
+	}
+	s.gen++
+	if late := s.Clock.Now().Sub(jc.StartAt); late > s.Tolerance {
+		log.Warnf("[chain=%d]: Scheduled to start at %s, starting %s late.", jc.RequestId, jc.StartAt, late)
+	}
+	s.wait(timer{gen: s.gen, startAt: jc.StartAt}, jc.RequestId)
+	return nil
+}
+
+// Cancel cancels the chain's schedule and removes it from Dir. It returns
+// false if the chain wasn't scheduled.
+func (s *Scheduler) Cancel(requestId uint) bool {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.timers[requestId]
+	if !ok {
+		return false
+	}
+	t.Stop()
+	delete(s.timers, requestId)
+	s.remove(requestId)
+	return true
+}
+
+// Scheduled returns when the chain is scheduled to start. It returns false if
+// the chain isn't scheduled.
+func (s *Scheduler) Scheduled(requestId uint) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.timers[requestId]
+	return t.startAt, ok
+}
+
+// Stop stops the scheduler without starting or canceling any chains: they stay
+// saved in Dir to be loaded when the Job Runner starts again. It returns the
+// request IDs of the chains that were scheduled, sorted.
+func (s *Scheduler) Stop() []uint {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = true
+	ids := make([]uint, 0, len(s.timers))
+	for requestId, t := range s.timers {
+		t.Stop()
+		ids = append(ids, requestId)
+	}
+	s.timers = map[uint]timer{}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Load returns the chains saved in Dir, sorted by request ID. It returns no
+// chains if Dir is not set or doesn't exist yet. The chains are not scheduled
+// until they're passed to Schedule.
+func (s *Scheduler) Load() ([]proto.JobChain, error) {
+	chains := []proto.JobChain{}
+	if s.Dir == "" {
+		return chains, nil
+	}
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return chains, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var jc proto.JobChain
+		if err := json.Unmarshal(bytes, &jc); err != nil {
+			return nil, fmt.Errorf("can't decode scheduled chain %s: %s", f.Name(), err)
+		}
+		chains = append(chains, jc)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i].RequestId < chains[j].RequestId })
+	return chains, nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// wait starts the timer of a chain: until its start time by the wall clock,
+// but no longer than Tolerance. The caller must hold the lock.
+func (s *Scheduler) wait(t timer, requestId uint) {
+	d := t.startAt.Sub(s.Clock.Now())
+	if d > s.Tolerance {
+		d = s.Tolerance
+	}
+	gen := t.gen
+	t.Timer = s.Clock.AfterFunc(d, func() { s.due(requestId, gen) })
+	s.timers[requestId] = t
+}
+
+// due starts a chain when its timer fires, unless the schedule was canceled
+// or replaced (by a timer of a later generation) after the timer fired. If
+// it's not the start time yet by the wall clock, it waits again.
+func (s *Scheduler) due(requestId uint, gen uint64) {
+	s.Lock()
+	t, ok := s.timers[requestId]
+	if !ok || t.gen != gen || s.stopped {
+		s.Unlock()
+		return
+	}
+	if s.Clock.Now().Before(t.startAt) {
+		s.wait(t, requestId)
+		s.Unlock()
+		return
+	}
+	delete(s.timers, requestId)
+	s.remove(requestId)
+	s.Unlock()
+	s.start(requestId)
+}
+
+// save writes the chain to Dir, if set, replacing it atomically. The caller
+// must hold the lock.
+func (s *Scheduler) save(jc proto.JobChain) error {
+	if s.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(jc)
+	if err != nil {
+		return err
+	}
+	file := s.file(jc.RequestId)
+	if err := ioutil.WriteFile(file+".tmp", bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// remove removes the chain from Dir, if set. The caller must hold the lock.
+func (s *Scheduler) remove(requestId uint) {
+	if s.Dir == "" {
+		return
+	}
+	os.Remove(s.file(requestId))
+}
+
+func (s *Scheduler) file(requestId uint) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%d.json", requestId))
+}
@@ -0,0 +1,157 @@
+// Copyright 2017, Square, Inc.
+
+package schedule_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/schedule"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestSchedule(t *testing.T) {
+	started := make(chan uint, 10)
+	s := schedule.NewScheduler(func(requestId uint) { started <- requestId })
+
+	if err := s.Schedule(proto.JobChain{RequestId: 1, StartAt: time.Now().Add(50 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Schedule(proto.JobChain{RequestId: 2, StartAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if at, ok := s.Scheduled(2); !ok || at.IsZero() {
+		t.Errorf("chain 2 not scheduled")
+	}
+
+	select {
+	case id := <-started:
+		if id != 1 {
+			t.Errorf("started chain %d, expected 1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chain 1 was not started")
+	}
+	if _, ok := s.Scheduled(1); ok {
+		t.Error("chain 1 is still scheduled after it started")
+	}
+
+	// Rescheduling replaces the schedule, and a start time in the past starts
+	// the chain now
+	if err := s.Schedule(proto.JobChain{RequestId: 2, StartAt: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-started:
+		if id != 2 {
+			t.Errorf("started chain %d, expected 2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("chain 2 was not started")
+	}
+
+	// A canceled chain isn't started
+	s.Schedule(proto.JobChain{RequestId: 3, StartAt: time.Now().Add(50 * time.Millisecond)})
+	if !s.Cancel(3) {
+		t.Error("Cancel returned false, expected true")
+	}
+	if s.Cancel(3) {
+		t.Error("Cancel returned true for a canceled chain, expected false")
+	}
+	select {
+	case id := <-started:
+		t.Errorf("started chain %d, expected none", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestScheduleDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := make(chan uint, 10)
+	s := schedule.NewScheduler(func(requestId uint) { started <- requestId })
+	s.Dir = dir
+
+	startAt := time.Now().Add(time.Hour).UTC().Round(time.Second)
+	jc4 := proto.JobChain{RequestId: 4, StartAt: startAt, Metadata: map[string]string{"ticket": "T-1"}}
+	jc5 := proto.JobChain{RequestId: 5, StartAt: startAt}
+	s.Schedule(jc5)
+	s.Schedule(jc4)
+	s.Schedule(proto.JobChain{RequestId: 6, StartAt: startAt})
+	s.Cancel(6)
+
+	// Stopping the scheduler (restarting the Job Runner) keeps the schedules
+	if ids := s.Stop(); !reflect.DeepEqual(ids, []uint{4, 5}) {
+		t.Errorf("scheduled = %v, expected 4 and 5", ids)
+	}
+	if err := s.Schedule(jc4); err != schedule.ErrStopped {
+		t.Errorf("err = %v, expected %s", err, schedule.ErrStopped)
+	}
+
+	s = schedule.NewScheduler(func(requestId uint) { started <- requestId })
+	s.Dir = dir
+	chains, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 2 {
+		t.Fatalf("loaded %d chains, expected 2", len(chains))
+	}
+	if chains[0].RequestId != 4 || !chains[0].StartAt.Equal(startAt) || chains[0].Metadata["ticket"] != "T-1" {
+		t.Errorf("chain = %+v, expected chain 4", chains[0])
+	}
+	if chains[1].RequestId != 5 {
+		t.Errorf("chain = %+v, expected chain 5", chains[1])
+	}
+
+	// A started chain is removed from the dir
+	chains[0].StartAt = time.Now()
+	s.Schedule(chains[0])
+	<-started
+	if chains, _ = s.Load(); len(chains) != 1 || chains[0].RequestId != 5 {
+		t.Errorf("chains = %+v, expected only chain 5", chains)
+	}
+}
+
+func TestScheduleClockChanges(t *testing.T) {
+	clock := mock.NewClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	var started []uint
+	s := schedule.NewScheduler(func(requestId uint) { started = append(started, requestId) })
+	s.Clock = clock
+	s.Tolerance = time.Minute
+
+	startAt := clock.Now().Add(time.Hour)
+	s.Schedule(proto.JobChain{RequestId: 1, StartAt: startAt})
+	s.Schedule(proto.JobChain{RequestId: 2, StartAt: startAt.Add(2 * time.Hour)})
+
+	// The clock is set back 10 minutes: after an hour, it's not 1pm yet, so
+	// chain 1 doesn't start early
+	clock.Jump(-10 * time.Minute)
+	clock.Advance(time.Hour)
+	if len(started) != 0 {
+		t.Fatalf("started %v at %s, expected none before %s", started, clock.Now(), startAt)
+	}
+	clock.Advance(10 * time.Minute)
+	if !reflect.DeepEqual(started, []uint{1}) {
+		t.Fatalf("started %v at %s, expected chain 1", started, clock.Now())
+	}
+
+	// The clock is set forward past chain 2's start time: it starts within
+	// Tolerance, not 2 hours later
+	clock.Jump(3 * time.Hour)
+	clock.Advance(time.Minute)
+	if !reflect.DeepEqual(started, []uint{1, 2}) {
+		t.Fatalf("started %v, expected chain 2 within a minute of the clock change", started)
+	}
+	if n := clock.Timers(); n != 0 {
+		t.Errorf("%d timers, expected none", n)
+	}
+}
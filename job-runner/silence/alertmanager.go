@@ -0,0 +1,106 @@
+// Copyright 2017, Square, Inc.
+
+package silence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewAlertmanager returns a Silencer that creates silences with the API (v2)
+// of the Alertmanager at addr, like "http://alertmanager:9093".
+func NewAlertmanager(client *http.Client, addr string) *Alertmanager {
+	return &Alertmanager{
+		client: client,
+		addr:   strings.TrimSuffix(addr, "/"),
+	}
+}
+
+// Alertmanager is a Silencer of Prometheus Alertmanager silences.
+type Alertmanager struct {
+	client *http.Client
+	addr   string
+}
+
+var _ Silencer = (*Alertmanager)(nil)
+
+type alertmanagerMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+type alertmanagerSilence struct {
+	Matchers  []alertmanagerMatcher `json:"matchers"`
+	StartsAt  time.Time             `json:"startsAt"`
+	EndsAt    time.Time             `json:"endsAt"`
+	CreatedBy string                `json:"createdBy"`
+	Comment   string                `json:"comment"`
+}
+
+func (a *Alertmanager) Create(matchers map[string]string, end time.Time, comment string) (string, error) {
+	s := alertmanagerSilence{
+		StartsAt:  time.Now().UTC(),
+		EndsAt:    end.UTC(),
+		CreatedBy: "spincycle",
+		Comment:   comment,
+	}
+	for name, value := range matchers {
+		s.Matchers = append(s.Matchers, alertmanagerMatcher{Name: name, Value: value, IsRegex: true, IsEqual: true})
+	}
+	sort.Slice(s.Matchers, func(i, j int) bool { return s.Matchers[i].Name < s.Matchers[j].Name })
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := a.do("POST", a.addr+"/api/v2/silences", payload)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.SilenceID == "" {
+		return "", fmt.Errorf("invalid Alertmanager response: %s", body)
+	}
+	return res.SilenceID, nil
+}
+
+func (a *Alertmanager) Expire(id string) error {
+	_, err := a.do("DELETE", a.addr+"/api/v2/silence/"+url.PathEscape(id), nil)
+	return err
+}
+
+// do sends a request to Alertmanager and returns the response body. It returns
+// an error if the response isn't 200 OK.
+func (a *Alertmanager) do(method, reqURL string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Alertmanager %s %s returned status %d: %s", method, req.URL.Path, res.StatusCode, body)
+	}
+	return body, nil
+}
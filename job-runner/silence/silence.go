@@ -0,0 +1,98 @@
+// Copyright 2017, Square, Inc.
+
+// Package silence silences the alerts about the targets of a job chain while
+// it runs (proto.JobChain.Silence), so the maintenance it does, like restarting
+// hosts, doesn't page. A silence is created in the monitoring system when the
+// chain starts and expired when it's done. It also has an end, so it expires
+// on its own if the chain never finishes.
+package silence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/chain"
+	"github.com/square/spincycle/proto"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DEFAULT_DURATION is the max time a silence lasts if the chain doesn't set
+// one (proto.Silence.Duration).
+const DEFAULT_DURATION = 4 * time.Hour
+
+// A Silencer creates and expires silences in a monitoring system, like
+// Alertmanager.
+type Silencer interface {
+	// Create silences alerts with labels that match every matcher (label =>
+	// regexp of its values) until end. It returns the ID of the silence.
+	Create(matchers map[string]string, end time.Time, comment string) (string, error)
+
+	// Expire ends a silence before its end.
+	Expire(id string) error
+}
+
+// NewHooks returns chain.Hooks that silence the alerts about every chain that
+// has a silence with s while it runs. The silence is created before the
+// chain's first job runs, so the chain waits for it; if it can't be created,
+// the error is logged and the chain runs anyway.
+func NewHooks(s Silencer) *Hooks {
+	return &Hooks{
+		silencer: s,
+		silences: map[uint]string{},
+		Mutex:    &sync.Mutex{},
+	}
+}
+
+// Hooks are chain.Hooks that silence alerts while chains run.
+type Hooks struct {
+	chain.NopHooks
+	silencer Silencer
+	// --
+	silences    map[uint]string // request ID => silence ID
+	*sync.Mutex                 // guards silences
+}
+
+var _ chain.Hooks = (*Hooks)(nil)
+
+func (h *Hooks) OnChainStart(jc proto.JobChain) {
+	if jc.Silence == nil {
+		return
+	}
+	d := DEFAULT_DURATION
+	if jc.Silence.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(jc.Silence.Duration); err != nil {
+			log.Errorf("[chain=%d]: Invalid silence duration %s, not silencing alerts.", jc.RequestId, jc.Silence.Duration)
+			return
+		}
+	}
+	comment := fmt.Sprintf("spincycle request %d (%s)", jc.RequestId, jc.RequestType)
+	id, err := h.silencer.Create(jc.Silence.Matchers, time.Now().Add(d), comment)
+	if err != nil {
+		log.Errorf("[chain=%d]: Can't silence alerts %v (error: %s).", jc.RequestId, jc.Silence.Matchers, err)
+		return
+	}
+	log.Infof("[chain=%d]: Silenced alerts %v for up to %s (silence %s).", jc.RequestId, jc.Silence.Matchers, d, id)
+	h.Lock()
+	h.silences[jc.RequestId] = id
+	h.Unlock()
+}
+
+// OnChainDone expires the chain's silence, also if the chain was suspended:
+// the chain gets a new one when it's resumed.
+func (h *Hooks) OnChainDone(jc proto.JobChain) {
+	h.Lock()
+	id, ok := h.silences[jc.RequestId]
+	delete(h.silences, jc.RequestId)
+	h.Unlock()
+	if !ok {
+		return
+	}
+	if err := h.silencer.Expire(id); err != nil {
+		log.Errorf("[chain=%d]: Can't expire silence %s, it expires on its own (error: %s).", jc.RequestId, id, err)
+		return
+	}
+	log.Infof("[chain=%d]: Expired silence %s.", jc.RequestId, id)
+}
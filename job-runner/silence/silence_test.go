@@ -0,0 +1,101 @@
+// Copyright 2017, Square, Inc.
+
+package silence_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/silence"
+	"github.com/square/spincycle/proto"
+)
+
+// fakeAlertmanager is enough of the Alertmanager API to create and expire
+// silences.
+type fakeAlertmanager struct {
+	silences map[string]map[string]interface{} // ID => silence
+	expired  []string
+	*sync.Mutex
+}
+
+func (a *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/api/v2/silences":
+		var s map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := "s1"
+		a.silences[id] = s
+		json.NewEncoder(w).Encode(map[string]string{"silenceID": id})
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+		id := strings.TrimPrefix(r.URL.Path, "/api/v2/silence/")
+		if _, ok := a.silences[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		a.expired = append(a.expired, id)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	am := &fakeAlertmanager{silences: map[string]map[string]interface{}{}, Mutex: &sync.Mutex{}}
+	server := httptest.NewServer(am)
+	defer server.Close()
+	hooks := silence.NewHooks(silence.NewAlertmanager(server.Client(), server.URL+"/"))
+
+	// A chain without a silence doesn't silence anything
+	hooks.OnChainStart(proto.JobChain{RequestId: 1})
+	hooks.OnChainDone(proto.JobChain{RequestId: 1, State: proto.STATE_COMPLETE})
+	if len(am.silences) != 0 || len(am.expired) != 0 {
+		t.Fatalf("silences = %v, expired = %v; expected none", am.silences, am.expired)
+	}
+
+	jc := proto.JobChain{
+		RequestId:   2,
+		RequestType: "restart-db",
+		Silence: &proto.Silence{
+			Matchers: map[string]string{"instance": "db1-.*", "cluster": "db1"},
+			Duration: "1h",
+		},
+	}
+	start := time.Now()
+	hooks.OnChainStart(jc)
+	s, ok := am.silences["s1"]
+	if !ok {
+		t.Fatalf("silences = %v, expected s1", am.silences)
+	}
+	expect := []interface{}{
+		map[string]interface{}{"name": "cluster", "value": "db1", "isRegex": true, "isEqual": true},
+		map[string]interface{}{"name": "instance", "value": "db1-.*", "isRegex": true, "isEqual": true},
+	}
+	if !reflect.DeepEqual(s["matchers"], expect) {
+		t.Errorf("matchers = %v, expected %v", s["matchers"], expect)
+	}
+	endsAt, _ := time.Parse(time.RFC3339Nano, s["endsAt"].(string))
+	if d := endsAt.Sub(start); d < time.Hour || d > time.Hour+time.Minute {
+		t.Errorf("silence ends in %s, expected 1h", d)
+	}
+	if s["comment"] != "spincycle request 2 (restart-db)" {
+		t.Errorf("comment = %v, expected the request", s["comment"])
+	}
+
+	// The silence is expired when the chain is done, once
+	jc.State = proto.STATE_COMPLETE
+	hooks.OnChainDone(jc)
+	hooks.OnChainDone(jc)
+	if !reflect.DeepEqual(am.expired, []string{"s1"}) {
+		t.Errorf("expired = %v, expected [s1]", am.expired)
+	}
+}
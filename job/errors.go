@@ -17,6 +17,10 @@ var (
 
 	// ErrRunTimeout should be returned by a job when it times out.
 	ErrRunTimeout = errors.New("run timeout")
+
+	// ErrScratchFull is returned by Scratch.Set when the value doesn't fit in
+	// the request's scratch.
+	ErrScratchFull = errors.New("scratch full")
 )
 
 // ErrArgNotSet should be returned by a job when a required key is not set in jobArgs.
@@ -0,0 +1,146 @@
+// Copyright 2017, Square, Inc.
+
+package internal
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// egressProxy is an HTTP proxy that only allows connections to some hosts. A
+// shell command with an egress policy is run with the proxy environment
+// variables set to it, so tools that honor them (curl, wget, most HTTP client
+// libraries) can only reach the allowed hosts. It is containment for
+// well-behaved tools, not a sandbox: a command that ignores the proxy
+// variables is not stopped.
+type egressProxy struct {
+	allowed  []string // "host" (any port) or "host:port"
+	listener net.Listener
+	server   *http.Server
+	// --
+	violations  []string // destinations that were denied
+	*sync.Mutex          // guards violations
+}
+
+// newEgressProxy starts a proxy on localhost that only allows connections to
+// the allowed destinations.
+func newEgressProxy(allowed []string) (*egressProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &egressProxy{
+		allowed:    allowed,
+		listener:   listener,
+		violations: []string{},
+		Mutex:      &sync.Mutex{},
+	}
+	p.server = &http.Server{Handler: p}
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+// Env returns the environment variables that make a command use the proxy.
+func (p *egressProxy) Env() []string {
+	url := "http://" + p.listener.Addr().String()
+	env := []string{}
+	for _, v := range []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY"} {
+		env = append(env, v+"="+url, strings.ToLower(v)+"="+url)
+	}
+	return append(env, "NO_PROXY=", "no_proxy=")
+}
+
+// Violations returns the destinations that were denied, in order.
+func (p *egressProxy) Violations() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.violations...)
+}
+
+// Close stops the proxy and closes all connections through it.
+func (p *egressProxy) Close() error {
+	return p.server.Close()
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dest := r.Host
+	if r.Method != "CONNECT" {
+		dest = r.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		if r.Method == "CONNECT" || r.URL.Scheme == "https" {
+			dest += ":443"
+		} else {
+			dest += ":80"
+		}
+	}
+
+	if !p.allows(dest) {
+		p.Lock()
+		p.violations = append(p.violations, dest)
+		p.Unlock()
+		http.Error(w, "egress to "+dest+" is not allowed by the job's policy", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == "CONNECT" {
+		p.tunnel(w, dest)
+		return
+	}
+
+	// Plain HTTP: forward the request as-is.
+	r.RequestURI = ""
+	res, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+// allows returns true if the policy allows connecting to dest ("host:port").
+func (p *egressProxy) allows(dest string) bool {
+	host, _, _ := net.SplitHostPort(dest)
+	for _, a := range p.allowed {
+		if strings.EqualFold(a, dest) || strings.EqualFold(a, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel connects the client to dest for a CONNECT request (e.g. HTTPS).
+func (p *egressProxy) tunnel(w http.ResponseWriter, dest string) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't tunnel", http.StatusInternalServerError)
+		return
+	}
+	destConn, err := net.DialTimeout("tcp", dest, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		destConn.Close()
+		return
+	}
+	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	go func() {
+		io.Copy(destConn, clientConn)
+		destConn.Close()
+	}()
+	io.Copy(clientConn, destConn)
+	clientConn.Close()
+}
@@ -0,0 +1,82 @@
+// Copyright 2017, Square, Inc.
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEgressProxy(t *testing.T) {
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer allowed.Close()
+	denied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a host that's not allowed")
+	}))
+	defer denied.Close()
+
+	allowedHost := strings.TrimPrefix(allowed.URL, "http://")
+	deniedHost := strings.TrimPrefix(denied.URL, "http://")
+
+	proxy, err := newEgressProxy([]string{allowedHost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	// Use the proxy like a command would, from the environment.
+	var proxyURL *url.URL
+	for _, v := range proxy.Env() {
+		if strings.HasPrefix(v, "HTTP_PROXY=") {
+			proxyURL, _ = url.Parse(strings.TrimPrefix(v, "HTTP_PROXY="))
+		}
+	}
+	if proxyURL == nil {
+		t.Fatalf("env %v has no HTTP_PROXY", proxy.Env())
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	res, err := client.Get(allowed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("allowed host: response status = %d, expected 200", res.StatusCode)
+	}
+
+	res, err = client.Get(denied.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("denied host: response status = %d, expected 403", res.StatusCode)
+	}
+
+	if v := proxy.Violations(); !reflect.DeepEqual(v, []string{deniedHost}) {
+		t.Errorf("violations = %v, expected [%s]", v, deniedHost)
+	}
+}
+
+func TestEgressProxyAllows(t *testing.T) {
+	p := &egressProxy{allowed: []string{"db.local", "api.local:443"}}
+	tests := map[string]bool{
+		"db.local:5432":  true, // any port
+		"API.local:443":  true,
+		"api.local:80":   false,
+		"evil.local:443": false,
+	}
+	for dest, expect := range tests {
+		if got := p.allows(dest); got != expect {
+			t.Errorf("allows(%s) = %t, expected %t", dest, got, expect)
+		}
+	}
+}
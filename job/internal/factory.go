@@ -8,13 +8,18 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 
 	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
 )
 
 // Factory is a job.Factory that makes "shell-command" type jobs.
@@ -34,14 +39,36 @@ func (f factory) Make(jobType, jobName string) (job.Job, error) {
 	return nil, job.ErrUnknownJobType
 }
 
+// Types is a job.TypeFactory interface method.
+func (f factory) Types() []string {
+	return []string{"shell-command"}
+}
+
+// Docs is a job.DocFactory interface method.
+func (f factory) Docs() map[string]job.Doc {
+	return map[string]job.Doc{
+		"shell-command": {
+			Description: "Runs a command with arguments. Its stdout and stderr are the job log.",
+			Args:        NewShellCommand("<jobName>").ArgSchema(),
+			JobData:     []job.DataDoc{},
+			Failures: []job.FailureDoc{
+				{State: "FAIL", Description: "the command can't be run or exits non-zero"},
+				{State: "POLICY_VIOLATION", Description: "the command tried to connect to a host not in its egress policy"},
+			},
+		},
+	}
+}
+
 // ShellCommand is a job.Job that runs a single shell command with arguments.
 type ShellCommand struct {
 	// Internal data (serialized)
-	Cmd  string   // command to execute
-	Args []string // args to cmd
+	Cmd    string   // command to execute
+	Args   []string // args to cmd
+	Egress []string // if set, only these hosts or host:ports can be reached (see egressProxy)
 
 	// While running
 	status string
+	log    io.Writer // job.Logger, nil if not set
 	*sync.RWMutex
 
 	// Meta
@@ -49,6 +76,12 @@ type ShellCommand struct {
 	jobType string
 }
 
+var (
+	_ job.CancelableJob = (*ShellCommand)(nil)
+	_ job.Logger        = (*ShellCommand)(nil)
+	_ job.ArgDescriber  = (*ShellCommand)(nil)
+)
+
 // NewShellCommand instantiates a new ShellCommand job. This should only be called
 // by the Factory. jobName must be unique within a job chain.
 func NewShellCommand(jobName string) *ShellCommand {
@@ -72,9 +105,23 @@ func (j *ShellCommand) Create(jobArgs map[string]string) error {
 		j.Args = strings.Split(args, ",")
 	}
 
+	egress := jobArgs[j.jobName+"_egress"]
+	if egress != "" {
+		j.Egress = strings.Split(egress, ",")
+	}
+
 	return nil
 }
 
+// ArgSchema is a job.ArgDescriber interface method.
+func (j *ShellCommand) ArgSchema() []job.ArgDoc {
+	return []job.ArgDoc{
+		{Name: j.jobName + "_cmd", Type: "string", Required: true, Description: "command to run"},
+		{Name: j.jobName + "_args", Type: "[]string", Description: "comma-separated args to the command"},
+		{Name: j.jobName + "_egress", Type: "[]string", Description: "comma-separated hosts or host:ports the command can connect to; if set, it can't connect anywhere else"},
+	}
+}
+
 // Serialize is a job.Job interface method.
 func (j *ShellCommand) Serialize() ([]byte, error) {
 	return json.Marshal(j)
@@ -88,34 +135,69 @@ func (j *ShellCommand) Deserialize(bytes []byte) error {
 	}
 	j.Cmd = d.Cmd
 	j.Args = d.Args
+	j.Egress = d.Egress
 	j.setStatus("ready to run")
 	return nil
 }
 
 // Run is a job.Job interface method.
 func (j *ShellCommand) Run(jobData map[string]interface{}) (job.Return, error) {
+	return j.RunContext(context.Background(), jobData)
+}
+
+// RunContext is a job.CancelableJob interface method. The cmd is killed when
+// ctx is canceled.
+func (j *ShellCommand) RunContext(ctx context.Context, jobData map[string]interface{}) (job.Return, error) {
 	// Set status before and after
 	j.setStatus("runnning " + j.Cmd)
 	defer j.setStatus("done running " + j.Cmd)
 
 	// Create the cmd to run
-	cmd := exec.Command(j.Cmd, j.Args...)
+	cmd := exec.CommandContext(ctx, j.Cmd, j.Args...)
 
-	// Capture STDOUT and STDERR
+	// Capture STDOUT and STDERR, and stream both to the log if set
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
+	if j.log != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, j.log)
+		cmd.Stderr = io.MultiWriter(&stderr, j.log)
+	}
+
+	// Apply the egress policy, if any, by making the cmd use a proxy that
+	// only allows connecting to the allowed hosts
+	var proxy *egressProxy
+	if len(j.Egress) > 0 {
+		var err error
+		if proxy, err = newEgressProxy(j.Egress); err != nil {
+			return job.Return{State: proto.STATE_FAIL}, err
+		}
+		defer proxy.Close()
+		cmd.Env = append(os.Environ(), proxy.Env()...)
+	}
+
 	// Run the cmd and wait for it to return
 	exit := int64(0)
+	state := proto.STATE_COMPLETE
 	err := cmd.Run()
 	if err != nil {
 		exit = 1
+		state = proto.STATE_FAIL
+	}
+
+	// The cmd violated the egress policy even if it handled being denied
+	if proxy != nil {
+		if violations := proxy.Violations(); len(violations) > 0 {
+			state = proto.STATE_POLICY_VIOLATION
+			err = fmt.Errorf("egress policy violation: %s", strings.Join(violations, ", "))
+		}
 	}
 
 	ret := job.Return{
+		State:  state,
 		Exit:   exit,
 		Error:  err,
 		Stdout: stdout.String(),
@@ -124,7 +206,8 @@ func (j *ShellCommand) Run(jobData map[string]interface{}) (job.Return, error) {
 	return ret, nil
 }
 
-// Stop is a job.Job interface method.
+// Stop is a job.Job interface method. The JR stops the cmd by canceling the
+// ctx given to RunContext.
 func (j *ShellCommand) Stop() error {
 	return nil
 }
@@ -136,6 +219,11 @@ func (j *ShellCommand) Status() string {
 	return j.status
 }
 
+// SetLog is a job.Logger interface method.
+func (j *ShellCommand) SetLog(w io.Writer) {
+	j.log = w
+}
+
 // Name is a job.Job interface method.
 func (j *ShellCommand) Name() string {
 	return j.jobName
@@ -3,8 +3,19 @@
 // Package job provides job-related interfaces, data structures, and errors.
 // To avoid an import cycle, this package must not have external dependencies
 // because everything else depends on it.
+//
+// This package is a stable API for job authors, like packages proto, client,
+// and jobtest: exported names aren't removed or changed except in a major
+// release. Interfaces that jobs implement never get new methods; new features
+// are new optional interfaces (like CancelableJob), so existing jobs keep
+// compiling and working when Spin Cycle is upgraded.
 package job
 
+import (
+	"context"
+	"io"
+)
+
 // A Job is the smallest, reusable building block in Spin Cycle that has meaning
 // by itself. A job should, ideally, do one thing. For example: "DownSIP" brings
 // down a SIP. This job is meaningful by itself and highly reusable.
@@ -43,6 +54,7 @@ type Job interface {
 	// Run runs the job using its interal data and the run-time jobData from
 	// previously-ran (upstream) jobs. Run can modify jobData. Run is expected
 	// to block, but the job must respond to Stop and Status while running.
+	// (A CancelableJob responds to its context being canceled instead.)
 	// The returned error, if any, indicates a problem before or after running
 	// the job. The final state of the job is returned in the Return structure,
 	// along with other things like the error and exit code (if there was one).
@@ -70,6 +82,162 @@ type Job interface {
 	Type() string
 }
 
+// A CancelableJob is a Job whose run is canceled with a context, so it doesn't
+// have to implement Stop correctly to be stopped. If a job implements it, the
+// JR calls RunContext instead of Run. ctx is canceled when the JR stops the
+// job: when its chain is stopped, or when the job times out or stalls. ctx has
+// the job's deadline, if it has a timeout. The job should return soon after
+// ctx is canceled, like by passing ctx to the commands and requests it makes.
+// The JR still calls Stop after canceling ctx, so Stop can return nil.
+type CancelableJob interface {
+	Job
+	RunContext(ctx context.Context, jobData map[string]interface{}) (Return, error)
+}
+
+// Cancelable adapts a Job to a CancelableJob, so the JR can run every job the
+// same way. It returns j if it's a CancelableJob. Otherwise, RunContext calls
+// Run and ignores ctx: j is stopped only by Stop, as before.
+func Cancelable(j Job) CancelableJob {
+	if cj, ok := j.(CancelableJob); ok {
+		return cj
+	}
+	return cancelable{j}
+}
+
+type cancelable struct {
+	Job
+}
+
+func (c cancelable) RunContext(ctx context.Context, jobData map[string]interface{}) (Return, error) {
+	return c.Run(jobData)
+}
+
+// A Logger is an optional interface for a job to have its log output captured
+// by the Job Runner. If a job implements it, the JR calls SetLog once before
+// calling Run. The job should write its log output (e.g. stdout and stderr of
+// a command) to the given writer while running so that clients can see what
+// the job is doing before it finishes. SetLog must not block.
+type Logger interface {
+	SetLog(io.Writer)
+}
+
+// A ProgressReporter is an optional interface for a job to report how far along
+// it is while running. If a job implements it, the JR calls SetProgress once
+// before calling Run. The job should call the given function whenever it makes
+// progress with the percent done (0-100). The function does not block.
+type ProgressReporter interface {
+	SetProgress(func(percent uint))
+}
+
+// A Heartbeater is an optional interface for a long-running job to tell the Job
+// Runner that it's alive, so a job that hangs can be told apart from one
+// that's slow. If a job implements it, the JR calls SetHeartbeat once before
+// calling Run. The job should call the given function periodically while it's
+// working, more often than the job's heartbeat timeout (see
+// proto.Job.HeartbeatTimeout). The function does not block.
+type Heartbeater interface {
+	SetHeartbeat(func())
+}
+
+// A Checkpointer is an optional interface for a long-running job to checkpoint
+// the jobData it has set so far, so it's saved with the chain while the job
+// runs, not only when it's done (see chain.CheckpointInterval). If a job
+// implements it, the JR calls Checkpoint periodically while Run is running.
+// It must return a copy of the keys the job has set in jobData, because the
+// job keeps running while the copy is saved.
+type Checkpointer interface {
+	Checkpoint() map[string]interface{}
+}
+
+// A Coster is an optional interface for a job that creates cloud resources
+// that cost money, so the JR can keep the chain within its budget (see
+// proto.JobChain.Budget). Costs are in whatever unit the job types agree on,
+// like USD. EstimatedCost is the estimated cost of one invocation (one call
+// to Run); the JR calls it after Deserialize and before Run, so it can depend
+// on the job's args. ActualCost is what the last invocation cost; the JR calls
+// it after Run returns. A job that doesn't know what it cost returns its
+// estimate.
+type Coster interface {
+	EstimatedCost() float64
+	ActualCost() float64
+}
+
+// An ArgsSetter is an optional interface for a job to get args that the Job
+// Runner resolves when the job runs (see proto.Job.Args), like secrets that
+// must not be serialized with the job. If a job implements it, the JR calls
+// SetArgs once after Deserialize and before Run. The job fails without running
+// if SetArgs returns an error.
+type ArgsSetter interface {
+	SetArgs(args map[string]string) error
+}
+
+// Context is the environment of the job chain that a job runs in, like the
+// datacenter and cluster it's for. It's set once for the chain
+// (proto.JobChain.Env), not serialized with every job.
+type Context struct {
+	RequestId  uint
+	Datacenter string
+	Cluster    string
+	DryRun     bool              // the job must not change anything, only say what it would do
+	Requestor  string            // who made the request
+	Label      string            // environment, like "staging" or "prod", which selects Config
+	Env        map[string]string // the whole environment, including the keys above
+
+	// Config is the config bundle of Label on the Job Runner, like endpoints,
+	// flags, and credentials for that environment. It's nil if the chain has
+	// no label or the Job Runner has no config bundles.
+	Config map[string]string
+
+	// Scratch is the request's scratch. It's nil if the Job Runner doesn't
+	// provide one, like to jobs that run on an agent or in a process of their
+	// own (see proto.Job.Limits).
+	Scratch Scratch
+}
+
+// A Scratch is a small key/value store of a request for a job's intermediate
+// state that must survive retries of the job and restarts of the Job Runner,
+// like the ID of a resource it created or how far it got, but that doesn't
+// belong in the jobData passed to the next jobs. The jobs of a request share
+// its scratch, so keys should be prefixed with the job's name if they're only
+// for the job. The scratch is removed when the chain is done. Set returns
+// ErrScratchFull if the scratch would be larger than the Job Runner allows.
+type Scratch interface {
+	Get(key string) (string, bool)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+// A ContextSetter is an optional interface for a job to get the environment of
+// its job chain. If a job implements it, the JR calls SetContext once after
+// Deserialize and before Run.
+type ContextSetter interface {
+	SetContext(Context)
+}
+
+// A Traced job is an optional interface for a job to be part of the request's
+// distributed trace. If a job implements it, the JR calls SetTraceparent once
+// before calling Run with the W3C traceparent of the span of the job's try.
+// Spans the job makes, and requests it sends, should be children of it.
+type Traced interface {
+	SetTraceparent(string)
+}
+
+// An Artifact is an output of a job that isn't jobData, like a report, a diff,
+// or a generated config, which is kept after the job and its chain are done.
+type Artifact struct {
+	Name        string // unique in the job, like "report.html"; not a path
+	ContentType string // MIME type, like "text/html"; "" = application/octet-stream
+	Data        []byte
+}
+
+// An ArtifactProducer is an optional interface for a job to output artifacts.
+// If a job implements it, the JR calls Artifacts once after Run returns,
+// whatever the job's final state, and stores the artifacts. An artifact from a
+// later try of the job replaces the one with the same name from an earlier try.
+type ArtifactProducer interface {
+	Artifacts() []Artifact
+}
+
 // A Factory instantiates a Job of the given type. A factory only instantiates
 // a new Job object, it must not call any Job interface methods on the newly
 // create job. If an error is returned, the returned Job should be ignored.
@@ -82,6 +250,118 @@ type Factory interface {
 	Make(jobType, jobName string) (Job, error)
 }
 
+// A Warmup is expensive setup shared by all jobs of one type, like client pools.
+// The Job Runner calls Warm once at startup, before making any jobs, and Close
+// once at shutdown. The job factory makes jobs of the type that reuse what was
+// set up. Health is called periodically while the JR runs; if it returns an
+// error, jobs of the type fail without running until it's healthy again.
+type Warmup interface {
+	// Warm does the setup. If it returns an error, the Job Runner does not start.
+	Warm() error
+
+	// Health returns an error if what was set up is not healthy.
+	Health() error
+
+	// Close tears down what was set up.
+	Close() error
+}
+
+// A WarmFactory is an optional interface for a Factory with job types that have
+// expensive setup. Warmups returns job type => Warmup for those types.
+type WarmFactory interface {
+	Warmups() map[string]Warmup
+}
+
+// Doc documents a job type: what it does, the job args it reads in Create, the
+// jobData it sets when it runs, and how it fails. The Job Runner serves the
+// docs of every job type at /api/v1/job-types so that spec authors can see how
+// to use a job type without reading its code.
+//
+// Schema is set by the Job Runner (see Describe) to the job args that jobs of
+// the type describe themselves (see ArgDescriber), so the Request Manager can
+// check a chain's job args against what the Job Runner actually runs.
+type Doc struct {
+	Description string       `json:"description"`
+	Args        []ArgDoc     `json:"args"`
+	JobData     []DataDoc    `json:"jobData"`
+	Failures    []FailureDoc `json:"failures"`
+	Schema      []ArgDoc     `json:"schema,omitempty"`
+}
+
+// ArgDoc documents a job arg, like "<jobName>_cmd". Type is a Go type name,
+// like "string" or "[]string" (comma-separated), because all job args are
+// strings that the job parses.
+type ArgDoc struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+// DataDoc documents a jobData key that the job sets for later jobs.
+type DataDoc struct {
+	Key         string `json:"key"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// FailureDoc documents a way the job fails: the final state of the job, like
+// "FAIL" (see proto.StateName), and what causes it.
+type FailureDoc struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+// A DocFactory is an optional interface for a Factory that documents its job
+// types. Docs returns job type => Doc.
+type DocFactory interface {
+	Docs() map[string]Doc
+}
+
+// A TypeFactory is an optional interface for a Factory that lists every job
+// type it makes, including types it doesn't document.
+type TypeFactory interface {
+	Types() []string
+}
+
+// An ArgDescriber is an optional interface for a job that describes the job
+// args it reads in Create. ArgSchema is called on a job made with jobName
+// "<jobName>", so arg names are like "<jobName>_cmd", and it's never created.
+type ArgDescriber interface {
+	ArgSchema() []ArgDoc
+}
+
+// Describe returns job type => Doc for every job type that f makes: the types
+// it lists if it's a TypeFactory and the types it documents if it's a
+// DocFactory. A type that isn't documented has an empty Doc. If a job of the
+// type is an ArgDescriber, its ArgSchema is the Doc's Schema.
+func Describe(f Factory) map[string]Doc {
+	docs := map[string]Doc{}
+	if df, ok := f.(DocFactory); ok {
+		for jobType, d := range df.Docs() {
+			docs[jobType] = d
+		}
+	}
+	if tf, ok := f.(TypeFactory); ok {
+		for _, jobType := range tf.Types() {
+			if _, ok := docs[jobType]; !ok {
+				docs[jobType] = Doc{}
+			}
+		}
+	}
+	for jobType, d := range docs {
+		j, err := f.Make(jobType, "<jobName>")
+		if err != nil {
+			continue
+		}
+		if ad, ok := j.(ArgDescriber); ok {
+			d.Schema = ad.ArgSchema()
+			docs[jobType] = d
+		}
+	}
+	return docs
+}
+
 // Return represents return values and output from a job. State indicates how
 // the job completed. If State == proto.STATE_COMPLETE, the job completed
 // successfully. Anything else indicates that the job failed or didn't complete,
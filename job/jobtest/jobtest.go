@@ -0,0 +1,80 @@
+// Copyright 2017, Square, Inc.
+
+// Package jobtest helps job authors test their jobs the way Spin Cycle uses
+// them: made and created by the Request Manager, serialized, then made again,
+// deserialized, and run by the Job Runner. Like package job, it's part of the
+// stable API.
+package jobtest
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/square/spincycle/job"
+)
+
+// Make makes a job of type jobType with f and creates it with jobArgs like the
+// RM does, then makes another job of the type and deserializes the first one
+// into it like the JR does. It returns the deserialized job, so a test that
+// runs it also checks that the job serializes everything it needs.
+func Make(f job.Factory, jobType, jobName string, jobArgs map[string]string) (job.Job, error) {
+	created, err := f.Make(jobType, jobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := created.Create(jobArgs); err != nil {
+		return nil, err
+	}
+	data, err := created.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := f.Make(jobType, jobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.Deserialize(data); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Run runs a job like the JR does: it gives the job a log if it's a
+// job.Logger, no-op funcs if it's a job.ProgressReporter or job.Heartbeater,
+// and ctx if it's a job.CancelableJob. It returns what the job returned and
+// its log output.
+func Run(ctx context.Context, j job.Job, jobData map[string]interface{}) (job.Return, string, error) {
+	log := &syncBuffer{Mutex: &sync.Mutex{}}
+	if logger, ok := j.(job.Logger); ok {
+		logger.SetLog(log)
+	}
+	if reporter, ok := j.(job.ProgressReporter); ok {
+		reporter.SetProgress(func(uint) {})
+	}
+	if heartbeater, ok := j.(job.Heartbeater); ok {
+		heartbeater.SetHeartbeat(func() {})
+	}
+	ret, err := job.Cancelable(j).RunContext(ctx, jobData)
+	return ret, log.String(), err
+}
+
+// syncBuffer is a bytes.Buffer that jobs can write to from many goroutines,
+// like a command's stdout and stderr.
+type syncBuffer struct {
+	buf bytes.Buffer
+	*sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
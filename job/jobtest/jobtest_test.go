@@ -0,0 +1,58 @@
+// Copyright 2017, Square, Inc.
+
+package jobtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job/internal"
+	"github.com/square/spincycle/job/jobtest"
+	"github.com/square/spincycle/proto"
+)
+
+func TestMakeAndRun(t *testing.T) {
+	j, err := jobtest.Make(internal.Factory, "shell-command", "greet", map[string]string{
+		"greet_cmd":  "echo",
+		"greet_args": "hello",
+	})
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	ret, log, err := jobtest.Run(context.Background(), j, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	if ret.State != proto.STATE_COMPLETE {
+		t.Errorf("state = %s, expected COMPLETE", proto.StateName[ret.State])
+	}
+	if log != "hello\n" {
+		t.Errorf("log = %q, expected hello", log)
+	}
+
+	// Args that Create needs are required
+	if _, err := jobtest.Make(internal.Factory, "shell-command", "greet", map[string]string{}); err == nil {
+		t.Error("err is nil, expected an error without greet_cmd")
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	j, err := jobtest.Make(internal.Factory, "shell-command", "wait", map[string]string{
+		"wait_cmd":  "sleep",
+		"wait_args": "10",
+	})
+	if err != nil {
+		t.Fatalf("err = %s, expected nil", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	ret, _, _ := jobtest.Run(ctx, j, map[string]interface{}{})
+	if ret.State != proto.STATE_FAIL {
+		t.Errorf("state = %s, expected FAIL", proto.StateName[ret.State])
+	}
+	if d := time.Now().Sub(start); d > 5*time.Second {
+		t.Errorf("Run returned after %s, expected it to return when ctx was canceled", d)
+	}
+}
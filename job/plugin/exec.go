@@ -0,0 +1,283 @@
+// Copyright 2017, Square, Inc.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+)
+
+// ExecFactory is a job.Factory for job types that are executables in a
+// directory: job type "foo" is the executable dir/foo. Each job method is one
+// run of the executable with the method as its only argument, a JSON request
+// on stdin, and a JSON response on stdout:
+//
+//	foo create  {"name":"job1","args":{...}}
+//	            {"data":<any>,"args":{...},"error":""}
+//	foo run     {"name":"job1","data":<any>,"args":{...},"jobData":{...}}
+//	            {"state":3,"exit":0,"error":"","jobData":{...}}
+//
+// create is called by the Request Manager: data is the job's internal data,
+// given back to run, and args are job args set for other jobs. run is called
+// by the Job Runner: args are the job's resolved args (see job.ArgsSetter),
+// and jobData is set for downstream jobs. state is a proto.STATE_* value. A
+// non-empty error, a non-zero exit, or an invalid response fails the call.
+// Stderr of run is the job's log output, and stopping the job sends SIGTERM
+// to the executable.
+//
+// A job type is documented by a job.Doc in JSON next to its executable, in
+// dir/foo.doc.json.
+type ExecFactory string
+
+// Make is a job.Factory interface method.
+func (dir ExecFactory) Make(jobType, jobName string) (job.Job, error) {
+	if jobType == "" || strings.ContainsAny(jobType, `/\`) || strings.HasPrefix(jobType, ".") {
+		return nil, job.ErrUnknownJobType
+	}
+	path := filepath.Join(string(dir), jobType)
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+		return nil, job.ErrUnknownJobType
+	}
+	return &execJob{
+		path:    path,
+		jobName: jobName,
+		jobType: jobType,
+		status:  "not running",
+		Mutex:   &sync.Mutex{},
+	}, nil
+}
+
+// Types is a job.TypeFactory interface method. The job types are the
+// executables in the directory, sorted.
+func (dir ExecFactory) Types() []string {
+	types := []string{}
+	files, _ := ioutil.ReadDir(string(dir))
+	for _, fi := range files {
+		if _, err := dir.Make(fi.Name(), ""); err == nil {
+			types = append(types, fi.Name())
+		}
+	}
+	return types
+}
+
+// Docs is a job.DocFactory interface method. Job types without a doc file, or
+// with one that can't be read, are not documented.
+func (dir ExecFactory) Docs() map[string]job.Doc {
+	docs := map[string]job.Doc{}
+	files, _ := filepath.Glob(filepath.Join(string(dir), "*.doc.json"))
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var d job.Doc
+		if err := json.Unmarshal(bytes, &d); err != nil {
+			continue
+		}
+		docs[strings.TrimSuffix(filepath.Base(file), ".doc.json")] = d
+	}
+	return docs
+}
+
+type execRequest struct {
+	Name    string                 `json:"name"`
+	Data    json.RawMessage        `json:"data,omitempty"`
+	Args    map[string]string      `json:"args"`
+	JobData map[string]interface{} `json:"jobData,omitempty"`
+}
+
+type execResponse struct {
+	Data    json.RawMessage        `json:"data"`
+	Args    map[string]string      `json:"args"`
+	State   byte                   `json:"state"`
+	Exit    int64                  `json:"exit"`
+	Error   string                 `json:"error"`
+	JobData map[string]interface{} `json:"jobData"`
+}
+
+// execJob is a job.Job that runs an executable for each method.
+type execJob struct {
+	path    string
+	jobName string
+	jobType string
+	data    json.RawMessage   // from create, serialized
+	args    map[string]string // from SetArgs
+	log     io.Writer         // job.Logger, nil if not set
+	// --
+	status      string
+	cmd         *exec.Cmd // running the executable
+	stopped     bool
+	*sync.Mutex // guards fields after the separator
+}
+
+// Create is a job.Job interface method.
+func (j *execJob) Create(jobArgs map[string]string) error {
+	var res execResponse
+	if _, err := j.call("create", execRequest{Name: j.jobName, Args: jobArgs}, &res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	j.data = res.Data
+	for k, v := range res.Args {
+		jobArgs[k] = v
+	}
+	return nil
+}
+
+// Serialize is a job.Job interface method.
+func (j *execJob) Serialize() ([]byte, error) {
+	return j.data, nil
+}
+
+// Deserialize is a job.Job interface method.
+func (j *execJob) Deserialize(bytes []byte) error {
+	j.data = bytes
+	j.setStatus("ready to run")
+	return nil
+}
+
+// SetArgs is a job.ArgsSetter interface method.
+func (j *execJob) SetArgs(args map[string]string) error {
+	j.args = args
+	return nil
+}
+
+// SetLog is a job.Logger interface method.
+func (j *execJob) SetLog(w io.Writer) {
+	j.log = w
+}
+
+// Run is a job.Job interface method.
+func (j *execJob) Run(jobData map[string]interface{}) (job.Return, error) {
+	j.setStatus("running " + j.path)
+	defer j.setStatus("done running " + j.path)
+
+	req := execRequest{
+		Name:    j.jobName,
+		Data:    j.data,
+		Args:    j.args,
+		JobData: jobData,
+	}
+	var res execResponse
+	stderr, err := j.call("run", req, &res)
+	if err != nil {
+		state := proto.STATE_FAIL
+		j.Lock()
+		if j.stopped {
+			state = proto.STATE_STOPPED
+		}
+		j.Unlock()
+		return job.Return{State: state, Exit: 1, Error: err, Stderr: stderr}, nil
+	}
+
+	for k, v := range res.JobData {
+		jobData[k] = v
+	}
+	ret := job.Return{
+		State:  res.State,
+		Exit:   res.Exit,
+		Stderr: stderr,
+	}
+	if res.Error != "" {
+		ret.Error = errors.New(res.Error)
+	}
+	if _, ok := proto.StateName[ret.State]; !ok || ret.State == proto.STATE_UNKNOWN {
+		ret.State = proto.STATE_FAIL
+		ret.Error = fmt.Errorf("%s returned invalid state %d", j.path, res.State)
+	}
+	return ret, nil
+}
+
+// Stop is a job.Job interface method.
+func (j *execJob) Stop() error {
+	j.Lock()
+	defer j.Unlock()
+	j.stopped = true
+	if j.cmd == nil || j.cmd.Process == nil {
+		return nil
+	}
+	return j.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Status is a job.Job interface method.
+func (j *execJob) Status() string {
+	j.Lock()
+	defer j.Unlock()
+	return j.status
+}
+
+// Name is a job.Job interface method.
+func (j *execJob) Name() string {
+	return j.jobName
+}
+
+// Type is a job.Job interface method.
+func (j *execJob) Type() string {
+	return j.jobType
+}
+
+// call runs the executable for a method and decodes its response. It returns
+// the stderr output of the executable.
+func (j *execJob) call(method string, req execRequest, res *execResponse) (string, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(j.path, method)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if j.log != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, j.log)
+	}
+
+	j.Lock()
+	if j.stopped {
+		j.Unlock()
+		return "", errors.New("stopped")
+	}
+	if err := cmd.Start(); err != nil {
+		j.Unlock()
+		return "", err
+	}
+	j.cmd = cmd
+	j.Unlock()
+
+	err = cmd.Wait()
+
+	j.Lock()
+	j.cmd = nil
+	j.Unlock()
+
+	if err != nil {
+		return stderr.String(), fmt.Errorf("%s %s: %s", j.path, method, err)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), res); err != nil {
+		return stderr.String(), fmt.Errorf("%s %s: invalid response: %s", j.path, method, err)
+	}
+	return stderr.String(), nil
+}
+
+func (j *execJob) setStatus(msg string) {
+	j.Lock()
+	defer j.Unlock()
+	j.status = msg
+}
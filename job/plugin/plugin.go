@@ -0,0 +1,141 @@
+// Copyright 2017, Square, Inc.
+
+// Package plugin provides job factories for job types that are not compiled
+// into Spin Cycle: Go plugins (.so files built with -buildmode=plugin) and
+// external executables that speak a JSON protocol on stdin and stdout (see
+// ExecFactory). This lets teams add job types without rebuilding the Job
+// Runner: only restarting it with the new plugins.
+package plugin
+
+import (
+	"fmt"
+	"os"
+	goplugin "plugin"
+	"strings"
+
+	"github.com/square/spincycle/job"
+)
+
+// Factories is a job.Factory that makes jobs with the first factory that knows
+// the job type, i.e. the first that does not return job.ErrUnknownJobType.
+type Factories []job.Factory
+
+// Make is a job.Factory interface method.
+func (fs Factories) Make(jobType, jobName string) (job.Job, error) {
+	for _, f := range fs {
+		j, err := f.Make(jobType, jobName)
+		if err == job.ErrUnknownJobType {
+			continue
+		}
+		return j, err
+	}
+	return nil, job.ErrUnknownJobType
+}
+
+// Warmups is a job.WarmFactory interface method. It returns the warmups of
+// every factory that has them. If two factories have a warmup for the same job
+// type, the first one wins because it makes the jobs.
+func (fs Factories) Warmups() map[string]job.Warmup {
+	warmups := map[string]job.Warmup{}
+	for i := len(fs) - 1; i >= 0; i-- {
+		wf, ok := fs[i].(job.WarmFactory)
+		if !ok {
+			continue
+		}
+		for jobType, w := range wf.Warmups() {
+			warmups[jobType] = w
+		}
+	}
+	return warmups
+}
+
+// Types is a job.TypeFactory interface method. It returns the job types of
+// every factory that lists them, once each, in factory order.
+func (fs Factories) Types() []string {
+	types := []string{}
+	seen := map[string]bool{}
+	for _, f := range fs {
+		tf, ok := f.(job.TypeFactory)
+		if !ok {
+			continue
+		}
+		for _, jobType := range tf.Types() {
+			if !seen[jobType] {
+				seen[jobType] = true
+				types = append(types, jobType)
+			}
+		}
+	}
+	return types
+}
+
+// Docs is a job.DocFactory interface method. It returns the docs of every
+// factory that has them. If two factories document the same job type, the
+// first one wins because it makes the jobs.
+func (fs Factories) Docs() map[string]job.Doc {
+	docs := map[string]job.Doc{}
+	for i := len(fs) - 1; i >= 0; i-- {
+		df, ok := fs[i].(job.DocFactory)
+		if !ok {
+			continue
+		}
+		for jobType, d := range df.Docs() {
+			docs[jobType] = d
+		}
+	}
+	return docs
+}
+
+// Open opens a Go plugin and returns its job factory: an exported variable
+// named Factory, like
+//
+//	var Factory job.Factory = myFactory{}
+//
+// The plugin must be built with the same version of Go and of Spin Cycle as
+// the Job Runner that opens it.
+func Open(path string) (job.Factory, error) {
+	p, err := goplugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Factory")
+	if err != nil {
+		return nil, err
+	}
+	switch f := sym.(type) {
+	case *job.Factory:
+		if *f == nil {
+			return nil, fmt.Errorf("%s: Factory is nil", path)
+		}
+		return *f, nil
+	case job.Factory:
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s: Factory is type %T, expected job.Factory", path, sym)
+}
+
+// Load returns a factory for job types in paths: Go plugins (files ending in
+// .so) and directories of executables (see ExecFactory). The factories are
+// tried in the order of paths.
+func Load(paths []string) (Factories, error) {
+	fs := Factories{}
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".so") {
+			f, err := Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("can't open plugin %s: %s", path, err)
+			}
+			fs = append(fs, f)
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a Go plugin (.so) or a directory of executables", path)
+		}
+		fs = append(fs, ExecFactory(path))
+	}
+	return fs, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2017, Square, Inc.
+
+package plugin_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/job/internal"
+	"github.com/square/spincycle/job/plugin"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+const script = `#!/bin/sh
+in=$(cat)
+case "$1" in
+create)
+	echo '{"data":{"host":"db1"},"args":{"next":"set by create"}}'
+	;;
+run)
+	echo "running on db1" >&2
+	case "$in" in
+	*'"sleep"'*) exec sleep 10 ;;
+	*'"bad"'*) echo '{"state":255}'; exit 0 ;;
+	*'"fail"'*) exit 2 ;;
+	esac
+	echo '{"state":3,"jobData":{"out":"y"}}'
+	;;
+esac
+`
+
+func execDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spincycle-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "db-check"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "not-exec"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestExecFactory(t *testing.T) {
+	dir := execDir(t)
+	defer os.RemoveAll(dir)
+	f := plugin.ExecFactory(dir)
+
+	for _, jobType := range []string{"nope", "not-exec", "../db-check", ""} {
+		if _, err := f.Make(jobType, "job1"); err != job.ErrUnknownJobType {
+			t.Errorf("%s: err = %v, expected %s", jobType, err, job.ErrUnknownJobType)
+		}
+	}
+
+	// Create and serialize like the RM
+	j, err := f.Make("db-check", "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Name() != "job1" || j.Type() != "db-check" {
+		t.Errorf("name, type = %s, %s, expected job1, db-check", j.Name(), j.Type())
+	}
+	jobArgs := map[string]string{"host": "db1"}
+	if err := j.Create(jobArgs); err != nil {
+		t.Fatal(err)
+	}
+	if jobArgs["next"] != "set by create" {
+		t.Errorf("jobArgs = %v, expected next set by create", jobArgs)
+	}
+	data, err := j.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deserialize and run like the JR
+	j, _ = f.Make("db-check", "job1")
+	if err := j.Deserialize(data); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	j.(job.Logger).SetLog(&log)
+	jobData := map[string]interface{}{"in": "x"}
+	ret, err := j.Run(jobData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.State != proto.STATE_COMPLETE || ret.Error != nil {
+		t.Errorf("state = %s, error = %v, expected COMPLETE and no error", proto.StateName[ret.State], ret.Error)
+	}
+	if expect := map[string]interface{}{"in": "x", "out": "y"}; !reflect.DeepEqual(jobData, expect) {
+		t.Errorf("jobData = %v, expected %v", jobData, expect)
+	}
+	if log.String() != "running on db1\n" {
+		t.Errorf("log = %q, expected stderr of the executable", log.String())
+	}
+}
+
+func TestExecJobFail(t *testing.T) {
+	dir := execDir(t)
+	defer os.RemoveAll(dir)
+	f := plugin.ExecFactory(dir)
+
+	for arg, expect := range map[string]string{"fail": "exit status 2", "bad": "invalid state 255"} {
+		j, _ := f.Make("db-check", "job1")
+		j.(job.ArgsSetter).SetArgs(map[string]string{"mode": arg})
+		ret, _ := j.Run(map[string]interface{}{})
+		if ret.State != proto.STATE_FAIL || ret.Error == nil || !strings.Contains(ret.Error.Error(), expect) {
+			t.Errorf("%s: state = %s, error = %v, expected FAIL and %q", arg, proto.StateName[ret.State], ret.Error, expect)
+		}
+	}
+}
+
+func TestExecJobStop(t *testing.T) {
+	dir := execDir(t)
+	defer os.RemoveAll(dir)
+
+	j, _ := plugin.ExecFactory(dir).Make("db-check", "job1")
+	j.(job.ArgsSetter).SetArgs(map[string]string{"mode": "sleep"})
+	retChan := make(chan job.Return)
+	go func() {
+		ret, _ := j.Run(map[string]interface{}{})
+		retChan <- ret
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := j.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ret := <-retChan:
+		if ret.State != proto.STATE_STOPPED {
+			t.Errorf("state = %s, expected STOPPED", proto.StateName[ret.State])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestFactories(t *testing.T) {
+	dir := execDir(t)
+	defer os.RemoveAll(dir)
+
+	mockJob := &mock.Job{}
+	fs, err := plugin.Load([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs = append(plugin.Factories{&mock.JobFactory{JobToReturn: mockJob, MakeErr: job.ErrUnknownJobType}}, fs...)
+
+	j, err := fs.Make("db-check", "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Type() != "db-check" {
+		t.Errorf("type = %s, expected db-check from the exec factory", j.Type())
+	}
+	if _, err := fs.Make("nope", "job1"); err != job.ErrUnknownJobType {
+		t.Errorf("err = %v, expected %s", err, job.ErrUnknownJobType)
+	}
+
+	// The first factory with a warmup for a job type wins
+	w1, w2 := &mock.Warmup{}, &mock.Warmup{Warmed: true}
+	fs = plugin.Factories{
+		&mock.JobFactory{WarmupsToReturn: map[string]job.Warmup{"a": w1}},
+		plugin.ExecFactory(dir),
+		&mock.JobFactory{WarmupsToReturn: map[string]job.Warmup{"a": w2, "b": w2}},
+	}
+	if expect := map[string]job.Warmup{"a": w1, "b": w2}; !reflect.DeepEqual(fs.Warmups(), expect) {
+		t.Errorf("warmups = %v, expected %v", fs.Warmups(), expect)
+	}
+
+	// Same for docs. Exec job types are documented by a doc file.
+	doc := `{"description": "checks a db", "args": [{"name": "host", "type": "string", "required": true}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "db-check.doc.json"), []byte(doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d1, d2 := job.Doc{Description: "first"}, job.Doc{Description: "second"}
+	fs[0] = &mock.JobFactory{DocsToReturn: map[string]job.Doc{"a": d1}}
+	fs[2] = &mock.JobFactory{DocsToReturn: map[string]job.Doc{"a": d2, "b": d2}}
+	expectDocs := map[string]job.Doc{
+		"a": d1,
+		"b": d2,
+		"db-check": {
+			Description: "checks a db",
+			Args:        []job.ArgDoc{{Name: "host", Type: "string", Required: true}},
+		},
+	}
+	if docs := fs.Docs(); !reflect.DeepEqual(docs, expectDocs) {
+		t.Errorf("docs = %+v, expected %+v", docs, expectDocs)
+	}
+
+	// Job types are listed once each, in factory order. Exec job types are
+	// the executables. Describe has every type that's listed or documented,
+	// with the args its jobs describe.
+	fs = plugin.Factories{
+		&mock.JobFactory{TypesToReturn: []string{"a", "db-check"}, MakeErr: job.ErrUnknownJobType},
+		plugin.ExecFactory(dir),
+		internal.Factory,
+	}
+	if expect := []string{"a", "db-check", "shell-command"}; !reflect.DeepEqual(fs.Types(), expect) {
+		t.Errorf("types = %v, expected %v", fs.Types(), expect)
+	}
+	docs := job.Describe(fs)
+	if len(docs) != 3 {
+		t.Errorf("docs = %+v, expected a, db-check, and shell-command", docs)
+	}
+	if !reflect.DeepEqual(docs["a"], job.Doc{}) {
+		t.Errorf("doc = %+v, expected an empty doc for an undocumented type", docs["a"])
+	}
+	if docs["db-check"].Description != "checks a db" || docs["db-check"].Schema != nil {
+		t.Errorf("doc = %+v, expected the doc file without a schema", docs["db-check"])
+	}
+	sc := docs["shell-command"]
+	if len(sc.Schema) == 0 || sc.Schema[0].Name != "<jobName>_cmd" || !reflect.DeepEqual(sc.Schema, sc.Args) {
+		t.Errorf("schema = %+v, expected the args of a shell-command job", sc.Schema)
+	}
+
+	if _, err := plugin.Load([]string{filepath.Join(dir, "db-check")}); err == nil {
+		t.Error("err = nil, expected an error for a file that isn't a plugin")
+	}
+	if _, err := plugin.Load([]string{filepath.Join(dir, "nope.so")}); err == nil {
+		t.Error("err = nil, expected an error for a missing plugin")
+	}
+}
@@ -3,31 +3,127 @@
 package proto
 
 const (
-	STATE_UNKNOWN    byte = iota
-	STATE_PENDING         // hasn't started yet
-	STATE_RUNNING         // is running
-	STATE_COMPLETE        // has completed
-	STATE_INCOMPLETE      // did not complete and isn't running
-	STATE_FAIL            // failed or was stoppoed
-	STATE_TIMEOUT         // stopped due to timeout
+	STATE_UNKNOWN          byte = iota
+	STATE_PENDING               // hasn't started yet
+	STATE_RUNNING               // is running
+	STATE_COMPLETE              // has completed
+	STATE_INCOMPLETE            // did not complete and isn't running
+	STATE_FAIL                  // failed
+	STATE_TIMEOUT               // stopped due to timeout
+	STATE_EXPIRED               // never started before its TTL
+	STATE_SUSPENDED             // stopped between jobs to be resumed later
+	STATE_DELETED               // removed before it was started
+	STATE_SKIPPED               // will never run because no edge to it was taken
+	STATE_ROLLING_BACK          // failed and is running rollback jobs
+	STATE_STOPPED               // stopped on request, returned within the grace period
+	STATE_FORCE_KILLED          // stopped on request, abandoned after the grace period
+	STATE_POLICY_VIOLATION      // failed because it broke a policy, like its egress policy
+	STATE_STALLED               // stopped because it didn't send a heartbeat in time
+	STATE_QUARANTINED           // the traverser panicked, the chain won't run until it's recovered
 )
 
 var StateName = map[byte]string{
-	STATE_UNKNOWN:    "UNKNOWN",
-	STATE_PENDING:    "PENDING",
-	STATE_RUNNING:    "RUNNING",
-	STATE_COMPLETE:   "COMPLETE",
-	STATE_INCOMPLETE: "INCOMPLETE",
-	STATE_FAIL:       "FAIL",
-	STATE_TIMEOUT:    "TIMEOUT",
+	STATE_UNKNOWN:          "UNKNOWN",
+	STATE_PENDING:          "PENDING",
+	STATE_RUNNING:          "RUNNING",
+	STATE_COMPLETE:         "COMPLETE",
+	STATE_INCOMPLETE:       "INCOMPLETE",
+	STATE_FAIL:             "FAIL",
+	STATE_TIMEOUT:          "TIMEOUT",
+	STATE_EXPIRED:          "EXPIRED",
+	STATE_SUSPENDED:        "SUSPENDED",
+	STATE_DELETED:          "DELETED",
+	STATE_SKIPPED:          "SKIPPED",
+	STATE_ROLLING_BACK:     "ROLLING_BACK",
+	STATE_STOPPED:          "STOPPED",
+	STATE_FORCE_KILLED:     "FORCE_KILLED",
+	STATE_POLICY_VIOLATION: "POLICY_VIOLATION",
+	STATE_STALLED:          "STALLED",
+	STATE_QUARANTINED:      "QUARANTINED",
 }
 
 var StateValue = map[string]byte{
-	"UNKNOWN":    STATE_UNKNOWN,
-	"PENDING":    STATE_PENDING,
-	"RUNNING":    STATE_RUNNING,
-	"COMPLETE":   STATE_COMPLETE,
-	"INCOMPLETE": STATE_INCOMPLETE,
-	"FAIL":       STATE_FAIL,
-	"TIMEOUT":    STATE_TIMEOUT,
+	"UNKNOWN":          STATE_UNKNOWN,
+	"PENDING":          STATE_PENDING,
+	"RUNNING":          STATE_RUNNING,
+	"COMPLETE":         STATE_COMPLETE,
+	"INCOMPLETE":       STATE_INCOMPLETE,
+	"FAIL":             STATE_FAIL,
+	"TIMEOUT":          STATE_TIMEOUT,
+	"EXPIRED":          STATE_EXPIRED,
+	"SUSPENDED":        STATE_SUSPENDED,
+	"DELETED":          STATE_DELETED,
+	"SKIPPED":          STATE_SKIPPED,
+	"ROLLING_BACK":     STATE_ROLLING_BACK,
+	"STOPPED":          STATE_STOPPED,
+	"FORCE_KILLED":     STATE_FORCE_KILLED,
+	"POLICY_VIOLATION": STATE_POLICY_VIOLATION,
+	"STALLED":          STATE_STALLED,
+	"QUARANTINED":      STATE_QUARANTINED,
 }
+
+const (
+	RETRY_BACKOFF_FIXED       = "fixed"       // wait RetryWait between every try
+	RETRY_BACKOFF_EXPONENTIAL = "exponential" // double the wait after every try
+	RETRY_BACKOFF_JITTER      = "jitter"      // exponential with random jitter
+)
+
+const (
+	ISOLATION_PROCESS = "process" // a process of its own with resource limits (setrlimit)
+	ISOLATION_CGROUP  = "cgroup"  // a process in a cgroup of its own, or ISOLATION_PROCESS if cgroups are not available
+)
+
+const (
+	MIRROR_DIVERGENCE_FAIL = "fail" // the try fails
+	MIRROR_DIVERGENCE_FLAG = "flag" // the try completes, with a warning event for the job
+)
+
+const (
+	BATCH_MODE_INDIVIDUAL = "individual" // each chain in a batch is added or rejected on its own
+	BATCH_MODE_ATOMIC     = "atomic"     // every chain in a batch is added, or none are
+)
+
+const (
+	DEAD_LETTER_CALLBACK        = "callback"        // a chain's callback (JobChainCallback)
+	DEAD_LETTER_SUSPENDED_CHAIN = "suspended-chain" // a suspended chain sent to the RM (SuspendedJobChain)
+)
+
+const (
+	EDGE_ON_SUCCESS = "success" // previous job completed (default)
+	EDGE_ON_FAIL    = "fail"    // previous job failed or timed out
+	EDGE_ON_DONE    = "done"    // previous job completed, failed, or timed out
+)
+
+const (
+	BLOCKED_DEPENDENCY              = "dependency"              // a previous job is not complete
+	BLOCKED_CHAIN_NOT_STARTED       = "chain_not_started"       // the chain hasn't been started
+	BLOCKED_CHAIN_STOPPED           = "chain_stopped"           // the chain was stopped
+	BLOCKED_CHAIN_DONE              = "chain_done"              // the chain is done, the job will never run
+	BLOCKED_CHAIN_SUSPENDED         = "chain_suspended"         // the chain was suspended, the job will run when resumed
+	BLOCKED_CHAIN_QUARANTINED       = "chain_quarantined"       // the traverser panicked, the job won't run until the chain is recovered
+	BLOCKED_CHAIN_CONCURRENCY_LIMIT = "chain_concurrency_limit" // the chain is running its max jobs
+	BLOCKED_CONCURRENCY_LIMIT       = "concurrency_limit"       // the Job Runner is running its max jobs, or its max jobs of the job's type
+	BLOCKED_REPO_UNAVAILABLE        = "repo_unavailable"        // the chain can't be saved and the Job Runner pauses chains until it can
+)
+
+const (
+	INTERVENTION_STOP    = "stop"    // the chain was stopped
+	INTERVENTION_SUSPEND = "suspend" // the chain was suspended
+)
+
+// JobChain.Metadata keys set by the Request Manager, so callbacks and reports
+// say who a chain is for, like to notify them.
+const (
+	META_USER   = "user"   // operator the request is for (Request.User)
+	META_CALLER = "caller" // account that made the request (Request.Caller)
+)
+
+// JobChain.Env keys that jobs get as fields of their job.Context. Other keys
+// are only in job.Context.Env.
+const (
+	ENV_DATACENTER = "datacenter"
+	ENV_CLUSTER    = "cluster"
+	ENV_DRY_RUN    = "dryRun"    // "true" or "false", like strconv.ParseBool
+	ENV_REQUESTOR  = "requestor" // who made the request, set by the Request Manager
+	ENV_LABEL      = "label"     // environment, like "staging" or "prod", whose config bundle jobs get
+)
@@ -0,0 +1,61 @@
+// Copyright 2017, Square, Inc.
+
+package proto
+
+// Error codes of API errors. Codes are stable, so clients can switch on them;
+// messages are for humans and can change. Every error type of the router has
+// a generic code, used when there is no more specific one.
+const (
+	// Generic codes, one per router error type
+	ERR_NOT_FOUND      = "ERR_NOT_FOUND"
+	ERR_MISSING_PARAM  = "ERR_MISSING_PARAM"
+	ERR_INVALID_PARAM  = "ERR_INVALID_PARAM"
+	ERR_BAD_REQUEST    = "ERR_BAD_REQUEST"
+	ERR_UNAUTHORIZED   = "ERR_UNAUTHORIZED"
+	ERR_FORBIDDEN      = "ERR_FORBIDDEN"
+	ERR_CONFLICT       = "ERR_CONFLICT"
+	ERR_NOT_ACCEPTABLE = "ERR_NOT_ACCEPTABLE"
+	ERR_RATE_LIMITED   = "ERR_RATE_LIMITED"
+	ERR_UNAVAILABLE    = "ERR_UNAVAILABLE"
+	ERR_INTERNAL       = "ERR_INTERNAL"
+
+	// Job Runner
+	ERR_CHAIN_NOT_FOUND       = "ERR_CHAIN_NOT_FOUND"       // no chain with the request ID
+	ERR_CHAIN_EXISTS          = "ERR_CHAIN_EXISTS"          // a different chain has the request ID
+	ERR_CHAIN_ALREADY_STARTED = "ERR_CHAIN_ALREADY_STARTED" // the chain isn't pending, so it can't be started, scheduled, or deleted
+	ERR_CHAIN_NOT_DONE        = "ERR_CHAIN_NOT_DONE"        // the chain has no result or report yet
+	ERR_INVALID_DAG           = "ERR_INVALID_DAG"           // the chain's jobs and edges aren't a valid graph, or a job can't be made
+	ERR_JOB_NOT_FOUND         = "ERR_JOB_NOT_FOUND"         // no job, or job try, with the name in the chain
+	ERR_SHUTTING_DOWN         = "ERR_SHUTTING_DOWN"         // the Job Runner is shutting down
+	ERR_AGENTS_DISABLED       = "ERR_AGENTS_DISABLED"       // the Job Runner doesn't run jobs on agents
+	ERR_AGENT_NOT_FOUND       = "ERR_AGENT_NOT_FOUND"       // the agent isn't registered, or has no such work
+	ERR_CHAIN_NOT_QUARANTINED = "ERR_CHAIN_NOT_QUARANTINED" // the chain isn't quarantined, or its jobs are still running, so it can't be recovered
+	ERR_ARTIFACTS_DISABLED    = "ERR_ARTIFACTS_DISABLED"    // the Job Runner doesn't store job artifacts
+	ERR_ARTIFACT_NOT_FOUND    = "ERR_ARTIFACT_NOT_FOUND"    // the job has no artifact with the name
+	ERR_BATCH_REJECTED        = "ERR_BATCH_REJECTED"        // another chain in an atomic batch was rejected, so the chain wasn't added
+	ERR_CHAIN_NOT_RETRYABLE   = "ERR_CHAIN_NOT_RETRYABLE"   // the chain didn't fail, is still running, or was rolled back, so it can't be retried
+
+	// Request Manager
+	ERR_REQUEST_NOT_FOUND   = "ERR_REQUEST_NOT_FOUND"   // no request with the ID
+	ERR_REQUEST_NOT_RUNNING = "ERR_REQUEST_NOT_RUNNING" // the request is done, so it can't be stopped
+	ERR_INVALID_REQUEST     = "ERR_INVALID_REQUEST"     // unknown request type, or missing or invalid args
+	ERR_NO_JOB_RUNNER       = "ERR_NO_JOB_RUNNER"       // the Job Runners can't be found
+	ERR_JOB_RUNNER          = "ERR_JOB_RUNNER"          // the Job Runner didn't take the chain
+	ERR_INVALID_SPECS       = "ERR_INVALID_SPECS"       // the request specs to reload aren't valid
+)
+
+// Error is the JSON body of every API error response:
+//
+//	{"code": "ERR_CHAIN_NOT_FOUND", "type": "not_found", "message": "..."}
+//
+// It implements error, so clients return it as-is and callers can switch on
+// Code.
+type Error struct {
+	Code    string `json:"code"`    // ERR_* const
+	Type    string `json:"type"`    // router error type, like "not_found", which sets the HTTP status
+	Message string `json:"message"` // human-readable
+}
+
+func (e Error) Error() string {
+	return e.Code + ": " + e.Message
+}
@@ -2,9 +2,16 @@
 
 // Package proto provides all API and service-to-service (s2s) message
 // structures and constants.
+//
+// This package is a stable API: exported names and JSON field names aren't
+// removed or changed except in a major release. New fields are optional, and
+// their zero value means what it meant before they were added, so clients and
+// servers of different versions work together. STATE_* values and error codes
+// never change.
 package proto
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -16,30 +23,715 @@ type Job struct {
 	Bytes []byte                 `json:"bytes"` // return value of Job.Serialize method
 	State byte                   `json:"state"` // STATE_* const
 	Data  map[string]interface{} `json:"data"`  // job-specific data during Job.Run
+
+	// Sequence is the name of the sequence in the request spec that the job
+	// is part of, set by the Request Manager. The Job Runner keeps metrics of
+	// sequences by request type (see JobChain.RequestType), and a sequence
+	// can be retried as a whole (see JobChain.SequenceRetries).
+	Sequence string `json:"sequence,omitempty"`
+
+	// Args are resolved by the Job Runner right before the job runs and given
+	// to the job (see job.ArgsSetter). A value can be a reference like
+	// "vault:secret/db/password" or "consul:key/path", so secrets are never
+	// in the chain, only references to them. Other values are given as-is.
+	Args map[string]string `json:"args,omitempty"`
+
+	// Agent is the pool of spincycle-agents that run the job on their hosts,
+	// for jobs that must run on the target host itself. Empty means the job
+	// runs in the Job Runner.
+	Agent string `json:"agent,omitempty"`
+
+	// Rollback is the name of a job in JobChain.RollbackJobs that undoes this
+	// job. If the chain fails, it runs if this job completed.
+	Rollback string `json:"rollback,omitempty"`
+
+	// Cost is the number of job slots the job uses while it runs, which counts
+	// against the chain's MaxConcurrentJobs and the Job Runner's limit. Zero
+	// means 1.
+	Cost uint `json:"cost"`
+
+	// Timeout is the max time (a time.Duration string, e.g. "10m") that one try
+	// of the job can run. If exceeded, the job is stopped and its state is
+	// STATE_TIMEOUT. Empty means no timeout.
+	Timeout string `json:"timeout"`
+
+	// HeartbeatTimeout is the max time (a time.Duration string, e.g. "1m")
+	// between heartbeats of a job that sends them (job.Heartbeater), from
+	// when it starts. If exceeded, the job is considered hung: it is stopped
+	// and its state is STATE_STALLED, which is a failure, so the job is
+	// retried, its fail edges are taken, and the chain rolls back like when
+	// it fails. Empty means heartbeats aren't checked.
+	HeartbeatTimeout string `json:"heartbeatTimeout,omitempty"`
+
+	// Retry policy. If the job fails, it is retried up to Retry times, waiting
+	// RetryWait (a time.Duration string, e.g. "5s") between tries. How the wait
+	// changes between tries is determined by RetryBackoff.
+	Retry        uint   `json:"retry"`        // max number of retries, 0 = never retry
+	RetryWait    string `json:"retryWait"`    // wait between tries, default no wait
+	RetryBackoff string `json:"retryBackoff"` // RETRY_BACKOFF_* const, default fixed
+
+	// Limits are the resources that the job can use. A job with limits runs in
+	// its own process, so a job that misbehaves can't take down the Job Runner
+	// with it. Nil means the job runs in the Job Runner's process.
+	Limits *JobLimits `json:"limits,omitempty"`
+
+	// Mirrors is the number of runners (or agents) that run each try of the
+	// job at once, for critical checks that must not be approved by a single
+	// bad vantage point. The try completes only if every mirror completes
+	// with the same job data. If they complete with different job data,
+	// MirrorDivergence (a MIRROR_DIVERGENCE_* const, default fail) is what
+	// happens. 0 or 1 means the job isn't mirrored. Mirrors count as one job
+	// against Cost and don't share job data: each gets a copy, and the job
+	// data of the first mirror is kept.
+	Mirrors          uint   `json:"mirrors,omitempty"`
+	MirrorDivergence string `json:"mirrorDivergence,omitempty"`
+
+	// Traceparent is the W3C traceparent of the span of the job's current try.
+	// It's set by the Job Runner when the job runs and given to jobs that are
+	// part of the trace (see job.Traced), also on spincycle-agents.
+	Traceparent string `json:"traceparent,omitempty"`
+
+	// Env is the chain's Env. It's set by the Job Runner when the job runs,
+	// so jobs run by spincycle-agents get it too.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// JobLimits are the resources that a job can use and how it's isolated from
+// the Job Runner. Zero values are no limit.
+type JobLimits struct {
+	Isolation  string  `json:"isolation,omitempty"`  // ISOLATION_* const, default process
+	MemoryMB   uint    `json:"memoryMB,omitempty"`   // max memory, in MiB
+	CPUSeconds uint    `json:"cpuSeconds,omitempty"` // max CPU time of one try
+	CPUs       float64 `json:"cpus,omitempty"`       // max CPUs used at once, only enforced by ISOLATION_CGROUP
 }
 
 // JobChain represents a directed acyclic graph of jobs for one request.
 // Job chains are identified by RequestId, which must be globally unique.
 type JobChain struct {
 	RequestId     uint                `json:"requestId"`     // unique identifier for the chain
+	RequestType   string              `json:"requestType"`   // type of request, like "restart-host", for metrics
 	Jobs          map[string]Job      `json:"jobs"`          // Job.Name => job
 	AdjacencyList map[string][]string `json:"adjacencyList"` // Job.Name => next jobs
 	State         byte                `json:"state"`         // STATE_* const
 	StartTime     time.Time           `json:"startTime"`     // when the chain started running
 	EndTime       time.Time           `json:"endTime"`       // when the chain ended running
+
+	// StartAt is when the chain is scheduled to start, zero if it isn't. It's
+	// set by the Job Runner when the chain is started with a future time.
+	StartAt time.Time `json:"startAt"`
+
+	// Conditions make edges in the adjacency list conditional on the outcome
+	// of the previous job or the jobData it produced. Edges without a condition
+	// are taken only if the previous job completed.
+	Conditions map[string]map[string]EdgeCondition `json:"conditions,omitempty"` // Job.Name => next Job.Name => condition
+
+	// Rollback jobs run when the chain fails, unless it was stopped: the
+	// rollback job (Job.Rollback) of every job that completed, one at a time
+	// in the reverse order that the jobs completed, then the chain's rollback
+	// job, if any. A rollback job gets a copy of the jobData of the job it
+	// undoes. Rollback stops at the first rollback job that doesn't complete.
+	RollbackJobs map[string]Job `json:"rollbackJobs,omitempty"` // Job.Name => rollback job
+	RollbackJob  string         `json:"rollbackJob,omitempty"`  // chain-level rollback job in RollbackJobs
+
+	// SequenceRetries are how many times to retry each sequence (Job.Sequence)
+	// as a whole: sequence => max retries. Some failures need a group of jobs
+	// to run again together, like allocate, configure, and verify. If a job
+	// in the sequence fails (after its own retries), no more jobs in the
+	// sequence are started, and once none are running, every job in the
+	// sequence is reset to PENDING, with the jobData it was first given, and
+	// the sequence runs again from its first job. A sequence with retries
+	// must have one first job: one job whose previous jobs are all outside
+	// the sequence.
+	SequenceRetries map[string]uint `json:"sequenceRetries,omitempty"`
+
+	// MaxConcurrentJobs limits how many job slots the jobs in the chain can use
+	// at once. A job uses Job.Cost slots (default 1), so with the default cost
+	// this limits how many jobs can run at once. Zero means no limit (but the
+	// Job Runner can have a global limit).
+	MaxConcurrentJobs uint `json:"maxConcurrentJobs"`
+
+	// Priority orders chains waiting to run when the Job Runner limits how
+	// many chains run at once: higher-priority chains run first. Chains with
+	// the same priority run in the order they were started. Default 0.
+	Priority int `json:"priority"`
+
+	// Metadata is arbitrary key/value data about the request from the caller
+	// who created it, like a ticket ID or the reason for the request. The
+	// Job Runner doesn't use it; it's returned with the chain's status,
+	// summary, and report, and chains can be listed by it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Env is the environment of the chain, like the datacenter and cluster
+	// it's for and whether it's a dry run (see ENV_* consts), which every
+	// job gets before it runs (see job.ContextSetter), so it's not
+	// serialized with every job.
+	Env map[string]string `json:"env,omitempty"`
+
+	// CallbackURL is an http or https URL to which the Job Runner POSTs a
+	// JobChainCallback when the chain is done running (complete, failed, or
+	// stopped), so the caller doesn't have to poll its status. Optional.
+	CallbackURL string `json:"callbackURL,omitempty"`
+
+	// ProgressURL is an http or https URL to which the Job Runner POSTs a
+	// JobChainProgress every time the state of the chain or one of its jobs
+	// changes, so the caller can track the chain while it runs. With
+	// ProgressPatch, every progress after the first one is a JSON Patch
+	// (RFC 6902) of the chain instead of the whole chain, which is much
+	// smaller for chains with many jobs. Optional.
+	ProgressURL   string `json:"progressURL,omitempty"`
+	ProgressPatch bool   `json:"progressPatch,omitempty"`
+
+	// Traceparent is the W3C traceparent of the caller's span, like the Request
+	// Manager's span for the request, so the chain's spans are in the same
+	// distributed trace. If not set, it's taken from the traceparent (or
+	// OpenTracing) header of the request that creates the chain.
+	Traceparent string `json:"traceparent,omitempty"`
+
+	// ExpectedDuration is how long (a time.Duration string, e.g. "30m") the
+	// chain is expected to run. If it runs longer than OverrunFactor times
+	// that (default 2), the Job Runner warns that the chain is overrunning: it
+	// logs a warning, sends a JobChainEvent with a Warning, and sets
+	// JobChainStatus.Overrun. The chain keeps running. Optional.
+	ExpectedDuration string  `json:"expectedDuration,omitempty"`
+	OverrunFactor    float64 `json:"overrunFactor,omitempty"` // >= 1, 0 = default
+
+	// Silence silences the alerts about the chain's targets while it runs, so
+	// the maintenance it does doesn't page, if the Job Runner has a silencer
+	// (see job-runner/silence). Optional.
+	Silence *Silence `json:"silence,omitempty"`
+
+	// Budget is the max the chain's jobs can spend on the cloud resources they
+	// create, in the unit of the job types' costs (see job.Coster), like USD.
+	// Before a job with an estimated cost runs, the Job Runner adds its
+	// estimate to what the chain has spent and what its running jobs are
+	// estimated to spend; if that's over the budget, the job isn't run: it's
+	// STATE_POLICY_VIOLATION. The projected and actual spend are in the chain's
+	// report (JobChainReport.Spend). Zero means no budget.
+	Budget float64 `json:"budget,omitempty"`
+
+	// Quarantine is set if the traverser running the chain panicked: the
+	// chain is STATE_QUARANTINED until an operator recovers it. It's kept
+	// after the chain is recovered. Set by the Job Runner.
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+
+	// Stopped is who stopped the chain and why, if it was stopped. Set by the
+	// Job Runner.
+	Stopped *StopInfo `json:"stopped,omitempty"`
+
+	// Scratch is the key/value scratch of the request's jobs (see
+	// job.Scratch), saved with the chain so it survives job retries and
+	// Job Runner restarts. It's removed when the chain is done. Set by the
+	// Job Runner.
+	Scratch map[string]string `json:"scratch,omitempty"`
+}
+
+// Quarantine is why a job chain was quarantined: the traverser running it
+// panicked, which is a bug in the Job Runner, not in a job.
+type Quarantine struct {
+	Time  time.Time `json:"time"`  // when the traverser panicked
+	Panic string    `json:"panic"` // value it panicked with
+	Stack string    `json:"stack"` // stack trace of the panic
+}
+
+// QuarantinedJobChain is a job chain that was quarantined, as listed by the
+// Job Runner.
+type QuarantinedJobChain struct {
+	RequestId   uint       `json:"requestId"`
+	RequestType string     `json:"requestType,omitempty"`
+	Quarantine  Quarantine `json:"quarantine"`
+}
+
+// EdgeCondition is a condition on the edge from a job to one of its next jobs.
+// When the job is done, the edge is taken if the job's final state matches On
+// and, if Key is set, the job's jobData has Key with a value that, formatted
+// with %v, equals Value. A next job runs when the edges from all of its previous
+// jobs are resolved and at least one is taken. If none are taken, the next job
+// is skipped (STATE_SKIPPED), as are its next jobs that can't run because of it.
+type EdgeCondition struct {
+	On    string `json:"on"`              // EDGE_ON_* const, default EDGE_ON_SUCCESS
+	Key   string `json:"key,omitempty"`   // jobData key to match, if set
+	Value string `json:"value,omitempty"` // jobData value to match
+}
+
+// JobArtifact describes an artifact output by a job (see job.Artifact), as
+// listed by the Job Runner.
+type JobArtifact struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"` // bytes
+}
+
+// SuspendedJobChain is a job chain that was suspended between jobs, usually
+// because the Job Runner is shutting down, so that it can be re-dispatched and
+// resumed. Jobs that completed are COMPLETE; jobs that still need to run are
+// PENDING. Jobs that failed keep their state.
+type SuspendedJobChain struct {
+	RequestId     uint      `json:"requestId"`
+	JobChain      *JobChain `json:"jobChain"`      // state is SUSPENDED
+	SuspendedTime time.Time `json:"suspendedTime"` // when the chain was suspended
+}
+
+// DeadLetter is something the Job Runner couldn't deliver after every try, like
+// a chain's callback, kept until an admin retries or discards it (GET
+// dead-letters). Body is what was POSTed to URL, as-is.
+type DeadLetter struct {
+	Id        string          `json:"id"`
+	Kind      string          `json:"kind"` // DEAD_LETTER_* const
+	RequestId uint            `json:"requestId"`
+	URL       string          `json:"url"`
+	Body      json.RawMessage `json:"body"`
+	Error     string          `json:"error"` // error of the last try
+	Tries     uint            `json:"tries"` // every try, including retries by admins
+	Time      time.Time       `json:"time"`  // when it was added
+}
+
+// StoppedJobChain is the result of stopping one chain when all chains are
+// stopped (PUT job-chains/stop-all).
+type StoppedJobChain struct {
+	RequestId uint   `json:"requestId"`
+	Stopped   bool   `json:"stopped"`         // false if it couldn't be stopped
+	Error     string `json:"error,omitempty"` // why it couldn't be stopped, or jobs that were force-killed
+}
+
+// JobChainBatch is many job chains added in one call (POST job-chains/batch),
+// like when the Request Manager dispatches many small chains at once. Mode is
+// a BATCH_MODE_* const, default BATCH_MODE_INDIVIDUAL.
+type JobChainBatch struct {
+	Mode   string     `json:"mode,omitempty"`
+	Chains []JobChain `json:"chains"`
+}
+
+// JobChainBatchResult is the result of adding a batch of job chains: whether
+// each chain was added, in the order of the batch. A chain that the Job Runner
+// already has is accepted, like when it's added again on its own.
+type JobChainBatchResult struct {
+	Mode    string          `json:"mode"`
+	Results []AddedJobChain `json:"results"`
+}
+
+// AddedJobChain is the result of adding one chain in a batch.
+type AddedJobChain struct {
+	RequestId uint   `json:"requestId"`
+	Accepted  bool   `json:"accepted"`
+	Code      string `json:"code,omitempty"`  // ERR_* const of why it was rejected
+	Error     string `json:"error,omitempty"` // why it was rejected
+}
+
+// JobChainSummary summarizes a job chain held by the Job Runner.
+type JobChainSummary struct {
+	RequestId   uint      `json:"requestId"`
+	State       byte      `json:"state"`       // STATE_* const
+	StartTime   time.Time `json:"startTime"`   // zero if not started
+	StartAt     time.Time `json:"startAt"`     // when it's scheduled to start, zero if not scheduled
+	TotalJobs   uint      `json:"totalJobs"`   // number of jobs in the chain
+	RunningJobs uint      `json:"runningJobs"` // number of jobs running now
+	Priority    int       `json:"priority"`    // JobChain.Priority
+	Queued      uint      `json:"queued"`      // position in the queue of chains waiting to run, 0 if not waiting
+
+	Metadata map[string]string `json:"metadata,omitempty"` // JobChain.Metadata
+}
+
+// JobChainDryRun reports what would happen if a job chain was run, without
+// running anything.
+type JobChainDryRun struct {
+	RequestId uint     `json:"requestId"`
+	Valid     bool     `json:"valid"`  // true if the chain can run
+	Errors    []string `json:"errors"` // why the chain can't run, if not valid
+
+	// Steps are the names of the jobs in the order they would run. Jobs in a
+	// step can run at the same time, after all jobs in earlier steps. Jobs
+	// after edges with conditions might be skipped when the chain runs.
+	Steps [][]string `json:"steps"`
 }
 
 // JobStatus represents the status of one job in a job chain.
 type JobStatus struct {
-	Name   string `json:"name"`   // unique name
-	Status string `json:"status"` // stdout of job, if any
-	State  byte   `json:"state"`  // STATE_* const
+	Name      string    `json:"name"`      // unique name
+	Status    string    `json:"status"`    // stdout of job, if any
+	State     byte      `json:"state"`     // STATE_* const
+	Rollback  bool      `json:"rollback"`  // true if a rollback job
+	StartTime time.Time `json:"startTime"` // when the job first started running
+	Elapsed   string    `json:"elapsed"`   // time since StartTime, like "1m30s"
+	Progress  int       `json:"progress"`  // percent done (0-100), -1 if not reported
+
+	TryHistory []JobTry `json:"tryHistory"` // every try of the job, in order
 }
 
 // JobChainStatus represents the status of a job chain reported by the Job Runner.
+//
+// The traverser running the chain heartbeats while it runs, even if no job
+// state changes. ServerTime and HeartbeatAge tell a chain that is quiet but
+// healthy from a traverser that is wedged, in which case Stale is true.
 type JobChainStatus struct {
-	RequestId   uint        `json:"requestId"`
-	JobStatuses JobStatuses `json:"jobStatuses"`
+	RequestId   uint              `json:"requestId"`
+	JobStatuses JobStatuses       `json:"jobStatuses"`
+	Metadata    map[string]string `json:"metadata,omitempty"` // JobChain.Metadata
+
+	ServerTime   time.Time `json:"serverTime"`             // when the status was made
+	HeartbeatAge string    `json:"heartbeatAge,omitempty"` // time since the traverser's last heartbeat, empty if not running
+	Stale        bool      `json:"stale"`                  // true if the heartbeat is too old
+	Overrun      bool      `json:"overrun"`                // true if the chain is running longer than it's expected to
+
+	// Degraded is true while the chain can't be saved to the Job Runner's
+	// chain repo. RepoGaps are the periods it couldn't be saved.
+	Degraded bool      `json:"degraded"`
+	RepoGaps []RepoGap `json:"repoGaps,omitempty"`
+
+	Stopped *StopInfo `json:"stopped,omitempty"` // JobChain.Stopped, while the chain is stopping
+}
+
+// StopInfo is who stopped a job chain and why. It's the optional body of a
+// request to stop a chain (PUT job-chains/{requestId}/stop), and it's kept
+// with the chain (JobChain.Stopped) so a chain found stopped later says who
+// stopped it. Requester defaults to the authenticated caller, and Time is set
+// by the Job Runner.
+type StopInfo struct {
+	Requester string    `json:"requester,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Silence is the alerts silenced while a job chain runs. The silence is
+// expired when the chain is done, or after Duration (a time.Duration string,
+// e.g. "2h", default 4h) if the chain never is, like when its Job Runner dies.
+type Silence struct {
+	Matchers map[string]string `json:"matchers"`           // alert label => regexp of its values, like {"instance": "db1-.*"}
+	Duration string            `json:"duration,omitempty"` // max time the silence lasts
+}
+
+// JobChainStatuses is the status of many job chains from one call, like for a
+// dashboard (GET job-chains/status?ids=1,2,3). NotFound are the request IDs of
+// chains that aren't running on the Job Runner.
+type JobChainStatuses struct {
+	Statuses []JobChainStatus `json:"statuses"` // in the order requested
+	NotFound []uint           `json:"notFound"`
+}
+
+// RepoGap is a period when a job chain couldn't be saved to the Job Runner's
+// chain repo, so the repo didn't have its latest state.
+type RepoGap struct {
+	Start        time.Time `json:"start"`        // first write that failed
+	End          time.Time `json:"end"`          // first write that succeeded after, zero if none yet
+	FailedWrites uint      `json:"failedWrites"` // writes that failed in the gap
+	Error        string    `json:"error"`        // error of the last write that failed
+}
+
+// JobChainEvent is a change in the state of a job in a job chain or, if Job is
+// empty, of the job chain itself.
+type JobChainEvent struct {
+	RequestId uint      `json:"requestId"`
+	Job       string    `json:"job,omitempty"` // job name, empty for the chain
+	State     byte      `json:"state"`         // new STATE_* const
+	Time      time.Time `json:"time"`          // when the state changed
+
+	// Warning is set, and State is the current state, if nothing changed but
+	// something is wrong, like the chain overrunning its expected duration.
+	Warning string `json:"warning,omitempty"`
+}
+
+// JobExplanation explains why a job in a job chain hasn't started running.
+// If Blockers is empty, nothing is blocking the job: it is running, it has
+// already run, or it is about to run.
+type JobExplanation struct {
+	RequestId uint         `json:"requestId"`
+	Name      string       `json:"name"`     // job name
+	State     byte         `json:"state"`    // STATE_* const
+	Blockers  []JobBlocker `json:"blockers"` // everything blocking the job
+}
+
+// JobBlocker is one reason a job hasn't started running.
+type JobBlocker struct {
+	Reason  string `json:"reason"`          // BLOCKED_* const
+	Message string `json:"message"`         // human-readable explanation
+	Job     string `json:"job,omitempty"`   // job blocking this job, for BLOCKED_DEPENDENCY
+	State   byte   `json:"state,omitempty"` // state of Job, for BLOCKED_DEPENDENCY
+}
+
+// JobChainReport is the final report of a job chain, made when the chain is
+// done running: what happened to every job, and when.
+type JobChainReport struct {
+	RequestId     uint            `json:"requestId"`
+	RequestType   string          `json:"requestType"`
+	State         byte            `json:"state"` // final STATE_* const
+	StartTime     time.Time       `json:"startTime"`
+	EndTime       time.Time       `json:"endTime"`
+	Jobs          []JobReport     `json:"jobs"`          // in the order they started, then jobs that didn't run
+	Interventions []Intervention  `json:"interventions"` // in the order they happened
+	Timeline      []JobChainEvent `json:"timeline"`      // every state change, in order
+
+	Metadata map[string]string `json:"metadata,omitempty"` // JobChain.Metadata
+
+	Spend *Spend `json:"spend,omitempty"` // if the chain has a budget or jobs with a cost
+}
+
+// Spend is what a job chain's jobs cost (see JobChain.Budget). Projected is
+// the sum of the estimated cost of every try that ran, Actual the sum of what
+// they cost. A chain that's resumed counts only what it spent since.
+type Spend struct {
+	Budget    float64  `json:"budget"`            // JobChain.Budget, 0 if none
+	Projected float64  `json:"projected"`         // estimated cost of the tries that ran
+	Actual    float64  `json:"actual"`            // actual cost of the tries that ran
+	Refused   []string `json:"refused,omitempty"` // jobs not run because they'd exceed the budget
+}
+
+// JobChainResult is the result of a chain that's done running: the final
+// state, run time, and jobData of its jobs, and the errors of the jobs that
+// failed. The Job Runner keeps the results of the chains that finished most
+// recently (GET job-chains/{requestId}/result).
+type JobChainResult struct {
+	RequestId   uint                 `json:"requestId"`
+	RequestType string               `json:"requestType"`
+	State       byte                 `json:"state"` // final STATE_* const
+	StartTime   time.Time            `json:"startTime"`
+	EndTime     time.Time            `json:"endTime"`
+	Seconds     float64              `json:"seconds"` // run time of the chain
+	Summary     CompletionSummary    `json:"summary"`
+	Jobs        map[string]JobResult `json:"jobs"`              // Job.Name => result, including rollback jobs
+	Stopped     *StopInfo            `json:"stopped,omitempty"` // JobChain.Stopped
+}
+
+// JobResult is the result of a job in a chain that's done running.
+type JobResult struct {
+	State   byte                   `json:"state"`           // final STATE_* const
+	Tries   uint                   `json:"tries"`           // 0 if it didn't run
+	Seconds float64                `json:"seconds"`         // from the start of the first try to the end of the last try
+	Error   string                 `json:"error,omitempty"` // error of the last try of a job that failed (JobTry.Error)
+	Data    map[string]interface{} `json:"data,omitempty"`  // final jobData, if the job still has it
+}
+
+// JobChainCallback is POSTed to JobChain.CallbackURL when a chain is done
+// running. JobData has the final jobData of the jobs that still have it when
+// the chain is done: the last jobs, whose jobData no other job used.
+type JobChainCallback struct {
+	RequestId uint                              `json:"requestId"`
+	State     byte                              `json:"state"`   // final STATE_* const
+	Summary   CompletionSummary                 `json:"summary"` // counts and run times, made from Report
+	Report    JobChainReport                    `json:"report"`  // final statuses and times of the chain and its jobs
+	JobData   map[string]map[string]interface{} `json:"jobData"` // Job.Name => jobData
+}
+
+// CompletionSummary summarizes how a chain that's done running went, so
+// consumers don't have to count the jobs in its report. Rollback jobs are not
+// counted.
+type CompletionSummary struct {
+	TotalJobs   uint         `json:"totalJobs"`
+	Completed   uint         `json:"completed"`
+	Failed      uint         `json:"failed"`  // FAIL, TIMEOUT, or POLICY_VIOLATION
+	Skipped     uint         `json:"skipped"` // SKIPPED
+	Stopped     uint         `json:"stopped"` // STOPPED or FORCE_KILLED
+	NotRun      uint         `json:"notRun"`  // still PENDING because the chain failed first
+	Seconds     float64      `json:"seconds"` // run time of the chain
+	SlowestJobs []JobRunTime `json:"slowestJobs"`
+}
+
+// JobRunTime is how long a job ran, from the start of its first try to the end
+// of its last try.
+type JobRunTime struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// JobChainProgress is POSTed to JobChain.ProgressURL when the state of the
+// chain or one of its jobs changes (Event). It has either the whole chain,
+// without jobData (JobChain), or, if the chain has ProgressPatch, a JSON Patch
+// (RFC 6902) that changes the chain in the previous progress into the current
+// one (Patch). Seq starts at 1 and increases by 1 with every progress, so the
+// receiver can tell if it missed one. Progress isn't retried: if one fails,
+// the next one has the whole chain.
+type JobChainProgress struct {
+	RequestId uint          `json:"requestId"`
+	Seq       uint          `json:"seq"`
+	Event     JobChainEvent `json:"event"`
+	JobChain  *JobChain     `json:"jobChain,omitempty"` // nil if Patch
+	Patch     []JSONPatchOp `json:"patch,omitempty"`    // empty if nothing but Event changed
+}
+
+// JSONPatchOp is one operation of a JSON Patch (RFC 6902).
+type JSONPatchOp struct {
+	Op    string      `json:"op"`    // "add", "remove", or "replace"
+	Path  string      `json:"path"`  // JSON Pointer (RFC 6901) to the value
+	Value interface{} `json:"value"` // new value, nil for "remove"
+}
+
+// JobReport is the outcome of one job in a JobChainReport. Jobs that didn't
+// run have zero Tries, StartTime, and EndTime.
+type JobReport struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Sequence  string    `json:"sequence"`  // Job.Sequence
+	State     byte      `json:"state"`     // final STATE_* const
+	Rollback  bool      `json:"rollback"`  // true if a rollback job
+	Tries     uint      `json:"tries"`     // number of times the job ran, including retries
+	TryIds    []string  `json:"tryIds"`    // unique ID of each try, in order
+	StartTime time.Time `json:"startTime"` // when the first try started
+	EndTime   time.Time `json:"endTime"`   // when the last try ended
+
+	TryHistory []JobTry `json:"tryHistory"` // every try of the job, in order
+}
+
+// JobTry is one try of a job. A job that's retried, or whose sequence is
+// retried, has one per try, so it's clear why the tries before the last one
+// failed.
+type JobTry struct {
+	Try       uint      `json:"try"`             // 1 for the first try
+	Id        string    `json:"id"`              // unique ID of the try, like in JobReport.TryIds
+	State     byte      `json:"state"`           // STATE_* const, STATE_RUNNING while it runs
+	StartTime time.Time `json:"startTime"`       // when it started
+	EndTime   time.Time `json:"endTime"`         // when it ended, zero while it runs
+	Error     string    `json:"error,omitempty"` // why it failed: the last line of its log, or the error running it
+	Log       string    `json:"log,omitempty"`   // path of its log under the API root (GET), while the chain runs
+}
+
+// Intervention is an action taken on a running job chain by an operator or
+// by the Job Runner, like stopping the chain.
+type Intervention struct {
+	Action    string    `json:"action"` // INTERVENTION_* const
+	Time      time.Time `json:"time"`
+	Requester string    `json:"requester,omitempty"` // who did it, if known (StopInfo.Requester)
+	Reason    string    `json:"reason,omitempty"`    // why, if known (StopInfo.Reason)
+}
+
+// Agent is a spincycle-agent that runs jobs for a Job Runner on its host.
+type Agent struct {
+	Name     string    `json:"name"`     // unique name, usually the hostname
+	Pool     string    `json:"pool"`     // pool of agents that run the same jobs (Job.Agent)
+	Version  string    `json:"version"`  // version of the agent
+	OS       string    `json:"os"`       // GOOS of the agent binary
+	Arch     string    `json:"arch"`     // GOARCH of the agent binary
+	LastSeen time.Time `json:"lastSeen"` // last time the agent called the Job Runner, set by the JR
+
+	// Compatible is true if the agent version is compatible with the Job
+	// Runner, set by the JR. Incompatible agents don't get work.
+	Compatible bool `json:"compatible"`
+}
+
+// AgentRegistration is the Job Runner's response when an agent registers:
+// the version handshake.
+type AgentRegistration struct {
+	Version    string        `json:"version"`           // version of the Job Runner
+	Compatible bool          `json:"compatible"`        // if false, the agent doesn't get work
+	Upgrade    *AgentUpgrade `json:"upgrade,omitempty"` // if set, the agent should upgrade
+
+	// Payload are the payload options (compression and encryption) that the
+	// Job Runner supports for the agent, like ["gzip", "aes-256-gcm"]. See
+	// package job-runner/payload.
+	Payload []string `json:"payload,omitempty"`
+}
+
+// AgentUpgrade is a signed spincycle-agent binary that an agent should upgrade
+// to. The agent verifies the signature before installing it.
+type AgentUpgrade struct {
+	Version   string `json:"version"`
+	Path      string `json:"path"`      // API path of the binary, relative to <API_ROOT>
+	Signature []byte `json:"signature"` // ed25519 signature of the binary
+}
+
+// AgentWork is one try of a job sent to an agent to run.
+type AgentWork struct {
+	Id        string                 `json:"id"` // unique ID of the try
+	RequestId uint                   `json:"requestId"`
+	Job       Job                    `json:"job"`
+	JobData   map[string]interface{} `json:"jobData"` // jobData given to the job
+}
+
+// AgentUpdate is sent by an agent for the work it's running, periodically
+// while the job runs and once when it's done.
+type AgentUpdate struct {
+	Status   string `json:"status"`   // status of the job
+	Progress int    `json:"progress"` // percent done, -1 if not reported
+	Log      string `json:"log"`      // log output of the job since the last update
+
+	// When the job is done, its final state and jobData.
+	Done    bool                   `json:"done"`
+	State   byte                   `json:"state"` // STATE_* const
+	JobData map[string]interface{} `json:"jobData"`
+}
+
+// AgentUpdateResponse is the Job Runner's response to an AgentUpdate.
+type AgentUpdateResponse struct {
+	Stop bool `json:"stop"` // stop the job
+}
+
+// JobRunnerHealth is the Job Runner's response to health and readiness
+// checks.
+type JobRunnerHealth struct {
+	Ready         bool      `json:"ready"`              // true if the Job Runner can take new chains
+	Problems      []string  `json:"problems,omitempty"` // why it's not ready
+	StartTime     time.Time `json:"startTime"`
+	Uptime        string    `json:"uptime"`        // time.Duration string
+	RunningChains uint      `json:"runningChains"` // chains running now
+	QueuedChains  uint      `json:"queuedChains"`  // chains waiting to run (see JobChain.Priority)
+
+	// MaxRunningChains is the max chains the Job Runner runs at once, 0 if
+	// there is no limit. A Job Runner running max chains is full: new
+	// chains wait in its queue.
+	MaxRunningChains uint `json:"maxRunningChains"`
+}
+
+// APIVersions are the API versions that a Job Runner serves.
+type APIVersions struct {
+	Versions []string `json:"versions"` // like ["v1", "v2"], oldest first
+	Default  string   `json:"default"`  // version of requests that don't ask for one
+	Current  string   `json:"current"`  // version that served this response
+}
+
+// CreateRequest is POSTed to the Request Manager to make a request: a request
+// type, which is a sequence in the request specs, and its args.
+type CreateRequest struct {
+	Type string            `json:"type"`           // request type, like "restart-host"
+	Args map[string]string `json:"args"`           // request arg => value
+	User string            `json:"user,omitempty"` // who made the request, for the record, if the caller isn't authenticated
+
+	// Priority orders requests waiting for a Job Runner with room to run
+	// them, higher first, and is the priority of the job chain on the Job
+	// Runner (JobChain.Priority). Default 0.
+	Priority int `json:"priority,omitempty"`
+
+	// Env is the environment of the job chain (JobChain.Env), like
+	// {"datacenter": "east", "dryRun": "true"}. The requestor is always the
+	// user.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// Request is a request made to the Request Manager. Its job chain has the same
+// RequestId, and it runs on the Job Runner at JobRunnerURL.
+type Request struct {
+	Id           uint              `json:"id"`
+	Type         string            `json:"type"`
+	Args         map[string]string `json:"args"`
+	User         string            `json:"user,omitempty"`   // operator the request is for
+	Caller       string            `json:"caller,omitempty"` // authenticated account that made it, empty if anonymous
+	State        byte              `json:"state"`            // STATE_* const, the state of the job chain once it's done
+	Priority     int               `json:"priority,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	StartedAt    time.Time         `json:"startedAt"`    // when the job chain was sent to the Job Runner, zero while queued
+	FinishedAt   time.Time         `json:"finishedAt"`   // zero until the job chain is done
+	TotalJobs    uint              `json:"totalJobs"`    // jobs in the job chain
+	JobRunnerURL string            `json:"jobRunnerURL"` // where the job chain was sent
+
+	// A request is queued (PENDING) while every Job Runner is full or not
+	// ready, or its user has their quota of requests running. QueuePosition
+	// starts at 1 for the next request to be sent, and is 0 if the request
+	// isn't queued. QueueETA is a rough estimate of when it's sent, zero if
+	// there isn't enough to go on.
+	QueuePosition uint      `json:"queuePosition,omitempty"`
+	QueueETA      time.Time `json:"queueETA"`
+}
+
+// RequestStatus is the live status of a request: the request merged with the
+// status of its job chain on the Job Runner that runs it. The Request Manager
+// caches the chain status briefly, so AsOf is when it was got from the Job
+// Runner. If it couldn't be got, Stale is true, Error is why, and ChainStatus
+// is the last one that was got, if any. ChainStatus is nil if the request
+// isn't running.
+type RequestStatus struct {
+	Request
+	Location    string          `json:"location,omitempty"` // URL of the job chain on the Job Runner that runs it
+	ChainStatus *JobChainStatus `json:"chainStatus,omitempty"`
+	AsOf        time.Time       `json:"asOf"`            // when ChainStatus was got, zero if never
+	Age         string          `json:"age,omitempty"`   // time since AsOf, like "1.5s"
+	Stale       bool            `json:"stale"`           // true if ChainStatus couldn't be got now
+	Error       string          `json:"error,omitempty"` // why ChainStatus couldn't be got
 }
 
 // JobStatuses are a list of job status sorted by job name.
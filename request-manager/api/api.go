@@ -0,0 +1,699 @@
+// Copyright 2017, Square, Inc.
+
+// Package api provides controllers for each Request Manager API endpoint.
+// Requests are expanded into job chains by the grapher and sent to the
+// least-loaded Job Runner, which runs them. Requests wait in a queue while
+// every Job Runner is full.
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/kv"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/request-manager/dispatch"
+	"github.com/square/spincycle/request-manager/grapher"
+	"github.com/square/spincycle/request-manager/queue"
+	"github.com/square/spincycle/request-manager/status"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	API_ROOT           = "/api/v1/"
+	REQUEST_ID_PATTERN = "([0-9]+)"
+
+	// CALLBACK_SIGNATURE_HEADER is the header of a callback with its
+	// signature, set by the Job Runner like job-runner/api.SignCallback.
+	CALLBACK_SIGNATURE_HEADER = "X-Spincycle-Signature"
+)
+
+// API provides controllers for endpoints it registers with a router.
+type API struct {
+	Router *router.Router
+	// URL is the base URL of this Request Manager, like http://rm:8888. If
+	// set, it's the callback URL of job chains, so requests are updated when
+	// their chain is done running. Optional.
+	URL string
+	// SpecsDir is the directory of the request specs. If set, the specs can
+	// be reloaded from it, after previewing what changes. Optional.
+	SpecsDir string
+	// CallbackSecret is the secret that Job Runners sign callbacks with
+	// (their -callback-secret). If set, a callback without its signature is
+	// rejected, so only Job Runners finish requests. Optional.
+	CallbackSecret []byte
+	// --
+	grapher     *grapher.Grapher
+	dispatcher  *dispatch.Dispatcher
+	requests    kv.Store           // request ID => proto.Request
+	queue       *queue.Queue       // requests waiting for a Job Runner
+	status      *status.Aggregator // where requests run, and their job chains' status
+	userQuota   uint               // max requests running at once per user, 0 = no limit
+	lastId      uint64             // last request ID, incremented atomically
+	runTime     time.Duration
+	setMux      *sync.Mutex // serializes updates to requests and runTime
+	dispatchMux *sync.Mutex // serializes sending queued requests
+}
+
+// NewAPI makes a new API that expands requests with the grapher and sends
+// their job chains to the Job Runner picked by the dispatcher. Request IDs
+// start at the current Unix time, so they don't repeat after a restart.
+func NewAPI(router *router.Router, g *grapher.Grapher, dispatcher *dispatch.Dispatcher) *API {
+	api := &API{
+		Router:      router,
+		grapher:     g,
+		dispatcher:  dispatcher,
+		requests:    kv.NewStore(),
+		queue:       queue.NewQueue(),
+		status:      status.NewAggregator(dispatcher.Client),
+		lastId:      uint64(time.Now().Unix()),
+		setMux:      &sync.Mutex{},
+		dispatchMux: &sync.Mutex{},
+	}
+
+	api.Router.AddRoute(API_ROOT+"requests", api.requestsHandler, "api-requests")
+	api.Router.AddRoute(API_ROOT+"requests/status", api.requestStatusesHandler, "api-request-statuses")
+	api.Router.AddRoute(API_ROOT+"requests/"+REQUEST_ID_PATTERN, api.requestHandler, "api-request")
+	api.Router.AddRoute(API_ROOT+"requests/"+REQUEST_ID_PATTERN+"/status", api.requestStatusHandler, "api-request-status")
+	api.Router.AddRoute(API_ROOT+"requests/"+REQUEST_ID_PATTERN+"/stop", api.stopRequestHandler, "api-stop-request")
+	api.Router.AddRoute(API_ROOT+"requests/"+REQUEST_ID_PATTERN+"/callback", api.callbackHandler, "api-request-callback")
+	api.Router.AddRoute(API_ROOT+"request-types", api.requestTypesHandler, "api-request-types")
+	api.Router.AddRoute(API_ROOT+"specs", api.specsHandler, "api-specs")
+	api.Router.AddRoute(API_ROOT+"specs/diff", api.specsDiffHandler, "api-specs-diff")
+	api.Router.AddRoute(API_ROOT+"job-runners", api.jobRunnersHandler, "api-job-runners")
+
+	return api
+}
+
+// ============================== CONTROLLERS ============================== //
+
+// GET <API_ROOT>/requests
+// List every request, sorted by ID.
+//
+// POST <API_ROOT>/requests
+// Make a request (proto.CreateRequest): expand it into a job chain, send the
+// chain to the least-loaded Job Runner, and start it. Return the request
+// (proto.Request). If every Job Runner is full or not ready, or the user has
+// their quota of requests running, the request is queued and sent later:
+// return it PENDING with its queue position and 202 Accepted.
+func (api *API) requestsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requests := []proto.Request{}
+		for _, r := range api.requests.GetAll() {
+			requests = append(requests, api.withQueue(r.(proto.Request)))
+		}
+		sort.Slice(requests, func(i, j int) bool { return requests[i].Id < requests[j].Id })
+
+		if out, err := marshal(requests); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	case "POST":
+		var cr proto.CreateRequest
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&cr); err != nil {
+			ctx.APIError(router.ErrBadRequest, "Invalid request (error: %s)", err)
+			return
+		}
+		if cr.Type == "" {
+			ctx.APIError(router.ErrMissingParam, "Request has no type.")
+			return
+		}
+
+		// An authenticated caller makes requests for itself, or for the
+		// operator it acts on behalf of. Only anonymous callers say who
+		// they are.
+		user := cr.User
+		if !ctx.Caller.Anonymous() {
+			user = ctx.Caller.User()
+		}
+
+		id := uint(atomic.AddUint64(&api.lastId, 1))
+		jc, err := api.grapher.CreateChain(id, cr.Type, cr.Args)
+		if err != nil {
+			ctx.APIErrorCode(router.ErrBadRequest, proto.ERR_INVALID_REQUEST, "Can't make job chain (error: %s)", err)
+			return
+		}
+		jc.Metadata = map[string]string{}
+		if user != "" {
+			jc.Metadata[proto.META_USER] = user
+		}
+		if ctx.Caller.Name != "" {
+			jc.Metadata[proto.META_CALLER] = ctx.Caller.Name
+		}
+		jc.Env = map[string]string{}
+		for k, v := range cr.Env {
+			jc.Env[k] = v
+		}
+		if user != "" {
+			jc.Env[proto.ENV_REQUESTOR] = user
+		}
+		if api.URL != "" {
+			jc.CallbackURL = fmt.Sprintf("%s%srequests/%d/callback", api.URL, API_ROOT, id)
+		}
+		jc.Priority = cr.Priority
+
+		// Every request goes through the queue, so it doesn't go ahead of
+		// requests already waiting, then it's sent now if it's next and a
+		// Job Runner has room
+		req := proto.Request{
+			Id:        id,
+			Type:      cr.Type,
+			Args:      cr.Args,
+			User:      user,
+			Caller:    ctx.Caller.Name,
+			State:     proto.STATE_PENDING,
+			Priority:  cr.Priority,
+			CreatedAt: time.Now(),
+			TotalJobs: uint(len(jc.Jobs)),
+		}
+		api.requests.Set(requestKey(id), req)
+		if err := api.queue.Push(queue.Item{Request: req, Chain: jc}); err != nil {
+			api.failRequest(req, err)
+			ctx.APIError(router.ErrInternal, "Can't queue request (error: %s)", err)
+			return
+		}
+		log.Infof("[request=%d]: Made %s request with %d jobs for %s.", id, req.Type, req.TotalJobs, who(ctx.Caller, user))
+
+		if err := api.dispatchQueued()[id]; err != nil {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_JOB_RUNNER, "Can't run job chain on the Job Runner (error: %s)", err)
+			return
+		}
+		req, err = api.getRequest(id)
+		if err != nil {
+			ctx.APIError(router.ErrInternal, "Request was removed (error: %s)", err)
+			return
+		}
+		req = api.withQueue(req)
+
+		if out, err := marshal(req); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			if req.QueuePosition > 0 {
+				ctx.Response.WriteHeader(http.StatusAccepted)
+			}
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/requests/{requestId}
+// Get a request, with its queue position if it's queued.
+func (api *API) requestHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		req, err := api.getRequest(requestId(ctx.Arguments[1]))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_REQUEST_NOT_FOUND, "Request not found (error: %s).", err)
+			return
+		}
+		req = api.withQueue(req)
+
+		if out, err := marshal(req); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/requests/{requestId}/status
+// Get the live status of a request (proto.RequestStatus): the request and, if
+// it's running, the status of its job chain on the Job Runner that runs it.
+func (api *API) requestStatusHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		req, err := api.getRequest(requestId(ctx.Arguments[1]))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_REQUEST_NOT_FOUND, "Request not found (error: %s).", err)
+			return
+		}
+
+		if out, err := marshal(api.status.Status(ctx.Request.Context(), api.withQueue(req))); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/requests/status[?ids=1,2,3]
+// Get the live status of many requests in one call, sorted by ID: a list of
+// proto.RequestStatus. The status of their job chains is got from every Job
+// Runner that runs them at once. Without ids, it's every running request.
+// Unknown request IDs are left out.
+func (api *API) requestStatusesHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		requests := []proto.Request{}
+		if ids := ctx.Request.URL.Query().Get("ids"); ids != "" {
+			for _, s := range strings.Split(ids, ",") {
+				id, err := strconv.ParseUint(s, 10, 64)
+				if err != nil {
+					ctx.APIError(router.ErrInvalidParam, "Invalid request ID: %s", s)
+					return
+				}
+				if req, err := api.getRequest(uint(id)); err == nil {
+					requests = append(requests, api.withQueue(req))
+				}
+			}
+		} else {
+			for _, r := range api.requests.GetAll() {
+				if req := r.(proto.Request); req.State == proto.STATE_RUNNING {
+					requests = append(requests, req)
+				}
+			}
+		}
+		sort.Slice(requests, func(i, j int) bool { return requests[i].Id < requests[j].Id })
+
+		if out, err := marshal(api.status.Statuses(ctx.Request.Context(), requests)); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// PUT <API_ROOT>/requests/{requestId}/stop
+// Stop the job chain of a request on the Job Runner. The request is updated
+// by the chain's callback. A queued request is removed from the queue and
+// STOPPED now.
+func (api *API) stopRequestHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "PUT":
+		req, err := api.getRequest(requestId(ctx.Arguments[1]))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_REQUEST_NOT_FOUND, "Request not found (error: %s).", err)
+			return
+		}
+		if api.queue.Remove(req.Id) {
+			req.State = proto.STATE_STOPPED
+			req.FinishedAt = time.Now()
+			api.setRequest(req)
+			log.Infof("[request=%d]: Stopped queued request by %s.", req.Id, who(ctx.Caller, ctx.Caller.User()))
+			return
+		}
+		if req.State != proto.STATE_RUNNING {
+			ctx.APIErrorCode(router.ErrConflict, proto.ERR_REQUEST_NOT_RUNNING, "Request is %s, not running.", proto.StateName[req.State])
+			return
+		}
+		if err := api.dispatcher.Client(req.JobRunnerURL).StopRequest(ctx.Request.Context(), req.Id); err != nil {
+			if e, ok := err.(proto.Error); ok && e.Code == proto.ERR_CHAIN_NOT_FOUND {
+				// The chain is done, but its callback hasn't updated
+				// the request yet.
+				ctx.APIErrorCode(router.ErrConflict, proto.ERR_REQUEST_NOT_RUNNING, "Request's job chain is no longer running on the Job Runner.")
+				return
+			}
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_JOB_RUNNER, "Can't stop job chain on the Job Runner (error: %s)", err)
+			return
+		}
+		log.Infof("[request=%d]: Stopped request by %s.", req.Id, who(ctx.Caller, ctx.Caller.User()))
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// POST <API_ROOT>/requests/{requestId}/callback
+// Update a request when its job chain is done running. The Job Runner posts
+// the chain's proto.JobChainCallback to its callback URL (see URL). If
+// CallbackSecret is set, the callback must be signed with it.
+func (api *API) callbackHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "POST":
+		req, err := api.getRequest(requestId(ctx.Arguments[1]))
+		if err != nil {
+			ctx.APIErrorCode(router.ErrNotFound, proto.ERR_REQUEST_NOT_FOUND, "Request not found (error: %s).", err)
+			return
+		}
+		body, err := ioutil.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.APIError(router.ErrBadRequest, "Can't read callback (error: %s)", err)
+			return
+		}
+		if len(api.CallbackSecret) > 0 && !validSignature(api.CallbackSecret, body, ctx.Request.Header.Get(CALLBACK_SIGNATURE_HEADER)) {
+			log.Warnf("[request=%d]: Rejected callback from %s with an invalid signature.", req.Id, ctx.Request.RemoteAddr)
+			ctx.APIError(router.ErrUnauthorized, "Invalid callback signature.")
+			return
+		}
+		var cb proto.JobChainCallback
+		if err := json.Unmarshal(body, &cb); err != nil {
+			ctx.APIError(router.ErrBadRequest, "Invalid callback (error: %s)", err)
+			return
+		}
+		if cb.RequestId != req.Id {
+			ctx.APIError(router.ErrBadRequest, "Callback is for request %d, not %d.", cb.RequestId, req.Id)
+			return
+		}
+		req.State = cb.State
+		req.FinishedAt = time.Now()
+		api.setRequest(req)
+		api.status.Untrack(req.Id)
+		api.recordRunTime(req)
+		log.Infof("[request=%d]: Request is done: %s.", req.Id, proto.StateName[req.State])
+
+		// It freed a slot on its Job Runner, and one of its user's quota
+		go api.dispatchQueued()
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/request-types
+// List the request types in the request specs, sorted.
+func (api *API) requestTypesHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		if out, err := marshal(api.grapher.Specs().RequestTypes()); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// PUT <API_ROOT>/specs
+// Reload the request specs from SpecsDir and use them for requests made from
+// now on. Return what changed (grapher.SpecsDiff). If the specs aren't valid,
+// the active specs are kept.
+func (api *API) specsHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "PUT":
+		diff, specs, ok := api.readSpecs(ctx)
+		if !ok {
+			return
+		}
+		api.grapher.SetSpecs(specs)
+		log.Infof("Reloaded request specs by %s: %d request types added, %d removed, %d changed.",
+			who(ctx.Caller, ctx.Caller.User()), len(diff.Added), len(diff.Removed), len(diff.Changed))
+
+		if out, err := marshal(diff); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/specs/diff
+// Preview reloading the request specs: read them from SpecsDir and return
+// what would change (grapher.SpecsDiff) without using them.
+func (api *API) specsDiffHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		diff, _, ok := api.readSpecs(ctx)
+		if !ok {
+			return
+		}
+
+		if out, err := marshal(diff); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// GET <API_ROOT>/job-runners
+// List the Job Runners that job chains are sent to, with their health and
+// load (dispatch.JobRunner), sorted by URL.
+func (api *API) jobRunnersHandler(ctx router.HTTPContext) {
+	switch ctx.Request.Method {
+	case "GET":
+		jrs, err := api.dispatcher.JobRunners()
+		if err != nil {
+			ctx.APIErrorCode(router.ErrUnavailable, proto.ERR_NO_JOB_RUNNER, "%s", err)
+			return
+		}
+
+		if out, err := marshal(jrs); err != nil {
+			ctx.APIError(router.ErrInternal, "Can't encode response (error: %s)", err)
+		} else {
+			fmt.Fprintln(ctx.Response, string(out))
+		}
+	default:
+		ctx.UnsupportedAPIMethod()
+	}
+}
+
+// ========================================================================= //
+
+// RestoreQueue loads the requests saved in dir by an earlier Request Manager,
+// queues them again, and saves requests queued from now on in dir. Call it
+// before serving the API. It returns the number of requests restored.
+func (api *API) RestoreQueue(dir string) (int, error) {
+	api.queue.Dir = dir
+	items, err := api.queue.Load()
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		api.requests.Set(requestKey(item.Request.Id), item.Request)
+		if err := api.queue.Push(item); err != nil {
+			return 0, err
+		}
+		log.Infof("[request=%d]: Restored queued request.", item.Request.Id)
+	}
+	return len(items), nil
+}
+
+// SetUserQuota limits how many requests of a user run at once. Requests of a
+// user who has max requests running wait in the queue; requests of other users
+// can go ahead of them. Zero means no limit (default).
+func (api *API) SetUserQuota(max uint) {
+	api.dispatchMux.Lock()
+	defer api.dispatchMux.Unlock()
+	api.userQuota = max
+}
+
+// SetStatusTTL sets how long the status of a request's job chain is cached
+// before it's got from the Job Runner again. Zero means it's not cached.
+func (api *API) SetStatusTTL(ttl time.Duration) {
+	api.status.SetTTL(ttl)
+}
+
+// RunQueue sends queued requests every interval, as Job Runners free up and
+// come and go. Requests are also sent when a request is made or is done. It
+// never returns, so call it in a goroutine.
+func (api *API) RunQueue(interval time.Duration) {
+	for range time.Tick(interval) {
+		api.dispatchQueued()
+	}
+}
+
+// dispatchQueued sends queued requests to the Job Runners picked by the
+// dispatcher, in queue order, until every Job Runner is full or not ready. A
+// request of a user at their quota stays queued. It returns the errors of
+// requests that couldn't be sent or started, which failed.
+func (api *API) dispatchQueued() map[uint]error {
+	api.dispatchMux.Lock()
+	defer api.dispatchMux.Unlock()
+	errs := map[uint]error{}
+	items := api.queue.Items()
+	if len(items) == 0 {
+		return errs
+	}
+	running := api.runningByUser()
+	for _, item := range items {
+		if api.userQuota > 0 && running[item.Request.User] >= api.userQuota {
+			continue
+		}
+		jrURL, jrClient, err := api.dispatcher.Pick()
+		if err != nil {
+			log.Debugf("%d requests queued: %s", api.queue.Len(), err)
+			break
+		}
+		if !api.queue.Remove(item.Request.Id) {
+			continue // stopped in the meantime
+		}
+
+		req := item.Request
+		req.JobRunnerURL = jrURL
+		req.StartedAt = time.Now()
+		api.setRequest(req)
+		if err := jrClient.NewJobChain(context.Background(), item.Chain); err != nil {
+			api.failRequest(req, err)
+			errs[req.Id] = fmt.Errorf("can't send job chain to %s: %s", jrURL, err)
+			continue
+		}
+		location, err := jrClient.StartRequestLocation(context.Background(), req.Id)
+		if err != nil {
+			api.failRequest(req, err)
+			errs[req.Id] = fmt.Errorf("can't start job chain on %s: %s", jrURL, err)
+			continue
+		}
+		req.State = proto.STATE_RUNNING
+		api.status.Track(req.Id, jrURL, location)
+		api.setRequest(req)
+		if cur, err := api.getRequest(req.Id); err == nil && !cur.FinishedAt.IsZero() {
+			api.status.Untrack(req.Id) // called back already
+		}
+		running[req.User]++
+		log.Infof("[request=%d]: Started request on %s after %s.", req.Id, jrURL, req.StartedAt.Sub(req.CreatedAt).Round(time.Millisecond))
+	}
+	return errs
+}
+
+// runningByUser returns the number of requests running per user.
+func (api *API) runningByUser() map[string]uint {
+	running := map[string]uint{}
+	for _, v := range api.requests.GetAll() {
+		if req := v.(proto.Request); req.State == proto.STATE_RUNNING {
+			running[req.User]++
+		}
+	}
+	return running
+}
+
+// withQueue returns the request with its queue position and ETA, if it's
+// queued.
+func (api *API) withQueue(req proto.Request) proto.Request {
+	pos := api.queue.Position(req.Id)
+	if pos == 0 {
+		return req
+	}
+	req.QueuePosition = pos
+	req.QueueETA = api.eta(pos)
+	return req
+}
+
+// eta roughly estimates when the queued request at pos is sent: every slot of
+// the Job Runners frees up once per average run time of requests. It returns
+// zero if no request is done yet or the slots are unknown.
+func (api *API) eta(pos uint) time.Time {
+	api.setMux.Lock()
+	runTime := api.runTime
+	api.setMux.Unlock()
+	slots := api.dispatcher.Slots()
+	if runTime == 0 || slots == 0 {
+		return time.Time{}
+	}
+	rounds := (pos + slots - 1) / slots
+	return time.Now().Add(time.Duration(rounds) * runTime).Round(time.Second)
+}
+
+// recordRunTime adds the run time of a request that's done to the moving
+// average of run times, for eta.
+func (api *API) recordRunTime(req proto.Request) {
+	if req.StartedAt.IsZero() {
+		return
+	}
+	d := req.FinishedAt.Sub(req.StartedAt)
+	api.setMux.Lock()
+	defer api.setMux.Unlock()
+	if api.runTime == 0 {
+		api.runTime = d
+	} else {
+		api.runTime = (4*api.runTime + d) / 5
+	}
+}
+
+// readSpecs reads the request specs in SpecsDir and returns what changes from
+// the active specs. If they can't be read, it writes the API error and returns
+// false.
+func (api *API) readSpecs(ctx router.HTTPContext) (grapher.SpecsDiff, *grapher.Specs, bool) {
+	if api.SpecsDir == "" {
+		ctx.APIError(router.ErrConflict, "The request specs can't be reloaded: no specs directory.")
+		return grapher.SpecsDiff{}, nil, false
+	}
+	specs, err := grapher.ReadSpecs(api.SpecsDir)
+	if err != nil {
+		ctx.APIErrorCode(router.ErrConflict, proto.ERR_INVALID_SPECS, "Can't read request specs (error: %s)", err)
+		return grapher.SpecsDiff{}, nil, false
+	}
+	return grapher.DiffSpecs(api.grapher.Specs(), specs), specs, true
+}
+
+// getRequest returns the request with the ID.
+func (api *API) getRequest(id uint) (proto.Request, error) {
+	v, err := api.requests.Get(requestKey(id))
+	if err != nil {
+		return proto.Request{}, err
+	}
+	return v.(proto.Request), nil
+}
+
+// setRequest updates a request, unless it was finished in the meantime by its
+// callback.
+func (api *API) setRequest(req proto.Request) {
+	api.setMux.Lock()
+	defer api.setMux.Unlock()
+	if cur, err := api.getRequest(req.Id); err == nil && !cur.FinishedAt.IsZero() {
+		return
+	}
+	api.requests.Set(requestKey(req.Id), req)
+}
+
+// failRequest records that the job chain of a request couldn't be sent to or
+// started on the Job Runner.
+func (api *API) failRequest(req proto.Request, err error) {
+	log.Errorf("[request=%d]: Can't run request on %s: %s", req.Id, req.JobRunnerURL, err)
+	req.State = proto.STATE_FAIL
+	req.FinishedAt = time.Now()
+	api.requests.Set(requestKey(req.Id), req)
+}
+
+// requestKey returns the key of a request in the requests store.
+func requestKey(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// requestId converts a request ID from the URL to a uint.
+func requestId(requestIdStr string) uint {
+	id, _ := strconv.ParseUint(requestIdStr, 10, 64)
+	return uint(id)
+}
+
+// validSignature returns true if signature is the signature of a callback body
+// with secret: "sha256=" and the hex HMAC-SHA256 of the body.
+func validSignature(secret, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	expect := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expect))
+}
+
+// marshal is a helper function to nicely print JSON.
+func marshal(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// who describes who made a call for the user, like "finch (via chatops)" when
+// an automation account acts on behalf of an operator, for logs.
+func who(caller router.Caller, user string) string {
+	switch {
+	case user == "":
+		return "anonymous"
+	case caller.Name != "" && caller.Name != user:
+		return user + " (via " + caller.Name + ")"
+	}
+	return user
+}
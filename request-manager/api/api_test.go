@@ -0,0 +1,525 @@
+// Copyright 2017, Square, Inc.
+
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/request-manager/dispatch"
+	"github.com/square/spincycle/request-manager/grapher"
+	"github.com/square/spincycle/test/mock"
+)
+
+const specs = `
+sequences:
+  restart-host:
+    request: true
+    args:
+      required:
+        - name: host
+    nodes:
+      drain:
+        type: drain-host
+      reboot:
+        type: reboot-host
+        deps: [drain]
+`
+
+func newGrapher(t *testing.T) *grapher.Grapher {
+	dir, err := ioutil.TempDir("", "rm-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "restart.yaml"), []byte(specs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := grapher.ReadSpecs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return grapher.NewGrapher(s, &mock.JobFactory{JobToReturn: &mock.Job{}})
+}
+
+// newDispatcher returns a Dispatcher for one Job Runner, http://jr1, whose
+// client is jrc.
+func newDispatcher(jrc *mock.JRClient) *dispatch.Dispatcher {
+	jrc.HealthResp = proto.JobRunnerHealth{Ready: true}
+	return dispatch.NewDispatcher(dispatch.NewStatic([]string{"http://jr1"}), func(string) client.JRClient { return jrc })
+}
+
+func post(t *testing.T, url string, v interface{}) (int, []byte) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestCreateRequest(t *testing.T) {
+	jrc := mock.NewJRClient()
+	api := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(jrc))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	api.URL = h.URL
+
+	code, body := post(t, h.URL+API_ROOT+"requests", proto.CreateRequest{
+		Type: "restart-host",
+		Args: map[string]string{"host": "h1"},
+		User: "finch",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200: %s", code, body)
+	}
+	var req proto.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Type != "restart-host" || req.User != "finch" || req.State != proto.STATE_RUNNING ||
+		req.TotalJobs != 2 || req.JobRunnerURL != "http://jr1" {
+		t.Errorf("request = %+v, expected running restart-host with 2 jobs", req)
+	}
+
+	chains := jrc.Chains()
+	if len(chains) != 1 {
+		t.Fatalf("sent %d job chains, expected 1", len(chains))
+	}
+	jc := chains[0]
+	expectCallback := fmt.Sprintf("%s%srequests/%d/callback", h.URL, API_ROOT, req.Id)
+	if jc.RequestId != req.Id || jc.CallbackURL != expectCallback {
+		t.Errorf("job chain request ID = %d, callback URL = %s, expected %d, %s", jc.RequestId, jc.CallbackURL, req.Id, expectCallback)
+	}
+	if started := jrc.Started(); len(started) != 1 || started[0] != req.Id {
+		t.Errorf("started = %v, expected [%d]", started, req.Id)
+	}
+
+	// Stop it, then the Job Runner calls back
+	stopReq, _ := http.NewRequest("PUT", fmt.Sprintf("%s%srequests/%d/stop", h.URL, API_ROOT, req.Id), nil)
+	resp, err := http.DefaultClient.Do(stopReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("stop response status = %d, expected 200", resp.StatusCode)
+	}
+	if stopped := jrc.Stopped(); len(stopped) != 1 || stopped[0] != req.Id {
+		t.Errorf("stopped = %v, expected [%d]", stopped, req.Id)
+	}
+
+	code, body = post(t, expectCallback, proto.JobChainCallback{RequestId: req.Id, State: proto.STATE_INCOMPLETE})
+	if code != http.StatusOK {
+		t.Fatalf("callback response status = %d, expected 200: %s", code, body)
+	}
+	got, err := api.getRequest(req.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != proto.STATE_INCOMPLETE || got.FinishedAt.IsZero() {
+		t.Errorf("request after callback = %+v, expected INCOMPLETE and finished", got)
+	}
+}
+
+func TestCallbackSignature(t *testing.T) {
+	jrc := mock.NewJRClient()
+	api := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(jrc))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	api.URL = h.URL
+	api.CallbackSecret = []byte("secret")
+
+	code, body := post(t, h.URL+API_ROOT+"requests", proto.CreateRequest{Type: "restart-host", Args: map[string]string{"host": "h1"}})
+	if code != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200: %s", code, body)
+	}
+	var req proto.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+
+	callback := func(signature string) int {
+		payload, _ := json.Marshal(proto.JobChainCallback{RequestId: req.Id, State: proto.STATE_COMPLETE})
+		httpReq, _ := http.NewRequest("POST", fmt.Sprintf("%s%srequests/%d/callback", h.URL, API_ROOT, req.Id), bytes.NewBuffer(payload))
+		if signature == "sign" {
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write(payload)
+			signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+		if signature != "" {
+			httpReq.Header.Set(CALLBACK_SIGNATURE_HEADER, signature)
+		}
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Forged callbacks don't finish the request
+	for _, signature := range []string{"", "sha256=0123456789abcdef"} {
+		if code := callback(signature); code != http.StatusUnauthorized {
+			t.Errorf("response status = %d, expected 401 for signature %q", code, signature)
+		}
+	}
+	if got, _ := api.getRequest(req.Id); got.State != proto.STATE_RUNNING || !got.FinishedAt.IsZero() {
+		t.Errorf("request = %+v, expected still running", got)
+	}
+
+	if code := callback("sign"); code != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", code)
+	}
+	if got, _ := api.getRequest(req.Id); got.State != proto.STATE_COMPLETE {
+		t.Errorf("request state = %d, expected COMPLETE", got.State)
+	}
+}
+
+func TestCreateRequestOnBehalfOf(t *testing.T) {
+	jrc := mock.NewJRClient()
+	rt := &router.Router{
+		Authenticator: router.TokenAuthenticator{"t1": {Name: "chatops", Roles: []string{"automation"}}},
+		Impersonator:  router.RoleImpersonator{"automation"},
+	}
+	api := NewAPI(rt, newGrapher(t), newDispatcher(jrc))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// The operator in the header is the user, not the one in the body
+	payload, _ := json.Marshal(proto.CreateRequest{
+		Type: "restart-host",
+		Args: map[string]string{"host": "h1"},
+		User: "someone",
+		Env:  map[string]string{proto.ENV_DATACENTER: "east", proto.ENV_REQUESTOR: "someone"},
+	})
+	httpReq, _ := http.NewRequest("POST", h.URL+API_ROOT+"requests", bytes.NewBuffer(payload))
+	httpReq.Header.Set("Authorization", "Bearer t1")
+	httpReq.Header.Set(router.ON_BEHALF_OF_HEADER, "finch")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200", resp.StatusCode)
+	}
+	var req proto.Request
+	if err := json.NewDecoder(resp.Body).Decode(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.User != "finch" || req.Caller != "chatops" {
+		t.Errorf("request user = %q, caller = %q, expected finch, chatops", req.User, req.Caller)
+	}
+
+	// Both are in the chain's metadata, so they're in its callback
+	chains := jrc.Chains()
+	if len(chains) != 1 {
+		t.Fatalf("sent %d job chains, expected 1", len(chains))
+	}
+	expect := map[string]string{proto.META_USER: "finch", proto.META_CALLER: "chatops"}
+	if !reflect.DeepEqual(chains[0].Metadata, expect) {
+		t.Errorf("metadata = %v, expected %v", chains[0].Metadata, expect)
+	}
+
+	// The operator is the requestor in the chain's env, too
+	expect = map[string]string{proto.ENV_DATACENTER: "east", proto.ENV_REQUESTOR: "finch"}
+	if !reflect.DeepEqual(chains[0].Env, expect) {
+		t.Errorf("env = %v, expected %v", chains[0].Env, expect)
+	}
+}
+
+func TestCreateRequestErrors(t *testing.T) {
+	jrc := mock.NewJRClient()
+	api := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(jrc))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	// Unknown request type and missing arg
+	for _, cr := range []proto.CreateRequest{
+		{Type: "reboot-everything"},
+		{Type: "restart-host"},
+	} {
+		if code, _ := post(t, h.URL+API_ROOT+"requests", cr); code != http.StatusBadRequest {
+			t.Errorf("%+v: response status = %d, expected 400", cr, code)
+		}
+	}
+
+	// The Job Runner doesn't take the chain, so the request failed
+	jrc.NewJobChainErr = mock.ErrJRClient
+	code, _ := post(t, h.URL+API_ROOT+"requests", proto.CreateRequest{Type: "restart-host", Args: map[string]string{"host": "h1"}})
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("response status = %d, expected 503", code)
+	}
+	all := api.requests.GetAll()
+	if len(all) != 1 {
+		t.Fatalf("%d requests, expected 1", len(all))
+	}
+	for _, v := range all {
+		if req := v.(proto.Request); req.State != proto.STATE_FAIL {
+			t.Errorf("request state = %s, expected FAIL", proto.StateName[req.State])
+		}
+	}
+}
+
+func TestCreateRequestQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rm-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jrc := mock.NewJRClient()
+	d := newDispatcher(jrc)
+	api := NewAPI(&router.Router{}, newGrapher(t), d)
+	if n, err := api.RestoreQueue(dir); err != nil || n != 0 {
+		t.Fatalf("restored %d requests (error: %v), expected 0", n, err)
+	}
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	api.URL = h.URL
+
+	create := func(cr proto.CreateRequest) (int, proto.Request) {
+		cr.Type = "restart-host"
+		cr.Args = map[string]string{"host": "h1"}
+		code, body := post(t, h.URL+API_ROOT+"requests", cr)
+		var req proto.Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("%s: %s", err, body)
+		}
+		return code, req
+	}
+
+	// The Job Runner is full, so requests are queued, higher priority first
+	jrc.HealthResp.MaxRunningChains = 1
+	jrc.HealthResp.RunningChains = 1
+	code, r1 := create(proto.CreateRequest{})
+	if code != http.StatusAccepted || r1.State != proto.STATE_PENDING || r1.QueuePosition != 1 {
+		t.Errorf("response status = %d, request = %+v, expected 202, PENDING, position 1", code, r1)
+	}
+	code, r2 := create(proto.CreateRequest{Priority: 5})
+	if code != http.StatusAccepted || r2.QueuePosition != 1 {
+		t.Errorf("response status = %d, request = %+v, expected 202, position 1", code, r2)
+	}
+	if len(jrc.Chains()) != 0 {
+		t.Errorf("sent %d job chains, expected 0", len(jrc.Chains()))
+	}
+
+	// Requests take their run time per slot of the Job Runners to go
+	api.setMux.Lock()
+	api.runTime = time.Minute
+	api.setMux.Unlock()
+	resp, err := http.Get(fmt.Sprintf("%s%srequests/%d", h.URL, API_ROOT, r1.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got proto.Request
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eta := time.Until(got.QueueETA); got.QueuePosition != 2 || eta < 119*time.Second || eta > 121*time.Second {
+		t.Errorf("request = %+v, expected position 2 and ETA in 2m", got)
+	}
+
+	// Another Request Manager restores the queue
+	api2 := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(mock.NewJRClient()))
+	if n, err := api2.RestoreQueue(dir); err != nil || n != 2 {
+		t.Errorf("restored %d requests (error: %v), expected 2", n, err)
+	}
+	if pos := api2.queue.Position(r1.Id); pos != 2 {
+		t.Errorf("restored position of r1 = %d, expected 2", pos)
+	}
+
+	// A queued request is stopped without going to the Job Runner
+	stopReq, _ := http.NewRequest("PUT", fmt.Sprintf("%s%srequests/%d/stop", h.URL, API_ROOT, r1.Id), nil)
+	resp, err = http.DefaultClient.Do(stopReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, _ := api.getRequest(r1.Id); resp.StatusCode != http.StatusOK || got.State != proto.STATE_STOPPED {
+		t.Errorf("stop response status = %d, request = %+v, expected 200, STOPPED", resp.StatusCode, got)
+	}
+
+	// The Job Runner frees up, so r2 is sent
+	jrc.HealthResp.RunningChains = 0
+	api.dispatchQueued()
+	if got, _ := api.getRequest(r2.Id); got.State != proto.STATE_RUNNING || got.StartedAt.IsZero() || api.queue.Len() != 0 {
+		t.Errorf("request = %+v, expected r2 RUNNING and an empty queue", got)
+	}
+	if chains := jrc.Chains(); len(chains) != 1 || chains[0].RequestId != r2.Id || chains[0].Priority != 5 {
+		t.Errorf("sent %+v, expected r2 with priority 5", chains)
+	}
+
+	// With a quota of 1, finch's second request waits for the first, but
+	// robin's doesn't
+	jrc.HealthResp.MaxRunningChains = 0
+	api.SetUserQuota(1)
+	if code, _ := create(proto.CreateRequest{User: "finch"}); code != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", code)
+	}
+	if code, _ := create(proto.CreateRequest{User: "finch"}); code != http.StatusAccepted {
+		t.Errorf("response status = %d, expected 202", code)
+	}
+	if code, _ := create(proto.CreateRequest{User: "robin"}); code != http.StatusOK {
+		t.Errorf("response status = %d, expected 200", code)
+	}
+	if n := api.queue.Len(); n != 1 {
+		t.Errorf("%d requests queued, expected 1", n)
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	jrc := mock.NewJRClient()
+	jrc.Location = "jr9/api/v1/job-chains/1" // the JR that runs the chain
+	api := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(jrc))
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+	api.URL = h.URL
+
+	code, body := post(t, h.URL+API_ROOT+"requests", proto.CreateRequest{Type: "restart-host", Args: map[string]string{"host": "h1"}})
+	if code != http.StatusOK {
+		t.Fatalf("response status = %d, expected 200: %s", code, body)
+	}
+	var req proto.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	jrc.StatusesResp = proto.JobChainStatuses{
+		Statuses: []proto.JobChainStatus{{RequestId: req.Id, JobStatuses: proto.JobStatuses{{Name: "drain", State: proto.STATE_RUNNING}}}},
+	}
+
+	get := func(url string, v interface{}) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("response status = %d, expected 200", resp.StatusCode)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var status proto.RequestStatus
+	get(fmt.Sprintf("%s%srequests/%d/status", h.URL, API_ROOT, req.Id), &status)
+	expectLocation := fmt.Sprintf("http://jr9/api/v1/job-chains/%d", req.Id)
+	if status.Id != req.Id || status.State != proto.STATE_RUNNING || status.Location != expectLocation ||
+		status.ChainStatus == nil || len(status.ChainStatus.JobStatuses) != 1 || status.Stale || status.AsOf.IsZero() {
+		t.Errorf("status = %+v, expected drain running at %s", status, expectLocation)
+	}
+
+	// Every running request, or the ones asked for
+	var statuses []proto.RequestStatus
+	get(h.URL+API_ROOT+"requests/status", &statuses)
+	if len(statuses) != 1 || statuses[0].Id != req.Id || statuses[0].ChainStatus == nil {
+		t.Errorf("statuses = %+v, expected request %d", statuses, req.Id)
+	}
+	statuses = nil
+	get(fmt.Sprintf("%s%srequests/status?ids=%d,1", h.URL, API_ROOT, req.Id), &statuses)
+	if len(statuses) != 1 || statuses[0].Id != req.Id {
+		t.Errorf("statuses = %+v, expected request %d, and unknown request 1 left out", statuses, req.Id)
+	}
+
+	// Once it's done, its chain isn't tracked
+	code, body = post(t, fmt.Sprintf("%s%srequests/%d/callback", h.URL, API_ROOT, req.Id), proto.JobChainCallback{RequestId: req.Id, State: proto.STATE_COMPLETE})
+	if code != http.StatusOK {
+		t.Fatalf("callback response status = %d, expected 200: %s", code, body)
+	}
+	status = proto.RequestStatus{}
+	get(fmt.Sprintf("%s%srequests/%d/status", h.URL, API_ROOT, req.Id), &status)
+	if status.State != proto.STATE_COMPLETE || status.ChainStatus != nil || status.Location != "" {
+		t.Errorf("status = %+v, expected COMPLETE without a chain status", status)
+	}
+}
+
+func TestReloadSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rm-specs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	api := NewAPI(&router.Router{}, newGrapher(t), newDispatcher(mock.NewJRClient()))
+	api.SpecsDir = dir
+	h := httptest.NewServer(api.Router)
+	defer h.Close()
+
+	do := func(method, path string) (int, []byte) {
+		req, _ := http.NewRequest(method, h.URL+API_ROOT+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	// A new request type, previewed, then reloaded
+	newSpecs := specs + `
+  drain-host:
+    request: true
+    nodes:
+      drain:
+        type: drain-host
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "restart.yaml"), []byte(newSpecs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"GET", "PUT"} {
+		path := "specs/diff"
+		if method == "PUT" {
+			path = "specs"
+		}
+		code, body := do(method, path)
+		if code != http.StatusOK {
+			t.Fatalf("%s %s: response status = %d, expected 200: %s", method, path, code, body)
+		}
+		var diff grapher.SpecsDiff
+		if err := json.Unmarshal(body, &diff); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(diff.Added, []string{"drain-host"}) || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+			t.Errorf("%s %s: diff = %+v, expected drain-host added", method, path, diff)
+		}
+		types := api.grapher.Specs().RequestTypes()
+		if reloaded := len(types) == 2; reloaded != (method == "PUT") {
+			t.Errorf("after %s %s: request types = %v", method, path, types)
+		}
+	}
+
+	// Invalid specs are not used
+	if err := ioutil.WriteFile(filepath.Join(dir, "restart.yaml"), []byte("sequences: {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := do("PUT", "specs"); code != http.StatusConflict {
+		t.Errorf("response status = %d, expected 409: %s", code, body)
+	}
+	if types := api.grapher.Specs().RequestTypes(); len(types) != 2 {
+		t.Errorf("request types = %v, expected the reloaded ones", types)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2017, Square, Inc.
+
+package dispatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoJobRunners is returned by a Discovery that finds no Job Runners.
+	ErrNoJobRunners = errors.New("no Job Runners found")
+)
+
+// A Discovery finds the Job Runners that the Request Manager can send job
+// chains to.
+type Discovery interface {
+	// JobRunners returns the base URLs of the Job Runners, like
+	// "http://jr1:9999", sorted.
+	JobRunners() ([]string, error)
+}
+
+// NewStatic returns a Discovery that always finds the Job Runners at the
+// base URLs.
+func NewStatic(urls []string) Discovery {
+	s := make(static, len(urls))
+	for i, u := range urls {
+		s[i] = strings.TrimSuffix(u, "/")
+	}
+	sort.Strings(s)
+	return s
+}
+
+type static []string
+
+func (s static) JobRunners() ([]string, error) {
+	if len(s) == 0 {
+		return nil, ErrNoJobRunners
+	}
+	return append([]string{}, s...), nil
+}
+
+// lookupSRV is net.LookupSRV, replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// NewDNS returns a Discovery that finds Job Runners by the DNS SRV records of
+// name, like "_spincycle-jr._tcp.example.com". Every record is a Job Runner at
+// its target and port, reached with scheme ("http" or "https").
+func NewDNS(name, scheme string) Discovery {
+	return dns{name: name, scheme: scheme}
+}
+
+type dns struct {
+	name   string
+	scheme string
+}
+
+func (d dns) JobRunners() ([]string, error) {
+	_, records, err := lookupSRV("", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrNoJobRunners
+	}
+	urls := make([]string, len(records))
+	for i, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		urls[i] = d.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(r.Port)))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// NewConsul returns a Discovery that finds Job Runners by the nodes of service
+// passing their health checks in the Consul catalog at addr (e.g.
+// "http://localhost:8500"). Every node is a Job Runner at the service's
+// address and port, reached with scheme ("http" or "https").
+func NewConsul(client *http.Client, addr, service, scheme string) Discovery {
+	return consul{client: client, addr: strings.TrimSuffix(addr, "/"), service: service, scheme: scheme}
+}
+
+type consul struct {
+	client  *http.Client
+	addr    string
+	service string
+	scheme  string
+}
+
+func (c consul) JobRunners() ([]string, error) {
+	q := url.Values{}
+	q.Set("passing", "1")
+	reqUrl := c.addr + "/v1/health/service/" + url.PathEscape(c.service) + "?" + q.Encode()
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string // the node's address if empty
+			Port    int
+		}
+	}
+	if err := getJSON(c.client, reqUrl, &entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNoJobRunners
+	}
+
+	urls := make([]string, len(entries))
+	for i, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		urls[i] = c.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// getJSON gets a URL and decodes the JSON response into v.
+func getJSON(client *http.Client, reqUrl string, v interface{}) error {
+	res, err := client.Get(reqUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d: %s", reqUrl, res.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("can't decode response from %s: %s", reqUrl, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2017, Square, Inc.
+
+package dispatch
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+func TestPick(t *testing.T) {
+	jrcs := map[string]*mock.JRClient{
+		"http://jr1": {HealthResp: proto.JobRunnerHealth{Ready: true, RunningChains: 5, QueuedChains: 1}},
+		"http://jr2": {HealthResp: proto.JobRunnerHealth{Ready: true, RunningChains: 2}},
+		"http://jr3": {HealthResp: proto.JobRunnerHealth{Ready: false, Problems: []string{"shutting down"}}},
+		"http://jr4": {HealthErr: mock.ErrJRClient},
+	}
+	d := NewDispatcher(NewStatic([]string{"http://jr4", "http://jr3/", "http://jr2", "http://jr1"}), func(url string) client.JRClient {
+		return jrcs[url]
+	})
+
+	jrs, err := d.JobRunners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jrs) != 4 || jrs[0].URL != "http://jr1" || jrs[0].Load() != 6 || jrs[3].Error == "" {
+		t.Errorf("job runners = %+v, expected jr1-4 sorted with their health", jrs)
+	}
+
+	// jr2 has the least load of the JRs that are ready
+	url, c, err := d.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "http://jr2" || c != jrcs["http://jr2"] {
+		t.Errorf("picked %s, expected http://jr2", url)
+	}
+
+	// With the same load, they take turns
+	jrcs["http://jr1"].HealthResp.RunningChains = 2
+	jrcs["http://jr1"].HealthResp.QueuedChains = 0
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		url, _, err := d.Pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, url)
+	}
+	expect := []string{"http://jr1", "http://jr1", "http://jr2", "http://jr1"}
+	if !reflect.DeepEqual(picked, expect) {
+		t.Errorf("picked %v, expected %v", picked, expect)
+	}
+
+	// jr1 is full, so jr2 gets every chain
+	jrcs["http://jr1"].HealthResp.MaxRunningChains = 2
+	jrcs["http://jr2"].HealthResp.MaxRunningChains = 3
+	for i := 0; i < 2; i++ {
+		if url, _, err := d.Pick(); err != nil || url != "http://jr2" {
+			t.Errorf("picked %s (error: %v), expected http://jr2", url, err)
+		}
+	}
+	if slots := d.Slots(); slots != 5 {
+		t.Errorf("slots = %d, expected 5", slots)
+	}
+	jrcs["http://jr2"].HealthResp.RunningChains = 3
+	if _, _, err := d.Pick(); err == nil {
+		t.Error("no error when every Job Runner is full")
+	}
+
+	// None ready
+	jrcs["http://jr1"].HealthResp.Ready = false
+	jrcs["http://jr2"].HealthResp.Ready = false
+	if _, _, err := d.Pick(); err == nil {
+		t.Error("no error when no Job Runner is ready")
+	}
+}
+
+func TestDNS(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_jr._tcp.example.com" {
+			return "", nil, fmt.Errorf("no such host %s", name)
+		}
+		return name, []*net.SRV{
+			{Target: "jr2.example.com.", Port: 9999},
+			{Target: "jr1.example.com.", Port: 9998},
+		}, nil
+	}
+
+	urls, err := NewDNS("_jr._tcp.example.com", "https").JobRunners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"https://jr1.example.com:9998", "https://jr2.example.com:9999"}
+	if !reflect.DeepEqual(urls, expect) {
+		t.Errorf("urls = %v, expected %v", urls, expect)
+	}
+	if _, err := NewDNS("_jr._tcp.example.org", "http").JobRunners(); err == nil {
+		t.Error("no error for a name without SRV records")
+	}
+}
+
+func TestConsul(t *testing.T) {
+	var query string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Path + "?" + r.URL.RawQuery
+		fmt.Fprintln(w, `[
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 9999}},
+			{"Node": {"Address": "10.0.0.3"}, "Service": {"Address": "10.0.1.1", "Port": 9999}}
+		]`)
+	}))
+	defer ts.Close()
+
+	urls, err := NewConsul(http.DefaultClient, ts.URL, "spincycle-jr", "http").JobRunners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "/v1/health/service/spincycle-jr?passing=1" {
+		t.Errorf("query = %s, expected /v1/health/service/spincycle-jr?passing=1", query)
+	}
+	expect := []string{"http://10.0.0.2:9999", "http://10.0.1.1:9999"}
+	if !reflect.DeepEqual(urls, expect) {
+		t.Errorf("urls = %v, expected %v", urls, expect)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2017, Square, Inc.
+
+// Package dispatch finds the Job Runners behind the Request Manager and picks
+// the least-loaded one for every job chain.
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+)
+
+// A JobRunner is a Job Runner found by a Discovery, with its health when it
+// was last checked.
+type JobRunner struct {
+	URL    string                `json:"url"`
+	Health proto.JobRunnerHealth `json:"health"`
+	Error  string                `json:"error,omitempty"` // why its health couldn't be checked
+}
+
+// Load is the number of chains running and queued on the Job Runner.
+func (jr JobRunner) Load() uint {
+	return jr.Health.RunningChains + jr.Health.QueuedChains
+}
+
+// Full returns true if the Job Runner limits how many chains run at once and
+// its load is at the limit, so a new chain would wait in its queue.
+func (jr JobRunner) Full() bool {
+	return jr.Health.MaxRunningChains > 0 && jr.Load() >= jr.Health.MaxRunningChains
+}
+
+// A Dispatcher picks the Job Runner to send a job chain to: the one with the
+// fewest chains running and queued (its load) among the Job Runners that are
+// ready and not full. Job Runners are found with a Discovery and their health is checked
+// every time one is picked, so Job Runners can come and go.
+type Dispatcher struct {
+	discovery Discovery
+	newClient func(url string) client.JRClient
+	// --
+	clients     map[string]client.JRClient // Job Runner URL => its client
+	picks       map[string]uint            // Job Runner URL => times picked
+	last        []JobRunner                // as of the last health checks
+	*sync.Mutex                            // guards clients, picks, and last
+}
+
+// NewDispatcher returns a Dispatcher for the Job Runners found by discovery.
+// newClient makes the client of a Job Runner given its base URL, like
+// client.NewJRClient.
+func NewDispatcher(discovery Discovery, newClient func(url string) client.JRClient) *Dispatcher {
+	return &Dispatcher{
+		discovery: discovery,
+		newClient: newClient,
+		clients:   map[string]client.JRClient{},
+		picks:     map[string]uint{},
+		Mutex:     &sync.Mutex{},
+	}
+}
+
+// Client returns the client of the Job Runner at the base URL, like the Job
+// Runner that a request was sent to.
+func (d *Dispatcher) Client(url string) client.JRClient {
+	d.Lock()
+	defer d.Unlock()
+	c, ok := d.clients[url]
+	if !ok {
+		c = d.newClient(url)
+		d.clients[url] = c
+	}
+	return c
+}
+
+// JobRunners returns the Job Runners found by the Discovery, with their
+// health checked now, sorted by URL.
+func (d *Dispatcher) JobRunners() ([]JobRunner, error) {
+	urls, err := d.discovery.JobRunners()
+	if err != nil {
+		return nil, fmt.Errorf("can't find Job Runners: %s", err)
+	}
+	jrs := make([]JobRunner, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			jrs[i].URL = url
+			health, err := d.Client(url).Health(context.Background())
+			if err != nil {
+				jrs[i].Error = err.Error()
+				return
+			}
+			jrs[i].Health = health
+		}(i, url)
+	}
+	wg.Wait()
+	d.Lock()
+	d.last = jrs
+	d.Unlock()
+	return jrs, nil
+}
+
+// Slots returns the number of chains that the ready Job Runners run at once,
+// as of their last health checks. It returns 0 if that's unknown: no Job
+// Runner is ready, or one has no limit.
+func (d *Dispatcher) Slots() uint {
+	d.Lock()
+	defer d.Unlock()
+	var slots uint
+	for _, jr := range d.last {
+		if jr.Error != "" || !jr.Health.Ready {
+			continue
+		}
+		if jr.Health.MaxRunningChains == 0 {
+			return 0
+		}
+		slots += jr.Health.MaxRunningChains
+	}
+	return slots
+}
+
+// Pick returns the URL and client of the least-loaded Job Runner that is
+// ready and not full. If more than one has the least load, the one picked the
+// fewest times is picked, so they take turns. It returns an error if no Job
+// Runner is ready and has room for another chain.
+func (d *Dispatcher) Pick() (string, client.JRClient, error) {
+	jrs, err := d.JobRunners()
+	if err != nil {
+		return "", nil, err
+	}
+
+	d.Lock()
+	var best *JobRunner
+	notReady := []string{}
+	for i, jr := range jrs {
+		if jr.Error != "" {
+			notReady = append(notReady, jr.URL+": "+jr.Error)
+			continue
+		}
+		if !jr.Health.Ready {
+			notReady = append(notReady, jr.URL+": not ready: "+strings.Join(jr.Health.Problems, ", "))
+			continue
+		}
+		if jr.Full() {
+			notReady = append(notReady, fmt.Sprintf("%s: full: %d of %d chains", jr.URL, jr.Load(), jr.Health.MaxRunningChains))
+			continue
+		}
+		if best == nil || jr.Load() < best.Load() || (jr.Load() == best.Load() && d.picks[jr.URL] < d.picks[best.URL]) {
+			best = &jrs[i]
+		}
+	}
+	if best != nil {
+		d.picks[best.URL]++
+	}
+	d.Unlock()
+
+	if best == nil {
+		return "", nil, fmt.Errorf("no Job Runner is ready and has room (%s)", strings.Join(notReady, "; "))
+	}
+	return best.URL, d.Client(best.URL), nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2017, Square, Inc.
+
+package grapher
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CHANGE_ADDED   = "added"
+	CHANGE_REMOVED = "removed"
+	CHANGE_CHANGED = "changed"
+)
+
+// A SpecsDiff is what changes between two sets of request specs, from the
+// point of view of callers: request types that are added or removed, and the
+// args and nodes of request types that change. A request type changes if a
+// sequence it includes changes, so the diff shows every request type that a
+// spec change affects.
+type SpecsDiff struct {
+	Added   []string      `json:"added"`   // request types, sorted
+	Removed []string      `json:"removed"` // request types, sorted
+	Changed []RequestDiff `json:"changed"` // sorted by request type
+}
+
+// Empty returns true if the specs make the same requests.
+func (d SpecsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// A RequestDiff is how a request type changes. Nodes are named like the jobs
+// of its chain, like "check/ping", and a node that includes a sequence is a
+// node too, like "check".
+type RequestDiff struct {
+	Type  string   `json:"type"`
+	Retry string   `json:"retry,omitempty"` // retries of the request's sequence, like "0 => 2", if they change
+	Args  []Change `json:"args,omitempty"`  // sorted by name
+	Nodes []Change `json:"nodes,omitempty"` // sorted by name
+}
+
+// A Change is an arg or node that's added, removed, or changed.
+type Change struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`           // CHANGE_* const
+	Detail string `json:"detail,omitempty"` // what it is or what changed, like "retry: 0 => 2; deps: [drain] => [drain check]"
+}
+
+// DiffSpecs returns what changes from the active specs to the next specs. Both
+// must be valid.
+func DiffSpecs(active, next *Specs) SpecsDiff {
+	diff := SpecsDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []RequestDiff{},
+	}
+	activeTypes := active.RequestTypes()
+	nextTypes := next.RequestTypes()
+	for _, name := range nextTypes {
+		if !contains(activeTypes, name) {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	for _, name := range activeTypes {
+		if !contains(nextTypes, name) {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+		a, n := active.Sequences[name], next.Sequences[name]
+		rd := RequestDiff{
+			Type:  name,
+			Args:  diffArgs(a.Args, n.Args),
+			Nodes: diffNodes(active.nodes(name), next.nodes(name)),
+		}
+		if a.Retry != n.Retry {
+			rd.Retry = fmt.Sprintf("%d => %d", a.Retry, n.Retry)
+		}
+		if rd.Retry != "" || len(rd.Args) > 0 || len(rd.Nodes) > 0 {
+			diff.Changed = append(diff.Changed, rd)
+		}
+	}
+	return diff
+}
+
+// -------------------------------------------------------------------------- //
+
+// flatNode is a node of a request type with what's needed to compare it.
+type flatNode struct {
+	What      string // "job <type>" or "sequence <name>"
+	Deps      []string
+	Args      []string // expected=given
+	Sets      []string
+	Retry     uint
+	RetryWait string
+	Timeout   string
+}
+
+// nodes returns the nodes of the sequence, and of the sequences it includes,
+// by the name of their job in the chain.
+func (s *Specs) nodes(name string) map[string]flatNode {
+	nodes := map[string]flatNode{}
+	s.flatten(s.Sequences[name], "", nodes)
+	return nodes
+}
+
+func (s *Specs) flatten(seq *SequenceSpec, prefix string, nodes map[string]flatNode) {
+	for _, node := range seq.Nodes {
+		fn := flatNode{
+			Deps:      sorted(node.Deps),
+			Sets:      sorted(node.Sets),
+			Retry:     node.Retry,
+			RetryWait: node.RetryWait,
+			Timeout:   node.Timeout,
+		}
+		for _, arg := range node.Args {
+			fn.Args = append(fn.Args, arg.Expected+"="+arg.Given)
+		}
+		sort.Strings(fn.Args)
+		name := prefix + node.Name
+		if node.Type != "" {
+			fn.What = "job " + node.Type
+		} else {
+			fn.What = "sequence " + node.Sequence
+			fn.Retry = s.Sequences[node.Sequence].Retry
+			s.flatten(s.Sequences[node.Sequence], name+"/", nodes)
+		}
+		nodes[name] = fn
+	}
+}
+
+// diffNodes returns the nodes that are added, removed, or changed.
+func diffNodes(active, next map[string]flatNode) []Change {
+	changes := []Change{}
+	for name, n := range next {
+		a, ok := active[name]
+		if !ok {
+			changes = append(changes, Change{Name: name, Change: CHANGE_ADDED, Detail: n.What})
+			continue
+		}
+		if detail := n.diff(a); detail != "" {
+			changes = append(changes, Change{Name: name, Change: CHANGE_CHANGED, Detail: detail})
+		}
+	}
+	for name, a := range active {
+		if _, ok := next[name]; !ok {
+			changes = append(changes, Change{Name: name, Change: CHANGE_REMOVED, Detail: a.What})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// diff describes what changes from node a to n, like `retry: 0 => 2; timeout:
+// "" => "10s"`. It returns "" if nothing changes.
+func (n flatNode) diff(a flatNode) string {
+	parts := []string{}
+	format := func(v interface{}) string {
+		if s, ok := v.(string); ok {
+			return strconv.Quote(s)
+		}
+		return fmt.Sprint(v)
+	}
+	add := func(field string, from, to interface{}) {
+		if !reflect.DeepEqual(from, to) {
+			parts = append(parts, field+": "+format(from)+" => "+format(to))
+		}
+	}
+	add("what", a.What, n.What)
+	add("deps", a.Deps, n.Deps)
+	add("args", a.Args, n.Args)
+	add("sets", a.Sets, n.Sets)
+	add("retry", a.Retry, n.Retry)
+	add("retryWait", a.RetryWait, n.RetryWait)
+	add("timeout", a.Timeout, n.Timeout)
+	return strings.Join(parts, "; ")
+}
+
+// diffArgs returns the args of a request type that are added, removed, or
+// changed: required or optional, or their default.
+func diffArgs(active, next SequenceArgs) []Change {
+	describe := func(args SequenceArgs) map[string]string {
+		m := map[string]string{}
+		for _, arg := range args.Required {
+			m[arg.Name] = "required"
+		}
+		for _, arg := range args.Optional {
+			m[arg.Name] = fmt.Sprintf("optional, default %q", arg.Default)
+		}
+		return m
+	}
+	a, n := describe(active), describe(next)
+	changes := []Change{}
+	for name, what := range n {
+		was, ok := a[name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Name: name, Change: CHANGE_ADDED, Detail: what})
+		case was != what:
+			changes = append(changes, Change{Name: name, Change: CHANGE_CHANGED, Detail: was + " => " + what})
+		}
+	}
+	for name, was := range a {
+		if _, ok := n[name]; !ok {
+			changes = append(changes, Change{Name: name, Change: CHANGE_REMOVED, Detail: was})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+func sorted(s []string) []string {
+	c := make([]string, len(s))
+	copy(c, s)
+	sort.Strings(c)
+	return c
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
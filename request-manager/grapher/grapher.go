@@ -0,0 +1,203 @@
+// Copyright 2017, Square, Inc.
+
+// Package grapher expands requests into job chains using the request specs.
+package grapher
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+)
+
+// A Grapher makes the job chain of a request from the request specs. Every
+// job in the chain is made with the job factory, created with its args
+// (job.Job.Create), and serialized (job.Job.Serialize), so the Job Runner can
+// deserialize and run it.
+type Grapher struct {
+	jobFactory job.Factory
+	// --
+	specs       *Specs
+	*sync.Mutex // guards specs
+}
+
+// NewGrapher returns a Grapher for specs, which must be valid (see
+// ReadSpecs).
+func NewGrapher(specs *Specs, jobFactory job.Factory) *Grapher {
+	return &Grapher{
+		jobFactory: jobFactory,
+		specs:      specs,
+		Mutex:      &sync.Mutex{},
+	}
+}
+
+// Specs returns the request specs.
+func (g *Grapher) Specs() *Specs {
+	g.Lock()
+	defer g.Unlock()
+	return g.specs
+}
+
+// SetSpecs replaces the request specs, which must be valid (see ReadSpecs).
+// Requests made from now on are expanded with them; chains already made
+// don't change.
+func (g *Grapher) SetSpecs(specs *Specs) {
+	g.Lock()
+	defer g.Unlock()
+	g.specs = specs
+}
+
+// CreateChain makes the job chain of a request: its request type is a
+// sequence in the specs with Request, and args are the sequence's args. Jobs
+// are named by their node, and jobs in an included sequence are prefixed by
+// the name of the node that includes it, like "check/ping". The chain must
+// have one first job and one last job.
+func (g *Grapher) CreateChain(requestId uint, requestType string, args map[string]string) (proto.JobChain, error) {
+	specs := g.Specs()
+	seq, ok := specs.Sequences[requestType]
+	if !ok || !seq.Request {
+		return proto.JobChain{}, fmt.Errorf("no request type %s", requestType)
+	}
+
+	jc := proto.JobChain{
+		RequestId:     requestId,
+		RequestType:   requestType,
+		Jobs:          map[string]proto.Job{},
+		AdjacencyList: map[string][]string{},
+		State:         proto.STATE_PENDING,
+	}
+	requestArgs := map[string]string{}
+	for k, v := range args {
+		requestArgs[k] = v
+	}
+	first, last, _, err := g.expand(specs, &jc, seq, "", requestArgs)
+	if err != nil {
+		return proto.JobChain{}, err
+	}
+	if len(first) != 1 || len(last) != 1 {
+		return proto.JobChain{}, fmt.Errorf("request %s has %d first jobs and %d last jobs, expected one of each",
+			requestType, len(first), len(last))
+	}
+	return jc, nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// expand adds the jobs of a sequence to the chain, given args, which it can
+// modify. prefix is prepended to the job names. It returns the first and last
+// jobs of the sequence, to connect the sequence to the nodes before and after
+// it, and its args after every node set its args.
+func (g *Grapher) expand(specs *Specs, jc *proto.JobChain, seq *SequenceSpec, prefix string, args map[string]string) ([]string, []string, map[string]string, error) {
+	for _, arg := range seq.Args.Required {
+		if _, ok := args[arg.Name]; !ok {
+			return nil, nil, nil, fmt.Errorf("sequence %s: required arg %s not given", seq.Name, arg.Name)
+		}
+	}
+	for _, arg := range seq.Args.Optional {
+		if _, ok := args[arg.Name]; !ok {
+			args[arg.Name] = arg.Default
+		}
+	}
+	if seq.Retry > 0 {
+		if _, ok := jc.SequenceRetries[seq.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("sequence %s has retries, so it can only be in a request once", seq.Name)
+		}
+		if jc.SequenceRetries == nil {
+			jc.SequenceRetries = map[string]uint{}
+		}
+		jc.SequenceRetries[seq.Name] = seq.Retry
+	}
+
+	order, err := seq.order()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	first := map[string][]string{} // node => its first jobs
+	last := map[string][]string{}  // node => its last jobs
+	hasNext := map[string]bool{}   // nodes that other nodes depend on
+	for _, node := range order {
+		nodeArgs := map[string]string{}
+		for k, v := range args {
+			nodeArgs[k] = v
+		}
+		for _, arg := range node.Args {
+			v, ok := args[arg.Given]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("sequence %s node %s: arg %s not given", seq.Name, node.Name, arg.Given)
+			}
+			nodeArgs[arg.Expected] = v
+		}
+
+		name := prefix + node.Name
+		if node.Type != "" {
+			j, err := g.createJob(seq, node, name, nodeArgs)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			jc.Jobs[name] = j
+			first[node.Name] = []string{name}
+			last[node.Name] = []string{name}
+		} else {
+			f, l, subArgs, err := g.expand(specs, jc, specs.Sequences[node.Sequence], name+"/", nodeArgs)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			first[node.Name], last[node.Name], nodeArgs = f, l, subArgs
+		}
+
+		for _, set := range node.Sets {
+			v, ok := nodeArgs[set]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("sequence %s node %s did not set arg %s", seq.Name, node.Name, set)
+			}
+			args[set] = v
+		}
+
+		for _, dep := range node.Deps {
+			hasNext[dep] = true
+			for _, from := range last[dep] {
+				jc.AdjacencyList[from] = append(jc.AdjacencyList[from], first[node.Name]...)
+			}
+		}
+	}
+
+	var seqFirst, seqLast []string
+	for _, node := range order {
+		if len(node.Deps) == 0 {
+			seqFirst = append(seqFirst, first[node.Name]...)
+		}
+		if !hasNext[node.Name] {
+			seqLast = append(seqLast, last[node.Name]...)
+		}
+	}
+	return seqFirst, seqLast, args, nil
+}
+
+// createJob makes, creates, and serializes the job of a node.
+func (g *Grapher) createJob(seq *SequenceSpec, node *NodeSpec, name string, args map[string]string) (proto.Job, error) {
+	j, err := g.jobFactory.Make(node.Type, name)
+	if err != nil {
+		return proto.Job{}, fmt.Errorf("sequence %s node %s: can't make job of type %s: %s", seq.Name, node.Name, node.Type, err)
+	}
+	if err := j.Create(args); err != nil {
+		return proto.Job{}, fmt.Errorf("sequence %s node %s: can't create job: %s", seq.Name, node.Name, err)
+	}
+	bytes, err := j.Serialize()
+	if err != nil {
+		return proto.Job{}, fmt.Errorf("sequence %s node %s: can't serialize job: %s", seq.Name, node.Name, err)
+	}
+	return proto.Job{
+		Name:      name,
+		Type:      node.Type,
+		Bytes:     bytes,
+		State:     proto.STATE_PENDING,
+		Sequence:  seq.Name,
+		Retry:     node.Retry,
+		RetryWait: node.RetryWait,
+		Timeout:   node.Timeout,
+
+		Mirrors:          node.Mirrors,
+		MirrorDivergence: node.MirrorDivergence,
+	}, nil
+}
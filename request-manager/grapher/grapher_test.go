@@ -0,0 +1,244 @@
+// Copyright 2017, Square, Inc.
+
+package grapher_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/square/spincycle/job"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/request-manager/grapher"
+	"github.com/square/spincycle/test/mock"
+)
+
+const specs = `
+sequences:
+  restart-host:
+    request: true
+    args:
+      required:
+        - name: host
+      optional:
+        - name: wait
+          default: 30s
+    nodes:
+      drain:
+        type: drain-host
+        args:
+          - expected: hostname
+            given: host
+        sets: [pool]
+        retry: 2
+        retryWait: 5s
+      reboot:
+        type: reboot-host
+        deps: [drain]
+      check:
+        sequence: check-host
+        deps: [reboot]
+  check-host:
+    retry: 1
+    args:
+      required:
+        - name: pool
+    nodes:
+      ping:
+        type: ping-host
+      rejoin:
+        type: rejoin-pool
+        deps: [ping]
+`
+
+func readSpecs(t *testing.T, files map[string]string) (*grapher.Specs, error) {
+	dir, err := ioutil.TempDir("", "grapher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return grapher.ReadSpecs(dir)
+}
+
+func TestCreateChain(t *testing.T) {
+	s, err := readSpecs(t, map[string]string{"restart.yaml": specs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := s.RequestTypes(); !reflect.DeepEqual(types, []string{"restart-host"}) {
+		t.Errorf("request types = %v, expected [restart-host]", types)
+	}
+
+	drain := &mock.Job{SerializeBytes: []byte("drain"), SetJobArgs: map[string]string{"pool": "p1"}}
+	rejoin := &mock.Job{}
+	jf := &mock.JobFactory{
+		JobToReturn:  &mock.Job{},
+		JobsToReturn: map[string]job.Job{"drain-host": drain, "rejoin-pool": rejoin},
+	}
+	g := grapher.NewGrapher(s, jf)
+
+	jc, err := g.CreateChain(5, "restart-host", map[string]string{"host": "h1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jc.RequestId != 5 || jc.RequestType != "restart-host" || len(jc.Jobs) != 4 {
+		t.Errorf("chain = %+v, expected request 5 restart-host with 4 jobs", jc)
+	}
+	expectAdj := map[string][]string{
+		"drain":      {"reboot"},
+		"reboot":     {"check/ping"},
+		"check/ping": {"check/rejoin"},
+	}
+	if !reflect.DeepEqual(jc.AdjacencyList, expectAdj) {
+		t.Errorf("adjacency list = %v, expected %v", jc.AdjacencyList, expectAdj)
+	}
+	expectJob := proto.Job{
+		Name:      "drain",
+		Type:      "drain-host",
+		Bytes:     []byte("drain"),
+		State:     proto.STATE_PENDING,
+		Sequence:  "restart-host",
+		Retry:     2,
+		RetryWait: "5s",
+	}
+	if !reflect.DeepEqual(jc.Jobs["drain"], expectJob) {
+		t.Errorf("drain job = %+v, expected %+v", jc.Jobs["drain"], expectJob)
+	}
+	if jc.Jobs["check/rejoin"].Sequence != "check-host" || !reflect.DeepEqual(jc.SequenceRetries, map[string]uint{"check-host": 1}) {
+		t.Errorf("check-host jobs or sequence retries wrong: %+v, %v", jc.Jobs["check/rejoin"], jc.SequenceRetries)
+	}
+
+	// The drain job gets the host as hostname and the default wait, and it
+	// sets the pool, which the included sequence requires.
+	expectArgs := map[string]string{"host": "h1", "hostname": "h1", "wait": "30s"}
+	if !reflect.DeepEqual(drain.CreateArgs, expectArgs) {
+		t.Errorf("drain args = %v, expected %v", drain.CreateArgs, expectArgs)
+	}
+	if rejoin.CreateArgs["pool"] != "p1" {
+		t.Errorf("rejoin args = %v, expected pool p1", rejoin.CreateArgs)
+	}
+
+	// Errors
+	if _, err := g.CreateChain(6, "restart-host", map[string]string{}); err == nil {
+		t.Error("no error without the required arg host")
+	}
+	if _, err := g.CreateChain(6, "check-host", map[string]string{"pool": "p1"}); err == nil {
+		t.Error("no error for a sequence that isn't a request")
+	}
+	drain.SetJobArgs = nil
+	if _, err := g.CreateChain(6, "restart-host", map[string]string{"host": "h1"}); err == nil {
+		t.Error("no error when the drain job doesn't set pool")
+	}
+}
+
+func TestReadSpecsInvalid(t *testing.T) {
+	invalid := map[string]string{
+		"type and sequence": `
+sequences:
+  a:
+    nodes:
+      n1: {type: t1, sequence: a}
+`,
+		"unknown dep": `
+sequences:
+  a:
+    nodes:
+      n1: {type: t1, deps: [n2]}
+`,
+		"dep cycle": `
+sequences:
+  a:
+    nodes:
+      n1: {type: t1, deps: [n2]}
+      n2: {type: t1, deps: [n1]}
+`,
+		"includes itself": `
+sequences:
+  a:
+    nodes:
+      n1: {sequence: b}
+  b:
+    nodes:
+      n1: {sequence: a}
+`,
+		"unknown field": `
+sequences:
+  a:
+    nodes:
+      n1: {type: t1, retries: 2}
+`,
+	}
+	for name, spec := range invalid {
+		if _, err := readSpecs(t, map[string]string{"spec.yaml": spec}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	// Sequence names are unique across files
+	_, err := readSpecs(t, map[string]string{"a.yaml": specs, "b.yaml": specs})
+	if err == nil || !strings.Contains(err.Error(), "already in another file") {
+		t.Errorf("err = %v, expected duplicate sequence error", err)
+	}
+}
+
+func TestDiffSpecs(t *testing.T) {
+	active, err := readSpecs(t, map[string]string{"restart.yaml": specs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := grapher.DiffSpecs(active, active); !diff.Empty() {
+		t.Errorf("diff of the same specs = %+v, expected empty", diff)
+	}
+
+	// The default of an arg changes, a job in an included sequence gets a
+	// timeout and is followed by a new job, and there's a new request type
+	next := strings.Replace(specs, "default: 30s", "default: 1m", 1)
+	next = strings.Replace(next, "type: ping-host", "type: ping-host\n        timeout: 10s", 1)
+	next = strings.Replace(next, "        deps: [ping]", "        deps: [ping]\n      log:\n        type: log-host\n        deps: [rejoin]", 1)
+	next += `
+  drain-host:
+    request: true
+    nodes:
+      drain:
+        type: drain-host
+`
+	s, err := readSpecs(t, map[string]string{"restart.yaml": next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := grapher.DiffSpecs(active, s)
+	expect := grapher.SpecsDiff{
+		Added:   []string{"drain-host"},
+		Removed: []string{},
+		Changed: []grapher.RequestDiff{
+			{
+				Type: "restart-host",
+				Args: []grapher.Change{
+					{Name: "wait", Change: grapher.CHANGE_CHANGED, Detail: `optional, default "30s" => optional, default "1m"`},
+				},
+				Nodes: []grapher.Change{
+					{Name: "check/log", Change: grapher.CHANGE_ADDED, Detail: "job log-host"},
+					{Name: "check/ping", Change: grapher.CHANGE_CHANGED, Detail: `timeout: "" => "10s"`},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(diff, expect) {
+		t.Errorf("diff = %+v, expected %+v", diff, expect)
+	}
+
+	// And back: the request type and job are removed
+	diff = grapher.DiffSpecs(s, active)
+	if !reflect.DeepEqual(diff.Removed, []string{"drain-host"}) || len(diff.Changed) != 1 ||
+		diff.Changed[0].Nodes[0] != (grapher.Change{Name: "check/log", Change: grapher.CHANGE_REMOVED, Detail: "job log-host"}) {
+		t.Errorf("diff = %+v, expected drain-host and check/log removed", diff)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017, Square, Inc.
+
+package grapher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Specs are the request specs: sequences of jobs that are expanded into job
+// chains. A sequence with Request is a request type that callers can make.
+// Sequences can include other sequences, so common steps are written once.
+//
+// In YAML, like:
+//
+//	sequences:
+//	  restart-host:
+//	    request: true
+//	    args:
+//	      required:
+//	        - name: host
+//	    nodes:
+//	      drain:
+//	        type: drain-host
+//	        args:
+//	          - expected: hostname
+//	            given: host
+//	        retry: 2
+//	        retryWait: 5s
+//	      reboot:
+//	        type: reboot-host
+//	        deps: [drain]
+//	      check:
+//	        sequence: check-host
+//	        deps: [reboot]
+type Specs struct {
+	Sequences map[string]*SequenceSpec `yaml:"sequences"` // sequence name => sequence
+}
+
+// A SequenceSpec is a sequence of jobs and other sequences (nodes), with the
+// args it needs.
+type SequenceSpec struct {
+	Name    string               `yaml:"-"`       // key in Specs.Sequences
+	Request bool                 `yaml:"request"` // callers can make a request of this type
+	Args    SequenceArgs         `yaml:"args"`
+	Retry   uint                 `yaml:"retry"` // JobChain.SequenceRetries
+	Nodes   map[string]*NodeSpec `yaml:"nodes"` // node name => node
+}
+
+// SequenceArgs are the args of a sequence. Required args must be given.
+// Optional args that aren't given have their default value.
+type SequenceArgs struct {
+	Required []*ArgSpec `yaml:"required"`
+	Optional []*ArgSpec `yaml:"optional"`
+}
+
+// An ArgSpec is one arg of a sequence.
+type ArgSpec struct {
+	Name    string `yaml:"name"`
+	Desc    string `yaml:"desc"`
+	Default string `yaml:"default"` // only for optional args
+}
+
+// A NodeSpec is a node in a sequence: either a job (Type) or another sequence
+// (Sequence). It runs after the nodes in Deps.
+type NodeSpec struct {
+	Name      string     `yaml:"-"`         // key in SequenceSpec.Nodes
+	Type      string     `yaml:"type"`      // job type
+	Sequence  string     `yaml:"sequence"`  // name of the sequence
+	Args      []*NodeArg `yaml:"args"`      // args given by another name
+	Sets      []string   `yaml:"sets"`      // args the node sets for the nodes after it
+	Deps      []string   `yaml:"deps"`      // nodes in the same sequence it runs after
+	Retry     uint       `yaml:"retry"`     // proto.Job.Retry
+	RetryWait string     `yaml:"retryWait"` // proto.Job.RetryWait
+	Timeout   string     `yaml:"timeout"`   // proto.Job.Timeout
+
+	Mirrors          uint   `yaml:"mirrors"`          // proto.Job.Mirrors
+	MirrorDivergence string `yaml:"mirrorDivergence"` // proto.Job.MirrorDivergence
+}
+
+// A NodeArg gives a node the arg Given of its sequence as the arg Expected.
+// A node is given every arg of its sequence by its own name, too.
+type NodeArg struct {
+	Expected string `yaml:"expected"`
+	Given    string `yaml:"given"`
+}
+
+// ReadSpecs reads the request specs in every .yaml file in dir and validates
+// them. Every sequence name must be unique across the files.
+func ReadSpecs(dir string) (*Specs, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no request specs (.yaml files) in %s", dir)
+	}
+	sort.Strings(files)
+
+	specs := &Specs{Sequences: map[string]*SequenceSpec{}}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var s Specs
+		if err := yaml.UnmarshalStrict(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid request spec %s: %s", file, err)
+		}
+		for name, seq := range s.Sequences {
+			if _, ok := specs.Sequences[name]; ok {
+				return nil, fmt.Errorf("invalid request spec %s: sequence %s is already in another file", file, name)
+			}
+			specs.Sequences[name] = seq
+		}
+	}
+	if err := specs.Validate(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// Validate sets the names of the sequences and nodes and returns an error if
+// the specs aren't valid: a node must be a job or a sequence that exists, and
+// the deps of the nodes and the sequences that include other sequences must
+// not have cycles.
+func (s *Specs) Validate() error {
+	if len(s.Sequences) == 0 {
+		return fmt.Errorf("no sequences in request specs")
+	}
+	for name, seq := range s.Sequences {
+		if seq == nil {
+			return fmt.Errorf("sequence %s is empty", name)
+		}
+		seq.Name = name
+		if len(seq.Nodes) == 0 {
+			return fmt.Errorf("sequence %s has no nodes", name)
+		}
+		for _, arg := range append(seq.Args.Required, seq.Args.Optional...) {
+			if arg == nil || arg.Name == "" {
+				return fmt.Errorf("sequence %s has an arg without a name", name)
+			}
+		}
+		for nodeName, node := range seq.Nodes {
+			if node == nil {
+				return fmt.Errorf("sequence %s node %s is empty", name, nodeName)
+			}
+			node.Name = nodeName
+			if (node.Type == "") == (node.Sequence == "") {
+				return fmt.Errorf("sequence %s node %s must have a type or a sequence, not both", name, nodeName)
+			}
+			if node.Sequence != "" {
+				if _, ok := s.Sequences[node.Sequence]; !ok {
+					return fmt.Errorf("sequence %s node %s: no sequence %s", name, nodeName, node.Sequence)
+				}
+			}
+			for _, arg := range node.Args {
+				if arg == nil || arg.Expected == "" || arg.Given == "" {
+					return fmt.Errorf("sequence %s node %s has an arg without expected and given names", name, nodeName)
+				}
+			}
+			for _, dep := range node.Deps {
+				if _, ok := seq.Nodes[dep]; !ok {
+					return fmt.Errorf("sequence %s node %s: no node %s to depend on", name, nodeName, dep)
+				}
+			}
+		}
+		if _, err := seq.order(); err != nil {
+			return err
+		}
+	}
+
+	// A sequence can't include itself, directly or not.
+	for name := range s.Sequences {
+		if err := s.checkIncludes(name, map[string]bool{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestTypes returns the names of the sequences that are requests, sorted.
+func (s *Specs) RequestTypes() []string {
+	types := []string{}
+	for name, seq := range s.Sequences {
+		if seq.Request {
+			types = append(types, name)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// -------------------------------------------------------------------------- //
+
+// checkIncludes returns an error if the sequence includes a sequence in
+// including, which are the sequences that include it.
+func (s *Specs) checkIncludes(name string, including map[string]bool) error {
+	if including[name] {
+		return fmt.Errorf("sequence %s includes itself", name)
+	}
+	including[name] = true
+	defer delete(including, name)
+	for _, node := range s.Sequences[name].Nodes {
+		if node.Sequence == "" {
+			continue
+		}
+		if err := s.checkIncludes(node.Sequence, including); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// order returns the nodes of the sequence in the order they're expanded: every
+// node after its deps, and nodes that can be in any order sorted by name. It
+// returns an error if the deps have a cycle.
+func (seq *SequenceSpec) order() ([]*NodeSpec, error) {
+	deps := map[string]int{}
+	next := map[string][]string{}
+	for name, node := range seq.Nodes {
+		deps[name] = len(node.Deps)
+		for _, dep := range node.Deps {
+			next[dep] = append(next[dep], name)
+		}
+	}
+	ready := []string{}
+	for name, n := range deps {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	order := []*NodeSpec{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, seq.Nodes[name])
+		for _, n := range next[name] {
+			deps[n]--
+			if deps[n] == 0 {
+				ready = append(ready, n)
+			}
+		}
+	}
+	if len(order) != len(seq.Nodes) {
+		return nil, fmt.Errorf("sequence %s: the deps of its nodes have a cycle", seq.Name)
+	}
+	return order, nil
+}
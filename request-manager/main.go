@@ -0,0 +1,136 @@
+// Copyright 2017, Square, Inc.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/square/spincycle/internal/router"
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/job/external"
+	"github.com/square/spincycle/request-manager/api"
+	"github.com/square/spincycle/request-manager/dispatch"
+	"github.com/square/spincycle/request-manager/grapher"
+	"github.com/square/spincycle/request-manager/status"
+)
+
+var (
+	addr            = flag.String("addr", ":8888", "Address to listen on")
+	specsDir        = flag.String("specs", "specs", "Directory of request specs (.yaml files)")
+	jrURLs          = flag.String("jr-url", "http://localhost:9999", "Comma-separated base URLs of the Job Runners that run job chains")
+	jrDNS           = flag.String("jr-dns", "", "Find Job Runners by the DNS SRV records of this name (e.g. _spincycle-jr._tcp.example.com) instead of -jr-url")
+	jrConsulAddr    = flag.String("jr-consul-addr", "", "Find Job Runners in the Consul catalog at this address instead of -jr-url")
+	jrConsulName    = flag.String("jr-consul-service", "spincycle-jr", "Consul service of the Job Runners (see -jr-consul-addr)")
+	jrScheme        = flag.String("jr-scheme", "http", "Scheme of the Job Runners found by -jr-dns or -jr-consul-addr: http or https")
+	rmURL           = flag.String("url", "", "Base URL of this Request Manager, which Job Runners call back when a job chain is done")
+	queueDir        = flag.String("queue-dir", "", "Save requests waiting for a Job Runner with room in this directory so they survive restarts")
+	queueInterval   = flag.Duration("queue-interval", 5*time.Second, "How often to send requests waiting for a Job Runner with room")
+	userQuota       = flag.Uint("user-quota", 0, "Max requests running at once per user, others wait in the queue, 0 = no limit")
+	callbackSecret  = flag.String("callback-secret", "", "Reject callbacks from Job Runners that aren't signed with this secret, their -callback-secret (default: $SPINCYCLE_CALLBACK_SECRET)")
+	insecureCB      = flag.Bool("insecure-callbacks", false, "Accept callbacks that aren't signed when -callback-secret isn't set, so anyone who can reach the RM can finish any request; for development only")
+	statusTTL       = flag.Duration("status-cache-ttl", status.DEFAULT_TTL, "How long the status of a request's job chain is cached before it's got from the Job Runner again, 0 = not cached")
+	jrToken         = flag.String("jr-token", "", "Authenticate to the Job Runners with this API token, their -operator-token (default: $SPINCYCLE_OPERATOR_TOKEN)")
+	automationToken = flag.String("automation-token", "", "API token of automation accounts, like chatops or a portal, which make requests on behalf of operators with the Spincycle-On-Behalf-Of header (default: $SPINCYCLE_AUTOMATION_TOKEN)")
+	logLevel        = flag.String("log-level", "info", "Log level: debug, info, warning, error, fatal, or panic")
+)
+
+func main() {
+	flag.Parse()
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logrus.SetLevel(level)
+
+	// Requests are expanded into job chains by the request specs. Jobs are
+	// made by the same job factory as the Job Runner's, so they serialize to
+	// what the Job Runner deserializes.
+	specs, err := grapher.ReadSpecs(*specsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g := grapher.NewGrapher(specs, external.JobFactory)
+	log.Printf("Request types: %s", strings.Join(specs.RequestTypes(), ", "))
+
+	// Find the Job Runners, and send every job chain to the least-loaded one,
+	// retrying if it's briefly unavailable
+	httpClient := client.NewHTTPClient(10*time.Second, nil)
+	var discovery dispatch.Discovery
+	switch {
+	case *jrDNS != "":
+		discovery = dispatch.NewDNS(*jrDNS, *jrScheme)
+	case *jrConsulAddr != "":
+		discovery = dispatch.NewConsul(httpClient, *jrConsulAddr, *jrConsulName, *jrScheme)
+	default:
+		discovery = dispatch.NewStatic(strings.Split(*jrURLs, ","))
+	}
+	retry := client.Retry{
+		Retries: 2,
+		Wait:    500 * time.Millisecond,
+		MaxWait: 5 * time.Second,
+	}
+	if *jrToken == "" {
+		*jrToken = os.Getenv("SPINCYCLE_OPERATOR_TOKEN")
+	}
+	jrHTTPClient := httpClient
+	if *jrToken != "" {
+		jrHTTPClient = client.WithToken(httpClient, *jrToken)
+	}
+	dispatcher := dispatch.NewDispatcher(discovery, func(url string) client.JRClient {
+		return client.NewJRClientWithRetry(jrHTTPClient, url, retry)
+	})
+
+	// Automation accounts, which have the automation token, make requests on
+	// behalf of operators. Requests record both.
+	rmRouter := &router.Router{Impersonator: router.RoleImpersonator{"automation"}}
+	if *automationToken == "" {
+		*automationToken = os.Getenv("SPINCYCLE_AUTOMATION_TOKEN")
+	}
+	if *automationToken != "" {
+		rmRouter.Authenticator = router.TokenAuthenticator{
+			*automationToken: {Name: "spincycle-automation", Roles: []string{"automation"}},
+		}
+	}
+
+	rmAPI := api.NewAPI(rmRouter, g, dispatcher)
+	rmAPI.URL = strings.TrimSuffix(*rmURL, "/")
+	rmAPI.SpecsDir = *specsDir
+
+	// Only JRs, which sign callbacks, finish requests
+	if *callbackSecret == "" {
+		*callbackSecret = os.Getenv("SPINCYCLE_CALLBACK_SECRET")
+	}
+	switch {
+	case *callbackSecret != "":
+		rmAPI.CallbackSecret = []byte(*callbackSecret)
+	case *insecureCB:
+		log.Printf("WARNING: callbacks aren't signed: anyone who can reach the RM can finish any request (-insecure-callbacks)")
+	default:
+		log.Fatal("-callback-secret or $SPINCYCLE_CALLBACK_SECRET is required, else anyone who can reach the RM can finish any request; use -insecure-callbacks to accept unsigned callbacks anyway")
+	}
+
+	// Requests wait in a queue while every JR is full or not ready, and are
+	// sent as JRs free up
+	rmAPI.SetUserQuota(*userQuota)
+	if *queueDir != "" {
+		n, err := rmAPI.RestoreQueue(*queueDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Restored %d queued requests", n)
+	}
+	go rmAPI.RunQueue(*queueInterval)
+
+	// The status of requests is got from the JRs that run their chains
+	rmAPI.SetStatusTTL(*statusTTL)
+
+	h := http.NewServeMux()
+	h.Handle("/api/", rmAPI.Router)
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
@@ -0,0 +1,180 @@
+// Copyright 2017, Square, Inc.
+
+// Package queue holds requests waiting to be sent to a Job Runner, because
+// every Job Runner is full or not ready, or their user has their quota of
+// requests running. If Dir is set, queued requests are saved in it, so they
+// survive restarts of the Request Manager.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/square/spincycle/proto"
+)
+
+// An Item is a queued request with its job chain, ready to be sent.
+type Item struct {
+	Request proto.Request  `json:"request"`
+	Chain   proto.JobChain `json:"chain"`
+}
+
+// A Queue orders requests by their priority (Request.Priority), highest first,
+// then by request ID, which is the order they were made.
+type Queue struct {
+	Dir string // where queued requests are saved, "" = not saved
+	// --
+	items       []Item
+	*sync.Mutex // guards items
+}
+
+// NewQueue returns an empty Queue.
+func NewQueue() *Queue {
+	return &Queue{
+		items: []Item{},
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Push adds a request to the queue, replacing it if it's already queued. It's
+// saved in Dir, if set, before it's added.
+func (q *Queue) Push(item Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if err := q.save(item); err != nil {
+		return err
+	}
+	q.remove(item.Request.Id)
+	i := sort.Search(len(q.items), func(i int) bool { return before(item, q.items[i]) })
+	q.items = append(q.items, Item{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = item
+	return nil
+}
+
+// Remove removes a request from the queue and Dir. It returns false if the
+// request isn't queued.
+func (q *Queue) Remove(requestId uint) bool {
+	q.Lock()
+	defer q.Unlock()
+	if !q.remove(requestId) {
+		return false
+	}
+	if q.Dir != "" {
+		os.Remove(q.file(requestId))
+	}
+	return true
+}
+
+// Position returns the position of a request in the queue, starting at 1 for
+// the next request. It returns 0 if the request isn't queued.
+func (q *Queue) Position(requestId uint) uint {
+	q.Lock()
+	defer q.Unlock()
+	for i, item := range q.items {
+		if item.Request.Id == requestId {
+			return uint(i + 1)
+		}
+	}
+	return 0
+}
+
+// Items returns a copy of the queued requests, in order.
+func (q *Queue) Items() []Item {
+	q.Lock()
+	defer q.Unlock()
+	items := make([]Item, len(q.items))
+	copy(items, q.items)
+	return items
+}
+
+// Len returns the number of queued requests.
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.items)
+}
+
+// Load returns the requests saved in Dir, sorted by request ID. It returns no
+// requests if Dir is not set or doesn't exist yet. The requests are not queued
+// until they're passed to Push.
+func (q *Queue) Load() ([]Item, error) {
+	items := []Item{}
+	if q.Dir == "" {
+		return items, nil
+	}
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return items, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		bytes, err := ioutil.ReadFile(filepath.Join(q.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var item Item
+		if err := json.Unmarshal(bytes, &item); err != nil {
+			return nil, fmt.Errorf("can't decode queued request %s: %s", f.Name(), err)
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Request.Id < items[j].Request.Id })
+	return items, nil
+}
+
+// -------------------------------------------------------------------------- //
+
+// before returns true if item a goes before item b in the queue.
+func before(a, b Item) bool {
+	if a.Request.Priority != b.Request.Priority {
+		return a.Request.Priority > b.Request.Priority
+	}
+	return a.Request.Id < b.Request.Id
+}
+
+// remove removes a request from items. The caller must hold the lock.
+func (q *Queue) remove(requestId uint) bool {
+	for i, item := range q.items {
+		if item.Request.Id == requestId {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the request to Dir, if set, replacing it atomically. The caller
+// must hold the lock.
+func (q *Queue) save(item Item) error {
+	if q.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	file := q.file(item.Request.Id)
+	if err := ioutil.WriteFile(file+".tmp", bytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func (q *Queue) file(requestId uint) string {
+	return filepath.Join(q.Dir, fmt.Sprintf("%d.json", requestId))
+}
@@ -0,0 +1,82 @@
+// Copyright 2017, Square, Inc.
+
+package queue_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/request-manager/queue"
+)
+
+func ids(items []queue.Item) []uint {
+	ids := []uint{}
+	for _, item := range items {
+		ids = append(ids, item.Request.Id)
+	}
+	return ids
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rm-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := queue.NewQueue()
+	q.Dir = dir
+	for _, req := range []proto.Request{
+		{Id: 3},
+		{Id: 1},
+		{Id: 4, Priority: 10},
+		{Id: 2, Priority: -1},
+		{Id: 5, Priority: 10},
+	} {
+		if err := q.Push(queue.Item{Request: req, Chain: proto.JobChain{RequestId: req.Id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Highest priority first, then in the order they were made
+	expect := []uint{4, 5, 1, 3, 2}
+	if got := ids(q.Items()); !reflect.DeepEqual(got, expect) {
+		t.Errorf("queue = %v, expected %v", got, expect)
+	}
+	if pos := q.Position(1); pos != 3 {
+		t.Errorf("position of 1 = %d, expected 3", pos)
+	}
+
+	if !q.Remove(5) {
+		t.Error("Remove returned false, expected true")
+	}
+	if q.Remove(5) {
+		t.Error("Remove returned true for a request that isn't queued")
+	}
+	if pos := q.Position(5); pos != 0 {
+		t.Errorf("position of removed request = %d, expected 0", pos)
+	}
+
+	// Another queue loads the saved requests, which it queues in order
+	q2 := queue.NewQueue()
+	q2.Dir = dir
+	items, err := q2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(items); !reflect.DeepEqual(got, []uint{1, 2, 3, 4}) {
+		t.Errorf("loaded %v, expected [1 2 3 4]", got)
+	}
+	for _, item := range items {
+		if item.Chain.RequestId != item.Request.Id {
+			t.Errorf("request %d loaded with chain %d", item.Request.Id, item.Chain.RequestId)
+		}
+		q2.Push(item)
+	}
+	if got := ids(q2.Items()); !reflect.DeepEqual(got, []uint{4, 1, 3, 2}) {
+		t.Errorf("queue = %v, expected [4 1 3 2]", got)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017, Square, Inc.
+
+// Package status tracks which Job Runner runs the job chain of every request
+// and gets the status of the chains from them, so the Request Manager has one
+// live view of requests spread across many Job Runners.
+package status
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+)
+
+const (
+	// DEFAULT_TTL is how long the status of a job chain is cached by default.
+	DEFAULT_TTL = 2 * time.Second
+
+	// MAX_STATUSES is the max number of chains whose status is got from a Job
+	// Runner in one call, the Job Runner's max (MAX_BULK_STATUS).
+	MAX_STATUSES = 100
+)
+
+// An Aggregator tracks the Job Runner that runs the job chain of every running
+// request and gets the status of the chains, many at once, from every Job
+// Runner at the same time. Statuses are cached for a TTL, so many callers
+// watching the same requests don't call the Job Runners more than once per TTL.
+// If a status can't be got, the last one is kept and marked stale.
+type Aggregator struct {
+	clientFor func(url string) client.JRClient
+	// --
+	ttl         time.Duration
+	chains      map[uint]*chain // request ID => its job chain
+	*sync.Mutex                 // guards ttl and chains
+}
+
+// chain is a job chain that's tracked, with its last status.
+type chain struct {
+	jrURL  string                // base URL of the Job Runner that runs it
+	status *proto.JobChainStatus // last status got, nil if none
+	asOf   time.Time             // when status was got
+	tried  time.Time             // when its status was last got or tried
+	err    string                // why the last try failed, "" if it didn't
+}
+
+// NewAggregator makes an Aggregator that gets statuses with the client of a
+// Job Runner given its base URL, like dispatch.Dispatcher.Client. Statuses are
+// cached for DEFAULT_TTL.
+func NewAggregator(clientFor func(url string) client.JRClient) *Aggregator {
+	return &Aggregator{
+		clientFor: clientFor,
+		ttl:       DEFAULT_TTL,
+		chains:    map[uint]*chain{},
+		Mutex:     &sync.Mutex{},
+	}
+}
+
+// SetTTL sets how long a status is cached. Zero means it's not cached: every
+// call gets it from the Job Runner.
+func (a *Aggregator) SetTTL(ttl time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.ttl = ttl
+}
+
+// Track records that the job chain of a request was started on the Job Runner
+// at the base URL sentTo, which responded with location, the Location header
+// of the start call (see client.JRClient.StartRequestLocation). The Job Runner
+// sets it to the host that runs the chain, so chains sent through a load
+// balancer are tracked at the Job Runner that runs them.
+func (a *Aggregator) Track(requestId uint, sentTo, location string) {
+	a.Lock()
+	defer a.Unlock()
+	a.chains[requestId] = &chain{jrURL: jobRunnerURL(sentTo, location)}
+}
+
+// Untrack stops tracking the job chain of a request, when it's done running.
+func (a *Aggregator) Untrack(requestId uint) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.chains, requestId)
+}
+
+// JobRunner returns the base URL of the Job Runner that runs the job chain of
+// a request, and false if the chain isn't tracked.
+func (a *Aggregator) JobRunner(requestId uint) (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+	c, ok := a.chains[requestId]
+	if !ok {
+		return "", false
+	}
+	return c.jrURL, true
+}
+
+// Status returns the live status of a request. See Statuses.
+func (a *Aggregator) Status(ctx context.Context, req proto.Request) proto.RequestStatus {
+	return a.Statuses(ctx, []proto.Request{req})[0]
+}
+
+// Statuses returns the live status of every request, in the same order. The
+// status of the job chains that are tracked and aren't cached, or whose cache
+// expired, is got from their Job Runners, all at once. Requests whose chain
+// isn't tracked, like queued requests and requests that are done, have no
+// chain status.
+func (a *Aggregator) Statuses(ctx context.Context, reqs []proto.Request) []proto.RequestStatus {
+	// Which chains to get the status of from which Job Runners
+	a.Lock()
+	now := time.Now()
+	get := map[string][]uint{} // Job Runner URL => request IDs
+	for _, req := range reqs {
+		c, ok := a.chains[req.Id]
+		if !ok || (!c.tried.IsZero() && now.Sub(c.tried) < a.ttl) {
+			continue
+		}
+		get[c.jrURL] = append(get[c.jrURL], req.Id)
+	}
+	a.Unlock()
+
+	var wg sync.WaitGroup
+	for jrURL, ids := range get {
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > MAX_STATUSES {
+				n = MAX_STATUSES
+			}
+			wg.Add(1)
+			go func(jrURL string, ids []uint) {
+				defer wg.Done()
+				a.get(ctx, jrURL, ids)
+			}(jrURL, ids[:n])
+			ids = ids[n:]
+		}
+	}
+	wg.Wait()
+
+	a.Lock()
+	defer a.Unlock()
+	now = time.Now()
+	statuses := make([]proto.RequestStatus, len(reqs))
+	for i, req := range reqs {
+		statuses[i].Request = req
+		c, ok := a.chains[req.Id]
+		if !ok {
+			continue
+		}
+		statuses[i].Location = fmt.Sprintf("%s/api/v1/job-chains/%d", c.jrURL, req.Id)
+		statuses[i].ChainStatus = c.status
+		statuses[i].Stale = c.err != ""
+		statuses[i].Error = c.err
+		if !c.asOf.IsZero() {
+			statuses[i].AsOf = c.asOf
+			statuses[i].Age = now.Sub(c.asOf).Round(time.Millisecond).String()
+		}
+	}
+	return statuses
+}
+
+// -------------------------------------------------------------------------- //
+
+// get gets the status of the job chains of the requests from the Job Runner,
+// and records them, or why they couldn't be got. A chain the Job Runner doesn't
+// have is done, but the request hasn't been called back yet.
+func (a *Aggregator) get(ctx context.Context, jrURL string, ids []uint) {
+	statuses, err := a.clientFor(jrURL).RequestStatuses(ctx, ids)
+	tried := time.Now()
+
+	a.Lock()
+	defer a.Unlock()
+	for _, id := range ids {
+		if c, ok := a.chains[id]; ok && c.jrURL == jrURL {
+			c.tried = tried
+			if err != nil {
+				c.err = fmt.Sprintf("can't get status from %s: %s", jrURL, err)
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	for i := range statuses.Statuses {
+		s := statuses.Statuses[i]
+		if c, ok := a.chains[s.RequestId]; ok && c.jrURL == jrURL {
+			c.status = &s
+			c.asOf = tried
+			c.err = ""
+		}
+	}
+	for _, id := range statuses.NotFound {
+		if c, ok := a.chains[id]; ok && c.jrURL == jrURL {
+			c.err = fmt.Sprintf("job chain is no longer running on %s", jrURL)
+		}
+	}
+}
+
+// jobRunnerURL returns the base URL of the Job Runner at location, the
+// Location header of the response to starting a chain on the Job Runner at
+// sentTo. The Job Runner's location is its hostname and the path of the chain,
+// like jr1/api/v1/job-chains/1, so the base URL has the scheme and port of
+// sentTo. If location is empty, it's sentTo.
+func jobRunnerURL(sentTo, location string) string {
+	if location == "" {
+		return sentTo
+	}
+	if u, err := url.Parse(location); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	u, err := url.Parse(sentTo)
+	if err != nil || u.Host == "" {
+		return sentTo
+	}
+	host := strings.SplitN(location, "/", 2)[0]
+	if host == "" {
+		return sentTo
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil && u.Port() != "" {
+		host = net.JoinHostPort(host, u.Port())
+	}
+	return u.Scheme + "://" + host
+}
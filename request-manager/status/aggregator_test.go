@@ -0,0 +1,117 @@
+// Copyright 2017, Square, Inc.
+
+package status
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+	"github.com/square/spincycle/test/mock"
+)
+
+// countingClient counts the calls to RequestStatuses.
+type countingClient struct {
+	*mock.JRClient
+	calls int
+}
+
+func (c *countingClient) RequestStatuses(ctx context.Context, requestIds []uint) (proto.JobChainStatuses, error) {
+	c.calls++
+	return c.JRClient.RequestStatuses(ctx, requestIds)
+}
+
+func TestJobRunnerURL(t *testing.T) {
+	tests := []struct {
+		sentTo, location, expect string
+	}{
+		{"http://jr-lb:9999", "", "http://jr-lb:9999"},
+		{"http://jr-lb:9999", "jr1/api/v1/job-chains/1", "http://jr1:9999"},
+		{"https://jr-lb", "jr1/api/v1/job-chains/1", "https://jr1"},
+		{"http://jr-lb:9999", "jr1:8888/api/v1/job-chains/1", "http://jr1:8888"},
+		{"http://jr-lb:9999", "https://jr1:7777/api/v1/job-chains/1", "https://jr1:7777"},
+		{"http://jr-lb:9999", "/api/v1/job-chains/1", "http://jr-lb:9999"},
+	}
+	for _, test := range tests {
+		if got := jobRunnerURL(test.sentTo, test.location); got != test.expect {
+			t.Errorf("jobRunnerURL(%s, %s) = %s, expected %s", test.sentTo, test.location, got, test.expect)
+		}
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	jrcs := map[string]*countingClient{
+		"http://jr1:9999": {JRClient: &mock.JRClient{
+			StatusesResp: proto.JobChainStatuses{
+				Statuses: []proto.JobChainStatus{{RequestId: 1, JobStatuses: proto.JobStatuses{{Name: "drain"}}}},
+				NotFound: []uint{3},
+			},
+		}},
+		"http://jr2:9999": {JRClient: &mock.JRClient{
+			StatusesResp: proto.JobChainStatuses{
+				Statuses: []proto.JobChainStatus{{RequestId: 2, JobStatuses: proto.JobStatuses{{Name: "reboot"}}}},
+			},
+		}},
+	}
+	a := NewAggregator(func(url string) client.JRClient { return jrcs[url] })
+	a.SetTTL(time.Hour)
+
+	// Sent through a load balancer, and run by the Job Runners in the
+	// Location of the start calls
+	a.Track(1, "http://jr-lb:9999", "jr1/api/v1/job-chains/1")
+	a.Track(2, "http://jr-lb:9999", "jr2/api/v1/job-chains/2")
+	a.Track(3, "http://jr-lb:9999", "jr1/api/v1/job-chains/3")
+	if jr, ok := a.JobRunner(2); !ok || jr != "http://jr2:9999" {
+		t.Errorf("JobRunner(2) = %s, %t, expected http://jr2:9999", jr, ok)
+	}
+
+	reqs := []proto.Request{
+		{Id: 1, State: proto.STATE_RUNNING},
+		{Id: 2, State: proto.STATE_RUNNING},
+		{Id: 3, State: proto.STATE_RUNNING},
+		{Id: 4, State: proto.STATE_PENDING}, // queued, not tracked
+	}
+	statuses := a.Statuses(context.Background(), reqs)
+	if len(statuses) != 4 {
+		t.Fatalf("got %d statuses, expected 4", len(statuses))
+	}
+	s1, s2, s3, s4 := statuses[0], statuses[1], statuses[2], statuses[3]
+	if s1.Id != 1 || s1.ChainStatus == nil || s1.ChainStatus.JobStatuses[0].Name != "drain" || s1.Stale || s1.AsOf.IsZero() ||
+		s1.Location != "http://jr1:9999/api/v1/job-chains/1" {
+		t.Errorf("status 1 = %+v, expected drain running on jr1", s1)
+	}
+	if s2.Id != 2 || s2.ChainStatus == nil || s2.ChainStatus.JobStatuses[0].Name != "reboot" || s2.Stale {
+		t.Errorf("status 2 = %+v, expected reboot running on jr2", s2)
+	}
+	if s3.Id != 3 || s3.ChainStatus != nil || !s3.Stale || s3.Error == "" {
+		t.Errorf("status 3 = %+v, expected stale, no longer running on jr1", s3)
+	}
+	if s4.Id != 4 || s4.ChainStatus != nil || s4.Stale || s4.Location != "" {
+		t.Errorf("status 4 = %+v, expected only the request", s4)
+	}
+	if jrcs["http://jr1:9999"].calls != 1 || jrcs["http://jr2:9999"].calls != 1 {
+		t.Errorf("calls = %d and %d, expected 1 call per Job Runner", jrcs["http://jr1:9999"].calls, jrcs["http://jr2:9999"].calls)
+	}
+
+	// Cached
+	a.Statuses(context.Background(), reqs)
+	if jrcs["http://jr1:9999"].calls != 1 || jrcs["http://jr2:9999"].calls != 1 {
+		t.Errorf("calls = %d and %d, expected statuses cached", jrcs["http://jr1:9999"].calls, jrcs["http://jr2:9999"].calls)
+	}
+
+	// When the cache expires and a Job Runner can't be reached, its last
+	// status is kept, marked stale
+	a.SetTTL(0)
+	jrcs["http://jr1:9999"].StatusesErr = mock.ErrJRClient
+	s1 = a.Status(context.Background(), reqs[0])
+	if s1.ChainStatus == nil || s1.ChainStatus.JobStatuses[0].Name != "drain" || !s1.Stale || s1.Error == "" {
+		t.Errorf("status 1 = %+v, expected the last status, stale", s1)
+	}
+
+	a.Untrack(1)
+	if s1 = a.Status(context.Background(), reqs[0]); s1.ChainStatus != nil || s1.Location != "" {
+		t.Errorf("status 1 = %+v, expected only the request after it was untracked", s1)
+	}
+}
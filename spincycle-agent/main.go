@@ -0,0 +1,156 @@
+// Copyright 2017, Square, Inc.
+
+// spincycle-agent runs jobs for a Job Runner on the host it runs on. It asks
+// the Job Runner for jobs in its pool (proto.Job.Agent), runs them, and sends
+// their status, log output, and final state back. Agents run the same job
+// factory as the Job Runner (job/external), so both must be built with the same
+// jobs.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/square/spincycle/job-runner/agent"
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/job-runner/payload"
+	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/job/external"
+	"github.com/square/spincycle/job/plugin"
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	jrURL      = flag.String("jr-url", "http://localhost:9999", "Base URL of the Job Runner")
+	name       = flag.String("name", "", "Unique name of the agent (default: hostname)")
+	pool       = flag.String("pool", "", "Pool of agents that this agent runs jobs for (required)")
+	token      = flag.String("token", "", "API token sent to the Job Runner (default: $SPINCYCLE_AGENT_TOKEN)")
+	caFile     = flag.String("ca", "", "CA certificate file to verify the Job Runner's certificate")
+	maxJobs    = flag.Uint("max-jobs", 1, "Max jobs running at once")
+	stopGrace  = flag.Duration("stop-grace", 10*time.Second, "On shutdown, max time to wait for running jobs to stop")
+	updateKey  = flag.String("update-key", "", "Base64 ed25519 public key to verify upgrades offered by the Job Runner; if not set, the agent never upgrades itself")
+	compress   = flag.Bool("compress", false, "Compress work and updates sent to and from the Job Runner with gzip, if it supports it")
+	payloadKey = flag.String("payload-key", "", "Base64 32-byte key to encrypt work and updates with AES-256-GCM; the Job Runner must have the same key for the pool (default: $SPINCYCLE_AGENT_PAYLOAD_KEY)")
+	jobPlugins = flag.String("job-plugins", "", "Comma-separated Go plugins (.so) and directories of executables with more job types")
+)
+
+func main() {
+	flag.Parse()
+
+	if *pool == "" {
+		log.Fatal("-pool is required")
+	}
+	if *name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		*name = hostname
+	}
+	if *token == "" {
+		*token = os.Getenv("SPINCYCLE_AGENT_TOKEN")
+	}
+
+	var tlsConfig *tls.Config
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates in %s", *caFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: caPool}
+	}
+
+	// Compress and encrypt work and updates, independent of TLS, e.g. on slow
+	// links between datacenters
+	codec := payload.Codec{Gzip: *compress}
+	if *payloadKey == "" {
+		*payloadKey = os.Getenv("SPINCYCLE_AGENT_PAYLOAD_KEY")
+	}
+	if *payloadKey != "" {
+		c, err := payload.ParseKey(*payloadKey)
+		if err != nil {
+			log.Fatalf("invalid -payload-key: %s", err)
+		}
+		codec.Cipher = c
+	}
+
+	// Requests for work wait up to 30s (the worker's default), so the client
+	// timeout must be longer than that
+	httpClient := client.NewHTTPClient(time.Minute, tlsConfig)
+	jr := client.NewAgentClientWithPayload(httpClient, *jrURL, *token, codec)
+
+	// Jobs are made like the Job Runner makes them, so load the same plugins.
+	// Arg references are not resolved: the Job Runner sends jobs as-is.
+	jobFactory := plugin.Factories{external.JobFactory}
+	if *jobPlugins != "" {
+		loaded, err := plugin.Load(strings.Split(*jobPlugins, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		jobFactory = append(jobFactory, loaded...)
+	}
+	rf := runner.NewRunnerFactory(jobFactory, nil, nil, nil, nil, nil)
+
+	a := proto.Agent{
+		Name:    *name,
+		Pool:    *pool,
+		Version: agent.VERSION,
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+	}
+	worker := agent.NewWorker(a, jr, rf)
+	worker.MaxJobs = *maxJobs
+	worker.StopGrace = *stopGrace
+
+	// Upgrade to signed binaries offered by the Job Runner, replacing this
+	// binary, then restart
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *updateKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*updateKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Fatalf("invalid -update-key: expected a base64 ed25519 public key")
+		}
+		worker.Upgrade = func(u proto.AgentUpgrade) error {
+			bin, err := jr.Download(u.Path)
+			if err != nil {
+				return err
+			}
+			return agent.Install(bin, u.Signature, ed25519.PublicKey(key), exe)
+		}
+	}
+
+	stopChan := make(chan struct{})
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+		log.Printf("Stopping, waiting up to %s for running jobs", *stopGrace)
+		close(stopChan)
+	}()
+
+	log.Printf("Agent %s running jobs in pool %s for %s", *name, *pool, *jrURL)
+	if worker.Run(stopChan) {
+		log.Printf("Upgraded, restarting")
+		if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017, Square, Inc.
+
+package mock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/square/spincycle/job-runner/schedule"
+)
+
+// Clock is a schedule.Clock that only moves when it's told to. Like the real
+// clock, timers measure elapsed time, not the wall clock, so the wall clock
+// can be changed with Jump without moving timers.
+type Clock struct {
+	// --
+	now         time.Time     // wall clock
+	elapsed     time.Duration // since the clock was made
+	timers      []*clockTimer
+	*sync.Mutex // guards now, elapsed, and timers
+}
+
+type clockTimer struct {
+	c       *Clock
+	at      time.Duration // elapsed time when it fires
+	f       func()
+	stopped bool
+}
+
+// NewClock returns a Clock whose wall clock is now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now:    now,
+		timers: []*clockTimer{},
+		Mutex:  &sync.Mutex{},
+	}
+}
+
+func (c *Clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// AfterFunc runs f when the clock is advanced by d, or, if d is not positive,
+// now in its own goroutine.
+func (c *Clock) AfterFunc(d time.Duration, f func()) schedule.Timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &clockTimer{c: c, at: c.elapsed + d, f: f}
+	if d <= 0 {
+		t.stopped = true
+		go f()
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and runs the funcs of the timers that
+// fire, in order, in the caller's goroutine.
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	end := c.elapsed + d
+	c.Unlock()
+	for {
+		c.Lock()
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at < c.timers[j].at })
+		if len(c.timers) == 0 || c.timers[0].at > end {
+			c.now = c.now.Add(end - c.elapsed)
+			c.elapsed = end
+			c.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = c.now.Add(t.at - c.elapsed)
+		c.elapsed = t.at
+		t.stopped = true
+		c.Unlock()
+		t.f()
+	}
+}
+
+// Jump changes the wall clock by d, forward or back, without moving timers,
+// like the system clock being set.
+func (c *Clock) Jump(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Timers returns the number of timers that haven't fired or been stopped.
+func (c *Clock) Timers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+func (t *clockTimer) Stop() bool {
+	c := t.c
+	c.Lock()
+	defer c.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	for i, ct := range c.timers {
+		if ct == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
@@ -5,7 +5,9 @@ package mock
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"time"
 
 	"github.com/square/spincycle/job"
 	"github.com/square/spincycle/proto"
@@ -15,17 +17,72 @@ var (
 	ErrJob = errors.New("forced error in job")
 )
 
+var _ job.Factory = (*JobFactory)(nil)
+
 type JobFactory struct {
-	JobToReturn job.Job
-	MakeErr     error
+	JobToReturn     job.Job
+	JobsToReturn    map[string]job.Job // Returned by Make for these job types instead of JobToReturn.
+	MakeErr         error
+	WarmupsToReturn map[string]job.Warmup // Returned by Warmups.
+	DocsToReturn    map[string]job.Doc    // Returned by Docs.
+	TypesToReturn   []string              // Returned by Types.
 }
 
 func (f *JobFactory) Make(jobType, jobName string) (job.Job, error) {
+	if j, ok := f.JobsToReturn[jobType]; ok {
+		return j, f.MakeErr
+	}
 	return f.JobToReturn, f.MakeErr
 }
 
+func (f *JobFactory) Warmups() map[string]job.Warmup {
+	return f.WarmupsToReturn
+}
+
+func (f *JobFactory) Docs() map[string]job.Doc {
+	return f.DocsToReturn
+}
+
+func (f *JobFactory) Types() []string {
+	return f.TypesToReturn
+}
+
+type Warmup struct {
+	WarmErr   error
+	HealthErr error
+	CloseErr  error
+	Warmed    bool // true after Warm is called
+	Closed    bool // true after Close is called
+}
+
+func (w *Warmup) Warm() error {
+	w.Warmed = true
+	return w.WarmErr
+}
+
+func (w *Warmup) Health() error {
+	return w.HealthErr
+}
+
+func (w *Warmup) Close() error {
+	w.Closed = true
+	return w.CloseErr
+}
+
+var (
+	_ job.Job              = (*Job)(nil)
+	_ job.Logger           = (*Job)(nil)
+	_ job.ArgsSetter       = (*Job)(nil)
+	_ job.ContextSetter    = (*Job)(nil)
+	_ job.ProgressReporter = (*Job)(nil)
+	_ job.Heartbeater      = (*Job)(nil)
+	_ job.ArtifactProducer = (*Job)(nil)
+)
+
 type Job struct {
 	CreateErr      error
+	CreateArgs     map[string]string // Copy of the jobArgs given to Create.
+	SetJobArgs     map[string]string // Set in the jobArgs by Create.
 	SerializeBytes []byte
 	SerializeErr   error
 	DeserializeErr error
@@ -33,13 +90,31 @@ type Job struct {
 	RunErr         error
 	AddedJobData   map[string]interface{} // Data to add to jobData.
 	RunBlock       chan struct{}          // Channel that job.Run() will block on, if defined.
+	LogOutput      string                 // Output written to the log set by SetLog, if any.
+	ProgressOutput []uint                 // Percents reported to the func set by SetProgress, if any.
+	HeartbeatEvery time.Duration          // How often job.Run() calls the func set by SetHeartbeat while blocked on RunBlock, 0 = never.
+	SetArgsErr     error
+	Args           map[string]string // Args given to SetArgs.
+	Context        job.Context       // Given to SetContext.
+	ArtifactsResp  []job.Artifact    // Returned by Artifacts.
 	StopErr        error
 	StatusResp     string
 	NameResp       string
 	TypeResp       string
+	// --
+	log       io.Writer
+	progress  func(uint)
+	heartbeat func()
 }
 
 func (j *Job) Create(jobArgs map[string]string) error {
+	j.CreateArgs = map[string]string{}
+	for k, v := range jobArgs {
+		j.CreateArgs[k] = v
+	}
+	for k, v := range j.SetJobArgs {
+		jobArgs[k] = v
+	}
 	return j.CreateErr
 }
 
@@ -52,8 +127,16 @@ func (j *Job) Deserialize(jobArgs []byte) error {
 }
 
 func (j *Job) Run(jobData map[string]interface{}) (job.Return, error) {
+	if j.log != nil && j.LogOutput != "" {
+		io.WriteString(j.log, j.LogOutput)
+	}
+	if j.progress != nil {
+		for _, percent := range j.ProgressOutput {
+			j.progress(percent)
+		}
+	}
 	if j.RunBlock != nil {
-		<-j.RunBlock
+		j.block()
 	}
 	// Add job data.
 	for k, v := range j.AddedJobData {
@@ -70,6 +153,49 @@ func (j *Job) Status() string {
 	return j.StatusResp
 }
 
+func (j *Job) SetLog(w io.Writer) {
+	j.log = w
+}
+
+func (j *Job) SetArgs(args map[string]string) error {
+	j.Args = args
+	return j.SetArgsErr
+}
+
+func (j *Job) SetContext(ctx job.Context) {
+	j.Context = ctx
+}
+
+func (j *Job) SetProgress(f func(uint)) {
+	j.progress = f
+}
+
+func (j *Job) SetHeartbeat(f func()) {
+	j.heartbeat = f
+}
+
+func (j *Job) Artifacts() []job.Artifact {
+	return j.ArtifactsResp
+}
+
+// block blocks on RunBlock, sending heartbeats every HeartbeatEvery.
+func (j *Job) block() {
+	if j.heartbeat == nil || j.HeartbeatEvery <= 0 {
+		<-j.RunBlock
+		return
+	}
+	ticker := time.NewTicker(j.HeartbeatEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.RunBlock:
+			return
+		case <-ticker.C:
+			j.heartbeat()
+		}
+	}
+}
+
 func (j *Job) Name() string {
 	return j.NameResp
 }
@@ -0,0 +1,123 @@
+// Copyright 2017, Square, Inc.
+
+package mock
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/square/spincycle/job-runner/client"
+	"github.com/square/spincycle/proto"
+)
+
+var (
+	ErrJRClient = errors.New("forced error in jr client")
+)
+
+var _ client.JRClient = (*JRClient)(nil)
+
+type JRClient struct {
+	NewJobChainErr  error
+	NewJobChainsErr error
+	StartErr        error
+	Location        string // returned by StartRequestLocation
+	StopErr         error
+	StatusResp      *proto.JobChainStatus
+	StatusErr       error
+	StatusesResp    proto.JobChainStatuses
+	StatusesErr     error
+	HealthResp      proto.JobRunnerHealth
+	HealthErr       error
+	// --
+	chains      []proto.JobChain // sent by NewJobChain and NewJobChains
+	started     []uint           // request IDs given to StartRequest
+	stopped     []uint           // request IDs given to StopRequest
+	*sync.Mutex                  // guards chains, started, and stopped
+}
+
+func NewJRClient() *JRClient {
+	return &JRClient{Mutex: &sync.Mutex{}}
+}
+
+func (c *JRClient) NewJobChain(ctx context.Context, jc proto.JobChain) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.NewJobChainErr == nil {
+		c.chains = append(c.chains, jc)
+	}
+	return c.NewJobChainErr
+}
+
+// NewJobChains adds every chain in the batch, unless NewJobChainsErr is set.
+func (c *JRClient) NewJobChains(ctx context.Context, batch proto.JobChainBatch) (proto.JobChainBatchResult, error) {
+	c.Lock()
+	defer c.Unlock()
+	result := proto.JobChainBatchResult{Mode: batch.Mode}
+	if c.NewJobChainsErr != nil {
+		return result, c.NewJobChainsErr
+	}
+	for _, jc := range batch.Chains {
+		c.chains = append(c.chains, jc)
+		result.Results = append(result.Results, proto.AddedJobChain{RequestId: jc.RequestId, Accepted: true})
+	}
+	return result, nil
+}
+
+func (c *JRClient) StartRequest(ctx context.Context, requestId uint) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.StartErr == nil {
+		c.started = append(c.started, requestId)
+	}
+	return c.StartErr
+}
+
+func (c *JRClient) StartRequestLocation(ctx context.Context, requestId uint) (string, error) {
+	if err := c.StartRequest(ctx, requestId); err != nil {
+		return "", err
+	}
+	return c.Location, nil
+}
+
+func (c *JRClient) StopRequest(ctx context.Context, requestId uint) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.StopErr == nil {
+		c.stopped = append(c.stopped, requestId)
+	}
+	return c.StopErr
+}
+
+func (c *JRClient) RequestStatus(ctx context.Context, requestId uint) (*proto.JobChainStatus, error) {
+	return c.StatusResp, c.StatusErr
+}
+
+func (c *JRClient) RequestStatuses(ctx context.Context, requestIds []uint) (proto.JobChainStatuses, error) {
+	return c.StatusesResp, c.StatusesErr
+}
+
+func (c *JRClient) Health(ctx context.Context) (proto.JobRunnerHealth, error) {
+	return c.HealthResp, c.HealthErr
+}
+
+// Chains returns the job chains sent by NewJobChain and NewJobChains.
+func (c *JRClient) Chains() []proto.JobChain {
+	c.Lock()
+	defer c.Unlock()
+	return append([]proto.JobChain{}, c.chains...)
+}
+
+// Started returns the request IDs started by StartRequest.
+func (c *JRClient) Started() []uint {
+	c.Lock()
+	defer c.Unlock()
+	return append([]uint{}, c.started...)
+}
+
+// Stopped returns the request IDs stopped by StopRequest.
+func (c *JRClient) Stopped() []uint {
+	c.Lock()
+	defer c.Unlock()
+	return append([]uint{}, c.stopped...)
+}
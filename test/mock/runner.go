@@ -5,32 +5,53 @@ package mock
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/square/spincycle/job-runner/runner"
+	"github.com/square/spincycle/proto"
 )
 
 var (
 	ErrRunner = errors.New("forced error in runner")
 )
 
+var (
+	_ runner.RunnerFactory = (*RunnerFactory)(nil)
+	_ runner.Runner        = (*Runner)(nil)
+	_ runner.Checkpointer  = (*Runner)(nil)
+	_ runner.Coster        = (*Runner)(nil)
+)
+
 type RunnerFactory struct {
 	RunnersToReturn map[string]*Runner // Keyed on job name.
 	MakeErr         error
 }
 
-func (f *RunnerFactory) Make(jobType, jobName string, jobBytes []byte, requestId uint) (runner.Runner, error) {
-	return f.RunnersToReturn[jobName], f.MakeErr
+func (f *RunnerFactory) Make(job proto.Job, requestId uint) (runner.Runner, error) {
+	return f.RunnersToReturn[job.Name], f.MakeErr
 }
 
 type Runner struct {
+	FailRuns     int  // Number of times Run fails before returning runCompleted.
+	FailState    byte // State that Run returns when it fails, default STATE_FAIL.
+	StopState    byte // State that Run returns when stopped, default STATE_STOPPED.
+	ProgressResp int  // Percent done that Progress returns.
+
+	CheckpointResp map[string]interface{} // jobData that Checkpoint returns, nil = can't checkpoint
+
+	EstimatedCostResp float64 // cost that EstimatedCost returns, 0 = no cost
+	ActualCostResp    float64 // cost that ActualCost returns
+	// --
 	runCompleted bool
 	statusResp   string
 	runBlock     chan struct{}          // Channel that Runner.Run() will block on, if defined.
 	stopChan     chan struct{}          // Channel used to stop a blocked Runner.Run().
 	jobData      map[string]interface{} // The jobData that this runner will set.
+	log          *runner.Log
 	// --
 	running     bool // true when Run is running
-	*sync.Mutex      // guards running
+	runs        int  // number of times Run has been called
+	*sync.Mutex      // guards running and runs
 }
 
 func NewRunner(runCompleted bool, statusResp string, runBlock, stopChan chan struct{}, jobData map[string]interface{}) *Runner {
@@ -40,14 +61,17 @@ func NewRunner(runCompleted bool, statusResp string, runBlock, stopChan chan str
 		runBlock:     runBlock,
 		stopChan:     stopChan,
 		jobData:      jobData,
+		log:          runner.NewLog(),
 		running:      false,
 		Mutex:        &sync.Mutex{},
 	}
 }
 
-func (r *Runner) Run(jobData map[string]interface{}) bool {
+func (r *Runner) Run(jobData map[string]interface{}) byte {
 	r.Lock() // -- lock
 	r.running = true
+	r.runs++
+	runs := r.runs
 	r.Unlock() // -- unlock
 
 	// Set the jobData
@@ -63,16 +87,25 @@ func (r *Runner) Run(jobData map[string]interface{}) bool {
 				// stop running when the runblock channel is closed
 				break LOOP
 			case <-r.stopChan:
-				return false
+				if r.StopState != 0 {
+					return r.StopState
+				}
+				return proto.STATE_STOPPED
 			}
 		}
 	} else if r.runBlock != nil {
 		<-r.runBlock
 	}
-	return r.runCompleted
+	if runs > r.FailRuns && r.runCompleted {
+		return proto.STATE_COMPLETE
+	}
+	if r.FailState != 0 {
+		return r.FailState
+	}
+	return proto.STATE_FAIL
 }
 
-func (r *Runner) Stop() error {
+func (r *Runner) Stop(grace time.Duration) error {
 	return nil
 }
 
@@ -80,8 +113,34 @@ func (r *Runner) Status() string {
 	return r.statusResp
 }
 
+func (r *Runner) Progress() int {
+	return r.ProgressResp
+}
+
+func (r *Runner) Log() *runner.Log {
+	return r.log
+}
+
+func (r *Runner) Checkpoint() (map[string]interface{}, bool) {
+	return r.CheckpointResp, r.CheckpointResp != nil
+}
+
+func (r *Runner) EstimatedCost() (float64, bool) {
+	return r.EstimatedCostResp, r.EstimatedCostResp != 0
+}
+
+func (r *Runner) ActualCost() float64 {
+	return r.ActualCostResp
+}
+
 func (r *Runner) Running() bool {
 	r.Lock()         // -- lock
 	defer r.Unlock() // -- unlock
 	return r.running
 }
+
+func (r *Runner) Runs() int {
+	r.Lock()         // -- lock
+	defer r.Unlock() // -- unlock
+	return r.runs
+}
@@ -3,24 +3,68 @@
 package mock
 
 import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/square/spincycle/job-runner/runner"
 	"github.com/square/spincycle/proto"
 )
 
+var (
+	ErrTraverser = errors.New("forced error in traverser")
+)
+
 type Traverser struct {
-	RunErr     error
-	StopErr    error
-	StatusResp proto.JobChainStatus
-	StatusErr  error
+	RunErr      error
+	StopErr     error
+	StopGrace   time.Duration  // Grace period given to Stop.
+	StopInfo    proto.StopInfo // Who stopped the chain and why, given to Stop.
+	SuspendResp proto.SuspendedJobChain
+	StatusResp  proto.JobChainStatus
+	StatusErr   error
+	LogResp     *runner.Log
+	LogErr      error
+	ExplainResp proto.JobExplanation
+	ExplainErr  error
+	Events      chan proto.JobChainEvent // Returned by Subscribe, if defined.
+	RecoverResp proto.SuspendedJobChain
+	RecoverErr  error
 }
 
 func (t *Traverser) Run() error {
 	return t.RunErr
 }
 
-func (t *Traverser) Stop() error {
+func (t *Traverser) Stop(grace time.Duration, stop proto.StopInfo) error {
+	t.StopGrace = grace
+	t.StopInfo = stop
 	return t.StopErr
 }
 
-func (t *Traverser) Status() (proto.JobChainStatus, error) {
+func (t *Traverser) Suspend() proto.SuspendedJobChain {
+	return t.SuspendResp
+}
+
+func (t *Traverser) Status(ctx context.Context) (proto.JobChainStatus, error) {
 	return t.StatusResp, t.StatusErr
 }
+
+func (t *Traverser) Log(jobName string, try uint) (*runner.Log, error) {
+	return t.LogResp, t.LogErr
+}
+
+func (t *Traverser) Explain(jobName string) (proto.JobExplanation, error) {
+	return t.ExplainResp, t.ExplainErr
+}
+
+func (t *Traverser) Subscribe() (<-chan proto.JobChainEvent, func()) {
+	if t.Events == nil {
+		t.Events = make(chan proto.JobChainEvent)
+	}
+	return t.Events, func() {}
+}
+
+func (t *Traverser) Recover() (proto.SuspendedJobChain, error) {
+	return t.RecoverResp, t.RecoverErr
+}
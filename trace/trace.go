@@ -0,0 +1,178 @@
+// Copyright 2017, Square, Inc.
+
+// Package trace propagates distributed trace context through job chains and
+// jobs, and records spans. A request is traced across the Request Manager, the
+// Job Runner, and jobs: the trace context comes in on API requests as a W3C
+// traceparent header (or OpenTracing ot-tracer-* headers), is attached to the
+// job chain, and each chain and job run is a span in the trace. Spans are
+// given to a Tracer, which operators implement to export them to their
+// tracing system.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	ErrInvalidTraceparent = errors.New("invalid traceparent")
+)
+
+// A SpanContext identifies a span in a trace.
+type SpanContext struct {
+	TraceId string // 32 lowercase hex characters
+	SpanId  string // 16 lowercase hex characters
+	Sampled bool
+}
+
+// Valid returns true if the span context has a trace and span ID.
+func (sc SpanContext) Valid() bool {
+	return len(sc.TraceId) == 32 && len(sc.SpanId) == 16
+}
+
+// Traceparent returns the span context as a W3C traceparent, like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". It returns an
+// empty string if the span context is not valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.Valid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceId, sc.SpanId, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent.
+func ParseTraceparent(s string) (SpanContext, error) {
+	p := strings.Split(strings.TrimSpace(s), "-")
+	if len(p) < 4 || len(p[0]) != 2 || p[0] == "ff" || (p[0] == "00" && len(p) != 4) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if !isHex(p[1], 32) || !isHex(p[2], 16) || !isHex(p[3], 2) || isZero(p[1]) || isZero(p[2]) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	flags, _ := hex.DecodeString(p[3])
+	return SpanContext{
+		TraceId: p[1],
+		SpanId:  p[2],
+		Sampled: flags[0]&1 == 1,
+	}, nil
+}
+
+// FromHeaders returns the span context in HTTP headers: a W3C traceparent, or
+// OpenTracing ot-tracer-traceid, ot-tracer-spanid, and ot-tracer-sampled. It
+// returns false if the headers don't have a valid span context.
+func FromHeaders(h http.Header) (SpanContext, bool) {
+	if tp := h.Get("traceparent"); tp != "" {
+		sc, err := ParseTraceparent(tp)
+		return sc, err == nil
+	}
+	traceId := strings.ToLower(h.Get("ot-tracer-traceid"))
+	spanId := strings.ToLower(h.Get("ot-tracer-spanid"))
+	if len(traceId) == 16 {
+		traceId = strings.Repeat("0", 16) + traceId // 64-bit trace ID
+	}
+	if !isHex(traceId, 32) || !isHex(spanId, 16) || isZero(traceId) || isZero(spanId) {
+		return SpanContext{}, false
+	}
+	return SpanContext{
+		TraceId: traceId,
+		SpanId:  spanId,
+		Sampled: h.Get("ot-tracer-sampled") == "true" || h.Get("ot-tracer-sampled") == "1",
+	}, true
+}
+
+// --------------------------------------------------------------------------
+
+// A Span is one operation in a trace, like running a job chain or one try of
+// a job.
+type Span struct {
+	Name       string
+	Context    SpanContext
+	ParentId   string // span ID of the parent span, empty if it's the root
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+}
+
+// StartSpan starts a span that is a child of parent. If parent is not valid,
+// the span is the root of a new trace, which is sampled.
+func StartSpan(name string, parent SpanContext) *Span {
+	s := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+	if parent.Valid() {
+		s.Context = SpanContext{TraceId: parent.TraceId, SpanId: newId(8), Sampled: parent.Sampled}
+		s.ParentId = parent.SpanId
+	} else {
+		s.Context = SpanContext{TraceId: newId(16), SpanId: newId(8), Sampled: true}
+	}
+	return s
+}
+
+// Finish ends the span and gives it to the tracer if the span is sampled.
+func (s *Span) Finish(t Tracer) {
+	s.End = time.Now()
+	if s.Context.Sampled && t != nil {
+		t.Record(*s)
+	}
+}
+
+// A Tracer records finished spans, e.g. by exporting them to a tracing system.
+// Record must not block for long because it's called when jobs finish.
+type Tracer interface {
+	Record(Span)
+}
+
+// Nop is a Tracer that does nothing with spans.
+type Nop struct{}
+
+func (Nop) Record(Span) {}
+
+// LogTracer is a Tracer that logs spans.
+type LogTracer struct{}
+
+func (LogTracer) Record(s Span) {
+	log.Infof("Span %s (trace=%s span=%s parent=%s start=%s duration=%s): %v", s.Name, s.Context.TraceId,
+		s.Context.SpanId, s.ParentId, s.Start.Format(time.RFC3339Nano), s.End.Sub(s.Start), s.Attributes)
+}
+
+// --------------------------------------------------------------------------
+
+// newId returns n random bytes hex-encoded, never all zeros.
+func newId(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		if id := hex.EncodeToString(b); !isZero(id) {
+			return id
+		}
+	}
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
@@ -0,0 +1,100 @@
+// Copyright 2017, Square, Inc.
+
+package trace_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/square/spincycle/trace"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := trace.ParseTraceparent(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanId != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("span context = %+v", sc)
+	}
+	if sc.Traceparent() != tp {
+		t.Errorf("traceparent = %s, expected %s", sc.Traceparent(), tp)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",        // no flags
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",     // zero trace ID
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",     // zero span ID
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",     // uppercase
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",     // invalid version
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz", // extra field in version 00
+	} {
+		if _, err := trace.ParseTraceparent(bad); err != trace.ErrInvalidTraceparent {
+			t.Errorf("%q: err = %v, expected %s", bad, err, trace.ErrInvalidTraceparent)
+		}
+	}
+}
+
+func TestFromHeaders(t *testing.T) {
+	h := http.Header{}
+	if _, ok := trace.FromHeaders(h); ok {
+		t.Error("got a span context from no headers")
+	}
+
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	sc, ok := trace.FromHeaders(h)
+	if !ok || sc.SpanId != "00f067aa0ba902b7" || sc.Sampled {
+		t.Errorf("got %+v, %t, expected the traceparent, not sampled", sc, ok)
+	}
+
+	// OpenTracing headers with a 64-bit trace ID
+	h = http.Header{}
+	h.Set("ot-tracer-traceid", "A3CE929D0E0E4736")
+	h.Set("ot-tracer-spanid", "00f067aa0ba902b7")
+	h.Set("ot-tracer-sampled", "true")
+	sc, ok = trace.FromHeaders(h)
+	if !ok || sc.TraceId != "0000000000000000a3ce929d0e0e4736" || !sc.Sampled {
+		t.Errorf("got %+v, %t, expected the OpenTracing context", sc, ok)
+	}
+}
+
+type recorder []trace.Span
+
+func (r *recorder) Record(s trace.Span) {
+	*r = append(*r, s)
+}
+
+func TestStartSpan(t *testing.T) {
+	// No parent: a new, sampled trace
+	root := trace.StartSpan("chain", trace.SpanContext{})
+	if !root.Context.Valid() || root.ParentId != "" || !root.Context.Sampled {
+		t.Errorf("root span = %+v, expected a new trace", root)
+	}
+
+	child := trace.StartSpan("job", root.Context)
+	if child.Context.TraceId != root.Context.TraceId || child.ParentId != root.Context.SpanId {
+		t.Errorf("child span = %+v, expected a child of %+v", child, root.Context)
+	}
+	if child.Context.SpanId == root.Context.SpanId {
+		t.Error("child has the same span ID as its parent")
+	}
+
+	r := &recorder{}
+	child.Finish(r)
+	root.Finish(r)
+	if len(*r) != 2 || (*r)[0].Name != "job" || (*r)[1].Name != "chain" {
+		t.Errorf("recorded %+v, expected job and chain spans", *r)
+	}
+	if (*r)[0].End.Before((*r)[0].Start) {
+		t.Error("span ends before it starts")
+	}
+
+	// Spans in a trace that isn't sampled aren't recorded
+	notSampled := trace.SpanContext{TraceId: root.Context.TraceId, SpanId: root.Context.SpanId}
+	trace.StartSpan("job", notSampled).Finish(r)
+	if len(*r) != 2 {
+		t.Errorf("recorded %d spans, expected 2", len(*r))
+	}
+}